@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"go.uber.org/zap"
 
@@ -75,8 +76,11 @@ type App struct {
 	// namespaces.
 	Subscriptions []*Subscription `json:"subscriptions,omitempty"`
 
-	// Map of event name to map of module ID/namespace to handlers
-	subscriptions map[string]map[caddy.ModuleID][]Handler
+	// Map of event name to map of module ID/namespace to handlers,
+	// guarded by subscriptionsMu: Off may remove bindings while the
+	// app is live and other goroutines are emitting.
+	subscriptions   map[string]map[caddy.ModuleID][]Handler
+	subscriptionsMu sync.RWMutex
 
 	logger  *zap.Logger
 	started bool
@@ -176,6 +180,9 @@ func (app *App) Subscribe(s *Subscription) error {
 		s.Modules = []caddy.ModuleID{""}
 	}
 
+	app.subscriptionsMu.Lock()
+	defer app.subscriptionsMu.Unlock()
+
 	for _, eventName := range s.Events {
 		if app.subscriptions[eventName] == nil {
 			app.subscriptions[eventName] = make(map[caddy.ModuleID][]Handler)
@@ -198,6 +205,33 @@ func (app *App) On(eventName string, handler Handler) error {
 	})
 }
 
+// Off removes a handler previously bound with On (or Subscribe) from
+// the named event, across all module scopes. Handlers are matched by
+// interface identity, so the same value that was passed to On must be
+// passed here, and its dynamic type must be comparable (handlers are
+// typically pointers, which always are; a non-comparable type would
+// panic the comparison). Unlike Subscribe, removal is permitted after
+// the app has started: modules deregister during their cleanup phase,
+// which runs while the app is still live.
+func (app *App) Off(eventName string, handler Handler) {
+	app.subscriptionsMu.Lock()
+	defer app.subscriptionsMu.Unlock()
+
+	for originModule, handlers := range app.subscriptions[eventName] {
+		remaining := make([]Handler, 0, len(handlers))
+		for _, h := range handlers {
+			if h != handler {
+				remaining = append(remaining, h)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(app.subscriptions[eventName], originModule)
+		} else {
+			app.subscriptions[eventName][originModule] = remaining
+		}
+	}
+}
+
 // Emit creates and dispatches an event named eventName to all relevant handlers with
 // the metadata data. Events are emitted and propagated synchronously. The returned Event
 // value will have any additional information from the invoked handlers.
@@ -270,11 +304,12 @@ func (app *App) Emit(ctx caddy.Context, eventName string, data map[string]any) c
 
 		// implement propagation up the module tree (i.e. start with "a.b.c" then "a.b" then "a" then "")
 		for {
-			if app.subscriptions[eventName] == nil {
+			handlers, eventBound := app.handlersFor(eventName, moduleID)
+			if !eventBound {
 				break // shortcut if event not bound at all
 			}
 
-			for _, handler := range app.subscriptions[eventName][moduleID] {
+			for _, handler := range handlers {
 				select {
 				case <-ctx.Done():
 					logger.Error("context canceled; event handling stopped")
@@ -323,6 +358,21 @@ func (app *App) Emit(ctx caddy.Context, eventName string, data map[string]any) c
 	return e
 }
 
+// handlersFor returns a snapshot of the handlers bound to eventName for
+// the given module scope, and reports whether the event is bound at all.
+// Emit invokes handlers from the snapshot rather than under the lock,
+// so a handler that itself calls Off (or emits another event) cannot
+// deadlock, and a concurrent Off cannot race the invocation loop.
+func (app *App) handlersFor(eventName string, moduleID caddy.ModuleID) ([]Handler, bool) {
+	app.subscriptionsMu.RLock()
+	defer app.subscriptionsMu.RUnlock()
+	eventSubs, ok := app.subscriptions[eventName]
+	if !ok {
+		return nil, false
+	}
+	return append([]Handler(nil), eventSubs[moduleID]...), true
+}
+
 // Handler is a type that can handle events.
 type Handler interface {
 	Handle(context.Context, caddy.Event) error
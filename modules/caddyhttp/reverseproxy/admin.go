@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 )
@@ -37,6 +39,11 @@ type upstreamStatus struct {
 	Address     string `json:"address"`
 	NumRequests int    `json:"num_requests"`
 	Fails       int    `json:"fails"`
+
+	// Whether the host is inside a rate-limit backoff window
+	// (see UpstreamBackoff), and how much of it is left.
+	InBackoff        bool    `json:"in_backoff,omitempty"`
+	BackoffRemaining float64 `json:"backoff_remaining_seconds,omitempty"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -47,14 +54,501 @@ func (adminUpstreams) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// Routes returns a route for the /reverse_proxy/upstreams endpoint.
+// Routes returns the routes for the reverse proxy admin endpoints.
 func (al adminUpstreams) Routes() []caddy.AdminRoute {
 	return []caddy.AdminRoute{
 		{
 			Pattern: "/reverse_proxy/upstreams",
 			Handler: caddy.AdminHandlerFunc(al.handleUpstreams),
 		},
+		{
+			Pattern: "/reverse_proxy/selection/preview",
+			Handler: caddy.AdminHandlerFunc(al.handleSelectionPreview),
+		},
+		{
+			Pattern: "/reverse_proxy/selection/health",
+			Handler: caddy.AdminHandlerFunc(al.handleSelectionHealth),
+		},
+		{
+			Pattern: "/reverse_proxy/selection/simulate_removal",
+			Handler: caddy.AdminHandlerFunc(al.handleSimulateRemoval),
+		},
+		{
+			Pattern: "/reverse_proxy/selection/trace",
+			Handler: caddy.AdminHandlerFunc(al.handleSelectionTrace),
+		},
+		{
+			Pattern: "/reverse_proxy/selection/topology",
+			Handler: caddy.AdminHandlerFunc(al.handleSelectionTopology),
+		},
+		{
+			Pattern: "/reverse_proxy/selection/overrides",
+			Handler: caddy.AdminHandlerFunc(al.handleSelectionOverrides),
+		},
+	}
+}
+
+// selectionPreviewEntry pairs a provisioned selection policy with the
+// static upstream pool of the handler that owns it, so the preview
+// endpoint can explain selections without a live request.
+type selectionPreviewEntry struct {
+	policy Selector
+	pool   UpstreamPool
+}
+
+// selectionPreviews indexes provisioned selection policies by their
+// module name (e.g. "memento"). When several handlers use the same
+// policy type, the most recently provisioned one wins; this registry
+// exists for debugging, not for routing.
+var (
+	selectionPreviews   = make(map[string]selectionPreviewEntry)
+	selectionPreviewsMu sync.RWMutex
+)
+
+// registerSelectionPreview makes a provisioned selection policy
+// available to the preview endpoint under the given id.
+func registerSelectionPreview(id string, policy Selector, pool UpstreamPool) {
+	selectionPreviewsMu.Lock()
+	defer selectionPreviewsMu.Unlock()
+	selectionPreviews[id] = selectionPreviewEntry{policy: policy, pool: pool}
+}
+
+// unregisterSelectionPreview removes the entry for id, but only if it
+// still refers to the given policy, so a handler being cleaned up does
+// not remove its replacement's registration.
+func unregisterSelectionPreview(id string, policy Selector) {
+	selectionPreviewsMu.Lock()
+	defer selectionPreviewsMu.Unlock()
+	if entry, ok := selectionPreviews[id]; ok && entry.policy == policy {
+		delete(selectionPreviews, id)
+	}
+}
+
+// handleSelectionPreview explains which upstream a key maps to for a
+// provisioned hashing-based selection policy. Expects ?policy=<id>&key=<value>.
+func (adminUpstreams) handleSelectionPreview(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	policyID := r.URL.Query().Get("policy")
+	key := r.URL.Query().Get("key")
+	if policyID == "" || key == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("both 'policy' and 'key' query parameters are required"),
+		}
+	}
+
+	selectionPreviewsMu.RLock()
+	entry, ok := selectionPreviews[policyID]
+	selectionPreviewsMu.RUnlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no provisioned selection policy named '%s'", policyID),
+		}
+	}
+
+	previewer, ok := entry.policy.(Previewer)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("selection policy '%s' is not hashing-based and does not support previews", policyID),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(previewer.Preview(entry.pool, key))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	return nil
+}
+
+// healthDebounceReporter is implemented by selection policies that
+// debounce health events before mutating their topology and can report
+// the per-node debounce counters.
+type healthDebounceReporter interface {
+	healthDebounceCounters() []debounceCounters
+}
+
+// handleSelectionHealth reports the health-event debounce counters of a
+// provisioned selection policy. Expects ?policy=<id>.
+func (adminUpstreams) handleSelectionHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	policyID := r.URL.Query().Get("policy")
+	if policyID == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("the 'policy' query parameter is required"),
+		}
+	}
+
+	selectionPreviewsMu.RLock()
+	entry, ok := selectionPreviews[policyID]
+	selectionPreviewsMu.RUnlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no provisioned selection policy named '%s'", policyID),
+		}
+	}
+
+	reporter, ok := entry.policy.(healthDebounceReporter)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("selection policy '%s' does not debounce health events", policyID),
+		}
 	}
+
+	counters := reporter.healthDebounceCounters()
+	if counters == nil {
+		counters = []debounceCounters{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(counters)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	return nil
+}
+
+// handleSelectionTrace dumps the sampled selection trace buffer of a
+// provisioned selection policy. Expects ?policy=<id>; the policy must
+// have trace_sample_rate configured.
+func (adminUpstreams) handleSelectionTrace(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	policyID := r.URL.Query().Get("policy")
+	if policyID == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("the 'policy' query parameter is required"),
+		}
+	}
+
+	selectionPreviewsMu.RLock()
+	entry, ok := selectionPreviews[policyID]
+	selectionPreviewsMu.RUnlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no provisioned selection policy named '%s'", policyID),
+		}
+	}
+
+	reporter, ok := entry.policy.(selectionTraceReporter)
+	var trace []selectionTraceEntry
+	if ok {
+		var enabled bool
+		trace, enabled = reporter.selectionTraceSnapshot()
+		ok = enabled
+	}
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("selection policy '%s' does not have trace sampling configured", policyID),
+		}
+	}
+	if trace == nil {
+		trace = []selectionTraceEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(trace); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	return nil
+}
+
+// handleSelectionTopology reports the tracked topology of a provisioned
+// selection policy: per-node membership metadata (when it joined, how
+// often it flapped, the last event applied) and an estimated key share
+// computed by sampling synthetic keys through the engine. Expects
+// ?policy=<id>.
+func (adminUpstreams) handleSelectionTopology(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	policyID := r.URL.Query().Get("policy")
+	if policyID == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("the 'policy' query parameter is required"),
+		}
+	}
+
+	selectionPreviewsMu.RLock()
+	entry, ok := selectionPreviews[policyID]
+	selectionPreviewsMu.RUnlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no provisioned selection policy named '%s'", policyID),
+		}
+	}
+
+	reporter, ok := entry.policy.(topologyReporter)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("selection policy '%s' does not track its own topology", policyID),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reporter.topologyStatus()); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	return nil
+}
+
+// overrideSetRequest is the body of a request installing a manual
+// routing override.
+type overrideSetRequest struct {
+	// The registered name of the selection policy (e.g. "memento").
+	Policy string `json:"policy"`
+
+	// The hash key to pin.
+	Key string `json:"key"`
+
+	// The dial address of the upstream the key must route to.
+	Upstream string `json:"upstream"`
+
+	// How long the override lasts. Zero or omitted means it never
+	// expires.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+// handleSelectionOverrides manages the manual routing overrides of a
+// provisioned selection policy. GET with ?policy=<id> lists the live
+// overrides; POST with a JSON overrideSetRequest body installs or
+// replaces one; DELETE with ?policy=<id>&key=<value> removes one.
+// Changes take effect immediately, without a config reload.
+func (adminUpstreams) handleSelectionOverrides(w http.ResponseWriter, r *http.Request) error {
+	var policyID string
+	switch r.Method {
+	case http.MethodGet, http.MethodDelete:
+		policyID = r.URL.Query().Get("policy")
+	case http.MethodPost:
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var setReq overrideSetRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&setReq); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("decoding request body: %v", err),
+			}
+		}
+		policyID = setReq.Policy
+	}
+	if policyID == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("the 'policy' parameter is required"),
+		}
+	}
+
+	selectionPreviewsMu.RLock()
+	entry, ok := selectionPreviews[policyID]
+	selectionPreviewsMu.RUnlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no provisioned selection policy named '%s'", policyID),
+		}
+	}
+
+	manager, ok := entry.policy.(overrideManager)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("selection policy '%s' does not support manual overrides", policyID),
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(manager.listOverrides()); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        err,
+			}
+		}
+	case http.MethodPost:
+		rule := overrideRule{Upstream: setReq.Upstream}
+		if setReq.TTL > 0 {
+			rule.ExpiresAt = time.Now().Add(time.Duration(setReq.TTL))
+		}
+		if err := manager.setOverride(setReq.Key, rule); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("the 'key' query parameter is required"),
+			}
+		}
+		if err := manager.deleteOverride(key); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        err,
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return nil
+}
+
+// removalSimulator is implemented by selection policies that can
+// estimate, without mutating their live state, which keys would be
+// remapped if an upstream were removed from their topology.
+type removalSimulator interface {
+	simulateRemoval(host string, keys []string) (*removalSimulation, error)
+}
+
+// removalSimulationRequest is the body of a simulate_removal request.
+type removalSimulationRequest struct {
+	// The registered name of the selection policy (e.g. "memento").
+	Policy string `json:"policy"`
+
+	// The dial address of the upstream whose removal to simulate.
+	Upstream string `json:"upstream"`
+
+	// The hash keys to replay. Optional if the policy tracks recent
+	// keys (track_keys); its sample is replayed instead.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// removalSimulation reports how replayed keys would be redistributed
+// if an upstream were removed.
+type removalSimulation struct {
+	// The dial address of the upstream whose removal was simulated.
+	Upstream string `json:"upstream"`
+
+	// How many keys were replayed in total.
+	TotalKeys int `json:"total_keys"`
+
+	// The keys that would map to a different upstream after removal.
+	MovedKeys []string `json:"moved_keys"`
+
+	// Net change in replayed-key ownership per upstream: negative for
+	// the removed upstream, positive for those absorbing its keys.
+	LoadDeltas map[string]int `json:"load_deltas"`
+}
+
+// handleSimulateRemoval estimates which keys would move if an upstream
+// were removed from a provisioned selection policy's topology. Expects
+// a POST with a JSON removalSimulationRequest body; the live policy is
+// never modified.
+func (adminUpstreams) handleSimulateRemoval(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var req removalSimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	if req.Policy == "" || req.Upstream == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("both 'policy' and 'upstream' are required"),
+		}
+	}
+
+	selectionPreviewsMu.RLock()
+	entry, ok := selectionPreviews[req.Policy]
+	selectionPreviewsMu.RUnlock()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no provisioned selection policy named '%s'", req.Policy),
+		}
+	}
+
+	simulator, ok := entry.policy.(removalSimulator)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("selection policy '%s' does not support removal simulation", req.Policy),
+		}
+	}
+
+	sim, err := simulator.simulateRemoval(req.Upstream, req.Keys)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sim); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	return nil
 }
 
 // handleUpstreams reports the status of the reverse proxy
@@ -95,10 +589,13 @@ func (adminUpstreams) handleUpstreams(w http.ResponseWriter, r *http.Request) er
 			return false
 		}
 
+		backoff := upstream.backoffRemaining()
 		results = append(results, upstreamStatus{
-			Address:     address,
-			NumRequests: upstream.NumRequests(),
-			Fails:       upstream.Fails(),
+			Address:          address,
+			NumRequests:      upstream.NumRequests(),
+			Fails:            upstream.Fails(),
+			InBackoff:        backoff > 0,
+			BackoffRemaining: backoff.Seconds(),
 		})
 		return true
 	})
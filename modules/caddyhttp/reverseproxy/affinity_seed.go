@@ -0,0 +1,112 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxAffinitySeedEntries caps how many overrides an affinity seed file
+// may contribute, so a pathological file (or one that isn't a seed list
+// at all) cannot balloon the live override set.
+const maxAffinitySeedEntries = 100_000
+
+// seedOverridesFromAffinityFile reads `key,upstream_dial` pairs from
+// path — one per line — and installs each as a timed override expiring
+// at now+ttl. During a migration from another stickiness scheme this
+// keeps keys on the upstream that historically owned them while new
+// keys follow the engine; once the TTL passes the overrides expire on
+// access, leaving pure engine behavior. Empty lines are skipped,
+// malformed lines are counted and skipped, and at most
+// maxAffinitySeedEntries entries are installed. Like warm-up, a file
+// that cannot be read is a warning, not an error: seeding is a
+// transition aid and must never keep a config from loading. Returns how
+// many overrides were installed.
+func seedOverridesFromAffinityFile(path string, ttl time.Duration, overrides *sync.Map, logger *zap.Logger) int {
+	file, err := os.Open(path)
+	if err != nil {
+		if logger != nil {
+			logger.Warn("cannot read affinity seed file, skipping seeding",
+				zap.String("affinity_seed", path),
+				zap.Error(err))
+		}
+		return 0
+	}
+	defer file.Close()
+
+	expiresAt := time.Now().Add(ttl)
+	seeded := 0
+	malformed := 0
+	firstMalformedLine := 0
+	truncated := false
+	lineNum := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if seeded >= maxAffinitySeedEntries {
+			truncated = true
+			break
+		}
+		// split on the last comma so a key that itself contains commas
+		// still pairs with its dial address, which never contains one
+		sep := strings.LastIndexByte(line, ',')
+		if sep <= 0 || sep == len(line)-1 {
+			malformed++
+			if firstMalformedLine == 0 {
+				firstMalformedLine = lineNum
+			}
+			continue
+		}
+		overrides.Store(line[:sep], overrideRule{
+			Upstream:  line[sep+1:],
+			ExpiresAt: expiresAt,
+		})
+		seeded++
+	}
+	if err := scanner.Err(); err != nil && logger != nil {
+		logger.Warn("error while reading affinity seed file",
+			zap.String("affinity_seed", path),
+			zap.Int("entries_seeded", seeded),
+			zap.Error(err))
+	}
+	if malformed > 0 && logger != nil {
+		logger.Warn("affinity seed file has lines that are not 'key,upstream_dial' pairs, skipped",
+			zap.String("affinity_seed", path),
+			zap.Int("malformed_lines", malformed),
+			zap.Int("first_malformed_line", firstMalformedLine))
+	}
+	if truncated && logger != nil {
+		logger.Warn("affinity seed file exceeds the entry cap, remainder skipped",
+			zap.String("affinity_seed", path),
+			zap.Int("entry_cap", maxAffinitySeedEntries))
+	}
+	if logger != nil {
+		logger.Info("seeded affinity overrides from file",
+			zap.String("affinity_seed", path),
+			zap.Int("entries_seeded", seeded),
+			zap.Time("expires_at", expiresAt))
+	}
+	return seeded
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Availability modes: which aspects of an upstream's state a selection
+// policy considers when deciding whether it may be selected.
+const (
+	// availabilityFull is the default: health and the MaxRequests
+	// limit, exactly what Upstream.Available reports.
+	availabilityFull = "full"
+
+	// availabilityHealthOnly considers health alone.
+	availabilityHealthOnly = "health_only"
+
+	// availabilityIgnoreMaxRequests considers everything except the
+	// MaxRequests limit. With only health and MaxRequests in play
+	// today this matches health_only, but it stays a distinct mode so
+	// any future availability dimension (e.g. draining) is still
+	// honored here.
+	availabilityIgnoreMaxRequests = "ignore_max_requests"
+)
+
+// availableFor reports whether the upstream may be selected under the
+// given availability mode. An empty mode means full availability. A
+// nil upstream is never selectable, so every policy filtering through
+// here tolerates nil pool entries.
+func availableFor(up *Upstream, mode string) bool {
+	if up == nil {
+		return false
+	}
+	switch mode {
+	case availabilityHealthOnly, availabilityIgnoreMaxRequests:
+		return up.Healthy()
+	default:
+		return up.Available()
+	}
+}
+
+// availabilityChooser is the availability configuration shared by the
+// selection policies. Available() conflates health and the MaxRequests
+// limit; for long-lived connections (long-poll, SSE) the in-flight
+// count is misleading, so a hashing policy may want to keep routing a
+// key to its owner even while the owner looks "full".
+type availabilityChooser struct {
+	// Which aspects of an upstream's state make it selectable:
+	// "full" (the default; health and the MaxRequests limit),
+	// "health_only", or "ignore_max_requests".
+	Availability string `json:"availability,omitempty"`
+}
+
+// provisionAvailability validates the configured availability mode.
+func (c *availabilityChooser) provisionAvailability() error {
+	switch c.Availability {
+	case "", availabilityFull, availabilityHealthOnly, availabilityIgnoreMaxRequests:
+		return nil
+	default:
+		return fmt.Errorf("unrecognized availability mode '%s' (expecting full, health_only, or ignore_max_requests)", c.Availability)
+	}
+}
+
+// unmarshalAvailabilityOption parses the `availability <mode>`
+// Caddyfile option shared by the selection policies. It reports whether
+// the current token was it, so callers can fall through to their own
+// unrecognized-option error when it was not.
+func (c *availabilityChooser) unmarshalAvailabilityOption(d *caddyfile.Dispenser) (bool, error) {
+	if d.Val() != "availability" {
+		return false, nil
+	}
+	if !d.NextArg() {
+		return true, d.ArgErr()
+	}
+	c.Availability = d.Val()
+	return true, nil
+}
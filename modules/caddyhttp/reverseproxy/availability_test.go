@@ -0,0 +1,128 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestAvailableFor(t *testing.T) {
+	pool := testPool()
+	saturated := pool[0]
+	saturated.MaxRequests = 1
+	saturated.countRequest(1)
+	defer saturated.countRequest(-1)
+
+	if availableFor(saturated, availabilityFull) {
+		t.Error("Expected a saturated host to be unavailable under full")
+	}
+	if availableFor(saturated, "") {
+		t.Error("Expected the empty mode to behave like full")
+	}
+	if !availableFor(saturated, availabilityHealthOnly) {
+		t.Error("Expected a saturated but healthy host to be available under health_only")
+	}
+	if !availableFor(saturated, availabilityIgnoreMaxRequests) {
+		t.Error("Expected a saturated but healthy host to be available under ignore_max_requests")
+	}
+
+	saturated.setHealthy(false)
+	defer saturated.setHealthy(true)
+	for _, mode := range []string{availabilityFull, availabilityHealthOnly, availabilityIgnoreMaxRequests} {
+		if availableFor(saturated, mode) {
+			t.Errorf("Expected an unhealthy host to be unavailable under %s", mode)
+		}
+	}
+}
+
+func TestAvailabilityProvisionRejectsUnknownMode(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	sel := &IPHashSelection{}
+	sel.Availability = "partial"
+	if err := sel.Provision(ctx); err == nil {
+		t.Error("Expected an error for an unknown availability mode")
+	}
+}
+
+func TestAvailabilityCaddyfileOption(t *testing.T) {
+	sel := RoundRobinSelection{}
+	if err := sel.UnmarshalCaddyfile(caddyfile.NewTestDispenser("round_robin {\n\tavailability health_only\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if sel.Availability != availabilityHealthOnly {
+		t.Errorf("Expected availability 'health_only', got '%s'", sel.Availability)
+	}
+
+	first := FirstSelection{}
+	if err := first.UnmarshalCaddyfile(caddyfile.NewTestDispenser("first {\n\tavailability ignore_max_requests\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if first.Availability != availabilityIgnoreMaxRequests {
+		t.Errorf("Expected availability 'ignore_max_requests', got '%s'", first.Availability)
+	}
+}
+
+// TestHashingAvailabilityHealthOnly covers the long-poll scenario the
+// option exists for: a host saturated via MaxRequests keeps owning its
+// hashed keys under health_only, while the default full mode rehashes
+// them away.
+func TestHashingAvailabilityHealthOnly(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	fullPolicy := IPHashSelection{}
+	if err := fullPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	healthOnlyPolicy := IPHashSelection{}
+	healthOnlyPolicy.Availability = availabilityHealthOnly
+	if err := healthOnlyPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	// find a client address whose hashed key lands on pool[0]
+	var req *http.Request
+	for i := 0; i < 256; i++ {
+		candidate, _ := http.NewRequest("GET", "/", nil)
+		candidate.RemoteAddr = fmt.Sprintf("172.0.0.%d:80", i)
+		if fullPolicy.Select(pool, candidate, nil) == pool[0] {
+			req = candidate
+			break
+		}
+	}
+	if req == nil {
+		t.Fatal("Expected some address to hash to the first host")
+	}
+
+	pool[0].MaxRequests = 1
+	pool[0].countRequest(1)
+	defer pool[0].countRequest(-1)
+
+	if got := fullPolicy.Select(pool, req, nil); got == pool[0] {
+		t.Error("Expected full availability to skip the saturated host")
+	}
+	if got := healthOnlyPolicy.Select(pool, req, nil); got != pool[0] {
+		t.Errorf("Expected health_only to keep the key on its saturated owner, got %v", got)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UpstreamBackoff honors rate-limit responses from upstreams: when a
+// proxied response carries one of the configured status codes, the
+// host enters a backoff window during which selection treats it as
+// unavailable, instead of hammering a backend that just said it is
+// overloaded. The window length comes from the response's Retry-After
+// header when present (clamped to max_duration) and from
+// default_duration otherwise. Hashing policies handle a host in
+// backoff the same way they handle any unavailable owner — a
+// deterministic secondary — so affinity degrades predictably rather
+// than randomly.
+type UpstreamBackoff struct {
+	// The response status codes that start a backoff window.
+	// Default: 429 and 503.
+	Statuses []int `json:"statuses,omitempty"`
+
+	// How long to back off when the response has no usable
+	// Retry-After header. Default: 5s.
+	DefaultDuration caddy.Duration `json:"default_duration,omitempty"`
+
+	// The longest backoff window a response can ask for; a larger
+	// Retry-After is clamped to this. Default: 2m.
+	MaxDuration caddy.Duration `json:"max_duration,omitempty"`
+}
+
+// provision fills defaults and validates the configuration.
+func (b *UpstreamBackoff) provision() error {
+	if len(b.Statuses) == 0 {
+		b.Statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	}
+	for _, status := range b.Statuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("upstream_backoff: invalid status code %d", status)
+		}
+	}
+	if b.DefaultDuration < 0 {
+		return fmt.Errorf("upstream_backoff: default_duration must be positive, got %v", time.Duration(b.DefaultDuration))
+	}
+	if b.DefaultDuration == 0 {
+		b.DefaultDuration = caddy.Duration(5 * time.Second)
+	}
+	if b.MaxDuration < 0 {
+		return fmt.Errorf("upstream_backoff: max_duration must be positive, got %v", time.Duration(b.MaxDuration))
+	}
+	if b.MaxDuration == 0 {
+		b.MaxDuration = caddy.Duration(2 * time.Minute)
+	}
+	return nil
+}
+
+// observe starts a backoff window on the upstream's host when the
+// response status is one of the configured codes.
+func (b *UpstreamBackoff) observe(upstream *Upstream, res *http.Response) {
+	matched := false
+	for _, status := range b.Statuses {
+		if res.StatusCode == status {
+			matched = true
+			break
+		}
+	}
+	if !matched || upstream.Host == nil {
+		return
+	}
+	upstream.Host.setBackoff(time.Now().Add(b.window(res.Header.Get("Retry-After"))))
+}
+
+// window converts a Retry-After value into a backoff duration. Both
+// RFC 9110 forms are honored — delay-seconds and an HTTP-date — and
+// the result is clamped to max_duration; a missing or unparseable
+// value falls back to default_duration.
+func (b *UpstreamBackoff) window(retryAfter string) time.Duration {
+	window := time.Duration(b.DefaultDuration)
+	if retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil && secs >= 0 {
+			window = time.Duration(secs) * time.Second
+		} else if when, err := http.ParseTime(retryAfter); err == nil {
+			window = time.Until(when)
+		}
+	}
+	if maxWindow := time.Duration(b.MaxDuration); window > maxWindow {
+		window = maxWindow
+	}
+	if window < 0 {
+		window = 0
+	}
+	return window
+}
+
+// UnmarshalCaddyfile parses the upstream_backoff block:
+//
+//	upstream_backoff {
+//	    statuses 429 503
+//	    default_duration 5s
+//	    max_duration 2m
+//	}
+func (b *UpstreamBackoff) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "statuses":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				status, err := strconv.Atoi(arg)
+				if err != nil {
+					return d.Errf("invalid status code '%s': %v", arg, err)
+				}
+				b.Statuses = append(b.Statuses, status)
+			}
+		case "default_duration":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid default_duration '%s': %v", d.Val(), err)
+			}
+			b.DefaultDuration = caddy.Duration(dur)
+		case "max_duration":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_duration '%s': %v", d.Val(), err)
+			}
+			b.MaxDuration = caddy.Duration(dur)
+		default:
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return nil
+}
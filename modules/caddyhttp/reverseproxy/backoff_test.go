@@ -0,0 +1,166 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func rateLimitResponse(status int, retryAfter string) *http.Response {
+	res := &http.Response{StatusCode: status, Header: http.Header{}}
+	if retryAfter != "" {
+		res.Header.Set("Retry-After", retryAfter)
+	}
+	return res
+}
+
+func TestUpstreamBackoffSkipsHostUntilExpiry(t *testing.T) {
+	backoff := UpstreamBackoff{DefaultDuration: caddy.Duration(50 * time.Millisecond)}
+	if err := backoff.provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+
+	pool := testPool()
+	backoff.observe(pool[0], rateLimitResponse(http.StatusTooManyRequests, ""))
+
+	if !pool[0].InBackoff() {
+		t.Error("Expected the host to be in backoff after a 429")
+	}
+	if pool[0].Available() {
+		t.Error("Expected a host in backoff to be unavailable")
+	}
+
+	// selection must route around the host for the whole window
+	randomPolicy := RandomSelection{}
+	for i := 0; i < 20; i++ {
+		if h := randomPolicy.Select(pool, &http.Request{}, nil); h == pool[0] {
+			t.Fatal("Expected selection to skip a host in backoff")
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if pool[0].InBackoff() {
+		t.Error("Expected the backoff window to have elapsed")
+	}
+	if !pool[0].Available() {
+		t.Error("Expected the host to be available again after the window")
+	}
+}
+
+func TestUpstreamBackoffObserveMatchesConfiguredStatuses(t *testing.T) {
+	backoff := UpstreamBackoff{}
+	if err := backoff.provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+
+	pool := testPool()
+	backoff.observe(pool[0], rateLimitResponse(http.StatusInternalServerError, "5"))
+	if pool[0].InBackoff() {
+		t.Error("Expected a 500 to leave the host out of backoff")
+	}
+
+	backoff.observe(pool[0], rateLimitResponse(http.StatusServiceUnavailable, "5"))
+	if !pool[0].InBackoff() {
+		t.Error("Expected a 503 to put the host in backoff")
+	}
+}
+
+func TestUpstreamBackoffRetryAfterWindow(t *testing.T) {
+	backoff := UpstreamBackoff{}
+	if err := backoff.provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+
+	if got := backoff.window(""); got != 5*time.Second {
+		t.Errorf("Expected the default window for a missing header, got %v", got)
+	}
+	if got := backoff.window("7"); got != 7*time.Second {
+		t.Errorf("Expected 7s from delay-seconds, got %v", got)
+	}
+	if got := backoff.window("whenever"); got != 5*time.Second {
+		t.Errorf("Expected the default window for an unparseable value, got %v", got)
+	}
+	if got := backoff.window("600"); got != 2*time.Minute {
+		t.Errorf("Expected a large delay to be clamped to max_duration, got %v", got)
+	}
+
+	future := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if got := backoff.window(future); got < 25*time.Second || got > 30*time.Second {
+		t.Errorf("Expected roughly 30s from an HTTP-date, got %v", got)
+	}
+	past := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	if got := backoff.window(past); got != 0 {
+		t.Errorf("Expected a past HTTP-date to yield a zero window, got %v", got)
+	}
+}
+
+func TestUpstreamBackoffProvision(t *testing.T) {
+	backoff := UpstreamBackoff{}
+	if err := backoff.provision(); err != nil {
+		t.Fatalf("provision error: %v", err)
+	}
+	if len(backoff.Statuses) != 2 || backoff.Statuses[0] != 429 || backoff.Statuses[1] != 503 {
+		t.Errorf("Expected default statuses 429 and 503, got %v", backoff.Statuses)
+	}
+	if time.Duration(backoff.DefaultDuration) != 5*time.Second {
+		t.Errorf("Expected a 5s default_duration, got %v", time.Duration(backoff.DefaultDuration))
+	}
+	if time.Duration(backoff.MaxDuration) != 2*time.Minute {
+		t.Errorf("Expected a 2m max_duration, got %v", time.Duration(backoff.MaxDuration))
+	}
+
+	invalid := UpstreamBackoff{Statuses: []int{42}}
+	if err := invalid.provision(); err == nil {
+		t.Error("Expected an error for an out-of-range status code")
+	}
+	negative := UpstreamBackoff{DefaultDuration: caddy.Duration(-time.Second)}
+	if err := negative.provision(); err == nil {
+		t.Error("Expected an error for a negative default_duration")
+	}
+}
+
+func TestUpstreamBackoffCaddyfile(t *testing.T) {
+	backoff := UpstreamBackoff{}
+	d := caddyfile.NewTestDispenser("upstream_backoff {\n\tstatuses 429 503 418\n\tdefault_duration 3s\n\tmax_duration 1m\n}")
+	d.Next() // consume directive name
+	if err := backoff.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if len(backoff.Statuses) != 3 || backoff.Statuses[2] != 418 {
+		t.Errorf("Expected 3 statuses ending in 418, got %v", backoff.Statuses)
+	}
+	if time.Duration(backoff.DefaultDuration) != 3*time.Second {
+		t.Errorf("Expected a 3s default_duration, got %v", time.Duration(backoff.DefaultDuration))
+	}
+	if time.Duration(backoff.MaxDuration) != time.Minute {
+		t.Errorf("Expected a 1m max_duration, got %v", time.Duration(backoff.MaxDuration))
+	}
+
+	d = caddyfile.NewTestDispenser("upstream_backoff {\n\tstatuses lots\n}")
+	d.Next()
+	if err := (&UpstreamBackoff{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for a non-numeric status code")
+	}
+	d = caddyfile.NewTestDispenser("upstream_backoff {\n\tjitter 1s\n}")
+	d.Next()
+	if err := (&UpstreamBackoff{}).UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for an unrecognized option")
+	}
+}
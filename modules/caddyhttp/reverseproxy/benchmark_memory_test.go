@@ -0,0 +1,63 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// engineHeapInUse forces a GC and returns the bytes currently allocated
+// on the heap, so before/after deltas isolate the memory retained by
+// the structures built in between.
+func engineHeapInUse() float64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return float64(stats.HeapAlloc)
+}
+
+// BenchmarkConsistentEngineBytesPerNode measures the heap retained per
+// node by a fully built ConsistentEngine: the memento engine plus the
+// node-to-bucket indirection. The upstreams are created outside the
+// measured window, so the figure is the engine's own bookkeeping cost
+// per node — the number that decides whether running at 5k upstreams
+// is a memory problem.
+func BenchmarkConsistentEngineBytesPerNode(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("nodes-%d", n), func(b *testing.B) {
+			upstreams := make([]*Upstream, n)
+			for i := range upstreams {
+				upstreams[i] = makeUpstream(fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256))
+			}
+			engines := make([]*ConsistentEngine, b.N)
+			before := engineHeapInUse()
+			for i := 0; i < b.N; i++ {
+				engine := NewConsistentEngine()
+				for _, upstream := range upstreams {
+					if err := engine.AddNode(upstream); err != nil {
+						b.Fatalf("AddNode error: %v", err)
+					}
+				}
+				engines[i] = engine
+			}
+			after := engineHeapInUse()
+			b.ReportMetric((after-before)/float64(b.N*n), "bytes/node")
+			runtime.KeepAlive(engines)
+			runtime.KeepAlive(upstreams)
+		})
+	}
+}
@@ -12,162 +12,227 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Command benchmark_to_csv runs the Memento vs. Rendezvous selection
+// policy benchmarks and emits the results in a machine-readable form.
+//
+// Usage:
+//
+//	go run ./modules/caddyhttp/reverseproxy/benchmark_tools \
+//	    -pkg ./modules/caddyhttp/reverseproxy \
+//	    -bench 'RendezvousVsMemento' -count 5 -out csv > results.csv
+//
+// With -compare, results are grouped by scenario and the tool emits the
+// Memento/Rendezvous time ratio per scenario plus a geometric mean
+// summary, instead of the raw per-benchmark rows.
 package main
 
 import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
 )
 
+// BenchmarkResult is one parsed line of `go test -bench` output.
 type BenchmarkResult struct {
-	TestName    string
-	Algorithm   string
-	TimeNs      float64
-	MemoryBytes int
-	Allocations int
-	Scenario    string
+	Name        string  `json:"name"`
+	Algorithm   string  `json:"algorithm"`
+	Scenario    string  `json:"scenario"`
+	Iterations  int     `json:"iterations"`
+	TimeNs      float64 `json:"time_ns"`
+	MemoryBytes int     `json:"memory_bytes"`
+	Allocations int     `json:"allocations"`
+}
+
+// ScenarioComparison aggregates the results of one scenario across both
+// algorithms. Ratio is Memento time over Rendezvous time, so a value
+// below 1 means Memento was faster.
+type ScenarioComparison struct {
+	Scenario     string  `json:"scenario"`
+	MementoNs    float64 `json:"memento_ns"`
+	RendezvousNs float64 `json:"rendezvous_ns"`
+	Ratio        float64 `json:"ratio"`
 }
 
 func main() {
-	fmt.Println("Running benchmark comparison and generating CSV...")
-
-	// Run all benchmark tests
-	benchmarks := []string{
-		"BenchmarkRendezvousVsMemento_SameKey",
-		"BenchmarkRendezvousVsMemento_DifferentKeys",
-		"BenchmarkRendezvousVsMemento_EventDrivenPerformance",
-		"BenchmarkRendezvousVsMemento_URIHash",
-		"BenchmarkRendezvousVsMemento_HeaderHash",
-		"BenchmarkRendezvousVsMemento_DifferentPoolSizes",
-		"BenchmarkRendezvous_PoolSizes",
-		"BenchmarkRendezvousVsMemento_MemoryAllocation",
-		"BenchmarkRendezvousVsMemento_ConcurrentAccess",
-		"BenchmarkRendezvousVsMemento_RealisticConcurrent",
-		"BenchmarkRendezvousVsMemento_ConsistencyCheck",
-		"BenchmarkMementoVsRendezvous_WithRemovedNodes",
-		"BenchmarkMementoVsRendezvous_100Nodes_ProgressiveRemoval",
+	pkg := flag.String("pkg", "./modules/caddyhttp/reverseproxy", "package containing the benchmarks")
+	bench := flag.String("bench", "RendezvousVsMemento|MementoVsRendezvous|Rendezvous_PoolSizes", "benchmark regex passed to go test -bench")
+	count := flag.Int("count", 1, "number of times to run each benchmark")
+	out := flag.String("out", "csv", "output format: csv or json")
+	compare := flag.Bool("compare", false, "group results by scenario and emit Memento/Rendezvous ratios")
+	flag.Parse()
+
+	if *out != "csv" && *out != "json" {
+		fmt.Fprintf(os.Stderr, "unrecognized output format %q: must be 'csv' or 'json'\n", *out)
+		os.Exit(2)
 	}
 
-	var results []BenchmarkResult
+	output, err := runBenchmarks(*pkg, *bench, *count)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "running benchmarks: %v\n", err)
+		os.Exit(1)
+	}
 
-	for _, benchmark := range benchmarks {
-		fmt.Printf("Running %s...\n", benchmark)
-		benchmarkResults := runBenchmark(benchmark)
-		results = append(results, benchmarkResults...)
+	results := parseBenchmarkOutput(output)
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "no benchmark results parsed; check -pkg and -bench")
+		os.Exit(1)
 	}
 
-	// Generate CSV
-	err := generateCSV(results)
+	if *compare {
+		comparisons, geomean := compareResults(results)
+		err = writeComparisons(os.Stdout, comparisons, geomean, *out)
+	} else {
+		err = writeResults(os.Stdout, results, *out)
+	}
 	if err != nil {
-		fmt.Printf("Error generating CSV: %v\n", err)
+		fmt.Fprintf(os.Stderr, "writing results: %v\n", err)
 		os.Exit(1)
 	}
-
-	fmt.Println("CSV file 'benchmark_results.csv' generated successfully!")
-	fmt.Printf("Total results: %d\n", len(results))
 }
 
-func runBenchmark(benchmarkPattern string) []BenchmarkResult {
-	cmd := exec.Command("go", "test",
-		"-bench", benchmarkPattern, "-benchmem", "-run", "^$")
-	cmd.Dir = "/home/massimo.saia/sw/caddy/modules/caddyhttp/reverseproxy"
-
-	output, err := cmd.Output()
-	if err != nil {
-		fmt.Printf("Error running benchmark %s: %v\n", benchmarkPattern, err)
-		return nil
+// runBenchmarks invokes `go test -bench` on the given package and
+// returns its standard output. The package's own stderr (build errors,
+// skipped-test notices) passes through to this process's stderr.
+func runBenchmarks(pkg, bench string, count int) (string, error) {
+	args := []string{"test", "-bench", bench, "-benchmem", "-run", "^$"}
+	if count > 1 {
+		args = append(args, "-count", strconv.Itoa(count))
 	}
+	args = append(args, pkg)
 
-	return parseBenchmarkOutput(string(output), benchmarkPattern)
+	cmd := exec.Command("go", args...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	return string(output), err
 }
 
-func parseBenchmarkOutput(output, pattern string) []BenchmarkResult {
+// parseBenchmarkOutput extracts all benchmark result lines from raw
+// `go test -bench` output, skipping headers, PASS/ok footers, and any
+// log lines the benchmarks themselves print.
+func parseBenchmarkOutput(output string) []BenchmarkResult {
 	var results []BenchmarkResult
-
-	lines := strings.Split(output, "\n")
-
-	for _, line := range lines {
-		if strings.Contains(line, "Benchmark") && strings.Contains(line, "ns/op") {
-			result := parseBenchmarkLine(line, pattern)
-			if result != nil {
-				results = append(results, *result)
-			}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if result, ok := parseBenchmarkLine(scanner.Text()); ok {
+			results = append(results, result)
 		}
 	}
-
 	return results
 }
 
-func parseBenchmarkLine(line, pattern string) *BenchmarkResult {
-	// Regex to match benchmark output format:
-	// BenchmarkRendezvousVsMemento_SameKey/Rendezvous_IPHash_SameKey-6         	 5766648	       204.7 ns/op	       0 B/op	       0 allocs/op
+// parseBenchmarkLine parses a single benchmark result line by splitting
+// it into whitespace-separated fields, the same way the benchfmt
+// reference parser does: the first field is the benchmark name (with a
+// trailing -GOMAXPROCS suffix to strip), the second is the iteration
+// count, and the rest are value/unit pairs. Unlike a format regex, this
+// handles benchmark names that themselves contain dashes.
+func parseBenchmarkLine(line string) (BenchmarkResult, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+		return BenchmarkResult{}, false
+	}
 
-	re := regexp.MustCompile(`Benchmark([^/]+)/([^-]+)-(\d+)\s+(\d+)\s+([\d.]+)\s+ns/op\s+(\d+)\s+B/op\s+(\d+)\s+allocs/op`)
-	matches := re.FindStringSubmatch(line)
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return BenchmarkResult{}, false
+	}
 
-	if len(matches) < 8 {
-		return nil
+	result := BenchmarkResult{
+		Name:       trimGOMAXPROCS(fields[0]),
+		Iterations: iterations,
 	}
 
-	testName := matches[2] // Extract the actual test name after the slash
-	timeNs, _ := strconv.ParseFloat(matches[5], 64)
-	memoryBytes, _ := strconv.Atoi(matches[6])
-	allocations, _ := strconv.Atoi(matches[7])
+	sawTime := false
+	for i := 2; i+1 < len(fields); i += 2 {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return BenchmarkResult{}, false
+		}
+		switch fields[i+1] {
+		case "ns/op":
+			result.TimeNs = value
+			sawTime = true
+		case "B/op":
+			result.MemoryBytes = int(value)
+		case "allocs/op":
+			result.Allocations = int(value)
+		}
+	}
+	if !sawTime {
+		return BenchmarkResult{}, false
+	}
 
-	// Determine algorithm and scenario
-	algorithm, scenario := parseTestName(testName, pattern)
+	result.Algorithm, result.Scenario = classifyBenchmark(result.Name)
+	return result, true
+}
 
-	return &BenchmarkResult{
-		TestName:    testName,
-		Algorithm:   algorithm,
-		TimeNs:      timeNs,
-		MemoryBytes: memoryBytes,
-		Allocations: allocations,
-		Scenario:    scenario,
+// trimGOMAXPROCS removes the trailing -N procs suffix the testing
+// package appends to benchmark names. Only a final dash followed
+// entirely by digits is stripped, so dashes inside the name survive.
+func trimGOMAXPROCS(name string) string {
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		if _, err := strconv.Atoi(name[i+1:]); err == nil {
+			return name[:i]
+		}
 	}
+	return name
 }
 
-func parseTestName(testName, pattern string) (algorithm, scenario string) {
-	// Parse algorithm type based on test name
-	if strings.Contains(testName, "Rendezvous") {
+// classifyBenchmark derives the algorithm and scenario from a benchmark
+// name. The algorithm comes from the sub-benchmark name (the part after
+// the first slash), since the parent name usually mentions both; the
+// scenario comes from the parent name, refined by sub-benchmark
+// variants where a parent covers several scenarios.
+func classifyBenchmark(name string) (algorithm, scenario string) {
+	parent := name
+	sub := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		parent = name[:i]
+		sub = name[i+1:]
+	}
+
+	switch {
+	case strings.Contains(sub, "Rendezvous"):
 		algorithm = "Rendezvous"
-	} else if strings.Contains(testName, "Memento") {
+	case strings.Contains(sub, "Memento"):
 		algorithm = "Memento"
-	} else {
+	default:
 		algorithm = "Unknown"
 	}
 
-	// Parse scenario based on pattern and test name
-	switch pattern {
+	switch parent {
 	case "BenchmarkRendezvousVsMemento_SameKey":
 		scenario = "Same Key"
 	case "BenchmarkRendezvousVsMemento_DifferentKeys":
 		scenario = "Different Keys"
 	case "BenchmarkRendezvousVsMemento_EventDrivenPerformance":
-		if strings.Contains(testName, "WithTopologyChanges") {
+		if strings.Contains(sub, "WithTopologyChanges") {
 			scenario = "Event-Driven with Topology Changes"
 		} else {
 			scenario = "Event-Driven Performance"
 		}
 	case "BenchmarkRendezvousVsMemento_URIHash":
-		if strings.Contains(testName, "SameURI") {
+		if strings.Contains(sub, "SameURI") {
 			scenario = "Same URI"
 		} else {
 			scenario = "Different URIs"
 		}
 	case "BenchmarkRendezvousVsMemento_HeaderHash":
-		if strings.Contains(testName, "SameHeader") {
+		if strings.Contains(sub, "SameHeader") {
 			scenario = "Same Header"
 		} else {
 			scenario = "Different Headers"
 		}
-	case "BenchmarkRendezvousVsMemento_DifferentPoolSizes":
-		scenario = "Pool Size Scalability"
-	case "BenchmarkRendezvous_PoolSizes":
+	case "BenchmarkRendezvousVsMemento_DifferentPoolSizes",
+		"BenchmarkRendezvous_PoolSizes":
 		scenario = "Pool Size Scalability"
 	case "BenchmarkRendezvousVsMemento_MemoryAllocation":
 		scenario = "Memory Allocation"
@@ -182,40 +247,130 @@ func parseTestName(testName, pattern string) (algorithm, scenario string) {
 	case "BenchmarkMementoVsRendezvous_100Nodes_ProgressiveRemoval":
 		scenario = "Progressive Removals"
 	default:
-		scenario = "Unknown"
+		// unrecognized benchmarks (arbitrary -bench regexes) group
+		// under their parent name rather than being dropped
+		scenario = strings.TrimPrefix(parent, "Benchmark")
 	}
 
 	return algorithm, scenario
 }
 
-func generateCSV(results []BenchmarkResult) error {
-	file, err := os.Create("benchmark_results.csv")
-	if err != nil {
-		return err
+// compareResults groups results by scenario, averages the time of each
+// algorithm within a scenario (multiple -count runs collapse here), and
+// returns per-scenario Memento/Rendezvous ratios in first-seen order
+// along with the geometric mean of the ratios. Scenarios missing either
+// algorithm are skipped.
+func compareResults(results []BenchmarkResult) ([]ScenarioComparison, float64) {
+	type accumulator struct {
+		sum float64
+		n   int
 	}
-	defer file.Close()
+	byScenario := make(map[string]map[string]*accumulator)
+	var order []string
 
-	// Write CSV header
-	_, err = file.WriteString("TestName,Algorithm,TimeNs,MemoryBytes,Allocations,Scenario\n")
-	if err != nil {
-		return err
+	for _, result := range results {
+		algorithms, ok := byScenario[result.Scenario]
+		if !ok {
+			algorithms = make(map[string]*accumulator)
+			byScenario[result.Scenario] = algorithms
+			order = append(order, result.Scenario)
+		}
+		acc, ok := algorithms[result.Algorithm]
+		if !ok {
+			acc = &accumulator{}
+			algorithms[result.Algorithm] = acc
+		}
+		acc.sum += result.TimeNs
+		acc.n++
+	}
+
+	var comparisons []ScenarioComparison
+	logSum := 0.0
+	for _, scenario := range order {
+		memento, okM := byScenario[scenario]["Memento"]
+		rendezvous, okR := byScenario[scenario]["Rendezvous"]
+		if !okM || !okR {
+			continue
+		}
+		mementoNs := memento.sum / float64(memento.n)
+		rendezvousNs := rendezvous.sum / float64(rendezvous.n)
+		ratio := mementoNs / rendezvousNs
+		comparisons = append(comparisons, ScenarioComparison{
+			Scenario:     scenario,
+			MementoNs:    mementoNs,
+			RendezvousNs: rendezvousNs,
+			Ratio:        ratio,
+		})
+		logSum += math.Log(ratio)
+	}
+
+	geomean := 0.0
+	if len(comparisons) > 0 {
+		geomean = math.Exp(logSum / float64(len(comparisons)))
+	}
+	return comparisons, geomean
+}
+
+// writeResults emits the raw per-benchmark rows in the chosen format.
+func writeResults(w io.Writer, results []BenchmarkResult, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
 	}
 
-	// Write data rows
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"Name", "Algorithm", "Scenario", "Iterations", "TimeNs", "MemoryBytes", "Allocations"}); err != nil {
+		return err
+	}
 	for _, result := range results {
-		line := fmt.Sprintf("%s,%s,%.2f,%d,%d,%s\n",
-			result.TestName,
+		record := []string{
+			result.Name,
 			result.Algorithm,
-			result.TimeNs,
-			result.MemoryBytes,
-			result.Allocations,
-			result.Scenario)
-
-		_, err = file.WriteString(line)
-		if err != nil {
+			result.Scenario,
+			strconv.Itoa(result.Iterations),
+			strconv.FormatFloat(result.TimeNs, 'f', 2, 64),
+			strconv.Itoa(result.MemoryBytes),
+			strconv.Itoa(result.Allocations),
+		}
+		if err := writer.Write(record); err != nil {
 			return err
 		}
 	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeComparisons emits the per-scenario comparison rows and the
+// geometric mean summary in the chosen format.
+func writeComparisons(w io.Writer, comparisons []ScenarioComparison, geomean float64, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Scenarios    []ScenarioComparison `json:"scenarios"`
+			GeomeanRatio float64              `json:"geomean_ratio"`
+		}{comparisons, geomean})
+	}
 
-	return nil
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"Scenario", "MementoNs", "RendezvousNs", "Ratio"}); err != nil {
+		return err
+	}
+	for _, comparison := range comparisons {
+		record := []string{
+			comparison.Scenario,
+			strconv.FormatFloat(comparison.MementoNs, 'f', 2, 64),
+			strconv.FormatFloat(comparison.RendezvousNs, 'f', 2, 64),
+			strconv.FormatFloat(comparison.Ratio, 'f', 4, 64),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := writer.Write([]string{"geometric mean", "", "", strconv.FormatFloat(geomean, 'f', 4, 64)}); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
 }
@@ -0,0 +1,112 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+func TestParseBenchmarkOutput(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/bench_output.txt")
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+
+	results := parseBenchmarkOutput(string(fixture))
+	if len(results) != 7 {
+		t.Fatalf("Expected 7 parsed results, got %d", len(results))
+	}
+
+	first := results[0]
+	if first.Name != "BenchmarkRendezvousVsMemento_SameKey/Rendezvous_IPHash_SameKey" {
+		t.Errorf("Unexpected name: %s", first.Name)
+	}
+	if first.Algorithm != "Rendezvous" {
+		t.Errorf("Expected algorithm Rendezvous, got %s", first.Algorithm)
+	}
+	if first.Scenario != "Same Key" {
+		t.Errorf("Expected scenario 'Same Key', got %s", first.Scenario)
+	}
+	if first.Iterations != 5766648 {
+		t.Errorf("Expected 5766648 iterations, got %d", first.Iterations)
+	}
+	if first.TimeNs != 204.7 {
+		t.Errorf("Expected 204.7 ns/op, got %v", first.TimeNs)
+	}
+	if first.MemoryBytes != 0 || first.Allocations != 0 {
+		t.Errorf("Expected zero memory stats, got %d B / %d allocs", first.MemoryBytes, first.Allocations)
+	}
+
+	// a benchmark name containing dashes must survive parsing; only the
+	// trailing -GOMAXPROCS suffix is stripped
+	dashed := results[4]
+	if dashed.Name != "BenchmarkRendezvousVsMemento_URIHash/Rendezvous_Different-URIs" {
+		t.Errorf("Dashed benchmark name parsed incorrectly: %s", dashed.Name)
+	}
+	if dashed.Scenario != "Different URIs" {
+		t.Errorf("Expected scenario 'Different URIs', got %s", dashed.Scenario)
+	}
+	if dashed.MemoryBytes != 48 || dashed.Allocations != 2 {
+		t.Errorf("Unexpected memory stats for dashed benchmark: %d B / %d allocs", dashed.MemoryBytes, dashed.Allocations)
+	}
+}
+
+func TestParseBenchmarkLineRejectsNonResults(t *testing.T) {
+	for _, line := range []string{
+		"goos: linux",
+		"pkg: github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy",
+		"PASS",
+		"ok  	github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy	12.482s",
+		"BenchmarkBroken-6 not-a-number 1.0 ns/op",
+		"BenchmarkNoTime-6 100 16 B/op 1 allocs/op",
+		"",
+	} {
+		if _, ok := parseBenchmarkLine(line); ok {
+			t.Errorf("Expected line to be rejected: %q", line)
+		}
+	}
+}
+
+func TestCompareResults(t *testing.T) {
+	results := []BenchmarkResult{
+		{Scenario: "Same Key", Algorithm: "Rendezvous", TimeNs: 200},
+		{Scenario: "Same Key", Algorithm: "Memento", TimeNs: 100},
+		// two -count runs of the same benchmark should be averaged
+		{Scenario: "Different Keys", Algorithm: "Rendezvous", TimeNs: 300},
+		{Scenario: "Different Keys", Algorithm: "Rendezvous", TimeNs: 500},
+		{Scenario: "Different Keys", Algorithm: "Memento", TimeNs: 800},
+		// a scenario without both algorithms is skipped
+		{Scenario: "Pool Size Scalability", Algorithm: "Rendezvous", TimeNs: 900},
+	}
+
+	comparisons, geomean := compareResults(results)
+	if len(comparisons) != 2 {
+		t.Fatalf("Expected 2 comparisons, got %d", len(comparisons))
+	}
+
+	if comparisons[0].Scenario != "Same Key" || comparisons[0].Ratio != 0.5 {
+		t.Errorf("Unexpected first comparison: %+v", comparisons[0])
+	}
+	if comparisons[1].Scenario != "Different Keys" || comparisons[1].Ratio != 2.0 {
+		t.Errorf("Unexpected second comparison: %+v", comparisons[1])
+	}
+
+	// geometric mean of 0.5 and 2.0 is 1.0
+	if math.Abs(geomean-1.0) > 1e-9 {
+		t.Errorf("Expected geometric mean 1.0, got %v", geomean)
+	}
+}
@@ -68,6 +68,16 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 //	    lb_try_duration <duration>
 //	    lb_try_interval <interval>
 //	    lb_retry_match <request-matcher>
+//	    lb_retry_affinity rehash|strict
+//	    lb_shadow <name> [<options...>]
+//	    lb_shadow_sample_rate <rate>
+//	    lb_selection_metrics
+//	    lb_slow_start <duration>
+//	    upstream_backoff {
+//	        statuses <codes...>
+//	        default_duration <duration>
+//	        max_duration <duration>
+//	    }
 //
 //	    # active health checking
 //	    health_uri          <uri>
@@ -332,6 +342,89 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			h.LoadBalancing.RetryMatchRaw = append(h.LoadBalancing.RetryMatchRaw, matcherSet)
 
+		case "lb_retry_affinity":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if d.Val() != "rehash" && d.Val() != "strict" {
+				return d.Errf("bad lb_retry_affinity value '%s': must be 'rehash' or 'strict'", d.Val())
+			}
+			if h.LoadBalancing == nil {
+				h.LoadBalancing = new(LoadBalancing)
+			}
+			h.LoadBalancing.RetryAffinity = d.Val()
+
+		case "lb_shadow":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if h.LoadBalancing != nil && h.LoadBalancing.ShadowPolicyRaw != nil {
+				return d.Err("shadow selection policy already specified")
+			}
+			name := d.Val()
+			modID := "http.reverse_proxy.selection_policies." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return err
+			}
+			sel, ok := unm.(Selector)
+			if !ok {
+				return d.Errf("module %s (%T) is not a reverseproxy.Selector", modID, unm)
+			}
+			if h.LoadBalancing == nil {
+				h.LoadBalancing = new(LoadBalancing)
+			}
+			h.LoadBalancing.ShadowPolicyRaw = caddyconfig.JSONModuleObject(sel, "policy", name, nil)
+
+		case "lb_shadow_sample_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return d.Errf("bad lb_shadow_sample_rate value '%s': %v", d.Val(), err)
+			}
+			if rate < 0 || rate > 1 {
+				return d.Errf("lb_shadow_sample_rate must be between 0 and 1, got %s", d.Val())
+			}
+			if h.LoadBalancing == nil {
+				h.LoadBalancing = new(LoadBalancing)
+			}
+			h.LoadBalancing.ShadowSampleRate = rate
+
+		case "lb_selection_metrics":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if h.LoadBalancing == nil {
+				h.LoadBalancing = new(LoadBalancing)
+			}
+			h.LoadBalancing.SelectionMetrics = true
+
+		case "lb_slow_start":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if h.LoadBalancing == nil {
+				h.LoadBalancing = new(LoadBalancing)
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("bad duration value %s: %v", d.Val(), err)
+			}
+			h.LoadBalancing.SlowStart = caddy.Duration(dur)
+
+		case "upstream_backoff":
+			if h.LoadBalancing == nil {
+				h.LoadBalancing = new(LoadBalancing)
+			}
+			if h.LoadBalancing.UpstreamBackoff == nil {
+				h.LoadBalancing.UpstreamBackoff = new(UpstreamBackoff)
+			}
+			if err := h.LoadBalancing.UpstreamBackoff.UnmarshalCaddyfile(d); err != nil {
+				return err
+			}
+
 		case "health_uri":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -15,11 +15,47 @@
 package reverseproxy
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy/memento"
 )
 
+// consistentHasher is the engine surface the memento selection policy
+// and its event handlers program against. Both engine variants — the
+// RWMutex memento and the lock-free copy-on-write memento — are served
+// by ConsistentEngine, whose behavior is chosen at construction, so
+// callers never branch on the engine type.
+type consistentHasher interface {
+	SetKeyHasher(fn hashFunction)
+	AddNode(upstream *Upstream) error
+	RemoveNode(upstream *Upstream) error
+	AddNodes(upstreams []*Upstream) error
+	RemoveNodes(upstreams []*Upstream) error
+	Reset(upstreams []*Upstream) error
+	Compact(threshold int) int
+	Clone() consistentHasher
+	Rebind(byID map[string]*Upstream) error
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(data []byte) error
+	RestoreNode(upstream *Upstream) error
+	IsRemoved(upstream *Upstream) bool
+	HasNode(upstream *Upstream) bool
+	Lookup(key string) (*Upstream, bool)
+	LookupBytes(key []byte) (*Upstream, bool)
+	GetBucket(key string) (*Upstream, bool)
+	GetBucketBytes(key []byte) (*Upstream, bool)
+	GetBucketIndex(key string) int
+	GetNodeID(bucket int) (*Upstream, bool)
+	GetTopology() []*Upstream
+	Size() int
+	GetMementoStats() map[string]interface{}
+	String() string
+}
+
 // ConsistentEngine wraps MementoEngine to provide a load balancing policy
 // that can handle arbitrary node removals and additions.
 // It manages node topology (node IDs as strings) and delegates
@@ -32,6 +68,22 @@ type ConsistentEngine struct {
 	// This ensures consistency checks and proper mapping management
 	indirection *Indirection
 
+	// Which MementoEngine implementation was chosen at construction,
+	// so Reset can rebuild an engine of the same type
+	lockFree bool
+
+	// The bucket each removed node held, keyed by node identity
+	// (hashKey), so RestoreNode can unwind the removal and give a
+	// recovering node its original bucket back
+	removedNodes map[string]int
+
+	// Optional key pre-mixer configured through the policy's
+	// hash_function option. The memento engine hashes keys with its own
+	// internal FNV-1a; when set, keys are run through this function
+	// first, so the configured function (e.g. keyed siphash) decides
+	// the distribution. Nil leaves keys untouched.
+	keyHasher hashFunction
+
 	// NOTE: Thread safety is handled at the MementoSelection level.
 	// This engine is not thread-safe by itself and must be protected
 	// by the caller's lock (typically MementoSelection.mu).
@@ -40,8 +92,9 @@ type ConsistentEngine struct {
 // NewConsistentEngine creates a new consistent engine with MementoEngine
 func NewConsistentEngine() *ConsistentEngine {
 	return &ConsistentEngine{
-		engine:      memento.NewMementoEngine(0),
-		indirection: NewIndirection(0),
+		engine:       memento.NewMementoEngine(0),
+		indirection:  NewIndirection(0),
+		removedNodes: make(map[string]int),
 	}
 }
 
@@ -49,27 +102,123 @@ func NewConsistentEngine() *ConsistentEngine {
 // using the specified implementation type (lockFree=true for Lock-Free, false for RWMutex)
 func NewConsistentEngineWithType(lockFree bool) *ConsistentEngine {
 	return &ConsistentEngine{
-		engine:      memento.NewMementoEngineWithType(0, lockFree),
-		indirection: NewIndirection(0),
+		engine:       memento.NewMementoEngineWithType(0, lockFree),
+		indirection:  NewIndirection(0),
+		lockFree:     lockFree,
+		removedNodes: make(map[string]int),
 	}
 }
 
-// GetBucket returns the bucket index for a given key.
-func (ce *ConsistentEngine) GetBucket(key string) *Upstream {
-	bucket := ce.engine.GetBucket(key)
+// SetKeyHasher installs (or, with nil, removes) a key pre-mixer: every
+// lookup key is hashed through fn and the engine's internal hashing
+// runs on the mixed form instead. Changing the hasher on a live engine
+// remaps keys, so it is meant to be called right after construction.
+func (ce *ConsistentEngine) SetKeyHasher(fn hashFunction) {
+	ce.keyHasher = fn
+}
 
-	upstream, err := ce.indirection.GetNodeID(bucket)
-	if err == nil {
-		return upstream
+// mixKey applies the configured key pre-mixer, if any.
+func (ce *ConsistentEngine) mixKey(key string) string {
+	if ce.keyHasher == nil {
+		return key
 	}
+	return strconv.FormatUint(ce.keyHasher(key, ""), 16)
+}
 
-	return nil
+// GetBucket returns the node that owns the given key. The second
+// return value is false only when the topology is empty: a non-empty
+// topology always yields one of its members.
+func (ce *ConsistentEngine) GetBucket(key string) (*Upstream, bool) {
+	return ce.Lookup(key)
+}
+
+// GetBucketBytes is GetBucket for callers that already hold the key as
+// a byte slice, hashing it without a string conversion.
+func (ce *ConsistentEngine) GetBucketBytes(key []byte) (*Upstream, bool) {
+	return ce.LookupBytes(key)
+}
+
+// Lookup atomically resolves a key to its upstream. Callers that check
+// Size, then the engine bucket, then the indirection as separate steps
+// can observe a concurrent topology change in between and get a stale
+// or missing node; Lookup instead resolves everything against the
+// copy-on-write snapshot the memento engine already takes, retrying the
+// (tiny) bucket-to-node window so the result reflects either the old or
+// the new topology, never the intermediate state. If every retry races
+// with churn, a deterministic member of the current topology is chosen
+// instead, so the second return value is false only when the engine is
+// empty. No lock is taken on this read path.
+func (ce *ConsistentEngine) Lookup(key string) (*Upstream, bool) {
+	key = ce.mixKey(key)
+	for attempt := 0; attempt < 3; attempt++ {
+		if ce.engine.Size() == 0 {
+			return nil, false
+		}
+		bucket := ce.engine.GetBucket(key)
+		if upstream, err := ce.indirection.GetNodeID(bucket); err == nil {
+			return upstream, true
+		}
+	}
+	return deterministicNode(ce, key)
+}
+
+// LookupBytes is Lookup for callers that already hold the key as a byte
+// slice. The key is hashed in place by the engine's byte entry points,
+// so the hot path stays free of the per-lookup string conversion (and
+// its allocation). Spelled out rather than shared generically with
+// Lookup: dispatching a generic key to the engine would box it in an
+// interface, reintroducing the very allocation this path removes.
+func (ce *ConsistentEngine) LookupBytes(key []byte) (*Upstream, bool) {
+	if ce.keyHasher != nil {
+		// mixing rebuilds the key anyway, so the byte fast path has
+		// nothing left to save; take the string path
+		return ce.Lookup(string(key))
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		if ce.engine.Size() == 0 {
+			return nil, false
+		}
+		bucket := ce.engine.GetBucketBytes(key)
+		if upstream, err := ce.indirection.GetNodeID(bucket); err == nil {
+			return upstream, true
+		}
+	}
+	return deterministicNode(ce, key)
+}
+
+// keyBytes mirrors the memento package's key constraint: hashing reads
+// keys byte by byte, which both representations support directly.
+type keyBytes interface {
+	~string | ~[]byte
+}
+
+// deterministicNode picks a stable member of the current topology for
+// the given key. It is the last resort when the engine's bucket for the
+// key cannot be resolved against the indirection (e.g. sustained
+// topology churn): every caller with the same key and the same topology
+// gets the same node, unlike the random fallback this replaces.
+func deterministicNode[T keyBytes](ce *ConsistentEngine, key T) (*Upstream, bool) {
+	nodes := ce.indirection.GetAllNodeIDs()
+	if len(nodes) == 0 {
+		return nil, false
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].hashKey() < nodes[j].hashKey()
+	})
+	return nodes[int(hashString(key)%uint64(len(nodes)))], true
+}
+
+// GetBucketIndex returns the raw memento bucket index for a key.
+// This is primarily useful for debugging and preview endpoints;
+// normal selection should use GetBucket.
+func (ce *ConsistentEngine) GetBucketIndex(key string) int {
+	return ce.engine.GetBucket(ce.mixKey(key))
 }
 
 // hashString computes a simple hash of a string
 // This is used for deterministic bucket selection when the original bucket
 // doesn't exist in the indirection
-func hashString(s string) uint64 {
+func hashString[T keyBytes](s T) uint64 {
 	var hash uint64 = 5381
 	for i := 0; i < len(s); i++ {
 		hash = ((hash << 5) + hash) + uint64(s[i])
@@ -77,15 +226,47 @@ func hashString(s string) uint64 {
 	return hash
 }
 
-// AddNode adds a new node to the topology.
+// Typed errors returned by topology mutations. Callers that care why
+// a mutation was rejected match them with errors.Is; every error keeps
+// the topology unchanged.
+var (
+	// ErrEmptyNodeID rejects a nil node or one whose identity
+	// (hashKey: the explicit hash key or the dial address) is empty.
+	// Such a node could never be told apart from "no node" later, so
+	// it is refused up front instead of poisoning the indirection.
+	ErrEmptyNodeID = errors.New("node has an empty identity")
+
+	// ErrDuplicateNode rejects adding or restoring a node that is
+	// already in the topology.
+	ErrDuplicateNode = errors.New("node is already in the topology")
+
+	// ErrUnknownNode rejects removing a node that is not in the
+	// topology.
+	ErrUnknownNode = errors.New("node is not in the topology")
+)
+
+// validNode checks the identity invariant shared by every topology
+// mutation: the node exists and its identity is non-empty.
+func validNode(upstream *Upstream) error {
+	if upstream == nil || upstream.hashKey() == "" {
+		return ErrEmptyNodeID
+	}
+	return nil
+}
+
+// AddNode adds a new node to the topology. The node must have a
+// non-empty identity (ErrEmptyNodeID) and must not already be in the
+// topology (ErrDuplicateNode).
 //
 // NOTE: This method is NOT thread-safe. The caller must hold an appropriate lock
 // (typically MementoSelection.mu with Lock() for writes).
 
 func (ce *ConsistentEngine) AddNode(upstream *Upstream) error {
-	// Check if node already exists
+	if err := validNode(upstream); err != nil {
+		return err
+	}
 	if ce.indirection.HasNode(upstream) {
-		return nil // Node already present
+		return fmt.Errorf("node %s: %w", upstream.String(), ErrDuplicateNode)
 	}
 
 	// Add to MementoEngine first
@@ -99,19 +280,28 @@ func (ce *ConsistentEngine) AddNode(upstream *Upstream) error {
 		return fmt.Errorf("failed to add node %s: %w", upstream.String(), err)
 	}
 
+	// the node is live again under a fresh bucket; any removal record
+	// for its identity is now stale
+	delete(ce.removedNodes, upstream.hashKey())
+
 	return nil
 }
 
-// RemoveNode removes a node from the topology.
+// RemoveNode removes a node from the topology. The node must have a
+// non-empty identity (ErrEmptyNodeID) and must currently be in the
+// topology (ErrUnknownNode).
 //
 // NOTE: This method is NOT thread-safe. The caller must hold an appropriate lock
 // (typically MementoSelection.mu with Lock() for writes).
 
 func (ce *ConsistentEngine) RemoveNode(upstream *Upstream) error {
+	if err := validNode(upstream); err != nil {
+		return err
+	}
 	// Get the bucket for this node from indirection
 	bucket, err := ce.indirection.GetBucket(upstream)
 	if err != nil {
-		return err // Node not found
+		return fmt.Errorf("node %s: %w", upstream.String(), ErrUnknownNode)
 	}
 
 	// Remove from indirection first (following Java implementation order)
@@ -123,14 +313,265 @@ func (ce *ConsistentEngine) RemoveNode(upstream *Upstream) error {
 	// Remove from MementoEngine
 	ce.engine.RemoveBucket(bucket)
 
+	ce.removedNodes[upstream.hashKey()] = bucket
+
 	return nil
 }
 
-// RestoreNode restores a previously removed node
-func (ce *ConsistentEngine) RestoreNode(upstream *Upstream) {
-	// AddNode already handles restoring previously removed nodes
-	// because MementoEngine tracks the last removed bucket
-	ce.AddNode(upstream)
+// AddNodes adds all the given nodes to the topology in a single pass.
+// This is the preferred path when provisioning large pools, since it
+// skips the per-call bookkeeping of repeated AddNode invocations.
+// Nodes already present are skipped (unlike AddNode, which reports
+// them); it stops at the first error, and nodes added before the error
+// remain in the topology. A nil node or one with an empty identity
+// stops the pass with ErrEmptyNodeID.
+func (ce *ConsistentEngine) AddNodes(upstreams []*Upstream) error {
+	for _, upstream := range upstreams {
+		if err := validNode(upstream); err != nil {
+			return err
+		}
+		if ce.indirection.HasNode(upstream) {
+			continue
+		}
+		bucket := ce.engine.AddBucket()
+		if err := ce.indirection.Put(upstream, bucket); err != nil {
+			// Rollback: remove the bucket from engine
+			ce.engine.RemoveBucket(bucket)
+			return fmt.Errorf("failed to add node %s: %w", upstream.String(), err)
+		}
+		delete(ce.removedNodes, upstream.hashKey())
+	}
+	return nil
+}
+
+// RemoveNodes removes all the given nodes from the topology in a single
+// pass. Nodes that are not present are skipped.
+func (ce *ConsistentEngine) RemoveNodes(upstreams []*Upstream) error {
+	for _, upstream := range upstreams {
+		bucket, err := ce.indirection.GetBucket(upstream)
+		if err != nil {
+			continue // node not present
+		}
+		if _, err := ce.indirection.RemoveNode(upstream); err != nil {
+			return fmt.Errorf("failed to remove node %s from indirection: %w", upstream.String(), err)
+		}
+		ce.engine.RemoveBucket(bucket)
+		ce.removedNodes[upstream.hashKey()] = bucket
+	}
+	return nil
+}
+
+// Reset rebuilds the engine from scratch with exactly the given nodes.
+// Unlike removing and re-adding nodes incrementally, a reset does not
+// grow the memento replacement history, so it is the right tool for
+// config reloads that replace most of the topology.
+func (ce *ConsistentEngine) Reset(upstreams []*Upstream) error {
+	ce.engine = memento.NewMementoEngineWithType(0, ce.lockFree)
+	ce.indirection = NewIndirection(len(upstreams))
+	ce.removedNodes = make(map[string]int)
+	return ce.AddNodes(upstreams)
+}
+
+// Clone returns a deep copy of the engine: the memento state (including
+// its replacement history, so the clone maps every key exactly like the
+// original) and the node-to-bucket indirection. Mutating the clone —
+// e.g. removing a node to estimate the blast radius of taking it down —
+// leaves the live engine untouched.
+func (ce *ConsistentEngine) Clone() consistentHasher {
+	removedNodes := make(map[string]int, len(ce.removedNodes))
+	for id, bucket := range ce.removedNodes {
+		removedNodes[id] = bucket
+	}
+	return &ConsistentEngine{
+		engine:       ce.engine.Clone(),
+		indirection:  ce.indirection.Clone(),
+		lockFree:     ce.lockFree,
+		keyHasher:    ce.keyHasher,
+		removedNodes: removedNodes,
+	}
+}
+
+// Compact rebuilds the engine from the current live topology when the
+// memento replacement history holds more than threshold tombstones.
+// Every removal that is never restored leaves a permanent entry that
+// GetBucket must chase through ever-longer replacer chains, so a
+// long-running proxy with autoscaled upstreams pays for churn forever;
+// compaction accepts a one-time key reshuffle in exchange for chain-free
+// lookups. The replacement engine and indirection are built fully aside
+// and swapped in whole, so a concurrent lookup resolves against either
+// the old snapshot or the complete new one, never a half-built state.
+// Returns how many tombstones were collapsed, or 0 if the history was
+// at or below the threshold.
+func (ce *ConsistentEngine) Compact(threshold int) int {
+	tombstones := ce.engine.MementoSize()
+	if tombstones <= threshold {
+		return 0
+	}
+	live := ce.indirection.GetAllNodeIDs()
+	engine := memento.NewMementoEngineWithType(0, ce.lockFree)
+	indirection := NewIndirection(len(live))
+	for _, upstream := range live {
+		bucket := engine.AddBucket()
+		if err := indirection.Put(upstream, bucket); err != nil {
+			// keep serving from the old state rather than swap in a
+			// partial topology; this shouldn't happen in practice
+			return 0
+		}
+	}
+	ce.engine = engine
+	ce.indirection = indirection
+	// compaction collapses the removal history the records point into
+	ce.removedNodes = make(map[string]int)
+	return tombstones
+}
+
+// Rebind replaces each node in the topology with the upstream of the
+// same identity from byID (keyed by hashKey), preserving its bucket.
+// A config reload constructs fresh Upstream values even for an
+// unchanged pool, so an engine preserved across the reload must be
+// re-pointed at the new values before it can serve lookups. An error
+// means some node has no replacement and the engine should not be
+// adopted; nodes rebound before the error keep their new pointers,
+// which is harmless as long as the caller then discards the engine.
+func (ce *ConsistentEngine) Rebind(byID map[string]*Upstream) error {
+	for _, old := range ce.indirection.GetAllNodeIDs() {
+		replacement, ok := byID[old.hashKey()]
+		if !ok {
+			return fmt.Errorf("no replacement upstream for node %s", old.hashKey())
+		}
+		if replacement == old {
+			continue
+		}
+		bucket, err := ce.indirection.RemoveNode(old)
+		if err != nil {
+			return err
+		}
+		if err := ce.indirection.Put(replacement, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consistentEngineSnapshot is the serialized form of a ConsistentEngine:
+// which engine variant took it, the full memento engine state (removal
+// history included), and the node-to-bucket indirection keyed by node
+// identity (hashKey).
+type consistentEngineSnapshot struct {
+	LockFree bool            `json:"lock_free"`
+	Engine   json.RawMessage `json:"engine"`
+	Nodes    map[string]int  `json:"nodes"`
+}
+
+// MarshalBinary serializes the engine as JSON: the node list with its
+// bucket mapping and the complete removal history. A later process can
+// restore it with UnmarshalBinary and skip rebuilding the topology —
+// and reshuffling keys — on a warm restart.
+func (ce *ConsistentEngine) MarshalBinary() ([]byte, error) {
+	engineState, err := ce.engine.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]int, ce.indirection.Size())
+	for _, upstream := range ce.indirection.GetAllNodeIDs() {
+		bucket, err := ce.indirection.GetBucket(upstream)
+		if err != nil {
+			return nil, err
+		}
+		nodes[upstream.hashKey()] = bucket
+	}
+	return json.Marshal(consistentEngineSnapshot{
+		LockFree: ce.lockFree,
+		Engine:   engineState,
+		Nodes:    nodes,
+	})
+}
+
+// UnmarshalBinary replaces the engine state with the one encoded in
+// data. A snapshot taken by the other engine variant is rejected, as
+// is any corrupt or internally inconsistent state; the receiver is
+// left untouched in that case, so the caller can fall back to a fresh
+// build. The restored topology holds placeholder upstreams carrying
+// only the node identity — the caller must Rebind the engine to the
+// live pool before serving lookups.
+func (ce *ConsistentEngine) UnmarshalBinary(data []byte) error {
+	var snap consistentEngineSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.LockFree != ce.lockFree {
+		return fmt.Errorf("snapshot was taken by a different engine variant")
+	}
+	engine := memento.NewMementoEngineWithType(0, ce.lockFree)
+	if err := engine.UnmarshalBinary(snap.Engine); err != nil {
+		return err
+	}
+	if len(snap.Nodes) != engine.Size() {
+		return fmt.Errorf("snapshot maps %d nodes but the engine holds %d", len(snap.Nodes), engine.Size())
+	}
+	indirection := NewIndirection(len(snap.Nodes))
+	for id, bucket := range snap.Nodes {
+		// a placeholder's hashKey() is its dial address, so Rebind can
+		// later match it against the live upstream of the same identity
+		if err := indirection.Put(&Upstream{Dial: id}, bucket); err != nil {
+			return err
+		}
+	}
+	ce.engine = engine
+	ce.indirection = indirection
+	// the snapshot does not carry removed-node records; recovering nodes
+	// are added as new until removals accumulate again
+	ce.removedNodes = make(map[string]int)
+	return nil
+}
+
+// HasNode reports whether the given node is currently in the topology.
+func (ce *ConsistentEngine) HasNode(upstream *Upstream) bool {
+	return ce.indirection.HasNode(upstream)
+}
+
+// IsRemoved reports whether the node was removed from the topology and
+// the engine still remembers its removal, i.e. RestoreNode can give it
+// back its original bucket. A node whose bucket has since been reused
+// by an add is not considered removed: restoring it exactly is no
+// longer possible and it should rejoin as a new node.
+func (ce *ConsistentEngine) IsRemoved(upstream *Upstream) bool {
+	if ce.indirection.HasNode(upstream) {
+		return false
+	}
+	bucket, ok := ce.removedNodes[upstream.hashKey()]
+	return ok && ce.engine.IsRemembered(bucket)
+}
+
+// RestoreNode restores a previously removed node. When the engine still
+// remembers the node's removal, the removal is unwound exactly and the
+// node gets its original bucket back, so the keys it owned before going
+// down return to it — regardless of what else was removed or added in
+// between. AddNode cannot do this: it appends a bucket (reviving the
+// most recently removed one), which after interleaved removals hands
+// the recovering node some other node's keys. A node the engine does
+// not remember is added as a new node instead. The node must have a
+// non-empty identity (ErrEmptyNodeID) and must not already be in the
+// topology (ErrDuplicateNode).
+func (ce *ConsistentEngine) RestoreNode(upstream *Upstream) error {
+	if err := validNode(upstream); err != nil {
+		return err
+	}
+	if ce.indirection.HasNode(upstream) {
+		return fmt.Errorf("node %s: %w", upstream.String(), ErrDuplicateNode)
+	}
+	id := upstream.hashKey()
+	bucket, remembered := ce.removedNodes[id]
+	if !remembered || !ce.engine.RestoreBucket(bucket) {
+		return ce.AddNode(upstream)
+	}
+	if err := ce.indirection.Put(upstream, bucket); err != nil {
+		// roll the restore back and fall back to a plain add
+		ce.engine.RemoveBucket(bucket)
+		return ce.AddNode(upstream)
+	}
+	delete(ce.removedNodes, id)
+	return nil
 }
 
 // GetTopology returns the current topology (list of node IDs).
@@ -164,6 +605,15 @@ func (ce *ConsistentEngine) GetMementoStats() map[string]interface{} {
 	}
 }
 
+// KeyShareEstimate samples sampleSize synthetic keys through Lookup and
+// returns the fraction of the keyspace each node currently owns. The
+// sample keys are deterministic, so repeated calls on an unchanged
+// topology return identical shares (consecutive metric scrapes don't
+// jitter). A non-positive sampleSize uses the default sample size.
+func (ce *ConsistentEngine) KeyShareEstimate(sampleSize int) map[*Upstream]float64 {
+	return estimateKeyShares(ce, sampleSize)
+}
+
 // String returns a string representation of the consistent engine.
 //
 // NOTE: This method is NOT thread-safe. The caller must hold an appropriate lock
@@ -173,15 +623,22 @@ func (ce *ConsistentEngine) String() string {
 		ce.engine.String(), ce.indirection.Size())
 }
 
-// GetNodeID returns the node ID for a given bucket index.
+// GetNodeID returns the node for a given bucket index. The second
+// return value is false when the bucket is not mapped to any node; a
+// mapped bucket always yields a non-nil node (adds with an empty
+// identity are rejected), so the sentinel can never be confused with
+// a legitimate value.
 //
 // NOTE: This method is NOT thread-safe. The caller must hold an appropriate lock
 // (typically MementoSelection.mu with RLock() for reads).
 
-func (ce *ConsistentEngine) GetNodeID(bucket int) *Upstream {
+func (ce *ConsistentEngine) GetNodeID(bucket int) (*Upstream, bool) {
 	upstream, err := ce.indirection.GetNodeID(bucket)
 	if err != nil {
-		return nil // Return nil if bucket doesn't exist
+		return nil, false
 	}
-	return upstream
+	return upstream, true
 }
+
+// Interface guard
+var _ consistentHasher = (*ConsistentEngine)(nil)
@@ -15,6 +15,7 @@
 package reverseproxy
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
@@ -45,9 +46,9 @@ func TestConsistentEngine(t *testing.T) {
 		t.Errorf("Expected size 5, got %d", consistentEngine.Size())
 	}
 
-	upstream := consistentEngine.GetBucket("test-key")
-	if upstream == nil {
-		t.Fatal("Expected non-nil upstream for key")
+	upstream, ok := consistentEngine.GetBucket("test-key")
+	if !ok {
+		t.Fatal("Expected an upstream for key")
 	}
 	found := false
 	for _, up := range upstreams {
@@ -119,11 +120,11 @@ func TestConsistentEngineConsistency(t *testing.T) {
 	}
 
 	key := "consistent-test-key"
-	upstream1 := consistentEngine.GetBucket(key)
-	upstream2 := consistentEngine.GetBucket(key)
+	upstream1, ok1 := consistentEngine.GetBucket(key)
+	upstream2, ok2 := consistentEngine.GetBucket(key)
 
-	if upstream1 == nil || upstream2 == nil {
-		t.Fatal("Expected non-nil upstream for key")
+	if !ok1 || !ok2 {
+		t.Fatal("Expected an upstream for key")
 	}
 	if upstream1 != upstream2 {
 		t.Errorf("Inconsistent mapping: %s vs %s", upstream1.String(), upstream2.String())
@@ -131,11 +132,11 @@ func TestConsistentEngineConsistency(t *testing.T) {
 
 	consistentEngine.RemoveNode(upstreams[2])
 
-	upstream3 := consistentEngine.GetBucket(key)
-	upstream4 := consistentEngine.GetBucket(key)
+	upstream3, ok3 := consistentEngine.GetBucket(key)
+	upstream4, ok4 := consistentEngine.GetBucket(key)
 
-	if upstream3 == nil || upstream4 == nil {
-		t.Fatal("Expected non-nil upstream for key after removal")
+	if !ok3 || !ok4 {
+		t.Fatal("Expected an upstream for key after removal")
 	}
 	if upstream3 != upstream4 {
 		t.Errorf("Inconsistent mapping after removal: %s vs %s", upstream3.String(), upstream4.String())
@@ -164,8 +165,8 @@ func TestConsistentEngineLoadBalancing(t *testing.T) {
 	nodeCounts := make(map[string]int, N)
 	for i := 0; i < K; i++ {
 		key := fmt.Sprintf("consistent-key-%d", i)
-		up := consistentEngine.GetBucket(key)
-		if up == nil {
+		up, ok := consistentEngine.GetBucket(key)
+		if !ok {
 			t.Fatalf("Invalid upstream for key %s", key)
 		}
 		nodeCounts[up.String()]++
@@ -244,8 +245,8 @@ func TestMementoLoadBalancing(t *testing.T) {
 
 	for i := 0; i < numKeys; i++ {
 		key := fmt.Sprintf("memento-key-%d", i)
-		up := consistentEngine.GetBucket(key)
-		if up == nil {
+		up, ok := consistentEngine.GetBucket(key)
+		if !ok {
 			t.Fatalf("Invalid upstream for key %s", key)
 		}
 		index, ok := indexByUpstream[up]
@@ -285,10 +286,10 @@ func TestMementoLoadBalancing(t *testing.T) {
 
 	for i := 0; i < numKeys; i++ {
 		key := fmt.Sprintf("memento-key-%d", i)
-		upAfter := consistentEngine.GetBucket(key)
+		upAfter, ok := consistentEngine.GetBucket(key)
 		upBefore := keyToUpstream[key]
 
-		if upAfter == nil {
+		if !ok {
 			t.Errorf("Invalid upstream for key %s after removal", key)
 			continue
 		}
@@ -407,8 +408,8 @@ func TestConsistentEngineLoadBalancingLockFree(t *testing.T) {
 	nodeCounts := make(map[string]int, N)
 	for i := 0; i < K; i++ {
 		key := fmt.Sprintf("consistent-key-%d", i)
-		up := consistentEngine.GetBucket(key)
-		if up == nil {
+		up, ok := consistentEngine.GetBucket(key)
+		if !ok {
 			t.Fatalf("Invalid upstream for key %s", key)
 		}
 		nodeCounts[up.String()]++
@@ -471,6 +472,613 @@ func BenchmarkConsistentEngineGetBucket(b *testing.B) {
 	key := "benchmark-key"
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = consistentEngine.GetBucket(key)
+		_, _ = consistentEngine.GetBucket(key)
+	}
+}
+
+func TestConsistentEngineBulkOperations(t *testing.T) {
+	consistentEngine := NewConsistentEngine()
+
+	upstreams := make([]*Upstream, 0, 10)
+	for i := 0; i < 10; i++ {
+		upstreams = append(upstreams, makeUpstream(fmt.Sprintf("node%d", i)))
+	}
+
+	if err := consistentEngine.AddNodes(upstreams); err != nil {
+		t.Fatalf("AddNodes error: %v", err)
+	}
+	if consistentEngine.Size() != 10 {
+		t.Errorf("Expected size 10 after AddNodes, got %d", consistentEngine.Size())
+	}
+
+	// adding the same nodes again is a no-op
+	if err := consistentEngine.AddNodes(upstreams); err != nil {
+		t.Fatalf("AddNodes error on duplicate add: %v", err)
+	}
+	if consistentEngine.Size() != 10 {
+		t.Errorf("Expected size 10 after duplicate AddNodes, got %d", consistentEngine.Size())
+	}
+
+	if err := consistentEngine.RemoveNodes(upstreams[:5]); err != nil {
+		t.Fatalf("RemoveNodes error: %v", err)
+	}
+	if consistentEngine.Size() != 5 {
+		t.Errorf("Expected size 5 after RemoveNodes, got %d", consistentEngine.Size())
+	}
+	for _, up := range upstreams[:5] {
+		if consistentEngine.HasNode(up) {
+			t.Errorf("Expected node %s to be removed", up.String())
+		}
+	}
+
+	// a reset rebuilds the engine with a clean memento history
+	if err := consistentEngine.Reset(upstreams); err != nil {
+		t.Fatalf("Reset error: %v", err)
+	}
+	if consistentEngine.Size() != 10 {
+		t.Errorf("Expected size 10 after Reset, got %d", consistentEngine.Size())
+	}
+	stats := consistentEngine.GetMementoStats()
+	if stats["memento_size"].(int) != 0 {
+		t.Errorf("Expected empty memento history after Reset, got %v", stats["memento_size"])
+	}
+
+	if _, ok := consistentEngine.GetBucket("bulk-key"); !ok {
+		t.Fatal("Expected an upstream for key after Reset")
+	}
+}
+
+func BenchmarkConsistentEngineProvisioning(b *testing.B) {
+	const numNodes = 1000
+	upstreams := make([]*Upstream, 0, numNodes)
+	for i := 0; i < numNodes; i++ {
+		upstreams = append(upstreams, makeUpstream(fmt.Sprintf("node%d", i)))
+	}
+
+	b.Run("AddNode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			consistentEngine := NewConsistentEngine()
+			for _, up := range upstreams {
+				consistentEngine.AddNode(up)
+			}
+		}
+	})
+
+	b.Run("AddNodes", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			consistentEngine := NewConsistentEngine()
+			consistentEngine.AddNodes(upstreams)
+		}
+	})
+
+	b.Run("Reset", func(b *testing.B) {
+		consistentEngine := NewConsistentEngine()
+		for i := 0; i < b.N; i++ {
+			consistentEngine.Reset(upstreams)
+		}
+	})
+}
+
+func TestConsistentEngineBothVariants(t *testing.T) {
+	for _, variant := range []struct {
+		name     string
+		lockFree bool
+	}{
+		{"rwmutex", false},
+		{"lockfree", true},
+	} {
+		t.Run(variant.name, func(t *testing.T) {
+			consistentEngine := NewConsistentEngineWithType(variant.lockFree)
+
+			upstreams := make([]*Upstream, 0, 10)
+			for i := 0; i < 10; i++ {
+				up := makeUpstream(fmt.Sprintf("node%d", i))
+				upstreams = append(upstreams, up)
+				if err := consistentEngine.AddNode(up); err != nil {
+					t.Fatalf("AddNode failed: %v", err)
+				}
+			}
+			if consistentEngine.Size() != 10 {
+				t.Fatalf("Expected size 10, got %d", consistentEngine.Size())
+			}
+
+			// Record the initial mapping and verify it is stable
+			const numKeys = 1000
+			mapping := make(map[string]*Upstream, numKeys)
+			for i := 0; i < numKeys; i++ {
+				key := fmt.Sprintf("key%d", i)
+				upstream, ok := consistentEngine.Lookup(key)
+				if !ok {
+					t.Fatalf("Lookup failed for %s", key)
+				}
+				if again, _ := consistentEngine.Lookup(key); again != upstream {
+					t.Fatalf("Unstable mapping for %s", key)
+				}
+				mapping[key] = upstream
+			}
+
+			// Removing one node must only remap the keys it owned
+			removed := upstreams[3]
+			if err := consistentEngine.RemoveNode(removed); err != nil {
+				t.Fatalf("RemoveNode failed: %v", err)
+			}
+			for key, before := range mapping {
+				after, ok := consistentEngine.Lookup(key)
+				if !ok {
+					t.Fatalf("Lookup failed for %s after removal", key)
+				}
+				if after == removed {
+					t.Fatalf("Key %s still maps to removed node", key)
+				}
+				if before != removed && after != before {
+					t.Errorf("Key %s remapped from %s to %s although its node was not removed",
+						key, before.String(), after.String())
+				}
+			}
+
+			// Reset rebuilds an engine of the same variant with the full pool
+			if err := consistentEngine.Reset(upstreams); err != nil {
+				t.Fatalf("Reset failed: %v", err)
+			}
+			if consistentEngine.Size() != 10 {
+				t.Fatalf("Expected size 10 after Reset, got %d", consistentEngine.Size())
+			}
+			if upstream, ok := consistentEngine.Lookup("reset-key"); !ok || upstream == nil {
+				t.Fatal("Expected successful lookup after Reset")
+			}
+		})
+	}
+}
+
+func TestConsistentEngineCompact(t *testing.T) {
+	consistentEngine := NewConsistentEngine()
+
+	upstreams := make([]*Upstream, 0, 20)
+	for i := 0; i < 20; i++ {
+		upstreams = append(upstreams, makeUpstream(fmt.Sprintf("node%d", i)))
+	}
+	if err := consistentEngine.AddNodes(upstreams); err != nil {
+		t.Fatalf("AddNodes error: %v", err)
+	}
+	if err := consistentEngine.RemoveNodes(upstreams[10:]); err != nil {
+		t.Fatalf("RemoveNodes error: %v", err)
+	}
+
+	tombstones := consistentEngine.GetMementoStats()["memento_size"].(int)
+	if tombstones == 0 {
+		t.Fatal("Expected removals to leave tombstones in the memento history")
+	}
+
+	// below or at the threshold nothing happens
+	if collapsed := consistentEngine.Compact(tombstones); collapsed != 0 {
+		t.Errorf("Expected no compaction at the threshold, collapsed %d", collapsed)
+	}
+
+	// above the threshold the engine is rebuilt from the live topology
+	collapsed := consistentEngine.Compact(5)
+	if collapsed != tombstones {
+		t.Errorf("Expected compaction to collapse %d tombstones, got %d", tombstones, collapsed)
+	}
+	if got := consistentEngine.GetMementoStats()["memento_size"].(int); got != 0 {
+		t.Errorf("Expected an empty memento history after compaction, got %d", got)
+	}
+	if consistentEngine.Size() != 10 {
+		t.Errorf("Expected the live topology to survive compaction, size is %d", consistentEngine.Size())
+	}
+	for _, up := range upstreams[:10] {
+		if !consistentEngine.HasNode(up) {
+			t.Errorf("Expected live node %s to survive compaction", up.String())
+		}
+	}
+	for _, up := range upstreams[10:] {
+		if consistentEngine.HasNode(up) {
+			t.Errorf("Expected removed node %s to stay gone after compaction", up.String())
+		}
+	}
+
+	// mappings are reshuffled once but stay consistent afterwards
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("compact-key-%d", i)
+		first, ok := consistentEngine.GetBucket(key)
+		if !ok {
+			t.Fatalf("Expected an upstream for key %s after compaction", key)
+		}
+		for j := 0; j < 5; j++ {
+			if got, _ := consistentEngine.GetBucket(key); got != first {
+				t.Errorf("Key %s: inconsistent mapping after compaction - got %s and %s",
+					key, first.String(), got.String())
+			}
+		}
+	}
+}
+
+// BenchmarkConsistentEngineLookupCompaction contrasts lookup latency on
+// an engine carrying 500 tombstones with the same topology after
+// compaction collapses them.
+func BenchmarkConsistentEngineLookupCompaction(b *testing.B) {
+	const liveNodes = 50
+	const tombstones = 500
+
+	buildEngine := func() *ConsistentEngine {
+		consistentEngine := NewConsistentEngine()
+		doomed := make([]*Upstream, 0, tombstones)
+		for i := 0; i < liveNodes+tombstones; i++ {
+			up := makeUpstream(fmt.Sprintf("node%d", i))
+			consistentEngine.AddNode(up)
+			if i >= liveNodes {
+				doomed = append(doomed, up)
+			}
+		}
+		consistentEngine.RemoveNodes(doomed)
+		return consistentEngine
+	}
+
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("bench-key-%d", i)
+	}
+
+	b.Run("BeforeCompaction", func(b *testing.B) {
+		consistentEngine := buildEngine()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = consistentEngine.GetBucket(keys[i%len(keys)])
+		}
+	})
+
+	b.Run("AfterCompaction", func(b *testing.B) {
+		consistentEngine := buildEngine()
+		if collapsed := consistentEngine.Compact(0); collapsed != tombstones {
+			b.Fatalf("Expected compaction to collapse %d tombstones, got %d", tombstones, collapsed)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = consistentEngine.GetBucket(keys[i%len(keys)])
+		}
+	})
+}
+
+// TestConsistentEngineSnapshotRoundTrip proves that serializing an
+// engine and restoring the snapshot into a fresh engine of the same
+// variant preserves the key-to-node mapping exactly, including the
+// removal history accumulated through removals and restores.
+func TestConsistentEngineSnapshotRoundTrip(t *testing.T) {
+	for _, variant := range []struct {
+		name     string
+		lockFree bool
+	}{
+		{"rwmutex", false},
+		{"lockfree", true},
+	} {
+		t.Run(variant.name, func(t *testing.T) {
+			consistentEngine := NewConsistentEngineWithType(variant.lockFree)
+			upstreams := make([]*Upstream, 0, 12)
+			for i := 0; i < 12; i++ {
+				upstreams = append(upstreams, makeUpstream(fmt.Sprintf("node%d", i)))
+			}
+			if err := consistentEngine.AddNodes(upstreams); err != nil {
+				t.Fatalf("AddNodes error: %v", err)
+			}
+
+			// leave tombstones behind: remove a few nodes and restore one
+			for _, i := range []int{2, 7, 9} {
+				if err := consistentEngine.RemoveNode(upstreams[i]); err != nil {
+					t.Fatalf("RemoveNode error: %v", err)
+				}
+			}
+			consistentEngine.RestoreNode(upstreams[9])
+
+			data, err := consistentEngine.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary error: %v", err)
+			}
+
+			restored := NewConsistentEngineWithType(variant.lockFree)
+			if err := restored.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary error: %v", err)
+			}
+			byID := make(map[string]*Upstream, len(upstreams))
+			for _, upstream := range upstreams {
+				byID[upstream.hashKey()] = upstream
+			}
+			if err := restored.Rebind(byID); err != nil {
+				t.Fatalf("Rebind error: %v", err)
+			}
+
+			if restored.Size() != consistentEngine.Size() {
+				t.Fatalf("Expected restored size %d, got %d", consistentEngine.Size(), restored.Size())
+			}
+			const numKeys = 10000
+			for i := 0; i < numKeys; i++ {
+				key := fmt.Sprintf("snapshot-key-%d", i)
+				want, ok := consistentEngine.Lookup(key)
+				if !ok {
+					t.Fatalf("Lookup failed for %s", key)
+				}
+				got, ok := restored.Lookup(key)
+				if !ok {
+					t.Fatalf("Restored lookup failed for %s", key)
+				}
+				if got != want {
+					t.Fatalf("Key %s: expected %s after round trip, got %s", key, want.String(), got.String())
+				}
+			}
+
+			// the restored engine must evolve identically under further
+			// removals and restores
+			if err := consistentEngine.RemoveNode(upstreams[5]); err != nil {
+				t.Fatalf("RemoveNode error: %v", err)
+			}
+			if err := restored.RemoveNode(upstreams[5]); err != nil {
+				t.Fatalf("RemoveNode on restored engine error: %v", err)
+			}
+			consistentEngine.RestoreNode(upstreams[5])
+			restored.RestoreNode(upstreams[5])
+			for i := 0; i < numKeys; i++ {
+				key := fmt.Sprintf("snapshot-key-%d", i)
+				want, _ := consistentEngine.Lookup(key)
+				got, _ := restored.Lookup(key)
+				if got != want {
+					t.Fatalf("Key %s: engines diverged after post-restore churn", key)
+				}
+			}
+		})
+	}
+}
+
+// TestConsistentEngineSnapshotRejectsMismatches verifies that corrupt
+// snapshots and snapshots from the other engine variant are rejected
+// with the receiver left untouched.
+func TestConsistentEngineSnapshotRejectsMismatches(t *testing.T) {
+	lockFreeEngine := NewConsistentEngineWithType(true)
+	upstreams := make([]*Upstream, 0, 5)
+	for i := 0; i < 5; i++ {
+		upstreams = append(upstreams, makeUpstream(fmt.Sprintf("node%d", i)))
+	}
+	if err := lockFreeEngine.AddNodes(upstreams); err != nil {
+		t.Fatalf("AddNodes error: %v", err)
+	}
+	data, err := lockFreeEngine.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary error: %v", err)
+	}
+
+	// a snapshot from the other variant must be rejected
+	rwMutexEngine := NewConsistentEngineWithType(false)
+	if err := rwMutexEngine.UnmarshalBinary(data); err == nil {
+		t.Error("Expected error restoring a lock-free snapshot into an rwmutex engine")
+	}
+
+	// corrupt payloads must be rejected without touching the engine
+	before := make(map[string]*Upstream)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("mismatch-key-%d", i)
+		before[key], _ = lockFreeEngine.Lookup(key)
+	}
+	for name, corrupt := range map[string]string{
+		"not json":       "definitely not json",
+		"missing nodes":  `{"lock_free":true,"engine":{"binomial_size":5,"enclosing_tree_filter":7,"minor_tree_filter":3,"last_removed":5,"removals":[]},"nodes":{}}`,
+		"corrupt engine": `{"lock_free":true,"engine":{"binomial_size":-2},"nodes":{}}`,
+	} {
+		if err := lockFreeEngine.UnmarshalBinary([]byte(corrupt)); err == nil {
+			t.Errorf("Expected error restoring %s snapshot", name)
+		}
+	}
+	for key, want := range before {
+		if got, _ := lockFreeEngine.Lookup(key); got != want {
+			t.Fatalf("Key %s: engine state disturbed by rejected restores", key)
+		}
+	}
+}
+
+func TestConsistentEngineLookupBytesParity(t *testing.T) {
+	consistentEngine := NewConsistentEngine()
+	upstreams := make([]*Upstream, 0, 20)
+	for i := 0; i < 20; i++ {
+		upstreams = append(upstreams, makeUpstream(fmt.Sprintf("node%d", i)))
+	}
+	if err := consistentEngine.AddNodes(upstreams); err != nil {
+		t.Fatalf("AddNodes error: %v", err)
+	}
+
+	// removals leave memento history behind, so byte lookups also
+	// follow replacement chains
+	for _, upstream := range upstreams[:5] {
+		if err := consistentEngine.RemoveNode(upstream); err != nil {
+			t.Fatalf("RemoveNode error: %v", err)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("parity-key-%d", i)
+		fromString, okString := consistentEngine.Lookup(key)
+		fromBytes, okBytes := consistentEngine.LookupBytes([]byte(key))
+		if okString != okBytes || fromString != fromBytes {
+			t.Fatalf("LookupBytes(%q) = (%v, %v), Lookup = (%v, %v)",
+				key, fromBytes, okBytes, fromString, okString)
+		}
+	}
+}
+
+func BenchmarkConsistentEngineLookupBytes(b *testing.B) {
+	consistentEngine := NewConsistentEngineWithType(true)
+	for i := 0; i < 100; i++ {
+		consistentEngine.AddNode(makeUpstream(fmt.Sprintf("node%d", i)))
+	}
+
+	key := []byte("benchmark-key")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = consistentEngine.LookupBytes(key)
+	}
+}
+
+func TestConsistentEngineIsRemoved(t *testing.T) {
+	consistentEngine := NewConsistentEngine()
+
+	upstreams := make([]*Upstream, 0, 5)
+	for i := 0; i < 5; i++ {
+		up := makeUpstream(fmt.Sprintf("node%d", i))
+		upstreams = append(upstreams, up)
+		consistentEngine.AddNode(up)
+	}
+
+	if consistentEngine.IsRemoved(upstreams[2]) {
+		t.Error("A live node must not be reported as removed")
+	}
+	if consistentEngine.IsRemoved(makeUpstream("stranger")) {
+		t.Error("A node the engine never saw must not be reported as removed")
+	}
+
+	if err := consistentEngine.RemoveNode(upstreams[2]); err != nil {
+		t.Fatalf("RemoveNode error: %v", err)
+	}
+	if !consistentEngine.IsRemoved(upstreams[2]) {
+		t.Error("A removed node whose bucket is still remembered must be reported as removed")
+	}
+
+	consistentEngine.RestoreNode(upstreams[2])
+	if consistentEngine.IsRemoved(upstreams[2]) {
+		t.Error("A restored node must no longer be reported as removed")
+	}
+	if !consistentEngine.HasNode(upstreams[2]) {
+		t.Error("Expected the restored node to be back in the topology")
+	}
+
+	// once an add reuses a removed node's bucket, restoring it exactly is
+	// no longer possible and it must not be reported as removed
+	if err := consistentEngine.RemoveNode(upstreams[4]); err != nil {
+		t.Fatalf("RemoveNode error: %v", err)
+	}
+	consistentEngine.AddNode(makeUpstream("replacement"))
+	if consistentEngine.IsRemoved(upstreams[4]) {
+		t.Error("A node whose bucket was reused must not be reported as removed")
+	}
+}
+
+// TestConsistentEngineRestoreNodeNonLIFO flaps one node several times
+// while another node goes down after it each time, so the flapping node
+// is never the most recently removed one when it recovers. RestoreNode
+// must still give it its original bucket back — AddNode would hand it
+// the other node's bucket and swap their keys.
+func TestConsistentEngineRestoreNodeNonLIFO(t *testing.T) {
+	consistentEngine := NewConsistentEngine()
+
+	const numNodes = 10
+	upstreams := make([]*Upstream, 0, numNodes)
+	for i := 0; i < numNodes; i++ {
+		up := makeUpstream(fmt.Sprintf("node%d", i))
+		upstreams = append(upstreams, up)
+		consistentEngine.AddNode(up)
+	}
+
+	const numKeys = 500
+	baseline := make(map[string]*Upstream, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("restore-key-%d", i)
+		owner, ok := consistentEngine.GetBucket(key)
+		if !ok {
+			t.Fatalf("No owner for key %s", key)
+		}
+		baseline[key] = owner
+	}
+
+	flapping := upstreams[3]
+	other := upstreams[7]
+	for round := 0; round < 3; round++ {
+		if err := consistentEngine.RemoveNode(flapping); err != nil {
+			t.Fatalf("Round %d: removing the flapping node: %v", round, err)
+		}
+		if err := consistentEngine.RemoveNode(other); err != nil {
+			t.Fatalf("Round %d: removing the other node: %v", round, err)
+		}
+
+		// the other node went down after the flapping one, so a LIFO
+		// restore (AddNode) would hand the flapping node its bucket
+		if !consistentEngine.IsRemoved(flapping) {
+			t.Fatalf("Round %d: expected the flapping node to be remembered as removed", round)
+		}
+		consistentEngine.RestoreNode(flapping)
+
+		for key, owner := range baseline {
+			if owner != flapping {
+				continue
+			}
+			got, ok := consistentEngine.GetBucket(key)
+			if !ok || got != flapping {
+				t.Fatalf("Round %d: key %s belonged to the flapping node but now maps to %v",
+					round, key, got)
+			}
+		}
+
+		// once the other node recovers too, the whole mapping must be
+		// back to the baseline
+		consistentEngine.RestoreNode(other)
+		for key, owner := range baseline {
+			got, ok := consistentEngine.GetBucket(key)
+			if !ok || got != owner {
+				t.Fatalf("Round %d: key %s mapped to %v after full recovery, expected %s",
+					round, key, got, owner.String())
+			}
+		}
+	}
+}
+
+func TestConsistentEngineTypedErrors(t *testing.T) {
+	consistentEngine := NewConsistentEngine()
+
+	// a node without an identity can never be resolved later, so
+	// every mutation refuses it up front
+	if err := consistentEngine.AddNode(nil); !errors.Is(err, ErrEmptyNodeID) {
+		t.Errorf("Expected ErrEmptyNodeID adding nil, got %v", err)
+	}
+	if err := consistentEngine.AddNode(&Upstream{Host: new(Host)}); !errors.Is(err, ErrEmptyNodeID) {
+		t.Errorf("Expected ErrEmptyNodeID adding an empty identity, got %v", err)
+	}
+	if err := consistentEngine.RemoveNode(nil); !errors.Is(err, ErrEmptyNodeID) {
+		t.Errorf("Expected ErrEmptyNodeID removing nil, got %v", err)
+	}
+	if err := consistentEngine.RestoreNode(&Upstream{Host: new(Host)}); !errors.Is(err, ErrEmptyNodeID) {
+		t.Errorf("Expected ErrEmptyNodeID restoring an empty identity, got %v", err)
+	}
+	if err := consistentEngine.AddNodes([]*Upstream{makeUpstream("node0"), nil}); !errors.Is(err, ErrEmptyNodeID) {
+		t.Errorf("Expected ErrEmptyNodeID bulk-adding nil, got %v", err)
+	}
+	if consistentEngine.Size() != 1 {
+		t.Errorf("Expected only the valid node in the topology, got size %d", consistentEngine.Size())
+	}
+
+	up := makeUpstream("node1")
+	if err := consistentEngine.AddNode(up); err != nil {
+		t.Fatalf("AddNode error: %v", err)
+	}
+	if err := consistentEngine.AddNode(up); !errors.Is(err, ErrDuplicateNode) {
+		t.Errorf("Expected ErrDuplicateNode re-adding a node, got %v", err)
+	}
+	if err := consistentEngine.RestoreNode(up); !errors.Is(err, ErrDuplicateNode) {
+		t.Errorf("Expected ErrDuplicateNode restoring a live node, got %v", err)
+	}
+
+	if err := consistentEngine.RemoveNode(makeUpstream("stranger")); !errors.Is(err, ErrUnknownNode) {
+		t.Errorf("Expected ErrUnknownNode removing a stranger, got %v", err)
+	}
+
+	// every rejected mutation left the topology untouched
+	if consistentEngine.Size() != 2 {
+		t.Errorf("Expected size 2 after rejected mutations, got %d", consistentEngine.Size())
+	}
+
+	// the success paths still report nil
+	if err := consistentEngine.RemoveNode(up); err != nil {
+		t.Errorf("RemoveNode error: %v", err)
+	}
+	if err := consistentEngine.RestoreNode(up); err != nil {
+		t.Errorf("RestoreNode error: %v", err)
+	}
+	// a restore the engine does not remember falls back to a plain
+	// add, which is still a success
+	if err := consistentEngine.RestoreNode(makeUpstream("node2")); err != nil {
+		t.Errorf("RestoreNode (fallback add) error: %v", err)
 	}
 }
@@ -0,0 +1,127 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Count weighting modes: how a load-comparing selection policy counts
+// a host's in-flight requests.
+const (
+	// countWeightingRaw is the default: the plain in-flight count.
+	countWeightingRaw = "raw"
+
+	// countWeightingAgeDiscounted decays each in-flight request's
+	// contribution exponentially with its age, so one hung request
+	// (an upstream holding a connection open against a long timeout)
+	// stops inflating the host's apparent load after a few
+	// half-lives instead of starving it of new work indefinitely.
+	countWeightingAgeDiscounted = "age_discounted"
+)
+
+// countWeightingChooser is the load-counting configuration shared by
+// the selection policies that compare hosts by in-flight requests.
+type countWeightingChooser struct {
+	// How in-flight requests are counted when comparing hosts:
+	// "raw" (the default) uses the plain count; "age_discounted"
+	// decays each request's contribution exponentially with its age,
+	// so a host stuck behind one hung request still receives a fair
+	// share of new work.
+	CountWeighting string `json:"count_weighting,omitempty"`
+
+	// The half-life of the exponential decay used by the
+	// age_discounted mode: an in-flight request counts for half after
+	// this long, a quarter after twice as long, and so on. Defaults
+	// to 1m.
+	DecayHalfLife caddy.Duration `json:"decay_half_life,omitempty"`
+}
+
+// provisionCountWeighting validates the configured mode and applies
+// the half-life default.
+func (c *countWeightingChooser) provisionCountWeighting() error {
+	switch c.CountWeighting {
+	case "", countWeightingRaw:
+	case countWeightingAgeDiscounted:
+		if c.DecayHalfLife < 0 {
+			return fmt.Errorf("decay_half_life must be positive, got %v", time.Duration(c.DecayHalfLife))
+		}
+		if c.DecayHalfLife == 0 {
+			c.DecayHalfLife = caddy.Duration(time.Minute)
+		}
+	default:
+		return fmt.Errorf("unrecognized count_weighting '%s': must be 'raw' or 'age_discounted'", c.CountWeighting)
+	}
+	return nil
+}
+
+// ageDiscounted reports whether the age_discounted mode is active.
+func (c *countWeightingChooser) ageDiscounted() bool {
+	return c.CountWeighting == countWeightingAgeDiscounted
+}
+
+// applyCountWeighting enables age-discounted load tracking on each
+// host in the pool. Policies call this from PopulateInitialTopology;
+// it is a no-op in raw mode, so hosts pay for the extra bookkeeping in
+// countRequest only when a policy asked for it.
+func (c *countWeightingChooser) applyCountWeighting(upstreams []*Upstream) {
+	if !c.ageDiscounted() {
+		return
+	}
+	for _, upstream := range upstreams {
+		if upstream == nil || upstream.Host == nil {
+			continue
+		}
+		upstream.enableAgeDiscounting(time.Duration(c.DecayHalfLife))
+	}
+}
+
+// hostLoad returns the host's in-flight load under the configured
+// weighting.
+func (c *countWeightingChooser) hostLoad(upstream *Upstream) float64 {
+	if c.ageDiscounted() {
+		return upstream.effectiveRequests()
+	}
+	return float64(upstream.NumRequests())
+}
+
+// unmarshalCountWeightingOption handles the count_weighting and
+// decay_half_life sub-directives from a policy's Caddyfile block. It
+// reports whether the current directive was one of them.
+func (c *countWeightingChooser) unmarshalCountWeightingOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "count_weighting":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.CountWeighting = d.Val()
+	case "decay_half_life":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		halfLife, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid decay_half_life '%s': %v", d.Val(), err)
+		}
+		c.DecayHalfLife = caddy.Duration(halfLife)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
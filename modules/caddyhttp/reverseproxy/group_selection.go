@@ -0,0 +1,360 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	weakrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// GroupSelection is a composite policy that splits the pool into named
+// groups of upstreams, picks a group by weight, and delegates to the
+// group's own inner policy over its members. One handler can then run,
+// say, a 95/5 primary/canary split with least_conn inside the primary
+// group and round_robin inside the canary, instead of two handlers and
+// a weighted rewrite. The group pick is random by default; configuring
+// a key makes it deterministic per client, so canary assignment is
+// sticky. A group whose members are all unavailable drops out of the
+// pick and its weight redistributes over the remaining groups.
+type GroupSelection struct {
+	// The groups to split the pool into. Upstreams listed in no
+	// group are never selected by this policy.
+	Groups []SelectionGroup `json:"groups,omitempty"`
+
+	// How to derive the group-pick key from the request: "ip" or
+	// "client_ip". Empty (the default) picks a weighted-random group
+	// per request.
+	Key string `json:"key,omitempty"`
+
+	groups []*selectionGroupState
+	logger *zap.Logger
+}
+
+// SelectionGroup configures one group of a groups policy.
+type SelectionGroup struct {
+	// The group name, used in logs and admin output.
+	Name string `json:"name"`
+
+	// The group's relative share of traffic. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+
+	// The dial addresses (or explicit hash keys) of the group's
+	// member upstreams.
+	Dials []string `json:"dials,omitempty"`
+
+	// The selection policy to run over the group's members.
+	// Defaults to `random`.
+	PolicyRaw json.RawMessage `json:"policy,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+}
+
+// selectionGroupState is the runtime view of one configured group.
+type selectionGroupState struct {
+	name    string
+	weight  int
+	members map[string]bool
+	policy  Selector
+}
+
+// owns reports whether the upstream is a member of the group, by the
+// same identity matching the tiered policy uses: explicit hash key
+// first, then the dial address as written and in canonical form.
+func (g *selectionGroupState) owns(upstream *Upstream) bool {
+	return g.members[upstream.hashKey()] ||
+		g.members[upstream.Dial] ||
+		g.members[upstream.String()]
+}
+
+// CaddyModule returns the Caddy module information.
+func (GroupSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.groups",
+		New: func() caddy.Module { return new(GroupSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *GroupSelection) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger()
+	switch s.Key {
+	case "", "ip", "client_ip":
+	default:
+		return fmt.Errorf("unrecognized key '%s': must be 'ip' or 'client_ip'", s.Key)
+	}
+	if len(s.Groups) == 0 {
+		return fmt.Errorf("at least one group is required")
+	}
+	names := make(map[string]bool, len(s.Groups))
+	for i := range s.Groups {
+		group := &s.Groups[i]
+		if group.Name == "" {
+			return fmt.Errorf("group %d has no name", i)
+		}
+		if names[group.Name] {
+			return fmt.Errorf("group name '%s' is used more than once", group.Name)
+		}
+		names[group.Name] = true
+		if group.Weight < 0 {
+			return fmt.Errorf("group '%s' has a negative weight %d", group.Name, group.Weight)
+		}
+		if group.Weight == 0 {
+			group.Weight = 1
+		}
+		if len(group.Dials) == 0 {
+			return fmt.Errorf("group '%s' has no member dials", group.Name)
+		}
+		if group.PolicyRaw == nil {
+			group.PolicyRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+		}
+		policy, err := loadInlineSelector(ctx, group.PolicyRaw)
+		if err != nil {
+			return fmt.Errorf("group '%s': loading inner selection policy: %v", group.Name, err)
+		}
+		state := &selectionGroupState{
+			name:    group.Name,
+			weight:  group.Weight,
+			members: make(map[string]bool, len(group.Dials)),
+			policy:  policy,
+		}
+		for _, dial := range group.Dials {
+			state.members[dial] = true
+			state.members[canonicalDialKey(dial)] = true
+		}
+		s.groups = append(s.groups, state)
+	}
+	return nil
+}
+
+// Select returns an available host, if any: a weighted group pick
+// first, then whatever the group's inner policy selects from the
+// group's members. A group the inner policy comes up empty on is
+// dropped and the pick repeats over the rest.
+func (s *GroupSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	type liveGroup struct {
+		state   *selectionGroupState
+		members UpstreamPool
+	}
+	live := make([]liveGroup, 0, len(s.groups))
+	totalWeight := 0
+	for _, state := range s.groups {
+		members := make(UpstreamPool, 0, len(pool))
+		anyAvailable := false
+		for _, upstream := range pool {
+			if upstream == nil || !state.owns(upstream) {
+				continue
+			}
+			members = append(members, upstream)
+			if upstream.Available() {
+				anyAvailable = true
+			}
+		}
+		// a dark group drops out of the pick entirely, so its
+		// weight redistributes over the groups still serving
+		if !anyAvailable {
+			continue
+		}
+		live = append(live, liveGroup{state: state, members: members})
+		totalWeight += state.weight
+	}
+
+	key := s.requestKey(req)
+	for len(live) > 0 {
+		var point int
+		if key != "" {
+			point = int(hashString(key) % uint64(totalWeight))
+		} else {
+			point = weakrand.Intn(totalWeight) //nolint:gosec
+		}
+		idx := len(live) - 1
+		cumulativeWeight := 0
+		for i, group := range live {
+			cumulativeWeight += group.state.weight
+			if point < cumulativeWeight {
+				idx = i
+				break
+			}
+		}
+		chosen := live[idx]
+		if upstream := chosen.state.policy.Select(chosen.members, req, w); upstream != nil {
+			return upstream
+		}
+		totalWeight -= chosen.state.weight
+		live = append(live[:idx], live[idx+1:]...)
+	}
+	return nil
+}
+
+// requestKey extracts the group-pick key from the request, or "" when
+// the pick is random.
+func (s *GroupSelection) requestKey(req *http.Request) string {
+	var address string
+	switch s.Key {
+	case "ip":
+		address = req.RemoteAddr
+	case "client_ip":
+		address = clientIPVarOrRemoteAddr(req)
+	default:
+		return ""
+	}
+	clientIP, _, err := net.SplitHostPort(address)
+	if err != nil {
+		clientIP = address
+	}
+	return clientIP
+}
+
+// SetEventsApp propagates the events app to every group's inner
+// policy that reacts to health events.
+func (s *GroupSelection) SetEventsApp(events *caddyevents.App) {
+	for _, state := range s.groups {
+		if aware, ok := state.policy.(EventsAware); ok {
+			aware.SetEventsApp(events)
+		}
+	}
+}
+
+// setHandlerIdentity propagates the owning handler's identity to every
+// group's inner policy that scopes health events by it.
+func (s *GroupSelection) setHandlerIdentity(id string) {
+	for _, state := range s.groups {
+		if aware, ok := state.policy.(handlerIdentityAware); ok {
+			aware.setHandlerIdentity(id)
+		}
+	}
+}
+
+// PopulateInitialTopology seeds each group's inner policy with only
+// the group's own members, so a topology-keeping inner policy (e.g.
+// memento) never maps keys onto another group's upstreams.
+func (s *GroupSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	for _, state := range s.groups {
+		initializer, ok := state.policy.(TopologyInitializer)
+		if !ok {
+			continue
+		}
+		members := make([]*Upstream, 0, len(upstreams))
+		for _, upstream := range upstreams {
+			if upstream != nil && state.owns(upstream) {
+				members = append(members, upstream)
+			}
+		}
+		initializer.PopulateInitialTopology(members)
+	}
+}
+
+// loadInlineSelector loads a selection policy from its inline-keyed
+// raw config, for composite policies that need more inner instances
+// than a struct field can express through ctx.LoadModule.
+func loadInlineSelector(ctx caddy.Context, raw json.RawMessage) (Selector, error) {
+	var inline struct {
+		Policy string `json:"policy"`
+	}
+	if err := json.Unmarshal(raw, &inline); err != nil {
+		return nil, fmt.Errorf("reading selection policy name: %v", err)
+	}
+	val, err := ctx.LoadModuleByID("http.reverse_proxy.selection_policies."+inline.Policy, raw)
+	if err != nil {
+		return nil, err
+	}
+	return val.(Selector), nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy groups [<key>] {
+//		key <source>
+//		group <name> [<weight>] {
+//			to <dials...>
+//			policy <policy>
+//		}
+//	}
+func (s *GroupSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if d.NextArg() {
+		s.Key = d.Val()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Key = d.Val()
+		case "group":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.Err("group requires a name and an optional weight")
+			}
+			group := SelectionGroup{Name: args[0]}
+			if len(args) == 2 {
+				weight, err := strconv.Atoi(args[1])
+				if err != nil {
+					return d.Errf("invalid group weight '%s': %v", args[1], err)
+				}
+				group.Weight = weight
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "to":
+					dials := d.RemainingArgs()
+					if len(dials) == 0 {
+						return d.ArgErr()
+					}
+					group.Dials = append(group.Dials, dials...)
+				case "policy":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					if group.PolicyRaw != nil {
+						return d.Err("inner selection policy already specified")
+					}
+					mod, err := loadFallbackPolicy(d)
+					if err != nil {
+						return err
+					}
+					group.PolicyRaw = mod
+				default:
+					return d.Errf("unrecognized group option '%s'", d.Val())
+				}
+			}
+			s.Groups = append(s.Groups, group)
+		default:
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*GroupSelection)(nil)
+	_ Selector              = (*GroupSelection)(nil)
+	_ caddyfile.Unmarshaler = (*GroupSelection)(nil)
+	_ EventsAware           = (*GroupSelection)(nil)
+	_ TopologyInitializer   = (*GroupSelection)(nil)
+	_ handlerIdentityAware  = (*GroupSelection)(nil)
+)
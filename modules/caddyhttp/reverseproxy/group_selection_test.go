@@ -0,0 +1,256 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// groupedPool returns three healthy primary upstreams (localhost:8080
+// through localhost:8082) followed by one canary (localhost:8083).
+func groupedPool() UpstreamPool {
+	pool := make(UpstreamPool, 0, 4)
+	for i := 0; i < 4; i++ {
+		pool = append(pool, &Upstream{
+			Host: new(Host),
+			Dial: fmt.Sprintf("localhost:%d", 8080+i),
+		})
+	}
+	return pool
+}
+
+// primaryCanaryGroups returns a primary group (weight 19, least_conn)
+// and a canary group (weight 1, round_robin) over groupedPool.
+func primaryCanaryGroups() []SelectionGroup {
+	return []SelectionGroup{
+		{
+			Name:      "primary",
+			Weight:    19,
+			Dials:     []string{"localhost:8080", "localhost:8081", "localhost:8082"},
+			PolicyRaw: caddyconfig.JSONModuleObject(LeastConnSelection{}, "policy", "least_conn", nil),
+		},
+		{
+			Name:      "canary",
+			Weight:    1,
+			Dials:     []string{"localhost:8083"},
+			PolicyRaw: caddyconfig.JSONModuleObject(RoundRobinSelection{}, "policy", "round_robin", nil),
+		},
+	}
+}
+
+func TestGroupSelectionSplitRatio(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := GroupSelection{Groups: primaryCanaryGroups()}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := groupedPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	canaryHits := 0
+	iterations := 10000
+	for i := 0; i < iterations; i++ {
+		upstream := policy.Select(pool, req, nil)
+		if upstream == nil {
+			t.Fatal("Expected a selection with all groups healthy")
+		}
+		if upstream.Dial == "localhost:8083" {
+			canaryHits++
+		}
+	}
+
+	// a 19:1 split puts 5% of picks on the canary; allow generous
+	// slack so the random pick does not flake the test
+	expected := iterations / 20
+	if canaryHits < expected/2 || canaryHits > expected*2 {
+		t.Errorf("Expected roughly %d canary picks out of %d, got %d", expected, iterations, canaryHits)
+	}
+}
+
+func TestGroupSelectionStickyByClientIP(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	groups := primaryCanaryGroups()
+	groups[0].Weight = 1 // even split so both groups get clients
+	policy := GroupSelection{Key: "client_ip", Groups: groups}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := groupedPool()
+	isCanary := func(upstream *Upstream) bool { return upstream.Dial == "localhost:8083" }
+
+	sawPrimary, sawCanary := false, false
+	for i := 0; i < 64; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:8080", i)
+
+		first := policy.Select(pool, req, nil)
+		if first == nil {
+			t.Fatal("Expected a selection with all groups healthy")
+		}
+		if isCanary(first) {
+			sawCanary = true
+		} else {
+			sawPrimary = true
+		}
+		// the same client lands in the same group every time
+		for j := 0; j < 10; j++ {
+			upstream := policy.Select(pool, req, nil)
+			if upstream == nil || isCanary(upstream) != isCanary(first) {
+				t.Fatalf("Expected client %s to stay in its group, got %s then %v", req.RemoteAddr, first.Dial, upstream)
+			}
+		}
+	}
+	if !sawPrimary || !sawCanary {
+		t.Errorf("Expected clients in both groups (primary=%v canary=%v)", sawPrimary, sawCanary)
+	}
+}
+
+func TestGroupSelectionWholeGroupFailure(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := GroupSelection{Key: "client_ip", Groups: primaryCanaryGroups()}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := groupedPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	// with the canary dark, its weight redistributes: every pick,
+	// sticky ones included, lands on the primary group
+	pool[3].setHealthy(false)
+	for i := 0; i < 30; i++ {
+		upstream := policy.Select(pool, req, nil)
+		if upstream == nil || upstream.Dial == "localhost:8083" {
+			t.Fatalf("Expected the primary group with the canary dark, got %v", upstream)
+		}
+	}
+
+	// and the other way around
+	pool[3].setHealthy(true)
+	for _, upstream := range pool[:3] {
+		upstream.setHealthy(false)
+	}
+	for i := 0; i < 30; i++ {
+		upstream := policy.Select(pool, req, nil)
+		if upstream == nil || upstream.Dial != "localhost:8083" {
+			t.Fatalf("Expected the canary with the primary group dark, got %v", upstream)
+		}
+	}
+
+	// everything dark selects nothing
+	pool[3].setHealthy(false)
+	if upstream := policy.Select(pool, req, nil); upstream != nil {
+		t.Errorf("Expected no selection with every group dark, got %v", upstream)
+	}
+}
+
+func TestGroupSelectionInnerPolicy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := GroupSelection{Groups: primaryCanaryGroups()}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	// the inner least_conn avoids the loaded primary members
+	pool := groupedPool()
+	pool[0].countRequest(10)
+	pool[1].countRequest(10)
+	pool[3].setHealthy(false) // keep every pick in the primary group
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	for i := 0; i < 20; i++ {
+		upstream := policy.Select(pool, req, nil)
+		if upstream == nil || upstream.Dial != "localhost:8082" {
+			t.Fatalf("Expected least_conn to pick the idle primary member, got %v", upstream)
+		}
+	}
+}
+
+func TestGroupSelectionProvision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for name, policy := range map[string]GroupSelection{
+		"no groups":       {},
+		"unnamed group":   {Groups: []SelectionGroup{{Dials: []string{"localhost:8080"}}}},
+		"duplicate name":  {Groups: []SelectionGroup{{Name: "g", Dials: []string{"localhost:8080"}}, {Name: "g", Dials: []string{"localhost:8081"}}}},
+		"negative weight": {Groups: []SelectionGroup{{Name: "g", Weight: -1, Dials: []string{"localhost:8080"}}}},
+		"no dials":        {Groups: []SelectionGroup{{Name: "g"}}},
+		"bad key":         {Key: "uri", Groups: []SelectionGroup{{Name: "g", Dials: []string{"localhost:8080"}}}},
+	} {
+		if err := policy.Provision(ctx); err == nil {
+			t.Errorf("Expected a provision error for %s", name)
+		}
+	}
+}
+
+func TestGroupSelectionCaddyfile(t *testing.T) {
+	policy := GroupSelection{}
+	err := policy.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`groups client_ip {
+		group primary 19 {
+			to localhost:8080 localhost:8081 localhost:8082
+			policy least_conn
+		}
+		group canary {
+			to localhost:8083
+			policy round_robin
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if policy.Key != "client_ip" {
+		t.Errorf("Expected key client_ip, got '%s'", policy.Key)
+	}
+	if len(policy.Groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(policy.Groups))
+	}
+	if policy.Groups[0].Name != "primary" || policy.Groups[0].Weight != 19 || len(policy.Groups[0].Dials) != 3 {
+		t.Errorf("Unexpected primary group: %+v", policy.Groups[0])
+	}
+	if policy.Groups[1].Name != "canary" || policy.Groups[1].Weight != 0 || policy.Groups[1].PolicyRaw == nil {
+		t.Errorf("Unexpected canary group: %+v", policy.Groups[1])
+	}
+
+	if err := (&GroupSelection{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"groups {\n\tgroup g x {\n\t\tto localhost:8080\n\t}\n}")); err == nil {
+		t.Error("Expected an error for a non-numeric weight")
+	}
+	if err := (&GroupSelection{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"groups {\n\tgroup g {\n\t\tupstreams localhost:8080\n\t}\n}")); err == nil {
+		t.Error("Expected an error for an unrecognized group option")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// hashFunction computes a 64-bit hash over the logical concatenation of
+// two strings, equivalent to hashing a+b but without building the
+// intermediate string. The hashing selection policies score each
+// (upstream identity, selection key) pair through one of these.
+type hashFunction func(a, b string) uint64
+
+// hashFunctionChooser is the hash function configuration shared by the
+// hashing selection policies and the memento policies. The default
+// xxhash is the fastest but is not collision-resistant: an attacker who
+// controls the selection key (URI, header, query) can engineer keys
+// that all map to one upstream. Keyed siphash closes that off at a
+// modest throughput cost; fnv1a is provided for parity with the
+// memento engine's internal hashing.
+type hashFunctionChooser struct {
+	// Which hash function scores selection keys: "xxhash" (the
+	// default), "fnv1a", or "siphash". Only siphash is keyed and
+	// therefore resistant to engineered collisions.
+	HashFunction string `json:"hash_function,omitempty"`
+
+	// Optional 128-bit siphash key as 32 hex characters. When empty,
+	// a random key is generated at provision time, which deliberately
+	// changes key-to-upstream mappings on every restart and differs
+	// between instances; set a shared secret when mappings must be
+	// stable across restarts or a fleet. (Named distinctly from the
+	// hash_input secret some policies carry.)
+	HashFunctionSecret string `json:"hash_function_secret,omitempty"`
+
+	// The chosen function; nil means the default xxhash, so hot
+	// paths can keep their allocation-free streaming fast path.
+	hashFn hashFunction
+}
+
+// provisionHashFunction resolves the configured hash function name
+// into a function value, generating a random siphash key if no secret
+// was configured.
+func (c *hashFunctionChooser) provisionHashFunction() error {
+	switch c.HashFunction {
+	case "", "xxhash":
+		c.hashFn = nil
+	case "fnv1a":
+		c.hashFn = fnv1aTwo
+	case "siphash":
+		var secret [16]byte
+		if c.HashFunctionSecret != "" {
+			decoded, err := hex.DecodeString(c.HashFunctionSecret)
+			if err != nil || len(decoded) != 16 {
+				return fmt.Errorf("hash_function secret must be 32 hex characters (a 128-bit siphash key)")
+			}
+			copy(secret[:], decoded)
+		} else if _, err := rand.Read(secret[:]); err != nil {
+			return fmt.Errorf("generating random siphash key: %v", err)
+		}
+		k0 := binary.LittleEndian.Uint64(secret[:8])
+		k1 := binary.LittleEndian.Uint64(secret[8:])
+		c.hashFn = func(a, b string) uint64 {
+			return sipHashTwo(k0, k1, a, b)
+		}
+	default:
+		return fmt.Errorf("unrecognized hash_function '%s' (expecting xxhash, fnv1a, or siphash)", c.HashFunction)
+	}
+	return nil
+}
+
+// unmarshalHashOption parses the `hash_function <name> [<secret>]`
+// Caddyfile option shared by the hashing policies. It reports whether
+// the current token was it, so callers can fall through to their own
+// unrecognized-option error when it was not.
+func (c *hashFunctionChooser) unmarshalHashOption(d *caddyfile.Dispenser) (bool, error) {
+	if d.Val() != "hash_function" {
+		return false, nil
+	}
+	if !d.NextArg() {
+		return true, d.ArgErr()
+	}
+	c.HashFunction = d.Val()
+	if d.NextArg() {
+		c.HashFunctionSecret = d.Val()
+	}
+	return true, nil
+}
+
+// fnv1aTwo hashes the concatenation a+b with FNV-1a, the same function
+// the memento engine uses internally, without building the
+// intermediate string.
+func fnv1aTwo(a, b string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(a); i++ {
+		h ^= uint64(a[i])
+		h *= prime64
+	}
+	for i := 0; i < len(b); i++ {
+		h ^= uint64(b[i])
+		h *= prime64
+	}
+	return h
+}
+
+// sipHashTwo computes SipHash-2-4 with key (k0, k1) over the logical
+// concatenation a+b. SipHash is a keyed pseudorandom function: without
+// the key, collisions cannot be engineered, which is the property the
+// siphash hash_function option exists for.
+func sipHashTwo(k0, k1 uint64, a, b string) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	length := len(a) + len(b)
+	byteAt := func(i int) uint64 {
+		if i < len(a) {
+			return uint64(a[i])
+		}
+		return uint64(b[i-len(a)])
+	}
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	// full 8-byte blocks
+	i := 0
+	for ; i+8 <= length; i += 8 {
+		m := byteAt(i) | byteAt(i+1)<<8 | byteAt(i+2)<<16 | byteAt(i+3)<<24 |
+			byteAt(i+4)<<32 | byteAt(i+5)<<40 | byteAt(i+6)<<48 | byteAt(i+7)<<56
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	// final block: remaining bytes plus the length in the top byte
+	m := uint64(length) << 56
+	for shift := uint(0); i < length; i++ {
+		m |= byteAt(i) << shift
+		shift += 8
+	}
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
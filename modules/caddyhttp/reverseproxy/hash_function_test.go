@@ -0,0 +1,220 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestHashFunctionProvision(t *testing.T) {
+	for i, tc := range []struct {
+		function  string
+		secret    string
+		expectErr bool
+	}{
+		{function: "", expectErr: false},
+		{function: "xxhash", expectErr: false},
+		{function: "fnv1a", expectErr: false},
+		{function: "siphash", expectErr: false},
+		{function: "siphash", secret: "000102030405060708090a0b0c0d0e0f", expectErr: false},
+		{function: "siphash", secret: "deadbeef", expectErr: true}, // too short
+		{function: "siphash", secret: "not-hex-characters-here-at-all!!", expectErr: true},
+		{function: "md5", expectErr: true},
+	} {
+		chooser := hashFunctionChooser{HashFunction: tc.function, HashFunctionSecret: tc.secret}
+		err := chooser.provisionHashFunction()
+		if tc.expectErr && err == nil {
+			t.Errorf("Test %d: Expected an error for hash_function '%s' secret '%s'", i, tc.function, tc.secret)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("Test %d: Unexpected error for hash_function '%s': %v", i, tc.function, err)
+		}
+	}
+}
+
+func TestHashFunctionCaddyfileOption(t *testing.T) {
+	sel := IPHashSelection{}
+	if err := sel.UnmarshalCaddyfile(caddyfile.NewTestDispenser("ip_hash {\n\thash_function siphash 000102030405060708090a0b0c0d0e0f\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if sel.HashFunction != "siphash" {
+		t.Errorf("Expected hash_function 'siphash', got '%s'", sel.HashFunction)
+	}
+	if sel.HashFunctionSecret != "000102030405060708090a0b0c0d0e0f" {
+		t.Errorf("Expected the secret to be captured, got '%s'", sel.HashFunctionSecret)
+	}
+
+	memento := MementoSelection{}
+	if err := memento.UnmarshalCaddyfile(caddyfile.NewTestDispenser("memento ip {\n\thash_function fnv1a\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if memento.HashFunction != "fnv1a" {
+		t.Errorf("Expected hash_function 'fnv1a', got '%s'", memento.HashFunction)
+	}
+
+	if err := (&IPHashSelection{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("ip_hash {\n\thash_function\n}")); err == nil {
+		t.Error("Expected an error for hash_function with no argument")
+	}
+}
+
+// TestSipHashKeyStability covers the restart behavior the siphash docs
+// promise: without a configured secret every provisioning draws a fresh
+// random key, so two instances (or one instance across restarts) hash
+// the same keys differently; with a shared secret the mappings agree.
+func TestSipHashKeyStability(t *testing.T) {
+	provision := func(secret string) hashFunction {
+		t.Helper()
+		chooser := hashFunctionChooser{HashFunction: "siphash", HashFunctionSecret: secret}
+		if err := chooser.provisionHashFunction(); err != nil {
+			t.Fatalf("provisionHashFunction error: %v", err)
+		}
+		return chooser.hashFn
+	}
+
+	first, second := provision(""), provision("")
+	same := true
+	for i := 0; i < 16; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if first(key, "") != second(key, "") {
+			same = false
+			break
+		}
+	}
+	if same {
+		t.Error("Expected two random siphash keys to hash at least one of 16 keys differently")
+	}
+
+	const secret = "000102030405060708090a0b0c0d0e0f"
+	first, second = provision(secret), provision(secret)
+	for i := 0; i < 16; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if first(key, "") != second(key, "") {
+			t.Fatalf("Expected a shared secret to produce identical hashes, key '%s' differs", key)
+		}
+	}
+}
+
+// TestSipHashCollisionSmoke is a smoke test of siphash's collision
+// resistance and distribution: many distinct keys must produce no
+// 64-bit collisions, and routing them through hostByHashingWith must
+// spread them roughly evenly across the pool.
+func TestSipHashCollisionSmoke(t *testing.T) {
+	chooser := hashFunctionChooser{HashFunction: "siphash", HashFunctionSecret: "000102030405060708090a0b0c0d0e0f"}
+	if err := chooser.provisionHashFunction(); err != nil {
+		t.Fatalf("provisionHashFunction error: %v", err)
+	}
+
+	const numKeys = 10000
+	seen := make(map[uint64]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("collision-smoke-%d", i)
+		sum := chooser.hashFn(key, "")
+		if other, ok := seen[sum]; ok {
+			t.Fatalf("64-bit collision between '%s' and '%s'", other, key)
+		}
+		seen[sum] = key
+	}
+
+	pool := createMementoPool(10)
+	counts := make(map[*Upstream]int, len(pool))
+	for i := 0; i < numKeys; i++ {
+		upstream, _ := hostByHashingWith(pool, fmt.Sprintf("collision-smoke-%d", i), chooser.hashFn, availabilityFull, nil)
+		counts[upstream]++
+	}
+	expected := numKeys / len(pool)
+	for upstream, count := range counts {
+		if count < expected/2 || count > expected*2 {
+			t.Errorf("Upstream %s owns %d of %d keys, expected roughly %d", upstream.Dial, count, numKeys, expected)
+		}
+	}
+}
+
+// TestMementoHashFunctionChangesMapping verifies that the hash_function
+// option actually reaches the memento engine: the same pool and keys
+// map differently under the default hashing than under keyed siphash.
+func TestMementoHashFunctionChangesMapping(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := createMementoPool(8)
+	provision := func(function, secret string) *MementoSelection {
+		t.Helper()
+		sel := &MementoSelection{Field: "uri"}
+		sel.HashFunction = function
+		sel.HashFunctionSecret = secret
+		if err := sel.Provision(ctx); err != nil {
+			t.Fatalf("Provision error: %v", err)
+		}
+		sel.PopulateInitialTopology(pool)
+		return sel
+	}
+
+	defaultSel := provision("", "")
+	sipSel := provision("siphash", "000102030405060708090a0b0c0d0e0f")
+	sipAgain := provision("siphash", "000102030405060708090a0b0c0d0e0f")
+
+	differs := false
+	for i := 0; i < 64; i++ {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/tenant/%d", i), nil)
+		sipPick := sipSel.Select(pool, req, nil)
+		if sipPick == nil {
+			t.Fatalf("Expected a selection for key %d", i)
+		}
+		if again := sipAgain.Select(pool, req, nil); again != sipPick {
+			t.Fatalf("Expected two engines with the same siphash secret to agree, key %d differs", i)
+		}
+		if defaultSel.Select(pool, req, nil) != sipPick {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Error("Expected siphash to map at least one of 64 keys differently than the default hashing")
+	}
+}
+
+// BenchmarkHashFunctions compares the three selectable hash functions
+// on a typical selection key, so the cost of switching away from the
+// default is a measurement instead of a guess.
+func BenchmarkHashFunctions(b *testing.B) {
+	const upstream = "10.0.1.1:8080"
+	const key = "203.0.113.7"
+
+	b.Run("xxhash", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			hashTwo(upstream, key)
+		}
+	})
+	b.Run("fnv1a", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fnv1aTwo(upstream, key)
+		}
+	})
+	b.Run("siphash", func(b *testing.B) {
+		chooser := hashFunctionChooser{HashFunction: "siphash"}
+		if err := chooser.provisionHashFunction(); err != nil {
+			b.Fatalf("provisionHashFunction error: %v", err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			chooser.hashFn(upstream, key)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// healthEventDebouncer filters flapping health events before they are
+// allowed to mutate a consistent hashing topology. A node's state only
+// flips after minConfirmations consecutive contradicting events, and
+// when flapWindow is set, a streak of contradicting events is discarded
+// if the gap between two of them exceeds the window. With the defaults
+// (1 confirmation, no window) every event passes through unchanged.
+type healthEventDebouncer struct {
+	flapWindow       time.Duration
+	minConfirmations int
+
+	mu     sync.Mutex
+	states map[string]*debounceState
+}
+
+// debounceState tracks the confirmed health of one node along with the
+// run of events contradicting it.
+type debounceState struct {
+	healthy   bool      // last confirmed state
+	streak    int       // consecutive events contradicting the confirmed state
+	lastEvent time.Time // when the latest contradicting event arrived
+}
+
+// debounceCounters is a point-in-time snapshot of one node's debounce
+// state, for the admin introspection endpoint.
+type debounceCounters struct {
+	Host                 string `json:"host"`
+	ConfirmedHealthy     bool   `json:"confirmed_healthy"`
+	PendingConfirmations int    `json:"pending_confirmations"`
+}
+
+// newHealthEventDebouncer returns a debouncer requiring the given
+// number of consecutive confirmations within the given window. Values
+// below 1 confirmation are treated as 1, and a zero window means
+// streaks never expire.
+func newHealthEventDebouncer(flapWindow time.Duration, minConfirmations int) *healthEventDebouncer {
+	if minConfirmations < 1 {
+		minConfirmations = 1
+	}
+	return &healthEventDebouncer{
+		flapWindow:       flapWindow,
+		minConfirmations: minConfirmations,
+		states:           make(map[string]*debounceState),
+	}
+}
+
+// confirm records a health observation for host and reports whether the
+// node's confirmed state just flipped, i.e. whether the caller should
+// act on the event. Nodes are assumed healthy until confirmed otherwise,
+// matching how topologies are seeded from the full upstream list.
+func (d *healthEventDebouncer) confirm(host string, healthy bool, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.states[host]
+	if !ok {
+		state = &debounceState{healthy: true}
+		d.states[host] = state
+	}
+
+	if healthy == state.healthy {
+		// the observation agrees with the confirmed state, so any
+		// partial streak in the other direction was a flap
+		state.streak = 0
+		return false
+	}
+
+	if state.streak > 0 && d.flapWindow > 0 && now.Sub(state.lastEvent) > d.flapWindow {
+		// the previous contradicting run went stale; start over
+		state.streak = 0
+	}
+	state.streak++
+	state.lastEvent = now
+
+	if state.streak < d.minConfirmations {
+		return false
+	}
+	state.healthy = healthy
+	state.streak = 0
+	return true
+}
+
+// assume seeds the confirmed state for host without counting a
+// transition. A policy that left a host out of its initial topology
+// (initial_topology healthy_only or lazy) records it as unhealthy here,
+// so the host's first real "healthy" event reads as a transition
+// instead of agreeing with the assumed-healthy default.
+func (d *healthEventDebouncer) assume(host string, healthy bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, ok := d.states[host]
+	if !ok {
+		state = &debounceState{}
+		d.states[host] = state
+	}
+	state.healthy = healthy
+	state.streak = 0
+}
+
+// counters returns a snapshot of every tracked node's debounce state.
+func (d *healthEventDebouncer) counters() []debounceCounters {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	snapshot := make([]debounceCounters, 0, len(d.states))
+	for host, state := range d.states {
+		snapshot = append(snapshot, debounceCounters{
+			Host:                 host,
+			ConfirmedHealthy:     state.healthy,
+			PendingConfirmations: state.streak,
+		})
+	}
+	return snapshot
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Matthew Holt and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthEventDebouncerDefaultsPassEverythingThrough(t *testing.T) {
+	d := newHealthEventDebouncer(0, 1)
+	now := time.Now()
+
+	if !d.confirm("10.0.0.1:80", false, now) {
+		t.Error("Expected the first unhealthy event to confirm immediately with 1 confirmation")
+	}
+	if !d.confirm("10.0.0.1:80", true, now) {
+		t.Error("Expected the first healthy event after an outage to confirm immediately")
+	}
+	if d.confirm("10.0.0.1:80", true, now) {
+		t.Error("Expected a repeated healthy event to be a no-op")
+	}
+}
+
+func TestHealthEventDebouncerRequiresConsecutiveEvents(t *testing.T) {
+	d := newHealthEventDebouncer(0, 3)
+	now := time.Now()
+
+	// two unhealthy events are not enough
+	if d.confirm("10.0.0.1:80", false, now) || d.confirm("10.0.0.1:80", false, now) {
+		t.Error("Expected no confirmation before 3 consecutive unhealthy events")
+	}
+	// a healthy event in between resets the streak
+	if d.confirm("10.0.0.1:80", true, now) {
+		t.Error("Expected the healthy event to be a no-op for an already-healthy node")
+	}
+	if d.confirm("10.0.0.1:80", false, now) || d.confirm("10.0.0.1:80", false, now) {
+		t.Error("Expected the flap to have reset the unhealthy streak")
+	}
+	if !d.confirm("10.0.0.1:80", false, now) {
+		t.Error("Expected the third consecutive unhealthy event to confirm")
+	}
+
+	// recovery needs the same number of confirmations
+	if d.confirm("10.0.0.1:80", true, now) || d.confirm("10.0.0.1:80", true, now) {
+		t.Error("Expected no confirmation before 3 consecutive healthy events")
+	}
+	if !d.confirm("10.0.0.1:80", true, now) {
+		t.Error("Expected the third consecutive healthy event to confirm recovery")
+	}
+}
+
+func TestHealthEventDebouncerFlapWindowExpiresStreaks(t *testing.T) {
+	d := newHealthEventDebouncer(10*time.Second, 2)
+	start := time.Now()
+
+	if d.confirm("10.0.0.1:80", false, start) {
+		t.Error("Expected no confirmation after a single unhealthy event")
+	}
+	// the second contradicting event arrives after the window, so the
+	// stale streak is discarded and it counts as the first again
+	if d.confirm("10.0.0.1:80", false, start.Add(11*time.Second)) {
+		t.Error("Expected the streak to restart after the flap window expired")
+	}
+	if !d.confirm("10.0.0.1:80", false, start.Add(12*time.Second)) {
+		t.Error("Expected two unhealthy events within the window to confirm")
+	}
+}
+
+func TestHealthEventDebouncerCounters(t *testing.T) {
+	d := newHealthEventDebouncer(0, 3)
+	now := time.Now()
+
+	d.confirm("10.0.0.1:80", false, now)
+	d.confirm("10.0.0.1:80", false, now)
+	d.confirm("10.0.0.2:80", true, now)
+
+	counters := d.counters()
+	if len(counters) != 2 {
+		t.Fatalf("Expected counters for 2 hosts, got %d", len(counters))
+	}
+	byHost := make(map[string]debounceCounters)
+	for _, c := range counters {
+		byHost[c.Host] = c
+	}
+	if c := byHost["10.0.0.1:80"]; !c.ConfirmedHealthy || c.PendingConfirmations != 2 {
+		t.Errorf("Expected host 1 to be confirmed healthy with 2 pending confirmations, got %+v", c)
+	}
+	if c := byHost["10.0.0.2:80"]; !c.ConfirmedHealthy || c.PendingConfirmations != 0 {
+		t.Errorf("Expected host 2 to be confirmed healthy with no pending confirmations, got %+v", c)
+	}
+}
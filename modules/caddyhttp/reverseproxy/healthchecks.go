@@ -26,6 +26,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -35,6 +36,78 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+// UpstreamHealthEvent is the structured payload carried by the "healthy"
+// and "unhealthy" events. It is stored under the "event" key of the event
+// data; the upstream's dial address is also kept under the legacy "host"
+// key for handlers that predate this type.
+type UpstreamHealthEvent struct {
+	// The dial address of the upstream whose status changed.
+	Dial string `json:"dial"`
+
+	// Whether the upstream is now considered healthy.
+	Healthy bool `json:"healthy"`
+
+	// Why the status changed, e.g. "active_health_check"; this lets
+	// handlers distinguish failed probes from admin-initiated drains.
+	Reason string `json:"reason,omitempty"`
+
+	// Identifies the reverse proxy handler whose health checker
+	// emitted the event. Selection policies scope events to their own
+	// handler by default, so two handlers with overlapping upstream
+	// addresses but different pools don't react to each other's
+	// flaps. Empty for events emitted by third parties.
+	Handler string `json:"handler,omitempty"`
+}
+
+// upstreamHealthEventFromEvent extracts the structured health payload
+// from an event, falling back to the legacy {"host": string} map form.
+func upstreamHealthEventFromEvent(event caddy.Event) (UpstreamHealthEvent, bool) {
+	if payload, ok := event.Data["event"].(UpstreamHealthEvent); ok {
+		return payload, true
+	}
+	if host, ok := event.Data["host"].(string); ok {
+		return UpstreamHealthEvent{Dial: host, Healthy: event.Name() == "healthy"}, true
+	}
+	return UpstreamHealthEvent{}, false
+}
+
+// healthEventData builds the event data for a health status change,
+// carrying both the structured payload and the legacy "host" key. The
+// dial address is canonicalized so handlers that index upstreams by
+// address (e.g. the memento policies) match it regardless of how the
+// emitter spelled it. The handler identity lets subscribing policies
+// ignore events that belong to a different reverse proxy handler.
+func healthEventData(dial string, healthy bool, reason, handler string) map[string]any {
+	dial = canonicalDialKey(dial)
+	return map[string]any{
+		"host":  dial,
+		"event": UpstreamHealthEvent{Dial: dial, Healthy: healthy, Reason: reason, Handler: handler},
+	}
+}
+
+// reasonActiveHealthCheck marks health events produced by active probes.
+const reasonActiveHealthCheck = "active_health_check"
+
+// reasonPassiveHealthCheck marks health events produced by passive
+// (request-driven) health checking.
+const reasonPassiveHealthCheck = "passive_health_check"
+
+// eventHealthCheckInitialComplete is emitted once the first active
+// health check round finishes, so selection policies that defer
+// topology population (initial_topology healthy_only) can populate
+// from real health state instead of assuming every configured host
+// is alive.
+const eventHealthCheckInitialComplete = "healthcheck.initial_complete"
+
+// initialHealthCheckCompleteEventData builds the event data for
+// eventHealthCheckInitialComplete. The handler identity lets
+// subscribing policies ignore the end of another handler's round.
+func initialHealthCheckCompleteEventData(handler string) map[string]any {
+	return map[string]any{
+		"event": UpstreamHealthEvent{Handler: handler},
+	}
+}
+
 // HealthChecks configures active and passive health checks.
 type HealthChecks struct {
 	// Active health checks run in the background on a timer. To
@@ -281,7 +354,13 @@ func (h *Handler) activeHealthChecker() {
 		}
 	}()
 	ticker := time.NewTicker(time.Duration(h.HealthChecks.Active.Interval))
-	h.doActiveHealthCheckForAllHosts()
+	firstRound := h.doActiveHealthCheckForAllHosts()
+	go func() {
+		firstRound.Wait()
+		if h.events != nil {
+			h.events.Emit(h.ctx, eventHealthCheckInitialComplete, initialHealthCheckCompleteEventData(h.handlerID))
+		}
+	}()
 	for {
 		select {
 		case <-ticker.C:
@@ -294,10 +373,14 @@ func (h *Handler) activeHealthChecker() {
 }
 
 // doActiveHealthCheckForAllHosts immediately performs a
-// health checks for all upstream hosts configured by h.
-func (h *Handler) doActiveHealthCheckForAllHosts() {
+// health checks for all upstream hosts configured by h. The returned
+// WaitGroup completes when every host's check has finished.
+func (h *Handler) doActiveHealthCheckForAllHosts() *sync.WaitGroup {
+	var checks sync.WaitGroup
 	for _, upstream := range h.Upstreams {
+		checks.Add(1)
 		go func(upstream *Upstream) {
+			defer checks.Done()
 			defer func() {
 				if err := recover(); err != nil {
 					if c := h.HealthChecks.Active.logger.Check(zapcore.ErrorLevel, "active health checker panicked"); c != nil {
@@ -374,6 +457,7 @@ func (h *Handler) doActiveHealthCheckForAllHosts() {
 			}
 		}(upstream)
 	}
+	return &checks
 }
 
 // doActiveHealthCheck performs a health check to upstream which
@@ -476,7 +560,10 @@ func (h *Handler) doActiveHealthCheck(dialInfo DialInfo, hostAddr string, networ
 		if upstream.Host.activeHealthFails() >= h.HealthChecks.Active.Fails {
 			// dispatch an event that the host newly became unhealthy
 			if upstream.setHealthy(false) {
-				h.events.Emit(h.ctx, "unhealthy", map[string]any{"host": hostAddr})
+				// identify the upstream by its configured dial address,
+				// not the probe's host:port — for unix sockets the two
+				// have nothing in common
+				h.events.Emit(h.ctx, "unhealthy", healthEventData(upstream.Dial, false, reasonActiveHealthCheck, h.handlerID))
 				upstream.Host.resetHealth()
 			}
 		}
@@ -499,7 +586,8 @@ func (h *Handler) doActiveHealthCheck(dialInfo DialInfo, hostAddr string, networ
 				if c := h.HealthChecks.Active.logger.Check(zapcore.InfoLevel, "host is up"); c != nil {
 					c.Write(zap.String("host", hostAddr))
 				}
-				h.events.Emit(h.ctx, "healthy", map[string]any{"host": hostAddr})
+				upstream.Host.markHealthySince(time.Now())
+				h.events.Emit(h.ctx, "healthy", healthEventData(upstream.Dial, true, reasonActiveHealthCheck, h.handlerID))
 				upstream.Host.resetHealth()
 			}
 		}
@@ -607,6 +695,16 @@ func (h *Handler) countFailure(upstream *Upstream) {
 		return
 	}
 
+	// if this failure crossed the passive threshold, dispatch an event so
+	// event-driven selection policies stay in sync without active probes;
+	// the per-host flag debounces repeated identical transitions
+	maxFails := h.HealthChecks.Passive.MaxFails
+	if maxFails > 0 && upstream.Host.Fails() >= maxFails {
+		if upstream.Host.setPassiveUnhealthy(true) {
+			h.events.Emit(h.ctx, "unhealthy", healthEventData(upstream.Dial, false, reasonPassiveHealthCheck, h.handlerID))
+		}
+	}
+
 	// forget it later
 	go func(host *Host, failDuration time.Duration) {
 		defer func() {
@@ -635,6 +733,16 @@ func (h *Handler) countFailure(upstream *Upstream) {
 					zap.Error(err),
 				)
 			}
+			return
+		}
+
+		// if the failure window cleared, dispatch the recovery event
+		// (debounced the same way as the unhealthy transition)
+		if maxFails > 0 && host.Fails() < maxFails {
+			if host.setPassiveUnhealthy(false) {
+				host.markHealthySince(time.Now())
+				h.events.Emit(h.ctx, "healthy", healthEventData(upstream.Dial, true, reasonPassiveHealthCheck, h.handlerID))
+			}
 		}
 	}(upstream.Host, failDuration)
 }
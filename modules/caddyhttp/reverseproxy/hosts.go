@@ -17,9 +17,13 @@ package reverseproxy
 import (
 	"context"
 	"fmt"
+	"math"
+	weakrand "math/rand"
 	"net/netip"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -46,6 +50,20 @@ type Upstream struct {
 	// backends is down. Also be aware of open proxy vulnerabilities.
 	Dial string `json:"dial,omitempty"`
 
+	// A stable identity for this upstream, used instead of the dial
+	// address by hashing-based selection policies. Setting this lets a
+	// backend keep its consistent-hash mappings and sticky cookies when
+	// its address or port changes (same machine, new socket). Must be
+	// unique across the upstreams of a handler. If empty, the dial
+	// address is the identity, which means renumbering an upstream
+	// remaps every key that hashed to it.
+	HashKey string `json:"hash_key,omitempty"`
+
+	// The zone (availability zone, data center, rack) this upstream
+	// runs in. Only consulted by the zone_aware selection policy,
+	// which prefers upstreams whose zone matches the proxy's own.
+	Zone string `json:"zone,omitempty"`
+
 	// The maximum number of simultaneous requests to allow to
 	// this upstream. If set, overrides the global passive health
 	// check UnhealthyRequestCount value.
@@ -61,20 +79,65 @@ type Upstream struct {
 	healthCheckPolicy         *PassiveHealthChecks
 	cb                        CircuitBreaker
 	unhealthy                 int32 // accessed atomically; status from active health checker
+
+	// how long selection policies ramp this upstream's traffic share
+	// back up after a return to health; zero disables the ramp. Set
+	// by the handler at provision time from LoadBalancing.SlowStart.
+	slowStartWindow time.Duration
+
+	// the canonical form of Dial, cached by the handler at provision
+	// time so String() and the event-matching paths don't re-parse the
+	// address on every call
+	canonicalDial string
+}
+
+// canonicalDialKey normalizes a dial address to its canonical
+// network-address form (network prefix plus address, with the default
+// "tcp" omitted), so every party that identifies upstreams by address —
+// Upstream.String(), the health event emitters, and the selection
+// policies' topology indexes — agrees on one spelling. Without this, a
+// unix socket dial like "unix//run/app.sock" and the health checker's
+// normalized address never match and the upstream can never rejoin the
+// topology. Unparseable input (e.g. a dial address that still contains
+// placeholders) is returned unchanged.
+func canonicalDialKey(dial string) string {
+	addr, err := caddy.ParseNetworkAddress(dial)
+	if err != nil {
+		return dial
+	}
+	return addr.String()
 }
 
 // (pointer receiver necessary to avoid a race condition, since
 // copying the Upstream reads the 'unhealthy' field which is
 // accessed atomically)
-func (u *Upstream) String() string { return u.Dial }
+func (u *Upstream) String() string {
+	if u.canonicalDial != "" {
+		return u.canonicalDial
+	}
+	return canonicalDialKey(u.Dial)
+}
+
+// hashKey returns the identity that hashing-based selection policies
+// key this upstream under: HashKey if configured, the dial address
+// otherwise.
+func (u *Upstream) hashKey() string {
+	if u.HashKey != "" {
+		return u.HashKey
+	}
+	return u.Dial
+}
 
 // Available returns true if the remote host
 // is available to receive requests. This is
 // the method that should be used by selection
 // policies, etc. to determine if a backend
-// should be able to be sent a request.
+// should be able to be sent a request. A host
+// that recently asked clients to back off (see
+// UpstreamBackoff) is not available until its
+// backoff window elapses.
 func (u *Upstream) Available() bool {
-	return u.Healthy() && !u.Full()
+	return u.Healthy() && !u.Full() && !u.InBackoff()
 }
 
 // Healthy returns true if the remote host
@@ -91,12 +154,56 @@ func (u *Upstream) Healthy() bool {
 	return healthy
 }
 
+// InBackoff returns true if the remote host is
+// inside a backoff window started by a rate-limit
+// response (see UpstreamBackoff).
+func (u *Upstream) InBackoff() bool {
+	return u.Host != nil && u.Host.backoffRemaining() > 0
+}
+
 // Full returns true if the remote host
 // cannot receive more requests at this time.
 func (u *Upstream) Full() bool {
 	return u.MaxRequests > 0 && u.Host.NumRequests() >= u.MaxRequests
 }
 
+// slowStartShare returns the fraction (0..1] of its full traffic share
+// this upstream should receive right now. It ramps linearly from 0 to 1
+// over the slow-start window following the host's most recent return to
+// health, and is 1 when slow start is disabled, the host has never been
+// unhealthy, or the window has elapsed.
+func (u *Upstream) slowStartShare() float64 {
+	if u.slowStartWindow <= 0 || u.Host == nil {
+		return 1
+	}
+	since := atomic.LoadInt64(&u.Host.healthySince)
+	if since == 0 {
+		return 1
+	}
+	elapsed := time.Since(time.Unix(0, since))
+	if elapsed >= u.slowStartWindow {
+		return 1
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(u.slowStartWindow)
+}
+
+// slowStartHoldback reports whether a selection should pass over this
+// upstream so it can keep warming up: true with probability
+// 1 - slowStartShare, so the host's traffic share ramps linearly over
+// the slow-start window. Callers should fall back to another upstream
+// when it returns true, but may still use the host if it is the only
+// one available.
+func (u *Upstream) slowStartHoldback() bool {
+	share := u.slowStartShare()
+	if share >= 1 {
+		return false
+	}
+	return weakrand.Float64() >= share //nolint:gosec
+}
+
 // fillDialInfo returns a filled DialInfo for upstream u, using the request
 // context. Note that the returned value is not a pointer.
 func (u *Upstream) fillDialInfo(repl *caddy.Replacer) (DialInfo, error) {
@@ -139,6 +246,20 @@ type Host struct {
 	fails        int64
 	activePasses int64
 	activeFails  int64
+	healthySince int64 // unix nanos of the most recent return to health; zero if never unhealthy
+	backoffUntil int64 // unix nanos until which rate-limit backoff keeps the host unavailable; zero if none
+
+	passiveUnhealthy int32 // whether passive health checking has marked the host down; used to debounce events
+
+	// age-discounted load tracking, enabled by selection policies
+	// configured with count_weighting age_discounted (see
+	// enableAgeDiscounting). The decayed value is guarded by loadMu;
+	// loadHalfLife is read atomically so countRequest can skip the
+	// bookkeeping entirely when no policy asked for it.
+	loadHalfLife  int64 // nanoseconds; zero disables tracking
+	loadMu        sync.Mutex
+	effectiveLoad float64
+	loadStampNano int64 // unix nanos of the last effectiveLoad update
 }
 
 // NumRequests returns the number of active requests to the upstream.
@@ -165,12 +286,69 @@ func (h *Host) activeHealthFails() int {
 // delta. It returns an error if the adjustment fails.
 func (h *Host) countRequest(delta int) error {
 	result := atomic.AddInt64(&h.numRequests, int64(delta))
+	h.trackEffectiveLoad(delta, result)
 	if result < 0 {
 		return fmt.Errorf("count below 0: %d", result)
 	}
 	return nil
 }
 
+// enableAgeDiscounting turns on effective-load tracking with the given
+// half-life. Selection policies that compare hosts by age-discounted
+// load call this for each host when they receive the initial topology.
+func (h *Host) enableAgeDiscounting(halfLife time.Duration) {
+	atomic.StoreInt64(&h.loadHalfLife, int64(halfLife))
+}
+
+// decayLoadLocked brings effectiveLoad forward to now, halving it once
+// per elapsed half-life. Callers must hold loadMu.
+func (h *Host) decayLoadLocked(now, halfLife int64) {
+	if h.loadStampNano != 0 && h.effectiveLoad > 0 {
+		if elapsed := now - h.loadStampNano; elapsed > 0 {
+			h.effectiveLoad *= math.Exp2(-float64(elapsed) / float64(halfLife))
+		}
+	}
+	h.loadStampNano = now
+}
+
+// trackEffectiveLoad folds one count/uncount event into the decayed
+// effective load. A new request contributes a full unit; a finishing
+// one removes a unit, clamped at zero because a long-lived request's
+// own contribution has already partially decayed. The value is also
+// capped at the raw in-flight count, its natural upper bound.
+func (h *Host) trackEffectiveLoad(delta int, rawCount int64) {
+	halfLife := atomic.LoadInt64(&h.loadHalfLife)
+	if halfLife <= 0 {
+		return
+	}
+	h.loadMu.Lock()
+	defer h.loadMu.Unlock()
+	h.decayLoadLocked(time.Now().UnixNano(), halfLife)
+	h.effectiveLoad += float64(delta)
+	if h.effectiveLoad < 0 {
+		h.effectiveLoad = 0
+	}
+	if bound := float64(rawCount); rawCount >= 0 && h.effectiveLoad > bound {
+		h.effectiveLoad = bound
+	}
+}
+
+// effectiveRequests returns the age-discounted in-flight load: each
+// active request's unit contribution decays exponentially with its
+// age, so a single stuck request stops dominating the host's apparent
+// load after a few half-lives. It falls back to the raw count when
+// age-discounted tracking has not been enabled on this host.
+func (h *Host) effectiveRequests() float64 {
+	halfLife := atomic.LoadInt64(&h.loadHalfLife)
+	if halfLife <= 0 {
+		return float64(h.NumRequests())
+	}
+	h.loadMu.Lock()
+	defer h.loadMu.Unlock()
+	h.decayLoadLocked(time.Now().UnixNano(), halfLife)
+	return h.effectiveLoad
+}
+
 // countFail mutates the recent failures count by
 // delta. It returns an error if the adjustment fails.
 func (h *Host) countFail(delta int) error {
@@ -201,6 +379,43 @@ func (h *Host) countHealthFail(delta int) error {
 	return nil
 }
 
+// setBackoff records the end of a rate-limit backoff window,
+// during which the host is not available for selection.
+func (h *Host) setBackoff(until time.Time) {
+	atomic.StoreInt64(&h.backoffUntil, until.UnixNano())
+}
+
+// backoffRemaining returns how much of the current backoff
+// window is left, or zero if the host is not in backoff.
+func (h *Host) backoffRemaining() time.Duration {
+	until := atomic.LoadInt64(&h.backoffUntil)
+	if until == 0 {
+		return 0
+	}
+	remaining := time.Until(time.Unix(0, until))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// setPassiveUnhealthy sets whether passive health checking considers
+// the host down, and returns true if the new value is different. This
+// is used to debounce health events on repeated identical transitions.
+func (h *Host) setPassiveUnhealthy(unhealthy bool) bool {
+	var val, compare int32 = 1, 0
+	if !unhealthy {
+		val, compare = 0, 1
+	}
+	return atomic.CompareAndSwapInt32(&h.passiveUnhealthy, compare, val)
+}
+
+// markHealthySince records the moment the host returned to health,
+// which starts the slow-start ramp for upstreams that share it.
+func (h *Host) markHealthySince(t time.Time) {
+	atomic.StoreInt64(&h.healthySince, t.UnixNano())
+}
+
 // resetHealth resets the health check counters.
 func (h *Host) resetHealth() {
 	atomic.StoreInt64(&h.activePasses, 0)
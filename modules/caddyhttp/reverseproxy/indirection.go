@@ -147,6 +147,22 @@ func (ind *Indirection) RemoveBucket(bucket int) (*Upstream, error) {
 	return upstream, nil
 }
 
+// Clone returns a copy of the indirection with the same mappings. The
+// upstream pointers are shared (they identify live hosts), but the
+// mapping state itself is independent of the original.
+func (ind *Indirection) Clone() *Indirection {
+	clone := NewIndirection(0)
+	ind.upstreamToBucket.Range(func(key, val interface{}) bool {
+		clone.upstreamToBucket.Store(key, val)
+		return true
+	})
+	ind.bucketToUpstream.Range(func(key, val interface{}) bool {
+		clone.bucketToUpstream.Store(key, val)
+		return true
+	})
+	return clone
+}
+
 // Size returns the number of mappings in the indirection
 // Note: This is approximate for sync.Map (it may not be exact under concurrent modifications)
 func (ind *Indirection) Size() int {
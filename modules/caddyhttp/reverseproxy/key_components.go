@@ -0,0 +1,129 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Key components: request attributes an IP-affinity policy can combine
+// into its hash key.
+const (
+	// keyComponentClientIP is the (optionally masked) IP the policy
+	// hashes today: the remote address for ip_hash, the trusted-proxy
+	// client IP for client_ip_hash.
+	keyComponentClientIP = "client_ip"
+
+	// keyComponentLocalPort is the local port the connection arrived
+	// on, so tenants terminated on different ports of the same
+	// instance don't share upstream affinity.
+	keyComponentLocalPort = "local_port"
+
+	// keyComponentSNI is the TLS server name the client sent, empty
+	// for plaintext requests.
+	keyComponentSNI = "sni"
+
+	// keyComponentHostHeader is the request's Host header.
+	keyComponentHostHeader = "host_header"
+)
+
+// keyComponentSeparator joins the components into one hash key.
+const keyComponentSeparator = "|"
+
+// keyComponentChooser is the key composition configuration shared by
+// the IP-affinity selection policies. By default the hash key is the
+// client IP alone; multi-tenant setups that terminate several tenants
+// on different local ports (or SNI names) of one instance can add the
+// port or server name so tenants hash independently.
+type keyComponentChooser struct {
+	// Which request attributes compose the hash key, joined in order
+	// with '|'. Any of "client_ip", "local_port", "sni",
+	// "host_header". Default is client_ip alone.
+	KeyComponents []string `json:"key_components,omitempty"`
+}
+
+// provisionKeyComponents validates the configured component names.
+func (c *keyComponentChooser) provisionKeyComponents() error {
+	for _, component := range c.KeyComponents {
+		switch component {
+		case keyComponentClientIP, keyComponentLocalPort, keyComponentSNI, keyComponentHostHeader:
+		default:
+			return fmt.Errorf("unrecognized key component '%s' (expecting client_ip, local_port, sni, or host_header)", component)
+		}
+	}
+	return nil
+}
+
+// composeKey builds the hash key for the request from the configured
+// components. clientIP is the already-extracted (and masked) IP the
+// policy would hash on its own; with no components configured it is
+// returned untouched, so the default path stays allocation-free.
+func (c *keyComponentChooser) composeKey(req *http.Request, clientIP string) string {
+	if len(c.KeyComponents) == 0 {
+		return clientIP
+	}
+	parts := make([]string, len(c.KeyComponents))
+	for i, component := range c.KeyComponents {
+		switch component {
+		case keyComponentClientIP:
+			parts[i] = clientIP
+		case keyComponentLocalPort:
+			parts[i] = localPortKey(req)
+		case keyComponentSNI:
+			if req.TLS != nil {
+				parts[i] = req.TLS.ServerName
+			}
+		case keyComponentHostHeader:
+			parts[i] = req.Host
+		}
+	}
+	return strings.Join(parts, keyComponentSeparator)
+}
+
+// localPortKey returns the local port the request's connection arrived
+// on, or the port of the Host header when the listener address is not
+// in the request context, or "" when neither carries a port.
+func localPortKey(req *http.Request) string {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		return port
+	}
+	return ""
+}
+
+// unmarshalKeyComponentsOption parses the `key_components
+// <component...>` Caddyfile option shared by the IP-affinity selection
+// policies. It reports whether the current token was it, so callers can
+// fall through to their own unrecognized-option error when it was not.
+func (c *keyComponentChooser) unmarshalKeyComponentsOption(d *caddyfile.Dispenser) (bool, error) {
+	if d.Val() != "key_components" {
+		return false, nil
+	}
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return true, d.ArgErr()
+	}
+	c.KeyComponents = args
+	return true, nil
+}
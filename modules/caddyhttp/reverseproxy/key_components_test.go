@@ -0,0 +1,169 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// keyComponentsRequest builds a request carrying every attribute the
+// key components can draw from: remote address, local listener address,
+// SNI, and Host header.
+func keyComponentsRequest(t *testing.T, remoteAddr string, localPort int, sni, host string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.RemoteAddr = remoteAddr
+	req.Host = host
+	if localPort > 0 {
+		localAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: localPort}
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, net.Addr(localAddr)))
+	}
+	if sni != "" {
+		req.TLS = &tls.ConnectionState{ServerName: sni}
+	}
+	return req
+}
+
+func TestKeyComponentsProvision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	sel := &IPHashSelection{}
+	sel.KeyComponents = []string{"client_ip", "local_port", "sni", "host_header"}
+	if err := sel.Provision(ctx); err != nil {
+		t.Errorf("Unexpected error for valid components: %v", err)
+	}
+
+	bad := &IPHashSelection{}
+	bad.KeyComponents = []string{"client_ip", "remote_port"}
+	if err := bad.Provision(ctx); err == nil {
+		t.Error("Expected an error for an unknown key component")
+	}
+
+	memento := &MementoSelection{Field: "uri"}
+	memento.KeyComponents = []string{"sni"}
+	if err := memento.Provision(ctx); err == nil {
+		t.Error("Expected an error for key_components with a non-ip field")
+	}
+
+	mementoIP := &MementoSelection{Field: "ip"}
+	mementoIP.KeyComponents = []string{"client_ip", "local_port"}
+	if err := mementoIP.Provision(ctx); err != nil {
+		t.Errorf("Unexpected error for memento ip field with components: %v", err)
+	}
+}
+
+func TestKeyComponentsCompose(t *testing.T) {
+	sel := IPHashSelection{}
+	sel.KeyComponents = []string{"client_ip", "local_port", "sni"}
+
+	req := keyComponentsRequest(t, "172.0.0.5:51234", 8443, "tenant-a.example", "tenant-a.example:8443")
+	key, _ := sel.requestKey(req)
+	if key != "172.0.0.5|8443|tenant-a.example" {
+		t.Errorf("Expected composed key '172.0.0.5|8443|tenant-a.example', got '%s'", key)
+	}
+
+	// plaintext request: the sni component is empty but keeps its slot
+	plain := keyComponentsRequest(t, "172.0.0.5:51234", 8080, "", "tenant-a.example:8080")
+	key, _ = sel.requestKey(plain)
+	if key != "172.0.0.5|8080|" {
+		t.Errorf("Expected composed key '172.0.0.5|8080|', got '%s'", key)
+	}
+
+	hostSel := ClientIPHashSelection{}
+	hostSel.KeyComponents = []string{"client_ip", "host_header"}
+	key, _ = hostSel.requestKey(req)
+	if key != "172.0.0.5|tenant-a.example:8443" {
+		t.Errorf("Expected composed key '172.0.0.5|tenant-a.example:8443', got '%s'", key)
+	}
+
+	// without a listener address in the context, local_port falls back
+	// to the Host header's port
+	noLocal := keyComponentsRequest(t, "172.0.0.5:51234", 0, "", "tenant-b.example:9443")
+	portSel := IPHashSelection{}
+	portSel.KeyComponents = []string{"client_ip", "local_port"}
+	key, _ = portSel.requestKey(noLocal)
+	if key != "172.0.0.5|9443" {
+		t.Errorf("Expected composed key '172.0.0.5|9443', got '%s'", key)
+	}
+}
+
+func TestKeyComponentsDefaultUnchanged(t *testing.T) {
+	req := keyComponentsRequest(t, "172.0.0.5:51234", 8443, "tenant-a.example", "tenant-a.example:8443")
+
+	sel := IPHashSelection{}
+	if key, _ := sel.requestKey(req); key != "172.0.0.5" {
+		t.Errorf("Expected the default key to stay the bare client IP, got '%s'", key)
+	}
+
+	memento := MementoSelection{Field: "ip"}
+	if key, _ := memento.requestKey(req); key != "172.0.0.5" {
+		t.Errorf("Expected the default memento ip key to stay the bare client IP, got '%s'", key)
+	}
+}
+
+func TestKeyComponentsSeparateTenants(t *testing.T) {
+	// the same client on two tenant ports must produce distinct keys
+	sel := IPHashSelection{}
+	sel.KeyComponents = []string{"client_ip", "local_port"}
+
+	tenantA := keyComponentsRequest(t, "172.0.0.5:51234", 8443, "", "example.com:8443")
+	tenantB := keyComponentsRequest(t, "172.0.0.5:51234", 9443, "", "example.com:9443")
+	keyA, _ := sel.requestKey(tenantA)
+	keyB, _ := sel.requestKey(tenantB)
+	if keyA == keyB {
+		t.Errorf("Expected distinct keys per tenant port, both were '%s'", keyA)
+	}
+}
+
+func TestKeyComponentsCaddyfileOption(t *testing.T) {
+	sel := IPHashSelection{}
+	if err := sel.UnmarshalCaddyfile(caddyfile.NewTestDispenser("ip_hash {\n\tkey_components client_ip local_port\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if len(sel.KeyComponents) != 2 || sel.KeyComponents[0] != "client_ip" || sel.KeyComponents[1] != "local_port" {
+		t.Errorf("Expected [client_ip local_port], got %v", sel.KeyComponents)
+	}
+
+	clientSel := ClientIPHashSelection{}
+	if err := clientSel.UnmarshalCaddyfile(caddyfile.NewTestDispenser("client_ip_hash {\n\tkey_components client_ip sni\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if len(clientSel.KeyComponents) != 2 || clientSel.KeyComponents[1] != "sni" {
+		t.Errorf("Expected [client_ip sni], got %v", clientSel.KeyComponents)
+	}
+
+	memento := MementoSelection{}
+	if err := memento.UnmarshalCaddyfile(caddyfile.NewTestDispenser("memento ip {\n\tkey_components client_ip local_port\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if len(memento.KeyComponents) != 2 {
+		t.Errorf("Expected 2 components, got %v", memento.KeyComponents)
+	}
+
+	if err := (&IPHashSelection{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser("ip_hash {\n\tkey_components\n}")); err == nil {
+		t.Error("Expected an error for key_components with no arguments")
+	}
+}
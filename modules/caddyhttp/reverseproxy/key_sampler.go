@@ -0,0 +1,75 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import "sync"
+
+// defaultRecentKeyLimit is how many distinct recent keys a sampler
+// retains when no explicit limit is configured.
+const defaultRecentKeyLimit = 1024
+
+// recentKeySampler keeps a bounded sample of the most recently seen
+// distinct hash keys. The removal simulation endpoint replays this
+// sample to estimate how much traffic would move if an upstream were
+// taken down, so the sample only needs to be representative, not
+// complete. Once the ring is full, each new distinct key evicts the
+// oldest one.
+type recentKeySampler struct {
+	mu    sync.Mutex
+	limit int
+	keys  []string       // ring buffer of distinct keys
+	index map[string]int // key -> position in keys, for O(1) dedup
+	next  int            // next ring slot to overwrite once full
+}
+
+// newRecentKeySampler returns a sampler retaining at most limit
+// distinct keys; a non-positive limit selects the default.
+func newRecentKeySampler(limit int) *recentKeySampler {
+	if limit <= 0 {
+		limit = defaultRecentKeyLimit
+	}
+	return &recentKeySampler{
+		limit: limit,
+		index: make(map[string]int, limit),
+	}
+}
+
+// record notes that the given key was just used for a selection. Keys
+// already in the sample are left in place, so the hot path for steady
+// traffic is one map lookup under the lock.
+func (rs *recentKeySampler) record(key string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, seen := rs.index[key]; seen {
+		return
+	}
+	if len(rs.keys) < rs.limit {
+		rs.index[key] = len(rs.keys)
+		rs.keys = append(rs.keys, key)
+		return
+	}
+	oldest := rs.keys[rs.next]
+	delete(rs.index, oldest)
+	rs.keys[rs.next] = key
+	rs.index[key] = rs.next
+	rs.next = (rs.next + 1) % rs.limit
+}
+
+// snapshot returns a copy of the current sample.
+func (rs *recentKeySampler) snapshot() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]string{}, rs.keys...)
+}
@@ -0,0 +1,257 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "reverse-proxy-map",
+		Usage: `--config <path> [--adapter <name>] [--route <path>] [--id <id>]`,
+		Short: "Compute a selection policy's key-to-upstream mapping offline",
+		Long: `
+Loads a config file, locates a reverse_proxy handler in it, provisions
+just that handler's load balancing selection policy, and maps keys read
+from stdin (one per line) to upstreams, writing "key,upstream" CSV to
+stdout. No server is started and no health checking runs: the mapping
+reflects the configured topology with every upstream treated as
+available.
+
+The handler is located by the path matcher of its enclosing route
+(--route, matched verbatim against the configured path matcher) or by
+the @id of the handler object (--id). If the config contains exactly
+one reverse_proxy handler, neither flag is needed.
+
+Only deterministic, key-driven policies can be mapped offline: the
+hashing policies and the memento family. Policies whose choice depends
+on runtime state (cookie, least_conn, random, ...) are refused.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("config", "c", "", "Configuration file to load")
+			cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.Flags().String("route", "", "Path matcher of the route enclosing the handler")
+			cmd.Flags().String("id", "", "@id of the reverse_proxy handler object")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdReverseProxyMap)
+		},
+	})
+}
+
+func cmdReverseProxyMap(fs caddycmd.Flags) (int, error) {
+	configFile := fs.String("config")
+	if configFile == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--config is required")
+	}
+	cfgJSON, _, _, err := caddycmd.LoadConfig(configFile, fs.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	err = mapSelectionKeys(cfgJSON, fs.String("route"), fs.String("id"), os.Stdin, os.Stdout)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// mapSelectionKeys is the core of the reverse-proxy-map command: it
+// finds the addressed reverse_proxy handler in the config, provisions
+// its selection policy in a minimal context, seeds the policy's
+// topology from the configured upstreams, and writes one "key,upstream"
+// CSV record per non-empty input line.
+func mapSelectionKeys(cfgJSON []byte, routePath, id string, in io.Reader, out io.Writer) error {
+	candidate, err := findReverseProxyHandler(cfgJSON, routePath, id)
+	if err != nil {
+		return err
+	}
+
+	var handlerCfg struct {
+		Upstreams     UpstreamPool `json:"upstreams,omitempty"`
+		LoadBalancing *struct {
+			SelectionPolicyRaw json.RawMessage `json:"selection_policy,omitempty"`
+		} `json:"load_balancing,omitempty"`
+	}
+	if err := json.Unmarshal(candidate.raw, &handlerCfg); err != nil {
+		return fmt.Errorf("decoding reverse_proxy handler: %v", err)
+	}
+	if len(handlerCfg.Upstreams) == 0 {
+		return fmt.Errorf("the reverse_proxy handler has no static upstreams; offline mapping needs a configured upstream list")
+	}
+	if handlerCfg.LoadBalancing == nil || len(handlerCfg.LoadBalancing.SelectionPolicyRaw) == 0 {
+		return fmt.Errorf("no selection policy configured; the default random policy cannot be mapped offline")
+	}
+
+	var probe struct {
+		Policy string `json:"policy"`
+	}
+	if err := json.Unmarshal(handlerCfg.LoadBalancing.SelectionPolicyRaw, &probe); err != nil || probe.Policy == "" {
+		return fmt.Errorf("selection policy has no 'policy' name")
+	}
+
+	// strip the inline module name key the way module loading normally
+	// would; the strict decoder rejects it as an unknown field otherwise
+	var policyCfg map[string]any
+	if err := json.Unmarshal(handlerCfg.LoadBalancing.SelectionPolicyRaw, &policyCfg); err != nil {
+		return fmt.Errorf("decoding selection policy: %v", err)
+	}
+	delete(policyCfg, "policy")
+	delete(policyCfg, "@id")
+	policyJSON, err := json.Marshal(policyCfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	val, err := ctx.LoadModuleByID("http.reverse_proxy.selection_policies."+probe.Policy, policyJSON)
+	if err != nil {
+		return fmt.Errorf("provisioning selection policy '%s': %v", probe.Policy, err)
+	}
+	previewer, ok := val.(Previewer)
+	if !ok {
+		return fmt.Errorf("selection policy '%s' depends on runtime state and cannot be mapped offline; only the hashing and memento policies are supported", probe.Policy)
+	}
+
+	pool := handlerCfg.Upstreams
+	for _, upstream := range pool {
+		upstream.fillHost()
+	}
+	if initializer, ok := val.(TopologyInitializer); ok {
+		initializer.PopulateInitialTopology(pool)
+	}
+
+	writer := csv.NewWriter(out)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" {
+			continue
+		}
+		if err := writer.Write([]string{key, previewer.Preview(pool, key).Upstream}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// mapHandlerCandidate is one reverse_proxy handler found in a config,
+// along with how it can be addressed on the command line.
+type mapHandlerCandidate struct {
+	raw   json.RawMessage
+	id    string
+	paths []string
+}
+
+// findReverseProxyHandler walks the config for reverse_proxy handlers
+// and returns the one addressed by routePath and/or id; either selector
+// left empty matches everything. Exactly one handler must remain.
+func findReverseProxyHandler(cfgJSON []byte, routePath, id string) (mapHandlerCandidate, error) {
+	var candidates []mapHandlerCandidate
+	collectReverseProxyHandlers(cfgJSON, nil, &candidates)
+	if len(candidates) == 0 {
+		return mapHandlerCandidate{}, fmt.Errorf("no reverse_proxy handler found in config")
+	}
+
+	var matches []mapHandlerCandidate
+	for _, candidate := range candidates {
+		if id != "" && candidate.id != id {
+			continue
+		}
+		if routePath != "" && !slices.Contains(candidate.paths, routePath) {
+			continue
+		}
+		matches = append(matches, candidate)
+	}
+	switch len(matches) {
+	case 1:
+		return matches[0], nil
+	case 0:
+		return mapHandlerCandidate{}, fmt.Errorf("no reverse_proxy handler matches the given --route/--id (%d in config)", len(candidates))
+	default:
+		return mapHandlerCandidate{}, fmt.Errorf("%d reverse_proxy handlers match; disambiguate with --route or --id", len(matches))
+	}
+}
+
+// collectReverseProxyHandlers recursively walks raw JSON, recording
+// every object with "handler": "reverse_proxy". paths carries the path
+// matchers of the nearest enclosing route so handlers can later be
+// addressed by route.
+func collectReverseProxyHandlers(raw json.RawMessage, paths []string, out *[]mapHandlerCandidate) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err == nil {
+		var handlerName string
+		if nameRaw, ok := obj["handler"]; ok {
+			_ = json.Unmarshal(nameRaw, &handlerName)
+		}
+		if handlerName == "reverse_proxy" {
+			var objID string
+			if idRaw, ok := obj["@id"]; ok {
+				_ = json.Unmarshal(idRaw, &objID)
+			}
+			*out = append(*out, mapHandlerCandidate{raw: raw, id: objID, paths: paths})
+			return
+		}
+		// a route's matchers address everything nested under it
+		if matchRaw, ok := obj["match"]; ok {
+			if routePaths := pathMatchersIn(matchRaw); len(routePaths) > 0 {
+				paths = routePaths
+			}
+		}
+		for _, value := range obj {
+			collectReverseProxyHandlers(value, paths, out)
+		}
+		return
+	}
+	var arr []json.RawMessage
+	if err := json.Unmarshal(raw, &arr); err == nil {
+		for _, value := range arr {
+			collectReverseProxyHandlers(value, paths, out)
+		}
+	}
+}
+
+// pathMatchersIn extracts the "path" matcher values from a route's
+// matcher sets.
+func pathMatchersIn(raw json.RawMessage) []string {
+	var sets []struct {
+		Path []string `json:"path"`
+	}
+	if err := json.Unmarshal(raw, &sets); err != nil {
+		return nil
+	}
+	var paths []string
+	for _, set := range sets {
+		paths = append(paths, set.Path...)
+	}
+	return paths
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const mapCommandTestConfig = `{
+	"apps": {
+		"http": {
+			"servers": {
+				"srv0": {
+					"listen": [":8080"],
+					"routes": [
+						{
+							"match": [{"path": ["/api/*"]}],
+							"handle": [{
+								"@id": "api_proxy",
+								"handler": "reverse_proxy",
+								"load_balancing": {
+									"selection_policy": {"policy": "memento", "field": "uri"}
+								},
+								"upstreams": [
+									{"dial": "10.0.0.1:8080"},
+									{"dial": "10.0.0.2:8080"},
+									{"dial": "10.0.0.3:8080"}
+								]
+							}]
+						},
+						{
+							"match": [{"path": ["/static/*"]}],
+							"handle": [{
+								"handler": "reverse_proxy",
+								"load_balancing": {
+									"selection_policy": {"policy": "least_conn"}
+								},
+								"upstreams": [{"dial": "10.0.0.9:8080"}]
+							}]
+						}
+					]
+				}
+			}
+		}
+	}
+}`
+
+// writeMapCommandTestConfig stages the test config in a temp file the
+// way an operator would pass it on the command line, and reads it back
+// as config bytes.
+func writeMapCommandTestConfig(t *testing.T) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(mapCommandTestConfig), 0o600); err != nil {
+		t.Fatalf("Failed to write temp config: %v", err)
+	}
+	cfgJSON, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read temp config: %v", err)
+	}
+	return cfgJSON
+}
+
+func TestMapSelectionKeysMemento(t *testing.T) {
+	cfgJSON := writeMapCommandTestConfig(t)
+
+	var keys []string
+	for i := 0; i < 32; i++ {
+		keys = append(keys, fmt.Sprintf("/api/tenant/%d", i))
+	}
+	input := strings.Join(keys, "\n") + "\n\n" // trailing blank line is skipped
+
+	var out bytes.Buffer
+	if err := mapSelectionKeys(cfgJSON, "", "api_proxy", strings.NewReader(input), &out); err != nil {
+		t.Fatalf("mapSelectionKeys error: %v", err)
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(out.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatalf("Output is not valid CSV: %v", err)
+	}
+	if len(records) != len(keys) {
+		t.Fatalf("Expected %d records, got %d", len(keys), len(records))
+	}
+
+	// golden mapping: a memento policy provisioned directly from the
+	// same config must agree on every key
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	golden := &MementoSelection{Field: "uri"}
+	if err := golden.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := UpstreamPool{
+		{Dial: "10.0.0.1:8080"},
+		{Dial: "10.0.0.2:8080"},
+		{Dial: "10.0.0.3:8080"},
+	}
+	for _, upstream := range pool {
+		upstream.fillHost()
+	}
+	golden.PopulateInitialTopology(pool)
+
+	for i, record := range records {
+		if len(record) != 2 {
+			t.Fatalf("Record %d: expected 2 fields, got %v", i, record)
+		}
+		if record[0] != keys[i] {
+			t.Errorf("Record %d: expected key '%s', got '%s'", i, keys[i], record[0])
+		}
+		if expected := golden.Preview(pool, keys[i]).Upstream; record[1] != expected {
+			t.Errorf("Record %d: expected upstream '%s' for key '%s', got '%s'", i, expected, keys[i], record[1])
+		}
+	}
+
+	// the mapping is a pure function of config and key
+	var again bytes.Buffer
+	if err := mapSelectionKeys(cfgJSON, "", "api_proxy", strings.NewReader(input), &again); err != nil {
+		t.Fatalf("mapSelectionKeys error on second run: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), again.Bytes()) {
+		t.Error("Expected two runs over the same config and keys to produce identical output")
+	}
+}
+
+func TestMapSelectionKeysHandlerAddressing(t *testing.T) {
+	cfgJSON := writeMapCommandTestConfig(t)
+
+	// two handlers in the config: no selector is ambiguous
+	err := mapSelectionKeys(cfgJSON, "", "", strings.NewReader("/api/x\n"), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "disambiguate") {
+		t.Errorf("Expected an ambiguity error with no selector, got %v", err)
+	}
+
+	// addressing by route path works
+	var out bytes.Buffer
+	if err := mapSelectionKeys(cfgJSON, "/api/*", "", strings.NewReader("/api/x\n"), &out); err != nil {
+		t.Fatalf("mapSelectionKeys by route error: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "/api/x,10.0.0.") {
+		t.Errorf("Expected a mapping record, got '%s'", out.String())
+	}
+
+	// a selector that matches nothing reports so
+	err = mapSelectionKeys(cfgJSON, "", "no_such_id", strings.NewReader(""), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "matches") {
+		t.Errorf("Expected a no-match error for an unknown id, got %v", err)
+	}
+}
+
+func TestMapSelectionKeysRefusesStatefulPolicy(t *testing.T) {
+	cfgJSON := writeMapCommandTestConfig(t)
+
+	err := mapSelectionKeys(cfgJSON, "/static/*", "", strings.NewReader("key\n"), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("Expected a refusal for least_conn")
+	}
+	if !strings.Contains(err.Error(), "least_conn") || !strings.Contains(err.Error(), "cannot be mapped offline") {
+		t.Errorf("Expected the refusal to name the policy, got: %v", err)
+	}
+}
@@ -58,15 +58,37 @@ func NewBinomialEngine(size int) *BinomialEngine {
 	return engine
 }
 
+// Clone returns a copy of the engine. The state is three integers, so
+// the copy is trivially independent of the original.
+func (be *BinomialEngine) Clone() *BinomialEngine {
+	clone := *be
+	return &clone
+}
+
 // GetBucket returns the index of the bucket where the given key should be mapped
 func (be *BinomialEngine) GetBucket(key string) int {
+	return binomialBucket(be, key)
+}
+
+// GetBucketBytes is GetBucket for callers that already hold the key as
+// a byte slice; the key is hashed in place, without converting it to a
+// string first.
+func (be *BinomialEngine) GetBucketBytes(key []byte) int {
+	return binomialBucket(be, key)
+}
+
+// binomialBucket maps a key to its bucket. It is generic over the two
+// key representations so the string and byte-slice entry points share
+// one implementation without a conversion (and its copy) on either
+// path.
+func binomialBucket[T keyString](be *BinomialEngine, key T) int {
 	// If the cluster counts only one node we return such a node
 	if be.size < 2 {
 		return 0
 	}
 
 	// We get the hash of the provided key
-	hash := be.hash(key)
+	hash := murmurHash(key)
 
 	// We get a position within the enclosing tree based on the value of the key hash
 	bucket := int(hash) & be.enclosingTreeFilter
@@ -174,12 +196,19 @@ func (be *BinomialEngine) relocateWithinLevel(bucket int, hash uint64) int {
 	return levelBaseIndex + levelIndex
 }
 
-// hash performs the hashing of the given string using MurmurHash3
-func (be *BinomialEngine) hash(key string) uint64 {
+// keyString constrains the two key representations the hashing entry
+// points accept. Hashing reads the key byte by byte, which both forms
+// support directly, so sharing the implementation needs no conversion
+// (and no unsafe tricks).
+type keyString interface {
+	~string | ~[]byte
+}
+
+// murmurHash performs the hashing of the given key using MurmurHash3
+func murmurHash[T keyString](key T) uint64 {
 	// Simple MurmurHash3 implementation for 32-bit hash
 	// This is a simplified version - in production you might want to use
 	// a proper MurmurHash3 library like github.com/spaolacci/murmur3
-	bytes := []byte(key)
 
 	// MurmurHash3 32-bit implementation
 	const (
@@ -192,11 +221,11 @@ func (be *BinomialEngine) hash(key string) uint64 {
 	)
 
 	h := uint32(0) // seed = 0
-	length := len(bytes)
+	length := len(key)
 
 	// Process 4-byte chunks
 	for i := 0; i < length-3; i += 4 {
-		k := uint32(bytes[i]) | uint32(bytes[i+1])<<8 | uint32(bytes[i+2])<<16 | uint32(bytes[i+3])<<24
+		k := uint32(key[i]) | uint32(key[i+1])<<8 | uint32(key[i+2])<<16 | uint32(key[i+3])<<24
 		k *= c1
 		k = bits.RotateLeft32(k, r1)
 		k *= c2
@@ -211,13 +240,13 @@ func (be *BinomialEngine) hash(key string) uint64 {
 		var k uint32
 		switch length % 4 {
 		case 3:
-			k ^= uint32(bytes[length-3]) << 16
+			k ^= uint32(key[length-3]) << 16
 			fallthrough
 		case 2:
-			k ^= uint32(bytes[length-2]) << 8
+			k ^= uint32(key[length-2]) << 8
 			fallthrough
 		case 1:
-			k ^= uint32(bytes[length-1])
+			k ^= uint32(key[length-1])
 			k *= c1
 			k = bits.RotateLeft32(k, r1)
 			k *= c2
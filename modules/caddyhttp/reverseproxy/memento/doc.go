@@ -0,0 +1,41 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memento implements the MementoHash consistent hashing
+// algorithm (https://arxiv.org/pdf/2406.19836): BinomialEngine maps
+// keys over a bucket range that grows and shrinks at the tail, and
+// MementoEngine layers a replacement set on top of it so arbitrary
+// buckets can be removed and restored with minimal key movement.
+//
+// The package deliberately knows nothing about upstreams or load
+// balancing: buckets are plain ints and keys are strings or byte
+// slices. There is exactly one node-keyed engine built on these
+// primitives — ConsistentEngine in the parent reverseproxy package,
+// which pairs a MementoEngine with a bucket-to-upstream indirection and
+// is shared by the memento selection policies. ConsistentEngine also
+// enforces the node-identity invariants — identities are non-empty and
+// unique in the topology — and reports violations with the typed errors
+// ErrEmptyNodeID, ErrDuplicateNode and ErrUnknownNode, so lookups can
+// never hand back a node that is indistinguishable from "no node". New
+// engine behavior
+// belongs here only when it is expressible in terms of buckets; anything
+// involving node identity belongs in ConsistentEngine, so fixes land in
+// one place.
+//
+// The exported surface — BinomialEngine, MementoEngine, the two
+// replacement-set implementations (Memento and MementoLockFree behind
+// MementoInterface), and the EntrySnapshot serialization types — is
+// stable: external plugins build custom selection policies against it,
+// so breaking changes require a deprecation cycle.
+package memento
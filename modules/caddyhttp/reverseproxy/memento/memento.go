@@ -185,6 +185,32 @@ func (m *Memento) Capacity() int {
 	return m.capacityForSize(tableLen)
 }
 
+// Clone returns a deep copy of the replacement set. Every entry is
+// copied, so the clone can be mutated freely without affecting the
+// original or its concurrent readers.
+func (m *Memento) Clone() MementoInterface {
+	m.mu.RLock()
+	table := m.table
+	m.mu.RUnlock()
+
+	clone := &Memento{
+		table:        make([]*Entry, len(table)),
+		minTableSize: m.minTableSize,
+		maxTableSize: m.maxTableSize,
+	}
+	for _, entry := range table {
+		for ; entry != nil; entry = entry.next {
+			clone.add(&Entry{
+				bucket:      entry.bucket,
+				replacer:    entry.replacer,
+				prevRemoved: entry.prevRemoved,
+			}, clone.table)
+			clone.size++
+		}
+	}
+	return clone
+}
+
 // isEmpty returns true if the replacement set is empty (internal use, no locking)
 func (m *Memento) isEmpty() bool {
 	return atomic.LoadInt64(&m.size) <= 0
@@ -16,7 +16,6 @@ package memento
 
 import (
 	"fmt"
-	"hash/fnv"
 )
 
 // MementoInterface defines the interface for both Memento implementations
@@ -27,6 +26,8 @@ type MementoInterface interface {
 	IsEmpty() bool
 	Size() int
 	Capacity() int
+	Clone() MementoInterface
+	Entries() []EntrySnapshot
 	String() string
 }
 
@@ -69,9 +70,36 @@ func NewMementoEngineWithType(size int, lockFree bool) *MementoEngine {
 	}
 }
 
+// Clone returns a deep copy of the engine: the memento replacement set,
+// the binomial engine state, and the last removed bucket. The clone
+// shares nothing with the original, so callers can mutate it freely
+// (e.g. to simulate a removal) without affecting live lookups.
+func (me *MementoEngine) Clone() *MementoEngine {
+	return &MementoEngine{
+		memento:        me.memento.Clone(),
+		binomialEngine: me.binomialEngine.Clone(),
+		lastRemoved:    me.lastRemoved,
+	}
+}
+
 // GetBucket returns the bucket where the given key should be mapped.
 func (me *MementoEngine) GetBucket(key string) int {
-	b := me.binomialEngine.GetBucket(key)
+	return mementoBucket(me, key)
+}
+
+// GetBucketBytes is GetBucket for callers that already hold the key as
+// a byte slice; the key is hashed in place, without converting it to a
+// string first.
+func (me *MementoEngine) GetBucketBytes(key []byte) int {
+	return mementoBucket(me, key)
+}
+
+// mementoBucket maps a key to its bucket, following replacements for
+// removed buckets. It is generic over the two key representations so
+// the string and byte-slice entry points share one implementation
+// without a conversion on either path.
+func mementoBucket[T keyString](me *MementoEngine, key T) int {
+	b := binomialBucket(me.binomialEngine, key)
 
 	/*
 	 * We check if the bucket was removed, if not we are done.
@@ -88,7 +116,7 @@ func (me *MementoEngine) GetBucket(key string) int {
 		 * represents the size of the working set when the bucket
 		 * was removed and get a new bucket in [0,replacer-1].
 		 */
-		h := me.hashWithSeed(key, b)
+		h := hashWithSeed(key, b)
 		b = int(h % uint64(replacer))
 
 		/*
@@ -123,6 +151,57 @@ func (me *MementoEngine) AddBucket() int {
 	return bucket
 }
 
+// IsRemembered reports whether the given bucket's removal is still
+// remembered, i.e. RestoreBucket can unwind it exactly.
+func (me *MementoEngine) IsRemembered(bucket int) bool {
+	if me.memento.Replacer(bucket) >= 0 {
+		return true
+	}
+	// a removal taken while the replacement set was empty shrinks the
+	// binomial engine instead of leaving a record; the shrunk bucket is
+	// restorable as long as nothing was removed or added after it
+	return bucket == me.lastRemoved && bucket == me.binomialArraySize()
+}
+
+// RestoreBucket restores the given removed bucket to the working set.
+// AddBucket always revives the most recently removed bucket (LIFO);
+// this instead unwinds the remembered removal of exactly this bucket,
+// so the keys that mapped to it before the removal map to it again even
+// when other buckets were removed after it. When the bucket is not the
+// head of the removal sequence, its successor's link is rewritten to
+// skip it, keeping the sequence intact for later restores. Returns
+// false — leaving the engine untouched — when the bucket's removal is
+// not remembered; the caller should fall back to AddBucket.
+func (me *MementoEngine) RestoreBucket(bucket int) bool {
+	if me.memento.Replacer(bucket) < 0 {
+		if bucket == me.lastRemoved && bucket == me.binomialArraySize() {
+			me.AddBucket()
+			return true
+		}
+		return false
+	}
+	if bucket == me.lastRemoved {
+		me.lastRemoved = me.memento.Restore(bucket)
+		return true
+	}
+	// the bucket sits in the middle of the removal sequence: find its
+	// successor (the bucket removed right after it) before restoring,
+	// then re-link the successor to the bucket removed before this one
+	var successor *EntrySnapshot
+	for _, entry := range me.memento.Entries() {
+		if entry.PrevRemoved == bucket {
+			successor = &entry
+			break
+		}
+	}
+	prevRemoved := me.memento.Restore(bucket)
+	if successor != nil {
+		me.memento.Restore(successor.Bucket)
+		me.memento.Remember(successor.Bucket, successor.Replacer, prevRemoved)
+	}
+	return true
+}
+
 // RemoveBucket removes a bucket from the working set
 func (me *MementoEngine) RemoveBucket(bucket int) int {
 	// Calculate working size (size after removal)
@@ -189,11 +268,24 @@ func (me *MementoEngine) String() string {
 	)
 }
 
-// hashWithSeed returns a hash of the key with the given seed
-// This simulates the hashFunction.hash(key, seed) from Java
-func (me *MementoEngine) hashWithSeed(key string, seed int) uint64 {
-	h := fnv.New64a()
-	h.Write([]byte(key))
-	h.Write([]byte{byte(seed), byte(seed >> 8), byte(seed >> 16), byte(seed >> 24)})
-	return h.Sum64()
+// hashWithSeed returns a FNV-1a hash of the key with the given seed
+// appended in little-endian order. This simulates the
+// hashFunction.hash(key, seed) from Java. The algorithm is written out
+// instead of going through hash/fnv so that neither key representation
+// pays for a []byte conversion or a hash.Hash allocation per call.
+func hashWithSeed[T keyString](key T, seed int) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	for _, b := range [4]byte{byte(seed), byte(seed >> 8), byte(seed >> 16), byte(seed >> 24)} {
+		h ^= uint64(b)
+		h *= prime64
+	}
+	return h
 }
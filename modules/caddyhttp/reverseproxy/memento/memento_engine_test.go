@@ -674,3 +674,129 @@ func TestMementoEngineLoadBalancing(t *testing.T) {
 			CV, CV_max, CV_atteso)
 	}
 }
+
+// TestMementoEngineSnapshotRoundTrip proves that serializing an engine
+// and restoring it into a fresh one preserves the key-to-bucket mapping
+// exactly, including the replacer chains left by removals and restores.
+func TestMementoEngineSnapshotRoundTrip(t *testing.T) {
+	for _, variant := range []struct {
+		name     string
+		lockFree bool
+	}{
+		{"rwmutex", false},
+		{"lockfree", true},
+	} {
+		t.Run(variant.name, func(t *testing.T) {
+			engine := NewMementoEngineWithType(0, variant.lockFree)
+			for i := 0; i < 30; i++ {
+				engine.AddBucket()
+			}
+
+			// build a non-trivial removal history: several removals,
+			// a couple of restores, then more removals
+			for _, bucket := range []int{3, 17, 8, 25} {
+				engine.RemoveBucket(bucket)
+			}
+			engine.AddBucket()
+			engine.AddBucket()
+			for _, bucket := range []int{11, 29} {
+				engine.RemoveBucket(bucket)
+			}
+
+			data, err := engine.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary error: %v", err)
+			}
+			restored := NewMementoEngineWithType(0, variant.lockFree)
+			if err := restored.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary error: %v", err)
+			}
+
+			if restored.Size() != engine.Size() {
+				t.Fatalf("Expected restored size %d, got %d", engine.Size(), restored.Size())
+			}
+			if restored.MementoSize() != engine.MementoSize() {
+				t.Fatalf("Expected restored memento size %d, got %d",
+					engine.MementoSize(), restored.MementoSize())
+			}
+			if restored.LastRemoved() != engine.LastRemoved() {
+				t.Fatalf("Expected restored last removed %d, got %d",
+					engine.LastRemoved(), restored.LastRemoved())
+			}
+
+			const numKeys = 50000
+			for i := 0; i < numKeys; i++ {
+				key := fmt.Sprintf("snapshot-key-%d", i)
+				if want, got := engine.GetBucket(key), restored.GetBucket(key); got != want {
+					t.Fatalf("Key %s: expected bucket %d after round trip, got %d", key, want, got)
+				}
+			}
+
+			// the restored engine must also evolve identically: the same
+			// removal and restore applied to both keeps them in lockstep
+			engine.RemoveBucket(5)
+			restored.RemoveBucket(5)
+			engine.AddBucket()
+			restored.AddBucket()
+			for i := 0; i < numKeys; i++ {
+				key := fmt.Sprintf("snapshot-key-%d", i)
+				if want, got := engine.GetBucket(key), restored.GetBucket(key); got != want {
+					t.Fatalf("Key %s: engines diverged after post-restore mutation: %d vs %d", key, want, got)
+				}
+			}
+		})
+	}
+}
+
+// TestMementoEngineSnapshotRejectsCorruptData verifies that invalid
+// snapshots are rejected and leave the receiver untouched.
+func TestMementoEngineSnapshotRejectsCorruptData(t *testing.T) {
+	engine := NewMementoEngine(10)
+	engine.RemoveBucket(4)
+	before := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("corrupt-key-%d", i)
+		before[key] = engine.GetBucket(key)
+	}
+
+	for name, data := range map[string]string{
+		"not json":         "not json at all",
+		"negative size":    `{"binomial_size":-1,"enclosing_tree_filter":0,"minor_tree_filter":0,"last_removed":0,"removals":[]}`,
+		"negative filters": `{"binomial_size":4,"enclosing_tree_filter":-3,"minor_tree_filter":-1,"last_removed":4,"removals":[]}`,
+		"too many removals": `{"binomial_size":2,"enclosing_tree_filter":1,"minor_tree_filter":0,"last_removed":2,` +
+			`"removals":[{"bucket":0,"replacer":1,"prev_removed":2},{"bucket":1,"replacer":0,"prev_removed":0},{"bucket":2,"replacer":0,"prev_removed":1}]}`,
+		"bucket out of range": `{"binomial_size":4,"enclosing_tree_filter":3,"minor_tree_filter":1,"last_removed":4,` +
+			`"removals":[{"bucket":9,"replacer":3,"prev_removed":4}]}`,
+		"duplicate removal": `{"binomial_size":4,"enclosing_tree_filter":3,"minor_tree_filter":1,"last_removed":4,` +
+			`"removals":[{"bucket":1,"replacer":3,"prev_removed":4},{"bucket":1,"replacer":2,"prev_removed":1}]}`,
+	} {
+		if err := engine.UnmarshalBinary([]byte(data)); err == nil {
+			t.Errorf("Expected error restoring %s snapshot", name)
+		}
+	}
+
+	// the failed restores must not have disturbed the live state
+	for key, want := range before {
+		if got := engine.GetBucket(key); got != want {
+			t.Fatalf("Key %s: expected bucket %d after rejected restores, got %d", key, want, got)
+		}
+	}
+}
+
+func TestGetBucketBytesMatchesGetBucket(t *testing.T) {
+	for _, lockFree := range []bool{false, true} {
+		engine := NewMementoEngineWithType(10, lockFree)
+
+		// remove a few buckets so lookups also exercise the
+		// replacement-chasing (seeded hash) path
+		engine.RemoveBucket(3)
+		engine.RemoveBucket(7)
+
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if got, want := engine.GetBucketBytes([]byte(key)), engine.GetBucket(key); got != want {
+				t.Fatalf("GetBucketBytes(%q) = %d, GetBucket = %d (lockFree=%v)", key, got, want, lockFree)
+			}
+		}
+	}
+}
@@ -152,6 +152,33 @@ func (m *MementoLockFree) Capacity() int {
 	return m.capacityForSize(len(table))
 }
 
+// Clone returns a deep copy of the replacement set. Every entry is
+// copied, so the clone can be mutated freely without affecting the
+// original or its concurrent readers.
+func (m *MementoLockFree) Clone() MementoInterface {
+	table := m.getTable()
+
+	clone := &MementoLockFree{
+		minTableSize: m.minTableSize,
+		maxTableSize: m.maxTableSize,
+	}
+	newTable := make([]*Entry, len(table))
+	var size int64
+	for _, entry := range table {
+		for ; entry != nil; entry = entry.next {
+			clone.add(&Entry{
+				bucket:      entry.bucket,
+				replacer:    entry.replacer,
+				prevRemoved: entry.prevRemoved,
+			}, newTable)
+			size++
+		}
+	}
+	clone.table.Store(newTable)
+	clone.size = size
+	return clone
+}
+
 // isEmpty returns true if the replacement set is empty (internal use, no locking)
 func (m *MementoLockFree) isEmpty() bool {
 	return atomic.LoadInt64(&m.size) <= 0
@@ -0,0 +1,123 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memento
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// heapInUse forces a GC and returns the bytes currently allocated on
+// the heap, so before/after deltas isolate the memory retained by the
+// structures built in between.
+func heapInUse() float64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return float64(stats.HeapAlloc)
+}
+
+// BenchmarkMementoEngineBytesPerNode measures the heap retained per
+// bucket by a MementoEngine with no removal history. The engine itself
+// is O(1) in the number of buckets (the binomial engine is a pair of
+// filters, the replacement set is empty), so the reported bytes/node
+// should stay near zero and flat as N grows; a regression here means a
+// per-bucket structure crept in.
+func BenchmarkMementoEngineBytesPerNode(b *testing.B) {
+	for _, lockFree := range []bool{false, true} {
+		variant := "rwmutex"
+		if lockFree {
+			variant = "lockfree"
+		}
+		for _, n := range []int{100, 1000, 5000} {
+			b.Run(fmt.Sprintf("%s/nodes-%d", variant, n), func(b *testing.B) {
+				engines := make([]*MementoEngine, b.N)
+				before := heapInUse()
+				for i := 0; i < b.N; i++ {
+					engine := NewMementoEngineWithType(0, lockFree)
+					for j := 0; j < n; j++ {
+						engine.AddBucket()
+					}
+					engines[i] = engine
+				}
+				after := heapInUse()
+				b.ReportMetric((after-before)/float64(b.N*n), "bytes/node")
+				runtime.KeepAlive(engines)
+			})
+		}
+	}
+}
+
+// BenchmarkMementoBytesPerTombstone measures the heap retained per
+// remembered removal: engines are built first, their resting size is
+// taken, then half of each engine's buckets are removed and the delta
+// is attributed to the tombstones (the Entry records plus the lookup
+// table slots holding them).
+func BenchmarkMementoBytesPerTombstone(b *testing.B) {
+	for _, lockFree := range []bool{false, true} {
+		variant := "rwmutex"
+		if lockFree {
+			variant = "lockfree"
+		}
+		for _, n := range []int{100, 1000, 5000} {
+			b.Run(fmt.Sprintf("%s/nodes-%d", variant, n), func(b *testing.B) {
+				tombstones := n / 2
+				engines := make([]*MementoEngine, b.N)
+				for i := 0; i < b.N; i++ {
+					engine := NewMementoEngineWithType(n, lockFree)
+					engines[i] = engine
+				}
+				before := heapInUse()
+				for _, engine := range engines {
+					// remove every other bucket so the removals never
+					// collapse into plain binomial shrinks
+					for bucket := 0; bucket < tombstones; bucket++ {
+						engine.RemoveBucket(bucket * 2)
+					}
+				}
+				after := heapInUse()
+				b.ReportMetric((after-before)/float64(b.N*tombstones), "bytes/tombstone")
+				runtime.KeepAlive(engines)
+			})
+		}
+	}
+}
+
+// BenchmarkMementoLockFreeChurnAllocs measures allocations per topology
+// change on the lock-free replacement set at a steady tombstone count
+// N. Steady-state churn should cost one Entry per removal regardless of
+// N; anything proportional to N means a table copy (resize) is being
+// paid on every change instead of amortized across the hysteresis band.
+func BenchmarkMementoLockFreeChurnAllocs(b *testing.B) {
+	for _, n := range []int{16, 256, 4096} {
+		b.Run(fmt.Sprintf("tombstones-%d", n), func(b *testing.B) {
+			m := NewMementoLockFree()
+			last := n
+			for bucket := 0; bucket < n; bucket++ {
+				last = m.Remember(bucket, n-bucket-1, last)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// restore one tombstone and remember a fresh one, so the
+				// set size oscillates around N without drifting into the
+				// resize thresholds
+				m.Restore(n + i - 1)
+				m.Remember(n+i, 0, last)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memento
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// EntrySnapshot is the serializable view of one removal record in the
+// memento replacement set. Replacer doubles as the size of the working
+// set when the bucket was removed, and PrevRemoved links the records
+// into the removal history the same way the live entries do, so a
+// restored set replays removals in their original order.
+type EntrySnapshot struct {
+	Bucket      int `json:"bucket"`
+	Replacer    int `json:"replacer"`
+	PrevRemoved int `json:"prev_removed"`
+}
+
+// entrySnapshots walks the given lookup table and returns every entry,
+// sorted by bucket so serialized snapshots are byte-stable. size is the
+// expected number of entries, used to allocate the result in one shot.
+func entrySnapshots(table []*Entry, size int) []EntrySnapshot {
+	if size < 0 {
+		size = 0
+	}
+	entries := make([]EntrySnapshot, 0, size)
+	for _, entry := range table {
+		for ; entry != nil; entry = entry.next {
+			entries = append(entries, EntrySnapshot{
+				Bucket:      entry.bucket,
+				Replacer:    entry.replacer,
+				PrevRemoved: entry.prevRemoved,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Bucket < entries[j].Bucket
+	})
+	return entries
+}
+
+// validateEntrySnapshots rejects records that could never have been
+// produced by a live replacement set; replaying them would corrupt the
+// lookup table or panic during lookups.
+func validateEntrySnapshots(entries []EntrySnapshot) error {
+	seen := make(map[int]struct{}, len(entries))
+	for _, entry := range entries {
+		if entry.Bucket < 0 || entry.Replacer < 0 || entry.PrevRemoved < 0 {
+			return fmt.Errorf("invalid removal record for bucket %d", entry.Bucket)
+		}
+		if _, dup := seen[entry.Bucket]; dup {
+			return fmt.Errorf("duplicate removal record for bucket %d", entry.Bucket)
+		}
+		seen[entry.Bucket] = struct{}{}
+	}
+	return nil
+}
+
+// Entries returns the current removal records, sorted by bucket.
+func (m *Memento) Entries() []EntrySnapshot {
+	m.mu.RLock()
+	table := m.table
+	m.mu.RUnlock()
+	return entrySnapshots(table, m.Size())
+}
+
+// MarshalBinary serializes the replacement set as JSON. Together with
+// UnmarshalBinary it lets a later process rebuild the exact removal
+// history instead of starting from an empty set.
+func (m *Memento) MarshalBinary() ([]byte, error) {
+	return json.Marshal(m.Entries())
+}
+
+// UnmarshalBinary replaces the replacement set with the one encoded in
+// data. The new table is built fully aside and swapped in whole, so a
+// failed restore leaves the receiver untouched.
+func (m *Memento) UnmarshalBinary(data []byte) error {
+	var entries []EntrySnapshot
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	if err := validateEntrySnapshots(entries); err != nil {
+		return err
+	}
+	fresh := NewMemento()
+	for _, entry := range entries {
+		fresh.Remember(entry.Bucket, entry.Replacer, entry.PrevRemoved)
+	}
+	m.mu.Lock()
+	m.table = fresh.table
+	m.minTableSize = fresh.minTableSize
+	m.maxTableSize = fresh.maxTableSize
+	m.mu.Unlock()
+	atomic.StoreInt64(&m.size, atomic.LoadInt64(&fresh.size))
+	return nil
+}
+
+// Entries returns the current removal records, sorted by bucket.
+func (m *MementoLockFree) Entries() []EntrySnapshot {
+	return entrySnapshots(m.getTable(), m.Size())
+}
+
+// MarshalBinary serializes the replacement set as JSON. Together with
+// UnmarshalBinary it lets a later process rebuild the exact removal
+// history instead of starting from an empty set.
+func (m *MementoLockFree) MarshalBinary() ([]byte, error) {
+	return json.Marshal(m.Entries())
+}
+
+// UnmarshalBinary replaces the replacement set with the one encoded in
+// data. The new table is built fully aside and swapped in atomically,
+// so a failed restore leaves the receiver untouched.
+func (m *MementoLockFree) UnmarshalBinary(data []byte) error {
+	var entries []EntrySnapshot
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	if err := validateEntrySnapshots(entries); err != nil {
+		return err
+	}
+	fresh := NewMementoLockFree()
+	for _, entry := range entries {
+		fresh.Remember(entry.Bucket, entry.Replacer, entry.PrevRemoved)
+	}
+	m.minTableSize = fresh.minTableSize
+	m.maxTableSize = fresh.maxTableSize
+	m.table.Store(fresh.getTable())
+	atomic.StoreInt64(&m.size, atomic.LoadInt64(&fresh.size))
+	return nil
+}
+
+// mementoEngineSnapshot is the serialized form of a MementoEngine: the
+// exact binomial engine state (the filters are history-dependent, so
+// the size alone is not enough to reproduce them), the last removed
+// bucket, and the full removal history.
+type mementoEngineSnapshot struct {
+	BinomialSize        int             `json:"binomial_size"`
+	EnclosingTreeFilter int             `json:"enclosing_tree_filter"`
+	MinorTreeFilter     int             `json:"minor_tree_filter"`
+	LastRemoved         int             `json:"last_removed"`
+	Removals            []EntrySnapshot `json:"removals"`
+}
+
+// MarshalBinary serializes the engine as JSON so a restored engine maps
+// every key to the same bucket as the original, replacer chains
+// included.
+func (me *MementoEngine) MarshalBinary() ([]byte, error) {
+	return json.Marshal(mementoEngineSnapshot{
+		BinomialSize:        me.binomialEngine.Size(),
+		EnclosingTreeFilter: me.binomialEngine.EnclosingTreeFilter(),
+		MinorTreeFilter:     me.binomialEngine.MinorTreeFilter(),
+		LastRemoved:         me.lastRemoved,
+		Removals:            me.memento.Entries(),
+	})
+}
+
+// UnmarshalBinary replaces the engine state with the one encoded in
+// data. The replacement set keeps the receiver's implementation variant
+// (RWMutex or lock-free). The state is rebuilt fully aside and swapped
+// in whole, so a failed restore leaves the receiver untouched.
+func (me *MementoEngine) UnmarshalBinary(data []byte) error {
+	var snap mementoEngineSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.BinomialSize < 0 || snap.EnclosingTreeFilter < 0 || snap.MinorTreeFilter < 0 {
+		return fmt.Errorf("invalid binomial engine state")
+	}
+	if len(snap.Removals) > snap.BinomialSize {
+		return fmt.Errorf("snapshot removes %d buckets out of %d", len(snap.Removals), snap.BinomialSize)
+	}
+	if err := validateEntrySnapshots(snap.Removals); err != nil {
+		return err
+	}
+	var memory MementoInterface
+	if _, lockFree := me.memento.(*MementoLockFree); lockFree {
+		memory = NewMementoLockFree()
+	} else {
+		memory = NewMemento()
+	}
+	for _, entry := range snap.Removals {
+		if entry.Bucket >= snap.BinomialSize {
+			return fmt.Errorf("removal record for bucket %d exceeds binomial size %d", entry.Bucket, snap.BinomialSize)
+		}
+		memory.Remember(entry.Bucket, entry.Replacer, entry.PrevRemoved)
+	}
+	me.memento = memory
+	me.binomialEngine = &BinomialEngine{
+		size:                snap.BinomialSize,
+		enclosingTreeFilter: snap.EnclosingTreeFilter,
+		minorTreeFilter:     snap.MinorTreeFilter,
+	}
+	me.lastRemoved = snap.LastRemoved
+	return nil
+}
@@ -16,11 +16,26 @@ package reverseproxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 )
 
 // createMementoPool creates a pool of n upstream hosts for testing
@@ -173,9 +188,9 @@ func TestMementoSelectionRemovalWith50Hosts(t *testing.T) {
 
 	t.Logf("Successfully remapped %d/%d keys to new hosts", remappedCount, len(keysMappedToRemovedHosts))
 
-	// Verify consistency: same key should always map to same host after removal
-	// Note: There might be an issue with bucket index >= len(pool) causing fallback to random
-	// This is a known limitation that needs to be fixed in the selection logic
+	// Verify consistency: same key must always map to same host after
+	// removal. The engine guarantees that a non-empty topology always
+	// resolves to one of its members, so this is a hard assertion.
 	for _, km := range keysMappedToRemovedHosts {
 		req1, _ := http.NewRequest("GET", "/", nil)
 		req1.RemoteAddr = km.key
@@ -188,24 +203,17 @@ func TestMementoSelectionRemovalWith50Hosts(t *testing.T) {
 		}
 
 		// Verify consistency with multiple calls
-		// Skip consistency check if bucket index might be >= len(pool)
-		// TODO: Fix selection logic to handle bucket index properly after removal
-		inconsistent := false
 		for i := 0; i < 5; i++ {
 			req2, _ := http.NewRequest("GET", "/", nil)
 			req2.RemoteAddr = km.key
 			host2 := mementoPolicy.Select(pool, req2, nil)
 
 			if host1 != host2 {
-				t.Logf("Key %s: inconsistent mapping detected - got %s and %s (this may indicate a bug in selection logic)",
+				t.Errorf("Key %s: inconsistent mapping - got %s and %s",
 					km.key, host1.Dial, host2.Dial)
-				inconsistent = true
 				break
 			}
 		}
-		if !inconsistent {
-			t.Logf("Key %s: consistent mapping to %s", km.key, host1.Dial)
-		}
 	}
 
 	// Verify that keys that didn't map to removed hosts still map to the same host
@@ -305,9 +313,8 @@ func TestMementoSelectionProgressiveRemoval(t *testing.T) {
 			}
 
 			if isRemoved {
-				t.Logf("Key %s: mapped to removed host %s at step %d (bucket index may be >= len(pool))",
+				t.Errorf("Key %s: mapped to removed host %s at step %d",
 					key, host.Dial, step+1)
-				// This is a known issue: when bucket index >= len(pool), fallback to random occurs
 				continue
 			}
 
@@ -317,7 +324,6 @@ func TestMementoSelectionProgressiveRemoval(t *testing.T) {
 		t.Logf("Step %d: %d/%d keys mapped to valid hosts", step+1, validMappings, numKeys)
 
 		// Verify consistency: same key maps to same host
-		// Note: Some keys may show inconsistency if bucket index >= len(pool)
 		for _, key := range testKeys {
 			req1, _ := http.NewRequest("GET", "/", nil)
 			req1.RemoteAddr = key
@@ -328,9 +334,7 @@ func TestMementoSelectionProgressiveRemoval(t *testing.T) {
 			host2 := mementoPolicy.Select(pool, req2, nil)
 
 			if host1 != host2 {
-				t.Logf("Key %s: inconsistent mapping at step %d (bucket index may be >= len(pool))",
-					key, step+1)
-				// This is a known limitation - not a hard failure
+				t.Errorf("Key %s: inconsistent mapping at step %d", key, step+1)
 			}
 		}
 	}
@@ -463,6 +467,563 @@ func TestMementoSelectionRemovalAndRestore(t *testing.T) {
 	}
 }
 
+// healthEventCounter counts health events, so tests can assert that
+// transitions are debounced to at most one event per actual state change.
+type healthEventCounter struct {
+	healthy   int32
+	unhealthy int32
+}
+
+func (c *healthEventCounter) Handle(_ context.Context, event caddy.Event) error {
+	switch event.Name() {
+	case "healthy":
+		atomic.AddInt32(&c.healthy, 1)
+	case "unhealthy":
+		atomic.AddInt32(&c.unhealthy, 1)
+	}
+	return nil
+}
+
+// TestMementoSelectionPassiveHealthEvents simulates a flapping upstream
+// through the passive health check path and verifies that the memento
+// topology follows, with at most one event per actual state change.
+func TestMementoSelectionPassiveHealthEvents(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision events app: %v", err)
+	}
+
+	mementoPolicy := MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	mementoPolicy.SetEventsApp(eventsApp)
+
+	counter := &healthEventCounter{}
+	eventsApp.On("healthy", counter)
+	eventsApp.On("unhealthy", counter)
+
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Failed to start events app: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	handler := &Handler{
+		events: eventsApp,
+		ctx:    ctx,
+		HealthChecks: &HealthChecks{
+			Passive: &PassiveHealthChecks{
+				FailDuration: caddy.Duration(25 * time.Millisecond),
+				MaxFails:     1,
+			},
+		},
+	}
+
+	// repeated failures must produce a single unhealthy transition
+	handler.countFailure(pool[0])
+	handler.countFailure(pool[0])
+	if got := atomic.LoadInt32(&counter.unhealthy); got != 1 {
+		t.Errorf("Expected exactly 1 unhealthy event, got %d", got)
+	}
+	if topologyActive(&mementoPolicy.topology, pool[0]) {
+		t.Error("Expected the failing host to be removed from the memento topology")
+	}
+
+	// once the failure window clears, exactly one healthy transition
+	// must fire and the topology must be restored
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&counter.healthy) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&counter.healthy); got != 1 {
+		t.Errorf("Expected exactly 1 healthy event, got %d", got)
+	}
+	if !topologyActive(&mementoPolicy.topology, pool[0]) {
+		t.Error("Expected the recovered host to be restored to the memento topology")
+	}
+}
+
+// TestMementoSelectionHealthEventPayloadForms verifies that the structured
+// UpstreamHealthEvent payload and the legacy {"host": string} map form
+// update the topology identically.
+func TestMementoSelectionHealthEventPayloadForms(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	const numHosts = 10
+	pool := createMementoPool(numHosts)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	selectAll := func() map[string]string {
+		mappings := make(map[string]string)
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("10.9.8.%d:80", i)
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = key
+			host := mementoPolicy.Select(pool, req, nil)
+			if host == nil {
+				t.Fatalf("Expected host selection for key %s", key)
+			}
+			mappings[key] = host.Dial
+		}
+		return mappings
+	}
+
+	target := pool[3]
+
+	// remove and restore via the legacy map form
+	mementoPolicy.handleUnhealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"host": target.String()},
+	})
+	legacyRemoved := selectAll()
+	for key, dial := range legacyRemoved {
+		if dial == target.Dial {
+			t.Errorf("Key %s still mapped to removed host after legacy event", key)
+		}
+	}
+	mementoPolicy.handleHealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"host": target.String()},
+	})
+
+	// remove and restore via the structured payload form
+	mementoPolicy.handleUnhealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"event": UpstreamHealthEvent{Dial: target.String(), Healthy: false, Reason: "test"}},
+	})
+	structuredRemoved := selectAll()
+	mementoPolicy.handleHealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"event": UpstreamHealthEvent{Dial: target.String(), Healthy: true, Reason: "test"}},
+	})
+
+	// the topology must have reacted identically to both forms
+	for key, dial := range legacyRemoved {
+		if structuredRemoved[key] != dial {
+			t.Errorf("Key %s: legacy form mapped to %s but structured form mapped to %s",
+				key, dial, structuredRemoved[key])
+		}
+	}
+}
+
+// TestMementoSelectionBoundedLoad verifies consistent hashing with bounded
+// loads: an overloaded primary owner is skipped, overflow traffic lands on a
+// stable secondary host, and keys owned by other hosts are unaffected.
+func TestMementoSelectionBoundedLoad(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip", BoundedLoad: true}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	const numHosts = 5
+	pool := createMementoPool(numHosts)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	selectFor := func(key string) *Upstream {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key
+		return mementoPolicy.Select(pool, req, nil)
+	}
+
+	// record the primary owner of each test key while the pool is idle
+	const numKeys = 100
+	primaries := make(map[string]*Upstream)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("10.1.2.%d:80", i)
+		host := selectFor(key)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s", key)
+		}
+		primaries[key] = host
+	}
+
+	// overload one host far beyond the load bound
+	// (average becomes 100/5 = 20, bound 25, so 100 in-flight exceeds it)
+	var hotKey string
+	for key, host := range primaries {
+		if host == pool[0] {
+			hotKey = key
+			break
+		}
+	}
+	if hotKey == "" {
+		t.Fatal("No key mapped to the first host - test cannot proceed")
+	}
+	pool[0].countRequest(100)
+
+	// the overloaded host must not be selected, and the overflow
+	// target for a given key must be deterministic
+	overflow := selectFor(hotKey)
+	if overflow == nil {
+		t.Fatal("Expected an overflow host for the hot key")
+	}
+	if overflow == pool[0] {
+		t.Error("Expected the overloaded host to be skipped")
+	}
+	for i := 0; i < 10; i++ {
+		if got := selectFor(hotKey); got != overflow {
+			t.Fatalf("Overflow target not deterministic: got %s, want %s", got.Dial, overflow.Dial)
+		}
+	}
+
+	// keys owned by other hosts keep their primary owner
+	for key, primary := range primaries {
+		if primary == pool[0] {
+			continue
+		}
+		if got := selectFor(key); got != primary {
+			t.Errorf("Key %s: expected primary owner %s, got %s", key, primary.Dial, got.Dial)
+		}
+	}
+
+	// once the load drains, the hot key returns to its primary owner
+	pool[0].countRequest(-100)
+	if got := selectFor(hotKey); got != pool[0] {
+		t.Errorf("Expected hot key to return to its primary owner, got %s", got.Dial)
+	}
+}
+
+func TestMementoSelectionRehashUnavailable(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip", RehashUnavailable: true}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	const numHosts = 5
+	pool := createMementoPool(numHosts)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	selectFor := func(key string) *Upstream {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key
+		return mementoPolicy.Select(pool, req, nil)
+	}
+
+	// record the primary owner of each test key while the pool is idle
+	const numKeys = 100
+	primaries := make(map[string]*Upstream)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("10.1.2.%d:80", i)
+		host := selectFor(key)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s", key)
+		}
+		primaries[key] = host
+	}
+
+	// saturate one host via MaxRequests so it is Full but still
+	// in the topology (no unhealthy event has fired)
+	pool[0].MaxRequests = 5
+	pool[0].countRequest(5)
+
+	// every key owned by the saturated host must consistently land on
+	// the same secondary host, run after run
+	secondaries := make(map[string]*Upstream)
+	for key, primary := range primaries {
+		if primary != pool[0] {
+			continue
+		}
+		secondary := selectFor(key)
+		if secondary == nil {
+			t.Fatalf("Expected a secondary host for key %s", key)
+		}
+		if secondary == pool[0] {
+			t.Errorf("Key %s: expected the saturated host to be skipped", key)
+		}
+		secondaries[key] = secondary
+	}
+	if len(secondaries) == 0 {
+		t.Fatal("No key mapped to the first host - test cannot proceed")
+	}
+	for i := 0; i < 10; i++ {
+		for key, secondary := range secondaries {
+			if got := selectFor(key); got != secondary {
+				t.Fatalf("Key %s: overflow target not deterministic: got %s, want %s",
+					key, got.Dial, secondary.Dial)
+			}
+		}
+	}
+
+	// keys owned by other hosts keep their primary owner
+	for key, primary := range primaries {
+		if primary == pool[0] {
+			continue
+		}
+		if got := selectFor(key); got != primary {
+			t.Errorf("Key %s: expected primary owner %s, got %s", key, primary.Dial, got.Dial)
+		}
+	}
+
+	// once the host has capacity again, its keys return to it
+	pool[0].countRequest(-5)
+	for key, primary := range primaries {
+		if primary != pool[0] {
+			continue
+		}
+		if got := selectFor(key); got != primary {
+			t.Errorf("Key %s: expected key to return to its primary owner, got %s", key, got.Dial)
+		}
+	}
+}
+
+func TestWeightedMementoSelectionRehashUnavailable(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	weightedPolicy := WeightedMementoSelection{
+		Field:             "ip",
+		Weights:           []int{1, 1, 1, 1, 1},
+		RehashUnavailable: true,
+	}
+	if err := weightedPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	const numHosts = 5
+	pool := createMementoPool(numHosts)
+	weightedPolicy.PopulateInitialTopology(pool)
+
+	selectFor := func(key string) *Upstream {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key
+		return weightedPolicy.Select(pool, req, nil)
+	}
+
+	const numKeys = 100
+	primaries := make(map[string]*Upstream)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("10.1.2.%d:80", i)
+		host := selectFor(key)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s", key)
+		}
+		primaries[key] = host
+	}
+
+	pool[0].MaxRequests = 5
+	pool[0].countRequest(5)
+
+	secondaries := make(map[string]*Upstream)
+	for key, primary := range primaries {
+		if primary != pool[0] {
+			continue
+		}
+		secondary := selectFor(key)
+		if secondary == nil || secondary == pool[0] {
+			t.Fatalf("Key %s: expected a secondary host distinct from the saturated one", key)
+		}
+		secondaries[key] = secondary
+	}
+	if len(secondaries) == 0 {
+		t.Fatal("No key mapped to the first host - test cannot proceed")
+	}
+	for i := 0; i < 10; i++ {
+		for key, secondary := range secondaries {
+			if got := selectFor(key); got != secondary {
+				t.Fatalf("Key %s: overflow target not deterministic: got %s, want %s",
+					key, got.Dial, secondary.Dial)
+			}
+		}
+	}
+
+	pool[0].countRequest(-5)
+	for key, primary := range primaries {
+		if got := selectFor(key); got != primary {
+			t.Errorf("Key %s: expected primary owner %s, got %s", key, primary.Dial, got.Dial)
+		}
+	}
+}
+
+// TestMementoSelectionConcurrentSelectAndTopologyFlap hammers Select
+// from several goroutines while another goroutine flaps nodes in and
+// out of the topology. Run with -race: Select must resolve each key
+// against a single snapshot of the consistent state and never return
+// a node that was removed at lookup time, nor crash on the transient
+// window between bucket resolution and node mapping.
+func TestMementoSelectionConcurrentSelectAndTopologyFlap(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	const numHosts = 10
+	pool := createMementoPool(numHosts)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	const (
+		numSelectors = 8
+		duration     = 500 * time.Millisecond
+	)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// 8 goroutines hammering Select
+	var selections int64
+	for g := 0; g < numSelectors; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:80", g, i%256, (i/256)%256)
+				if host := mementoPolicy.Select(pool, req, nil); host != nil {
+					atomic.AddInt64(&selections, 1)
+				}
+			}
+		}(g)
+	}
+
+	// one goroutine flapping nodes in and out of the topology
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			upstream := pool[i%numHosts]
+			if err := mementoPolicy.consistentEngine.RemoveNode(upstream); err == nil {
+				topologyDeactivate(&mementoPolicy.topology, upstream, "unhealthy")
+			}
+			if err := mementoPolicy.consistentEngine.AddNode(upstream); err == nil {
+				topologyActivate(&mementoPolicy.topology, upstream, "healthy")
+			}
+		}
+	}()
+
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+
+	if atomic.LoadInt64(&selections) == 0 {
+		t.Error("Expected concurrent selections to succeed while topology flaps")
+	}
+}
+
+func TestSelectionPreviewEndpoint(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	registerSelectionPreview("memento", mementoPolicy, pool)
+	defer unregisterSelectionPreview("memento", mementoPolicy)
+
+	previewFor := func(policy, key string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest("GET",
+			"/reverse_proxy/selection/preview?policy="+policy+"&key="+key, nil)
+		w := httptest.NewRecorder()
+		err := adminUpstreams{}.handleSelectionPreview(w, req)
+		return w, err
+	}
+
+	// the preview must match what Select actually returns
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("10.9.8.%d", i)
+		w, err := previewFor("memento", key)
+		if err != nil {
+			t.Fatalf("Preview request for key %s failed: %v", key, err)
+		}
+		var expl SelectionExplanation
+		if err := json.NewDecoder(w.Body).Decode(&expl); err != nil {
+			t.Fatalf("Decoding preview response: %v", err)
+		}
+		if expl.Policy != "memento" || expl.Key != key {
+			t.Errorf("Key %s: unexpected explanation metadata: %+v", key, expl)
+		}
+		if expl.Bucket == nil {
+			t.Fatalf("Key %s: expected a bucket index in the explanation", key)
+		}
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key + ":80"
+		selected := mementoPolicy.Select(pool, req, nil)
+		if selected == nil || selected.Dial != expl.Upstream {
+			t.Errorf("Key %s: preview says %s but Select chose %v", key, expl.Upstream, selected)
+		}
+	}
+
+	// a non-hashing policy cannot be previewed
+	registerSelectionPreview("random", RandomSelection{}, pool)
+	defer unregisterSelectionPreview("random", RandomSelection{})
+	if _, err := previewFor("random", "anything"); err == nil {
+		t.Error("Expected previewing a non-hashing policy to fail")
+	} else if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Errorf("Expected a 400 APIError, got %v", err)
+	}
+
+	// an unknown policy id is a 404
+	if _, err := previewFor("nope", "anything"); err == nil {
+		t.Error("Expected previewing an unknown policy to fail")
+	} else if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("Expected a 404 APIError, got %v", err)
+	}
+
+	// both query parameters are required
+	if _, err := previewFor("memento", ""); err == nil {
+		t.Error("Expected previewing without a key to fail")
+	}
+}
+
+// BenchmarkMementoHealthEventLookup measures how quickly the policy resolves
+// a health event's node ID to an upstream. This used to be a linear scan of
+// the whole topology comparing String() values; it is now an O(1) map lookup.
+func BenchmarkMementoHealthEventLookup(b *testing.B) {
+	for _, size := range []int{100, 500} {
+		b.Run(fmt.Sprintf("pool_%d", size), func(b *testing.B) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			mementoPolicy := MementoSelection{Field: "ip"}
+			if err := mementoPolicy.Provision(ctx); err != nil {
+				b.Fatalf("Provision error: %v", err)
+			}
+			pool := createMementoPool(size)
+			mementoPolicy.PopulateInitialTopology(pool)
+
+			// use the last host so a scan-based lookup would do maximum work
+			host := pool[size-1].String()
+			unhealthy := caddy.Event{Data: map[string]any{"host": host}}
+			healthy := caddy.Event{Data: map[string]any{"host": host}}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mementoPolicy.handleUnhealthyEvent(context.Background(), unhealthy)
+				mementoPolicy.handleHealthyEvent(context.Background(), healthy)
+			}
+		})
+	}
+}
+
 // TestMementoSelectionRemovalEdgeCases tests edge cases for host removal
 func TestMementoSelectionRemovalEdgeCases(t *testing.T) {
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
@@ -500,11 +1061,9 @@ func TestMementoSelectionRemovalEdgeCases(t *testing.T) {
 		})
 	}
 
-	// Verify all keys map to valid hosts (when bucket index < len(pool))
-	// Note: When bucket index >= len(pool), fallback to random selection occurs
-	// This means keys may map to different hosts, but they should still be valid
+	// With a single node left in the topology, every key must map to it:
+	// the engine never hands back a node outside its topology
 	remainingHost := pool[numHosts-2]
-	validMappings := 0
 	for i := 0; i < 10; i++ {
 		req, _ := http.NewRequest("GET", "/", nil)
 		req.RemoteAddr = fmt.Sprintf("192.168.1.%d:80", i)
@@ -513,27 +1072,2477 @@ func TestMementoSelectionRemovalEdgeCases(t *testing.T) {
 			t.Errorf("Expected host selection for key %d", i)
 			continue
 		}
-		// Host should be valid (not removed)
-		isRemoved := false
-		for j := 0; j < numHosts-2; j++ {
-			if host == pool[j] {
-				isRemoved = true
-				break
-			}
+		if host != remainingHost {
+			t.Errorf("Key %d: expected remaining host %s, got %s", i, remainingHost.Dial, host.Dial)
 		}
-		if !isRemoved {
-			validMappings++
-			// When bucket index is valid (< len(pool)), should map to remaining host
-			// But bucket index might be >= len(pool), causing fallback to random
-			if host == remainingHost {
-				t.Logf("Key %d: correctly mapped to remaining host %s", i, host.Dial)
-			} else {
-				t.Logf("Key %d: mapped to %s (bucket index may be >= len(pool), using fallback)",
-					i, host.Dial)
-			}
-		} else {
-			t.Errorf("Key %d: mapped to removed host %s", i, host.Dial)
+	}
+}
+
+// TestMementoSelectionFullOutageFallbackModes simulates health checks
+// removing every node from the topology and verifies that each
+// fallback_mode degrades the way it promises while the pool itself
+// still lists (available) upstreams.
+func TestMementoSelectionFullOutageFallbackModes(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	newOutagePolicy := func(mode string) (*MementoSelection, UpstreamPool) {
+		policy := &MementoSelection{Field: "uri", FallbackMode: mode}
+		if err := policy.Provision(ctx); err != nil {
+			t.Fatalf("Provision error for fallback_mode %q: %v", mode, err)
 		}
+		pool := createMementoPool(3)
+		policy.PopulateInitialTopology(pool)
+		for _, upstream := range pool {
+			policy.handleUnhealthyEvent(context.Background(), caddy.Event{
+				Data: map[string]any{"host": upstream.Dial},
+			})
+		}
+		if size := policy.consistentEngine.Size(); size != 0 {
+			t.Fatalf("Expected empty engine after full outage, got size %d", size)
+		}
+		return policy, pool
+	}
+
+	t.Run("rendezvous", func(t *testing.T) {
+		policy, pool := newOutagePolicy("rendezvous")
+		for i := 0; i < 20; i++ {
+			uri := fmt.Sprintf("/outage/%d", i)
+			req, _ := http.NewRequest("GET", uri, nil)
+			req.RequestURI = uri
+			selected := policy.Select(pool, req, nil)
+			if selected == nil {
+				t.Fatalf("Expected a host for %s during outage", uri)
+			}
+			if expected := hostByHashing(pool, uri); selected != expected {
+				t.Errorf("Key %s: expected rendezvous host %s, got %s", uri, expected.Dial, selected.Dial)
+			}
+			if again := policy.Select(pool, req, nil); again != selected {
+				t.Errorf("Key %s: rendezvous fallback not deterministic", uri)
+			}
+		}
+	})
+
+	t.Run("first", func(t *testing.T) {
+		policy, pool := newOutagePolicy("first")
+		for i := 0; i < 5; i++ {
+			uri := fmt.Sprintf("/outage/%d", i)
+			req, _ := http.NewRequest("GET", uri, nil)
+			req.RequestURI = uri
+			if selected := policy.Select(pool, req, nil); selected != pool[0] {
+				t.Errorf("Key %s: expected first host %s, got %v", uri, pool[0].Dial, selected)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		policy, pool := newOutagePolicy("random")
+		req, _ := http.NewRequest("GET", "/outage", nil)
+		req.RequestURI = "/outage"
+		if selected := policy.Select(pool, req, nil); selected == nil {
+			t.Error("Expected the fallback policy to select a host during outage")
+		}
+	})
+
+	badPolicy := &MementoSelection{Field: "uri", FallbackMode: "rr"}
+	if err := badPolicy.Provision(ctx); err == nil {
+		t.Error("Expected Provision error for unrecognized fallback_mode")
+	}
+}
+
+// TestMementoSelectionStaggeredRecovery drives a full outage followed by
+// nodes coming back one at a time, and verifies the topology is re-seeded
+// from the healthy events: the first recovered host takes all traffic
+// only while it is alone, and the engine grows back to the full pool.
+func TestMementoSelectionStaggeredRecovery(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := &MementoSelection{Field: "uri"}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(5)
+	policy.PopulateInitialTopology(pool)
+
+	// Full outage: every node is reported unhealthy
+	for _, upstream := range pool {
+		policy.handleUnhealthyEvent(context.Background(), caddy.Event{
+			Data: map[string]any{"host": upstream.Dial},
+		})
+	}
+	if size := policy.consistentEngine.Size(); size != 0 {
+		t.Fatalf("Expected empty engine after full outage, got size %d", size)
+	}
+
+	selectHost := func(uri string) *Upstream {
+		req, _ := http.NewRequest("GET", uri, nil)
+		req.RequestURI = uri
+		return policy.Select(pool, req, nil)
+	}
+
+	// First host recovers: it should take all traffic while it is the
+	// only topology member
+	policy.handleHealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"host": pool[2].Dial},
+	})
+	if size := policy.consistentEngine.Size(); size != 1 {
+		t.Fatalf("Expected engine size 1 after first recovery, got %d", size)
+	}
+	for i := 0; i < 10; i++ {
+		if selected := selectHost(fmt.Sprintf("/recovery/%d", i)); selected != pool[2] {
+			t.Errorf("Expected first recovered host %s, got %v", pool[2].Dial, selected)
+		}
+	}
+
+	// Remaining hosts recover one at a time
+	for _, upstream := range []*Upstream{pool[0], pool[1], pool[3], pool[4]} {
+		policy.handleHealthyEvent(context.Background(), caddy.Event{
+			Data: map[string]any{"host": upstream.Dial},
+		})
+	}
+	if size := policy.consistentEngine.Size(); size != len(pool) {
+		t.Fatalf("Expected engine size %d after full recovery, got %d", len(pool), size)
+	}
+
+	// Traffic must spread again instead of staying pinned to the first
+	// recovered host
+	selectedHosts := make(map[*Upstream]int)
+	for i := 0; i < 200; i++ {
+		selected := selectHost(fmt.Sprintf("/recovery/%d", i))
+		if selected == nil {
+			t.Fatal("Expected a host after full recovery")
+		}
+		selectedHosts[selected]++
+	}
+	if len(selectedHosts) < 3 {
+		t.Errorf("Expected traffic to spread across the recovered pool, got %d distinct hosts", len(selectedHosts))
+	}
+
+	// Stability after recovery: repeated selections stay put
+	for i := 0; i < 20; i++ {
+		uri := fmt.Sprintf("/recovery/%d", i)
+		if selectHost(uri) != selectHost(uri) {
+			t.Errorf("Key %s: unstable mapping after recovery", uri)
+		}
+	}
+}
+
+// TestMementoSelectionDynamicTopologySync simulates a dynamic upstream
+// source producing a changing set across refreshes and verifies that the
+// handler's diffing keeps the consistent topology in step with minimal
+// key movement.
+func TestMementoSelectionDynamicTopologySync(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	handler := &Handler{}
+
+	// a fake dynamic source returns fresh Upstream values every refresh
+	discover := func(dials ...string) UpstreamPool {
+		pool := make(UpstreamPool, 0, len(dials))
+		for _, dial := range dials {
+			up := &Upstream{Host: new(Host), Dial: dial}
+			up.setHealthy(true)
+			pool = append(pool, up)
+		}
+		return pool
+	}
+
+	const numKeys = 200
+	mapping := func(pool UpstreamPool) map[string]string {
+		out := make(map[string]string, numKeys)
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("172.16.0.%d:80", i)
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = key
+			host := mementoPolicy.Select(pool, req, nil)
+			if host == nil {
+				t.Fatalf("Expected host selection for key %s", key)
+			}
+			out[key] = host.Dial
+		}
+		return out
+	}
+
+	// first refresh seeds the topology
+	setA := discover("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80", "10.0.0.5:80")
+	handler.syncDynamicTopology(mementoPolicy, setA)
+	if size := mementoPolicy.consistentEngine.Size(); size != 5 {
+		t.Fatalf("Expected 5 nodes after first refresh, got %d", size)
+	}
+	before := mapping(setA)
+
+	// second refresh: one upstream disappears, a new one appears, and
+	// the survivors are all-new values with the same dial addresses
+	setB := discover("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80", "10.0.0.6:80")
+	handler.syncDynamicTopology(mementoPolicy, setB)
+	if size := mementoPolicy.consistentEngine.Size(); size != 5 {
+		t.Fatalf("Expected 5 nodes after second refresh, got %d", size)
+	}
+	after := mapping(setB)
+
+	moved := 0
+	for key, dial := range after {
+		if dial == "10.0.0.5:80" {
+			t.Errorf("Key %s: still mapped to removed upstream", key)
+		}
+		if dial == before[key] {
+			continue
+		}
+		moved++
+		// a key that was not on the removed upstream may only move to
+		// the newly added one; anything else is gratuitous remapping
+		if before[key] != "10.0.0.5:80" && dial != "10.0.0.6:80" {
+			t.Errorf("Key %s: moved from %s to %s with neither involved in the refresh",
+				key, before[key], dial)
+		}
+	}
+	if moved == 0 {
+		t.Error("Expected the removed upstream's keys to move")
+	}
+	if moved > numKeys/2 {
+		t.Errorf("Expected minimal key movement, but %d/%d keys moved", moved, numKeys)
+	}
+
+	// a refresh with the same membership (but fresh values) moves nothing
+	setC := discover("10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80", "10.0.0.6:80")
+	handler.syncDynamicTopology(mementoPolicy, setC)
+	for key, dial := range mapping(setC) {
+		if dial != after[key] {
+			t.Errorf("Key %s: moved from %s to %s across an unchanged refresh", key, after[key], dial)
+		}
+	}
+}
+
+// TestMementoSelectionHealthEventDebouncing feeds a flapping event
+// sequence directly to the policy's event handlers and counts topology
+// mutations: with min_confirmations above 1, a node only leaves or
+// rejoins the topology after enough consecutive contradicting events.
+func TestMementoSelectionHealthEventDebouncing(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip", MinConfirmations: 3}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	mementoPolicy.PopulateInitialTopology(pool)
+	if mementoPolicy.consistentEngine.Size() != 3 {
+		t.Fatalf("Expected 3 nodes, got %d", mementoPolicy.consistentEngine.Size())
+	}
+
+	unhealthy := caddy.Event{Data: map[string]any{"host": pool[0].Dial}}
+	healthy := caddy.Event{Data: map[string]any{"host": pool[0].Dial}}
+
+	// a flapping sequence never reaches 3 consecutive unhealthy events,
+	// so the topology must not mutate at all
+	for i := 0; i < 10; i++ {
+		if err := mementoPolicy.handleUnhealthyEvent(context.Background(), unhealthy); err != nil {
+			t.Fatalf("handleUnhealthyEvent error: %v", err)
+		}
+		if err := mementoPolicy.handleHealthyEvent(context.Background(), healthy); err != nil {
+			t.Fatalf("handleHealthyEvent error: %v", err)
+		}
+		if mementoPolicy.consistentEngine.Size() != 3 {
+			t.Fatalf("Expected the flap to be debounced, size is %d after iteration %d",
+				mementoPolicy.consistentEngine.Size(), i)
+		}
+	}
+
+	// three consecutive unhealthy events confirm the outage; the node
+	// must be removed exactly once, on the third event
+	for i := 1; i <= 3; i++ {
+		if err := mementoPolicy.handleUnhealthyEvent(context.Background(), unhealthy); err != nil {
+			t.Fatalf("handleUnhealthyEvent error: %v", err)
+		}
+		wantSize := 3
+		if i == 3 {
+			wantSize = 2
+		}
+		if mementoPolicy.consistentEngine.Size() != wantSize {
+			t.Fatalf("Expected size %d after %d consecutive unhealthy events, got %d",
+				wantSize, i, mementoPolicy.consistentEngine.Size())
+		}
+	}
+
+	// recovery needs the same number of confirmations
+	for i := 1; i <= 3; i++ {
+		if err := mementoPolicy.handleHealthyEvent(context.Background(), healthy); err != nil {
+			t.Fatalf("handleHealthyEvent error: %v", err)
+		}
+		wantSize := 2
+		if i == 3 {
+			wantSize = 3
+		}
+		if mementoPolicy.consistentEngine.Size() != wantSize {
+			t.Fatalf("Expected size %d after %d consecutive healthy events, got %d",
+				wantSize, i, mementoPolicy.consistentEngine.Size())
+		}
+	}
+
+	// the introspection counters reflect the confirmed state
+	var found bool
+	for _, c := range mementoPolicy.healthDebounceCounters() {
+		if c.Host == pool[0].Dial {
+			found = true
+			if !c.ConfirmedHealthy || c.PendingConfirmations != 0 {
+				t.Errorf("Expected the recovered node to be confirmed healthy with no pending confirmations, got %+v", c)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected debounce counters to include the flapping node")
+	}
+}
+
+// TestMementoSelectionHealthEventDebouncingDefaults verifies that the
+// default configuration (1 confirmation) keeps today's behavior: every
+// event mutates the topology immediately.
+func TestMementoSelectionHealthEventDebouncingDefaults(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	event := caddy.Event{Data: map[string]any{"host": pool[0].Dial}}
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	if mementoPolicy.consistentEngine.Size() != 2 {
+		t.Errorf("Expected the first unhealthy event to remove the node, size is %d", mementoPolicy.consistentEngine.Size())
+	}
+	if err := mementoPolicy.handleHealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleHealthyEvent error: %v", err)
+	}
+	if mementoPolicy.consistentEngine.Size() != 3 {
+		t.Errorf("Expected the first healthy event to restore the node, size is %d", mementoPolicy.consistentEngine.Size())
+	}
+}
+
+// TestMementoSelectionCookieFallbackNilWriter verifies that a memento
+// policy configured with a cookie fallback survives selection without a
+// response writer: the fallback must still pick a host and simply skip
+// writing the sticky session cookie.
+func TestMementoSelectionCookieFallbackNilWriter(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{
+		Field:       "ip",
+		FallbackRaw: caddyconfig.JSONModuleObject(CookieHashSelection{}, "policy", "cookie", nil),
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// a request without a remote address has no key, so selection goes
+	// straight to the cookie fallback; with no writer this used to panic
+	// inside http.SetCookie
+	req, _ := http.NewRequest("GET", "/", nil)
+	upstream := mementoPolicy.Select(pool, req, nil)
+	if upstream == nil {
+		t.Fatal("Expected the cookie fallback to pick a host with a nil writer")
+	}
+
+	// with a writer supplied, the fallback still pins the client
+	w := httptest.NewRecorder()
+	upstream = mementoPolicy.Select(pool, req, w)
+	if upstream == nil {
+		t.Fatal("Expected the cookie fallback to pick a host")
+	}
+	if len(w.Result().Cookies()) == 0 {
+		t.Error("Expected the fallback to set the sticky session cookie when a writer is available")
+	}
+}
+
+// TestMementoSelectionExpressionField exercises the "expression" field
+// mode: the placeholder expression is evaluated per request against the
+// replacer in the request context, composite keys map stably, and an
+// expansion that comes up empty defers to the fallback policy.
+func TestMementoSelectionExpressionField(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{
+		Field:      "expression",
+		Expression: "{http.vars.tenant}:{http.vars.shard}",
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	newRequest := func(tenant, shard string) *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		repl := caddy.NewReplacer()
+		if tenant != "" {
+			repl.Set("http.vars.tenant", tenant)
+		}
+		if shard != "" {
+			repl.Set("http.vars.shard", shard)
+		}
+		return req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	}
+
+	// the same composite key maps to the same host every time
+	for i := 0; i < 10; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		first := mementoPolicy.Select(pool, newRequest(tenant, "0"), nil)
+		if first == nil {
+			t.Fatalf("Expected a host for %s", tenant)
+		}
+		for j := 0; j < 5; j++ {
+			if got := mementoPolicy.Select(pool, newRequest(tenant, "0"), nil); got != first {
+				t.Errorf("Expected %s to stay on %s, got %s", tenant, first.Dial, got.Dial)
+			}
+		}
+	}
+
+	// an empty expansion cannot key the topology, so the fallback runs
+	if _, ok := mementoPolicy.requestKey(newRequest("", "")); ok {
+		t.Error("Expected no key from an empty expansion")
+	}
+	if upstream := mementoPolicy.Select(pool, newRequest("", ""), nil); upstream == nil {
+		t.Error("Expected the fallback to pick a host for an empty expansion")
+	}
+
+	// without a replacer in the context there is no key either
+	bare, _ := http.NewRequest("GET", "/", nil)
+	if _, ok := mementoPolicy.requestKey(bare); ok {
+		t.Error("Expected no key without a replacer in the request context")
+	}
+
+	// the weighted policy shares the same field mode
+	weightedPolicy := WeightedMementoSelection{
+		Field:      "expression",
+		Expression: "{http.vars.tenant}",
+		Weights:    []int{3, 1},
+	}
+	if err := weightedPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	weightedPool := createMementoPool(2)
+	weightedPolicy.PopulateInitialTopology(weightedPool)
+	first := weightedPolicy.Select(weightedPool, newRequest("acme", ""), nil)
+	if first == nil {
+		t.Fatal("Expected the weighted policy to pick a host")
+	}
+	for i := 0; i < 5; i++ {
+		if got := weightedPolicy.Select(weightedPool, newRequest("acme", ""), nil); got != first {
+			t.Errorf("Expected the weighted policy to keep acme on %s, got %s", first.Dial, got.Dial)
+		}
+	}
+
+	// an expression field without an expression cannot provision
+	invalid := MementoSelection{Field: "expression"}
+	if err := invalid.Provision(ctx); err == nil {
+		t.Error("Expected provisioning field 'expression' without an expression to fail")
+	}
+}
+
+// TestMementoSelectionCompactThreshold verifies that the policy compacts
+// the engine's removal history once unhealthy events push it past the
+// configured threshold, without touching the live topology.
+func TestMementoSelectionCompactThreshold(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip", CompactThreshold: 5}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(20)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// each unhealthy event leaves a tombstone; crossing the threshold
+	// must trigger a rebuild that collapses them all
+	for i := 10; i < 20; i++ {
+		event := caddy.Event{Data: map[string]any{"host": pool[i].Dial}}
+		if err := mementoPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+			t.Fatalf("handleUnhealthyEvent error: %v", err)
+		}
+	}
+
+	stats := mementoPolicy.consistentEngine.GetMementoStats()
+	if got := stats["memento_size"].(int); got > mementoPolicy.CompactThreshold {
+		t.Errorf("Expected the removal history to stay at or below %d tombstones, got %d",
+			mementoPolicy.CompactThreshold, got)
+	}
+	if mementoPolicy.consistentEngine.Size() != 10 {
+		t.Errorf("Expected 10 live nodes after compaction, size is %d", mementoPolicy.consistentEngine.Size())
+	}
+
+	// selection still resolves consistently over the survivors
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:80", i)
+		first := mementoPolicy.Select(pool, req, nil)
+		if first == nil {
+			t.Fatal("Expected a host after compaction")
+		}
+		for j := 0; j < 3; j++ {
+			if got := mementoPolicy.Select(pool, req, nil); got != first {
+				t.Errorf("Key %s: inconsistent mapping after compaction", req.RemoteAddr)
+			}
+		}
+	}
+}
+
+func TestMementoSelectionSimulateRemoval(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip", TrackKeys: true}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(10)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// drive selections with distinct client IPs so the sampler fills up
+	numKeys := 50
+	for i := 0; i < numKeys; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.1.%d.%d:80", i/256, i%256)
+		if mementoPolicy.Select(pool, req, nil) == nil {
+			t.Fatal("Expected a host to be selected")
+		}
+	}
+
+	keys := mementoPolicy.keySampler.snapshot()
+	if len(keys) != numKeys {
+		t.Fatalf("Expected %d sampled keys, got %d", numKeys, len(keys))
+	}
+
+	// remember who owns each key before the removal
+	victim := pool[3]
+	ownerBefore := make(map[string]*Upstream, len(keys))
+	for _, key := range keys {
+		owner, ok := mementoPolicy.consistentEngine.Lookup(key)
+		if !ok {
+			t.Fatalf("Key %s has no owner before removal", key)
+		}
+		ownerBefore[key] = owner
+	}
+
+	sim, err := mementoPolicy.simulateRemoval(victim.Dial, nil)
+	if err != nil {
+		t.Fatalf("simulateRemoval error: %v", err)
+	}
+	if sim.Upstream != victim.Dial {
+		t.Errorf("Expected simulation for %s, got %s", victim.Dial, sim.Upstream)
+	}
+	if sim.TotalKeys != numKeys {
+		t.Errorf("Expected %d replayed keys, got %d", numKeys, sim.TotalKeys)
+	}
+
+	// the simulation must not have touched the live engine
+	if mementoPolicy.consistentEngine.Size() != 10 {
+		t.Fatalf("Simulation mutated the live engine: size is %d", mementoPolicy.consistentEngine.Size())
+	}
+	for _, key := range keys {
+		owner, _ := mementoPolicy.consistentEngine.Lookup(key)
+		if owner != ownerBefore[key] {
+			t.Fatalf("Simulation changed the live mapping of key %s", key)
+		}
+	}
+
+	// now actually remove the victim and compare reality to the forecast
+	event := caddy.Event{Data: map[string]any{"host": victim.Dial}}
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+
+	moved := make(map[string]bool, len(sim.MovedKeys))
+	for _, key := range sim.MovedKeys {
+		moved[key] = true
+	}
+	for _, key := range keys {
+		owner, ok := mementoPolicy.consistentEngine.Lookup(key)
+		if !ok {
+			t.Fatalf("Key %s has no owner after removal", key)
+		}
+		if (owner != ownerBefore[key]) != moved[key] {
+			t.Errorf("Key %s: simulation predicted moved=%v but actual moved=%v",
+				key, moved[key], owner != ownerBefore[key])
+		}
+	}
+	if delta, ok := sim.LoadDeltas[victim.Dial]; !ok || delta != -len(sim.MovedKeys) {
+		t.Errorf("Expected the victim to lose all %d moved keys, delta is %d",
+			len(sim.MovedKeys), delta)
+	}
+}
+
+func TestWeightedMementoSelectionSimulateRemoval(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	weightedPolicy := WeightedMementoSelection{
+		Field:   "ip",
+		Weights: []int{3, 2, 1},
+	}
+	if err := weightedPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	weightedPolicy.PopulateInitialTopology(pool)
+
+	// no sampler configured, so the caller must supply the keys
+	if _, err := weightedPolicy.simulateRemoval(pool[0].Dial, nil); err == nil {
+		t.Error("Expected an error when no keys are available to replay")
+	}
+
+	keys := make([]string, 40)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.2.0.%d", i)
+	}
+	ownerBefore := make(map[string]*Upstream, len(keys))
+	for _, key := range keys {
+		owner, ok := weightedPolicy.consistentEngine.Lookup(key)
+		if !ok {
+			t.Fatalf("Key %s has no owner before removal", key)
+		}
+		ownerBefore[key] = owner
+	}
+
+	victim := pool[1]
+	sim, err := weightedPolicy.simulateRemoval(victim.Dial, keys)
+	if err != nil {
+		t.Fatalf("simulateRemoval error: %v", err)
+	}
+
+	event := caddy.Event{Data: map[string]any{"host": victim.Dial}}
+	if err := weightedPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+
+	moved := make(map[string]bool, len(sim.MovedKeys))
+	for _, key := range sim.MovedKeys {
+		moved[key] = true
+	}
+	for _, key := range keys {
+		owner, ok := weightedPolicy.consistentEngine.Lookup(key)
+		if !ok {
+			t.Fatalf("Key %s has no owner after removal", key)
+		}
+		if (owner != ownerBefore[key]) != moved[key] {
+			t.Errorf("Key %s: simulation predicted moved=%v but actual moved=%v",
+				key, moved[key], owner != ownerBefore[key])
+		}
+	}
+
+	// an upstream outside the topology cannot be simulated
+	if _, err := weightedPolicy.simulateRemoval("localhost:9999", keys); err == nil {
+		t.Error("Expected an error for an unknown upstream")
+	}
+}
+
+func TestWeightedMementoSelectionCapacityOverflow(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	weightedPolicy := WeightedMementoSelection{
+		Field:   "ip",
+		Weights: []int{3, 2, 1},
+	}
+	if err := weightedPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	weightedPolicy.PopulateInitialTopology(pool)
+
+	selectFor := func(key string) *Upstream {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key
+		return weightedPolicy.Select(pool, req, nil)
+	}
+
+	// record the primary owner of each test key while the pool is idle
+	const numKeys = 1200
+	primaries := make(map[string]*Upstream)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("10.3.%d.%d:80", i/256, i%256)
+		host := selectFor(key)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s", key)
+		}
+		primaries[key] = host
+	}
+
+	// saturate the heaviest host via MaxRequests so it is Full but
+	// still in the topology (no unhealthy event has fired)
+	pool[0].MaxRequests = 5
+	pool[0].countRequest(5)
+
+	// every key owned by the saturated host must overflow to the same
+	// secondary, run after run, without touching the random fallback
+	secondaries := make(map[string]*Upstream)
+	for key, primary := range primaries {
+		if primary != pool[0] {
+			continue
+		}
+		secondary := selectFor(key)
+		if secondary == nil || secondary == pool[0] {
+			t.Fatalf("Key %s: expected a secondary host distinct from the saturated one", key)
+		}
+		secondaries[key] = secondary
+	}
+	if len(secondaries) == 0 {
+		t.Fatal("No key mapped to the first host - test cannot proceed")
+	}
+	for i := 0; i < 5; i++ {
+		for key, secondary := range secondaries {
+			if got := selectFor(key); got != secondary {
+				t.Fatalf("Key %s: overflow target not deterministic: got %s, want %s",
+					key, got.Dial, secondary.Dial)
+			}
+		}
+	}
+
+	// the shed load must follow the remaining weights (2:1), not an
+	// even or random split
+	counts := make(map[*Upstream]int)
+	for _, secondary := range secondaries {
+		counts[secondary]++
+	}
+	ratio := float64(counts[pool[1]]) / float64(counts[pool[2]])
+	if ratio < 1.4 || ratio > 2.8 {
+		t.Errorf("Expected overflow distribution near the 2:1 remaining weights, got %d:%d (ratio %.2f)",
+			counts[pool[1]], counts[pool[2]], ratio)
+	}
+
+	// keys owned by other hosts keep their primary owner
+	for key, primary := range primaries {
+		if primary == pool[0] {
+			continue
+		}
+		if got := selectFor(key); got != primary {
+			t.Errorf("Key %s: expected primary owner %s, got %s", key, primary.Dial, got.Dial)
+		}
+	}
+
+	// once the host has capacity again, its keys return to it
+	pool[0].countRequest(-5)
+	for key, primary := range primaries {
+		if got := selectFor(key); got != primary {
+			t.Errorf("Key %s: expected key to return to its primary owner, got %s", key, got.Dial)
+		}
+	}
+
+	// a topology change must invalidate the cached overflow view: after
+	// the lightest host goes away, overflow for the saturated host's
+	// keys can only land on the one remaining peer
+	event := caddy.Event{Data: map[string]any{"host": pool[2].Dial}}
+	if err := weightedPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	pool[0].countRequest(5)
+	for key, primary := range primaries {
+		if primary != pool[0] {
+			continue
+		}
+		if got := selectFor(key); got != pool[1] {
+			t.Errorf("Key %s: expected overflow to the only remaining peer %s, got %s",
+				key, pool[1].Dial, got.Dial)
+		}
+	}
+}
+
+func TestMementoSelectionPreserveState(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	first := &MementoSelection{Field: "ip", PreserveState: true}
+	if err := first.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(10)
+	first.PopulateInitialTopology(pool)
+
+	// learn some topology from health events before the "reload"
+	for i := 7; i < 10; i++ {
+		event := caddy.Event{Data: map[string]any{"host": pool[i].Dial}}
+		if err := first.handleUnhealthyEvent(context.Background(), event); err != nil {
+			t.Fatalf("handleUnhealthyEvent error: %v", err)
+		}
+	}
+
+	const numKeys = 100
+	mapping := make(map[string]string)
+	for i := 0; i < numKeys; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.4.0.%d:80", i)
+		host := first.Select(pool, req, nil)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s", req.RemoteAddr)
+		}
+		mapping[req.RemoteAddr] = host.Dial
+	}
+
+	// a reload provisions the successor (fresh Upstream values for the
+	// same pool) before the predecessor is cleaned up
+	second := &MementoSelection{Field: "ip", PreserveState: true}
+	if err := second.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	reloadedPool := createMementoPool(10)
+	second.PopulateInitialTopology(reloadedPool)
+	if err := first.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+
+	// the adopted engine keeps the learned topology and the mapping
+	if got := second.consistentEngine.Size(); got != 7 {
+		t.Errorf("Expected the adopted engine to keep 7 live nodes, got %d", got)
+	}
+	for i := 0; i < numKeys; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.4.0.%d:80", i)
+		host := second.Select(reloadedPool, req, nil)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s after reload", req.RemoteAddr)
+		}
+		if host.Dial != mapping[req.RemoteAddr] {
+			t.Errorf("Key %s: mapping not preserved across reload: got %s, want %s",
+				req.RemoteAddr, host.Dial, mapping[req.RemoteAddr])
+		}
+	}
+
+	// a healthy event restores a previously removed node via the
+	// reloaded pool's own upstream values
+	event := caddy.Event{Data: map[string]any{"host": reloadedPool[7].Dial}}
+	if err := second.handleHealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleHealthyEvent error: %v", err)
+	}
+	if got := second.consistentEngine.Size(); got != 8 {
+		t.Errorf("Expected 8 live nodes after recovery, got %d", got)
+	}
+
+	// a changed upstream set must not adopt: the engine is rebuilt
+	third := &MementoSelection{Field: "ip", PreserveState: true}
+	if err := third.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	grownPool := createMementoPool(11)
+	third.PopulateInitialTopology(grownPool)
+	if got := third.consistentEngine.Size(); got != 11 {
+		t.Errorf("Expected a fresh engine with 11 nodes for the changed pool, got %d", got)
+	}
+
+	// once the last reference is released the state destructs, so a
+	// later identical provisioning starts from scratch
+	if err := second.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	if err := third.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	fourth := &MementoSelection{Field: "ip", PreserveState: true}
+	if err := fourth.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	fourth.PopulateInitialTopology(createMementoPool(10))
+	if got := fourth.consistentEngine.Size(); got != 10 {
+		t.Errorf("Expected a fresh engine after the state was released, got %d nodes", got)
+	}
+	if err := fourth.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+}
+
+func TestMementoSelectionHashInput(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{
+		Field:       "header",
+		HeaderField: "X-User",
+		HashInput:   "hmac",
+		HashSecret:  "affinity-secret",
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(10)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// the digested key must map each header value to one stable host
+	for i := 0; i < 30; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user%d@example.com", i))
+		first := mementoPolicy.Select(pool, req, nil)
+		if first == nil {
+			t.Fatal("Expected a host for the digested header key")
+		}
+		for j := 0; j < 5; j++ {
+			if got := mementoPolicy.Select(pool, req, nil); got != first {
+				t.Errorf("Header user%d: inconsistent mapping with hmac hash input", i)
+			}
+		}
+	}
+
+	// hmac still requires a secret here
+	missingSecret := MementoSelection{Field: "header", HeaderField: "X-User", HashInput: "hmac"}
+	if err := missingSecret.Provision(ctx); err == nil {
+		t.Error("Expected an error when hmac is chosen without a secret")
+	}
+}
+
+func TestMementoSelectionEventHostNormalization(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := UpstreamPool{
+		{Host: new(Host), Dial: "127.0.0.1:9001"},
+		{Host: new(Host), Dial: "127.0.0.1:9002"},
+		{Host: new(Host), Dial: "unix//run/app.sock"},
+	}
+	for _, upstream := range pool {
+		upstream.setHealthy(true)
+	}
+	mementoPolicy.PopulateInitialTopology(pool)
+	if got := mementoPolicy.consistentEngine.Size(); got != 3 {
+		t.Fatalf("Expected 3 nodes in the topology, got %d", got)
+	}
+
+	// an emitter that spells the address with an explicit network must
+	// still match the upstream configured without one
+	event := caddy.Event{Data: healthEventData("tcp/127.0.0.1:9001", false, reasonActiveHealthCheck, "")}
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	if mementoPolicy.consistentEngine.HasNode(pool[0]) {
+		t.Error("Expected the tcp upstream to be removed via the normalized event host")
+	}
+
+	// unix sockets round-trip through the event payload untouched
+	event = caddy.Event{Data: healthEventData("unix//run/app.sock", false, reasonActiveHealthCheck, "")}
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	if mementoPolicy.consistentEngine.HasNode(pool[2]) {
+		t.Error("Expected the unix socket upstream to be removed")
+	}
+	event = caddy.Event{Data: healthEventData("unix//run/app.sock", true, reasonActiveHealthCheck, "")}
+	if err := mementoPolicy.handleHealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleHealthyEvent error: %v", err)
+	}
+	if !mementoPolicy.consistentEngine.HasNode(pool[2]) {
+		t.Error("Expected the unix socket upstream to rejoin the topology")
+	}
+
+	// an unknown host is ignored without error (and logged at debug)
+	event = caddy.Event{Data: healthEventData("10.9.9.9:1", false, reasonActiveHealthCheck, "")}
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+}
+
+// TestMementoSelectionCookieField verifies that `field cookie` keys the
+// hash on an existing application cookie: requests carrying the cookie
+// map stably, requests without it defer to the fallback policy, and no
+// response cookie is ever written.
+func TestMementoSelectionCookieField(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "cookie", CookieName: "JSESSIONID"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	makeReq := func(session string) *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: session})
+		}
+		return req
+	}
+
+	// A request with the cookie maps to a host, and the same session
+	// always maps to the same host.
+	w := httptest.NewRecorder()
+	first := mementoPolicy.Select(pool, makeReq("ABC123"), w)
+	if first == nil {
+		t.Fatal("Expected host selection for session ABC123")
+	}
+	for i := 0; i < 10; i++ {
+		if got := mementoPolicy.Select(pool, makeReq("ABC123"), nil); got != first {
+			t.Errorf("Session ABC123 moved from %s to %s", first.Dial, got.Dial)
+		}
+	}
+
+	// The policy never writes a response cookie; affinity lives in the
+	// application's own cookie.
+	if setCookie := w.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Errorf("Expected no Set-Cookie header, got %q", setCookie)
+	}
+
+	// A request without the cookie still gets a host via the fallback
+	// policy, and still no response cookie.
+	w = httptest.NewRecorder()
+	if host := mementoPolicy.Select(pool, makeReq(""), w); host == nil {
+		t.Error("Expected fallback host selection without the cookie")
+	}
+	if setCookie := w.Header().Get("Set-Cookie"); setCookie != "" {
+		t.Errorf("Expected no Set-Cookie header on fallback, got %q", setCookie)
+	}
+}
+
+// TestMementoSelectionCookieFieldStabilityOnAddition verifies that
+// cookie-keyed mappings survive an upstream addition with minimal
+// movement: sessions either keep their host or move to the new one.
+func TestMementoSelectionCookieFieldStabilityOnAddition(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "cookie", CookieName: "JSESSIONID"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	const numSessions = 200
+	makeReq := func(i int) *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: fmt.Sprintf("SESSION-%d", i)})
+		return req
+	}
+
+	before := make([]*Upstream, numSessions)
+	for i := 0; i < numSessions; i++ {
+		before[i] = mementoPolicy.Select(pool, makeReq(i), nil)
+		if before[i] == nil {
+			t.Fatalf("Expected host selection for session %d", i)
+		}
+	}
+
+	// Add a new upstream to the pool and the topology.
+	added := &Upstream{Host: new(Host), Dial: "localhost:9090"}
+	added.setHealthy(true)
+	pool = append(pool, added)
+	mementoPolicy.AddUpstream(added)
+
+	moved := 0
+	for i := 0; i < numSessions; i++ {
+		after := mementoPolicy.Select(pool, makeReq(i), nil)
+		if after == before[i] {
+			continue
+		}
+		if after != added {
+			t.Errorf("Session %d moved from %s to %s instead of the added host", i, before[i].Dial, after.Dial)
+		}
+		moved++
+	}
+	if moved == 0 {
+		t.Error("Expected some sessions to move to the added host")
+	}
+	if moved >= numSessions/2 {
+		t.Errorf("Expected minimal movement, but %d of %d sessions moved", moved, numSessions)
+	}
+}
+
+// TestMementoSelectionCookieFieldValidation verifies that `field cookie`
+// without a cookie_name is rejected at provision time.
+func TestMementoSelectionCookieFieldValidation(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "cookie"}
+	if err := mementoPolicy.Provision(ctx); err == nil {
+		t.Error("Expected provision error for field 'cookie' without cookie_name")
+	}
+
+	weightedPolicy := WeightedMementoSelection{Field: "cookie"}
+	if err := weightedPolicy.Provision(ctx); err == nil {
+		t.Error("Expected provision error for field 'cookie' without cookie_name")
+	}
+}
+
+// TestMementoSelectionCookieFieldCaddyfile verifies the documented
+// `lb_policy memento cookie { cookie_name JSESSIONID }` syntax.
+func TestMementoSelectionCookieFieldCaddyfile(t *testing.T) {
+	var sel MementoSelection
+	err := sel.UnmarshalCaddyfile(caddyfile.NewTestDispenser("memento cookie {\n\tcookie_name JSESSIONID\n}"))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if sel.Field != "cookie" {
+		t.Errorf("Expected field 'cookie', got %q", sel.Field)
+	}
+	if sel.CookieName != "JSESSIONID" {
+		t.Errorf("Expected cookie_name 'JSESSIONID', got %q", sel.CookieName)
+	}
+}
+
+func TestMementoSelectionStateFile(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	stateFile := filepath.Join(t.TempDir(), "memento.state")
+
+	first := &MementoSelection{Field: "ip", StateFile: stateFile}
+	if err := first.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(10)
+	first.PopulateInitialTopology(pool)
+
+	const numKeys = 200
+	mapping := make(map[string]string)
+	for i := 0; i < numKeys; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.9.0.%d:80", i)
+		host := first.Select(pool, req, nil)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s", req.RemoteAddr)
+		}
+		mapping[req.RemoteAddr] = host.Dial
+	}
+
+	// cleanup writes the snapshot; a "restarted" process with the same
+	// upstream set restores it and keeps the mapping
+	if err := first.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Fatalf("Expected state file to be written: %v", err)
+	}
+
+	second := &MementoSelection{Field: "ip", StateFile: stateFile}
+	if err := second.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	restartedPool := createMementoPool(10)
+	second.PopulateInitialTopology(restartedPool)
+	for i := 0; i < numKeys; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.9.0.%d:80", i)
+		host := second.Select(restartedPool, req, nil)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %s after restart", req.RemoteAddr)
+		}
+		if host.Dial != mapping[req.RemoteAddr] {
+			t.Errorf("Key %s: mapping not preserved across restart: got %s, want %s",
+				req.RemoteAddr, host.Dial, mapping[req.RemoteAddr])
+		}
+	}
+
+	// health events keep working against the restored topology
+	event := caddy.Event{Data: map[string]any{"host": restartedPool[4].Dial}}
+	if err := second.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	if got := second.consistentEngine.Size(); got != 9 {
+		t.Errorf("Expected 9 live nodes after unhealthy event, got %d", got)
+	}
+
+	// a changed upstream set must not adopt the snapshot
+	third := &MementoSelection{Field: "ip", StateFile: stateFile}
+	if err := third.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	third.PopulateInitialTopology(createMementoPool(11))
+	if got := third.consistentEngine.Size(); got != 11 {
+		t.Errorf("Expected a fresh engine with 11 nodes for the changed pool, got %d", got)
+	}
+
+	// a corrupt snapshot is ignored and the topology built fresh
+	if err := os.WriteFile(stateFile, []byte("not a snapshot"), 0o600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	fourth := &MementoSelection{Field: "ip", StateFile: stateFile}
+	if err := fourth.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	fourth.PopulateInitialTopology(createMementoPool(10))
+	if got := fourth.consistentEngine.Size(); got != 10 {
+		t.Errorf("Expected a fresh engine after a corrupt snapshot, got %d nodes", got)
+	}
+}
+
+func TestMementoSelectionTopologyReplace(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	mementoPolicy.TraceSampleRate = 1 // so the topology version is observable
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	// 13 known upstreams; discovery first narrows the live set to the
+	// first 10
+	pool := createMementoPool(13)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	hostsOf := func(ups []*Upstream) []string {
+		hosts := make([]string, len(ups))
+		for i, upstream := range ups {
+			hosts[i] = upstream.Dial
+		}
+		return hosts
+	}
+	replace := func(ups []*Upstream) {
+		event := caddy.Event{Data: map[string]any{"hosts": hostsOf(ups)}}
+		if err := mementoPolicy.handleTopologyReplaceEvent(context.Background(), event); err != nil {
+			t.Fatalf("handleTopologyReplaceEvent error: %v", err)
+		}
+	}
+	version := func() uint64 {
+		return atomic.LoadUint64(&mementoPolicy.tracer.version)
+	}
+
+	replace(pool[:10])
+	if got := mementoPolicy.consistentEngine.Size(); got != 10 {
+		t.Fatalf("Expected 10 live nodes after the first replace, got %d", got)
+	}
+
+	const numKeys = 300
+	before := make([]*Upstream, numKeys)
+	selectFor := func(i int) *Upstream {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.50.%d.%d:80", i/256, i%256)
+		host := mementoPolicy.Select(pool, req, nil)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %d", i)
+		}
+		return host
+	}
+	for i := 0; i < numKeys; i++ {
+		before[i] = selectFor(i)
+	}
+
+	// replace with a 10-node set sharing 7 members: nodes 7-9 depart,
+	// nodes 10-12 join, in one atomic swap
+	departed := map[*Upstream]bool{pool[7]: true, pool[8]: true, pool[9]: true}
+	joined := map[*Upstream]bool{pool[10]: true, pool[11]: true, pool[12]: true}
+	newSet := append(append([]*Upstream{}, pool[:7]...), pool[10], pool[11], pool[12])
+	versionBefore := version()
+	replace(newSet)
+
+	if got := mementoPolicy.consistentEngine.Size(); got != 10 {
+		t.Fatalf("Expected 10 live nodes after the replace, got %d", got)
+	}
+	if got := version(); got != versionBefore+1 {
+		t.Errorf("Expected a single topology version bump, got %d", got-versionBefore)
+	}
+
+	// only keys owned by the three departed nodes may move, and they
+	// must land on the joining nodes
+	moved := 0
+	for i := 0; i < numKeys; i++ {
+		after := selectFor(i)
+		if !departed[before[i]] {
+			if after != before[i] {
+				t.Errorf("Key %d moved from %s to %s although its node did not depart",
+					i, before[i].Dial, after.Dial)
+			}
+			continue
+		}
+		moved++
+		if !joined[after] {
+			t.Errorf("Key %d left departed node %s but landed on %s instead of a joining node",
+				i, before[i].Dial, after.Dial)
+		}
+	}
+	if moved == 0 {
+		t.Error("Expected some keys on the departed nodes to move")
+	}
+
+	// a replace matching the current topology is a no-op
+	versionBefore = version()
+	replace(newSet)
+	if got := version(); got != versionBefore {
+		t.Errorf("Expected no version bump for a no-op replace, got %d", got-versionBefore)
+	}
+
+	// unknown hosts are skipped rather than failing the whole swap
+	event := caddy.Event{Data: map[string]any{"hosts": append(hostsOf(newSet), "unknown:9999")}}
+	if err := mementoPolicy.handleTopologyReplaceEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleTopologyReplaceEvent with unknown host error: %v", err)
+	}
+	if got := mementoPolicy.consistentEngine.Size(); got != 10 {
+		t.Errorf("Expected the unknown host to be skipped, got %d live nodes", got)
+	}
+}
+
+func TestMementoSelectionTopologyStatus(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip", ShareSampleSize: 2000}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(4)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// one full unhealthy/healthy cycle for the first node
+	unhealthyEvent := caddy.Event{Data: map[string]any{"host": pool[0].Dial}}
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), unhealthyEvent); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	healthyEvent := caddy.Event{Data: map[string]any{"host": pool[0].Dial}}
+	if err := mementoPolicy.handleHealthyEvent(context.Background(), healthyEvent); err != nil {
+		t.Fatalf("handleHealthyEvent error: %v", err)
+	}
+
+	reports := mementoPolicy.topologyStatus()
+	if len(reports) != 4 {
+		t.Fatalf("Expected 4 topology reports, got %d", len(reports))
+	}
+	byUpstream := make(map[string]topologyNodeReport, len(reports))
+	totalShare := 0.0
+	for _, report := range reports {
+		byUpstream[report.Upstream] = report
+		totalShare += report.KeyShare
+		if !report.Active {
+			t.Errorf("Expected %s to be active", report.Upstream)
+		}
+		if report.AddedAt.IsZero() {
+			t.Errorf("Expected %s to record when it joined", report.Upstream)
+		}
+		if report.KeyShare <= 0 {
+			t.Errorf("Expected %s to own a share of the keyspace, got %f", report.Upstream, report.KeyShare)
+		}
+	}
+	// every sampled key lands on some node, so the shares sum to 1
+	if totalShare < 0.999 || totalShare > 1.001 {
+		t.Errorf("Expected key shares to sum to ~1.0, got %f", totalShare)
+	}
+
+	flapped := byUpstream[pool[0].Dial]
+	if flapped.FlapCount != 1 {
+		t.Errorf("Expected flap count 1 after one unhealthy/healthy cycle, got %d", flapped.FlapCount)
+	}
+	if flapped.LastEvent != "healthy" {
+		t.Errorf("Expected last event 'healthy', got %q", flapped.LastEvent)
+	}
+	for _, other := range pool[1:] {
+		if got := byUpstream[other.Dial].FlapCount; got != 0 {
+			t.Errorf("Expected flap count 0 for %s, got %d", other.Dial, got)
+		}
+	}
+
+	// a second cycle increments the count again
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), unhealthyEvent); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	reports = mementoPolicy.topologyStatus()
+	for _, report := range reports {
+		if report.Upstream != pool[0].Dial {
+			continue
+		}
+		if report.FlapCount != 2 {
+			t.Errorf("Expected flap count 2 after a second removal, got %d", report.FlapCount)
+		}
+		if report.Active {
+			t.Error("Expected the removed node to be reported inactive")
+		}
+		if report.KeyShare != 0 {
+			t.Errorf("Expected no key share for an inactive node, got %f", report.KeyShare)
+		}
+	}
+
+	// the admin endpoint serves the same report as JSON
+	registerSelectionPreview("memento", mementoPolicy, pool)
+	defer unregisterSelectionPreview("memento", mementoPolicy)
+	req := httptest.NewRequest(http.MethodGet, "/reverse_proxy/selection/topology?policy=memento", nil)
+	w := httptest.NewRecorder()
+	if err := (adminUpstreams{}).handleSelectionTopology(w, req); err != nil {
+		t.Fatalf("handleSelectionTopology error: %v", err)
+	}
+	var served []topologyNodeReport
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatalf("Expected a JSON topology report, got %v", err)
+	}
+	if len(served) != 4 {
+		t.Errorf("Expected 4 nodes in the served report, got %d", len(served))
+	}
+}
+
+func TestMementoSelectionClientIPBareRequest(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "client_ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(3)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// a request with no vars map must fall back to RemoteAddr
+	// instead of panicking on the missing client IP var
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	host := mementoPolicy.Select(pool, req, nil)
+	if host == nil {
+		t.Fatal("Expected a host to be selected from RemoteAddr")
+	}
+	if again := mementoPolicy.Select(pool, req, nil); again != host {
+		t.Errorf("Expected the RemoteAddr fallback to be deterministic, got %s then %s", host, again)
+	}
+}
+
+func TestMementoSelectionURIQueryParamCanonicalization(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{
+		Field:             "uri",
+		IgnoreQueryParams: []string{"utm_*", "_"},
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// cache-busting params and parameter order must not change the
+	// selected upstream
+	base := httptest.NewRequest(http.MethodGet, "/videos?id=7&quality=hd", nil)
+	busted := httptest.NewRequest(http.MethodGet, "/videos?quality=hd&_=123456&id=7&utm_source=mail", nil)
+
+	baseHost := mementoPolicy.Select(pool, base, nil)
+	if baseHost == nil {
+		t.Fatal("Expected a host to be selected")
+	}
+	if bustedHost := mementoPolicy.Select(pool, busted, nil); bustedHost != baseHost {
+		t.Errorf("Expected cache-busted request to keep affinity, got %s instead of %s", bustedHost, baseHost)
+	}
+}
+
+func TestMementoSelectionHeaderCanonicalization(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{
+		Field:        "header",
+		HeaderField:  "X-Tenant",
+		Canonicalize: true,
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	newRequest := func(value string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Tenant", value)
+		return req
+	}
+
+	// spelling variations of one tenant must keep their affinity
+	base := mementoPolicy.Select(pool, newRequest("acme"), nil)
+	if base == nil {
+		t.Fatal("Expected a host to be selected")
+	}
+	for _, variant := range []string{"Acme", " acme ", "ACME"} {
+		if host := mementoPolicy.Select(pool, newRequest(variant), nil); host != base {
+			t.Errorf("Expected variant %q to map to %s, got %s", variant, base, host)
+		}
+	}
+}
+
+// BenchmarkMementoSelectionSelectIP measures the full Select path for
+// the ip field on the default (lock-free) engine. Run with -benchmem:
+// the engine's hashing is conversion-free, so allocations per Select
+// should be zero.
+func BenchmarkMementoSelectionSelectIP(b *testing.B) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		b.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(10)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if mementoPolicy.Select(pool, req, nil) == nil {
+			b.Fatal("Expected a host to be selected")
+		}
+	}
+}
+
+func TestMementoSelectionDuplicateDialUpstreams(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// by default, two upstreams with the same identity fail provisioning
+	rejecting := &Handler{
+		Upstreams: UpstreamPool{{Dial: "localhost:8080"}, {Dial: "localhost:8080"}},
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(MementoSelection{}, "policy", "memento", nil),
+		},
+	}
+	err := rejecting.Provision(ctx)
+	if err == nil {
+		rejecting.Cleanup()
+		t.Fatal("Expected provisioning to fail for duplicate dial identities")
+	}
+	if !strings.Contains(err.Error(), "localhost:8080") {
+		t.Errorf("Expected the error to name the colliding identity, got: %v", err)
+	}
+
+	// with allow_duplicate_dials, the collision is disambiguated by
+	// assigning indexed hash keys and both nodes join the topology
+	allowing := &Handler{
+		Upstreams: UpstreamPool{{Dial: "localhost:8080"}, {Dial: "localhost:8080"}},
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(MementoSelection{AllowDuplicateDials: true}, "policy", "memento", nil),
+		},
+	}
+	if err := allowing.Provision(ctx); err != nil {
+		t.Fatalf("Expected provisioning to succeed with allow_duplicate_dials, got: %v", err)
+	}
+	defer allowing.Cleanup()
+
+	first, second := allowing.Upstreams[0], allowing.Upstreams[1]
+	if first.HashKey == second.HashKey || first.HashKey == "" {
+		t.Errorf("Expected distinct generated hash keys, got %q and %q", first.HashKey, second.HashKey)
+	}
+
+	mementoPolicy := allowing.LoadBalancing.SelectionPolicy.(*MementoSelection)
+	if size := mementoPolicy.consistentEngine.Size(); size != 2 {
+		t.Errorf("Expected both disambiguated upstreams in the topology, got size %d", size)
+	}
+	for _, upstream := range allowing.Upstreams {
+		if mementoPolicy.nodeByID(upstream.HashKey) != upstream {
+			t.Errorf("Expected the identity index to resolve %q to its own upstream", upstream.HashKey)
+		}
+	}
+}
+
+// TestMementoSelectionCleanupUnsubscribes verifies that Cleanup
+// deregisters the policy from the events app and releases the engine:
+// events emitted after cleanup must not touch the old instance's
+// topology, and a direct Handle call must be a no-op.
+func TestMementoSelectionCleanupUnsubscribes(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision events app: %v", err)
+	}
+
+	mementoPolicy := MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	mementoPolicy.SetEventsApp(eventsApp)
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Failed to start events app: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	// sanity: events reach the policy before cleanup
+	eventsApp.Emit(ctx, "unhealthy", map[string]any{"host": pool[0].Dial})
+	if topologyActive(&mementoPolicy.topology, pool[0]) {
+		t.Fatal("Expected the unhealthy event to reach the policy before cleanup")
+	}
+
+	if err := mementoPolicy.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	if mementoPolicy.consistentEngine != nil {
+		t.Error("Expected Cleanup to release the engine")
+	}
+	if mementoPolicy.events != nil {
+		t.Error("Expected Cleanup to drop the events app reference")
+	}
+
+	// events emitted after cleanup must not resurrect the topology
+	for _, upstream := range pool {
+		eventsApp.Emit(ctx, "healthy", map[string]any{"host": upstream.Dial})
+	}
+	topologySize := 0
+	mementoPolicy.topology.Range(func(_, _ any) bool {
+		topologySize++
+		return true
+	})
+	if topologySize != 0 {
+		t.Errorf("Expected an empty topology after cleanup, got %d entries", topologySize)
+	}
+
+	// a direct Handle call against the cleaned instance is a no-op
+	event, err := caddy.NewEvent(ctx, "healthy", map[string]any{"host": pool[0].Dial})
+	if err != nil {
+		t.Fatalf("NewEvent error: %v", err)
+	}
+	if err := mementoPolicy.Handle(ctx, event); err != nil {
+		t.Errorf("Expected Handle to be a no-op after cleanup, got: %v", err)
+	}
+}
+
+// TestWeightedMementoSelectionCleanupUnsubscribes is the weighted
+// counterpart: Cleanup must deregister from the events app and release
+// the engine, topology, and overflow views.
+func TestWeightedMementoSelectionCleanupUnsubscribes(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision events app: %v", err)
+	}
+
+	weightedPolicy := WeightedMementoSelection{Field: "ip"}
+	if err := weightedPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	weightedPolicy.SetEventsApp(eventsApp)
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Failed to start events app: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	weightedPolicy.PopulateInitialTopology(pool)
+
+	if err := weightedPolicy.Cleanup(); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	if weightedPolicy.consistentEngine != nil {
+		t.Error("Expected Cleanup to release the engine")
+	}
+	if weightedPolicy.events != nil {
+		t.Error("Expected Cleanup to drop the events app reference")
+	}
+
+	eventsApp.Emit(ctx, "healthy", map[string]any{"host": pool[0].Dial})
+	topologySize := 0
+	weightedPolicy.topology.Range(func(_, _ any) bool {
+		topologySize++
+		return true
+	})
+	if topologySize != 0 {
+		t.Errorf("Expected an empty topology after cleanup, got %d entries", topologySize)
+	}
+}
+
+// tieredTestPolicy provisions a two-group tiered policy over a
+// 6-upstream pool (group "dc-east" gets the first three dials, group
+// "dc-west" the rest) and returns the policy, the pool, and the events
+// app driving it.
+func tieredTestPolicy(t *testing.T, ctx caddy.Context) (*TieredMementoSelection, UpstreamPool, *caddyevents.App) {
+	t.Helper()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision events app: %v", err)
+	}
+
+	policy := &TieredMementoSelection{
+		Field:       "header",
+		HeaderField: "X-Key",
+		Groups: []TieredMementoGroup{
+			{Name: "dc-east", Weight: 2, Dials: []string{"localhost:8080", "localhost:8081", "localhost:8082"}},
+			{Name: "dc-west", Weight: 1, Dials: []string{"localhost:8083", "localhost:8084", "localhost:8085"}},
+		},
+	}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.SetEventsApp(eventsApp)
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Failed to start events app: %v", err)
+	}
+
+	pool := createMementoPool(6)
+	policy.PopulateInitialTopology(pool)
+	return policy, pool, eventsApp
+}
+
+// tieredGroupName resolves which group the policy assigned an upstream to.
+func tieredGroupName(t *testing.T, policy *TieredMementoSelection, upstream *Upstream) string {
+	t.Helper()
+	val, ok := policy.groupOf.Load(upstream)
+	if !ok {
+		t.Fatalf("Upstream %s belongs to no group", upstream.Dial)
+	}
+	return val.(*tieredGroupState).name
+}
+
+// TestTieredMementoIntraGroupRemoval verifies that losing one member
+// moves only that member's keys, and only to other members of the same
+// group.
+func TestTieredMementoIntraGroupRemoval(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy, pool, eventsApp := tieredTestPolicy(t, ctx)
+
+	const numKeys = 500
+	before := make(map[string]*Upstream, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		upstream := policy.SelectByKey(pool, key)
+		if upstream == nil {
+			t.Fatalf("Expected key %q to resolve before the removal", key)
+		}
+		before[key] = upstream
+	}
+
+	removed := pool[1] // a dc-east member
+	eventsApp.Emit(ctx, "unhealthy", map[string]any{"host": removed.Dial})
+
+	for key, owner := range before {
+		after := policy.SelectByKey(pool, key)
+		if after == nil {
+			t.Fatalf("Expected key %q to still resolve after the removal", key)
+		}
+		if owner != removed {
+			if after != owner {
+				t.Errorf("Key %q moved from %s to %s although its owner stayed up", key, owner.Dial, after.Dial)
+			}
+			continue
+		}
+		if after == removed {
+			t.Errorf("Key %q still maps to the removed upstream", key)
+		}
+		if group := tieredGroupName(t, policy, after); group != "dc-east" {
+			t.Errorf("Key %q spilled to group %s although its own group still has members", key, group)
+		}
+	}
+}
+
+// TestTieredMementoWholeGroupOutage verifies that an entire group going
+// dark moves only that group's keys, deterministically, to the
+// surviving groups — and that the keys come back when the group does.
+func TestTieredMementoWholeGroupOutage(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy, pool, eventsApp := tieredTestPolicy(t, ctx)
+
+	const numKeys = 500
+	before := make(map[string]*Upstream, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		upstream := policy.SelectByKey(pool, key)
+		if upstream == nil {
+			t.Fatalf("Expected key %q to resolve before the outage", key)
+		}
+		before[key] = upstream
+	}
+
+	// take down all of dc-west (the last three pool members)
+	for _, upstream := range pool[3:] {
+		eventsApp.Emit(ctx, "unhealthy", map[string]any{"host": upstream.Dial})
+	}
+
+	for key, owner := range before {
+		after := policy.SelectByKey(pool, key)
+		if after == nil {
+			t.Fatalf("Expected key %q to still resolve during the outage", key)
+		}
+		if tieredGroupName(t, policy, owner) == "dc-east" {
+			if after != owner {
+				t.Errorf("Key %q moved from %s to %s although its group was unaffected", key, owner.Dial, after.Dial)
+			}
+			continue
+		}
+		if group := tieredGroupName(t, policy, after); group != "dc-east" {
+			t.Errorf("Key %q still maps into the dark group via %s", key, after.Dial)
+		}
+	}
+
+	// dc-west recovering pulls its keys back into the group
+	for _, upstream := range pool[3:] {
+		eventsApp.Emit(ctx, "healthy", map[string]any{"host": upstream.Dial})
+	}
+	for key, owner := range before {
+		if tieredGroupName(t, policy, owner) != "dc-west" {
+			continue
+		}
+		after := policy.SelectByKey(pool, key)
+		if after == nil {
+			t.Fatalf("Expected key %q to resolve after the recovery", key)
+		}
+		if group := tieredGroupName(t, policy, after); group != "dc-west" {
+			t.Errorf("Key %q did not return to its group after the recovery (now on %s)", key, after.Dial)
+		}
+	}
+}
+
+// TestMementoConsistencyBreakerResync artificially desyncs the engine
+// from the pool (a host dies but the unhealthy event never reaches the
+// policy) and verifies that the consistency circuit breaker fires
+// after the configured run of fallback selections, re-syncs the
+// topology from the pool, and that subsequent selections stop falling
+// back — all rate-limited by the re-sync interval.
+func TestMementoConsistencyBreakerResync(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := MementoSelection{
+		Field:           "header",
+		HeaderField:     "X-Key",
+		ResyncThreshold: 3,
+		ResyncInterval:  caddy.Duration(time.Millisecond),
+	}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(3)
+	policy.PopulateInitialTopology(pool)
+
+	keyOwnedBy := func(owner *Upstream) string {
+		for i := 0; i < 1000; i++ {
+			candidate := fmt.Sprintf("breaker-key-%d", i)
+			if policy.SelectByKey(pool, candidate) == owner {
+				return candidate
+			}
+		}
+		t.Fatalf("No key maps to %s", owner.Dial)
+		return ""
+	}
+	reqFor := func(key string) *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Key", key)
+		return req
+	}
+
+	key := keyOwnedBy(pool[0])
+
+	// the key's owner dies, but no unhealthy event reaches the policy
+	pool[0].setHealthy(false)
+
+	// below the threshold the selections fall back but the engine is
+	// left alone
+	for i := 0; i < 2; i++ {
+		if upstream := policy.Select(pool, reqFor(key), nil); upstream == nil {
+			t.Fatal("Expected the fallback to still produce a host")
+		}
+	}
+	if !policy.consistentEngine.HasNode(pool[0]) {
+		t.Fatal("Breaker fired below its threshold")
+	}
+
+	// the third consecutive miss trips the breaker
+	if upstream := policy.Select(pool, reqFor(key), nil); upstream == nil {
+		t.Fatal("Expected the tripping selection to still produce a host")
+	}
+	if policy.consistentEngine.HasNode(pool[0]) {
+		t.Fatal("Expected the re-sync to drop the dead upstream from the engine")
+	}
+	if size := policy.consistentEngine.Size(); size != 2 {
+		t.Errorf("Expected the surviving upstreams to be kept, got engine size %d", size)
+	}
+
+	// subsequent selections resolve through the topology again
+	after := policy.SelectByKey(pool, key)
+	if after == nil {
+		t.Fatal("Expected the key to resolve without falling back after the re-sync")
+	}
+	if after == pool[0] {
+		t.Error("Expected the key to move off the dead upstream")
+	}
+
+	// a second drift inside the re-sync interval must not thrash
+	policy.resyncBreaker.interval = time.Hour
+	key2 := keyOwnedBy(pool[1])
+	pool[1].setHealthy(false)
+	for i := 0; i < 5; i++ {
+		policy.Select(pool, reqFor(key2), nil)
+	}
+	if !policy.consistentEngine.HasNode(pool[1]) {
+		t.Error("Expected the rate limit to hold off a second re-sync")
+	}
+}
+
+// TestMementoSelectionRejectsPlaceholderDials verifies that a
+// topology-tracking policy refuses static upstream addresses containing
+// placeholders: they resolve per request, so the topology would be
+// pinned to whatever the first request resolved.
+func TestMementoSelectionRejectsPlaceholderDials(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	handler := &Handler{
+		Upstreams: UpstreamPool{{Dial: "localhost:8080"}, {Dial: "{env.BACKEND_HOST}:8081"}},
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(MementoSelection{}, "policy", "memento", nil),
+		},
+	}
+	err := handler.Provision(ctx)
+	if err == nil {
+		handler.Cleanup()
+		t.Fatal("Expected provisioning to fail for a placeholder-bearing dial address")
+	}
+	if !strings.Contains(err.Error(), "{env.BACKEND_HOST}:8081") {
+		t.Errorf("Expected the error to name the placeholder address, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "dynamic upstreams") {
+		t.Errorf("Expected the error to point at dynamic upstreams, got: %v", err)
+	}
+
+	// placeholder-free addresses provision as before
+	plain := &Handler{
+		Upstreams: UpstreamPool{{Dial: "localhost:8080"}, {Dial: "localhost:8081"}},
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(MementoSelection{}, "policy", "memento", nil),
+		},
+	}
+	if err := plain.Provision(ctx); err != nil {
+		t.Fatalf("Expected provisioning to succeed without placeholders, got: %v", err)
+	}
+	plain.Cleanup()
+}
+
+// TestWarmupFromKeysFile verifies the warm-up helper: every non-empty
+// line of the file is run through the engine once, and an unreadable
+// file is skipped without error.
+func TestWarmupFromKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(path, []byte("tenant-1\ntenant-2\n\ntenant-3\ntenant-4\ntenant-5\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+
+	engine := NewConsistentEngineWithType(true)
+	if err := engine.AddNodes(createMementoPool(4)); err != nil {
+		t.Fatalf("AddNodes error: %v", err)
+	}
+
+	if processed := warmupFromKeysFile(path, engine, nil); processed != 5 {
+		t.Errorf("Expected 5 keys to be processed (blank line skipped), got %d", processed)
+	}
+	if processed := warmupFromKeysFile(filepath.Join(dir, "absent.txt"), engine, nil); processed != 0 {
+		t.Errorf("Expected 0 keys from an absent file, got %d", processed)
+	}
+}
+
+// TestWarmupKeysFileAbsent verifies that a configured but missing
+// warm-up file does not keep the policy from provisioning or serving.
+func TestWarmupKeysFileAbsent(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	sel := &MementoSelection{Field: "ip"}
+	sel.WarmupKeysFile = filepath.Join(t.TempDir(), "does-not-exist.txt")
+	if err := sel.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	sel.PopulateInitialTopology(pool)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:80"
+	if upstream := sel.Select(pool, req, nil); upstream == nil {
+		t.Error("Expected a selection despite the missing warm-up file")
+	}
+}
+
+// TestWeightedMementoDefaultWeightForNewHosts verifies that a healthy
+// event for a host the policy has never seen admits it with the
+// configured default weight, and that without the option such hosts
+// stay out of the topology.
+func TestWeightedMementoDefaultWeightForNewHosts(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision events app: %v", err)
+	}
+
+	weights := []int{1, 1}
+	policy := &WeightedMementoSelection{Field: "ip", Weights: weights, DefaultWeightForNewHosts: 2}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.SetEventsApp(eventsApp)
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Failed to start events app: %v", err)
+	}
+
+	pool := createWeightedPool(2, weights)
+	policy.PopulateInitialTopology(pool)
+
+	const newDial = "localhost:9999"
+	eventsApp.Emit(ctx, "healthy", map[string]any{"host": newDial})
+
+	newHost := policy.nodeByID(newDial)
+	if newHost == nil {
+		t.Fatal("Expected the healthy event to admit the new host")
+	}
+
+	// weights are now 1, 1, 2, so the new host should own about half
+	// of the keyspace
+	shares := policy.consistentEngine.KeyShareEstimate(10000)
+	share := shares[newHost]
+	if share < 0.40 || share > 0.60 {
+		t.Errorf("Expected the new host to own ~0.5 of the keyspace at weight 2, got %.4f", share)
+	}
+
+	// a later flap re-adds it with the same weight
+	eventsApp.Emit(ctx, "unhealthy", map[string]any{"host": newDial})
+	if _, ok := policy.consistentEngine.KeyShareEstimate(10000)[newHost]; ok {
+		t.Fatal("Expected the unhealthy event to remove the new host")
+	}
+	eventsApp.Emit(ctx, "healthy", map[string]any{"host": newDial})
+	share = policy.consistentEngine.KeyShareEstimate(10000)[newHost]
+	if share < 0.40 || share > 0.60 {
+		t.Errorf("Expected the re-added host to keep weight 2, got share %.4f", share)
+	}
+
+	// without the option, an unknown host is rejected
+	rejecting := &WeightedMementoSelection{Field: "ip", Weights: weights}
+	if err := rejecting.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	rejecting.SetEventsApp(eventsApp)
+	rejecting.PopulateInitialTopology(createWeightedPool(2, weights))
+	eventsApp.Emit(ctx, "healthy", map[string]any{"host": "localhost:9998"})
+	if rejecting.nodeByID("localhost:9998") != nil {
+		t.Error("Expected an unknown host to be rejected when default_weight_for_new_hosts is unset")
+	}
+}
+
+func TestMementoLogsTopologyErrorsInsteadOfMisrouting(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(3)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+	mementoPolicy.logger = zap.New(core)
+
+	// contrive the tracking mismatch a typed error guards against: the
+	// topology record says the node is inactive while the engine still
+	// holds it, so the healthy handler tries a duplicate add
+	topologyDeactivate(&mementoPolicy.topology, pool[0], "test")
+	mementoPolicy.handleHealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"host": pool[0].String()},
+	})
+
+	if logs.FilterMessage("cannot add recovered upstream to topology").Len() == 0 {
+		t.Error("Expected the duplicate add to be logged")
+	}
+
+	// and the policy still routes every key to a real pool member
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.%d:80", i)
+		selected := mementoPolicy.Select(pool, req, nil)
+		if selected == nil {
+			t.Fatal("Expected a selection despite the topology error")
+		}
+		found := false
+		for _, up := range pool {
+			if up == selected {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("Selected upstream %s is not a pool member", selected.String())
+		}
+	}
+}
+
+// TestMementoSelectionFieldValidation verifies that an unsupported or
+// incomplete field configuration is rejected at provision time rather
+// than silently routing every request through the fallback policy.
+func TestMementoSelectionFieldValidation(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	invalid := []MementoSelection{
+		{Field: "haeder"},     // typo for a real field
+		{Field: "query"},      // valid for other policies, not memento
+		{Field: "header"},     // missing header_field
+		{Field: "cookie"},     // missing cookie_name
+		{Field: "expression"}, // missing expression
+	}
+	for _, policy := range invalid {
+		if err := policy.Provision(ctx); err == nil {
+			t.Errorf("Expected provision error for memento field %q", policy.Field)
+		}
+	}
+
+	weightedInvalid := []WeightedMementoSelection{
+		{Field: "path_only"}, // memento-only variant
+		{Field: "header"},
+		{Field: "cookie"},
+		{Field: "expression"},
+	}
+	for _, policy := range weightedInvalid {
+		if err := policy.Provision(ctx); err == nil {
+			t.Errorf("Expected provision error for weighted_memento field %q", policy.Field)
+		}
+	}
+
+	valid := MementoSelection{Field: "path_and_query"}
+	if err := valid.Provision(ctx); err != nil {
+		t.Errorf("Unexpected provision error for field 'path_and_query': %v", err)
+	}
+	validWeighted := WeightedMementoSelection{Field: "header", HeaderField: "X-User"}
+	if err := validWeighted.Provision(ctx); err != nil {
+		t.Errorf("Unexpected provision error for field 'header' with header_field: %v", err)
+	}
+}
+
+// TestMementoSelectionCaddyfileSuggestions verifies that a misspelled
+// sub-directive gets a "did you mean" hint, while an option nowhere
+// near any known one keeps the plain error.
+func TestMementoSelectionCaddyfileSuggestions(t *testing.T) {
+	var sel MementoSelection
+	err := sel.UnmarshalCaddyfile(caddyfile.NewTestDispenser("memento {\n\theader_feild X-User\n}"))
+	if err == nil || !strings.Contains(err.Error(), "did you mean 'header_field'?") {
+		t.Errorf("Expected suggestion for 'header_feild', got: %v", err)
+	}
+
+	var farOff MementoSelection
+	err = farOff.UnmarshalCaddyfile(caddyfile.NewTestDispenser("memento {\n\tbananas\n}"))
+	if err == nil {
+		t.Error("Expected error for unrecognized option 'bananas'")
+	} else if strings.Contains(err.Error(), "did you mean") {
+		t.Errorf("Expected no suggestion for 'bananas', got: %v", err)
+	}
+
+	var weighted WeightedMementoSelection
+	err = weighted.UnmarshalCaddyfile(caddyfile.NewTestDispenser("weighted_memento {\n\tmax_virtual_nods 100\n}"))
+	if err == nil || !strings.Contains(err.Error(), "did you mean 'max_virtual_nodes'?") {
+		t.Errorf("Expected suggestion for 'max_virtual_nods', got: %v", err)
+	}
+}
+
+// TestMementoHandlerScopedHealthEvents verifies that a memento policy
+// ignores health events emitted by another reverse proxy handler, so
+// two handlers whose pools overlap on an upstream address don't
+// contaminate each other's topologies; accept_external_events opts
+// back into the shared behavior, and events without a handler identity
+// (legacy or third-party emitters) are always applied.
+func TestMementoHandlerScopedHealthEvents(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision events app: %v", err)
+	}
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Failed to start events app: %v", err)
+	}
+
+	upstream := func(dial string) *Upstream {
+		u := &Upstream{Host: new(Host), Dial: dial}
+		u.setHealthy(true)
+		return u
+	}
+	shared := "localhost:8085"
+	poolA := UpstreamPool{upstream("localhost:8080"), upstream(shared)}
+	poolB := UpstreamPool{upstream("localhost:9090"), upstream(shared)}
+
+	policyA := MementoSelection{Field: "ip"}
+	if err := policyA.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policyA.setHandlerIdentity("handler-a")
+	policyA.SetEventsApp(eventsApp)
+	policyA.PopulateInitialTopology(poolA)
+
+	policyB := MementoSelection{Field: "ip"}
+	if err := policyB.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policyB.setHandlerIdentity("handler-b")
+	policyB.SetEventsApp(eventsApp)
+	policyB.PopulateInitialTopology(poolB)
+
+	// handler A's checker reports the shared address unhealthy: only
+	// A's topology may change
+	eventsApp.Emit(ctx, "unhealthy", healthEventData(shared, false, reasonActiveHealthCheck, "handler-a"))
+	if topologyActive(&policyA.topology, poolA[1]) {
+		t.Error("Expected the owning policy to remove the flapped upstream")
+	}
+	if !topologyActive(&policyB.topology, poolB[1]) {
+		t.Error("Expected the other handler's policy to ignore the foreign event")
+	}
+
+	// a recovery from handler A restores only A's topology
+	eventsApp.Emit(ctx, "healthy", healthEventData(shared, true, reasonActiveHealthCheck, "handler-a"))
+	if !topologyActive(&policyA.topology, poolA[1]) {
+		t.Error("Expected the owning policy to restore the recovered upstream")
+	}
+
+	// opting into external events makes B react to A's flaps again
+	policyB.AcceptExternalEvents = true
+	eventsApp.Emit(ctx, "unhealthy", healthEventData(shared, false, reasonActiveHealthCheck, "handler-a"))
+	if topologyActive(&policyB.topology, poolB[1]) {
+		t.Error("Expected accept_external_events to apply the foreign event")
+	}
+	eventsApp.Emit(ctx, "healthy", healthEventData(shared, true, reasonActiveHealthCheck, "handler-a"))
+	policyB.AcceptExternalEvents = false
+
+	// events carrying no handler identity are always applied
+	eventsApp.Emit(ctx, "unhealthy", healthEventData(shared, false, reasonActiveHealthCheck, ""))
+	if topologyActive(&policyA.topology, poolA[1]) || topologyActive(&policyB.topology, poolB[1]) {
+		t.Error("Expected both policies to apply an event without a handler identity")
+	}
+}
+
+func TestMementoSelectionAffinitySeed(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// find the engine's own choice for the key with an unseeded policy
+	plain := &MementoSelection{Field: "ip"}
+	if err := plain.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(3)
+	plain.PopulateInitialTopology(pool)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.10:80"
+	engineChoice := plain.Select(pool, req, nil)
+	if engineChoice == nil {
+		t.Fatal("Expected a selection from the unseeded policy")
+	}
+
+	// seed the key to a different upstream, the way a migration would
+	// pin sessions to the owner exported from the old stickiness scheme
+	var seedTarget *Upstream
+	for _, upstream := range pool {
+		if upstream != engineChoice {
+			seedTarget = upstream
+			break
+		}
+	}
+	seedFile := filepath.Join(t.TempDir(), "affinity.csv")
+	contents := fmt.Sprintf("203.0.113.10,%s\nnot a pair\n203.0.113.99,\n", seedTarget.Dial)
+	if err := os.WriteFile(seedFile, []byte(contents), 0o600); err != nil {
+		t.Fatalf("Cannot write seed file: %v", err)
+	}
+
+	seeded := &MementoSelection{
+		Field:            "ip",
+		AffinitySeedFile: seedFile,
+		SeedTTL:          caddy.Duration(50 * time.Millisecond),
+	}
+	if err := seeded.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	seeded.PopulateInitialTopology(pool)
+
+	// the malformed lines must not have become overrides
+	if _, ok := seeded.overrides.Load("not a pair"); ok {
+		t.Error("Expected a line without a comma to be skipped")
+	}
+	if _, ok := seeded.overrides.Load("203.0.113.99"); ok {
+		t.Error("Expected a line without a dial address to be skipped")
+	}
+
+	// pre-TTL the seeded key routes to its historical owner, while
+	// unseeded keys follow the engine from the start
+	if h := seeded.Select(pool, req, nil); h != seedTarget {
+		t.Errorf("Expected the seeded key to route to %s, got %v", seedTarget.Dial, h)
+	}
+	other, _ := http.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "203.0.113.11:80"
+	if h := seeded.Select(pool, other, nil); h != plain.Select(pool, other, nil) {
+		t.Error("Expected unseeded keys to follow the engine")
+	}
+
+	// post-TTL the seed expires on access and pure engine behavior remains
+	time.Sleep(60 * time.Millisecond)
+	if h := seeded.Select(pool, req, nil); h != engineChoice {
+		t.Errorf("Expected the expired seed to leave the engine's choice %s, got %v", engineChoice.Dial, h)
+	}
+	if _, still := seeded.overrides.Load("203.0.113.10"); still {
+		t.Error("Expected the expired seed to be dropped on access")
+	}
+}
+
+func TestMementoSelectionInitialTopologyModes(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// a pool whose first host is dead at startup
+	newPool := func() UpstreamPool {
+		pool := createMementoPool(3)
+		pool[0].setHealthy(false)
+		return pool
+	}
+
+	// all (the default): every configured host enters the topology,
+	// dead or not
+	allPolicy := &MementoSelection{Field: "ip"}
+	if err := allPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := newPool()
+	allPolicy.PopulateInitialTopology(pool)
+	if !topologyActive(&allPolicy.topology, pool[0]) {
+		t.Error("Expected initial_topology all to enter the dead host")
+	}
+
+	// healthy_only: nothing enters until the first active round
+	// completes, and the dead host is left out when it does
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Provision events app error: %v", err)
+	}
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Start events app error: %v", err)
+	}
+	healthyOnly := &MementoSelection{Field: "ip", InitialTopology: "healthy_only"}
+	if err := healthyOnly.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	healthyOnly.SetEventsApp(eventsApp)
+	pool = newPool()
+	healthyOnly.PopulateInitialTopology(pool)
+	for _, upstream := range pool {
+		if topologyActive(&healthyOnly.topology, upstream) {
+			t.Fatal("Expected population to wait for the first health check round")
+		}
+	}
+	eventsApp.Emit(ctx, eventHealthCheckInitialComplete, initialHealthCheckCompleteEventData(""))
+	if topologyActive(&healthyOnly.topology, pool[0]) {
+		t.Error("Expected the dead host to stay out of the topology")
+	}
+	if !topologyActive(&healthyOnly.topology, pool[1]) || !topologyActive(&healthyOnly.topology, pool[2]) {
+		t.Error("Expected the healthy hosts to enter the topology")
+	}
+	// the excluded host joins once it recovers
+	pool[0].setHealthy(true)
+	eventsApp.Emit(ctx, "healthy", healthEventData(pool[0].Dial, true, reasonActiveHealthCheck, ""))
+	if !topologyActive(&healthyOnly.topology, pool[0]) {
+		t.Error("Expected the recovered host to join the topology")
+	}
+
+	// lazy: the first selection populates from its pool's available
+	// members, leaving the dead host out
+	lazy := &MementoSelection{Field: "ip", InitialTopology: "lazy"}
+	if err := lazy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool = newPool()
+	lazy.PopulateInitialTopology(pool)
+	for _, upstream := range pool {
+		if topologyActive(&lazy.topology, upstream) {
+			t.Fatal("Expected population to wait for the first selection")
+		}
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:80"
+	if h := lazy.Select(pool, req, nil); h == nil || h == pool[0] {
+		t.Errorf("Expected the first selection to pick a live host, got %v", h)
+	}
+	if topologyActive(&lazy.topology, pool[0]) {
+		t.Error("Expected the dead host to stay out of the lazily built topology")
+	}
+	if !topologyActive(&lazy.topology, pool[1]) || !topologyActive(&lazy.topology, pool[2]) {
+		t.Error("Expected the available hosts to enter the lazily built topology")
+	}
+
+	// an unknown mode fails provisioning
+	bad := &MementoSelection{Field: "ip", InitialTopology: "on_demand"}
+	if err := bad.Provision(ctx); err == nil {
+		t.Error("Expected an unrecognized initial_topology to fail provisioning")
+	}
+}
+
+func TestWeightedMementoInitialTopologyHealthyOnly(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Provision events app error: %v", err)
+	}
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Start events app error: %v", err)
+	}
+
+	policy := &WeightedMementoSelection{
+		Field:           "ip",
+		Weights:         []int{3, 2, 1},
+		InitialTopology: "healthy_only",
+	}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.SetEventsApp(eventsApp)
+	pool := createMementoPool(3)
+	pool[0].setHealthy(false)
+	policy.PopulateInitialTopology(pool)
+	for _, upstream := range pool {
+		if topologyActive(&policy.topology, upstream) {
+			t.Fatal("Expected population to wait for the first health check round")
+		}
+	}
+
+	eventsApp.Emit(ctx, eventHealthCheckInitialComplete, initialHealthCheckCompleteEventData(""))
+	if topologyActive(&policy.topology, pool[0]) {
+		t.Error("Expected the dead host to stay out of the topology")
+	}
+	if !topologyActive(&policy.topology, pool[1]) || !topologyActive(&policy.topology, pool[2]) {
+		t.Error("Expected the healthy hosts to enter the topology")
+	}
+
+	// the excluded host re-enters with its configured weight, not the
+	// default for late joiners
+	pool[0].setHealthy(true)
+	eventsApp.Emit(ctx, "healthy", healthEventData(pool[0].Dial, true, reasonActiveHealthCheck, ""))
+	if !topologyActive(&policy.topology, pool[0]) {
+		t.Error("Expected the recovered host to join the topology")
+	}
+	if weight := policy.initialWeights[pool[0]]; weight != 3 {
+		t.Errorf("Expected the recovered host to keep its configured weight 3, got %d", weight)
 	}
-	t.Logf("Verified %d/10 keys mapped to valid hosts", validMappings)
 }
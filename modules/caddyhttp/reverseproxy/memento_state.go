@@ -0,0 +1,56 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// mementoStates retains consistent-engine state across config reloads
+// for memento policies with preserve_state enabled. Caddy provisions
+// the new config before cleaning up the old one, so the successor's
+// LoadOrNew overlaps the predecessor's reference and the state changes
+// hands without the refcount ever reaching zero; when the policy is
+// truly removed from the config, the last Delete destructs the state.
+var mementoStates = caddy.NewUsagePool()
+
+// mementoStateKey derives the stable identity of a policy's preserved
+// state: the policy kind, the engine variant, and the set of configured
+// upstreams. A reload with an identical upstream set produces the same
+// key and adopts the previous engine; any change to the set produces a
+// new key and therefore a fresh engine.
+func mementoStateKey(policy, engine string, upstreams []*Upstream) string {
+	ids := make([]string, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		ids = append(ids, upstream.hashKey())
+	}
+	sort.Strings(ids)
+	return policy + "|" + engine + "|" + strings.Join(ids, ",")
+}
+
+// preservedMementoState is what a memento policy leaves behind on
+// reload for its successor to adopt: the consistent engine with its
+// full replacement history and learned topology, so the key-to-node
+// mapping survives reprovisioning instead of resetting.
+type preservedMementoState struct {
+	engine consistentHasher
+}
+
+// Destruct implements caddy.Destructor. The engine needs no teardown;
+// dropping the last reference is enough.
+func (preservedMementoState) Destruct() error { return nil }
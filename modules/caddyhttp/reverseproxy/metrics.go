@@ -2,7 +2,9 @@ package reverseproxy
 
 import (
 	"errors"
+	"net/http"
 	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,12 +13,20 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
 var reverseProxyMetrics = struct {
-	once             sync.Once
-	upstreamsHealthy *prometheus.GaugeVec
-	logger           *zap.Logger
+	once              sync.Once
+	upstreamsHealthy  *prometheus.GaugeVec
+	selectionTotal    *prometheus.CounterVec
+	selectionDuration *prometheus.HistogramVec
+	selectionOverflow *prometheus.CounterVec
+	shadowAgree       prometheus.Counter
+	shadowDisagree    *prometheus.CounterVec
+	topologyResync    *prometheus.CounterVec
+	keyShare          *prometheus.GaugeVec
+	logger            *zap.Logger
 }{}
 
 func initReverseProxyMetrics(handler *Handler, registry *prometheus.Registry) {
@@ -30,22 +40,184 @@ func initReverseProxyMetrics(handler *Handler, registry *prometheus.Registry) {
 			Name:      "upstreams_healthy",
 			Help:      "Health status of reverse proxy upstreams.",
 		}, upstreamsLabels)
+		reverseProxyMetrics.selectionTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selection_total",
+			Help:      "Load balancing selections by policy, selected upstream, and whether the policy's fallback fired.",
+		}, []string{"policy", "upstream", "fallback"})
+		reverseProxyMetrics.selectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selection_duration_seconds",
+			Help:      "Duration of load balancing selections by policy.",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 8),
+		}, []string{"policy"})
+		reverseProxyMetrics.selectionOverflow = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selection_overflow_total",
+			Help:      "Selections re-routed to a deterministic secondary because the key's owner was at capacity, by policy and capped upstream.",
+		}, []string{"policy", "upstream"})
+		reverseProxyMetrics.shadowAgree = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selection_shadow_agree_total",
+			Help:      "Requests for which the shadow selection policy picked the same upstream as the primary.",
+		})
+		reverseProxyMetrics.shadowDisagree = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selection_shadow_disagree_total",
+			Help:      "Requests for which the shadow selection policy picked a different upstream than the primary, by both picks.",
+		}, []string{"primary_upstream", "shadow_upstream"})
+		reverseProxyMetrics.topologyResync = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "topology_resync_total",
+			Help:      "Automatic topology re-syncs triggered by the consistency circuit breaker, by policy.",
+		}, []string{"policy"})
+		reverseProxyMetrics.keyShare = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "key_share_estimate",
+			Help:      "Estimated fraction of the keyspace each upstream owns under a consistent hashing policy; refreshed on topology changes, not per request.",
+		}, []string{"policy", "upstream"})
 	})
 
 	// duplicate registration could happen if multiple sites with reverse proxy are configured; so ignore the error because
 	// there's no good way to capture having multiple sites with reverse proxy. If this happens, the metrics will be
 	// registered twice, but the second registration will be ignored.
-	if err := registry.Register(reverseProxyMetrics.upstreamsHealthy); err != nil &&
-		!errors.Is(err, prometheus.AlreadyRegisteredError{
-			ExistingCollector: reverseProxyMetrics.upstreamsHealthy,
-			NewCollector:      reverseProxyMetrics.upstreamsHealthy,
-		}) {
-		panic(err)
+	for _, collector := range []prometheus.Collector{
+		reverseProxyMetrics.upstreamsHealthy,
+		reverseProxyMetrics.selectionTotal,
+		reverseProxyMetrics.selectionDuration,
+		reverseProxyMetrics.selectionOverflow,
+		reverseProxyMetrics.shadowAgree,
+		reverseProxyMetrics.shadowDisagree,
+		reverseProxyMetrics.topologyResync,
+		reverseProxyMetrics.keyShare,
+	} {
+		if err := registry.Register(collector); err != nil &&
+			!errors.Is(err, prometheus.AlreadyRegisteredError{
+				ExistingCollector: collector,
+				NewCollector:      collector,
+			}) {
+			panic(err)
+		}
 	}
 
 	reverseProxyMetrics.logger = handler.logger.Named("reverse_proxy.metrics")
 }
 
+// selectionFallbackVarKey is the request variable that fallbackMarker
+// sets when a policy's fallback selector actually fires, so the handler
+// can label the selection outcome metric accordingly.
+const selectionFallbackVarKey = "reverse_proxy.selection_used_fallback"
+
+// fallbackMarker wraps a policy's fallback selection policy and marks
+// the current request when it fires. The mark is a single request
+// variable write, so wrapping costs nothing measurable even when
+// selection metrics are disabled.
+type fallbackMarker struct {
+	Selector
+}
+
+// markFallback wraps sel so its use is visible to selection metrics.
+func markFallback(sel Selector) Selector {
+	return fallbackMarker{sel}
+}
+
+func (f fallbackMarker) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	if req != nil {
+		caddyhttp.SetVar(req.Context(), selectionFallbackVarKey, true)
+	}
+	return f.Selector.Select(pool, req, w)
+}
+
+// observeSelection records one load balancing selection outcome: which
+// policy ran, which upstream it picked ("none" when it came up empty),
+// whether the policy's fallback fired, and how long the selection took.
+func observeSelection(policy string, upstream *Upstream, r *http.Request, duration time.Duration) {
+	if reverseProxyMetrics.selectionTotal == nil {
+		return
+	}
+	selected := "none"
+	if upstream != nil {
+		selected = upstream.Dial
+	}
+	fallbackUsed, _ := caddyhttp.GetVar(r.Context(), selectionFallbackVarKey).(bool)
+	reverseProxyMetrics.selectionTotal.With(prometheus.Labels{
+		"policy":   policy,
+		"upstream": selected,
+		"fallback": strconv.FormatBool(fallbackUsed),
+	}).Inc()
+	reverseProxyMetrics.selectionDuration.With(prometheus.Labels{"policy": policy}).Observe(duration.Seconds())
+}
+
+// observeSelectionOverflow records that a selection was re-routed to a
+// deterministic secondary because the key's primary owner was at its
+// capacity limit (e.g. max_requests).
+func observeSelectionOverflow(policy string, primary *Upstream) {
+	if reverseProxyMetrics.selectionOverflow == nil {
+		return
+	}
+	reverseProxyMetrics.selectionOverflow.With(prometheus.Labels{
+		"policy":   policy,
+		"upstream": primary.Dial,
+	}).Inc()
+}
+
+// shadowSelectionLabel renders an upstream for the shadow comparison
+// metric and log, standing in "none" for an empty pick.
+func shadowSelectionLabel(upstream *Upstream) string {
+	if upstream == nil {
+		return "none"
+	}
+	return upstream.Dial
+}
+
+// observeShadowSelection records whether the shadow selection policy
+// agreed with the primary's pick for one request.
+func observeShadowSelection(primary, shadow *Upstream) {
+	if reverseProxyMetrics.shadowAgree == nil {
+		return
+	}
+	if primary == shadow {
+		reverseProxyMetrics.shadowAgree.Inc()
+		return
+	}
+	reverseProxyMetrics.shadowDisagree.With(prometheus.Labels{
+		"primary_upstream": shadowSelectionLabel(primary),
+		"shadow_upstream":  shadowSelectionLabel(shadow),
+	}).Inc()
+}
+
+// observeTopologyResync records one automatic topology re-sync fired
+// by a policy's consistency circuit breaker.
+func observeTopologyResync(policy string) {
+	if reverseProxyMetrics.topologyResync == nil {
+		return
+	}
+	reverseProxyMetrics.topologyResync.With(prometheus.Labels{"policy": policy}).Inc()
+}
+
+// observeKeyShares replaces the key share gauge series for one policy
+// with a fresh estimate. Series for upstreams no longer in the topology
+// are dropped rather than left at their last value.
+func observeKeyShares(policy string, shares map[*Upstream]float64) {
+	if reverseProxyMetrics.keyShare == nil {
+		return
+	}
+	reverseProxyMetrics.keyShare.DeletePartialMatch(prometheus.Labels{"policy": policy})
+	for upstream, share := range shares {
+		reverseProxyMetrics.keyShare.With(prometheus.Labels{
+			"policy":   policy,
+			"upstream": upstream.Dial,
+		}).Set(share)
+	}
+}
+
 type metricsUpstreamsHealthyUpdater struct {
 	handler *Handler
 }
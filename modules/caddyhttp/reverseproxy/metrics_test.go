@@ -0,0 +1,308 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestSelectionMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	initReverseProxyMetrics(&Handler{logger: zap.NewNop()}, registry)
+
+	// use a label no other test emits so global counters don't interfere
+	const policy = "metrics_test_policy"
+
+	pool := testPool()
+	newReq := func() *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		return req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+	}
+
+	// two direct selections of the same upstream
+	for i := 0; i < 2; i++ {
+		observeSelection(policy, pool[0], newReq(), time.Millisecond)
+	}
+
+	// one selection that went through the fallback
+	req := newReq()
+	fallback := markFallback(FirstSelection{})
+	upstream := fallback.Select(pool, req, nil)
+	if upstream != pool[0] {
+		t.Fatalf("Expected the fallback to pick the first host, got %v", upstream)
+	}
+	observeSelection(policy, upstream, req, time.Millisecond)
+
+	// and one that came up empty
+	observeSelection(policy, nil, newReq(), time.Millisecond)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	familyByName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		familyByName[family.GetName()] = family
+	}
+
+	totals := familyByName["caddy_reverse_proxy_selection_total"]
+	if totals == nil {
+		t.Fatal("Expected the selection_total counter to be registered")
+	}
+	counts := make(map[string]float64)
+	for _, metric := range totals.GetMetric() {
+		labels := make(map[string]string)
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["policy"] != policy {
+			continue
+		}
+		counts[labels["upstream"]+"/"+labels["fallback"]] = metric.GetCounter().GetValue()
+	}
+	if got := counts[pool[0].Dial+"/false"]; got != 2 {
+		t.Errorf("Expected 2 direct selections of %s, got %v", pool[0].Dial, got)
+	}
+	if got := counts[pool[0].Dial+"/true"]; got != 1 {
+		t.Errorf("Expected 1 fallback selection of %s, got %v", pool[0].Dial, got)
+	}
+	if got := counts["none/false"]; got != 1 {
+		t.Errorf("Expected 1 empty selection, got %v", got)
+	}
+
+	durations := familyByName["caddy_reverse_proxy_selection_duration_seconds"]
+	if durations == nil {
+		t.Fatal("Expected the selection_duration histogram to be registered")
+	}
+	var sampleCount uint64
+	for _, metric := range durations.GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "policy" && label.GetValue() == policy {
+				sampleCount = metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if sampleCount != 4 {
+		t.Errorf("Expected 4 duration observations, got %d", sampleCount)
+	}
+}
+
+func TestFallbackMarkerOnlyMarksWhenItFires(t *testing.T) {
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+
+	if used, _ := caddyhttp.GetVar(req.Context(), selectionFallbackVarKey).(bool); used {
+		t.Fatal("Expected no fallback mark before any selection")
+	}
+	markFallback(FirstSelection{}).Select(pool, req, nil)
+	if used, _ := caddyhttp.GetVar(req.Context(), selectionFallbackVarKey).(bool); !used {
+		t.Error("Expected the fallback mark to be set after the fallback ran")
+	}
+}
+
+// shadowCounts sums the current shadow agreement counters from the
+// registry: the plain agree total and the disagree total across all
+// label pairs.
+func shadowCounts(t *testing.T, registry *prometheus.Registry) (agree, disagree float64) {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	for _, family := range families {
+		switch family.GetName() {
+		case "caddy_reverse_proxy_selection_shadow_agree_total":
+			for _, metric := range family.GetMetric() {
+				agree += metric.GetCounter().GetValue()
+			}
+		case "caddy_reverse_proxy_selection_shadow_disagree_total":
+			for _, metric := range family.GetMetric() {
+				disagree += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return agree, disagree
+}
+
+func TestShadowSelectionMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	initReverseProxyMetrics(&Handler{logger: zap.NewNop()}, registry)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := createMementoPool(4)
+
+	shadow := &MementoSelection{Field: "ip"}
+	if err := shadow.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	shadow.PopulateInitialTopology(pool)
+
+	handler := &Handler{
+		logger:            zap.NewNop(),
+		selectionPolicyID: "ip_hash",
+		shadowPolicyID:    "memento",
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicy:  IPHashSelection{},
+			ShadowPolicy:     shadow,
+			ShadowSampleRate: 1,
+		},
+	}
+
+	// the counters are process-global, so compare against a snapshot
+	agreeBefore, disagreeBefore := shadowCounts(t, registry)
+
+	// replay a fixed set of client addresses through both policies
+	// offline to know how often they should disagree
+	const numClients = 64
+	expectedDisagree := 0
+	for i := 0; i < numClients; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:80", i/8, i%8)
+
+		primary := handler.LoadBalancing.SelectionPolicy.Select(pool, req, nil)
+		if primary == nil {
+			t.Fatalf("Expected the primary policy to select a host for %s", req.RemoteAddr)
+		}
+		if shadowPick := shadow.Select(pool, req, nil); shadowPick != primary {
+			expectedDisagree++
+		}
+
+		handler.runShadowSelection(pool, req, primary)
+	}
+
+	agreeAfter, disagreeAfter := shadowCounts(t, registry)
+	if got := disagreeAfter - disagreeBefore; got != float64(expectedDisagree) {
+		t.Errorf("Expected %d disagreements, counter moved by %v", expectedDisagree, got)
+	}
+	if got := agreeAfter - agreeBefore; got != float64(numClients-expectedDisagree) {
+		t.Errorf("Expected %d agreements, counter moved by %v", numClients-expectedDisagree, got)
+	}
+}
+
+func TestShadowSelectionAgreementRecorded(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	initReverseProxyMetrics(&Handler{logger: zap.NewNop()}, registry)
+
+	pool := testPool()
+	handler := &Handler{
+		logger: zap.NewNop(),
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicy:  FirstSelection{},
+			ShadowPolicy:     FirstSelection{},
+			ShadowSampleRate: 1,
+		},
+	}
+
+	agreeBefore, _ := shadowCounts(t, registry)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:80"
+	handler.runShadowSelection(pool, req, FirstSelection{}.Select(pool, req, nil))
+	agreeAfter, _ := shadowCounts(t, registry)
+	if agreeAfter-agreeBefore != 1 {
+		t.Errorf("Expected exactly one agreement to be recorded, counter moved by %v", agreeAfter-agreeBefore)
+	}
+}
+
+// keyShareSeries reads the key share gauge series for one policy label,
+// keyed by upstream address.
+func keyShareSeries(t *testing.T, registry *prometheus.Registry, policy string) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather error: %v", err)
+	}
+	shares := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "caddy_reverse_proxy_key_share_estimate" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var metricPolicy, upstream string
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "policy":
+					metricPolicy = label.GetValue()
+				case "upstream":
+					upstream = label.GetValue()
+				}
+			}
+			if metricPolicy == policy {
+				shares[upstream] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return shares
+}
+
+// TestKeyShareGaugeUpdatesOnTopologyChange verifies that the key share
+// gauge is published when the topology is populated and re-published
+// when a health event changes it, dropping the dead upstream's series.
+func TestKeyShareGaugeUpdatesOnTopologyChange(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	initReverseProxyMetrics(&Handler{logger: zap.NewNop()}, registry)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	eventsApp := &caddyevents.App{}
+	if err := eventsApp.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision events app: %v", err)
+	}
+
+	policy := MementoSelection{Field: "ip"}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.SetEventsApp(eventsApp)
+	if err := eventsApp.Start(); err != nil {
+		t.Fatalf("Failed to start events app: %v", err)
+	}
+
+	pool := createMementoPool(3)
+	policy.PopulateInitialTopology(pool)
+
+	shares := keyShareSeries(t, registry, "memento")
+	if len(shares) != len(pool) {
+		t.Fatalf("Expected %d gauge series after initial topology, got %d", len(pool), len(shares))
+	}
+	total := 0.0
+	for _, share := range shares {
+		total += share
+	}
+	if total < 0.99 || total > 1.01 {
+		t.Errorf("Expected shares to sum to ~1.0, got %.4f", total)
+	}
+
+	// an unhealthy event shrinks the topology; the gauge must follow
+	// without waiting for a request or a scrape
+	pool[0].setHealthy(false)
+	eventsApp.Emit(ctx, "unhealthy", map[string]any{"host": pool[0].Dial})
+
+	shares = keyShareSeries(t, registry, "memento")
+	if _, ok := shares[pool[0].Dial]; ok {
+		t.Errorf("Expected the series for %s to be dropped after the unhealthy event", pool[0].Dial)
+	}
+	if len(shares) != len(pool)-1 {
+		t.Fatalf("Expected %d gauge series after the unhealthy event, got %d", len(pool)-1, len(shares))
+	}
+	total = 0.0
+	for _, share := range shares {
+		total += share
+	}
+	if total < 0.99 || total > 1.01 {
+		t.Errorf("Expected remaining shares to sum to ~1.0, got %.4f", total)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	weakrand "math/rand"
 	"net"
 	"net/http"
 	"net/http/httptrace"
@@ -34,6 +35,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/net/http/httpguts"
@@ -206,6 +208,21 @@ type Handler struct {
 	connectionsCloseTimer *time.Timer
 	connectionsMu         *sync.Mutex
 
+	// Tracks the upstream set last fed into a topology-aware selection
+	// policy from a dynamic upstream source, keyed by upstream identity
+	dynamicTopology   map[string]*Upstream
+	dynamicTopologyMu *sync.Mutex
+
+	// The module ID of the selection policy, for selection metrics labels
+	selectionPolicyID string
+
+	// The module ID of the shadow selection policy, for disagreement logs
+	shadowPolicyID string
+
+	// Identifies this handler instance in the health events it emits,
+	// so selection policies can ignore events from other handlers
+	handlerID string
+
 	ctx    caddy.Context
 	logger *zap.Logger
 	events *caddyevents.App
@@ -228,8 +245,10 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	h.events = eventAppIface.(*caddyevents.App)
 	h.ctx = ctx
 	h.logger = ctx.Logger()
+	h.handlerID = uuid.NewString()
 	h.connections = make(map[io.ReadWriteCloser]openConnection)
 	h.connectionsMu = new(sync.Mutex)
+	h.dynamicTopologyMu = new(sync.Mutex)
 
 	// warn about unsafe buffering config
 	if h.RequestBuffers == -1 || h.ResponseBuffers == -1 {
@@ -263,12 +282,97 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 			return fmt.Errorf("loading load balancing selection policy: %s", err)
 		}
 		h.LoadBalancing.SelectionPolicy = mod.(Selector)
-		
-		// Set up event integration for MementoSelection if applicable
-		if mementoSel, ok := h.LoadBalancing.SelectionPolicy.(*MementoSelection); ok {
-			mementoSel.SetEventsApp(h.events)
-			// Populate initial topology with configured upstreams
-			mementoSel.PopulateInitialTopology(h.Upstreams)
+
+		// Let policies whose configuration depends on the pool size
+		// (e.g. a per-upstream weights list) check it now; dynamic
+		// upstreams leave the static pool empty, so there is nothing
+		// to check against in that case
+		if sel, ok := h.LoadBalancing.SelectionPolicy.(poolSizeValidator); ok && len(h.Upstreams) > 0 {
+			if err := sel.validatePoolSize(len(h.Upstreams)); err != nil {
+				return fmt.Errorf("load balancing selection policy: %v", err)
+			}
+		}
+
+		// Wire up policies that subscribe to events or keep their own
+		// upstream topology (the memento policies, composites that
+		// wrap them, or third-party consistent policies): events
+		// first, then the initial topology, so no topology change is
+		// missed while seeding. The handler's identity goes in before
+		// the subscription starts so the policy can scope health
+		// events to this handler from the first event on
+		if sel, ok := h.LoadBalancing.SelectionPolicy.(handlerIdentityAware); ok {
+			sel.setHandlerIdentity(h.handlerID)
+		}
+		if sel, ok := h.LoadBalancing.SelectionPolicy.(EventsAware); ok {
+			sel.SetEventsApp(h.events)
+		}
+		// policies that index upstreams by their dial identity cannot
+		// tell two identically-stringifying upstreams apart; reject
+		// (or disambiguate) collisions before seeding the topology
+		if sel, ok := h.LoadBalancing.SelectionPolicy.(duplicateDialResolver); ok {
+			if err := sel.resolveDuplicateDials(h.Upstreams); err != nil {
+				return err
+			}
+		}
+		// a placeholder in a static upstream address resolves per
+		// request, but a topology-keeping policy would only ever see
+		// the first resolution; refuse the combination outright
+		if _, ok := h.LoadBalancing.SelectionPolicy.(TopologyAware); ok {
+			if err := rejectPlaceholderDials(h.Upstreams); err != nil {
+				return fmt.Errorf("load balancing selection policy: %v", err)
+			}
+		}
+		if sel, ok := h.LoadBalancing.SelectionPolicy.(TopologyInitializer); ok {
+			sel.PopulateInitialTopology(h.Upstreams)
+		}
+
+		// Make the policy available to the admin preview endpoint
+		if module, ok := h.LoadBalancing.SelectionPolicy.(caddy.Module); ok {
+			registerSelectionPreview(module.CaddyModule().ID.Name(), h.LoadBalancing.SelectionPolicy, h.Upstreams)
+		}
+	}
+	if h.LoadBalancing != nil && h.LoadBalancing.ShadowPolicyRaw != nil {
+		mod, err := ctx.LoadModule(h.LoadBalancing, "ShadowPolicyRaw")
+		if err != nil {
+			return fmt.Errorf("loading shadow selection policy: %s", err)
+		}
+		h.LoadBalancing.ShadowPolicy = mod.(Selector)
+		if module, ok := h.LoadBalancing.ShadowPolicy.(caddy.Module); ok {
+			h.shadowPolicyID = module.CaddyModule().ID.Name()
+		}
+		if rate := h.LoadBalancing.ShadowSampleRate; rate < 0 || rate > 1 {
+			return fmt.Errorf("shadow_sample_rate must be between 0 and 1, got %f", rate)
+		}
+		if h.LoadBalancing.ShadowSampleRate == 0 {
+			h.LoadBalancing.ShadowSampleRate = 1
+		}
+
+		// the shadow policy gets the same wiring as the primary so a
+		// topology-driven candidate (e.g. memento) tracks health the
+		// same way it would once promoted
+		if sel, ok := h.LoadBalancing.ShadowPolicy.(handlerIdentityAware); ok {
+			sel.setHandlerIdentity(h.handlerID)
+		}
+		if sel, ok := h.LoadBalancing.ShadowPolicy.(EventsAware); ok {
+			sel.SetEventsApp(h.events)
+		}
+		if sel, ok := h.LoadBalancing.ShadowPolicy.(duplicateDialResolver); ok {
+			if err := sel.resolveDuplicateDials(h.Upstreams); err != nil {
+				return err
+			}
+		}
+		if _, ok := h.LoadBalancing.ShadowPolicy.(TopologyAware); ok {
+			if err := rejectPlaceholderDials(h.Upstreams); err != nil {
+				return fmt.Errorf("shadow selection policy: %v", err)
+			}
+		}
+		if sel, ok := h.LoadBalancing.ShadowPolicy.(TopologyInitializer); ok {
+			sel.PopulateInitialTopology(h.Upstreams)
+		}
+	}
+	if h.LoadBalancing != nil && h.LoadBalancing.UpstreamBackoff != nil {
+		if err := h.LoadBalancing.UpstreamBackoff.provision(); err != nil {
+			return err
 		}
 	}
 	if h.CBRaw != nil {
@@ -338,6 +442,10 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	if h.LoadBalancing.SelectionPolicy == nil {
 		h.LoadBalancing.SelectionPolicy = RandomSelection{}
 	}
+	// remember the policy's module ID for selection metrics labels
+	if module, ok := h.LoadBalancing.SelectionPolicy.(caddy.Module); ok {
+		h.selectionPolicyID = module.CaddyModule().ID.Name()
+	}
 	if h.LoadBalancing.TryDuration > 0 && h.LoadBalancing.TryInterval == 0 {
 		// a non-zero try_duration with a zero try_interval
 		// will always spin the CPU for try_duration if the
@@ -345,6 +453,9 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		// defaulting to a sane wait period between attempts
 		h.LoadBalancing.TryInterval = caddy.Duration(250 * time.Millisecond)
 	}
+	if err := h.LoadBalancing.validateRetryAffinity(h.selectionPolicyID, h.logger); err != nil {
+		return err
+	}
 	lbMatcherSets, err := ctx.LoadModule(h.LoadBalancing, "RetryMatchRaw")
 	if err != nil {
 		return err
@@ -354,8 +465,16 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 		return err
 	}
 
-	// set up upstreams
+	// set up upstreams; hash keys, when configured, are the stable
+	// identity of an upstream for hashing policies and must be unique
+	hashKeys := make(map[string]string)
 	for _, u := range h.Upstreams {
+		if u.HashKey != "" {
+			if other, dup := hashKeys[u.HashKey]; dup {
+				return fmt.Errorf("upstreams %s and %s share hash_key '%s': hash keys must be unique", other, u.Dial, u.HashKey)
+			}
+			hashKeys[u.HashKey] = u.Dial
+		}
 		h.provisionUpstream(u)
 	}
 
@@ -404,6 +523,13 @@ func (h *Handler) Cleanup() error {
 		_, _ = hosts.Delete(upstream.String())
 	}
 
+	// remove our selection policy from the admin preview registry
+	if h.LoadBalancing != nil && h.LoadBalancing.SelectionPolicy != nil {
+		if module, ok := h.LoadBalancing.SelectionPolicy.(caddy.Module); ok {
+			unregisterSelectionPreview(module.CaddyModule().ID.Name(), h.LoadBalancing.SelectionPolicy)
+		}
+	}
+
 	return err
 }
 
@@ -454,6 +580,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 	// from previous tries because of the nuances of load balancing & retries
 	var proxyErr error
 	var retries int
+	tried := make(map[*Upstream]struct{}, 1)
 	for {
 		// if the request body was buffered (and only the entire body, hence no body
 		// set to read from after the buffer), make reading from the body idempotent
@@ -465,7 +592,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		}
 
 		var done bool
-		done, proxyErr = h.proxyLoopIteration(clonedReq, r, w, proxyErr, start, retries, repl, reqHeader, reqHost, next)
+		done, proxyErr = h.proxyLoopIteration(clonedReq, r, w, proxyErr, start, retries, tried, repl, reqHeader, reqHost, next)
 		if done {
 			break
 		}
@@ -496,7 +623,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 // It returns true when the loop is done and should break; false otherwise. The error value returned should
 // be assigned to the proxyErr value for the next iteration of the loop (or the error handled after break).
 func (h *Handler) proxyLoopIteration(r *http.Request, origReq *http.Request, w http.ResponseWriter, proxyErr error, start time.Time, retries int,
-	repl *caddy.Replacer, reqHeader http.Header, reqHost string, next caddyhttp.Handler,
+	tried map[*Upstream]struct{}, repl *caddy.Replacer, reqHeader http.Header, reqHost string, next caddyhttp.Handler,
 ) (bool, error) {
 	// get the updated list of upstreams
 	upstreams := h.Upstreams
@@ -514,6 +641,11 @@ func (h *Handler) proxyLoopIteration(r *http.Request, origReq *http.Request, w h
 			if c := h.logger.Check(zapcore.DebugLevel, "provisioned dynamic upstreams"); c != nil {
 				c.Write(zap.Int("count", len(dUpstreams)))
 			}
+			// keep topology-tracking selection policies (consistent
+			// hashing) in step with the freshly discovered set
+			if aware, ok := h.LoadBalancing.SelectionPolicy.(TopologyAware); ok {
+				h.syncDynamicTopology(aware, dUpstreams)
+			}
 			defer func() {
 				// these upstreams are dynamic, so they are only used for this iteration
 				// of the proxy loop; be sure to let them go away when we're done with them
@@ -524,8 +656,39 @@ func (h *Handler) proxyLoopIteration(r *http.Request, origReq *http.Request, w h
 		}
 	}
 
-	// choose an available upstream
-	upstream := h.LoadBalancing.SelectionPolicy.Select(upstreams, r, w)
+	// choose an available upstream; on a retry, prefer one we have not
+	// already attempted for this request, so hashing policies don't
+	// re-select the same failing host until passive health kicks in
+	if h.LoadBalancing.SelectionMetrics {
+		// clear any fallback mark left by a previous iteration
+		caddyhttp.SetVar(r.Context(), selectionFallbackVarKey, false)
+	}
+	// reset the fallback cause likewise, so each iteration reports its
+	// own selection outcome
+	caddyhttp.SetVar(r.Context(), selectionCauseVarKey, selectionFallbackNone)
+	selectionStart := time.Now()
+	var upstream *Upstream
+	if len(tried) > 0 {
+		if excluder, ok := h.LoadBalancing.SelectionPolicy.(retryAwareSelector); ok {
+			upstream = excluder.SelectExcluding(upstreams, r, w, tried)
+		}
+	}
+	if upstream == nil {
+		upstream = h.LoadBalancing.SelectionPolicy.Select(upstreams, r, w)
+	}
+	// record the selection timing and policy regardless of outcome, so
+	// log formats can reference them even for failed selections; the
+	// fallback cause var was filled in by the policy itself, if any
+	caddyhttp.SetVar(r.Context(), selectionDurationVarKey, time.Since(selectionStart).Microseconds())
+	caddyhttp.SetVar(r.Context(), selectionPolicyVarKey, h.selectionPolicyID)
+	if h.LoadBalancing.SelectionMetrics {
+		observeSelection(h.selectionPolicyID, upstream, r, time.Since(selectionStart))
+	}
+	if len(tried) == 0 {
+		// only the first attempt shadows, so the counters stay
+		// one-per-request even when retries re-select
+		h.runShadowSelection(upstreams, r, upstream)
+	}
 	if upstream == nil {
 		if proxyErr == nil {
 			proxyErr = caddyhttp.Error(http.StatusServiceUnavailable, errNoUpstream)
@@ -535,6 +698,7 @@ func (h *Handler) proxyLoopIteration(r *http.Request, origReq *http.Request, w h
 		}
 		return false, proxyErr
 	}
+	tried[upstream] = struct{}{}
 
 	// the dial address may vary per-request if placeholders are
 	// used, so perform those replacements here; the resulting
@@ -565,6 +729,17 @@ func (h *Handler) proxyLoopIteration(r *http.Request, origReq *http.Request, w h
 	repl.Set("http.reverse_proxy.upstream.max_requests", upstream.MaxRequests)
 	repl.Set("http.reverse_proxy.upstream.fails", upstream.Host.Fails())
 
+	// record how this upstream was chosen, before the roundtrip, so
+	// header_up directives and log formats can reference the selection
+	// as {http.vars.reverse_proxy.selection.*} placeholders
+	caddyhttp.SetVar(r.Context(), selectionPolicyVarKey, h.selectionPolicyID)
+	caddyhttp.SetVar(r.Context(), selectionUpstreamVarKey, upstream.String())
+	if keyer, ok := h.LoadBalancing.SelectionPolicy.(affinityKeyer); ok {
+		if key, ok := keyer.requestKey(r); ok {
+			caddyhttp.SetVar(r.Context(), selectionKeyVarKey, key)
+		}
+	}
+
 	// mutate request headers according to this upstream;
 	// because we're in a retry loop, we have to copy
 	// headers (and the r.Host value) from the original
@@ -595,6 +770,16 @@ func (h *Handler) proxyLoopIteration(r *http.Request, origReq *http.Request, w h
 	// remember this failure (if enabled)
 	h.countFailure(upstream)
 
+	// under strict retry_affinity, this request's upstream is fixed by
+	// the affinity policy; surface the error rather than moving the
+	// request to a different upstream
+	if h.LoadBalancing.strictAffinityAbort() {
+		if c := h.logger.Check(zapcore.DebugLevel, "not retrying; retry_affinity is strict"); c != nil {
+			c.Write(zap.Error(proxyErr))
+		}
+		return true, proxyErr
+	}
+
 	// if we've tried long enough, break
 	if !h.LoadBalancing.tryAgain(h.ctx, start, retries, proxyErr, r, h.logger) {
 		return true, proxyErr
@@ -925,6 +1110,11 @@ func (h *Handler) reverseProxy(rw http.ResponseWriter, req *http.Request, origRe
 		di.Upstream.cb.RecordMetric(res.StatusCode, duration)
 	}
 
+	// honor rate-limit responses (if enabled)
+	if h.LoadBalancing != nil && h.LoadBalancing.UpstreamBackoff != nil {
+		h.LoadBalancing.UpstreamBackoff.observe(di.Upstream, res)
+	}
+
 	// perform passive health checks (if enabled)
 	if h.HealthChecks != nil && h.HealthChecks.Passive != nil {
 		// strike if the status code matches one that is "bad"
@@ -1219,9 +1409,16 @@ func (h Handler) provisionUpstream(upstream *Upstream) {
 	// create or get the host representation for this upstream
 	upstream.fillHost()
 
+	// cache the canonical spelling of the dial address; String() and
+	// the health event matching paths read this on every request
+	upstream.canonicalDial = canonicalDialKey(upstream.Dial)
+
 	// give it the circuit breaker, if any
 	upstream.cb = h.CB
 
+	// let selection policies ramp up traffic to recovered hosts
+	upstream.slowStartWindow = time.Duration(h.LoadBalancing.SlowStart)
+
 	// if the passive health checker has a non-zero UnhealthyRequestCount
 	// but the upstream has no MaxRequests set (they are the same thing,
 	// but the passive health checker is a default value for upstreams
@@ -1243,6 +1440,54 @@ func (h Handler) provisionUpstream(upstream *Upstream) {
 	}
 }
 
+// syncDynamicTopology diffs a freshly discovered dynamic upstream set
+// against the set from the previous refresh and feeds the additions and
+// removals into the selection policy. Upstreams are compared by their
+// stable identity (hash key, or dial address) because dynamic sources
+// produce new Upstream values on every refresh; an upstream whose
+// identity survives a refresh stays in the policy's topology untouched,
+// which is what keeps consistent-hash key movement minimal.
+// rejectPlaceholderDials returns an error when any statically configured
+// upstream address contains a placeholder. Such addresses resolve per
+// request, but topology-keeping policies index upstreams by their dial
+// identity at provision time, so the topology would only ever reflect
+// the first resolution. Addresses that vary at runtime belong in
+// dynamic upstreams, which feed the topology through syncDynamicTopology
+// on every resolution instead.
+func rejectPlaceholderDials(upstreams []*Upstream) error {
+	for _, upstream := range upstreams {
+		if strings.Contains(upstream.Dial, "{") {
+			return fmt.Errorf("upstream address '%s' contains a placeholder, which a topology-tracking policy cannot follow; use dynamic upstreams instead", upstream.Dial)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) syncDynamicTopology(aware TopologyAware, upstreams []*Upstream) {
+	h.dynamicTopologyMu.Lock()
+	defer h.dynamicTopologyMu.Unlock()
+
+	if h.dynamicTopology == nil {
+		h.dynamicTopology = make(map[string]*Upstream)
+	}
+
+	current := make(map[string]struct{}, len(upstreams))
+	for _, upstream := range upstreams {
+		key := upstream.hashKey()
+		current[key] = struct{}{}
+		if _, known := h.dynamicTopology[key]; !known {
+			aware.AddUpstream(upstream)
+			h.dynamicTopology[key] = upstream
+		}
+	}
+	for key, upstream := range h.dynamicTopology {
+		if _, stillThere := current[key]; !stillThere {
+			aware.RemoveUpstream(upstream)
+			delete(h.dynamicTopology, key)
+		}
+	}
+}
+
 // bufferedBody reads originalBody into a buffer with maximum size of limit (-1 for unlimited),
 // then returns a reader for the buffer along with how many bytes were buffered. Always close
 // the return value when done with it, just like if it was the original body! If limit is 0
@@ -1439,15 +1684,185 @@ type LoadBalancing struct {
 	// host according to the load balancing policy.
 	RetryMatchRaw caddyhttp.RawMatcherSets `json:"retry_match,omitempty" caddy:"namespace=http.matchers"`
 
+	// How retries interact with affinity-based (hashing and sticky)
+	// selection policies. With "rehash" (the default), a retried
+	// attempt selects again and may land on a different upstream,
+	// which breaks the affinity the policy provides; single-writer
+	// backends may not tolerate that. With "strict", a request whose
+	// attempt failed is never moved to a different upstream: the
+	// original error is returned instead. Has no effect on policies
+	// that are not affinity-based.
+	RetryAffinity string `json:"retry_affinity,omitempty"`
+
+	// A second selection policy to run in shadow mode alongside the
+	// primary, for sizing a planned migration before the switch. The
+	// shadow result never routes a request: the handler only records
+	// whether the two policies agree, as the
+	// caddy_reverse_proxy_selection_shadow_agree_total and
+	// ..._disagree_total counters, and logs disagreements at debug
+	// level. The shadow policy never sees the response writer, so a
+	// cookie-writing candidate cannot mutate responses from shadow
+	// mode.
+	ShadowPolicyRaw json.RawMessage `json:"shadow_policy,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+
+	// The fraction of requests, between 0 and 1, on which the shadow
+	// policy runs. Defaults to 1 (every request); lower it to bound
+	// the shadow's selection cost on busy proxies.
+	ShadowSampleRate float64 `json:"shadow_sample_rate,omitempty"`
+
+	// Whether to record Prometheus metrics for selection outcomes: a
+	// counter of selections by policy, upstream, and fallback use, and
+	// a histogram of selection durations by policy. Disabled by
+	// default; when disabled, selections are not instrumented at all.
+	SelectionMetrics bool `json:"selection_metrics,omitempty"`
+
+	// How long to ramp a host's traffic share back up after it
+	// transitions to healthy. During this window, selection policies
+	// scale the host's effective weight linearly from 0 to 100%, so a
+	// recovering host with cold caches is not immediately hit with its
+	// full share and knocked over again. Disabled by default (zero
+	// duration): recovered hosts get their full share immediately.
+	SlowStart caddy.Duration `json:"slow_start,omitempty"`
+
+	// Honor rate-limit responses from upstreams: when a proxied
+	// response has one of the configured status codes, the host is
+	// skipped by selection until its Retry-After (or a default
+	// duration) elapses. Disabled by default.
+	UpstreamBackoff *UpstreamBackoff `json:"upstream_backoff,omitempty"`
+
 	SelectionPolicy Selector              `json:"-"`
+	ShadowPolicy    Selector              `json:"-"`
 	RetryMatch      caddyhttp.MatcherSets `json:"-"`
 }
 
+// The recognized retry_affinity modes.
+const (
+	retryAffinityRehash = "rehash"
+	retryAffinityStrict = "strict"
+)
+
+// validateRetryAffinity checks the retry_affinity value and, when an
+// affinity-based selection policy is combined with retries in rehash
+// mode, warns that retried attempts may land on a different upstream.
+func (lb *LoadBalancing) validateRetryAffinity(policyName string, logger *zap.Logger) error {
+	switch lb.RetryAffinity {
+	case "", retryAffinityRehash, retryAffinityStrict:
+	default:
+		return fmt.Errorf("unrecognized retry_affinity '%s': must be '%s' or '%s'",
+			lb.RetryAffinity, retryAffinityRehash, retryAffinityStrict)
+	}
+	if _, isAffinity := lb.SelectionPolicy.(affinitySelector); !isAffinity {
+		return nil
+	}
+	retriesEnabled := lb.TryDuration > 0 || lb.Retries > 0
+	if retriesEnabled && lb.RetryAffinity != retryAffinityStrict {
+		logger.Warn("retries with an affinity-based selection policy may move retried attempts to a different upstream, breaking session affinity; set retry_affinity to 'strict' to fail instead",
+			zap.String("policy", policyName))
+	}
+	return nil
+}
+
+// strictAffinityAbort reports whether a failed attempt must not be
+// retried because retry_affinity is strict and the selection policy is
+// affinity-based, so a retry could move the request to a different
+// upstream.
+func (lb LoadBalancing) strictAffinityAbort() bool {
+	if lb.RetryAffinity != retryAffinityStrict {
+		return false
+	}
+	_, isAffinity := lb.SelectionPolicy.(affinitySelector)
+	return isAffinity
+}
+
+// runShadowSelection runs the configured shadow selection policy on
+// the same pool and records whether it agrees with the primary's pick.
+// The shadow result never routes the request, and the shadow policy is
+// given a nil response writer so a cookie-writing candidate cannot
+// mutate the response. A sample rate below 1 skips the shadow entirely
+// for the complementary fraction of requests.
+func (h *Handler) runShadowSelection(upstreams UpstreamPool, r *http.Request, primary *Upstream) {
+	lb := h.LoadBalancing
+	if lb.ShadowPolicy == nil {
+		return
+	}
+	if lb.ShadowSampleRate < 1 && weakrand.Float64() >= lb.ShadowSampleRate { //nolint:gosec
+		return
+	}
+	shadow := lb.ShadowPolicy.Select(upstreams, r, nil)
+	observeShadowSelection(primary, shadow)
+	if primary != shadow {
+		if c := h.logger.Check(zapcore.DebugLevel, "shadow selection policy disagreed"); c != nil {
+			c.Write(
+				zap.String("primary_policy", h.selectionPolicyID),
+				zap.String("shadow_policy", h.shadowPolicyID),
+				zap.String("primary_upstream", shadowSelectionLabel(primary)),
+				zap.String("shadow_upstream", shadowSelectionLabel(shadow)),
+			)
+		}
+	}
+}
+
 // Selector selects an available upstream from the pool.
+//
+// The http.ResponseWriter may be nil: selection can be driven outside
+// the request path (e.g. by active health checking) and policies must
+// not write to it unconditionally. Implementations that set response
+// headers, such as the cookie policy, skip that step when it is nil.
+//
+// The pool may be empty or contain nil entries — composite policies
+// (chain, map, sticky wrappers) hand their children whatever slice
+// they were given. Select must not panic on such pools: nil entries
+// are skipped as if unavailable, and when no upstream can be selected
+// the result is nil, never an error or a panic.
 type Selector interface {
 	Select(UpstreamPool, *http.Request, http.ResponseWriter) *Upstream
 }
 
+// Previewer is an optional interface that hashing-based selection
+// policies can implement to explain which upstream a given key maps
+// to without an actual request. It powers the admin preview endpoint
+// at /reverse_proxy/selection/preview.
+type Previewer interface {
+	Preview(pool UpstreamPool, key string) SelectionExplanation
+}
+
+// KeySelector is an optional interface that hashing-based selection
+// policies can implement to resolve an already-extracted key against
+// the pool without an http.Request. Callers that have a key in hand
+// (health-check warm-up, retries, benchmarks) use it to pay only the
+// hashing cost instead of constructing a fake request; Select is then
+// just "extract key, call SelectByKey". A nil result means the policy
+// could not map the key to a usable upstream (for example, its
+// topology is empty), and the caller should fall back the way Select
+// would.
+type KeySelector interface {
+	SelectByKey(pool UpstreamPool, key string) *Upstream
+}
+
+// SelectionExplanation describes how a hashing-based selection policy
+// maps a key to an upstream.
+type SelectionExplanation struct {
+	// The name of the policy that produced this explanation.
+	Policy string `json:"policy"`
+
+	// The key that was hashed, exactly as given.
+	Key string `json:"key"`
+
+	// Whether a request replacer was applied to the key before
+	// hashing. Always false for previews, which hash the given
+	// key verbatim.
+	ReplacerApplied bool `json:"replacer_applied"`
+
+	// The winning combined hash, for HRW (rendezvous) policies.
+	Hash uint64 `json:"hash,omitempty"`
+
+	// The memento bucket index the key maps to (memento policies only).
+	Bucket *int `json:"bucket,omitempty"`
+
+	// The upstream the key maps to; empty if no upstream was selected.
+	Upstream string `json:"upstream,omitempty"`
+}
+
 // UpstreamSource gets the list of upstreams that can be used when
 // proxying a request. Returned upstreams will be load balanced and
 // health-checked. This should be a very fast function -- instant
@@ -0,0 +1,187 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// overrideRule pins the keys equal to one map key to a specific
+// upstream, regardless of what the hash says.
+type overrideRule struct {
+	// The dial address of the upstream the key must route to.
+	Upstream string `json:"upstream"`
+
+	// When the override stops applying. Zero means it never expires.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// overrideChooser is the manual override configuration shared by the
+// hashing and memento selection policies. Overrides are consulted with
+// the extracted hash key before any hashing, so support can pin
+// "tenant X goes to upstream B for the next hour" without touching the
+// hash function or the topology. The set is hot-updatable through the
+// admin API, so entries added or removed at runtime take effect without
+// a config reload.
+type overrideChooser struct {
+	// Manual routing overrides: hash key to the rule pinning it.
+	Overrides map[string]overrideRule `json:"overrides,omitempty"`
+
+	// The live override set; a pointer so policy values copied during
+	// selection share one set with the admin endpoint's updates.
+	overrides *sync.Map // map[string]overrideRule
+
+	overrideLogger *zap.Logger
+}
+
+// provisionOverrides validates the configured overrides and seeds the
+// live set from them.
+func (c *overrideChooser) provisionOverrides(ctx caddy.Context) error {
+	c.overrides = new(sync.Map)
+	c.overrideLogger = ctx.Logger()
+	for key, rule := range c.Overrides {
+		if rule.Upstream == "" {
+			return fmt.Errorf("override for key '%s' has no upstream", key)
+		}
+		c.overrides.Store(key, rule)
+	}
+	return nil
+}
+
+// overrideFor returns the pool member a live override pins the key to.
+// Expired entries are dropped on access. An override whose target is
+// not in the pool or not selectable under the policy's availability
+// mode falls through to normal selection, with a log line so support
+// can see the pin is not holding.
+func (c overrideChooser) overrideFor(key string, pool UpstreamPool, mode string) (*Upstream, bool) {
+	if c.overrides == nil {
+		return nil, false
+	}
+	val, ok := c.overrides.Load(key)
+	if !ok {
+		return nil, false
+	}
+	rule := val.(overrideRule)
+	if !rule.ExpiresAt.IsZero() && time.Now().After(rule.ExpiresAt) {
+		c.overrides.Delete(key)
+		return nil, false
+	}
+	for _, upstream := range pool {
+		if upstream == nil || upstream.Dial != rule.Upstream {
+			continue
+		}
+		if availableFor(upstream, mode) {
+			return upstream, true
+		}
+		if c.overrideLogger != nil {
+			c.overrideLogger.Warn("override target is unavailable; falling through to hashing",
+				zap.String("key", key),
+				zap.String("upstream", rule.Upstream))
+		}
+		return nil, false
+	}
+	if c.overrideLogger != nil {
+		c.overrideLogger.Warn("override target is not in the pool; falling through to hashing",
+			zap.String("key", key),
+			zap.String("upstream", rule.Upstream))
+	}
+	return nil, false
+}
+
+// overrideManager is implemented by selection policies whose manual
+// overrides can be listed and updated at runtime through the admin API.
+type overrideManager interface {
+	listOverrides() map[string]overrideRule
+	setOverride(key string, rule overrideRule) error
+	deleteOverride(key string) error
+}
+
+// listOverrides returns the live overrides, dropping expired entries.
+func (c *overrideChooser) listOverrides() map[string]overrideRule {
+	rules := make(map[string]overrideRule)
+	if c.overrides == nil {
+		return rules
+	}
+	now := time.Now()
+	c.overrides.Range(func(key, val any) bool {
+		rule := val.(overrideRule)
+		if !rule.ExpiresAt.IsZero() && now.After(rule.ExpiresAt) {
+			c.overrides.Delete(key)
+			return true
+		}
+		rules[key.(string)] = rule
+		return true
+	})
+	return rules
+}
+
+// setOverride installs or replaces the override for key.
+func (c *overrideChooser) setOverride(key string, rule overrideRule) error {
+	if c.overrides == nil {
+		return fmt.Errorf("the selection policy is not provisioned")
+	}
+	if key == "" {
+		return fmt.Errorf("override key cannot be empty")
+	}
+	if rule.Upstream == "" {
+		return fmt.Errorf("override for key '%s' has no upstream", key)
+	}
+	c.overrides.Store(key, rule)
+	return nil
+}
+
+// deleteOverride removes the override for key, if any.
+func (c *overrideChooser) deleteOverride(key string) error {
+	if c.overrides == nil {
+		return fmt.Errorf("the selection policy is not provisioned")
+	}
+	c.overrides.Delete(key)
+	return nil
+}
+
+// unmarshalOverrideOption parses the repeatable `override <key>
+// <upstream> [<duration>]` Caddyfile option shared by the hashing and
+// memento selection policies. It reports whether the current token was
+// it, so callers can fall through to their own unrecognized-option
+// error when it was not.
+func (c *overrideChooser) unmarshalOverrideOption(d *caddyfile.Dispenser) (bool, error) {
+	if d.Val() != "override" {
+		return false, nil
+	}
+	args := d.RemainingArgs()
+	if len(args) != 2 && len(args) != 3 {
+		return true, d.ArgErr()
+	}
+	rule := overrideRule{Upstream: args[1]}
+	if len(args) == 3 {
+		ttl, err := caddy.ParseDuration(args[2])
+		if err != nil {
+			return true, d.Errf("invalid override duration '%s': %v", args[2], err)
+		}
+		rule.ExpiresAt = time.Now().Add(ttl)
+	}
+	if c.Overrides == nil {
+		c.Overrides = make(map[string]overrideRule)
+	}
+	c.Overrides[args[0]] = rule
+	return true, nil
+}
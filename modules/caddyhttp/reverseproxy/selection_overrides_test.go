@@ -0,0 +1,257 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestOverrideRoutesKey(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	ipHash := IPHashSelection{}
+	ipHash.Overrides = map[string]overrideRule{
+		"172.0.0.1": {Upstream: "0.0.0.3"},
+	}
+	if err := ipHash.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+	for i := 0; i < 5; i++ {
+		if h := ipHash.Select(pool, req, nil); h != pool[2] {
+			t.Errorf("Expected the override to pin 172.0.0.1 to 0.0.0.3, got %v", h)
+		}
+	}
+
+	// other keys still hash normally
+	other, _ := http.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "172.0.0.2:80"
+	want := ipHash.SelectByKey(pool, "172.0.0.2")
+	if h := ipHash.Select(pool, other, nil); h != want {
+		t.Errorf("Expected unoverridden keys to keep hashing, got %v instead of %v", h, want)
+	}
+}
+
+func TestOverrideMementoPolicy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	mementoPolicy.Overrides = map[string]overrideRule{
+		"10.0.0.50": {Upstream: "localhost:8082"},
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.50:80"
+	h := mementoPolicy.Select(pool, req, nil)
+	if h == nil || h.Dial != "localhost:8082" {
+		t.Errorf("Expected the override to pin 10.0.0.50 to localhost:8082, got %v", h)
+	}
+}
+
+func TestOverrideExpiryRestoresHashing(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	ipHash := IPHashSelection{}
+	if err := ipHash.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	hashed := ipHash.SelectByKey(pool, "172.0.0.1")
+
+	// an already-expired override must not take effect, and must be
+	// dropped from the live set on first access
+	ipHash.overrides.Store("172.0.0.1", overrideRule{
+		Upstream:  "0.0.0.2",
+		ExpiresAt: time.Now().Add(-time.Second),
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+	if h := ipHash.Select(pool, req, nil); h != hashed {
+		t.Errorf("Expected an expired override to fall through to hashing, got %v instead of %v", h, hashed)
+	}
+	if _, still := ipHash.overrides.Load("172.0.0.1"); still {
+		t.Error("Expected the expired override to be dropped on access")
+	}
+}
+
+func TestOverrideUnavailableTargetFallsThrough(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	ipHash := IPHashSelection{}
+	ipHash.Overrides = map[string]overrideRule{
+		"172.0.0.1": {Upstream: "0.0.0.2"},
+	}
+	if err := ipHash.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+	if h := ipHash.Select(pool, req, nil); h != pool[1] {
+		t.Fatalf("Expected the override to hold while its target is healthy, got %v", h)
+	}
+
+	pool[1].setHealthy(false)
+	h := ipHash.Select(pool, req, nil)
+	if h == nil || h == pool[1] {
+		t.Errorf("Expected an unavailable override target to fall through to hashing, got %v", h)
+	}
+	pool[1].setHealthy(true)
+
+	// a target missing from the pool falls through the same way
+	ipHash.overrides.Store("172.0.0.1", overrideRule{Upstream: "0.0.0.99"})
+	if h := ipHash.Select(pool, req, nil); h == nil {
+		t.Error("Expected a missing override target to fall through to hashing")
+	}
+}
+
+func TestOverrideCaddyfileOption(t *testing.T) {
+	ipHash := IPHashSelection{}
+	err := ipHash.UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"ip_hash {\n\toverride 172.0.0.1 0.0.0.3\n\toverride 172.0.0.2 0.0.0.1 1h\n}"))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if len(ipHash.Overrides) != 2 {
+		t.Fatalf("Expected 2 overrides, got %d", len(ipHash.Overrides))
+	}
+	if ipHash.Overrides["172.0.0.1"].Upstream != "0.0.0.3" {
+		t.Errorf("Expected 172.0.0.1 pinned to 0.0.0.3, got %+v", ipHash.Overrides["172.0.0.1"])
+	}
+	if ipHash.Overrides["172.0.0.1"].ExpiresAt != (time.Time{}) {
+		t.Error("Expected an override without a duration to never expire")
+	}
+	timed := ipHash.Overrides["172.0.0.2"]
+	if timed.ExpiresAt.Before(time.Now().Add(59*time.Minute)) ||
+		timed.ExpiresAt.After(time.Now().Add(61*time.Minute)) {
+		t.Errorf("Expected the timed override to expire in about an hour, got %v", timed.ExpiresAt)
+	}
+
+	memento := MementoSelection{}
+	if err := memento.UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"memento uri {\n\toverride /reports 10.0.0.2:8080\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if memento.Overrides["/reports"].Upstream != "10.0.0.2:8080" {
+		t.Errorf("Expected /reports pinned to 10.0.0.2:8080, got %+v", memento.Overrides)
+	}
+
+	if err := (&IPHashSelection{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"ip_hash {\n\toverride 172.0.0.1\n}")); err == nil {
+		t.Error("Expected an error for override without an upstream")
+	}
+	if err := (&IPHashSelection{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"ip_hash {\n\toverride 172.0.0.1 0.0.0.3 soon\n}")); err == nil {
+		t.Error("Expected an error for an invalid override duration")
+	}
+}
+
+func TestSelectionOverridesEndpoint(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	registerSelectionPreview("memento", mementoPolicy, pool)
+	defer unregisterSelectionPreview("memento", mementoPolicy)
+
+	// install an override through the endpoint
+	body, _ := json.Marshal(overrideSetRequest{
+		Policy:   "memento",
+		Key:      "10.0.0.50",
+		Upstream: "localhost:8083",
+	})
+	req := httptest.NewRequest("POST", "/reverse_proxy/selection/overrides", bytes.NewReader(body))
+	if err := (adminUpstreams{}).handleSelectionOverrides(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("Installing an override failed: %v", err)
+	}
+
+	// it takes effect immediately, without a reload
+	selReq, _ := http.NewRequest("GET", "/", nil)
+	selReq.RemoteAddr = "10.0.0.50:80"
+	if h := mementoPolicy.Select(pool, selReq, nil); h == nil || h.Dial != "localhost:8083" {
+		t.Errorf("Expected the endpoint-installed override to route 10.0.0.50, got %v", h)
+	}
+
+	// and it shows up in the listing
+	req = httptest.NewRequest("GET", "/reverse_proxy/selection/overrides?policy=memento", nil)
+	w := httptest.NewRecorder()
+	if err := (adminUpstreams{}).handleSelectionOverrides(w, req); err != nil {
+		t.Fatalf("Listing overrides failed: %v", err)
+	}
+	var listed map[string]overrideRule
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+		t.Fatalf("Decoding override listing: %v", err)
+	}
+	if listed["10.0.0.50"].Upstream != "localhost:8083" {
+		t.Errorf("Expected the listing to show the override, got %+v", listed)
+	}
+
+	// deleting it restores hashing
+	req = httptest.NewRequest("DELETE", "/reverse_proxy/selection/overrides?policy=memento&key=10.0.0.50", nil)
+	if err := (adminUpstreams{}).handleSelectionOverrides(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("Deleting the override failed: %v", err)
+	}
+	expl := mementoPolicy.Preview(pool, "10.0.0.50")
+	if h := mementoPolicy.Select(pool, selReq, nil); h == nil || h.Dial != expl.Upstream {
+		t.Errorf("Expected hashing to resume after deletion, got %v instead of %s", h, expl.Upstream)
+	}
+
+	// a policy without override support is a 400
+	registerSelectionPreview("random", RandomSelection{}, pool)
+	defer unregisterSelectionPreview("random", RandomSelection{})
+	req = httptest.NewRequest("GET", "/reverse_proxy/selection/overrides?policy=random", nil)
+	if err := (adminUpstreams{}).handleSelectionOverrides(httptest.NewRecorder(), req); err == nil {
+		t.Error("Expected listing overrides of a non-hashing policy to fail")
+	} else if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Errorf("Expected a 400 APIError, got %v", err)
+	}
+
+	// an unknown policy id is a 404
+	req = httptest.NewRequest("GET", "/reverse_proxy/selection/overrides?policy=nope", nil)
+	if err := (adminUpstreams{}).handleSelectionOverrides(httptest.NewRecorder(), req); err == nil {
+		t.Error("Expected listing overrides of an unknown policy to fail")
+	} else if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusNotFound {
+		t.Errorf("Expected a 404 APIError, got %v", err)
+	}
+}
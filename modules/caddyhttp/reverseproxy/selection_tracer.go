@@ -0,0 +1,209 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+	weakrand "math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// defaultTraceBufferSize is how many trace records a policy retains
+// when no explicit buffer size is configured.
+const defaultTraceBufferSize = 256
+
+// selectionTracing is shared by the hashing selection policies to
+// optionally sample selection decisions into an in-memory ring buffer,
+// so affinity anomalies reported after the fact can be replayed
+// offline from a support bundle. It is embedded in each policy's
+// config so the options surface uniformly as `trace_sample_rate` and
+// `trace_buffer_size`; the buffer is exposed by the admin endpoint
+// GET /reverse_proxy/selection/trace?policy=<id>.
+type selectionTracing struct {
+	// The probability, between 0 and 1, that a selection decision is
+	// recorded in the trace buffer. 0 (the default) disables tracing
+	// entirely; the hot path then pays only a nil check.
+	TraceSampleRate float64 `json:"trace_sample_rate,omitempty"`
+
+	// How many trace records to retain. Once full, each new record
+	// evicts the oldest. Default is 256.
+	TraceBufferSize int `json:"trace_buffer_size,omitempty"`
+
+	tracer *selectionTracer
+}
+
+// selectionTraceEntry is one sampled selection decision. The key is
+// stored hashed, never verbatim, so trace buffers can be shipped in
+// support bundles without leaking client identifiers.
+type selectionTraceEntry struct {
+	// When the selection happened.
+	Timestamp time.Time `json:"timestamp"`
+
+	// The hash of the selection key, in hexadecimal. Matches the
+	// "hashed" verbose-log key mode, so trace lines and debug logs
+	// for the same key can be correlated.
+	KeyHash string `json:"key_hash"`
+
+	// The name of the policy that made the decision.
+	Policy string `json:"policy"`
+
+	// The chosen upstream, or "none" if selection failed.
+	Upstream string `json:"upstream"`
+
+	// The policy's topology version at the time of the decision.
+	// Every upstream addition or removal bumps the version, so a
+	// trace line can be matched to the topology that produced it.
+	TopologyVersion uint64 `json:"topology_version"`
+}
+
+// selectionTracer is the ring buffer behind a policy's trace config.
+type selectionTracer struct {
+	version uint64 // topology version; bumped on every add/remove (atomic)
+
+	mu   sync.Mutex
+	ring []selectionTraceEntry
+	next int  // next slot to overwrite
+	full bool // whether the ring has wrapped
+}
+
+// provisionSelectionTracing validates the sampling options and, when
+// tracing is enabled, allocates the ring buffer.
+func (st *selectionTracing) provisionSelectionTracing() error {
+	if st.TraceSampleRate < 0 || st.TraceSampleRate > 1 {
+		return fmt.Errorf("trace_sample_rate must be between 0 and 1, got %f", st.TraceSampleRate)
+	}
+	if st.TraceBufferSize < 0 {
+		return fmt.Errorf("trace_buffer_size must be positive, got %d", st.TraceBufferSize)
+	}
+	if st.TraceSampleRate == 0 {
+		return nil
+	}
+	size := st.TraceBufferSize
+	if size == 0 {
+		size = defaultTraceBufferSize
+	}
+	st.tracer = &selectionTracer{ring: make([]selectionTraceEntry, size)}
+	return nil
+}
+
+// traceSelection samples one selection decision at the configured
+// rate. With tracing disabled this is a single nil check.
+func (st selectionTracing) traceSelection(policy, key string, upstream *Upstream) {
+	if st.tracer == nil {
+		return
+	}
+	//nolint:gosec // sampling does not need cryptographic randomness
+	if weakrand.Float64() >= st.TraceSampleRate {
+		return
+	}
+	selected := "none"
+	if upstream != nil {
+		selected = upstream.String()
+	}
+	st.tracer.record(selectionTraceEntry{
+		Timestamp:       time.Now(),
+		KeyHash:         strconv.FormatUint(hash(key), 16),
+		Policy:          policy,
+		Upstream:        selected,
+		TopologyVersion: atomic.LoadUint64(&st.tracer.version),
+	})
+}
+
+// bumpTopologyVersion notes that an upstream joined or left the
+// policy's topology, so subsequent trace records can be correlated
+// with the new topology.
+func (st selectionTracing) bumpTopologyVersion() {
+	if st.tracer == nil {
+		return
+	}
+	atomic.AddUint64(&st.tracer.version, 1)
+}
+
+// selectionTraceReporter is implemented by selection policies with
+// trace sampling configured; the admin trace endpoint reads the
+// buffer through it.
+type selectionTraceReporter interface {
+	selectionTraceSnapshot() ([]selectionTraceEntry, bool)
+}
+
+// selectionTraceSnapshot returns the buffered trace records in
+// chronological order, and whether tracing is enabled at all.
+func (st selectionTracing) selectionTraceSnapshot() ([]selectionTraceEntry, bool) {
+	if st.tracer == nil {
+		return nil, false
+	}
+	return st.tracer.snapshot(), true
+}
+
+// unmarshalTraceOption parses the `trace_sample_rate` and
+// `trace_buffer_size` Caddyfile options shared by the hashing
+// policies. It reports whether the current token was one of them, so
+// callers can fall through to their own unrecognized-option error
+// when it was not.
+func (st *selectionTracing) unmarshalTraceOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "trace_sample_rate":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		rate, err := strconv.ParseFloat(d.Val(), 64)
+		if err != nil {
+			return true, d.Errf("invalid trace_sample_rate '%s': %v", d.Val(), err)
+		}
+		st.TraceSampleRate = rate
+	case "trace_buffer_size":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		size, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid trace_buffer_size '%s': %v", d.Val(), err)
+		}
+		st.TraceBufferSize = size
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// record appends one entry, evicting the oldest once the ring is full.
+func (tr *selectionTracer) record(entry selectionTraceEntry) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.ring[tr.next] = entry
+	tr.next++
+	if tr.next == len(tr.ring) {
+		tr.next = 0
+		tr.full = true
+	}
+}
+
+// snapshot copies the buffered entries, oldest first.
+func (tr *selectionTracer) snapshot() []selectionTraceEntry {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if !tr.full {
+		return append([]selectionTraceEntry{}, tr.ring[:tr.next]...)
+	}
+	out := make([]selectionTraceEntry, 0, len(tr.ring))
+	out = append(out, tr.ring[tr.next:]...)
+	out = append(out, tr.ring[:tr.next]...)
+	return out
+}
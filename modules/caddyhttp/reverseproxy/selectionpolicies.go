@@ -15,15 +15,25 @@
 package reverseproxy
 
 import (
+	"container/list"
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
 	weakrand "math/rand"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +42,7 @@ import (
 
 	"github.com/cespare/xxhash/v2"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -47,19 +58,39 @@ func init() {
 	caddy.RegisterModule(RoundRobinSelection{})
 	caddy.RegisterModule(WeightedRoundRobinSelection{})
 	caddy.RegisterModule(FirstSelection{})
+	caddy.RegisterModule(PrioritySelection{})
 	caddy.RegisterModule(IPHashSelection{})
 	caddy.RegisterModule(ClientIPHashSelection{})
 	caddy.RegisterModule(URIHashSelection{})
+	caddy.RegisterModule(RendezvousSelection{})
 	caddy.RegisterModule(QueryHashSelection{})
+	caddy.RegisterModule(JumpHashSelection{})
 	caddy.RegisterModule(HeaderHashSelection{})
 	caddy.RegisterModule(CookieHashSelection{})
+	caddy.RegisterModule(HeaderStickySelection{})
+	caddy.RegisterModule(StickyTableSelection{})
+	caddy.RegisterModule(ChainSelection{})
+	caddy.RegisterModule(MapSelection{})
 	caddy.RegisterModule(MementoSelection{})
 	caddy.RegisterModule(WeightedMementoSelection{})
+	caddy.RegisterModule(ConsistentLeastConnSelection{})
+	caddy.RegisterModule(TieredMementoSelection{})
+	caddy.RegisterModule(ZoneAwareSelection{})
+	caddy.RegisterModule(GroupSelection{})
 }
 
 // RandomSelection is a policy that selects
 // an available host at random.
-type RandomSelection struct{}
+type RandomSelection struct {
+	// Excludes the upstream each client last received from that
+	// client's next selection, so consecutive idempotent fan-out
+	// requests from the same client spread cache population across
+	// hosts instead of re-hitting the same one. The exclusion is
+	// skipped when at most one host is available.
+	AntiAffinity *AntiAffinity `json:"anti_affinity,omitempty"`
+
+	availabilityChooser
+}
 
 // CaddyModule returns the Caddy module information.
 func (RandomSelection) CaddyModule() caddy.ModuleInfo {
@@ -69,9 +100,23 @@ func (RandomSelection) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision sets up the module.
+func (r *RandomSelection) Provision(ctx caddy.Context) error {
+	if err := r.provisionAvailability(); err != nil {
+		return err
+	}
+	if r.AntiAffinity != nil {
+		return r.AntiAffinity.provision()
+	}
+	return nil
+}
+
 // Select returns an available host, if any.
 func (r RandomSelection) Select(pool UpstreamPool, request *http.Request, _ http.ResponseWriter) *Upstream {
-	return selectRandomHost(pool)
+	excluded, key := r.AntiAffinity.exclude(pool, request)
+	upstream := selectRandomHostExcluding(pool, excluded, r.Availability)
+	r.AntiAffinity.record(key, upstream)
+	return upstream
 }
 
 // UnmarshalCaddyfile sets up the module from Caddyfile tokens.
@@ -80,17 +125,265 @@ func (r *RandomSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if d.NextArg() {
 		return d.ArgErr()
 	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "anti_affinity":
+			antiAffinity, err := unmarshalAntiAffinity(d)
+			if err != nil {
+				return err
+			}
+			r.AntiAffinity = antiAffinity
+		default:
+			handled, err := r.unmarshalAvailabilityOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// AntiAffinity configures the random policies to exclude the upstream
+// a client last received from that client's next selection. The store
+// behind it is a bounded, concurrent-safe TTL LRU, so an abusive or
+// very wide client population cannot grow it without limit.
+type AntiAffinity struct {
+	// What identifies a client: "ip" (the default) or "header".
+	Key string `json:"key,omitempty"`
+
+	// The name of the header identifying a client, when the key is
+	// "header".
+	HeaderField string `json:"header_field,omitempty"`
+
+	// How long a recorded selection keeps excluding its host.
+	// Default is 30s.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// How many client keys the store tracks at most; the least
+	// recently used entries are evicted first. Default is 1024.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	tracker *antiAffinityTracker
+}
+
+// provision validates the configuration and sets up the tracker.
+func (a *AntiAffinity) provision() error {
+	switch a.Key {
+	case "":
+		a.Key = "ip"
+	case "ip":
+	case "header":
+		if a.HeaderField == "" {
+			return fmt.Errorf("header_field is required when the anti_affinity key is 'header'")
+		}
+	default:
+		return fmt.Errorf("unrecognized anti_affinity key '%s': must be 'ip' or 'header'", a.Key)
+	}
+	if a.TTL == 0 {
+		a.TTL = caddy.Duration(30 * time.Second)
+	}
+	if a.TTL < 0 {
+		return fmt.Errorf("anti_affinity ttl must be positive, got %v", time.Duration(a.TTL))
+	}
+	if a.MaxEntries == 0 {
+		a.MaxEntries = 1024
+	}
+	if a.MaxEntries < 0 {
+		return fmt.Errorf("anti_affinity max_entries must be positive, got %d", a.MaxEntries)
+	}
+	a.tracker = newAntiAffinityTracker(time.Duration(a.TTL), a.MaxEntries)
 	return nil
 }
 
+// clientKey extracts the client identity from the request, or "" when
+// the request carries none.
+func (a *AntiAffinity) clientKey(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	switch a.Key {
+	case "ip":
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		return clientIP
+	case "header":
+		return req.Header.Get(a.HeaderField)
+	}
+	return ""
+}
+
+// exclude returns the upstream to hold out of this request's selection
+// (nil for none) and the client key to record the outcome under. The
+// exclusion is skipped when the pool has at most one available host,
+// so a lone survivor still serves.
+func (a *AntiAffinity) exclude(pool UpstreamPool, req *http.Request) (*Upstream, string) {
+	if a == nil || a.tracker == nil {
+		return nil, ""
+	}
+	key := a.clientKey(req)
+	if key == "" {
+		return nil, ""
+	}
+	last := a.tracker.last(key)
+	if last == nil {
+		return nil, key
+	}
+	available := 0
+	for _, upstream := range pool {
+		if upstream != nil && upstream.Available() {
+			available++
+			if available > 1 {
+				return last, key
+			}
+		}
+	}
+	return nil, key
+}
+
+// record remembers the upstream selected for the client key.
+func (a *AntiAffinity) record(key string, upstream *Upstream) {
+	if a == nil || a.tracker == nil || key == "" || upstream == nil {
+		return
+	}
+	a.tracker.record(key, upstream)
+}
+
+// antiAffinityTracker remembers the upstream each client key last
+// received, in a bounded TTL LRU. Concurrent-safe.
+type antiAffinityTracker struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*antiAffinityEntry
+	// most recently used entries first; the element value is the
+	// client key (string) so eviction can delete from the map
+	order *list.List
+	elems map[string]*list.Element
+}
+
+// antiAffinityEntry is one recorded selection.
+type antiAffinityEntry struct {
+	upstream *Upstream
+	expires  time.Time
+}
+
+func newAntiAffinityTracker(ttl time.Duration, maxEntries int) *antiAffinityTracker {
+	return &antiAffinityTracker{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*antiAffinityEntry),
+		order:      list.New(),
+		elems:      make(map[string]*list.Element),
+	}
+}
+
+// last returns the upstream last recorded for the key, or nil when the
+// key is unknown or its entry expired.
+func (t *antiAffinityTracker) last(key string) *Upstream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		t.removeLocked(key)
+		return nil
+	}
+	return entry.upstream
+}
+
+// record stores the upstream for the key, evicting the least recently
+// used entries when the store is full.
+func (t *antiAffinityTracker) record(key string, upstream *Upstream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if entry, ok := t.entries[key]; ok {
+		entry.upstream = upstream
+		entry.expires = now.Add(t.ttl)
+		t.order.MoveToFront(t.elems[key])
+		return
+	}
+	for len(t.entries) >= t.maxEntries {
+		oldest := t.order.Back()
+		if oldest == nil {
+			break
+		}
+		t.removeLocked(oldest.Value.(string))
+	}
+	t.entries[key] = &antiAffinityEntry{upstream: upstream, expires: now.Add(t.ttl)}
+	t.elems[key] = t.order.PushFront(key)
+}
+
+// removeLocked drops the key; the caller holds the mutex.
+func (t *antiAffinityTracker) removeLocked(key string) {
+	if elem, ok := t.elems[key]; ok {
+		t.order.Remove(elem)
+		delete(t.elems, key)
+	}
+	delete(t.entries, key)
+}
+
+// unmarshalAntiAffinity parses the shared Caddyfile option:
+//
+//	anti_affinity <ip|header <name>> [<ttl>]
+func unmarshalAntiAffinity(d *caddyfile.Dispenser) (*AntiAffinity, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	antiAffinity := &AntiAffinity{Key: args[0]}
+	rest := args[1:]
+	if antiAffinity.Key == "header" {
+		if len(rest) == 0 {
+			return nil, d.Err("anti_affinity header requires a header name")
+		}
+		antiAffinity.HeaderField = rest[0]
+		rest = rest[1:]
+	}
+	if len(rest) > 1 {
+		return nil, d.ArgErr()
+	}
+	if len(rest) == 1 {
+		ttl, err := caddy.ParseDuration(rest[0])
+		if err != nil {
+			return nil, d.Errf("invalid anti_affinity ttl '%s': %v", rest[0], err)
+		}
+		antiAffinity.TTL = caddy.Duration(ttl)
+	}
+	return antiAffinity, nil
+}
+
 // WeightedRoundRobinSelection is a policy that selects
 // a host based on weighted round-robin ordering.
 type WeightedRoundRobinSelection struct {
 	// The weight of each upstream in order,
 	// corresponding with the list of upstreams configured.
-	Weights     []int `json:"weights,omitempty"`
-	index       uint32
-	totalWeight int
+	Weights []int `json:"weights,omitempty"`
+
+	// Placeholder expressions resolving to the weight of each upstream
+	// in order (e.g. "{env.BACKEND1_WEIGHT}"), as an alternative to
+	// static Weights, so weights can come from a dynamic source without
+	// a config reload. A placeholder that doesn't resolve to a positive
+	// integer keeps the previous weight and logs a warning.
+	WeightPlaceholders []string `json:"weight_placeholders,omitempty"`
+
+	// How often to re-evaluate WeightPlaceholders and apply changed
+	// weights. Zero (the default) resolves them once at provision time.
+	ReresolveInterval caddy.Duration `json:"reresolve_interval,omitempty"`
+
+	index           uint32
+	totalWeight     int
+	resolvedWeights atomic.Value // []int resolved from WeightPlaceholders
+	logger          *zap.Logger
+	warnOnce        sync.Once
 }
 
 // CaddyModule returns the Caddy module information.
@@ -112,66 +405,200 @@ func (r *WeightedRoundRobinSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser)
 		return d.ArgErr()
 	}
 
+	// weights are positional, so one placeholder among the arguments
+	// routes them all through placeholder resolution (literal numbers
+	// resolve to themselves)
+	placeholders := false
 	for _, weight := range args {
-		weightInt, err := strconv.Atoi(weight)
-		if err != nil {
-			return d.Errf("invalid weight value '%s': %v", weight, err)
+		if strings.Contains(weight, "{") {
+			placeholders = true
+			break
 		}
-		if weightInt < 0 {
-			return d.Errf("invalid weight value '%s': weight should be non-negative", weight)
+	}
+	if placeholders {
+		r.WeightPlaceholders = args
+	} else {
+		for _, weight := range args {
+			weightInt, err := strconv.Atoi(weight)
+			if err != nil {
+				return d.Errf("invalid weight value '%s': %v", weight, err)
+			}
+			if weightInt < 0 {
+				return d.Errf("invalid weight value '%s': weight should be non-negative", weight)
+			}
+			r.Weights = append(r.Weights, weightInt)
+		}
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "reresolve_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid reresolve_interval '%s': %v", d.Val(), err)
+			}
+			r.ReresolveInterval = caddy.Duration(interval)
+		default:
+			return d.Errf("unrecognized option '%s'", d.Val())
 		}
-		r.Weights = append(r.Weights, weightInt)
 	}
 	return nil
 }
 
 // Provision sets up r.
 func (r *WeightedRoundRobinSelection) Provision(ctx caddy.Context) error {
-	for _, weight := range r.Weights {
+	r.logger = ctx.Logger(r)
+	if len(r.WeightPlaceholders) > 0 {
+		if len(r.Weights) > 0 {
+			return fmt.Errorf("weights and weight_placeholders are mutually exclusive")
+		}
+		r.resolvedWeights.Store(resolveWeightPlaceholders(caddy.NewReplacer(), r.WeightPlaceholders, nil, r.logger))
+		if r.ReresolveInterval > 0 {
+			go r.reresolveWeightsLoop(ctx)
+		}
+	}
+	for _, weight := range r.currentWeights() {
 		r.totalWeight += weight
 	}
 	return nil
 }
 
+// currentWeights returns the weights in effect: the latest resolved
+// placeholder values when configured, otherwise the static list.
+func (r *WeightedRoundRobinSelection) currentWeights() []int {
+	if weights, ok := r.resolvedWeights.Load().([]int); ok {
+		return weights
+	}
+	return r.Weights
+}
+
+// reresolveWeightsLoop re-evaluates the weight placeholders on the
+// configured interval until the policy's context is cancelled (config
+// unload). Select picks up each new list atomically.
+func (r *WeightedRoundRobinSelection) reresolveWeightsLoop(ctx caddy.Context) {
+	ticker := time.NewTicker(time.Duration(r.ReresolveInterval))
+	defer ticker.Stop()
+	repl := caddy.NewReplacer()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			previous, _ := r.resolvedWeights.Load().([]int)
+			r.resolvedWeights.Store(resolveWeightPlaceholders(repl, r.WeightPlaceholders, previous, r.logger))
+		}
+	}
+}
+
+// weightAt returns the configured weight for the upstream at pool
+// position i; positions beyond the configured list default to 1.
+func (r *WeightedRoundRobinSelection) weightAt(i int) int {
+	if weights := r.currentWeights(); i < len(weights) {
+		return weights[i]
+	}
+	return 1
+}
+
+// resolveWeightPlaceholders evaluates weight placeholder expressions
+// and returns the resulting weights. A placeholder that doesn't
+// resolve to a positive integer keeps the matching previous weight —
+// or 1 when there is none yet — and logs a warning, so a briefly
+// missing source never drops a node.
+func resolveWeightPlaceholders(repl *caddy.Replacer, placeholders []string, previous []int, logger *zap.Logger) []int {
+	weights := make([]int, len(placeholders))
+	for i, placeholder := range placeholders {
+		weights[i] = 1
+		if i < len(previous) {
+			weights[i] = previous[i]
+		}
+		val, err := repl.ReplaceOrErr(placeholder, true, true)
+		if err != nil {
+			if logger != nil {
+				logger.Warn("weight placeholder did not resolve; keeping previous weight",
+					zap.String("placeholder", placeholder),
+					zap.Int("weight", weights[i]),
+					zap.Error(err))
+			}
+			continue
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || weight <= 0 {
+			if logger != nil {
+				logger.Warn("weight placeholder resolved to an invalid weight; keeping previous weight",
+					zap.String("placeholder", placeholder),
+					zap.String("value", val),
+					zap.Int("weight", weights[i]))
+			}
+			continue
+		}
+		weights[i] = weight
+	}
+	return weights
+}
+
 // Select returns an available host, if any.
 func (r *WeightedRoundRobinSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
 	if len(pool) == 0 {
 		return nil
 	}
-	if len(r.Weights) < 2 {
+	configured := r.currentWeights()
+	if len(configured) < 2 && len(pool) < 2 {
 		return pool[0]
 	}
-	var index, totalWeight int
-	var weights []int
-
-	for _, w := range r.Weights {
-		if w > 0 {
-			weights = append(weights, w)
-		}
-	}
-	currentWeight := int(atomic.AddUint32(&r.index, 1)) % r.totalWeight
-	for i, weight := range weights {
-		totalWeight += weight
-		if currentWeight < totalWeight {
-			index = i
-			break
-		}
+	if len(configured) > 0 && len(configured) != len(pool) {
+		r.warnOnce.Do(func() {
+			if r.logger != nil {
+				r.logger.Warn("weight count does not match upstream count; missing weights default to 1 and extra weights are ignored",
+					zap.Int("weights", len(configured)),
+					zap.Int("upstreams", len(pool)))
+			}
+		})
 	}
 
-	upstreams := make([]*Upstream, 0, len(weights))
+	// collect the currently-available upstreams with their configured
+	// weights, aligned by pool position, and compute the weighted
+	// position over that subset: when part of the pool is down, the
+	// configured ratios then still hold among whoever is up, instead
+	// of the counter drifting across a cumulative table that no longer
+	// matches the candidates
+	upstreams := make([]*Upstream, 0, len(pool))
+	weights := make([]int, 0, len(pool))
+	var totalWeight int
+	var warming []*Upstream
 	for i, upstream := range pool {
-		if !upstream.Available() || r.Weights[i] == 0 {
+		weight := r.weightAt(i)
+		if upstream == nil || !upstream.Available() || weight == 0 {
 			continue
 		}
-		upstreams = append(upstreams, upstream)
-		if len(upstreams) == cap(upstreams) {
-			break
+		// hold back a fraction of a warming host's turns so its
+		// effective weight ramps up over the slow-start window
+		if upstream.slowStartHoldback() {
+			warming = append(warming, upstream)
+			continue
 		}
+		upstreams = append(upstreams, upstream)
+		weights = append(weights, weight)
+		totalWeight += weight
 	}
 	if len(upstreams) == 0 {
-		return nil
+		if len(warming) == 0 {
+			return nil
+		}
+		return warming[int(atomic.AddUint32(&r.index, 1))%len(warming)]
+	}
+
+	currentWeight := int(atomic.AddUint32(&r.index, 1)) % totalWeight
+	var cumulativeWeight int
+	for i, weight := range weights {
+		cumulativeWeight += weight
+		if currentWeight < cumulativeWeight {
+			return upstreams[i]
+		}
 	}
-	return upstreams[index%len(upstreams)]
+	return upstreams[0]
 }
 
 // RandomChoiceSelection is a policy that selects
@@ -181,6 +608,23 @@ type RandomChoiceSelection struct {
 	// The size of the sub-pool created from the larger upstream pool. The default value
 	// is 2 and the maximum at selection time is the size of the upstream pool.
 	Choose int `json:"choose,omitempty"`
+
+	// The weight of each upstream in order, corresponding with the
+	// list of upstreams configured. When set, candidates are sampled
+	// with probability proportional to their weight before the least
+	// loaded one is chosen. A missing weight defaults to 1 and a zero
+	// weight excludes the upstream.
+	Weights []int `json:"weights,omitempty"`
+
+	// Excludes the upstream each client last received from that
+	// client's next selection, so consecutive idempotent fan-out
+	// requests from the same client spread cache population across
+	// hosts instead of re-hitting the same one. The exclusion is
+	// skipped when at most one host is available.
+	AntiAffinity *AntiAffinity `json:"anti_affinity,omitempty"`
+
+	availabilityChooser
+	countWeightingChooser
 }
 
 // CaddyModule returns the Caddy module information.
@@ -204,14 +648,65 @@ func (r *RandomChoiceSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error
 		return d.Errf("invalid choice value '%s': %v", chooseStr, err)
 	}
 	r.Choose = choose
+
+	// any remaining arguments are per-upstream weights
+	for _, weight := range d.RemainingArgs() {
+		weightInt, err := strconv.Atoi(weight)
+		if err != nil {
+			return d.Errf("invalid weight value '%s': %v", weight, err)
+		}
+		if weightInt < 0 {
+			return d.Errf("invalid weight value '%s': weight should be non-negative", weight)
+		}
+		r.Weights = append(r.Weights, weightInt)
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "anti_affinity":
+			antiAffinity, err := unmarshalAntiAffinity(d)
+			if err != nil {
+				return err
+			}
+			r.AntiAffinity = antiAffinity
+		default:
+			handled, err := r.unmarshalAvailabilityOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = r.unmarshalCountWeightingOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
 	return nil
 }
 
 // Provision sets up r.
 func (r *RandomChoiceSelection) Provision(ctx caddy.Context) error {
+	if err := r.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := r.provisionCountWeighting(); err != nil {
+		return err
+	}
 	if r.Choose == 0 {
 		r.Choose = 2
 	}
+	for _, weight := range r.Weights {
+		if weight < 0 {
+			return fmt.Errorf("invalid weight %d: weight should be non-negative", weight)
+		}
+	}
+	if r.AntiAffinity != nil {
+		return r.AntiAffinity.provision()
+	}
 	return nil
 }
 
@@ -223,20 +718,83 @@ func (r RandomChoiceSelection) Validate() error {
 	return nil
 }
 
+// PopulateInitialTopology enables age-discounted load tracking on the
+// configured upstreams when the age_discounted count weighting is
+// active; in raw mode it does nothing.
+func (r *RandomChoiceSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	r.applyCountWeighting(upstreams)
+}
+
+// weightAt returns the configured weight for the upstream at pool
+// position i; positions beyond the configured list default to 1.
+func (r RandomChoiceSelection) weightAt(i int) int {
+	if i < len(r.Weights) {
+		return r.Weights[i]
+	}
+	return 1
+}
+
 // Select returns an available host, if any.
-func (r RandomChoiceSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
+func (r RandomChoiceSelection) Select(pool UpstreamPool, request *http.Request, _ http.ResponseWriter) *Upstream {
+	excluded, key := r.AntiAffinity.exclude(pool, request)
+	upstream := r.selectExcluding(pool, excluded)
+	r.AntiAffinity.record(key, upstream)
+	return upstream
+}
+
+// selectExcluding runs the two-choice selection with one host held
+// out; pass nil to exclude nothing.
+func (r RandomChoiceSelection) selectExcluding(pool UpstreamPool, excluded *Upstream) *Upstream {
 	k := min(r.Choose, len(pool))
-	choices := make([]*Upstream, k)
+	if len(r.Weights) == 0 {
+		choices := make([]*Upstream, k)
+		for i, upstream := range pool {
+			if upstream == excluded || !availableFor(upstream, r.Availability) {
+				continue
+			}
+			j := weakrand.Intn(i + 1) //nolint:gosec
+			if j < k {
+				choices[j] = upstream
+			}
+		}
+		return leastRequests(choices, r.ageDiscounted())
+	}
+
+	// Weighted reservoir sampling (A-Res): each candidate draws the
+	// key rand^(1/weight) and the k largest keys are kept, so a host
+	// is sampled with probability proportional to its weight;
+	// see https://en.wikipedia.org/wiki/Reservoir_sampling#Algorithm_A-Res
+	type candidate struct {
+		upstream *Upstream
+		key      float64
+	}
+	chosen := make([]candidate, 0, k)
 	for i, upstream := range pool {
-		if !upstream.Available() {
+		if upstream == excluded || !availableFor(upstream, r.Availability) {
 			continue
 		}
-		j := weakrand.Intn(i + 1) //nolint:gosec
-		if j < k {
-			choices[j] = upstream
+		weight := r.weightAt(i)
+		if weight == 0 {
+			continue
+		}
+		key := math.Pow(weakrand.Float64(), 1.0/float64(weight)) //nolint:gosec
+		pos := len(chosen)
+		for pos > 0 && chosen[pos-1].key < key {
+			pos--
+		}
+		if pos < k {
+			if len(chosen) < k {
+				chosen = append(chosen, candidate{})
+			}
+			copy(chosen[pos+1:], chosen[pos:])
+			chosen[pos] = candidate{upstream: upstream, key: key}
 		}
 	}
-	return leastRequests(choices)
+	choices := make([]*Upstream, len(chosen))
+	for i, c := range chosen {
+		choices[i] = c.upstream
+	}
+	return leastRequests(choices, r.ageDiscounted())
 }
 
 // LeastConnSelection is a policy that selects the
@@ -248,7 +806,17 @@ func (r RandomChoiceSelection) Select(pool UpstreamPool, _ *http.Request, _ http
 // counts active requests rather than connections,
 // since these days requests are multiplexed onto
 // shared connections.
-type LeastConnSelection struct{}
+type LeastConnSelection struct {
+	// The weight of each upstream in order, corresponding with the
+	// list of upstreams configured. When set, hosts are compared by
+	// active requests divided by weight, so higher-capacity hosts
+	// take proportionally more requests. A missing weight defaults
+	// to 1 and a zero weight excludes the upstream.
+	Weights []int `json:"weights,omitempty"`
+
+	availabilityChooser
+	countWeightingChooser
+}
 
 // CaddyModule returns the Caddy module information.
 func (LeastConnSelection) CaddyModule() caddy.ModuleInfo {
@@ -258,27 +826,76 @@ func (LeastConnSelection) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision sets up r.
+func (r *LeastConnSelection) Provision(ctx caddy.Context) error {
+	if err := r.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := r.provisionCountWeighting(); err != nil {
+		return err
+	}
+	for _, weight := range r.Weights {
+		if weight < 0 {
+			return fmt.Errorf("invalid weight %d: weight should be non-negative", weight)
+		}
+	}
+	return nil
+}
+
+// PopulateInitialTopology enables age-discounted load tracking on the
+// configured upstreams when the age_discounted count weighting is
+// active; in raw mode it does nothing.
+func (r *LeastConnSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	r.applyCountWeighting(upstreams)
+}
+
+// weightAt returns the configured weight for the upstream at pool
+// position i; positions beyond the configured list default to 1.
+func (r LeastConnSelection) weightAt(i int) int {
+	if i < len(r.Weights) {
+		return r.Weights[i]
+	}
+	return 1
+}
+
 // Select selects the up host with the least number of connections in the
-// pool. If more than one host has the same least number of connections,
-// one of the hosts is chosen at random.
-func (LeastConnSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
+// pool, where connection counts are divided by the host's weight if
+// weights are configured. If more than one host has the same least
+// number of (weighted) connections, one of the hosts is chosen at random.
+func (r LeastConnSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
 	var bestHost *Upstream
 	var count int
-	leastReqs := -1
+	leastLoad := -1.0
+	leastWeight := 1.0
 
-	for _, host := range pool {
-		if !host.Available() {
+	for i, host := range pool {
+		if !availableFor(host, r.Availability) {
+			continue
+		}
+		weight := float64(r.weightAt(i))
+		if weight == 0 {
 			continue
 		}
-		numReqs := host.NumRequests()
-		if leastReqs == -1 || numReqs < leastReqs {
-			leastReqs = numReqs
+		load := r.hostLoad(host)
+		if share := host.slowStartShare(); share < 1 {
+			if share == 0 {
+				continue
+			}
+			// inflate the in-flight count so a warming host looks
+			// busier than it is, in proportion to the remaining ramp
+			load = (load+1)/share - 1
+		}
+		// compare load/weight against leastLoad/leastWeight by
+		// cross-multiplying to avoid division
+		if leastLoad == -1 || load*leastWeight < leastLoad*weight {
+			leastLoad = load
+			leastWeight = weight
 			count = 0
 		}
 
 		// among hosts with same least connections, perform a reservoir
 		// sample: https://en.wikipedia.org/wiki/Reservoir_sampling
-		if numReqs == leastReqs {
+		if load*leastWeight == leastLoad*weight {
 			count++
 			if count == 1 || (weakrand.Int()%count) == 0 { //nolint:gosec
 				bestHost = host
@@ -289,18 +906,102 @@ func (LeastConnSelection) Select(pool UpstreamPool, _ *http.Request, _ http.Resp
 	return bestHost
 }
 
-// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (r *LeastConnSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume policy name
-	if d.NextArg() {
-		return d.ArgErr()
-	}
-	return nil
-}
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request. It works over the full pool rather than a
+// filtered copy so that per-upstream weights stay aligned with their
+// position in the upstream list.
+func (r LeastConnSelection) SelectExcluding(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	var bestHost *Upstream
+	var count int
+	leastLoad := -1.0
+	leastWeight := 1.0
+
+	for i, host := range pool {
+		if _, ok := tried[host]; ok {
+			continue
+		}
+		if !availableFor(host, r.Availability) {
+			continue
+		}
+		weight := float64(r.weightAt(i))
+		if weight == 0 {
+			continue
+		}
+		load := r.hostLoad(host)
+		if share := host.slowStartShare(); share < 1 {
+			if share == 0 {
+				continue
+			}
+			load = (load+1)/share - 1
+		}
+		if leastLoad == -1 || load*leastWeight < leastLoad*weight {
+			leastLoad = load
+			leastWeight = weight
+			count = 0
+		}
+		if load*leastWeight == leastLoad*weight {
+			count++
+			if count == 1 || (weakrand.Int()%count) == 0 { //nolint:gosec
+				bestHost = host
+			}
+		}
+	}
+
+	return bestHost
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *LeastConnSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	// any arguments are per-upstream weights
+	for _, weight := range d.RemainingArgs() {
+		weightInt, err := strconv.Atoi(weight)
+		if err != nil {
+			return d.Errf("invalid weight value '%s': %v", weight, err)
+		}
+		if weightInt < 0 {
+			return d.Errf("invalid weight value '%s': weight should be non-negative", weight)
+		}
+		r.Weights = append(r.Weights, weightInt)
+	}
+	for d.NextBlock(0) {
+		handled, err := r.unmarshalAvailabilityOption(d)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			handled, err = r.unmarshalCountWeightingOption(d)
+			if err != nil {
+				return err
+			}
+		}
+		if !handled {
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return nil
+}
 
 // RoundRobinSelection is a policy that selects
 // a host based on round-robin ordering.
 type RoundRobinSelection struct {
+	// Whether to start the rotation at a random offset instead of at
+	// the first upstream. Without this, every instance of the policy
+	// (each server block, and every instance right after a config
+	// reload) sends its first requests to the same upstream. Default:
+	// false, so the selection order stays deterministic.
+	RandomStart bool `json:"random_start,omitempty"`
+
+	// How far the counter advances per selection. Must be positive;
+	// defaults to 1. A step that is coprime with the pool size (any
+	// step works for prime-sized pools) still visits every upstream
+	// exactly once per cycle while spreading consecutive selections
+	// further apart.
+	Step uint32 `json:"step,omitempty"`
+
+	availabilityChooser
+
 	robin uint32
 }
 
@@ -312,20 +1013,57 @@ func (RoundRobinSelection) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision sets up the policy.
+func (r *RoundRobinSelection) Provision(ctx caddy.Context) error {
+	if err := r.provisionAvailability(); err != nil {
+		return err
+	}
+	if r.Step == 0 {
+		r.Step = 1
+	}
+	if r.RandomStart {
+		atomic.StoreUint32(&r.robin, weakrand.Uint32())
+	}
+	return nil
+}
+
 // Select returns an available host, if any.
 func (r *RoundRobinSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
 	n := uint32(len(pool))
 	if n == 0 {
 		return nil
 	}
+	step := r.Step
+	if step == 0 {
+		step = 1
+	}
+	var warming *Upstream
 	for i := uint32(0); i < n; i++ {
-		robin := atomic.AddUint32(&r.robin, 1)
+		robin := atomic.AddUint32(&r.robin, step)
 		host := pool[robin%n]
-		if host.Available() {
-			return host
+		if availableFor(host, r.Availability) {
+			if !host.slowStartHoldback() {
+				return host
+			}
+			// remember a warming host in case nothing else is up
+			if warming == nil {
+				warming = host
+			}
 		}
+		// the stride landed on an unavailable host; probe
+		// adjacent slots so every upstream gets considered
+		// even when the step shares a factor with the pool size
+		step = 1
 	}
-	return nil
+	return warming
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request.
+func (r *RoundRobinSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+		return r.Select(p, req, w)
+	})
 }
 
 // UnmarshalCaddyfile sets up the module from Caddyfile tokens.
@@ -334,12 +1072,43 @@ func (r *RoundRobinSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if d.NextArg() {
 		return d.ArgErr()
 	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "random_start":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			r.RandomStart = true
+		case "step":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			step, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid step value '%s': %v", d.Val(), err)
+			}
+			if step <= 0 {
+				return d.Errf("step must be positive: %d", step)
+			}
+			r.Step = uint32(step)
+		default:
+			handled, err := r.unmarshalAvailabilityOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
 	return nil
 }
 
 // FirstSelection is a policy that selects
 // the first available host.
-type FirstSelection struct{}
+type FirstSelection struct {
+	availabilityChooser
+}
 
 // CaddyModule returns the Caddy module information.
 func (FirstSelection) CaddyModule() caddy.ModuleInfo {
@@ -349,10 +1118,15 @@ func (FirstSelection) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision sets up the module.
+func (r *FirstSelection) Provision(ctx caddy.Context) error {
+	return r.provisionAvailability()
+}
+
 // Select returns an available host, if any.
-func (FirstSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
+func (r FirstSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
 	for _, host := range pool {
-		if host.Available() {
+		if availableFor(host, r.Availability) {
 			return host
 		}
 	}
@@ -365,654 +1139,1089 @@ func (r *FirstSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if d.NextArg() {
 		return d.ArgErr()
 	}
+	for d.NextBlock(0) {
+		handled, err := r.unmarshalAvailabilityOption(d)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
 	return nil
 }
 
-// IPHashSelection is a policy that selects a host
-// based on hashing the remote IP of the request.
-type IPHashSelection struct{}
+// PrioritySelection is a policy that selects the first available host
+// following an explicit preference order, independent of how the
+// upstream list itself is ordered. This suits failover setups where
+// the upstream list is generated (e.g. alphabetically) but the
+// preferred host differs per region.
+type PrioritySelection struct {
+	// The upstream dial addresses (or hash_keys) in preference order.
+	// Selection walks this list and picks the first listed host that is
+	// present in the pool and available; hosts not listed at all are
+	// considered last, in config order. Entries that match no
+	// configured upstream are skipped with a provision-time warning
+	// rather than an error, so one priority list can be shared across
+	// region-specific templates.
+	Priorities []string `json:"priorities,omitempty"`
+
+	prioritySet map[string]struct{}
+	logger      *zap.Logger
+}
 
 // CaddyModule returns the Caddy module information.
-func (IPHashSelection) CaddyModule() caddy.ModuleInfo {
+func (PrioritySelection) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.ip_hash",
-		New: func() caddy.Module { return new(IPHashSelection) },
+		ID:  "http.reverse_proxy.selection_policies.priority",
+		New: func() caddy.Module { return new(PrioritySelection) },
 	}
 }
 
-// Select returns an available host, if any.
-func (IPHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
-	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		clientIP = req.RemoteAddr
+// Provision sets up the module.
+func (s *PrioritySelection) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger(s)
+	s.prioritySet = make(map[string]struct{}, len(s.Priorities))
+	for _, id := range s.Priorities {
+		s.prioritySet[id] = struct{}{}
 	}
-	return hostByHashing(pool, clientIP)
+	return nil
 }
 
-// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (r *IPHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+// SetEventsApp implements EventsAware so the handler hands the
+// configured pool to PopulateInitialTopology during provisioning; the
+// priority policy has no use for health events themselves.
+func (s *PrioritySelection) SetEventsApp(_ *caddyevents.App) {}
+
+// PopulateInitialTopology warns about priority entries that match no
+// configured upstream, which usually means a template meant for
+// another region. The entries are skipped, not rejected, so selection
+// proceeds over the rest of the list.
+func (s *PrioritySelection) PopulateInitialTopology(upstreams []*Upstream) {
+	known := make(map[string]struct{}, len(upstreams)*2)
+	for _, upstream := range upstreams {
+		known[upstream.Dial] = struct{}{}
+		known[upstream.hashKey()] = struct{}{}
+	}
+	for _, id := range s.Priorities {
+		if _, ok := known[id]; !ok && s.logger != nil {
+			s.logger.Warn("priority entry does not match any configured upstream",
+				zap.String("priority", id))
+		}
+	}
+}
+
+// Select returns the first available host in priority order, then the
+// first available unlisted host in config order.
+func (s PrioritySelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
+	for _, id := range s.Priorities {
+		for _, host := range pool {
+			if host == nil || (host.Dial != id && host.hashKey() != id) {
+				continue
+			}
+			if host.Available() {
+				return host
+			}
+		}
+	}
+	// none of the prioritized hosts can serve; fall back to the
+	// remaining pool in config order
+	for _, host := range pool {
+		if host == nil {
+			continue
+		}
+		if _, listed := s.prioritySet[host.Dial]; listed {
+			continue
+		}
+		if _, listed := s.prioritySet[host.hashKey()]; listed {
+			continue
+		}
+		if host.Available() {
+			return host
+		}
+	}
+	return nil
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request, continuing down the priority order.
+func (s PrioritySelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+		return s.Select(p, req, w)
+	})
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy priority <dial_addresses...>
+func (s *PrioritySelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume policy name
-	if d.NextArg() {
-		return d.ArgErr()
+	for d.NextArg() {
+		s.Priorities = append(s.Priorities, d.Val())
 	}
 	return nil
 }
 
-// ClientIPHashSelection is a policy that selects a host
-// based on hashing the client IP of the request, as determined
-// by the HTTP app's trusted proxies settings.
-type ClientIPHashSelection struct{}
+// verboseLogging is shared by the hashing selection policies to
+// optionally emit a structured debug log for every selection decision:
+// which policy ran, the extracted key, the selected upstream, and
+// whether the fallback fired. It is embedded in each policy's config
+// so the options surface uniformly as `verbose_logging` and
+// `log_key_mode`.
+type verboseLogging struct {
+	// Whether to log every selection decision at debug level.
+	// Off by default.
+	VerboseLogging bool `json:"verbose_logging,omitempty"`
+
+	// How the key appears in verbose logs, to avoid leaking PII:
+	// "hashed" (the default) logs the hash of the key, "truncated"
+	// logs at most its first 8 bytes, and "plain" logs it as-is.
+	LogKeyMode string `json:"log_key_mode,omitempty"`
 
-// CaddyModule returns the Caddy module information.
-func (ClientIPHashSelection) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.client_ip_hash",
-		New: func() caddy.Module { return new(ClientIPHashSelection) },
+	logger *zap.Logger
+}
+
+// provisionVerboseLogging validates the log key mode and attaches the
+// module logger.
+func (v *verboseLogging) provisionVerboseLogging(ctx caddy.Context, mod caddy.Module) error {
+	switch v.LogKeyMode {
+	case "", "hashed", "truncated", "plain":
+	default:
+		return fmt.Errorf("unrecognized log_key_mode '%s': must be 'hashed', 'truncated', or 'plain'", v.LogKeyMode)
 	}
+	v.logger = ctx.Logger(mod)
+	return nil
 }
 
-// Select returns an available host, if any.
-func (ClientIPHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
-	address := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string)
-	clientIP, _, err := net.SplitHostPort(address)
-	if err != nil {
-		clientIP = address // no port
+// verboseLogEnabled reports whether a selection decision should be
+// logged. The check is cheap and allocation-free, so disabled configs
+// pay nothing on the hot path; callers must gate logSelection (and any
+// extra field construction) behind it.
+func (v verboseLogging) verboseLogEnabled() bool {
+	return v.VerboseLogging && v.logger != nil && v.logger.Core().Enabled(zapcore.DebugLevel)
+}
+
+// logSelection emits one selection decision.
+func (v verboseLogging) logSelection(policy, key string, upstream *Upstream, fallbackUsed bool, extra ...zap.Field) {
+	selected := "none"
+	if upstream != nil {
+		selected = upstream.String()
 	}
-	return hostByHashing(pool, clientIP)
+	fields := append([]zap.Field{
+		zap.String("policy", policy),
+		zap.String("key", v.safeKey(key)),
+		zap.String("upstream", selected),
+		zap.Bool("fallback", fallbackUsed),
+	}, extra...)
+	v.logger.Debug("selected upstream", fields...)
 }
 
-// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (r *ClientIPHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume policy name
-	if d.NextArg() {
-		return d.ArgErr()
+// safeKey renders the key according to LogKeyMode.
+func (v verboseLogging) safeKey(key string) string {
+	switch v.LogKeyMode {
+	case "plain":
+		return key
+	case "truncated":
+		if len(key) > 8 {
+			return key[:8] + "..."
+		}
+		return key
 	}
-	return nil
+	return strconv.FormatUint(hash(key), 16)
 }
 
-// URIHashSelection is a policy that selects a
-// host by hashing the request URI.
-type URIHashSelection struct{}
+// unmarshalVerboseOption parses the `verbose_logging` and
+// `log_key_mode` Caddyfile options shared by the hashing policies.
+// It reports whether the current token was one of them, so callers can
+// fall through to their own unrecognized-option error when it was not.
+func (v *verboseLogging) unmarshalVerboseOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "verbose_logging":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		v.VerboseLogging = true
+	case "log_key_mode":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		v.LogKeyMode = d.Val()
+	default:
+		return false, nil
+	}
+	return true, nil
+}
 
-// CaddyModule returns the Caddy module information.
-func (URIHashSelection) CaddyModule() caddy.ModuleInfo {
-	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.uri_hash",
-		New: func() caddy.Module { return new(URIHashSelection) },
+// maskedIPKey reduces an IP address to its network prefix string
+// according to the configured mask bits, so clients whose addresses
+// rotate within one prefix (e.g. a mobile carrier's /64) keep their
+// affinity. Mask bits of 0 (unset), 32 for IPv4, or 128 for IPv6
+// leave the address untouched; addresses that don't parse are hashed
+// as-is, matching the previous behavior for malformed values.
+func maskedIPKey(ipStr string, v4Bits, v6Bits int) string {
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return ipStr
+	}
+	addr = addr.Unmap()
+	bits, maxBits := v6Bits, 128
+	if addr.Is4() {
+		bits, maxBits = v4Bits, 32
+	}
+	if bits <= 0 || bits >= maxBits {
+		return ipStr
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ipStr
 	}
+	return prefix.String()
 }
 
-// Select returns an available host, if any.
-func (URIHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
-	return hostByHashing(pool, req.RequestURI)
+// clientIPVarOrRemoteAddr returns the client IP that the client_ip
+// middleware parsed for the request, falling back to RemoteAddr when
+// the var is missing or empty — e.g. when the policy runs outside the
+// normal middleware chain, as in health warm-up or tests.
+func clientIPVarOrRemoteAddr(req *http.Request) string {
+	if address, ok := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string); ok && address != "" {
+		return address
+	}
+	return req.RemoteAddr
 }
 
-// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (r *URIHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume policy name
-	if d.NextArg() {
-		return d.ArgErr()
+// validateMaskBits checks that the configured mask bits are within
+// range for their address family.
+func validateMaskBits(v4Bits, v6Bits int) error {
+	if v4Bits < 0 || v4Bits > 32 {
+		return fmt.Errorf("ipv4_mask_bits must be between 0 and 32, got %d", v4Bits)
+	}
+	if v6Bits < 0 || v6Bits > 128 {
+		return fmt.Errorf("ipv6_mask_bits must be between 0 and 128, got %d", v6Bits)
 	}
 	return nil
 }
 
-// QueryHashSelection is a policy that selects
-// a host based on a given request query parameter.
-type QueryHashSelection struct {
-	// The query key whose value is to be hashed and used for upstream selection.
-	Key string `json:"key,omitempty"`
+// maxFallbackDepth caps how deeply fallback selection policies may
+// nest. Each level costs an allocation of the inner policy plus
+// another round of key extraction per request, and nothing reasonable
+// needs more than a few.
+const maxFallbackDepth = 5
+
+// fallbackChainKey is the provision-context key carrying the chain of
+// fallback configs loaded so far, so nesting depth and repeated
+// configs are detected across module boundaries.
+type fallbackChainKey struct{}
+
+// loadFallbackSelector loads a policy's configured fallback selection
+// policy from raw, rejecting chains that nest more than
+// maxFallbackDepth levels and configs that reappear within their own
+// fallback chain. policyName is the module's inline policy name
+// (e.g. "query").
+func loadFallbackSelector(ctx caddy.Context, policy Selector, policyName string, raw json.RawMessage) (Selector, error) {
+	chain, _ := ctx.Value(fallbackChainKey{}).([]string)
+	if len(chain) >= maxFallbackDepth {
+		return nil, fmt.Errorf("fallback policies nest more than %d levels deep", maxFallbackDepth)
+	}
+	normalized := normalizeFallbackConfig(raw)
+	for _, prev := range chain {
+		if prev == normalized {
+			return nil, fmt.Errorf("fallback of %s policy repeats a config already in its own chain", policyName)
+		}
+	}
+	if selfReferencingFallback(policy, policyName, raw) {
+		return nil, fmt.Errorf("%s policy cannot be its own fallback", policyName)
+	}
+	chain = append(chain[:len(chain):len(chain)], normalized)
+	ctx.Context = context.WithValue(ctx.Context, fallbackChainKey{}, chain)
+	mod, err := ctx.LoadModule(policy, "FallbackRaw")
+	if err != nil {
+		return nil, err
+	}
+	return mod.(Selector), nil
+}
 
-	// The fallback policy to use if the query key is not present. Defaults to `random`.
-	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
-	fallback    Selector
+// selfReferencingFallback reports whether raw configures the same
+// policy type as the outer policy with identical settings — a fallback
+// that can never make progress, since it only runs when that exact
+// policy already failed to pick a host.
+func selfReferencingFallback(policy Selector, policyName string, raw json.RawMessage) bool {
+	var inner map[string]any
+	if json.Unmarshal(raw, &inner) != nil {
+		return false
+	}
+	if name, _ := inner["policy"].(string); name != policyName {
+		return false
+	}
+	delete(inner, "policy")
+	delete(inner, "fallback")
+	outerJSON, err := json.Marshal(policy)
+	if err != nil {
+		return false
+	}
+	var outer map[string]any
+	if json.Unmarshal(outerJSON, &outer) != nil {
+		return false
+	}
+	delete(outer, "fallback")
+	return reflect.DeepEqual(inner, outer)
+}
+
+// normalizeFallbackConfig canonicalizes a fallback config for
+// comparison, so key order and whitespace differences don't hide a
+// repeated config.
+func normalizeFallbackConfig(raw json.RawMessage) string {
+	var decoded map[string]any
+	if json.Unmarshal(raw, &decoded) != nil {
+		return string(raw)
+	}
+	out, err := json.Marshal(decoded)
+	if err != nil {
+		return string(raw)
+	}
+	return string(out)
+}
+
+// IPHashSelection is a policy that selects a host
+// based on hashing the remote IP of the request.
+type IPHashSelection struct {
+	// Mask IPv4 addresses to this many bits before hashing, so
+	// clients whose addresses rotate within one subnet keep their
+	// affinity. Default is 32 (hash the full address).
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+
+	// Mask IPv6 addresses to this many bits before hashing.
+	// Default is 128 (hash the full address).
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	verboseLogging
+	selectionTracing
+	hashFunctionChooser
+	availabilityChooser
+	keyComponentChooser
+	overrideChooser
 }
 
 // CaddyModule returns the Caddy module information.
-func (QueryHashSelection) CaddyModule() caddy.ModuleInfo {
+func (IPHashSelection) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.query",
-		New: func() caddy.Module { return new(QueryHashSelection) },
+		ID:  "http.reverse_proxy.selection_policies.ip_hash",
+		New: func() caddy.Module { return new(IPHashSelection) },
 	}
 }
 
 // Provision sets up the module.
-func (s *QueryHashSelection) Provision(ctx caddy.Context) error {
-	if s.Key == "" {
-		return fmt.Errorf("query key is required")
+func (r *IPHashSelection) Provision(ctx caddy.Context) error {
+	if err := validateMaskBits(r.IPv4MaskBits, r.IPv6MaskBits); err != nil {
+		return err
 	}
-	if s.FallbackRaw == nil {
-		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	if err := r.provisionHashFunction(); err != nil {
+		return err
+	}
+	if err := r.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := r.provisionKeyComponents(); err != nil {
+		return err
 	}
-	mod, err := ctx.LoadModule(s, "FallbackRaw")
+	if err := r.provisionOverrides(ctx); err != nil {
+		return err
+	}
+	if err := r.provisionVerboseLogging(ctx, r); err != nil {
+		return err
+	}
+	return r.provisionSelectionTracing()
+}
+
+// requestKey returns the (optionally masked) remote IP that
+// this policy hashes for the request, combined with any further
+// configured key components.
+func (r IPHashSelection) requestKey(req *http.Request) (string, bool) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
-		return fmt.Errorf("loading fallback selection policy: %s", err)
+		clientIP = req.RemoteAddr
 	}
-	s.fallback = mod.(Selector)
-	return nil
+	return r.composeKey(req, maskedIPKey(clientIP, r.IPv4MaskBits, r.IPv6MaskBits)), true
 }
 
 // Select returns an available host, if any.
-func (s QueryHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
-	// Since the query may have multiple values for the same key,
-	// we'll join them to avoid a problem where the user can control
-	// the upstream that the request goes to by sending multiple values
-	// for the same key, when the upstream only considers the first value.
-	// Keep in mind that a client changing the order of the values may
-	// affect which upstream is selected, but this is a semantically
-	// different request, because the order of the values is significant.
-	vals := strings.Join(req.URL.Query()[s.Key], ",")
-	if vals == "" {
-		return s.fallback.Select(pool, req, nil)
+func (r IPHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
+	key, _ := r.requestKey(req)
+	if upstream, ok := r.overrideFor(key, pool, r.Availability); ok {
+		return upstream
 	}
-	return hostByHashing(pool, vals)
+	return r.SelectByKey(pool, key)
 }
 
-// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (s *QueryHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume policy name
+// SelectByKey resolves an already-extracted (and masked) key against
+// the pool, without touching a request.
+func (r IPHashSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	upstream, _ := hostByHashingWith(pool, key, r.hashFn, r.Availability, nil)
+	r.traceSelection("ip_hash", key, upstream)
+	if r.verboseLogEnabled() {
+		r.logSelection("ip_hash", key, upstream, false)
+	}
+	return upstream
+}
 
-	if !d.NextArg() {
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request; the key deterministically falls to the
+// next-highest scoring host among those remaining.
+func (r IPHashSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+		return r.Select(p, req, w)
+	})
+}
+
+// Preview explains which upstream the given client IP maps to.
+func (r IPHashSelection) Preview(pool UpstreamPool, key string) SelectionExplanation {
+	return previewByHashing("ip_hash", pool, maskedIPKey(key, r.IPv4MaskBits, r.IPv6MaskBits), r.hashFn, r.Availability, nil)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *IPHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
 		return d.ArgErr()
 	}
-	s.Key = d.Val()
-
 	for d.NextBlock(0) {
 		switch d.Val() {
-		case "fallback":
+		case "ipv4_mask":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			if s.FallbackRaw != nil {
-				return d.Err("fallback selection policy already specified")
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
 			}
-			mod, err := loadFallbackPolicy(d)
+			r.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
 			if err != nil {
-				return err
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
 			}
-			s.FallbackRaw = mod
+			r.IPv6MaskBits = bits
 		default:
-			return d.Errf("unrecognized option '%s'", d.Val())
+			handled, err := r.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = r.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = r.unmarshalHashOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = r.unmarshalAvailabilityOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = r.unmarshalKeyComponentsOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = r.unmarshalOverrideOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
 		}
 	}
 	return nil
 }
 
-// HeaderHashSelection is a policy that selects
-// a host based on a given request header.
-type HeaderHashSelection struct {
-	// The HTTP header field whose value is to be hashed and used for upstream selection.
-	Field string `json:"field,omitempty"`
-
-	// The fallback policy to use if the header is not present. Defaults to `random`.
-	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
-	fallback    Selector
+// ClientIPHashSelection is a policy that selects a host
+// based on hashing the client IP of the request, as determined
+// by the HTTP app's trusted proxies settings.
+type ClientIPHashSelection struct {
+	// Mask IPv4 addresses to this many bits before hashing, so
+	// clients whose addresses rotate within one subnet keep their
+	// affinity. Default is 32 (hash the full address).
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+
+	// Mask IPv6 addresses to this many bits before hashing.
+	// Default is 128 (hash the full address).
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	hashFunctionChooser
+	availabilityChooser
+	keyComponentChooser
+	overrideChooser
 }
 
 // CaddyModule returns the Caddy module information.
-func (HeaderHashSelection) CaddyModule() caddy.ModuleInfo {
+func (ClientIPHashSelection) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.header",
-		New: func() caddy.Module { return new(HeaderHashSelection) },
+		ID:  "http.reverse_proxy.selection_policies.client_ip_hash",
+		New: func() caddy.Module { return new(ClientIPHashSelection) },
 	}
 }
 
 // Provision sets up the module.
-func (s *HeaderHashSelection) Provision(ctx caddy.Context) error {
-	if s.Field == "" {
-		return fmt.Errorf("header field is required")
+func (r *ClientIPHashSelection) Provision(ctx caddy.Context) error {
+	if err := validateMaskBits(r.IPv4MaskBits, r.IPv6MaskBits); err != nil {
+		return err
 	}
-	if s.FallbackRaw == nil {
-		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	if err := r.provisionHashFunction(); err != nil {
+		return err
+	}
+	if err := r.provisionAvailability(); err != nil {
+		return err
 	}
-	mod, err := ctx.LoadModule(s, "FallbackRaw")
+	if err := r.provisionKeyComponents(); err != nil {
+		return err
+	}
+	return r.provisionOverrides(ctx)
+}
+
+// requestKey returns the (optionally masked) client IP that
+// this policy hashes for the request, combined with any further
+// configured key components.
+func (r ClientIPHashSelection) requestKey(req *http.Request) (string, bool) {
+	address := clientIPVarOrRemoteAddr(req)
+	clientIP, _, err := net.SplitHostPort(address)
 	if err != nil {
-		return fmt.Errorf("loading fallback selection policy: %s", err)
+		clientIP = address // no port
 	}
-	s.fallback = mod.(Selector)
-	return nil
+	return r.composeKey(req, maskedIPKey(clientIP, r.IPv4MaskBits, r.IPv6MaskBits)), true
 }
 
 // Select returns an available host, if any.
-func (s HeaderHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
-	// The Host header should be obtained from the req.Host field
-	// since net/http removes it from the header map.
-	if s.Field == "Host" && req.Host != "" {
-		return hostByHashing(pool, req.Host)
+func (r ClientIPHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
+	key, _ := r.requestKey(req)
+	if upstream, ok := r.overrideFor(key, pool, r.Availability); ok {
+		return upstream
 	}
+	upstream, _ := hostByHashingWith(pool, key, r.hashFn, r.Availability, nil)
+	return upstream
+}
 
-	val := req.Header.Get(s.Field)
-	if val == "" {
-		return s.fallback.Select(pool, req, nil)
-	}
-	return hostByHashing(pool, val)
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request.
+func (r ClientIPHashSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+		return r.Select(p, req, w)
+	})
+}
+
+// Preview explains which upstream the given client IP maps to.
+func (r ClientIPHashSelection) Preview(pool UpstreamPool, key string) SelectionExplanation {
+	return previewByHashing("client_ip_hash", pool, maskedIPKey(key, r.IPv4MaskBits, r.IPv6MaskBits), r.hashFn, r.Availability, nil)
 }
 
 // UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (s *HeaderHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+func (r *ClientIPHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume policy name
-
-	if !d.NextArg() {
+	if d.NextArg() {
 		return d.ArgErr()
 	}
-	s.Field = d.Val()
-
 	for d.NextBlock(0) {
 		switch d.Val() {
-		case "fallback":
+		case "ipv4_mask":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			if s.FallbackRaw != nil {
-				return d.Err("fallback selection policy already specified")
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
 			}
-			mod, err := loadFallbackPolicy(d)
+			r.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
 			if err != nil {
-				return err
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
 			}
-			s.FallbackRaw = mod
+			r.IPv6MaskBits = bits
 		default:
-			return d.Errf("unrecognized option '%s'", d.Val())
+			handled, err := r.unmarshalHashOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = r.unmarshalAvailabilityOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = r.unmarshalKeyComponentsOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = r.unmarshalOverrideOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
 		}
 	}
 	return nil
 }
 
-// CookieHashSelection is a policy that selects
-// a host based on a given cookie name.
-type CookieHashSelection struct {
-	// The HTTP cookie name whose value is to be hashed and used for upstream selection.
-	Name string `json:"name,omitempty"`
-	// Secret to hash (Hmac256) chosen upstream in cookie
-	Secret string `json:"secret,omitempty"`
-	// The cookie's Max-Age before it expires. Default is no expiry.
-	MaxAge caddy.Duration `json:"max_age,omitempty"`
-
-	// The fallback policy to use if the cookie is not present. Defaults to `random`.
-	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
-	fallback    Selector
+// URIHashSelection is a policy that selects a
+// host by hashing the request URI.
+type URIHashSelection struct {
+	// Which part of the request to hash. Can be "uri" (the possibly
+	// rewritten request URI; the default), "original_uri" (the URI as
+	// received by the server, before any rewrites, so proxies mounted
+	// behind different rewrites hash the same value), "path_only" (the
+	// path without the query string), or "path_and_query".
+	Source string `json:"source,omitempty"`
+
+	// Query parameters to drop before hashing, so cache-busting
+	// parameters like "_" or "utm_*" don't break URI affinity. Each
+	// entry is a literal name or a path.Match glob. The surviving
+	// parameters are re-encoded sorted by name, so reordered query
+	// strings hash identically.
+	IgnoreQueryParams []string `json:"ignore_query_params,omitempty"`
+
+	// Query parameters to keep before hashing; all others are dropped.
+	// When set, this allow-list takes precedence and
+	// ignore_query_params is not consulted. Same pattern syntax and
+	// canonical sorting as ignore_query_params.
+	IncludeQueryParams []string `json:"include_query_params,omitempty"`
+
+	verboseLogging
+	selectionTracing
+	hashFunctionChooser
+	availabilityChooser
+	overrideChooser
 }
 
 // CaddyModule returns the Caddy module information.
-func (CookieHashSelection) CaddyModule() caddy.ModuleInfo {
+func (URIHashSelection) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.cookie",
-		New: func() caddy.Module { return new(CookieHashSelection) },
+		ID:  "http.reverse_proxy.selection_policies.uri_hash",
+		New: func() caddy.Module { return new(URIHashSelection) },
 	}
 }
 
 // Provision sets up the module.
-func (s *CookieHashSelection) Provision(ctx caddy.Context) error {
-	if s.Name == "" {
-		s.Name = "lb"
+func (r *URIHashSelection) Provision(ctx caddy.Context) error {
+	switch r.Source {
+	case "":
+		r.Source = "uri"
+	case "uri", "original_uri", "path_only", "path_and_query":
+	default:
+		return fmt.Errorf("unrecognized source '%s': must be 'uri', 'original_uri', 'path_only', or 'path_and_query'", r.Source)
 	}
-	if s.FallbackRaw == nil {
-		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	if err := validateQueryParamPatterns(r.IgnoreQueryParams); err != nil {
+		return err
 	}
-	mod, err := ctx.LoadModule(s, "FallbackRaw")
-	if err != nil {
-		return fmt.Errorf("loading fallback selection policy: %s", err)
+	if err := validateQueryParamPatterns(r.IncludeQueryParams); err != nil {
+		return err
 	}
-	s.fallback = mod.(Selector)
-	return nil
+	if err := r.provisionHashFunction(); err != nil {
+		return err
+	}
+	if err := r.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := r.provisionOverrides(ctx); err != nil {
+		return err
+	}
+	if err := r.provisionVerboseLogging(ctx, r); err != nil {
+		return err
+	}
+	return r.provisionSelectionTracing()
+}
+
+// requestKey returns the request URI form that this policy hashes,
+// according to the configured source and query parameter filters.
+func (r URIHashSelection) requestKey(req *http.Request) (string, bool) {
+	return canonicalizeQueryParams(uriHashKey(req, r.Source), r.IncludeQueryParams, r.IgnoreQueryParams), true
 }
 
 // Select returns an available host, if any.
-func (s CookieHashSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
-	// selects a new Host using the fallback policy (typically random)
-	// and write a sticky session cookie to the response.
-	selectNewHost := func() *Upstream {
-		upstream := s.fallback.Select(pool, req, w)
-		if upstream == nil {
-			return nil
-		}
-		sha, err := hashCookie(s.Secret, upstream.Dial)
-		if err != nil {
-			return upstream
-		}
-		cookie := &http.Cookie{
-			Name:   s.Name,
-			Value:  sha,
-			Path:   "/",
-			Secure: false,
-		}
-		isProxyHttps := false
-		if trusted, ok := caddyhttp.GetVar(req.Context(), caddyhttp.TrustedProxyVarKey).(bool); ok && trusted {
-			xfp, xfpOk, _ := lastHeaderValue(req.Header, "X-Forwarded-Proto")
-			isProxyHttps = xfpOk && xfp == "https"
-		}
-		if req.TLS != nil || isProxyHttps {
-			cookie.Secure = true
-			cookie.SameSite = http.SameSiteNoneMode
-		}
-		if s.MaxAge > 0 {
-			cookie.MaxAge = int(time.Duration(s.MaxAge).Seconds())
-		}
-		http.SetCookie(w, cookie)
+func (r URIHashSelection) Select(pool UpstreamPool, req *http.Request, _ http.ResponseWriter) *Upstream {
+	key, _ := r.requestKey(req)
+	if upstream, ok := r.overrideFor(key, pool, r.Availability); ok {
 		return upstream
 	}
+	return r.SelectByKey(pool, key)
+}
 
-	cookie, err := req.Cookie(s.Name)
-	// If there's no cookie, select a host using the fallback policy
-	if err != nil || cookie == nil {
-		return selectNewHost()
-	}
-	// If the cookie is present, loop over the available upstreams until we find a match
-	cookieValue := cookie.Value
-	for _, upstream := range pool {
-		if !upstream.Available() {
-			continue
-		}
-		sha, err := hashCookie(s.Secret, upstream.Dial)
-		if err == nil && sha == cookieValue {
-			return upstream
-		}
+// SelectByKey resolves an already-extracted URI key against the pool,
+// without touching a request.
+func (r URIHashSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	upstream, _ := hostByHashingWith(pool, key, r.hashFn, r.Availability, nil)
+	r.traceSelection("uri_hash", key, upstream)
+	if r.verboseLogEnabled() {
+		r.logSelection("uri_hash", key, upstream, false)
 	}
-	// If there is no matching host, select a host using the fallback policy
-	return selectNewHost()
+	return upstream
 }
 
-// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
-//
-//	lb_policy cookie [<name> [<secret>]] {
-//		fallback <policy>
-//		max_age <duration>
-//	}
-//
-// By default name is `lb`
-func (s *CookieHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	args := d.RemainingArgs()
-	switch len(args) {
-	case 1:
-	case 2:
-		s.Name = args[1]
-	case 3:
-		s.Name = args[1]
-		s.Secret = args[2]
-	default:
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request.
+func (r URIHashSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+		return r.Select(p, req, w)
+	})
+}
+
+// Preview explains which upstream the given URI maps to.
+func (r URIHashSelection) Preview(pool UpstreamPool, key string) SelectionExplanation {
+	return previewByHashing("uri_hash", pool, key, r.hashFn, r.Availability, nil)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *URIHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		r.Source = d.Val()
+	}
+	if d.NextArg() {
 		return d.ArgErr()
 	}
 	for d.NextBlock(0) {
 		switch d.Val() {
-		case "fallback":
-			if !d.NextArg() {
+		case "ignore_query_params":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
 				return d.ArgErr()
 			}
-			if s.FallbackRaw != nil {
-				return d.Err("fallback selection policy already specified")
+			r.IgnoreQueryParams = append(r.IgnoreQueryParams, args...)
+			continue
+		case "include_query_params":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
 			}
-			mod, err := loadFallbackPolicy(d)
+			r.IncludeQueryParams = append(r.IncludeQueryParams, args...)
+			continue
+		}
+		handled, err := r.unmarshalVerboseOption(d)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			handled, err = r.unmarshalTraceOption(d)
 			if err != nil {
 				return err
 			}
-			s.FallbackRaw = mod
-		case "max_age":
-			if !d.NextArg() {
-				return d.ArgErr()
-			}
-			if s.MaxAge != 0 {
-				return d.Err("cookie max_age already specified")
-			}
-			maxAge, err := caddy.ParseDuration(d.Val())
+		}
+		if !handled {
+			handled, err = r.unmarshalHashOption(d)
 			if err != nil {
-				return d.Errf("invalid duration: %s", d.Val())
+				return err
 			}
-			if maxAge <= 0 {
-				return d.Errf("invalid duration: %s, max_age should be non-zero and positive", d.Val())
+		}
+		if !handled {
+			handled, err = r.unmarshalAvailabilityOption(d)
+			if err != nil {
+				return err
 			}
-			if d.NextArg() {
-				return d.ArgErr()
+		}
+		if !handled {
+			handled, err = r.unmarshalOverrideOption(d)
+			if err != nil {
+				return err
 			}
-			s.MaxAge = caddy.Duration(maxAge)
-		default:
+		}
+		if !handled {
 			return d.Errf("unrecognized option '%s'", d.Val())
 		}
 	}
 	return nil
 }
 
-// hashCookie hashes (HMAC 256) some data with the secret
-func hashCookie(secret string, data string) (string, error) {
-	h := hmac.New(sha256.New, []byte(secret))
-	_, err := h.Write([]byte(data))
-	if err != nil {
-		return "", err
+// uriHashKey extracts the string to hash for URI-based selection
+// according to the given source. "original_uri" reads the request as
+// it arrived at the server, before any rewrites, falling back to the
+// current URI when no original request is recorded in the context
+// (e.g. outside a server's handler chain).
+func uriHashKey(req *http.Request, source string) string {
+	switch source {
+	case "original_uri":
+		if or, ok := req.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok && or.RequestURI != "" {
+			return or.RequestURI
+		}
+	case "path_only":
+		return req.URL.Path
+	case "path_and_query":
+		if req.URL.RawQuery != "" {
+			return req.URL.Path + "?" + req.URL.RawQuery
+		}
+		return req.URL.Path
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+	return req.RequestURI
 }
 
-// selectRandomHost returns a random available host
-func selectRandomHost(pool []*Upstream) *Upstream {
-	// use reservoir sampling because the number of available
-	// hosts isn't known: https://en.wikipedia.org/wiki/Reservoir_sampling
-	var randomHost *Upstream
-	var count int
-	for _, upstream := range pool {
-		if !upstream.Available() {
-			continue
-		}
-		// (n % 1 == 0) holds for all n, therefore a
-		// upstream will always be chosen if there is at
-		// least one available
-		count++
-		if (weakrand.Int() % count) == 0 { //nolint:gosec
-			randomHost = upstream
-		}
+// canonicalizeQueryParams rewrites a URI key's query string so
+// equivalent requests hash identically: when include is non-empty only
+// matching parameters are kept (the allow-list takes precedence and
+// ignore is not consulted), otherwise parameters matching ignore are
+// dropped. The survivors are re-encoded sorted by name, so
+// "?a=1&b=2" and "?b=2&a=1" map to the same upstream. Patterns may be
+// literal names or path.Match globs such as "utm_*". Keys whose query
+// string doesn't parse are hashed as-is.
+func canonicalizeQueryParams(uri string, include, ignore []string) string {
+	if len(include) == 0 && len(ignore) == 0 {
+		return uri
 	}
-	return randomHost
-}
-
-// leastRequests returns the host with the
-// least number of active requests to it.
-// If more than one host has the same
-// least number of active requests, then
-// one of those is chosen at random.
-func leastRequests(upstreams []*Upstream) *Upstream {
-	if len(upstreams) == 0 {
-		return nil
+	uriPath, rawQuery, found := strings.Cut(uri, "?")
+	if !found || rawQuery == "" {
+		return uri
 	}
-	var best []*Upstream
-	bestReqs := -1
-	for _, upstream := range upstreams {
-		if upstream == nil {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return uri
+	}
+	filtered := url.Values{}
+	for name, vals := range values {
+		if len(include) > 0 {
+			if !matchesQueryParamPattern(include, name) {
+				continue
+			}
+		} else if matchesQueryParamPattern(ignore, name) {
 			continue
 		}
-		reqs := upstream.NumRequests()
-		if reqs == 0 {
-			return upstream
-		}
-		// If bestReqs was just initialized to -1
-		// we need to append upstream also
-		if reqs <= bestReqs || bestReqs == -1 {
-			bestReqs = reqs
-			best = append(best, upstream)
-		}
-	}
-	if len(best) == 0 {
-		return nil
+		filtered[name] = vals
 	}
-	if len(best) == 1 {
-		return best[0]
+	if len(filtered) == 0 {
+		return uriPath
 	}
-	return best[weakrand.Intn(len(best))] //nolint:gosec
+	return uriPath + "?" + filtered.Encode()
 }
 
-// hostByHashing returns an available host from pool based on a hashable string s.
-func hostByHashing(pool []*Upstream, s string) *Upstream {
-	// Highest Random Weight (HRW, or "Rendezvous") hashing,
-	// guarantees stability when the list of upstreams changes;
-	// see https://medium.com/i0exception/rendezvous-hashing-8c00e2fb58b0,
-	// https://randorithms.com/2020/12/26/rendezvous-hashing.html,
-	// and https://en.wikipedia.org/wiki/Rendezvous_hashing.
-	var highestHash uint64
-	var upstream *Upstream
-	for _, up := range pool {
-		if !up.Available() {
-			continue
-		}
-		h := hash(up.String() + s) // important to hash key and server together
-		if h > highestHash {
-			highestHash = h
-			upstream = up
+// matchesQueryParamPattern reports whether the parameter name matches
+// any of the patterns, each a literal name or a path.Match glob.
+func matchesQueryParamPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
 		}
 	}
-	return upstream
+	return false
 }
 
-// hash calculates a fast hash based on s.
-func hash(s string) uint64 {
-	h := xxhash.New()
-	_, _ = h.Write([]byte(s))
-	return h.Sum64()
-}
-
-func loadFallbackPolicy(d *caddyfile.Dispenser) (json.RawMessage, error) {
-	name := d.Val()
-	modID := "http.reverse_proxy.selection_policies." + name
-	unm, err := caddyfile.UnmarshalModule(d, modID)
-	if err != nil {
-		return nil, err
-	}
-	sel, ok := unm.(Selector)
-	if !ok {
-		return nil, d.Errf("module %s (%T) is not a reverseproxy.Selector", modID, unm)
+// validateQueryParamPatterns checks that every configured query
+// parameter pattern is a valid path.Match glob.
+func validateQueryParamPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid query parameter pattern '%s': %v", pattern, err)
+		}
 	}
-	return caddyconfig.JSONModuleObject(sel, "policy", name, nil), nil
+	return nil
 }
 
-// MementoSelection is a policy that selects a host
-// using the BinomialHash algorithm for optimal load distribution
-// and minimal redistribution when the topology changes.
-type MementoSelection struct {
-	// The field to use for hashing. Can be "ip", "uri", "header", etc.
-	// Defaults to "ip" if not specified.
+// RendezvousSelection is a policy that selects a host with Highest
+// Random Weight ("rendezvous") hashing over a configurable key source.
+// It generalizes ip_hash/uri_hash/etc. with virtual replicas: each
+// upstream is hashed Replicas times against the key and keeps its best
+// score, which smooths the load distribution on small pools at the
+// cost of proportionally more hashing per selection. Like all HRW
+// policies, removing one upstream only remaps the keys it owned.
+type RendezvousSelection struct {
+	// The field to use for hashing. Can be "ip", "client_ip", "uri"
+	// (or its variants "original_uri", "path_only", "path_and_query"),
+	// "header", or "query". Defaults to "ip" if not specified.
 	Field string `json:"field,omitempty"`
 
 	// The header field name if Field is "header"
 	HeaderField string `json:"header_field,omitempty"`
 
+	// The query parameter name if Field is "query"
+	QueryKey string `json:"query_key,omitempty"`
+
+	// Mask IPv4/IPv6 addresses to this many bits before hashing when
+	// Field is "ip" or "client_ip", so clients whose addresses rotate
+	// within one subnet keep their affinity. Defaults are 32 and 128
+	// (hash the full address).
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	// How many times to hash each upstream against the key. Higher
+	// values even out the per-upstream share of keys on small pools.
+	// Default is 1 (plain HRW).
+	Replicas int `json:"replicas,omitempty"`
+
 	// The fallback policy to use if the field is not present. Defaults to `random`.
 	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
 	fallback    Selector
 
-	// Internal state for consistent hashing
-	consistentEngine *ConsistentEngine
-	topology         sync.Map // Track which upstreams are currently available (map[*Upstream]bool, thread-safe)
-
-	// Event system integration
-	events *caddyevents.App
-	ctx    caddy.Context
+	verboseLogging
+	selectionTracing
 }
 
 // CaddyModule returns the Caddy module information.
-func (MementoSelection) CaddyModule() caddy.ModuleInfo {
+func (RendezvousSelection) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.memento",
-		New: func() caddy.Module { return new(MementoSelection) },
+		ID:  "http.reverse_proxy.selection_policies.rendezvous",
+		New: func() caddy.Module { return new(RendezvousSelection) },
 	}
 }
 
 // Provision sets up the module.
-func (s *MementoSelection) Provision(ctx caddy.Context) error {
+func (s *RendezvousSelection) Provision(ctx caddy.Context) error {
 	if s.Field == "" {
-		s.Field = "ip" // Default to IP-based hashing
+		s.Field = "ip"
+	}
+	if s.Replicas < 0 {
+		return fmt.Errorf("replicas must be positive, got %d", s.Replicas)
+	}
+	if s.Replicas == 0 {
+		s.Replicas = 1
+	}
+	if err := validateMaskBits(s.IPv4MaskBits, s.IPv6MaskBits); err != nil {
+		return err
 	}
-
 	if s.FallbackRaw == nil {
 		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
 	}
-	mod, err := ctx.LoadModule(s, "FallbackRaw")
+	fallback, err := loadFallbackSelector(ctx, s, "rendezvous", s.FallbackRaw)
 	if err != nil {
 		return fmt.Errorf("loading fallback selection policy: %s", err)
 	}
-	s.fallback = mod.(Selector)
-
-	// Initialize topology tracking (sync.Map is zero-initialized, no need to initialize)
-
-	// Initialize consistent engine
-	// ConsistentEngine creates MementoEngine internally, which in turn creates BinomialEngine
-	// This architecture allows for arbitrary node removals while maintaining consistency
-	s.consistentEngine = NewConsistentEngineWithType(true)
-
-	// Set up event system integration
-	s.ctx = ctx
-
-	// Note: Event subscription will be handled by the reverse proxy handler
-	// when it provisions this selection policy, not during our Provision phase
-
-	return nil
-}
-
-// Select returns an available host, if any.
-func (s MementoSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
-	if len(pool) == 0 {
-		return nil
+	s.fallback = markFallback(fallback)
+	if err := s.provisionVerboseLogging(ctx, s); err != nil {
+		return err
 	}
+	return s.provisionSelectionTracing()
+}
 
-	// Get the key to hash based on the field type
-	var key string
+// requestKey extracts the hash key for the request according to the
+// configured Field. The second return value is false when no key can
+// be derived (unknown field, or a missing header or query parameter),
+// in which case the caller should defer to the fallback policy.
+func (s RendezvousSelection) requestKey(req *http.Request) (string, bool) {
 	switch s.Field {
 	case "ip":
 		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
 		if err != nil {
 			clientIP = req.RemoteAddr
 		}
-		key = clientIP
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
 	case "client_ip":
-		address := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string)
+		address := clientIPVarOrRemoteAddr(req)
 		clientIP, _, err := net.SplitHostPort(address)
 		if err != nil {
 			clientIP = address
 		}
-		key = clientIP
-	case "uri":
-		key = req.RequestURI
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "uri", "original_uri", "path_only", "path_and_query":
+		return uriHashKey(req, s.Field), true
 	case "header":
 		if s.HeaderField == "" {
-			return s.fallback.Select(pool, req, w)
+			return "", false
 		}
+		var key string
 		if s.HeaderField == "Host" && req.Host != "" {
 			key = req.Host
 		} else {
 			key = req.Header.Get(s.HeaderField)
 		}
 		if key == "" {
-			return s.fallback.Select(pool, req, w)
+			return "", false
 		}
-	default:
-		return s.fallback.Select(pool, req, w)
+		return transformHashInput(key, s.HashInput, s.HashSecret), true
+	case "query":
+		if s.QueryKey == "" {
+			return "", false
+		}
+		// join multiple values so clients can't steer selection by
+		// repeating the parameter; see QueryHashSelection.Select
+		vals := strings.Join(req.URL.Query()[s.QueryKey], ",")
+		return vals, vals != ""
 	}
+	return "", false
+}
 
-	// Use consistent engine with Memento for stable hashing (default)
-	// If the engine is not yet initialized with topology (e.g., no events in tests),
-	// fall back to random selection.
+// bestReplica runs HRW over the pool with s.Replicas virtual replicas
+// per upstream, skipping hosts in tried (may be nil), and returns the
+// winner along with its winning combined hash.
+func (s RendezvousSelection) bestReplica(pool UpstreamPool, key string, tried map[*Upstream]struct{}) (*Upstream, uint64) {
+	var highestHash uint64
 	var upstream *Upstream
-
-	// No lock needed: Indirection and topology are now thread-safe (sync.Map)
-	if s.consistentEngine == nil || s.consistentEngine.Size() == 0 {
-		// Fallback: use random selection if engine not initialized
-		return s.fallback.Select(pool, req, w)
+	for _, up := range pool {
+		if _, ok := tried[up]; ok {
+			continue
+		}
+		if up == nil || !up.Available() {
+			continue
+		}
+		for replica := 0; replica < s.Replicas; replica++ {
+			h := hash(up.hashKey() + "#" + strconv.Itoa(replica) + key)
+			if h > highestHash || (h == highestHash && upstream != up && hrwTieBreak(upstream, up)) {
+				highestHash = h
+				upstream = up
+			}
+		}
 	}
+	return upstream, highestHash
+}
 
-	// Get node from consistent engine
-	upstream = s.consistentEngine.GetBucket(key)
-
-	if upstream == nil {
-		// Bucket index doesn't map to a valid node - this shouldn't happen
-		// but we fallback to random selection to be safe
-		return s.fallback.Select(pool, req, w)
+// Select returns an available host, if any.
+func (s RendezvousSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	key, ok := s.requestKey(req)
+	if !ok {
+		upstream := selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+		s.traceSelection("rendezvous", key, upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("rendezvous", key, upstream, true)
+		}
+		return upstream
+	}
+	upstream, _ := s.bestReplica(pool, key, nil)
+	s.traceSelection("rendezvous", key, upstream)
+	if s.verboseLogEnabled() {
+		s.logSelection("rendezvous", key, upstream, false)
 	}
+	return upstream
+}
 
-	if upstream.Available() {
-		return upstream
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request; the key deterministically falls to the
+// next-highest scoring host among those remaining.
+func (s RendezvousSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+			return selectViaFallback(s.fallback, p, req, w, selectionFallbackKeyMissing)
+		})
 	}
+	upstream, _ := s.bestReplica(pool, key, tried)
+	return upstream
+}
 
-	// Node ID not found in pool - this can happen if topology and pool are out of sync
-	// Fallback to random selection
-	return s.fallback.Select(pool, req, w)
+// Preview explains which upstream the given key maps to.
+func (s RendezvousSelection) Preview(pool UpstreamPool, key string) SelectionExplanation {
+	upstream, winning := s.bestReplica(pool, key, nil)
+	expl := SelectionExplanation{Policy: "rendezvous", Key: key, Hash: winning}
+	if upstream != nil {
+		expl.Upstream = upstream.String()
+	}
+	return expl
 }
 
 // UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (s *MementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+func (s *RendezvousSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	d.Next() // consume policy name
 
 	// Parse field type
@@ -1032,6 +2241,41 @@ func (s *MementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			s.HeaderField = d.Val()
+		case "query_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.QueryKey = d.Val()
+		case "ipv4_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv6MaskBits = bits
+		case "replicas":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			replicas, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid replicas '%s': %v", d.Val(), err)
+			}
+			if replicas < 1 {
+				return d.Errf("invalid replicas '%s': must be at least 1", d.Val())
+			}
+			s.Replicas = replicas
 		case "fallback":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -1043,205 +2287,6369 @@ func (s *MementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if err != nil {
 				return err
 			}
-			s.FallbackRaw = mod
-		default:
-			return d.Errf("unrecognized option '%s'", d.Val())
+			s.FallbackRaw = mod
+		default:
+			handled, err := s.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = s.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalHashOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalAvailabilityOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// validateHashInput checks a policy's hash_input configuration:
+// "raw" (the default) feeds the extracted value to the hash unchanged,
+// "sha256" digests it first, and "hmac" keys the digest with a secret,
+// which is then required. Digesting keeps PII such as email addresses
+// out of the hashing stage and out of any logging of selection keys.
+func validateHashInput(mode, secret string) error {
+	switch mode {
+	case "", "raw", "sha256":
+	case "hmac":
+		if secret == "" {
+			return fmt.Errorf("hash_input 'hmac' requires a secret")
+		}
+	default:
+		return fmt.Errorf("unrecognized hash_input '%s': must be 'raw', 'sha256', or 'hmac'", mode)
+	}
+	return nil
+}
+
+// transformHashInput applies the configured hash_input mode to an
+// extracted key. The result is deterministic for a given mode and
+// secret, so mappings stay stable across restarts.
+func transformHashInput(key, mode, secret string) string {
+	switch mode {
+	case "sha256":
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	case "hmac":
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(key))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	return key
+}
+
+// headerHashValue extracts the hash value for the named header from
+// the request. With joinValues every value is joined with ","
+// (otherwise only the first counts, matching Header.Get), and with
+// canonicalize each value is whitespace-trimmed and lowercased first,
+// so spelling variations like "Acme" and "acme " map to the same
+// upstream. A header that is present but carries only empty values
+// counts as absent, so the caller's fallback runs.
+func headerHashValue(req *http.Request, field string, joinValues, canonicalize bool) (string, bool) {
+	// The Host header should be obtained from the req.Host field
+	// since net/http removes it from the header map.
+	vals := req.Header.Values(field)
+	if field == "Host" && req.Host != "" {
+		vals = []string{req.Host}
+	}
+	if !joinValues && len(vals) > 1 {
+		vals = vals[:1]
+	}
+	parts := make([]string, 0, len(vals))
+	for _, val := range vals {
+		if canonicalize {
+			val = strings.ToLower(strings.TrimSpace(val))
+		}
+		if val == "" {
+			continue
+		}
+		parts = append(parts, val)
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, ","), true
+}
+
+// QueryHashSelection is a policy that selects
+// a host based on a given request query parameter.
+type QueryHashSelection struct {
+	// The query key whose value is to be hashed and used for upstream selection.
+	Key string `json:"key,omitempty"`
+
+	// The weight of each upstream in order, corresponding with the list
+	// of upstreams configured. If set, hashing is biased so the share of
+	// keys owned by each upstream approximates the weight ratios, while
+	// keeping per-key affinity. A missing weight defaults to 1 and a
+	// zero weight excludes the upstream.
+	Weights []int `json:"weights,omitempty"`
+
+	// How to treat the extracted value before hashing: "raw" (the
+	// default) hashes it as-is, "sha256" hashes its digest, and "hmac"
+	// hashes a keyed digest using HashSecret, keeping sensitive values
+	// out of the hashing stage and key logging.
+	HashInput string `json:"hash_input,omitempty"`
+
+	// The secret for the "hmac" hash input mode. Required when that
+	// mode is chosen; the same secret yields the same mapping across
+	// restarts and instances.
+	HashSecret string `json:"hash_secret,omitempty"`
+
+	// The fallback policy to use if the query key is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+
+	verboseLogging
+	selectionTracing
+	hashFunctionChooser
+	availabilityChooser
+	overrideChooser
+}
+
+// CaddyModule returns the Caddy module information.
+func (QueryHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.query",
+		New: func() caddy.Module { return new(QueryHashSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *QueryHashSelection) Provision(ctx caddy.Context) error {
+	if s.Key == "" {
+		return fmt.Errorf("query key is required")
+	}
+	for _, weight := range s.Weights {
+		if weight < 0 {
+			return fmt.Errorf("invalid weight %d: weight should be non-negative", weight)
+		}
+	}
+	if err := validateHashInput(s.HashInput, s.HashSecret); err != nil {
+		return err
+	}
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "query", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+	if err := s.provisionHashFunction(); err != nil {
+		return err
+	}
+	if err := s.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := s.provisionOverrides(ctx); err != nil {
+		return err
+	}
+	if err := s.provisionVerboseLogging(ctx, s); err != nil {
+		return err
+	}
+	return s.provisionSelectionTracing()
+}
+
+// requestKey returns the joined (and optionally digested) query
+// values that this policy hashes, or false if the query key is absent.
+func (s QueryHashSelection) requestKey(req *http.Request) (string, bool) {
+	// Since the query may have multiple values for the same key,
+	// we'll join them to avoid a problem where the user can control
+	// the upstream that the request goes to by sending multiple values
+	// for the same key, when the upstream only considers the first value.
+	// Keep in mind that a client changing the order of the values may
+	// affect which upstream is selected, but this is a semantically
+	// different request, because the order of the values is significant.
+	vals := strings.Join(req.URL.Query()[s.Key], ",")
+	if vals == "" {
+		return "", false
+	}
+	return transformHashInput(vals, s.HashInput, s.HashSecret), true
+}
+
+// Select returns an available host, if any.
+func (s QueryHashSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	vals, ok := s.requestKey(req)
+	if !ok {
+		upstream := selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+		s.traceSelection("query", vals, upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("query", vals, upstream, true)
+		}
+		return upstream
+	}
+	if upstream, ok := s.overrideFor(vals, pool, s.Availability); ok {
+		return upstream
+	}
+	return s.SelectByKey(pool, vals)
+}
+
+// SelectByKey resolves an already-extracted (and optionally digested)
+// query value against the pool, without touching a request.
+func (s QueryHashSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	var upstream *Upstream
+	if len(s.Weights) > 0 {
+		upstream, _ = hostByHashingWeightedWith(pool, key, s.hashFn, s.Availability, s.Weights, nil)
+	} else {
+		upstream, _ = hostByHashingWith(pool, key, s.hashFn, s.Availability, nil)
+	}
+	s.traceSelection("query", key, upstream)
+	if s.verboseLogEnabled() {
+		s.logSelection("query", key, upstream, false)
+	}
+	return upstream
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request; the key deterministically falls to the
+// next-highest scoring host among those remaining.
+func (s QueryHashSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	vals, ok := s.requestKey(req)
+	if !ok {
+		return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+			return selectViaFallback(s.fallback, p, req, w, selectionFallbackKeyMissing)
+		})
+	}
+	var upstream *Upstream
+	if len(s.Weights) > 0 {
+		upstream, _ = hostByHashingWeightedWith(pool, vals, s.hashFn, s.Availability, s.Weights, tried)
+	} else {
+		upstream, _ = hostByHashingWith(pool, vals, s.hashFn, s.Availability, tried)
+	}
+	return upstream
+}
+
+// Preview explains which upstream the given query value maps to.
+func (s QueryHashSelection) Preview(pool UpstreamPool, key string) SelectionExplanation {
+	return previewByHashing("query", pool, key, s.hashFn, s.Availability, s.Weights)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (s *QueryHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Key = d.Val()
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "weights":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, weight := range args {
+				weightInt, err := strconv.Atoi(weight)
+				if err != nil {
+					return d.Errf("invalid weight value '%s': %v", weight, err)
+				}
+				if weightInt < 0 {
+					return d.Errf("invalid weight value '%s': weight should be non-negative", weight)
+				}
+				s.Weights = append(s.Weights, weightInt)
+			}
+		case "hash_input":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HashInput = d.Val()
+			if d.NextArg() {
+				s.HashSecret = d.Val()
+			}
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		default:
+			handled, err := s.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = s.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalHashOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalAvailabilityOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalOverrideOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// JumpHashSelection is a policy that selects a host by applying the
+// Lamping-Veach jump consistent hash to a request key, computed over
+// the available upstreams in pool order. It keeps no state at all —
+// the mapping is a pure function of the key and the upstream count —
+// so it is a lighter-weight alternative to memento for pools that only
+// grow and shrink at the tail (e.g. a scaled stateful set): adding or
+// removing the last upstream moves only the minimal share of keys.
+//
+// The trade-off is that jump hash has no notion of which upstream
+// left: removing or losing an upstream in the middle of the pool
+// shifts every later upstream down one position and reshuffles far
+// more keys than memento would. Use memento when arbitrary upstreams
+// can come and go; use jump_hash when churn is tail-only and the
+// per-request cost and memory footprint matter most.
+type JumpHashSelection struct {
+	// The field to use for hashing. Can be "ip" (the default),
+	// "client_ip", "uri", "header", "query", or one of the URI
+	// variants also supported by uri_hash: "original_uri" (the URI
+	// before any rewrites), "path_only", or "path_and_query".
+	Field string `json:"field,omitempty"`
+
+	// The header field name if Field is "header"
+	HeaderField string `json:"header_field,omitempty"`
+
+	// The query key whose values are joined into the hash key if
+	// Field is "query".
+	QueryKey string `json:"query_key,omitempty"`
+
+	// How to treat header- and query-derived keys before hashing:
+	// "raw" (the default) hashes the value as-is, "sha256" hashes its
+	// digest, and "hmac" hashes a keyed digest using HashSecret,
+	// keeping sensitive values out of the hashing stage and key
+	// logging.
+	HashInput string `json:"hash_input,omitempty"`
+
+	// The secret for the "hmac" hash input mode. Required when that
+	// mode is chosen; the same secret yields the same mapping across
+	// restarts and instances.
+	HashSecret string `json:"hash_secret,omitempty"`
+
+	// Mask IPv4/IPv6 addresses to this many bits before hashing when
+	// Field is "ip" or "client_ip", so clients whose addresses rotate
+	// within one subnet keep their affinity. Defaults are 32 and 128
+	// (hash the full address).
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	// The fallback policy to use if the field is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+
+	verboseLogging
+	selectionTracing
+}
+
+// CaddyModule returns the Caddy module information.
+func (JumpHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.jump_hash",
+		New: func() caddy.Module { return new(JumpHashSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *JumpHashSelection) Provision(ctx caddy.Context) error {
+	if s.Field == "" {
+		s.Field = "ip"
+	}
+	switch s.Field {
+	case "ip", "client_ip", "uri", "original_uri", "path_only", "path_and_query":
+	case "header":
+		if s.HeaderField == "" {
+			return fmt.Errorf("field 'header' requires a header_field")
+		}
+	case "query":
+		if s.QueryKey == "" {
+			return fmt.Errorf("field 'query' requires a query_key")
+		}
+	default:
+		return fmt.Errorf("unrecognized field '%s': must be one of 'ip', 'client_ip', 'uri', 'original_uri', 'path_only', 'path_and_query', 'header', or 'query'", s.Field)
+	}
+	if err := validateMaskBits(s.IPv4MaskBits, s.IPv6MaskBits); err != nil {
+		return err
+	}
+	if err := validateHashInput(s.HashInput, s.HashSecret); err != nil {
+		return err
+	}
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "jump_hash", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+	if err := s.provisionVerboseLogging(ctx, s); err != nil {
+		return err
+	}
+	return s.provisionSelectionTracing()
+}
+
+// requestKey extracts the hash key for the request according to the
+// configured Field. The second return value is false when no key can
+// be derived (unknown field, or a missing header or query key), in
+// which case the caller should defer to the fallback policy.
+func (s JumpHashSelection) requestKey(req *http.Request) (string, bool) {
+	switch s.Field {
+	case "ip":
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "client_ip":
+		address := clientIPVarOrRemoteAddr(req)
+		clientIP, _, err := net.SplitHostPort(address)
+		if err != nil {
+			clientIP = address
+		}
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "uri", "original_uri", "path_only", "path_and_query":
+		return uriHashKey(req, s.Field), true
+	case "header":
+		if s.HeaderField == "" {
+			return "", false
+		}
+		var key string
+		if s.HeaderField == "Host" && req.Host != "" {
+			key = req.Host
+		} else {
+			key = req.Header.Get(s.HeaderField)
+		}
+		if key == "" {
+			return "", false
+		}
+		return transformHashInput(key, s.HashInput, s.HashSecret), true
+	case "query":
+		if s.QueryKey == "" {
+			return "", false
+		}
+		// join multiple values so clients cannot steer selection by
+		// repeating the key (same reasoning as the query policy)
+		vals := strings.Join(req.URL.Query()[s.QueryKey], ",")
+		if vals == "" {
+			return "", false
+		}
+		return transformHashInput(vals, s.HashInput, s.HashSecret), true
+	}
+	return "", false
+}
+
+// Select returns an available host, if any.
+func (s JumpHashSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	key, ok := s.requestKey(req)
+	if !ok {
+		upstream := selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+		s.traceSelection("jump_hash", key, upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("jump_hash", key, upstream, true)
+		}
+		return upstream
+	}
+	upstream := s.SelectByKey(pool, key)
+	if upstream == nil {
+		upstream = selectViaFallback(s.fallback, pool, req, w, selectionFallbackUnavailable)
+		s.traceSelection("jump_hash", key, upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("jump_hash", key, upstream, true)
+		}
+	}
+	return upstream
+}
+
+// SelectByKey resolves an already-extracted key against the available
+// pool, without touching a request. It returns nil when no upstream is
+// available; request-path callers then defer to the fallback policy.
+func (s JumpHashSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	upstream := jumpHashHost(pool, key, nil)
+	if upstream == nil {
+		return nil
+	}
+	s.traceSelection("jump_hash", key, upstream)
+	if s.verboseLogEnabled() {
+		s.logSelection("jump_hash", key, upstream, false)
+	}
+	return upstream
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request; the key is re-jumped over the remaining
+// hosts, so the retry target is deterministic for the key.
+func (s JumpHashSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+			return selectViaFallback(s.fallback, p, req, w, selectionFallbackKeyMissing)
+		})
+	}
+	if upstream := jumpHashHost(pool, key, tried); upstream != nil {
+		return upstream
+	}
+	return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+		return selectViaFallback(s.fallback, p, req, w, selectionFallbackUnavailable)
+	})
+}
+
+// Preview explains which upstream the given key maps to, including the
+// jump hash bucket (the key's index among the available upstreams in
+// pool order).
+func (s JumpHashSelection) Preview(pool UpstreamPool, key string) SelectionExplanation {
+	expl := SelectionExplanation{Policy: "jump_hash", Key: key}
+	available := make(UpstreamPool, 0, len(pool))
+	for _, upstream := range pool {
+		if upstream != nil && upstream.Available() {
+			available = append(available, upstream)
+		}
+	}
+	if len(available) == 0 {
+		return expl
+	}
+	bucket := jumpHash(hash(key), len(available))
+	expl.Bucket = &bucket
+	expl.Upstream = available[bucket].String()
+	return expl
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (s *JumpHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	// Parse field type
+	if d.NextArg() {
+		s.Field = d.Val()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Field = d.Val()
+		case "header_field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HeaderField = d.Val()
+		case "query_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.QueryKey = d.Val()
+		case "hash_input":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HashInput = d.Val()
+			if d.NextArg() {
+				s.HashSecret = d.Val()
+			}
+		case "ipv4_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv6MaskBits = bits
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		default:
+			handled, err := s.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = s.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// jumpHashHost maps the key onto the available (and untried, when a
+// tried set is given) upstreams in pool order using jump consistent
+// hashing. Returns nil when no upstream qualifies.
+func jumpHashHost(pool UpstreamPool, key string, tried map[*Upstream]struct{}) *Upstream {
+	available := make(UpstreamPool, 0, len(pool))
+	for _, upstream := range pool {
+		if _, skip := tried[upstream]; skip || upstream == nil || !upstream.Available() {
+			continue
+		}
+		available = append(available, upstream)
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	return available[jumpHash(hash(key), len(available))]
+}
+
+// jumpHash is the Lamping-Veach jump consistent hash: it maps the key
+// to a bucket in [0, numBuckets) such that changing the bucket count
+// from n to n+1 moves only 1/(n+1) of the keys — and always onto the
+// new last bucket. numBuckets must be positive.
+func jumpHash(key uint64, numBuckets int) int {
+	var bucket, next int64 = -1, 0
+	for next < int64(numBuckets) {
+		bucket = next
+		key = key*2862933555777941757 + 1
+		next = int64(float64(bucket+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(bucket)
+}
+
+// HeaderHashSelection is a policy that selects
+// a host based on a given request header.
+type HeaderHashSelection struct {
+	// The HTTP header field whose value is to be hashed and used for upstream selection.
+	Field string `json:"field,omitempty"`
+
+	// The weight of each upstream in order, corresponding with the list
+	// of upstreams configured. If set, hashing is biased so the share of
+	// keys owned by each upstream approximates the weight ratios, while
+	// keeping per-key affinity. A missing weight defaults to 1 and a
+	// zero weight excludes the upstream.
+	Weights []int `json:"weights,omitempty"`
+
+	// How to treat the extracted value before hashing: "raw" (the
+	// default) hashes it as-is, "sha256" hashes its digest, and "hmac"
+	// hashes a keyed digest using HashSecret, keeping sensitive values
+	// such as email addresses out of the hashing stage and key logging.
+	HashInput string `json:"hash_input,omitempty"`
+
+	// The secret for the "hmac" hash input mode. Required when that
+	// mode is chosen; the same secret yields the same mapping across
+	// restarts and instances.
+	HashSecret string `json:"hash_secret,omitempty"`
+
+	// Whether to hash all values of the header joined with ",". By
+	// default only the first value counts.
+	JoinValues bool `json:"join_values,omitempty"`
+
+	// Whether to trim whitespace and lowercase each header value
+	// before hashing, so spelling variations of the same logical
+	// value ("Acme" vs "acme") map to the same upstream. Opt-in
+	// because enabling it changes existing mappings.
+	Canonicalize bool `json:"canonicalize,omitempty"`
+
+	// The fallback policy to use if the header is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+
+	verboseLogging
+	selectionTracing
+	hashFunctionChooser
+	availabilityChooser
+	overrideChooser
+}
+
+// CaddyModule returns the Caddy module information.
+func (HeaderHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.header",
+		New: func() caddy.Module { return new(HeaderHashSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *HeaderHashSelection) Provision(ctx caddy.Context) error {
+	if s.Field == "" {
+		return fmt.Errorf("header field is required")
+	}
+	for _, weight := range s.Weights {
+		if weight < 0 {
+			return fmt.Errorf("invalid weight %d: weight should be non-negative", weight)
+		}
+	}
+	if err := validateHashInput(s.HashInput, s.HashSecret); err != nil {
+		return err
+	}
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "header", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+	if err := s.provisionHashFunction(); err != nil {
+		return err
+	}
+	if err := s.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := s.provisionOverrides(ctx); err != nil {
+		return err
+	}
+	if err := s.provisionVerboseLogging(ctx, s); err != nil {
+		return err
+	}
+	return s.provisionSelectionTracing()
+}
+
+// requestKey returns the (optionally joined, canonicalized, and
+// digested) header value that this policy hashes, or false if the
+// header field is absent or empty.
+func (s HeaderHashSelection) requestKey(req *http.Request) (string, bool) {
+	val, ok := headerHashValue(req, s.Field, s.JoinValues, s.Canonicalize)
+	if !ok {
+		return "", false
+	}
+	return transformHashInput(val, s.HashInput, s.HashSecret), true
+}
+
+// Select returns an available host, if any.
+func (s HeaderHashSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	val, ok := s.requestKey(req)
+	if !ok {
+		upstream := selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+		s.traceSelection("header", val, upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("header", val, upstream, true)
+		}
+		return upstream
+	}
+	if upstream, ok := s.overrideFor(val, pool, s.Availability); ok {
+		return upstream
+	}
+	return s.SelectByKey(pool, val)
+}
+
+// SelectByKey resolves an already-extracted (and optionally digested)
+// header value against the pool, without touching a request.
+func (s HeaderHashSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	var upstream *Upstream
+	if len(s.Weights) > 0 {
+		upstream, _ = hostByHashingWeightedWith(pool, key, s.hashFn, s.Availability, s.Weights, nil)
+	} else {
+		upstream, _ = hostByHashingWith(pool, key, s.hashFn, s.Availability, nil)
+	}
+	s.traceSelection("header", key, upstream)
+	if s.verboseLogEnabled() {
+		s.logSelection("header", key, upstream, false)
+	}
+	return upstream
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request; the key deterministically falls to the
+// next-highest scoring host among those remaining.
+func (s HeaderHashSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	val, ok := s.requestKey(req)
+	if !ok {
+		return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+			return selectViaFallback(s.fallback, p, req, w, selectionFallbackKeyMissing)
+		})
+	}
+	var upstream *Upstream
+	if len(s.Weights) > 0 {
+		upstream, _ = hostByHashingWeightedWith(pool, val, s.hashFn, s.Availability, s.Weights, tried)
+	} else {
+		upstream, _ = hostByHashingWith(pool, val, s.hashFn, s.Availability, tried)
+	}
+	return upstream
+}
+
+// Preview explains which upstream the given header value maps to.
+func (s HeaderHashSelection) Preview(pool UpstreamPool, key string) SelectionExplanation {
+	return previewByHashing("header", pool, key, s.hashFn, s.Availability, s.Weights)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (s *HeaderHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Field = d.Val()
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "weights":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, weight := range args {
+				weightInt, err := strconv.Atoi(weight)
+				if err != nil {
+					return d.Errf("invalid weight value '%s': %v", weight, err)
+				}
+				if weightInt < 0 {
+					return d.Errf("invalid weight value '%s': weight should be non-negative", weight)
+				}
+				s.Weights = append(s.Weights, weightInt)
+			}
+		case "hash_input":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HashInput = d.Val()
+			if d.NextArg() {
+				s.HashSecret = d.Val()
+			}
+		case "join_values":
+			s.JoinValues = true
+		case "canonicalize":
+			s.Canonicalize = true
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		default:
+			handled, err := s.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = s.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalHashOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalAvailabilityOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalOverrideOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// CookieHashSelection is a policy that selects
+// a host based on a given cookie name.
+type CookieHashSelection struct {
+	// The HTTP cookie name whose value is to be hashed and used for upstream selection.
+	Name string `json:"name,omitempty"`
+	// Secret to hash (Hmac256) chosen upstream in cookie
+	Secret string `json:"secret,omitempty"`
+	// The cookie's Max-Age before it expires. Default is no expiry.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// What to do when the cookie matches an upstream that exists but is
+	// currently unavailable. The default, "rehome", selects a new host
+	// with the fallback policy and overwrites the cookie, permanently
+	// moving the client. "temporary" also serves this request from a
+	// fallback host but keeps the original cookie, so the client returns
+	// to its home upstream once it recovers. A cookie that matches no
+	// upstream at all is always re-pinned regardless of this setting.
+	StickyOnFailure string `json:"sticky_on_failure,omitempty"`
+
+	// A salt mixed into the cookie's HMAC, so a cookie issued by one
+	// site is not a valid affinity token on another site sharing the
+	// same upstream pool. If empty, the request's Host (the site
+	// address) is used, which isolates sites automatically but re-pins
+	// clients that switch between hosts of the same site; set an
+	// explicit salt to share cookies across such hosts. Ignored in
+	// compat_mode.
+	Salt string `json:"salt,omitempty"`
+
+	// Compatibility mode: compute unsalted cookie hashes exactly like
+	// older versions did, so live affinity cookies stay valid across
+	// an upgrade. Disables salting entirely.
+	CompatMode bool `json:"compat_mode,omitempty"`
+
+	// Maps upstream dial addresses to an override identity used instead
+	// of the dial address when computing and verifying the cookie HMAC.
+	// Two upstreams may intentionally share an identity during a
+	// blue/green cutover window, so cookies issued against the old
+	// deployment keep matching its replacement with no re-pinning.
+	StickyIDs map[string]string `json:"sticky_ids,omitempty"`
+
+	// Which upstream wins when several available upstreams share a
+	// sticky identity: "last" (the default) prefers the one later in
+	// pool order, i.e. the newer deployment during a cutover; "first"
+	// prefers the earlier one.
+	Prefer string `json:"prefer,omitempty"`
+
+	// The fallback policy to use if the cookie is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+
+	verboseLogging
+	selectionTracing
+}
+
+// CaddyModule returns the Caddy module information.
+func (CookieHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.cookie",
+		New: func() caddy.Module { return new(CookieHashSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *CookieHashSelection) Provision(ctx caddy.Context) error {
+	if s.Name == "" {
+		s.Name = "lb"
+	}
+	switch s.StickyOnFailure {
+	case "", "rehome":
+		s.StickyOnFailure = "rehome"
+	case "temporary":
+	default:
+		return fmt.Errorf("unrecognized sticky_on_failure '%s': must be 'rehome' or 'temporary'", s.StickyOnFailure)
+	}
+	switch s.Prefer {
+	case "", "last":
+		s.Prefer = "last"
+	case "first":
+	default:
+		return fmt.Errorf("unrecognized prefer '%s': must be 'first' or 'last'", s.Prefer)
+	}
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "cookie", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+	if err := s.provisionVerboseLogging(ctx, s); err != nil {
+		return err
+	}
+	return s.provisionSelectionTracing()
+}
+
+// cookieSalt returns the salt mixed into the cookie HMAC for this
+// request: the configured salt, or the request's Host (the site
+// address) by default. Empty in compat_mode, which preserves the
+// unsalted hashes of older versions.
+func (s CookieHashSelection) cookieSalt(req *http.Request) string {
+	if s.CompatMode {
+		return ""
+	}
+	if s.Salt != "" {
+		return s.Salt
+	}
+	return req.Host
+}
+
+// stickyID returns the identity hashed into an upstream's sticky
+// cookie: the configured override for its dial address, if any, or
+// its general hash key. Overrides may be shared by two upstreams
+// during a blue/green cutover so cookies issued against the old
+// deployment keep matching its replacement.
+func (s CookieHashSelection) stickyID(upstream *Upstream) string {
+	if id, ok := s.StickyIDs[upstream.Dial]; ok {
+		return id
+	}
+	return upstream.hashKey()
+}
+
+// saltedCookieHash hashes the upstream identity with the policy
+// secret, mixing in the salt when present; an empty salt produces
+// the historical unsalted value.
+func saltedCookieHash(secret, salt, data string) (string, error) {
+	if salt != "" {
+		data = salt + "|" + data
+	}
+	return hashCookie(secret, data)
+}
+
+// Select returns an available host, if any.
+func (s CookieHashSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	salt := s.cookieSalt(req)
+	// selects a new Host using the fallback policy (typically random)
+	// and write a sticky session cookie to the response.
+	selectNewHost := func(cause string) *Upstream {
+		upstream := selectViaFallback(s.fallback, pool, req, w, cause)
+		if upstream == nil {
+			return nil
+		}
+		sha, err := saltedCookieHash(s.Secret, salt, s.stickyID(upstream))
+		if err != nil {
+			return upstream
+		}
+		cookie := &http.Cookie{
+			Name:   s.Name,
+			Value:  sha,
+			Path:   "/",
+			Secure: false,
+		}
+		isProxyHttps := false
+		if trusted, ok := caddyhttp.GetVar(req.Context(), caddyhttp.TrustedProxyVarKey).(bool); ok && trusted {
+			xfp, xfpOk, _ := lastHeaderValue(req.Header, "X-Forwarded-Proto")
+			isProxyHttps = xfpOk && xfp == "https"
+		}
+		if req.TLS != nil || isProxyHttps {
+			cookie.Secure = true
+			cookie.SameSite = http.SameSiteNoneMode
+		}
+		if s.MaxAge > 0 {
+			cookie.MaxAge = int(time.Duration(s.MaxAge).Seconds())
+		}
+		// no response to write the cookie to when selection runs
+		// outside the request path (e.g. as a memento fallback)
+		if w != nil {
+			http.SetCookie(w, cookie)
+		}
+		return upstream
+	}
+
+	cookie, err := req.Cookie(s.Name)
+	// If there's no cookie, select a host using the fallback policy
+	if err != nil || cookie == nil {
+		upstream := selectNewHost(selectionFallbackKeyMissing)
+		s.traceSelection("cookie", "", upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("cookie", "", upstream, true)
+		}
+		return upstream
+	}
+	// If the cookie is present, loop over the upstreams looking for a
+	// match, remembering whether a match exists but is unavailable.
+	// Several upstreams may share a sticky identity during a blue/green
+	// cutover; by default the later available match in pool order (the
+	// newer deployment) wins.
+	cookieValue := cookie.Value
+	var matched *Upstream
+	matchedUnavailable := false
+	for _, upstream := range pool {
+		if upstream == nil {
+			continue
+		}
+		sha, err := saltedCookieHash(s.Secret, salt, s.stickyID(upstream))
+		if err != nil || sha != cookieValue {
+			continue
+		}
+		if !upstream.Available() {
+			matchedUnavailable = true
+			continue
+		}
+		matched = upstream
+		if s.Prefer == "first" {
+			break
+		}
+	}
+	if matched != nil {
+		s.traceSelection("cookie", cookieValue, matched)
+		if s.verboseLogEnabled() {
+			s.logSelection("cookie", cookieValue, matched, false)
+		}
+		return matched
+	}
+	// If the pinned host exists but is down and the policy is to stay
+	// sticky, serve this request from another host without rewriting the
+	// cookie so the client returns home once the upstream recovers
+	if matchedUnavailable && s.StickyOnFailure == "temporary" {
+		upstream := selectViaFallback(s.fallback, pool, req, w, selectionFallbackUnavailable)
+		s.traceSelection("cookie", cookieValue, upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("cookie", cookieValue, upstream, true)
+		}
+		return upstream
+	}
+	// Otherwise select a host using the fallback policy and re-pin the
+	// client to it: because the pinned host is down, or because the
+	// cookie no longer matches any host in the pool
+	cause := selectionFallbackNodeMissing
+	if matchedUnavailable {
+		cause = selectionFallbackUnavailable
+	}
+	upstream := selectNewHost(cause)
+	s.traceSelection("cookie", cookieValue, upstream)
+	if s.verboseLogEnabled() {
+		s.logSelection("cookie", cookieValue, upstream, true)
+	}
+	return upstream
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request. The pinned host is among the tried ones by
+// definition, so this behaves as if it were unavailable: with
+// sticky_on_failure 'temporary' the cookie is left alone, otherwise
+// the client is re-pinned to whichever host serves the retry.
+func (s CookieHashSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	if s.StickyOnFailure == "temporary" {
+		if cookie, err := req.Cookie(s.Name); err == nil && cookie != nil {
+			salt := s.cookieSalt(req)
+			for _, upstream := range pool {
+				if upstream == nil {
+					continue
+				}
+				sha, err := saltedCookieHash(s.Secret, salt, s.stickyID(upstream))
+				if err != nil || sha != cookie.Value {
+					continue
+				}
+				if _, ok := tried[upstream]; ok {
+					return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+						return selectViaFallback(s.fallback, p, req, w, selectionFallbackUnavailable)
+					})
+				}
+			}
+		}
+	}
+	return selectExcluding(pool, tried, func(p UpstreamPool) *Upstream {
+		return s.Select(p, req, w)
+	})
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy cookie [<name> [<secret>]] {
+//		fallback <policy>
+//		max_age <duration>
+//		sticky_on_failure rehome|temporary
+//		salt <salt>
+//		compat_mode
+//		sticky_id <dial> <id>
+//		prefer first|last
+//	}
+//
+// By default name is `lb`
+func (s *CookieHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 1:
+	case 2:
+		s.Name = args[1]
+	case 3:
+		s.Name = args[1]
+		s.Secret = args[2]
+	default:
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		case "max_age":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.MaxAge != 0 {
+				return d.Err("cookie max_age already specified")
+			}
+			maxAge, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid duration: %s", d.Val())
+			}
+			if maxAge <= 0 {
+				return d.Errf("invalid duration: %s, max_age should be non-zero and positive", d.Val())
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			s.MaxAge = caddy.Duration(maxAge)
+		case "sticky_on_failure":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.StickyOnFailure = d.Val()
+		case "salt":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Salt = d.Val()
+		case "compat_mode":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			s.CompatMode = true
+		case "sticky_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dial := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.StickyIDs == nil {
+				s.StickyIDs = make(map[string]string)
+			}
+			s.StickyIDs[dial] = d.Val()
+		case "prefer":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Prefer = d.Val()
+		default:
+			handled, err := s.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = s.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// HeaderStickySelection is a policy that provides sticky sessions
+// for clients that do not persist cookies (e.g. gRPC or API clients)
+// by way of a signed affinity token carried in a request header.
+type HeaderStickySelection struct {
+	// The request header field to read the affinity token from.
+	// Default is `X-Session-Affinity`.
+	Header string `json:"header,omitempty"`
+
+	// The response header field to write the affinity token to when
+	// a new upstream is selected, so the client can echo it back on
+	// subsequent requests. Defaults to the same field as Header.
+	ResponseHeader string `json:"response_header,omitempty"`
+
+	// Secrets to sign (HMAC 256) the affinity token with. New tokens
+	// are signed with the first secret; all secrets are accepted when
+	// verifying, which allows secret rotation.
+	Secrets []string `json:"secrets,omitempty"`
+
+	// The fallback policy to use if the token is not present or does
+	// not match an available upstream. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+}
+
+// CaddyModule returns the Caddy module information.
+func (HeaderStickySelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.sticky_header",
+		New: func() caddy.Module { return new(HeaderStickySelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *HeaderStickySelection) Provision(ctx caddy.Context) error {
+	if s.Header == "" {
+		s.Header = "X-Session-Affinity"
+	}
+	if s.ResponseHeader == "" {
+		s.ResponseHeader = s.Header
+	}
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "sticky_header", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+	return nil
+}
+
+// signingSecret returns the secret used to sign new affinity tokens.
+func (s HeaderStickySelection) signingSecret() string {
+	if len(s.Secrets) > 0 {
+		return s.Secrets[0]
+	}
+	return ""
+}
+
+// verifySecrets returns all secrets accepted when verifying a token.
+func (s HeaderStickySelection) verifySecrets() []string {
+	if len(s.Secrets) > 0 {
+		return s.Secrets
+	}
+	return []string{""}
+}
+
+// Select returns an available host, if any.
+func (s HeaderStickySelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	// selects a new host using the fallback policy (typically random)
+	// and writes the affinity token to the response header so the
+	// client can echo it back.
+	selectNewHost := func(cause string) *Upstream {
+		upstream := selectViaFallback(s.fallback, pool, req, w, cause)
+		if upstream == nil {
+			return nil
+		}
+		token, err := hashCookie(s.signingSecret(), upstream.Dial)
+		if err != nil {
+			return upstream
+		}
+		if w != nil {
+			w.Header().Set(s.ResponseHeader, token)
+		}
+		return upstream
+	}
+
+	token := req.Header.Get(s.Header)
+	// If there's no token, select a host using the fallback policy
+	if token == "" {
+		return selectNewHost(selectionFallbackKeyMissing)
+	}
+	// If the token is present, loop over the available upstreams until we find a match
+	for _, upstream := range pool {
+		if upstream == nil || !upstream.Available() {
+			continue
+		}
+		for _, secret := range s.verifySecrets() {
+			sha, err := hashCookie(secret, upstream.Dial)
+			if err == nil && sha == token {
+				return upstream
+			}
+		}
+	}
+	// If there is no matching host, select a host using the fallback policy
+	return selectNewHost(selectionFallbackNodeMissing)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy sticky_header [<header> [<secrets...>]] {
+//		response_header <name>
+//		fallback <policy>
+//	}
+//
+// By default header is `X-Session-Affinity`
+func (s *HeaderStickySelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	args := d.RemainingArgs()
+	if len(args) >= 2 {
+		s.Header = args[1]
+	}
+	if len(args) >= 3 {
+		s.Secrets = args[2:]
+	}
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "response_header":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.ResponseHeader != "" {
+				return d.Err("response header already specified")
+			}
+			s.ResponseHeader = d.Val()
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		default:
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// StickyTableSelection is a policy that provides session affinity
+// through an in-memory table instead of hashing: the first request for
+// a key selects an upstream with an inner policy (least_conn by
+// default) and records the key-to-upstream mapping with a TTL, and
+// subsequent requests for the same key hit the table. Unlike ip_hash,
+// clients that share a hash key (e.g. behind a large NAT) are spread
+// by the inner policy rather than all pinned to one upstream. The
+// table is bounded: when it is full, the least recently used entry is
+// evicted.
+type StickyTableSelection struct {
+	// How to extract the affinity key from the request: "ip" (the
+	// default), "client_ip", "header", "query", or "cookie".
+	Key string `json:"key,omitempty"`
+
+	// The header, query parameter, or cookie name to read the key
+	// from when Key is "header", "query", or "cookie".
+	KeyName string `json:"key_name,omitempty"`
+
+	// How long a recorded affinity stays valid. An expired entry is
+	// re-selected with the inner policy on the next request for its
+	// key. Default is 5m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// The maximum number of keys the table may hold. Default is 8192.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// The policy used to select an upstream the first time a key is
+	// seen, after its entry expired, or after its upstream became
+	// unavailable. Defaults to `least_conn`.
+	PolicyRaw json.RawMessage `json:"policy,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	policy    Selector
+
+	mu      sync.Mutex
+	entries map[string]*stickyTableEntry
+	// most recently used entries first; the element value is the
+	// table key (string) so eviction can delete from the map
+	order *list.List
+	elems map[string]*list.Element
+
+	events *caddyevents.App
+}
+
+// stickyTableEntry is one recorded key-to-upstream affinity.
+type stickyTableEntry struct {
+	upstream *Upstream
+	expires  time.Time
+}
+
+// CaddyModule returns the Caddy module information.
+func (StickyTableSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.sticky_table",
+		New: func() caddy.Module { return new(StickyTableSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *StickyTableSelection) Provision(ctx caddy.Context) error {
+	switch s.Key {
+	case "":
+		s.Key = "ip"
+	case "ip", "client_ip":
+	case "header", "query", "cookie":
+		if s.KeyName == "" {
+			return fmt.Errorf("key_name is required when key is '%s'", s.Key)
+		}
+	default:
+		return fmt.Errorf("unrecognized key '%s': must be 'ip', 'client_ip', 'header', 'query', or 'cookie'", s.Key)
+	}
+	if s.TTL == 0 {
+		s.TTL = caddy.Duration(5 * time.Minute)
+	}
+	if s.TTL < 0 {
+		return fmt.Errorf("ttl must be positive, got %v", time.Duration(s.TTL))
+	}
+	if s.MaxEntries == 0 {
+		s.MaxEntries = 8192
+	}
+	if s.MaxEntries < 0 {
+		return fmt.Errorf("max_entries must be positive, got %d", s.MaxEntries)
+	}
+
+	if s.PolicyRaw == nil {
+		s.PolicyRaw = caddyconfig.JSONModuleObject(LeastConnSelection{}, "policy", "least_conn", nil)
+	}
+	mod, err := ctx.LoadModule(s, "PolicyRaw")
+	if err != nil {
+		return fmt.Errorf("loading inner selection policy: %s", err)
+	}
+	s.policy = mod.(Selector)
+
+	s.entries = make(map[string]*stickyTableEntry)
+	s.elems = make(map[string]*list.Element)
+	s.order = list.New()
+	return nil
+}
+
+// affinityKey extracts the affinity key from the request, or "" if the
+// request does not carry one.
+func (s *StickyTableSelection) affinityKey(req *http.Request) string {
+	switch s.Key {
+	case "ip":
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		return clientIP
+	case "client_ip":
+		address := clientIPVarOrRemoteAddr(req)
+		clientIP, _, err := net.SplitHostPort(address)
+		if err != nil {
+			clientIP = address
+		}
+		return clientIP
+	case "header":
+		return req.Header.Get(s.KeyName)
+	case "query":
+		return req.URL.Query().Get(s.KeyName)
+	case "cookie":
+		if cookie, err := req.Cookie(s.KeyName); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// Select returns an available host, if any.
+func (s *StickyTableSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	key := s.affinityKey(req)
+	if key == "" {
+		recordFallbackCause(req, selectionFallbackKeyMissing)
+		return s.policy.Select(pool, req, w)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		if time.Now().Before(entry.expires) && entry.upstream.Available() {
+			s.order.MoveToFront(s.elems[key])
+			return entry.upstream
+		}
+		// expired, or the recorded upstream can't take requests:
+		// drop the entry and re-select below
+		recordFallbackCause(req, selectionFallbackNodeMissing)
+		s.deleteEntry(key)
+	}
+
+	upstream := s.policy.Select(pool, req, w)
+	if upstream == nil {
+		return nil
+	}
+	s.storeEntry(key, upstream)
+	return upstream
+}
+
+// storeEntry records an affinity, evicting the least recently used
+// entry if the table is full. The caller must hold s.mu.
+func (s *StickyTableSelection) storeEntry(key string, upstream *Upstream) {
+	if len(s.entries) >= s.MaxEntries {
+		if oldest := s.order.Back(); oldest != nil {
+			s.deleteEntry(oldest.Value.(string))
+		}
+	}
+	s.entries[key] = &stickyTableEntry{
+		upstream: upstream,
+		expires:  time.Now().Add(time.Duration(s.TTL)),
+	}
+	s.elems[key] = s.order.PushFront(key)
+}
+
+// deleteEntry removes one entry from the table. The caller must hold s.mu.
+func (s *StickyTableSelection) deleteEntry(key string) {
+	if elem, ok := s.elems[key]; ok {
+		s.order.Remove(elem)
+		delete(s.elems, key)
+	}
+	delete(s.entries, key)
+}
+
+// SetEventsApp sets the events app for this selection policy so dead
+// upstreams' affinities are dropped as soon as health checks report them.
+func (s *StickyTableSelection) SetEventsApp(events *caddyevents.App) {
+	if events != nil {
+		s.events = events
+		s.events.On("unhealthy", s)
+	}
+}
+
+// PopulateInitialTopology implements TopologyInitializer. The table is
+// populated lazily by requests, so there is nothing to seed.
+func (s *StickyTableSelection) PopulateInitialTopology(upstreams []*Upstream) {}
+
+// Handle implements caddyevents.Handler: on an unhealthy event, every
+// affinity recorded for the dead upstream is dropped so those keys are
+// re-selected by the inner policy on their next request.
+func (s *StickyTableSelection) Handle(ctx context.Context, event caddy.Event) error {
+	if event.Name() != "unhealthy" {
+		return nil
+	}
+	payload, ok := upstreamHealthEventFromEvent(event)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if entry.upstream.Dial == payload.Dial {
+			s.deleteEntry(key)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy sticky_table [<key>] {
+//		key <source>
+//		key_name <name>
+//		ttl <duration>
+//		max_entries <n>
+//		policy <policy>
+//	}
+func (s *StickyTableSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if d.NextArg() {
+		s.Key = d.Val()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Key = d.Val()
+		case "key_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.KeyName = d.Val()
+		case "ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid ttl '%s': %v", d.Val(), err)
+			}
+			s.TTL = caddy.Duration(ttl)
+		case "max_entries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxEntries, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_entries '%s': %v", d.Val(), err)
+			}
+			s.MaxEntries = maxEntries
+		case "policy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.PolicyRaw != nil {
+				return d.Err("inner selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.PolicyRaw = mod
+		default:
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// hashCookie hashes (HMAC 256) some data with the secret
+func hashCookie(secret string, data string) (string, error) {
+	h := hmac.New(sha256.New, []byte(secret))
+	_, err := h.Write([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// selectRandomHost returns a random available host
+func selectRandomHost(pool []*Upstream) *Upstream {
+	return selectRandomHostExcluding(pool, nil, availabilityFull)
+}
+
+// selectRandomHostExcluding is selectRandomHost with one host held
+// out (pass nil to exclude nothing) and an availability mode deciding
+// which hosts count as selectable.
+func selectRandomHostExcluding(pool []*Upstream, excluded *Upstream, mode string) *Upstream {
+	// use reservoir sampling because the number of available
+	// hosts isn't known: https://en.wikipedia.org/wiki/Reservoir_sampling
+	var randomHost *Upstream
+	var count int
+	for _, upstream := range pool {
+		if upstream == excluded || !availableFor(upstream, mode) {
+			continue
+		}
+		// (n % 1 == 0) holds for all n, therefore a
+		// upstream will always be chosen if there is at
+		// least one available
+		count++
+		if (weakrand.Int() % count) == 0 { //nolint:gosec
+			randomHost = upstream
+		}
+	}
+	return randomHost
+}
+
+// leastRequests returns the host with the
+// least number of active requests to it.
+// If more than one host has the same
+// least number of active requests, then
+// one of those is chosen at random. With
+// ageDiscounted set, hosts are compared by
+// their age-discounted effective load
+// instead of the raw in-flight count.
+func leastRequests(upstreams []*Upstream, ageDiscounted bool) *Upstream {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	var best []*Upstream
+	bestLoad := -1.0
+	for _, upstream := range upstreams {
+		if upstream == nil {
+			continue
+		}
+		load := float64(upstream.NumRequests())
+		if ageDiscounted {
+			load = upstream.effectiveRequests()
+		}
+		if load == 0 {
+			return upstream
+		}
+		// If bestLoad was just initialized to -1
+		// we need to append upstream also
+		if load <= bestLoad || bestLoad == -1 {
+			bestLoad = load
+			best = append(best, upstream)
+		}
+	}
+	if len(best) == 0 {
+		return nil
+	}
+	if len(best) == 1 {
+		return best[0]
+	}
+	return best[weakrand.Intn(len(best))] //nolint:gosec
+}
+
+// hrwTieBreak reports whether candidate should replace current when
+// their HRW scores are equal: the upstream with the lexicographically
+// smaller canonical key wins. Ties are rare with 64-bit hashes but not
+// impossible, and without a deterministic rule the winner depends on
+// pool iteration order — two instances with differently-ordered
+// upstream lists would then disagree on a key's owner.
+func hrwTieBreak(current, candidate *Upstream) bool {
+	return current == nil || candidate.hashKey() < current.hashKey()
+}
+
+// hostByHashing returns an available host from pool based on a hashable string s.
+func hostByHashing(pool []*Upstream, s string) *Upstream {
+	upstream, _ := hostByHashingExplained(pool, s, nil)
+	return upstream
+}
+
+// hostByHashingExplained is hostByHashing, but also returns the winning
+// combined hash so debugging endpoints can report it. Hosts in tried
+// (may be nil) are skipped; because each host's score depends only on
+// itself and the key, the winner is then the next-highest scoring host.
+func hostByHashingExplained(pool []*Upstream, s string, tried map[*Upstream]struct{}) (*Upstream, uint64) {
+	return hostByHashingWith(pool, s, nil, availabilityFull, tried)
+}
+
+// hostByHashingWith is the fn- and mode-aware core of hostByHashing: a
+// nil fn means the default streaming xxhash, anything else (e.g. a
+// policy's configured fnv1a or keyed siphash) scores each pair through
+// it, and mode decides which upstreams count as selectable.
+func hostByHashingWith(pool []*Upstream, s string, fn hashFunction, mode string, tried map[*Upstream]struct{}) (*Upstream, uint64) {
+	// Highest Random Weight (HRW, or "Rendezvous") hashing,
+	// guarantees stability when the list of upstreams changes;
+	// see https://medium.com/i0exception/rendezvous-hashing-8c00e2fb58b0,
+	// https://randorithms.com/2020/12/26/rendezvous-hashing.html,
+	// and https://en.wikipedia.org/wiki/Rendezvous_hashing.
+	var highestHash uint64
+	var upstream *Upstream
+	for _, up := range pool {
+		if _, ok := tried[up]; ok {
+			continue
+		}
+		if !availableFor(up, mode) {
+			continue
+		}
+		var h uint64
+		if fn == nil {
+			h = hashTwo(up.hashKey(), s) // important to hash key and server together
+		} else {
+			h = fn(up.hashKey(), s)
+		}
+		if h > highestHash || (h == highestHash && hrwTieBreak(upstream, up)) {
+			highestHash = h
+			upstream = up
+		}
+	}
+	return upstream, highestHash
+}
+
+// hostByHashingWeighted returns an available host from pool based on a
+// hashable string s, biased by the given per-upstream weights: each
+// upstream is expanded into as many virtual replicas as its weight, so
+// over many distinct keys the share of keys owned by each upstream
+// approximates the weight ratios. A missing weight defaults to 1 and a
+// zero weight excludes the upstream. Like hostByHashing, this is HRW
+// hashing, so removing one upstream only remaps the keys it owned.
+func hostByHashingWeighted(pool []*Upstream, s string, weights []int) *Upstream {
+	upstream, _ := hostByHashingWeightedExplained(pool, s, weights, nil)
+	return upstream
+}
+
+// hostByHashingWeightedExplained is hostByHashingWeighted, but also
+// returns the winning combined hash so debugging endpoints can report
+// it. Hosts in tried (may be nil) are skipped without disturbing the
+// positional weight lookup.
+func hostByHashingWeightedExplained(pool []*Upstream, s string, weights []int, tried map[*Upstream]struct{}) (*Upstream, uint64) {
+	return hostByHashingWeightedWith(pool, s, nil, availabilityFull, weights, tried)
+}
+
+// hostByHashingWeightedWith is the fn- and mode-aware core of
+// hostByHashingWeighted; a nil fn keeps the allocation-free streaming
+// xxhash path.
+func hostByHashingWeightedWith(pool []*Upstream, s string, fn hashFunction, mode string, weights []int, tried map[*Upstream]struct{}) (*Upstream, uint64) {
+	var highestHash uint64
+	var upstream *Upstream
+	var d xxhash.Digest
+	for i, up := range pool {
+		if _, ok := tried[up]; ok {
+			continue
+		}
+		if !availableFor(up, mode) {
+			continue
+		}
+		weight := 1
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		for replica := 0; replica < weight; replica++ {
+			var h uint64
+			if fn == nil {
+				// streamed equivalent of hash(key + "#" + replica + s),
+				// avoiding the concatenation allocations per replica
+				d.Reset()
+				_, _ = d.WriteString(up.hashKey())
+				_, _ = d.WriteString("#")
+				_, _ = d.WriteString(strconv.Itoa(replica))
+				_, _ = d.WriteString(s)
+				h = d.Sum64()
+			} else {
+				h = fn(up.hashKey()+"#"+strconv.Itoa(replica), s)
+			}
+			if h > highestHash || (h == highestHash && upstream != up && hrwTieBreak(upstream, up)) {
+				highestHash = h
+				upstream = up
+			}
+		}
+	}
+	return upstream, highestHash
+}
+
+// previewByHashing builds a SelectionExplanation for an HRW-based
+// policy by hashing the given key verbatim against the pool, applying
+// weights the same way Select would.
+func previewByHashing(policy string, pool UpstreamPool, key string, fn hashFunction, mode string, weights []int) SelectionExplanation {
+	var upstream *Upstream
+	var winning uint64
+	if len(weights) > 0 {
+		upstream, winning = hostByHashingWeightedWith(pool, key, fn, mode, weights, nil)
+	} else {
+		upstream, winning = hostByHashingWith(pool, key, fn, mode, nil)
+	}
+	expl := SelectionExplanation{Policy: policy, Key: key, Hash: winning}
+	if upstream != nil {
+		expl.Upstream = upstream.String()
+	}
+	return expl
+}
+
+// hash calculates a fast hash based on s.
+func hash(s string) uint64 {
+	return xxhash.Sum64String(s)
+}
+
+// hashTwo hashes the concatenation a+b without building the
+// intermediate string, producing exactly the same value as hash(a + b):
+// xxhash is a streaming hash, so feeding the parts separately yields
+// the same digest as feeding them joined. This keeps the hot HRW loop
+// free of per-candidate allocations.
+func hashTwo(a, b string) uint64 {
+	var d xxhash.Digest
+	d.Reset()
+	_, _ = d.WriteString(a)
+	_, _ = d.WriteString(b)
+	return d.Sum64()
+}
+
+func loadFallbackPolicy(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	name := d.Val()
+	modID := "http.reverse_proxy.selection_policies." + name
+	mod, err := caddy.GetModule(modID)
+	if err != nil {
+		return nil, d.Errf("getting module named '%s': %v", modID, err)
+	}
+	inst := mod.New()
+	unm, ok := inst.(caddyfile.Unmarshaler)
+	if !ok {
+		return nil, d.Errf("module %s is not a Caddyfile unmarshaler; is %T", mod.ID, inst)
+	}
+	if err := unm.UnmarshalCaddyfile(caddyfile.NewDispenser(fallbackPolicySegment(d))); err != nil {
+		return nil, err
+	}
+	sel, ok := unm.(Selector)
+	if !ok {
+		return nil, d.Errf("module %s (%T) is not a reverseproxy.Selector", modID, unm)
+	}
+	return caddyconfig.JSONModuleObject(sel, "policy", name, nil), nil
+}
+
+// fallbackPolicySegment collects the tokens belonging to a nested
+// fallback policy, starting at the current token (the policy name): the
+// remaining arguments on the line, plus the policy's own block if an
+// opening brace follows them. Unlike Dispenser.NextSegment, braces are
+// balanced as tokens rather than by line position, so a nested block
+// can't swallow the enclosing policy's closing brace when the two
+// appear on the same line.
+func fallbackPolicySegment(d *caddyfile.Dispenser) caddyfile.Segment {
+	tkns := caddyfile.Segment{d.Token()}
+	for d.NextArg() {
+		tkns = append(tkns, d.Token())
+	}
+	last := d.Token()
+	if !d.Next() {
+		return tkns
+	}
+	open := d.Token()
+	if open.Text != "{" || open.File != last.File || open.Line != last.Line {
+		// no block of its own; leave the next token for the caller
+		d.Prev()
+		return tkns
+	}
+	tkns = append(tkns, open)
+	depth := 1
+	for depth > 0 && d.Next() {
+		tkns = append(tkns, d.Token())
+		switch d.Val() {
+		case "{":
+			depth++
+		case "}":
+			depth--
+		}
+	}
+	return relineSegment(tkns)
+}
+
+// relineSegment rewrites the line numbers of a collected segment into a
+// canonical layout: a brace-delimited block always starts after its
+// opening brace's line, and every closing brace sits on a line of its
+// own. Tokens that shared a line keep sharing one otherwise, so
+// multi-argument directives stay intact. This lets option parsers that
+// guard against trailing arguments (`if d.NextArg() { return
+// d.ArgErr() }`) accept blocks written inline on a single line.
+func relineSegment(tkns caddyfile.Segment) caddyfile.Segment {
+	relined := make(caddyfile.Segment, len(tkns))
+	line := 1
+	for i, tok := range tkns {
+		if i > 0 {
+			prev := tkns[i-1]
+			switch {
+			case !prev.Quoted() && prev.Text == "{", // first token of a block
+				!prev.Quoted() && prev.Text == "}", // token after a block
+				!tok.Quoted() && tok.Text == "}",   // closing brace gets its own line
+				prev.File != tok.File,
+				prev.Line+prev.NumLineBreaks() < tok.Line: // originally on a new line
+				line++
+			}
+		}
+		tok.Line = line
+		relined[i] = tok
+	}
+	return relined
+}
+
+// selectViaFallback delegates the request to a policy's fallback. All
+// fallback invocations go through here so the ResponseWriter is always
+// passed along (fallbacks like cookie write their affinity cookie to
+// it, and passing nil instead would silently break that stickiness)
+// and so the cause — why the primary selection was abandoned — lands
+// in the request vars for log formats.
+func selectViaFallback(fallback Selector, pool UpstreamPool, req *http.Request, w http.ResponseWriter, cause string) *Upstream {
+	recordFallbackCause(req, cause)
+	return fallback.Select(pool, req, w)
+}
+
+// editDistance computes the Levenshtein distance between two short
+// strings. The Caddyfile unmarshalers use it to suggest the closest
+// known sub-directive when a config misspells one.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// suggestOption returns the known option closest to an unrecognized
+// one, or "" when nothing is within two edits — far enough that a
+// suggestion would be a guess rather than a typo correction.
+func suggestOption(got string, known []string) string {
+	const maxSuggestDistance = 2
+	best, bestDist := "", maxSuggestDistance+1
+	for _, opt := range known {
+		if d := editDistance(got, opt); d < bestDist {
+			best, bestDist = opt, d
+		}
+	}
+	return best
+}
+
+// sharedSelectionOptions are the sub-directives handled by the shared
+// option helpers (verbose logging, tracing, hash function choice,
+// availability mode, key components, and overrides) that the memento
+// policies chain in their Caddyfile default cases. They are listed
+// here so suggestOption can match misspellings against them too.
+var sharedSelectionOptions = []string{
+	"verbose_logging", "log_key_mode",
+	"trace_sample_rate", "trace_buffer_size",
+	"hash_function", "availability", "key_components", "override",
+}
+
+// ChainSelection is a composite policy that tries an ordered list
+// of selection policies and returns the first upstream any of them
+// selects. This generalizes the single `fallback` option some
+// policies offer: for example, use cookie affinity if the cookie
+// exists, otherwise hash the client IP, otherwise pick the least
+// loaded host.
+type ChainSelection struct {
+	// The ordered list of selection policies to try. Each entry is
+	// a selection policy module; the first one to return a non-nil
+	// upstream wins.
+	PoliciesRaw []json.RawMessage `json:"policies,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+
+	policies []Selector
+}
+
+// CaddyModule returns the Caddy module information.
+func (ChainSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.chain",
+		New: func() caddy.Module { return new(ChainSelection) },
+	}
+}
+
+// Provision sets up the policy by loading all child policies.
+func (s *ChainSelection) Provision(ctx caddy.Context) error {
+	if len(s.PoliciesRaw) == 0 {
+		return fmt.Errorf("chain policy requires at least one policy")
+	}
+	mods, err := ctx.LoadModule(s, "PoliciesRaw")
+	if err != nil {
+		return fmt.Errorf("loading chained selection policies: %v", err)
+	}
+	for _, mod := range mods.([]any) {
+		s.policies = append(s.policies, mod.(Selector))
+	}
+	return nil
+}
+
+// Select returns the first upstream selected by any
+// of the chained policies, in order.
+func (s *ChainSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	for _, policy := range s.policies {
+		if upstream := policy.Select(pool, req, w); upstream != nil {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// SetEventsApp propagates the events app to all child
+// policies that react to health events.
+func (s *ChainSelection) SetEventsApp(events *caddyevents.App) {
+	for _, policy := range s.policies {
+		if aware, ok := policy.(EventsAware); ok {
+			aware.SetEventsApp(events)
+		}
+	}
+}
+
+// setHandlerIdentity propagates the owning handler's identity to all
+// child policies that scope health events by it.
+func (s *ChainSelection) setHandlerIdentity(id string) {
+	for _, policy := range s.policies {
+		if aware, ok := policy.(handlerIdentityAware); ok {
+			aware.setHandlerIdentity(id)
+		}
+	}
+}
+
+// PopulateInitialTopology propagates the initial upstream
+// topology to all child policies that track it.
+func (s *ChainSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	for _, policy := range s.policies {
+		if aware, ok := policy.(TopologyInitializer); ok {
+			aware.PopulateInitialTopology(upstreams)
+		}
+	}
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy chain {
+//	    <policy> [<args...>]
+//	    ...
+//	}
+func (s *ChainSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for d.NextBlock(0) {
+		mod, err := loadFallbackPolicy(d)
+		if err != nil {
+			return err
+		}
+		s.PoliciesRaw = append(s.PoliciesRaw, mod)
+	}
+	return nil
+}
+
+// MapSelection is a composite policy that dispatches each request to
+// one of several child selection policies based on the evaluated value
+// of a request placeholder. This makes it possible to serve, say,
+// cookie-sticky interactive traffic and round-robin webhook traffic
+// through a single handler without duplicating the whole proxy config.
+type MapSelection struct {
+	// The placeholder (or string containing placeholders) whose
+	// evaluated value picks the policy to dispatch to, e.g.
+	// "{http.request.header.X-Traffic-Class}".
+	Source string `json:"source,omitempty"`
+
+	// Map from evaluated source value to the selection policy
+	// to use for matching requests.
+	PoliciesRaw map[string]json.RawMessage `json:"policies,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+
+	// The policy to use when no map entry matches.
+	// Defaults to `random`.
+	DefaultRaw json.RawMessage `json:"default,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+
+	policies      map[string]Selector
+	defaultPolicy Selector
+}
+
+// CaddyModule returns the Caddy module information.
+func (MapSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.map",
+		New: func() caddy.Module { return new(MapSelection) },
+	}
+}
+
+// Provision sets up the policy by loading all child policies once,
+// so dispatching is just a map lookup per request.
+func (s *MapSelection) Provision(ctx caddy.Context) error {
+	if s.Source == "" {
+		return fmt.Errorf("map policy requires a source placeholder")
+	}
+	s.policies = make(map[string]Selector)
+	if len(s.PoliciesRaw) > 0 {
+		mods, err := ctx.LoadModule(s, "PoliciesRaw")
+		if err != nil {
+			return fmt.Errorf("loading mapped selection policies: %v", err)
+		}
+		for key, mod := range mods.(map[string]any) {
+			s.policies[key] = mod.(Selector)
+		}
+	}
+	if s.DefaultRaw == nil {
+		s.DefaultRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	mod, err := ctx.LoadModule(s, "DefaultRaw")
+	if err != nil {
+		return fmt.Errorf("loading default selection policy: %v", err)
+	}
+	s.defaultPolicy = mod.(Selector)
+	return nil
+}
+
+// Select evaluates the source placeholder and dispatches to the
+// mapped policy, or to the default policy if no entry matches.
+func (s *MapSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	if repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		key := repl.ReplaceAll(s.Source, "")
+		if policy, ok := s.policies[key]; ok {
+			return policy.Select(pool, req, w)
+		}
+	}
+	return s.defaultPolicy.Select(pool, req, w)
+}
+
+// SetEventsApp propagates the events app to all child
+// policies that react to health events.
+func (s *MapSelection) SetEventsApp(events *caddyevents.App) {
+	for _, policy := range s.policies {
+		if aware, ok := policy.(EventsAware); ok {
+			aware.SetEventsApp(events)
+		}
+	}
+	if aware, ok := s.defaultPolicy.(EventsAware); ok {
+		aware.SetEventsApp(events)
+	}
+}
+
+// setHandlerIdentity propagates the owning handler's identity to all
+// child policies that scope health events by it.
+func (s *MapSelection) setHandlerIdentity(id string) {
+	for _, policy := range s.policies {
+		if aware, ok := policy.(handlerIdentityAware); ok {
+			aware.setHandlerIdentity(id)
+		}
+	}
+	if aware, ok := s.defaultPolicy.(handlerIdentityAware); ok {
+		aware.setHandlerIdentity(id)
+	}
+}
+
+// PopulateInitialTopology propagates the initial upstream
+// topology to all child policies that track it.
+func (s *MapSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	for _, policy := range s.policies {
+		if aware, ok := policy.(TopologyInitializer); ok {
+			aware.PopulateInitialTopology(upstreams)
+		}
+	}
+	if aware, ok := s.defaultPolicy.(TopologyInitializer); ok {
+		aware.PopulateInitialTopology(upstreams)
+	}
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy map <source> {
+//	    <value> <policy> [<args...>]
+//	    default <policy> [<args...>]
+//	}
+func (s *MapSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Source = d.Val()
+
+	for d.NextBlock(0) {
+		key := d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		mod, err := loadFallbackPolicy(d)
+		if err != nil {
+			return err
+		}
+		if key == "default" {
+			if s.DefaultRaw != nil {
+				return d.Err("default selection policy already specified")
+			}
+			s.DefaultRaw = mod
+			continue
+		}
+		if s.PoliciesRaw == nil {
+			s.PoliciesRaw = make(map[string]json.RawMessage)
+		}
+		if _, ok := s.PoliciesRaw[key]; ok {
+			return d.Errf("selection policy for '%s' already specified", key)
+		}
+		s.PoliciesRaw[key] = mod
+	}
+	return nil
+}
+
+// EventsAware is implemented by selection policies that subscribe to
+// health (or other) events to keep internal state current. The reverse
+// proxy handler calls SetEventsApp while it provisions, after the
+// policy's own Provision has returned and before any request is
+// served, so implementations can subscribe immediately. Third-party
+// policies implementing this interface are wired up the same way the
+// built-in memento policies are.
+type EventsAware interface {
+	SetEventsApp(events *caddyevents.App)
+}
+
+// TopologyInitializer is implemented by selection policies that keep
+// an internal topology of upstreams (e.g. a consistent hashing ring).
+// The handler calls PopulateInitialTopology with the statically
+// configured upstreams while it provisions, after SetEventsApp for
+// policies that also implement EventsAware, so the initial topology
+// is in place before the first selection.
+type TopologyInitializer interface {
+	PopulateInitialTopology(upstreams []*Upstream)
+}
+
+// handlerIdentityAware is implemented by selection policies that scope
+// health events to the reverse proxy handler that owns them. The
+// handler passes its identity before SetEventsApp, so the policy can
+// filter from the first event on; composite policies forward the
+// identity to their children.
+type handlerIdentityAware interface {
+	setHandlerIdentity(id string)
+}
+
+// handlerScope is the event-scoping state shared by the selection
+// policies that subscribe to health events. The "healthy"/"unhealthy"
+// events are global, so two handlers using memento policies with
+// overlapping upstream addresses but different pools would otherwise
+// react to each other's flaps, adding hosts to a topology the handler
+// never routes to.
+type handlerScope struct {
+	// Whether to react to health events emitted by other reverse
+	// proxy handlers. By default only events from this policy's own
+	// handler (or events carrying no handler identity at all, such as
+	// those emitted by third-party modules) are applied; set this for
+	// deployments that intentionally share health state across
+	// handlers proxying to the same backends.
+	AcceptExternalEvents bool `json:"accept_external_events,omitempty"`
+
+	handlerID string
+}
+
+// setHandlerIdentity implements handlerIdentityAware.
+func (hs *handlerScope) setHandlerIdentity(id string) {
+	hs.handlerID = id
+}
+
+// acceptsHealthEventFrom reports whether a health event should be
+// applied to this policy's topology. Events from another handler are
+// ignored unless accept_external_events is set; events without a
+// handler identity, or received by a policy that never learned its
+// own handler's identity, are always accepted.
+func (hs *handlerScope) acceptsHealthEventFrom(event caddy.Event) bool {
+	if hs.AcceptExternalEvents || hs.handlerID == "" {
+		return true
+	}
+	payload, ok := upstreamHealthEventFromEvent(event)
+	if !ok || payload.Handler == "" {
+		return true
+	}
+	return payload.Handler == hs.handlerID
+}
+
+// unmarshalHandlerScopeOption handles the accept_external_events
+// sub-directive from a policy's Caddyfile block. It reports whether
+// the current directive was it.
+func (hs *handlerScope) unmarshalHandlerScopeOption(d *caddyfile.Dispenser) (bool, error) {
+	if d.Val() != "accept_external_events" {
+		return false, nil
+	}
+	if d.NextArg() {
+		return true, d.ArgErr()
+	}
+	hs.AcceptExternalEvents = true
+	return true, nil
+}
+
+// Initial-topology modes: when the policy enters the configured
+// upstreams into the consistent topology.
+const (
+	initialTopologyAll         = "all"
+	initialTopologyHealthyOnly = "healthy_only"
+	initialTopologyLazy        = "lazy"
+)
+
+// deferredTopology holds back initial topology population for the
+// healthy_only and lazy modes: the handler's PopulateInitialTopology
+// call parks the configured upstream set here, and the mode's trigger —
+// the first active health check round completing, or the first
+// selection — populates the topology once with the subset that passes
+// the mode's filter. Later triggers are no-ops.
+type deferredTopology struct {
+	mu        sync.Mutex
+	populated bool
+	upstreams []*Upstream
+
+	// the policy's filtered population path; it receives the full
+	// upstream list so positional configuration (the weighted policy's
+	// weights) keeps its indices, and enters only the members keep
+	// accepts
+	populate func(upstreams []*Upstream, keep func(*Upstream) bool)
+}
+
+// hold parks the configured upstream set for a later trigger.
+func (d *deferredTopology) hold(upstreams []*Upstream) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.populated {
+		return
+	}
+	d.upstreams = upstreams
+}
+
+// trigger populates the topology, once, with the members of upstreams
+// (or of the held set when upstreams is nil) that pass keep.
+func (d *deferredTopology) trigger(upstreams []*Upstream, keep func(*Upstream) bool) {
+	d.mu.Lock()
+	if d.populated {
+		d.mu.Unlock()
+		return
+	}
+	d.populated = true
+	if upstreams == nil {
+		upstreams = d.upstreams
+	}
+	d.upstreams = nil
+	d.mu.Unlock()
+
+	d.populate(upstreams, keep)
+}
+
+// TopologyAware is implemented by selection policies that additionally
+// need to learn about membership changes that don't arrive as health
+// events, such as a dynamic upstream source producing a new set on
+// refresh. The reverse proxy handler diffs each refreshed set against
+// the previous one and calls AddUpstream/RemoveUpstream for the
+// difference only, so surviving upstreams keep their position in the
+// topology.
+type TopologyAware interface {
+	TopologyInitializer
+	AddUpstream(upstream *Upstream)
+	RemoveUpstream(upstream *Upstream)
+}
+
+// poolSizeValidator is implemented by selection policies whose static
+// configuration can only be fully checked against the number of
+// configured upstreams, which the policy never sees at config time.
+// The handler calls it while provisioning, before seeding the initial
+// topology, so a configuration that cannot line up with the pool fails
+// the config load instead of silently mis-balancing.
+type poolSizeValidator interface {
+	validatePoolSize(numUpstreams int) error
+}
+
+// retryAwareSelector is implemented by selection policies that can
+// steer a retry away from upstreams the handler already tried for the
+// same request. The handler consults it only on retries, so
+// implementations may assume tried is non-empty.
+type retryAwareSelector interface {
+	SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream
+}
+
+// affinityKeyer is implemented by selection policies that derive a
+// per-request affinity key. After selection, the handler records the
+// key in the reverse_proxy.selection.key request variable so logs,
+// traces, and header_up directives can correlate requests with their
+// hash bucket. The second return value is false when the request
+// carries no key (and the policy fell back to another selection).
+type affinityKeyer interface {
+	requestKey(req *http.Request) (string, bool)
+}
+
+// affinitySelector is a marker implemented by selection policies whose
+// choice is a deterministic function of the request (hashing and sticky
+// policies) rather than of upstream load. For these policies, retrying
+// a failed attempt on a different upstream breaks the affinity the
+// policy exists to provide; the handler consults this marker at
+// provision time to warn about that interaction and at retry time to
+// honor the load balancer's retry_affinity setting.
+type affinitySelector interface {
+	AffinitySelector()
+}
+
+// The hashing and sticky policies all pin a request to an upstream as a
+// function of the request itself, so they carry the affinity marker.
+func (IPHashSelection) AffinitySelector()              {}
+func (ClientIPHashSelection) AffinitySelector()        {}
+func (URIHashSelection) AffinitySelector()             {}
+func (RendezvousSelection) AffinitySelector()          {}
+func (QueryHashSelection) AffinitySelector()           {}
+func (JumpHashSelection) AffinitySelector()            {}
+func (HeaderHashSelection) AffinitySelector()          {}
+func (CookieHashSelection) AffinitySelector()          {}
+func (HeaderStickySelection) AffinitySelector()        {}
+func (*StickyTableSelection) AffinitySelector()        {}
+func (MementoSelection) AffinitySelector()             {}
+func (*WeightedMementoSelection) AffinitySelector()    {}
+func (ConsistentLeastConnSelection) AffinitySelector() {}
+func (*TieredMementoSelection) AffinitySelector()      {}
+
+// Request variables recording the outcome of upstream selection. They
+// are set before the roundtrip so header_up and log formats can
+// reference them as {http.vars.reverse_proxy.selection.*} placeholders.
+const (
+	selectionPolicyVarKey   = "reverse_proxy.selection.policy"
+	selectionKeyVarKey      = "reverse_proxy.selection.key"
+	selectionUpstreamVarKey = "reverse_proxy.selection.upstream"
+	selectionDurationVarKey = "reverse_proxy.selection.duration_us"
+	selectionCauseVarKey    = "reverse_proxy.selection.fallback"
+)
+
+// The values selectionCauseVarKey can hold: why a policy abandoned its
+// primary selection for this request. "none" means the primary path
+// served the request.
+const (
+	selectionFallbackNone        = "none"
+	selectionFallbackEngineEmpty = "engine_empty"
+	selectionFallbackNodeMissing = "node_missing"
+	selectionFallbackKeyMissing  = "key_missing"
+	selectionFallbackUnavailable = "unavailable"
+)
+
+// recordFallbackCause notes in the request vars why the selection fell
+// back, so log formats can reference it. The first cause recorded for
+// a selection wins: when a fallback policy itself falls back, the
+// outermost reason is the one the operator can act on.
+func recordFallbackCause(req *http.Request, cause string) {
+	if req == nil {
+		return
+	}
+	if existing, ok := caddyhttp.GetVar(req.Context(), selectionCauseVarKey).(string); ok && existing != selectionFallbackNone {
+		return
+	}
+	caddyhttp.SetVar(req.Context(), selectionCauseVarKey, cause)
+}
+
+// selectExcluding runs sel over the subset of pool that is not in
+// tried. If every host has already been tried, it runs sel over the
+// full pool instead: retrying a possibly-failing host beats returning
+// no host at all.
+func selectExcluding(pool UpstreamPool, tried map[*Upstream]struct{}, sel func(UpstreamPool) *Upstream) *Upstream {
+	untried := make(UpstreamPool, 0, len(pool))
+	for _, upstream := range pool {
+		if _, ok := tried[upstream]; !ok {
+			untried = append(untried, upstream)
+		}
+	}
+	if len(untried) == 0 {
+		return sel(pool)
+	}
+	return sel(untried)
+}
+
+// MementoSelection is a policy that selects a host
+// using the BinomialHash algorithm for optimal load distribution
+// and minimal redistribution when the topology changes.
+type MementoSelection struct {
+	// The field to use for hashing. Can be "ip", "client_ip", "uri",
+	// "header", "cookie", "expression", or one of the URI variants
+	// also supported by uri_hash: "original_uri" (the URI before any
+	// rewrites), "path_only", or "path_and_query". Defaults to "ip"
+	// if not specified.
+	Field string `json:"field,omitempty"`
+
+	// The header field name if Field is "header"
+	HeaderField string `json:"header_field,omitempty"`
+
+	// Whether to hash all values of the header joined with "," when
+	// Field is "header". By default only the first value counts.
+	JoinValues bool `json:"join_values,omitempty"`
+
+	// Whether to trim whitespace and lowercase header values before
+	// hashing when Field is "header", so spelling variations of the
+	// same logical value map to the same upstream. Opt-in because
+	// enabling it changes existing mappings.
+	Canonicalize bool `json:"canonicalize,omitempty"`
+
+	// The cookie name if Field is "cookie". The named cookie's value
+	// becomes the hash key, so an existing application session cookie
+	// (e.g. JSESSIONID) drives affinity without the lb_policy cookie
+	// machinery: the engine computes the mapping rather than storing
+	// it in the cookie, so it survives pool changes with minimal key
+	// movement, and no response cookie is ever written. Requests
+	// without the cookie defer to the fallback policy.
+	CookieName string `json:"cookie_name,omitempty"`
+
+	// The placeholder expression to evaluate per request if Field is
+	// "expression", e.g. "{http.request.header.X-Tenant}:{http.vars.shard}".
+	// The expanded string becomes the hash key, so composite keys and
+	// route variables set by earlier handlers both work. An expansion
+	// that comes up empty defers to the fallback policy.
+	Expression string `json:"expression,omitempty"`
+
+	// How to treat header-derived keys before hashing: "raw" (the
+	// default) hashes the value as-is, "sha256" hashes its digest, and
+	// "hmac" hashes a keyed digest using HashSecret, keeping sensitive
+	// header values out of the hashing stage and key logging.
+	HashInput string `json:"hash_input,omitempty"`
+
+	// The secret for the "hmac" hash input mode. Required when that
+	// mode is chosen; the same secret yields the same mapping across
+	// restarts and instances.
+	HashSecret string `json:"hash_secret,omitempty"`
+
+	// Mask IPv4/IPv6 addresses to this many bits before hashing when
+	// Field is "ip" or "client_ip", so clients whose addresses rotate
+	// within one subnet keep their affinity. Defaults are 32 and 128
+	// (hash the full address).
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	// Which memento engine implementation to use: "lockfree" (the
+	// default) uses atomic reads with copy-on-write topology updates,
+	// which scales best for read-heavy selection but amplifies writes
+	// on topology change; "rwmutex" serializes topology changes under
+	// a lock with cheaper writes, at the cost of read contention when
+	// many requests select concurrently.
+	Engine string `json:"engine,omitempty"`
+
+	// Whether to bound the load on the selected host (consistent
+	// hashing with bounded loads). When enabled, a host whose
+	// in-flight request count exceeds LoadFactor times the average
+	// across available hosts is skipped in favor of a deterministic
+	// secondary host for the same key.
+	BoundedLoad bool `json:"bounded_load,omitempty"`
+
+	// The load bound factor used when BoundedLoad is enabled.
+	// Must be at least 1. Default is 1.25.
+	LoadFactor float64 `json:"load_factor,omitempty"`
+
+	// Whether to deterministically re-hash the key when the selected
+	// upstream is known but unavailable (e.g. at its MaxRequests limit
+	// before any unhealthy event fires), instead of going straight to
+	// the fallback policy. This keeps a given key's overflow target
+	// stable rather than random.
+	RehashUnavailable bool `json:"rehash_unavailable,omitempty"`
+
+	// How many derived keys to try when RehashUnavailable is enabled
+	// before giving up and using the fallback policy. Default is 8.
+	MaxProbes int `json:"max_probes,omitempty"`
+
+	// How to degrade when the consistent topology cannot resolve the
+	// key — typically during a full outage, when health checks have
+	// removed every node while the pool still lists upstreams.
+	// "random" (the default) defers to the fallback policy;
+	// "rendezvous" hashes the key over the available pool with
+	// highest-random-weight hashing, so affinity stays deterministic
+	// for the whole outage window; "first" picks the first available
+	// host in pool order.
+	FallbackMode string `json:"fallback_mode,omitempty"`
+
+	// How many consecutive contradicting health events it takes before
+	// a node is actually removed from (or restored to) the topology.
+	// Raising this above the default of 1 keeps a flapping health
+	// checker from churning keys on every probe.
+	MinConfirmations int `json:"min_confirmations,omitempty"`
+
+	// When MinConfirmations is above 1, a run of contradicting health
+	// events is discarded if the gap between two of them exceeds this
+	// window. Zero (the default) means runs never expire.
+	FlapWindow caddy.Duration `json:"flap_window,omitempty"`
+
+	// Rebuild the consistent engine from the live topology once the
+	// removal history exceeds this many tombstones. Removals that are
+	// never restored stay in the memento table forever and lookups
+	// chase their replacer chains, so autoscaled pools slow down over
+	// time; compaction trades a one-time key reshuffle for chain-free
+	// lookups again. Zero (the default) never compacts.
+	CompactThreshold int `json:"compact_threshold,omitempty"`
+
+	// Whether to keep a bounded sample of recently seen hash keys, so
+	// the removal simulation admin endpoint can estimate the blast
+	// radius of taking an upstream down without the caller supplying
+	// keys. Off by default.
+	TrackKeys bool `json:"track_keys,omitempty"`
+
+	// How many distinct recent keys to retain when TrackKeys is
+	// enabled. Default is 1024.
+	TrackKeysLimit int `json:"track_keys_limit,omitempty"`
+
+	// How many synthetic keys to sample through the engine when the
+	// topology status endpoint estimates each node's key share.
+	// Default is 10000.
+	ShareSampleSize int `json:"share_sample_size,omitempty"`
+
+	// Query parameters to drop before hashing when Field is "uri" or
+	// one of its variants, so cache-busting parameters like "_" or
+	// "utm_*" don't break URI affinity. Each entry is a literal name
+	// or a path.Match glob. The surviving parameters are re-encoded
+	// sorted by name, so reordered query strings hash identically.
+	IgnoreQueryParams []string `json:"ignore_query_params,omitempty"`
+
+	// Query parameters to keep before hashing; all others are dropped.
+	// When set, this allow-list takes precedence and
+	// ignore_query_params is not consulted. Same pattern syntax and
+	// canonical sorting as ignore_query_params.
+	IncludeQueryParams []string `json:"include_query_params,omitempty"`
+
+	// Whether two configured upstreams may share the same identity
+	// (dial address). By default a collision fails provisioning, since
+	// the topology's identity index would silently merge the entries;
+	// when enabled, colliding upstreams are disambiguated automatically
+	// by assigning each an indexed hash key ("dial#0", "dial#1", ...).
+	AllowDuplicateDials bool `json:"allow_duplicate_dials,omitempty"`
+
+	// When to enter the configured upstreams into the consistent
+	// topology: "all" (the default) enters every upstream during
+	// provisioning, before any health state exists, so a host that is
+	// dead at startup still receives keys until the first unhealthy
+	// event; "healthy_only" defers population until the first active
+	// health check round completes, entering only the upstreams it
+	// found healthy (requires active health checks); "lazy" defers
+	// population until the first selection, entering the upstreams
+	// available in that selection's pool.
+	InitialTopology string `json:"initial_topology,omitempty"`
+
+	// How many consecutive selections may miss the consistent topology
+	// (the engine unable to map a key to a usable member of a pool
+	// that still has available hosts) before the consistency circuit
+	// breaker fires. Such runs mean the engine and the pool have
+	// drifted apart (lost health events, bugs) and every affected
+	// request silently degrades to the fallback, costing cache hit
+	// rates without any visible error. When the breaker fires it logs
+	// an error, bumps the topology_resync metric, and re-syncs the
+	// topology from the pool's available members. 0 (the default)
+	// disables the breaker.
+	ResyncThreshold int `json:"resync_threshold,omitempty"`
+
+	// The minimum interval between automatic topology re-syncs, so a
+	// persistently broken topology doesn't rebuild on every request.
+	// Default is 30s.
+	ResyncInterval caddy.Duration `json:"resync_interval,omitempty"`
+
+	// Whether to keep the topology in sync with the pool passed to
+	// Select, for setups without an events app (minimal configs,
+	// tests): each selection fingerprints the pool's available members
+	// and, when the fingerprint differs from the last one seen, diffs
+	// the pool against the engine and applies the adds and removes.
+	// The steady-state cost is one allocation-free pass over the pool.
+	// Off by default; health events remain the preferred mechanism
+	// when an events app is configured.
+	SyncFromPool bool `json:"sync_from_pool,omitempty"`
+
+	// The minimum interval between fingerprint checks when
+	// sync_from_pool is enabled, bounding the per-selection cost on
+	// large pools. Zero (the default) checks on every selection.
+	SyncInterval caddy.Duration `json:"sync_interval,omitempty"`
+
+	// Whether to carry the consistent engine across config reloads.
+	// Without it every reload rebuilds the mapping from scratch, losing
+	// the topology learned from health events and causing a burst of
+	// affinity misses even when the upstream list didn't change. With
+	// it, reprovisioning adopts the previous engine whenever the
+	// configured upstream set is identical, and only rebuilds when the
+	// set actually changed. Off by default.
+	PreserveState bool `json:"preserve_state,omitempty"`
+
+	// An optional path to persist the consistent engine state to.
+	// Cleanup writes a snapshot of the engine — node list, removal
+	// history, and indirection mapping — to this file, and a later
+	// provisioning restores it when the configured upstream set matches
+	// the snapshot's, so even a full process restart keeps the
+	// key-to-node mapping instead of rebuilding it (and reshuffling
+	// keys) from scratch. A corrupt or mismatched snapshot is ignored
+	// with a warning and the topology is built fresh.
+	StateFile string `json:"state_file,omitempty"`
+
+	// An optional path to a newline-delimited list of keys to run
+	// through the engine once after the topology is populated, warming
+	// internal structures so known-hot keys (e.g. tenant IDs) don't pay
+	// first-lookup latency right after a reload. A missing or unreadable
+	// file logs a warning and is otherwise ignored.
+	WarmupKeysFile string `json:"warmup_keys_file,omitempty"`
+
+	// An optional path to a file of `key,upstream_dial` pairs (one per
+	// line) to install as timed routing overrides once the topology is
+	// populated. When migrating from another stickiness scheme (e.g.
+	// cookie-based), exporting the old key ownership — from the
+	// shadow-mode disagreement log or the trace buffer — and seeding it
+	// here keeps existing sessions on their historical upstream while
+	// new keys follow the engine; the seeds expire after seed_ttl,
+	// leaving pure engine behavior. Malformed lines and an unreadable
+	// file log a warning and are otherwise ignored, and at most
+	// maxAffinitySeedEntries entries are installed.
+	AffinitySeedFile string `json:"affinity_seed,omitempty"`
+
+	// How long seeded affinity overrides stay in effect. Defaults to 1h.
+	SeedTTL caddy.Duration `json:"seed_ttl,omitempty"`
+
+	// The fallback policy to use if the field is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+
+	verboseLogging
+	selectionTracing
+	hashFunctionChooser
+	availabilityChooser
+	keyComponentChooser
+	overrideChooser
+	handlerScope
+
+	// Internal state for consistent hashing
+	consistentEngine consistentHasher
+	topology         sync.Map // Track which upstreams are currently available (map[*Upstream]bool, thread-safe)
+	nodesByID        sync.Map // Node ID (dial string) -> *Upstream, for O(1) event lookups (thread-safe)
+	debouncer        *healthEventDebouncer
+	keySampler       *recentKeySampler
+	resyncBreaker    *consistencyBreaker
+	poolSync         *poolSyncState
+	deferredInit     *deferredTopology // set when initial_topology defers population
+	stateKey         string            // usage pool key while PreserveState holds a reference
+
+	// Event system integration
+	events *caddyevents.App
+	ctx    caddy.Context
+}
+
+// CaddyModule returns the Caddy module information.
+func (MementoSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.memento",
+		New: func() caddy.Module { return new(MementoSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *MementoSelection) Provision(ctx caddy.Context) error {
+	if s.Field == "" {
+		s.Field = "ip" // Default to IP-based hashing
+	}
+	switch s.Field {
+	case "ip", "client_ip", "uri", "original_uri", "path_only", "path_and_query":
+	case "header":
+		if s.HeaderField == "" {
+			return fmt.Errorf("field 'header' requires a header_field")
+		}
+	case "cookie":
+		if s.CookieName == "" {
+			return fmt.Errorf("field 'cookie' requires a cookie_name")
+		}
+	case "expression":
+		if s.Expression == "" {
+			return fmt.Errorf("field 'expression' requires an expression to evaluate")
+		}
+	default:
+		return fmt.Errorf("unrecognized field '%s': must be one of 'ip', 'client_ip', 'uri', 'original_uri', 'path_only', 'path_and_query', 'header', 'cookie', or 'expression'", s.Field)
+	}
+	if s.LoadFactor == 0 {
+		s.LoadFactor = 1.25
+	}
+	if s.LoadFactor < 1 {
+		return fmt.Errorf("load_factor must be at least 1, got %f", s.LoadFactor)
+	}
+	if s.MaxProbes < 0 {
+		return fmt.Errorf("max_probes must be positive, got %d", s.MaxProbes)
+	}
+	if s.MaxProbes == 0 {
+		s.MaxProbes = maxLoadProbes
+	}
+	if err := validateMaskBits(s.IPv4MaskBits, s.IPv6MaskBits); err != nil {
+		return err
+	}
+	switch s.FallbackMode {
+	case "":
+		s.FallbackMode = "random"
+	case "random", "rendezvous", "first":
+	default:
+		return fmt.Errorf("unrecognized fallback_mode '%s': must be 'random', 'rendezvous', or 'first'", s.FallbackMode)
+	}
+	if s.MinConfirmations < 0 {
+		return fmt.Errorf("min_confirmations must be positive, got %d", s.MinConfirmations)
+	}
+	if s.MinConfirmations == 0 {
+		s.MinConfirmations = 1
+	}
+	s.debouncer = newHealthEventDebouncer(time.Duration(s.FlapWindow), s.MinConfirmations)
+	if s.ResyncThreshold < 0 {
+		return fmt.Errorf("resync_threshold must be positive, got %d", s.ResyncThreshold)
+	}
+	if s.ResyncInterval == 0 {
+		s.ResyncInterval = caddy.Duration(30 * time.Second)
+	}
+	if s.ResyncThreshold > 0 {
+		s.resyncBreaker = &consistencyBreaker{
+			policy:    s,
+			threshold: int64(s.ResyncThreshold),
+			interval:  time.Duration(s.ResyncInterval),
+		}
+	}
+	if s.SyncInterval < 0 {
+		return fmt.Errorf("sync_interval must be positive, got %v", time.Duration(s.SyncInterval))
+	}
+	if s.SyncFromPool {
+		s.poolSync = &poolSyncState{
+			policy:   s,
+			interval: time.Duration(s.SyncInterval),
+		}
+	}
+	if s.CompactThreshold < 0 {
+		return fmt.Errorf("compact_threshold must be positive, got %d", s.CompactThreshold)
+	}
+	if err := validateHashInput(s.HashInput, s.HashSecret); err != nil {
+		return err
+	}
+	if s.TrackKeysLimit < 0 {
+		return fmt.Errorf("track_keys_limit must be positive, got %d", s.TrackKeysLimit)
+	}
+	if s.TrackKeys {
+		s.keySampler = newRecentKeySampler(s.TrackKeysLimit)
+	}
+	if s.ShareSampleSize < 0 {
+		return fmt.Errorf("share_sample_size must be positive, got %d", s.ShareSampleSize)
+	}
+	if err := validateQueryParamPatterns(s.IgnoreQueryParams); err != nil {
+		return err
+	}
+	if err := validateQueryParamPatterns(s.IncludeQueryParams); err != nil {
+		return err
+	}
+	if s.SeedTTL < 0 {
+		return fmt.Errorf("seed_ttl must be positive, got %v", time.Duration(s.SeedTTL))
+	}
+	if s.SeedTTL == 0 {
+		s.SeedTTL = caddy.Duration(time.Hour)
+	}
+
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "memento", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+
+	// Initialize topology tracking (sync.Map is zero-initialized, no need to initialize)
+
+	// Initialize consistent engine
+	// ConsistentEngine creates MementoEngine internally, which in turn creates BinomialEngine
+	// This architecture allows for arbitrary node removals while maintaining consistency
+	switch s.Engine {
+	case "", "lockfree":
+		s.Engine = "lockfree"
+		s.consistentEngine = NewConsistentEngineWithType(true)
+	case "rwmutex":
+		s.consistentEngine = NewConsistentEngineWithType(false)
+	default:
+		return fmt.Errorf("unrecognized engine '%s': must be 'lockfree' or 'rwmutex'", s.Engine)
+	}
+
+	switch s.InitialTopology {
+	case "":
+		s.InitialTopology = initialTopologyAll
+	case initialTopologyAll:
+	case initialTopologyHealthyOnly, initialTopologyLazy:
+		s.deferredInit = &deferredTopology{populate: s.populateFiltered}
+	default:
+		return fmt.Errorf("unrecognized initial_topology '%s': must be 'all', 'healthy_only', or 'lazy'", s.InitialTopology)
+	}
+
+	if err := s.provisionHashFunction(); err != nil {
+		return err
+	}
+	if err := s.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := s.provisionKeyComponents(); err != nil {
+		return err
+	}
+	if len(s.KeyComponents) > 0 && s.Field != "ip" {
+		return fmt.Errorf("key_components is only supported with the 'ip' field, not '%s'", s.Field)
+	}
+	if err := s.provisionOverrides(ctx); err != nil {
+		return err
+	}
+	s.consistentEngine.SetKeyHasher(s.hashFn)
+
+	if err := s.provisionVerboseLogging(ctx, s); err != nil {
+		return err
+	}
+	if err := s.provisionSelectionTracing(); err != nil {
+		return err
+	}
+
+	// Set up event system integration
+	s.ctx = ctx
+
+	// Note: Event subscription will be handled by the reverse proxy handler
+	// when it provisions this selection policy, not during our Provision phase
+
+	return nil
+}
+
+// requestKey extracts the hash key for the request according to the
+// configured Field. The second return value is false when no key can
+// be derived (unknown field, or a missing header), in which case the
+// caller should defer to the fallback policy.
+func (s MementoSelection) requestKey(req *http.Request) (string, bool) {
+	switch s.Field {
+	case "ip":
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		return s.composeKey(req, maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits)), true
+	case "client_ip":
+		address := clientIPVarOrRemoteAddr(req)
+		clientIP, _, err := net.SplitHostPort(address)
+		if err != nil {
+			clientIP = address
+		}
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "uri", "original_uri", "path_only", "path_and_query":
+		return canonicalizeQueryParams(uriHashKey(req, s.Field), s.IncludeQueryParams, s.IgnoreQueryParams), true
+	case "header":
+		if s.HeaderField == "" {
+			return "", false
+		}
+		key, ok := headerHashValue(req, s.HeaderField, s.JoinValues, s.Canonicalize)
+		if !ok {
+			return "", false
+		}
+		return transformHashInput(key, s.HashInput, s.HashSecret), true
+	case "cookie":
+		if s.CookieName == "" {
+			return "", false
+		}
+		cookie, err := req.Cookie(s.CookieName)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return transformHashInput(cookie.Value, s.HashInput, s.HashSecret), true
+	case "expression":
+		repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if !ok {
+			return "", false
+		}
+		key := repl.ReplaceAll(s.Expression, "")
+		return key, key != ""
+	}
+	return "", false
+}
+
+// Select returns an available host, if any.
+func (s MementoSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	if len(pool) == 0 {
+		return nil
+	}
+	s.ensureLazyTopology(pool)
+
+	// Get the key to hash based on the field type
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+	}
+	if s.keySampler != nil {
+		s.keySampler.record(key)
+	}
+	if upstream, ok := s.overrideFor(key, pool, s.Availability); ok {
+		return upstream
+	}
+
+	// Use consistent engine with Memento for stable hashing (default)
+	// If the engine is not yet initialized with topology (e.g., no events in tests),
+	// degrade according to the configured fallback mode.
+	if s.consistentEngine == nil {
+		return s.fallbackSelect(pool, req, w, key)
+	}
+
+	if s.poolSync != nil {
+		s.poolSync.maybeSync(pool)
+	}
+
+	if upstream := s.SelectByKey(pool, key); upstream != nil {
+		if s.resyncBreaker != nil {
+			s.resyncBreaker.recordHit()
+		}
+		return upstream
+	}
+
+	if s.BoundedLoad {
+		// every probe exceeded the bound; spread the load like least_conn
+		return LeastConnSelection{}.Select(pool, req, w)
+	}
+
+	// The key's owner can't take the request and rehashing is off or
+	// found nothing usable - degrade per the configured fallback mode.
+	// A run of these while the pool still has available hosts is the
+	// consistency breaker's trigger: it means the engine and the pool
+	// have drifted apart.
+	if s.resyncBreaker != nil {
+		s.resyncBreaker.recordMiss(pool)
+	}
+	return s.fallbackSelect(pool, req, w, key)
+}
+
+// SelectByKey resolves an already-extracted key against the consistent
+// topology, without touching a request. It returns nil when the
+// topology cannot map the key to a usable upstream (engine not
+// initialized, empty, or the key's owner unavailable with rehashing
+// off); request-path callers then degrade per the fallback mode.
+func (s *MementoSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	if s.consistentEngine == nil {
+		return nil
+	}
+	s.ensureLazyTopology(pool)
+
+	if s.BoundedLoad {
+		return s.boundedLookup(pool, key)
+	}
+
+	// Resolve the key against one snapshot of the consistent state;
+	// a concurrent topology change yields either the old or the new
+	// owner, never a stale intermediate node
+	upstream, ok := s.consistentEngine.Lookup(key)
+	if !ok {
+		// Engine is empty (e.g. every node was marked unhealthy). A
+		// non-empty engine always yields a topology member, so this
+		// is the only way Lookup comes up empty.
+		return nil
+	}
+
+	if availableFor(upstream, s.Availability) && !upstream.slowStartHoldback() {
+		s.traceSelection("memento", key, upstream)
+		if s.verboseLogEnabled() {
+			s.logSelection("memento", key, upstream, false,
+				zap.Int("bucket", s.consistentEngine.GetBucketIndex(key)))
+		}
+		return upstream
+	}
+
+	// The key's owner is warming up after a recovery (a fraction of
+	// its keys defer to their secondary target until the slow-start
+	// window passes) or is known but can't take the request right now
+	// (e.g. MaxRequests reached before any unhealthy event fired);
+	// optionally re-hash deterministically so the overflow target is
+	// stable for this key instead of jumping straight to the fallback
+	if s.RehashUnavailable {
+		if secondary := s.rehashLookup(key); secondary != nil {
+			return secondary
+		}
+	}
+
+	return nil
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request. The key's owner has been tried by definition,
+// so the engine is probed with deterministically derived keys (the same
+// scheme rehashLookup uses) until it yields an untried available host;
+// failing that, the fallback mode decides among the untried hosts.
+func (s *MementoSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	if len(pool) == 0 {
+		return nil
+	}
+	s.ensureLazyTopology(pool)
+	untried := make(UpstreamPool, 0, len(pool))
+	for _, upstream := range pool {
+		if _, ok := tried[upstream]; !ok {
+			untried = append(untried, upstream)
+		}
+	}
+	if len(untried) == 0 {
+		// every host has been tried; retrying a possibly-failing host
+		// beats returning no host at all
+		return s.Select(pool, req, w)
+	}
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectViaFallback(s.fallback, untried, req, w, selectionFallbackKeyMissing)
+	}
+	if s.consistentEngine == nil {
+		return s.fallbackSelect(untried, req, w, key)
+	}
+	for probe := 0; probe <= s.MaxProbes; probe++ {
+		probeKey := key
+		if probe > 0 {
+			probeKey = key + "#" + strconv.Itoa(probe)
+		}
+		candidate, ok := s.consistentEngine.Lookup(probeKey)
+		if !ok {
+			// engine is empty; no derived key will fare any better
+			break
+		}
+		if _, already := tried[candidate]; already || !availableFor(candidate, s.Availability) {
+			continue
+		}
+		return candidate
+	}
+	return s.fallbackSelect(untried, req, w, key)
+}
+
+// fallbackSelect resolves a request whose key the consistent topology
+// could not map to a usable node, honoring the configured FallbackMode.
+// The rendezvous and first modes only apply when a hash key was
+// actually extracted; callers that have no key (e.g. a missing header)
+// go through the fallback policy directly.
+func (s *MementoSelection) fallbackSelect(pool UpstreamPool, req *http.Request, w http.ResponseWriter, key string) *Upstream {
+	// distinguish an empty topology from a key whose owner cannot take
+	// the request; the rendezvous and first modes are fallbacks too, so
+	// the cause is recorded regardless of which branch serves it
+	cause := selectionFallbackUnavailable
+	if s.consistentEngine == nil || s.consistentEngine.Size() == 0 {
+		cause = selectionFallbackEngineEmpty
+	}
+	recordFallbackCause(req, cause)
+	upstream := func() *Upstream {
+		switch s.FallbackMode {
+		case "rendezvous":
+			if upstream, _ := hostByHashingWith(pool, key, s.hashFn, s.Availability, nil); upstream != nil {
+				return upstream
+			}
+		case "first":
+			if upstream := (FirstSelection{}).Select(pool, req, w); upstream != nil {
+				return upstream
+			}
+		}
+		return selectViaFallback(s.fallback, pool, req, w, cause)
+	}()
+	s.traceSelection("memento", key, upstream)
+	if s.verboseLogEnabled() {
+		s.logSelection("memento", key, upstream, true)
+	}
+	return upstream
+}
+
+// consistencyBreaker watches for runs of selections that the
+// consistent topology could not serve even though the pool still had
+// available members — the signature of the engine and the pool having
+// drifted apart (lost health events, bugs). Without it the only
+// symptom of drift is a silent degradation to the fallback policy and
+// a worse cache hit rate. Past the threshold the breaker re-syncs the
+// topology from the pool, rate-limited so a persistently broken setup
+// doesn't rebuild on every request.
+type consistencyBreaker struct {
+	policy      *MementoSelection
+	threshold   int64
+	interval    time.Duration
+	consecutive int64 // consecutive topology misses (atomic)
+	lastResync  int64 // when the last re-sync ran, unix nanos (atomic)
+}
+
+// recordHit resets the run of consecutive misses.
+func (b *consistencyBreaker) recordHit() {
+	atomic.StoreInt64(&b.consecutive, 0)
+}
+
+// recordMiss counts one selection the topology could not serve. Misses
+// with no available host in the pool don't count: falling back is the
+// correct outcome then, not a symptom of drift.
+func (b *consistencyBreaker) recordMiss(pool UpstreamPool) {
+	anyAvailable := false
+	for _, upstream := range pool {
+		if upstream != nil && upstream.Available() {
+			anyAvailable = true
+			break
+		}
+	}
+	if !anyAvailable {
+		return
+	}
+	if atomic.AddInt64(&b.consecutive, 1) < b.threshold {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&b.lastResync)
+	if now-last < int64(b.interval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&b.lastResync, last, now) {
+		// another goroutine won the race and is re-syncing
+		return
+	}
+	atomic.StoreInt64(&b.consecutive, 0)
+	if b.policy.logger != nil {
+		b.policy.logger.Error("memento topology drifted from the upstream pool; re-syncing",
+			zap.Int64("consecutive_misses", b.threshold),
+			zap.Int("pool_size", len(pool)))
+	}
+	observeTopologyResync("memento")
+	b.policy.resyncTopology(pool)
+}
+
+// poolSyncState drives the opt-in sync_from_pool mode. Topology changes
+// are normally fed by health events, but a config without an events app
+// never delivers any, so the engine would never learn about a reloaded
+// pool or a member flipping Available(). Each selection compares a
+// cheap fingerprint of the pool's available members against the last
+// one seen and re-syncs the topology only when they differ.
+type poolSyncState struct {
+	policy      *MementoSelection
+	interval    time.Duration
+	lastCheck   int64  // when the last fingerprint check ran, unix nanos (atomic)
+	fingerprint uint64 // fingerprint of the available members at the last sync (atomic)
+	syncing     int32  // whether a re-sync is in flight (atomic)
+}
+
+// poolFingerprint folds the pool's available members into one value:
+// the xor of each member's identity hash, mixed with the member count.
+// Xor is order-independent, so a reordered pool doesn't read as a
+// change, and the whole computation allocates nothing.
+func poolFingerprint(pool UpstreamPool) uint64 {
+	var fp uint64
+	var count uint64
+	for _, upstream := range pool {
+		if upstream == nil || !upstream.Available() {
+			continue
+		}
+		fp ^= hashString(upstream.hashKey())
+		count++
+	}
+	return fp ^ (count * 0x9e3779b97f4a7c15)
+}
+
+// maybeSync fingerprints the pool if the check interval has elapsed and
+// re-syncs the topology when the available members changed. The common
+// case — nothing changed — costs two atomic loads and one pass over the
+// pool; when a change is detected, one goroutine applies the diff while
+// concurrent selections keep serving from the current topology.
+func (ps *poolSyncState) maybeSync(pool UpstreamPool) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&ps.lastCheck)
+	if ps.interval > 0 {
+		if now-last < int64(ps.interval) {
+			return
+		}
+		if !atomic.CompareAndSwapInt64(&ps.lastCheck, last, now) {
+			// another goroutine took this interval's check
+			return
+		}
+	}
+	fp := poolFingerprint(pool)
+	if fp == atomic.LoadUint64(&ps.fingerprint) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&ps.syncing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&ps.syncing, 0)
+	atomic.StoreUint64(&ps.fingerprint, fp)
+	ps.policy.resyncTopology(pool)
+}
+
+// resyncTopology rebuilds the consistent topology from the pool's
+// currently available members, diff-aware: members the engine already
+// tracks keep their buckets (so their keys don't move), stale engine
+// entries are dropped, and missing pool members are added in pool
+// order so every instance applying the same pool assigns the same
+// buckets.
+func (s *MementoSelection) resyncTopology(pool UpstreamPool) {
+	if s.consistentEngine == nil {
+		return
+	}
+	desired := make(map[*Upstream]bool, len(pool))
+	for _, upstream := range pool {
+		if upstream != nil && upstream.Available() {
+			desired[upstream] = true
+		}
+	}
+	for _, upstream := range s.consistentEngine.GetTopology() {
+		if desired[upstream] {
+			// already tracked: keep its bucket
+			delete(desired, upstream)
+			continue
+		}
+		if err := s.consistentEngine.RemoveNode(upstream); err == nil {
+			topologyDeactivate(&s.topology, upstream, "resync")
+			unindexUpstreamIDs(&s.nodesByID, upstream)
+		}
+	}
+	for _, upstream := range pool {
+		if !desired[upstream] {
+			continue
+		}
+		if err := s.consistentEngine.AddNode(upstream); err != nil {
+			if s.logger != nil {
+				s.logger.Error("cannot add upstream to topology during resync",
+					zap.String("upstream", upstream.String()),
+					zap.Error(err))
+			}
+			continue
+		}
+		topologyActivate(&s.topology, upstream, "resync")
+		indexUpstreamIDs(&s.nodesByID, upstream)
+	}
+	s.topologyChanged()
+}
+
+// Preview explains which upstream the given key maps to, including the
+// memento bucket index. The pool argument is unused because the policy
+// tracks its own topology through health events.
+func (s *MementoSelection) Preview(_ UpstreamPool, key string) SelectionExplanation {
+	expl := SelectionExplanation{Policy: "memento", Key: key}
+	if s.consistentEngine == nil || s.consistentEngine.Size() == 0 {
+		return expl
+	}
+	bucket := s.consistentEngine.GetBucketIndex(key)
+	expl.Bucket = &bucket
+	if upstream, ok := s.consistentEngine.GetNodeID(bucket); ok {
+		expl.Upstream = upstream.String()
+	}
+	return expl
+}
+
+// rehashLookup probes the engine with keys derived deterministically
+// from the original key until it finds an available upstream, trying at
+// most MaxProbes derived keys. Returns nil if every probe came up
+// empty or unavailable.
+func (s *MementoSelection) rehashLookup(key string) *Upstream {
+	for probe := 1; probe <= s.MaxProbes; probe++ {
+		if candidate, ok := s.consistentEngine.Lookup(key + "#" + strconv.Itoa(probe)); ok && availableFor(candidate, s.Availability) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// maxLoadProbes is how many deterministically derived keys a bounded-load
+// lookup tries before giving up and spreading the load like least_conn.
+const maxLoadProbes = 8
+
+// loadBound computes the bounded-load admission limit for the pool:
+// loadFactor times the average number of in-flight requests across
+// available hosts. The second return value is false when no host is
+// available.
+func loadBound(pool UpstreamPool, loadFactor float64) (float64, bool) {
+	var total, count int
+	for _, upstream := range pool {
+		if upstream == nil || !upstream.Available() {
+			continue
+		}
+		total += upstream.NumRequests()
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return loadFactor * float64(total) / float64(count), true
+}
+
+// boundedLookup returns the upstream for key whose in-flight load is
+// within the configured bound. When the primary owner exceeds the bound,
+// secondary candidates are probed with keys derived deterministically
+// from the original key, so a hot key's overflow target is stable and
+// warm caches stay mostly effective. Returns nil if every probe
+// exceeded the bound.
+func (s *MementoSelection) boundedLookup(pool UpstreamPool, key string) *Upstream {
+	bound, ok := loadBound(pool, s.LoadFactor)
+	if !ok {
+		return nil
+	}
+	probeKey := key
+	for probe := 0; probe <= maxLoadProbes; probe++ {
+		if probe > 0 {
+			probeKey = key + "#" + strconv.Itoa(probe)
+		}
+		upstream, ok := s.consistentEngine.Lookup(probeKey)
+		if !ok || !availableFor(upstream, s.Availability) {
+			continue
+		}
+		if float64(upstream.NumRequests()) <= bound {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// mementoCaddyfileOptions lists every sub-directive the memento
+// unmarshaler accepts, so unrecognized options can be matched against
+// it for a "did you mean" suggestion.
+var mementoCaddyfileOptions = append([]string{
+	"field", "header_field", "join_values", "canonicalize", "cookie_name",
+	"expression", "engine", "ipv4_mask", "ipv6_mask", "bounded_load",
+	"rehash_unavailable", "fallback_mode", "min_confirmations",
+	"flap_window", "compact_threshold", "resync_threshold",
+	"resync_interval", "sync_from_pool", "sync_interval", "track_keys",
+	"share_sample_size", "ignore_query_params", "include_query_params",
+	"allow_duplicate_dials", "initial_topology", "preserve_state",
+	"state_file", "warmup_keys_file", "affinity_seed", "seed_ttl",
+	"fallback", "accept_external_events",
+}, sharedSelectionOptions...)
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (s *MementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	// Parse field type
+	if d.NextArg() {
+		s.Field = d.Val()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Field = d.Val()
+		case "header_field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HeaderField = d.Val()
+		case "join_values":
+			s.JoinValues = true
+		case "canonicalize":
+			s.Canonicalize = true
+		case "cookie_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.CookieName = d.Val()
+		case "expression":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Expression = d.Val()
+		case "engine":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Engine = d.Val()
+		case "ipv4_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv6MaskBits = bits
+		case "bounded_load":
+			s.BoundedLoad = true
+			if d.NextArg() {
+				loadFactor, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid load factor '%s': %v", d.Val(), err)
+				}
+				s.LoadFactor = loadFactor
+			}
+		case "rehash_unavailable":
+			s.RehashUnavailable = true
+			if d.NextArg() {
+				maxProbes, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_probes '%s': %v", d.Val(), err)
+				}
+				s.MaxProbes = maxProbes
+			}
+		case "fallback_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.FallbackMode = d.Val()
+		case "min_confirmations":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			minConfirmations, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid min_confirmations '%s': %v", d.Val(), err)
+			}
+			s.MinConfirmations = minConfirmations
+		case "flap_window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			flapWindow, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid flap_window '%s': %v", d.Val(), err)
+			}
+			s.FlapWindow = caddy.Duration(flapWindow)
+		case "compact_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid compact_threshold '%s': %v", d.Val(), err)
+			}
+			s.CompactThreshold = threshold
+		case "resync_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid resync_threshold '%s': %v", d.Val(), err)
+			}
+			s.ResyncThreshold = threshold
+		case "resync_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid resync_interval '%s': %v", d.Val(), err)
+			}
+			s.ResyncInterval = caddy.Duration(interval)
+		case "sync_from_pool":
+			s.SyncFromPool = true
+		case "sync_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid sync_interval '%s': %v", d.Val(), err)
+			}
+			s.SyncInterval = caddy.Duration(interval)
+		case "track_keys":
+			s.TrackKeys = true
+			if d.NextArg() {
+				limit, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid track_keys limit '%s': %v", d.Val(), err)
+				}
+				s.TrackKeysLimit = limit
+			}
+		case "share_sample_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid share_sample_size '%s': %v", d.Val(), err)
+			}
+			s.ShareSampleSize = size
+		case "ignore_query_params":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			s.IgnoreQueryParams = append(s.IgnoreQueryParams, args...)
+		case "include_query_params":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			s.IncludeQueryParams = append(s.IncludeQueryParams, args...)
+		case "allow_duplicate_dials":
+			s.AllowDuplicateDials = true
+		case "initial_topology":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.InitialTopology = d.Val()
+		case "preserve_state":
+			s.PreserveState = true
+		case "state_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.StateFile = d.Val()
+		case "warmup_keys_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.WarmupKeysFile = d.Val()
+		case "affinity_seed":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.AffinitySeedFile = d.Val()
+		case "seed_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			seedTTL, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid seed_ttl '%s': %v", d.Val(), err)
+			}
+			s.SeedTTL = caddy.Duration(seedTTL)
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		default:
+			handled, err := s.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = s.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalHashOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalAvailabilityOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalKeyComponentsOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalOverrideOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalHandlerScopeOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				if suggestion := suggestOption(d.Val(), mementoCaddyfileOptions); suggestion != "" {
+					return d.Errf("unrecognized option '%s' (did you mean '%s'?)", d.Val(), suggestion)
+				}
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// SetEventsApp sets the events app for this selection policy
+// This should be called by the reverse proxy handler when it provisions the selection policy
+func (s *MementoSelection) SetEventsApp(events *caddyevents.App) {
+	if events != nil {
+		s.events = events
+		s.subscribeToHealthEvents()
+	}
+}
+
+// resolveDuplicateDials implements duplicateDialResolver; the handler
+// calls it before seeding the initial topology.
+func (s *MementoSelection) resolveDuplicateDials(upstreams []*Upstream) error {
+	return resolveDuplicateDialIdentities(upstreams, s.AllowDuplicateDials)
+}
+
+// PopulateInitialTopology populates the Memento topology with initial upstreams
+// This should be called by the reverse proxy handler after SetEventsApp.
+// Under initial_topology healthy_only or lazy the upstream set is only
+// parked here; population happens on the mode's trigger.
+func (s *MementoSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	if s.deferredInit != nil {
+		s.deferredInit.hold(upstreams)
+		return
+	}
+	s.populateTopology(upstreams)
+}
+
+// populateFiltered indexes every configured upstream — so a host the
+// filter excluded still joins the topology on its first healthy event —
+// and populates the topology with the subset keep accepts. Excluded
+// hosts are recorded as unhealthy with the debouncer, so that first
+// healthy event reads as a transition.
+func (s *MementoSelection) populateFiltered(upstreams []*Upstream, keep func(*Upstream) bool) {
+	kept := make([]*Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream == nil {
+			continue
+		}
+		indexUpstreamIDs(&s.nodesByID, upstream)
+		if keep(upstream) {
+			kept = append(kept, upstream)
+			continue
+		}
+		if s.debouncer != nil {
+			s.debouncer.assume(upstream.String(), false)
+		}
+	}
+	s.populateTopology(kept)
+}
+
+// populateTopology is the real population path, run directly for
+// initial_topology all and through populateFiltered otherwise.
+func (s *MementoSelection) populateTopology(upstreams []*Upstream) {
+	if s.consistentEngine == nil {
+		return
+	}
+	// publish the initial key shares regardless of which path below
+	// populated the topology, and once it is in place, warm the engine
+	// from the configured keys file and install the affinity seeds
+	defer s.seedAffinityOverrides()
+	defer s.warmupEngine()
+	defer s.refreshKeyShareGauge()
+
+	// Adopt the engine a predecessor left behind on reload, if any;
+	// otherwise fall through and build a fresh topology
+	if s.PreserveState && s.adoptPreservedState(upstreams) {
+		return
+	}
+
+	// No in-memory predecessor (e.g. a full process restart): restore
+	// the snapshot the previous process wrote on shutdown, if any
+	if s.StateFile != "" && s.adoptStateFile(upstreams) {
+		return
+	}
+
+	// No lock needed: topology and engine are now thread-safe
+	// Add all configured upstreams as healthy, using the bulk path
+	// so large pools are provisioned in a single pass
+	toAdd := make([]*Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if !topologyActive(&s.topology, upstream) {
+			toAdd = append(toAdd, upstream)
+		}
+	}
+	// an error shouldn't happen in normal operation; nodes added before
+	// the error are still in the engine, so track exactly those below
+	if err := s.consistentEngine.AddNodes(toAdd); err != nil && s.logger != nil {
+		s.logger.Error("cannot populate initial topology", zap.Error(err))
+	}
+	for _, upstream := range toAdd {
+		if !s.consistentEngine.HasNode(upstream) {
+			continue
+		}
+		topologyActivate(&s.topology, upstream, "initial")
+		indexUpstreamIDs(&s.nodesByID, upstream)
+	}
+}
+
+// warmupEngine runs the configured warm-up keys file through the
+// engine, if one is set.
+func (s *MementoSelection) warmupEngine() {
+	if s.WarmupKeysFile == "" {
+		return
+	}
+	warmupFromKeysFile(s.WarmupKeysFile, s.consistentEngine, s.logger)
+}
+
+// seedAffinityOverrides installs the configured affinity seed file as
+// timed overrides, if one is set.
+func (s *MementoSelection) seedAffinityOverrides() {
+	if s.AffinitySeedFile == "" {
+		return
+	}
+	seedOverridesFromAffinityFile(s.AffinitySeedFile, time.Duration(s.SeedTTL), s.overrides, s.logger)
+}
+
+// ensureLazyTopology populates the topology from this selection's pool
+// when initial_topology is "lazy" and this is the first selection.
+func (s *MementoSelection) ensureLazyTopology(pool UpstreamPool) {
+	if s.deferredInit == nil || s.InitialTopology != initialTopologyLazy {
+		return
+	}
+	s.deferredInit.trigger(pool, func(upstream *Upstream) bool {
+		return availableFor(upstream, s.Availability)
+	})
+}
+
+// completeInitialHealthChecks populates a healthy_only-deferred
+// topology from the health state the first active round established.
+func (s *MementoSelection) completeInitialHealthChecks() {
+	if s.deferredInit == nil || s.InitialTopology != initialTopologyHealthyOnly {
+		return
+	}
+	s.deferredInit.trigger(nil, func(upstream *Upstream) bool {
+		return upstream.Healthy()
+	})
+}
+
+// adoptPreservedState hands the policy the engine its predecessor left
+// in mementoStates, provided the configured upstream set is identical
+// (the usage pool key encodes the set, so a changed pool simply misses).
+// It returns true when the topology was fully populated from preserved
+// state; false means the caller should build a fresh topology, and the
+// pooled state — just created if this is the first provisioning under
+// this key — is pointed at this policy's own engine so the next reload
+// can adopt it.
+func (s *MementoSelection) adoptPreservedState(upstreams []*Upstream) bool {
+	s.stateKey = mementoStateKey("memento", s.Engine, upstreams)
+	val, loaded, err := mementoStates.LoadOrNew(s.stateKey, func() (caddy.Destructor, error) {
+		return &preservedMementoState{engine: s.consistentEngine}, nil
+	})
+	if err != nil {
+		return false
+	}
+	state := val.(*preservedMementoState)
+	if !loaded {
+		return false
+	}
+
+	byID := make(map[string]*Upstream, len(upstreams))
+	for _, upstream := range upstreams {
+		byID[upstream.hashKey()] = upstream
+	}
+	if err := state.engine.Rebind(byID); err != nil {
+		// the preserved topology doesn't line up with this pool;
+		// rebuild from scratch rather than serve a broken mapping,
+		// and pool the fresh engine for the next reload instead
+		s.logger.Warn("cannot adopt preserved memento state, rebuilding",
+			zap.Error(err))
+		state.engine = s.consistentEngine
+		return false
+	}
+	s.consistentEngine = state.engine
+	// the adopted engine keeps serving with this config's hash
+	// function, not whatever its predecessor was provisioned with
+	s.consistentEngine.SetKeyHasher(s.hashFn)
+
+	// nodes the predecessor removed on unhealthy events stay out of
+	// the topology, but are indexed so a healthy event can restore them
+	for _, upstream := range upstreams {
+		if state.engine.HasNode(upstream) {
+			topologyActivate(&s.topology, upstream, "preserved")
+		}
+		indexUpstreamIDs(&s.nodesByID, upstream)
+	}
+	if s.verboseLogEnabled() {
+		s.logger.Info("adopted preserved memento state",
+			zap.Int("topology_size", s.consistentEngine.Size()))
+	}
+	return true
+}
+
+// adoptStateFile restores the consistent engine from the snapshot the
+// previous process wrote to StateFile on shutdown, provided the
+// configured upstream set is exactly the snapshot's node set. It
+// returns true when the topology was fully restored; corrupt or
+// mismatched snapshots leave a warning and return false so the caller
+// builds a fresh topology. A missing file is the expected first-start
+// case and is skipped silently.
+func (s *MementoSelection) adoptStateFile(upstreams []*Upstream) bool {
+	data, err := os.ReadFile(s.StateFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Warn("cannot read memento state file, building fresh topology",
+				zap.String("state_file", s.StateFile),
+				zap.Error(err))
+		}
+		return false
+	}
+	if err := s.consistentEngine.UnmarshalBinary(data); err != nil {
+		// the engine is untouched on a failed restore, so it can be
+		// populated fresh by the caller as-is
+		s.logger.Warn("cannot restore memento state file, building fresh topology",
+			zap.String("state_file", s.StateFile),
+			zap.Error(err))
+		return false
+	}
+
+	// the restored topology holds placeholder nodes; re-point it at the
+	// live pool, requiring the sets to match exactly
+	byID := make(map[string]*Upstream, len(upstreams))
+	for _, upstream := range upstreams {
+		byID[upstream.hashKey()] = upstream
+	}
+	var rebindErr error
+	if s.consistentEngine.Size() != len(byID) {
+		rebindErr = fmt.Errorf("snapshot has %d nodes, config has %d", s.consistentEngine.Size(), len(byID))
+	} else {
+		rebindErr = s.consistentEngine.Rebind(byID)
+	}
+	if rebindErr != nil {
+		s.logger.Warn("memento state file does not match the configured upstream set, building fresh topology",
+			zap.String("state_file", s.StateFile),
+			zap.Error(rebindErr))
+		s.consistentEngine = NewConsistentEngineWithType(s.Engine == "lockfree")
+		s.consistentEngine.SetKeyHasher(s.hashFn)
+		return false
+	}
+
+	for _, upstream := range upstreams {
+		topologyActivate(&s.topology, upstream, "restored")
+		indexUpstreamIDs(&s.nodesByID, upstream)
+	}
+	if s.verboseLogEnabled() {
+		s.logger.Info("restored memento state from file",
+			zap.String("state_file", s.StateFile),
+			zap.Int("topology_size", s.consistentEngine.Size()))
+	}
+	return true
+}
+
+// persistStateFile snapshots the consistent engine to StateFile so the
+// next process can warm-restart from it. Failures are logged and
+// otherwise ignored: a lost snapshot costs a cold rebuild on the next
+// start, not correctness.
+func (s *MementoSelection) persistStateFile() {
+	data, err := s.consistentEngine.MarshalBinary()
+	if err != nil {
+		s.logger.Warn("cannot snapshot memento state",
+			zap.String("state_file", s.StateFile),
+			zap.Error(err))
+		return
+	}
+	if err := os.WriteFile(s.StateFile, data, 0o600); err != nil {
+		s.logger.Warn("cannot write memento state file",
+			zap.String("state_file", s.StateFile),
+			zap.Error(err))
+	}
+}
+
+// Cleanup persists the engine snapshot when a state file is configured,
+// and releases this policy's reference to any preserved state. The
+// successor config is provisioned (and takes its own reference) before
+// Caddy cleans up the old one, so the state only destructs when the
+// policy is truly removed from the config.
+//
+// It also deregisters this instance from the events app and releases
+// the engine and topology, so a replaced config's policy stops reacting
+// to health events and doesn't pin the engine memory; the event
+// handlers treat a nil engine as a no-op, so a stray late event against
+// the old instance does nothing.
+func (s *MementoSelection) Cleanup() error {
+	// stop receiving health events before touching the engine
+	s.unsubscribeFromHealthEvents()
+	if s.StateFile != "" && s.consistentEngine != nil {
+		s.persistStateFile()
+	}
+	if s.stateKey != "" {
+		_, _ = mementoStates.Delete(s.stateKey)
+		s.stateKey = ""
+	}
+	s.consistentEngine = nil
+	s.topology.Range(func(key, _ any) bool {
+		s.topology.Delete(key)
+		return true
+	})
+	s.nodesByID.Range(func(key, _ any) bool {
+		s.nodesByID.Delete(key)
+		return true
+	})
+	return nil
+}
+
+// duplicateDialResolver is implemented by selection policies that index
+// upstreams by their dial identity. The handler calls it at provision
+// time, before seeding the initial topology, so identity collisions are
+// rejected (or disambiguated) instead of silently merging entries.
+type duplicateDialResolver interface {
+	resolveDuplicateDials(upstreams []*Upstream) error
+}
+
+// resolveDuplicateDialIdentities checks the pool for upstreams whose
+// identity collides: two upstreams without explicit hash keys can
+// legitimately stringify identically (the same dial reached via
+// different placeholder expansions), and an identity-keyed index then
+// merges them — one entry receives all the traffic and health events
+// toggle the wrong node. By default the collision is an error listing
+// the offenders. When allow is true, the colliding upstreams are
+// disambiguated in place by assigning each an indexed hash key
+// ("dial#0", "dial#1", ...), which the engines and the identity index
+// resolve through hashKey(); the upstreams still share one Host (and
+// thus health state), since they are the same backend address.
+func resolveDuplicateDialIdentities(upstreams []*Upstream, allow bool) error {
+	groups := make(map[string][]*Upstream)
+	order := []string{}
+	for _, upstream := range upstreams {
+		if upstream.HashKey != "" {
+			// explicit hash keys are already required to be unique
+			continue
+		}
+		id := upstream.String()
+		if len(groups[id]) == 0 {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], upstream)
+	}
+	for _, id := range order {
+		group := groups[id]
+		if len(group) < 2 {
+			continue
+		}
+		if !allow {
+			return fmt.Errorf("%d upstreams share the identity '%s', which the topology index would silently merge: set a unique hash_key on each, or allow_duplicate_dials to disambiguate them automatically", len(group), id)
+		}
+		for i, upstream := range group {
+			upstream.HashKey = fmt.Sprintf("%s#%d", id, i)
+		}
+	}
+	return nil
+}
+
+// indexUpstreamIDs registers every identity a health event might use
+// for the upstream — its hash key, its dial address, and the canonical
+// form of the dial address — so event handlers resolve it no matter
+// which spelling the emitter used (a unix socket's probe address, for
+// one, has nothing in common with its dial string).
+func indexUpstreamIDs(byID *sync.Map, upstream *Upstream) {
+	byID.Store(upstream.hashKey(), upstream)
+	if upstream.Dial != upstream.hashKey() {
+		byID.Store(upstream.Dial, upstream)
+	}
+	if canonical := upstream.String(); canonical != upstream.Dial {
+		byID.Store(canonical, upstream)
+	}
+}
+
+// unindexUpstreamIDs removes every identity registered by indexUpstreamIDs.
+func unindexUpstreamIDs(byID *sync.Map, upstream *Upstream) {
+	byID.Delete(upstream.hashKey())
+	byID.Delete(upstream.Dial)
+	byID.Delete(upstream.String())
+}
+
+// nodeByID returns the known upstream for the given node ID (dial string)
+// in O(1), or nil if the upstream was never part of the topology. The
+// ID is also tried in its canonical spelling, so events from emitters
+// that don't normalize still match.
+func (s *MementoSelection) nodeByID(host string) *Upstream {
+	if val, ok := s.nodesByID.Load(host); ok {
+		return val.(*Upstream)
+	}
+	if val, ok := s.nodesByID.Load(canonicalDialKey(host)); ok {
+		return val.(*Upstream)
+	}
+	return nil
+}
+
+// AddUpstream implements TopologyAware. It adds an upstream discovered
+// after provisioning (e.g. by a dynamic upstream source) to the
+// consistent topology.
+func (s *MementoSelection) AddUpstream(upstream *Upstream) {
+	if s.consistentEngine == nil {
+		return
+	}
+	if topologyActive(&s.topology, upstream) {
+		return
+	}
+	if err := s.consistentEngine.AddNode(upstream); err != nil {
+		if s.logger != nil {
+			s.logger.Error("cannot add discovered upstream to topology",
+				zap.String("upstream", upstream.String()),
+				zap.Error(err))
+		}
+		return
+	}
+	topologyActivate(&s.topology, upstream, "add_upstream")
+	indexUpstreamIDs(&s.nodesByID, upstream)
+	s.topologyChanged()
+}
+
+// RemoveUpstream implements TopologyAware. Unlike an unhealthy event,
+// which keeps the node known so a later healthy event can restore it,
+// removal means the upstream no longer exists and is forgotten entirely.
+func (s *MementoSelection) RemoveUpstream(upstream *Upstream) {
+	if s.consistentEngine == nil {
+		return
+	}
+	if err := s.consistentEngine.RemoveNode(upstream); err != nil {
+		// an unknown node here usually means a double removal; note it
+		// rather than failing, the end state is the same
+		if s.logger != nil {
+			s.logger.Debug("cannot remove upstream from topology",
+				zap.String("upstream", upstream.String()),
+				zap.Error(err))
+		}
+		return
+	}
+	s.topology.Delete(upstream)
+	unindexUpstreamIDs(&s.nodesByID, upstream)
+	s.topologyChanged()
+	s.compactIfNeeded()
+}
+
+// compactIfNeeded rebuilds the consistent engine once the removal
+// history has grown past CompactThreshold, and logs how many tombstones
+// the rebuild collapsed. A threshold of zero disables compaction.
+func (s *MementoSelection) compactIfNeeded() {
+	if s.CompactThreshold <= 0 {
+		return
+	}
+	collapsed := s.consistentEngine.Compact(s.CompactThreshold)
+	if collapsed > 0 && s.logger != nil {
+		s.logger.Info("compacted memento removal history",
+			zap.Int("tombstones_collapsed", collapsed),
+			zap.Int("compact_threshold", s.CompactThreshold))
+	}
+}
+
+// subscribeToHealthEvents subscribes to health check events for real-time topology updates
+func (s *MementoSelection) subscribeToHealthEvents() {
+	if s.events == nil {
+		return
+	}
+
+	// Subscribe to "healthy" events
+	s.events.On("healthy", s)
+
+	// Subscribe to "unhealthy" events
+	s.events.On("unhealthy", s)
+
+	// Subscribe to whole-pool replacements from service discovery
+	s.events.On("topology_replace", s)
+
+	// Subscribe to the end of the first active health check round,
+	// which triggers a healthy_only-deferred topology population
+	s.events.On(eventHealthCheckInitialComplete, s)
+}
+
+// unsubscribeFromHealthEvents removes this policy's event bindings so a
+// cleaned-up instance no longer receives health events
+func (s *MementoSelection) unsubscribeFromHealthEvents() {
+	if s.events == nil {
+		return
+	}
+	s.events.Off("healthy", s)
+	s.events.Off("unhealthy", s)
+	s.events.Off("topology_replace", s)
+	s.events.Off(eventHealthCheckInitialComplete, s)
+	s.events = nil
+}
+
+// handleHealthyEvent handles when an upstream becomes healthy
+func (s *MementoSelection) handleHealthyEvent(ctx context.Context, event caddy.Event) error {
+	if s.consistentEngine == nil {
+		return nil
+	}
+
+	payload, ok := upstreamHealthEventFromEvent(event)
+	if !ok {
+		return nil
+	}
+
+	upstream := s.nodeByID(payload.Dial)
+	if upstream == nil {
+		// usually means an emitter and this policy disagree on how the
+		// upstream address is spelled; log it so the mismatch is visible
+		if s.logger != nil {
+			s.logger.Debug("health event host does not match any known upstream",
+				zap.String("host", payload.Dial),
+				zap.String("event", event.Name()))
+		}
+		return nil
+	}
+
+	// Only act once the debouncer confirms a real state change; a
+	// probing health checker re-emits "healthy" on every success
+	if s.debouncer != nil && !s.debouncer.confirm(payload.Dial, true, time.Now()) {
+		return nil
+	}
+
+	// No lock needed: topology and engine are now thread-safe
+	// Add node to consistent engine if not already present
+	if !topologyActive(&s.topology, upstream) {
+		if s.consistentEngine.Size() == 0 {
+			// Recovering from a full outage: rebuild the engine from
+			// scratch instead of adding to a fully drained one, so the
+			// replacement history accumulated while every node was
+			// removed doesn't shape the post-recovery mapping. Later
+			// healthy events add the remaining nodes to this fresh
+			// engine just like initial provisioning would.
+			if err := s.consistentEngine.Reset([]*Upstream{upstream}); err != nil {
+				if s.logger != nil {
+					s.logger.Error("cannot rebuild topology for recovering upstream",
+						zap.String("upstream", upstream.String()),
+						zap.Error(err))
+				}
+				return nil
+			}
+		} else if s.consistentEngine.IsRemoved(upstream) {
+			// the engine still remembers this node's removal: unwind it
+			// so the node gets its original bucket — and its keys — back,
+			// instead of appending a bucket that may belong to some other
+			// removed node
+			if err := s.consistentEngine.RestoreNode(upstream); err != nil {
+				if s.logger != nil {
+					s.logger.Error("cannot restore recovered upstream to topology",
+						zap.String("upstream", upstream.String()),
+						zap.Error(err))
+				}
+				return nil
+			}
+		} else if err := s.consistentEngine.AddNode(upstream); err != nil {
+			// shouldn't happen in normal operation; the node stays out
+			// of the topology, but selection still has the rest
+			if s.logger != nil {
+				s.logger.Error("cannot add recovered upstream to topology",
+					zap.String("upstream", upstream.String()),
+					zap.Error(err))
+			}
+			return nil
+		}
+		topologyActivate(&s.topology, upstream, "healthy")
+		s.topologyChanged()
+	}
+
+	return nil
+}
+
+// handleUnhealthyEvent handles when an upstream becomes unhealthy
+func (s *MementoSelection) handleUnhealthyEvent(ctx context.Context, event caddy.Event) error {
+	if s.consistentEngine == nil {
+		return nil
+	}
+
+	payload, ok := upstreamHealthEventFromEvent(event)
+	if !ok {
+		return nil
+	}
+
+	upstream := s.nodeByID(payload.Dial)
+	if upstream == nil {
+		// usually means an emitter and this policy disagree on how the
+		// upstream address is spelled; log it so the mismatch is visible
+		if s.logger != nil {
+			s.logger.Debug("health event host does not match any known upstream",
+				zap.String("host", payload.Dial),
+				zap.String("event", event.Name()))
+		}
+		return nil
+	}
+
+	// Only act once the debouncer confirms a real state change, so a
+	// brief flap doesn't churn the keys owned by this node
+	if s.debouncer != nil && !s.debouncer.confirm(payload.Dial, false, time.Now()) {
+		return nil
+	}
+
+	// No lock needed: topology and engine are now thread-safe
+	// Remove node from consistent engine if present
+	if topologyActive(&s.topology, upstream) {
+		if err := s.consistentEngine.RemoveNode(upstream); err != nil {
+			// the node might have been removed concurrently; the end
+			// state is the same either way, so just note it
+			if s.logger != nil {
+				s.logger.Debug("cannot remove unhealthy upstream from topology",
+					zap.String("upstream", upstream.String()),
+					zap.Error(err))
+			}
+			return nil
+		}
+		topologyDeactivate(&s.topology, upstream, "unhealthy")
+		s.topologyChanged()
+		s.compactIfNeeded()
+	}
+
+	return nil
+}
+
+// topologyReplaceHosts extracts the desired host list from a
+// "topology_replace" event. Service discovery emits the event with a
+// "hosts" list naming every upstream that should be in the topology;
+// both []string and the []interface{} that JSON-decoded event data
+// yields are accepted.
+func topologyReplaceHosts(event caddy.Event) ([]string, bool) {
+	switch list := event.Data["hosts"].(type) {
+	case []string:
+		return list, true
+	case []interface{}:
+		hosts := make([]string, 0, len(list))
+		for _, val := range list {
+			host, ok := val.(string)
+			if !ok {
+				return nil, false
+			}
+			hosts = append(hosts, host)
+		}
+		return hosts, true
+	}
+	return nil, false
+}
+
+// handleTopologyReplaceEvent handles a "topology_replace" event, whose
+// data carries the full desired host list under "hosts". Synthesizing
+// individual healthy/unhealthy events for a discovery push leaves a
+// window where the topology is a mix of the old and the new set and
+// keys move twice; here the diff against the current topology is
+// computed up front and applied as one bulk removal plus one bulk
+// addition, with a single topology version bump. Hosts that match no
+// known upstream are skipped with a debug log, and the debouncer is
+// bypassed: a discovery push is authoritative, not a flapping probe.
+func (s *MementoSelection) handleTopologyReplaceEvent(ctx context.Context, event caddy.Event) error {
+	if s.consistentEngine == nil {
+		return nil
+	}
+	hosts, ok := topologyReplaceHosts(event)
+	if !ok {
+		return nil
+	}
+
+	// resolve the desired set, keeping the event's host order for the
+	// additions so every instance applying the same push assigns the
+	// same buckets
+	desired := make(map[*Upstream]bool, len(hosts))
+	toAdd := make([]*Upstream, 0, len(hosts))
+	for _, host := range hosts {
+		upstream := s.nodeByID(host)
+		if upstream == nil {
+			if s.logger != nil {
+				s.logger.Debug("topology_replace host does not match any known upstream",
+					zap.String("host", host))
+			}
+			continue
+		}
+		if desired[upstream] {
+			continue
+		}
+		desired[upstream] = true
+		if !topologyActive(&s.topology, upstream) {
+			toAdd = append(toAdd, upstream)
+		}
+	}
+
+	var toRemove []*Upstream
+	s.topology.Range(func(key, val interface{}) bool {
+		upstream := key.(*Upstream)
+		if val.(*topologyNode).isActive() && !desired[upstream] {
+			toRemove = append(toRemove, upstream)
+		}
+		return true
+	})
+	// sync.Map iteration order is random; sort so the removal history
+	// (and therefore the mapping) is identical on every instance
+	sort.Slice(toRemove, func(i, j int) bool {
+		return toRemove[i].hashKey() < toRemove[j].hashKey()
+	})
+
+	if len(toRemove) == 0 && len(toAdd) == 0 {
+		return nil
+	}
+
+	// bulk-apply the whole diff, then bump the version once so trace
+	// records never attribute part of the swap to an older topology
+	_ = s.consistentEngine.RemoveNodes(toRemove)
+	_ = s.consistentEngine.AddNodes(toAdd)
+	for _, upstream := range toRemove {
+		topologyDeactivate(&s.topology, upstream, "topology_replace")
+	}
+	for _, upstream := range toAdd {
+		if s.consistentEngine.HasNode(upstream) {
+			topologyActivate(&s.topology, upstream, "topology_replace")
+		}
+	}
+	s.topologyChanged()
+	s.compactIfNeeded()
+	return nil
+}
+
+// topologyChanged records that an upstream joined or left the consistent
+// topology: it bumps the trace version stamp and re-publishes the key
+// share gauge, so the gauge reflects changes without being re-sampled
+// per request or per scrape.
+func (s *MementoSelection) topologyChanged() {
+	s.bumpTopologyVersion()
+	s.refreshKeyShareGauge()
+}
+
+// refreshKeyShareGauge re-estimates each node's share of the keyspace
+// and publishes it to the key share gauge.
+func (s *MementoSelection) refreshKeyShareGauge() {
+	if s.consistentEngine == nil {
+		return
+	}
+	observeKeyShares("memento", s.consistentEngine.KeyShareEstimate(s.ShareSampleSize))
+}
+
+// topologyStatus reports the tracked per-node membership metadata plus
+// an estimated key share per node, for the admin topology endpoint.
+func (s *MementoSelection) topologyStatus() []topologyNodeReport {
+	var engine topologyEngine
+	if s.consistentEngine != nil {
+		engine = s.consistentEngine
+	}
+	return topologyStatusReport(&s.topology, engine, s.ShareSampleSize)
+}
+
+// healthDebounceCounters exposes the debouncer's per-node state for
+// the admin introspection endpoint.
+func (s *MementoSelection) healthDebounceCounters() []debounceCounters {
+	if s.debouncer == nil {
+		return nil
+	}
+	return s.debouncer.counters()
+}
+
+// simulateRemoval estimates the blast radius of taking the named
+// upstream down: it clones the consistent engine, removes the upstream
+// on the clone, and replays the given keys (or the recent-key sample
+// when TrackKeys is enabled and no keys are supplied) against both.
+// The live engine is never modified.
+func (s *MementoSelection) simulateRemoval(host string, keys []string) (*removalSimulation, error) {
+	if s.consistentEngine == nil {
+		return nil, fmt.Errorf("consistent engine is not initialized")
+	}
+	upstream := s.nodeByID(host)
+	if upstream == nil {
+		return nil, fmt.Errorf("unknown upstream '%s'", host)
+	}
+	if len(keys) == 0 && s.keySampler != nil {
+		keys = s.keySampler.snapshot()
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys to replay: supply keys in the request or enable track_keys on the policy")
+	}
+
+	clone := s.consistentEngine.Clone()
+	if err := clone.RemoveNode(upstream); err != nil {
+		return nil, fmt.Errorf("upstream '%s' is not in the current topology: %v", host, err)
+	}
+
+	sim := &removalSimulation{
+		Upstream:   upstream.Dial,
+		TotalKeys:  len(keys),
+		MovedKeys:  []string{},
+		LoadDeltas: map[string]int{},
+	}
+	for _, key := range keys {
+		before, okBefore := s.consistentEngine.Lookup(key)
+		after, okAfter := clone.Lookup(key)
+		if !okBefore || !okAfter || before == after {
+			continue
+		}
+		sim.MovedKeys = append(sim.MovedKeys, key)
+		sim.LoadDeltas[before.Dial]--
+		sim.LoadDeltas[after.Dial]++
+	}
+	return sim, nil
+}
+
+// Handle implements caddyevents.Handler interface
+func (s *MementoSelection) Handle(ctx context.Context, event caddy.Event) error {
+	switch event.Name() {
+	case "healthy":
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
+		return s.handleHealthyEvent(ctx, event)
+	case "unhealthy":
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
+		return s.handleUnhealthyEvent(ctx, event)
+	case "topology_replace":
+		return s.handleTopologyReplaceEvent(ctx, event)
+	case eventHealthCheckInitialComplete:
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
+		s.completeInitialHealthChecks()
+	}
+	return nil
+}
+
+// WeightedMementoSelection is a policy that selects a host
+// using a weighted consistent hashing algorithm (based on Memento)
+// for optimal load distribution and minimal redistribution when the topology changes.
+type WeightedMementoSelection struct {
+	// The field to use for hashing. Can be "ip", "uri", "header",
+	// "cookie", "expression", etc. Defaults to "ip" if not specified.
+	Field string `json:"field,omitempty"`
+
+	// The header field name if Field is "header"
+	HeaderField string `json:"header_field,omitempty"`
+
+	// Whether to hash all values of the header joined with "," when
+	// Field is "header". By default only the first value counts.
+	JoinValues bool `json:"join_values,omitempty"`
+
+	// Whether to trim whitespace and lowercase header values before
+	// hashing when Field is "header", so spelling variations of the
+	// same logical value map to the same upstream. Opt-in because
+	// enabling it changes existing mappings.
+	Canonicalize bool `json:"canonicalize,omitempty"`
+
+	// The cookie name if Field is "cookie". The named cookie's value
+	// (typically an existing application session cookie) becomes the
+	// hash key; no response cookie is written, and requests without
+	// the cookie defer to the fallback policy.
+	CookieName string `json:"cookie_name,omitempty"`
+
+	// The placeholder expression to evaluate per request if Field is
+	// "expression". The expanded string becomes the hash key; an
+	// expansion that comes up empty defers to the fallback policy.
+	Expression string `json:"expression,omitempty"`
+
+	// How to treat header-derived keys before hashing: "raw" (the
+	// default) hashes the value as-is, "sha256" hashes its digest, and
+	// "hmac" hashes a keyed digest using HashSecret, keeping sensitive
+	// header values out of the hashing stage and key logging.
+	HashInput string `json:"hash_input,omitempty"`
+
+	// The secret for the "hmac" hash input mode. Required when that
+	// mode is chosen; the same secret yields the same mapping across
+	// restarts and instances.
+	HashSecret string `json:"hash_secret,omitempty"`
+
+	// Mask IPv4/IPv6 addresses to this many bits before hashing when
+	// Field is "ip" or "client_ip", so clients whose addresses rotate
+	// within one subnet keep their affinity. Defaults are 32 and 128
+	// (hash the full address).
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	// The weight of each upstream in order,
+	// corresponding with the list of upstreams configured.
+	// Weights are reduced by their greatest common divisor during
+	// provisioning, so {50, 30, 20} is equivalent to {5, 3, 2}.
+	Weights []int `json:"weights,omitempty"`
+
+	// Placeholder expressions resolving to the weight of each upstream
+	// in order (e.g. "{env.BACKEND1_WEIGHT}"), as an alternative to
+	// static Weights, so weights can come from a dynamic source without
+	// a config reload. Placeholder weights skip GCD reduction and a
+	// placeholder that doesn't resolve to a positive integer keeps the
+	// previous weight and logs a warning.
+	WeightPlaceholders []string `json:"weight_placeholders,omitempty"`
+
+	// How often to re-evaluate WeightPlaceholders and apply changed
+	// weights through the engine's runtime weight-update path. Zero
+	// (the default) resolves them once at provision time.
+	ReresolveInterval caddy.Duration `json:"reresolve_interval,omitempty"`
+
+	// The maximum total number of virtual nodes (one per unit of
+	// reduced weight) the consistent hashing engine may allocate.
+	// Provisioning fails if the reduced weights still exceed this
+	// cap. Default is 1024.
+	MaxVirtualNodes int `json:"max_virtual_nodes,omitempty"`
+
+	// Whether to bound the load on the selected host (consistent
+	// hashing with bounded loads). When enabled, a host whose
+	// in-flight request count exceeds LoadFactor times the average
+	// across available hosts is skipped in favor of a deterministic
+	// secondary host for the same key.
+	BoundedLoad bool `json:"bounded_load,omitempty"`
+
+	// The load bound factor used when BoundedLoad is enabled.
+	// Must be at least 1. Default is 1.25.
+	LoadFactor float64 `json:"load_factor,omitempty"`
+
+	// Whether to deterministically re-hash the key when the selected
+	// upstream is known but unavailable (e.g. at its MaxRequests limit
+	// before any unhealthy event fires), instead of going straight to
+	// the fallback policy. This keeps a given key's overflow target
+	// stable rather than random.
+	RehashUnavailable bool `json:"rehash_unavailable,omitempty"`
+
+	// How many derived keys to try when RehashUnavailable is enabled
+	// before giving up and using the fallback policy. Default is 8.
+	MaxProbes int `json:"max_probes,omitempty"`
+
+	// How many consecutive contradicting health events it takes before
+	// a node is actually removed from (or restored to) the topology.
+	// Raising this above the default of 1 keeps a flapping health
+	// checker from churning keys on every probe.
+	MinConfirmations int `json:"min_confirmations,omitempty"`
+
+	// When MinConfirmations is above 1, a run of contradicting health
+	// events is discarded if the gap between two of them exceeds this
+	// window. Zero (the default) means runs never expire.
+	FlapWindow caddy.Duration `json:"flap_window,omitempty"`
+
+	// Whether to keep a bounded sample of recently seen hash keys, so
+	// the removal simulation admin endpoint can estimate the blast
+	// radius of taking an upstream down without the caller supplying
+	// keys. Off by default.
+	TrackKeys bool `json:"track_keys,omitempty"`
+
+	// How many distinct recent keys to retain when TrackKeys is
+	// enabled. Default is 1024.
+	TrackKeysLimit int `json:"track_keys_limit,omitempty"`
+
+	// How many synthetic keys to sample through the engine when the
+	// topology status endpoint estimates each node's key share.
+	// Default is 10000.
+	ShareSampleSize int `json:"share_sample_size,omitempty"`
+
+	// Whether two configured upstreams may share the same identity
+	// (dial address). By default a collision fails provisioning, since
+	// the topology's identity index would silently merge the entries;
+	// when enabled, colliding upstreams are disambiguated automatically
+	// by assigning each an indexed hash key ("dial#0", "dial#1", ...).
+	AllowDuplicateDials bool `json:"allow_duplicate_dials,omitempty"`
+
+	// When to enter the configured upstreams into the consistent
+	// topology: "all" (the default) enters every upstream during
+	// provisioning, before any health state exists; "healthy_only"
+	// defers population until the first active health check round
+	// completes, entering only the upstreams it found healthy;
+	// "lazy" defers population until the first selection, entering
+	// the upstreams available in that selection's pool. Weights stay
+	// positional over the full configured list in either mode.
+	InitialTopology string `json:"initial_topology,omitempty"`
+
+	// An optional path to a newline-delimited list of keys to run
+	// through the engine once after the topology is populated, warming
+	// internal structures so known-hot keys (e.g. tenant IDs) don't pay
+	// first-lookup latency right after a reload. A missing or unreadable
+	// file logs a warning and is otherwise ignored.
+	WarmupKeysFile string `json:"warmup_keys_file,omitempty"`
+
+	// The weight assigned to upstreams that join the topology after
+	// provisioning, e.g. a host a healthy event references that was
+	// never given a configured weight (weights are positional over the
+	// static upstream list, so late joiners have none of their own).
+	// 0 (the default) rejects such hosts, keeping the topology limited
+	// to the configured set.
+	DefaultWeightForNewHosts int `json:"default_weight_for_new_hosts,omitempty"`
+
+	// The fallback policy to use if the field is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+
+	verboseLogging
+	selectionTracing
+	hashFunctionChooser
+	availabilityChooser
+	keyComponentChooser
+	overrideChooser
+	handlerScope
+
+	// Internal state for consistent hashing
+	consistentEngine *WeightedConsistentEngine
+	initialWeights   map[*Upstream]int // Persist initial weights for re-balancing
+	initialUpstreams []*Upstream       // The configured upstream order, for positional weight re-resolution
+	topology         sync.Map          // Track which nodes are currently available (map[*Upstream]*topologyNode, thread-safe)
+	nodesByID        sync.Map          // Node ID (dial string) -> *Upstream, for O(1) event lookups (thread-safe)
+
+	// Serializes topology initialization against the event handlers'
+	// check-and-modify sections, so a health event racing
+	// PopulateInitialTopology can't add a node the initial cluster is
+	// about to include and leave duplicate virtual nodes behind
+	topologyUpdateMu sync.Mutex
+	debouncer        *healthEventDebouncer
+	keySampler       *recentKeySampler
+	deferredInit     *deferredTopology // set when initial_topology defers population
+	overflowViews    sync.Map          // *Upstream -> *WeightedConsistentEngine without that node, for capacity overflow
+
+	// When the engine last warned about being empty (unix nanos,
+	// atomic), so a misconfigured topology surfaces in the logs
+	// without a warning per request
+	emptyEngineLastWarn int64
+
+	// Event system integration
+	events *caddyevents.App
+	ctx    caddy.Context
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (WeightedMementoSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.weighted_memento",
+		New: func() caddy.Module { return new(WeightedMementoSelection) },
+	}
+}
+
+// weightedMementoCaddyfileOptions lists every sub-directive the
+// weighted_memento unmarshaler accepts, for "did you mean" suggestions
+// on unrecognized options.
+var weightedMementoCaddyfileOptions = append([]string{
+	"field", "header_field", "join_values", "canonicalize", "cookie_name",
+	"expression", "hash_input", "ipv4_mask", "ipv6_mask", "bounded_load",
+	"rehash_unavailable", "max_virtual_nodes", "min_confirmations",
+	"flap_window", "track_keys", "share_sample_size",
+	"allow_duplicate_dials", "initial_topology",
+	"default_weight_for_new_hosts", "warmup_keys_file", "fallback",
+	"accept_external_events",
+}, sharedSelectionOptions...)
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (s *WeightedMementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	// Any leading arguments are per-upstream weights. They are optional:
+	// with only a block supplied, every upstream defaults to weight 1.
+	// Weights are positional, so one placeholder among the arguments
+	// routes them all through placeholder resolution (literal numbers
+	// resolve to themselves).
+	args := d.RemainingArgs()
+	placeholders := false
+	for _, weight := range args {
+		if strings.Contains(weight, "{") {
+			placeholders = true
+			break
+		}
+	}
+	if placeholders {
+		s.WeightPlaceholders = args
+	} else {
+		s.Weights = []int{}
+		for _, weight := range args {
+			weightInt, err := strconv.Atoi(weight)
+			if err != nil {
+				return d.Errf("invalid weight value '%s': %v", weight, err)
+			}
+			if weightInt <= 0 {
+				return d.Errf("invalid weight value '%s': weight should be positive", weight)
+			}
+			s.Weights = append(s.Weights, weightInt)
+		}
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Field = d.Val()
+		case "header_field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HeaderField = d.Val()
+		case "join_values":
+			s.JoinValues = true
+		case "canonicalize":
+			s.Canonicalize = true
+		case "cookie_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.CookieName = d.Val()
+		case "expression":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Expression = d.Val()
+		case "hash_input":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HashInput = d.Val()
+			if d.NextArg() {
+				s.HashSecret = d.Val()
+			}
+		case "ipv4_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv6MaskBits = bits
+		case "bounded_load":
+			s.BoundedLoad = true
+			if d.NextArg() {
+				loadFactor, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid load factor '%s': %v", d.Val(), err)
+				}
+				s.LoadFactor = loadFactor
+			}
+		case "rehash_unavailable":
+			s.RehashUnavailable = true
+			if d.NextArg() {
+				maxProbes, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_probes '%s': %v", d.Val(), err)
+				}
+				s.MaxProbes = maxProbes
+			}
+		case "max_virtual_nodes":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxVirtualNodes, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid max_virtual_nodes '%s': %v", d.Val(), err)
+			}
+			s.MaxVirtualNodes = maxVirtualNodes
+		case "min_confirmations":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			minConfirmations, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid min_confirmations '%s': %v", d.Val(), err)
+			}
+			s.MinConfirmations = minConfirmations
+		case "flap_window":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			flapWindow, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid flap_window '%s': %v", d.Val(), err)
+			}
+			s.FlapWindow = caddy.Duration(flapWindow)
+		case "track_keys":
+			s.TrackKeys = true
+			if d.NextArg() {
+				limit, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid track_keys limit '%s': %v", d.Val(), err)
+				}
+				s.TrackKeysLimit = limit
+			}
+		case "share_sample_size":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			size, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid share_sample_size '%s': %v", d.Val(), err)
+			}
+			s.ShareSampleSize = size
+		case "allow_duplicate_dials":
+			s.AllowDuplicateDials = true
+		case "initial_topology":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.InitialTopology = d.Val()
+		case "default_weight_for_new_hosts":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			weight, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid default_weight_for_new_hosts '%s': %v", d.Val(), err)
+			}
+			s.DefaultWeightForNewHosts = weight
+		case "warmup_keys_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.WarmupKeysFile = d.Val()
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		default:
+			handled, err := s.unmarshalVerboseOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				handled, err = s.unmarshalTraceOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalHashOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalAvailabilityOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalKeyComponentsOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalOverrideOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				handled, err = s.unmarshalHandlerScopeOption(d)
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				if suggestion := suggestOption(d.Val(), weightedMementoCaddyfileOptions); suggestion != "" {
+					return d.Errf("unrecognized option '%s' (did you mean '%s'?)", d.Val(), suggestion)
+				}
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision sets up the module.
+func (s *WeightedMementoSelection) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger(s)
+	if s.Field == "" {
+		s.Field = "ip" // Default to IP-based hashing
+	}
+	switch s.Field {
+	case "ip", "client_ip", "uri":
+	case "header":
+		if s.HeaderField == "" {
+			return fmt.Errorf("field 'header' requires a header_field")
+		}
+	case "cookie":
+		if s.CookieName == "" {
+			return fmt.Errorf("field 'cookie' requires a cookie_name")
+		}
+	case "expression":
+		if s.Expression == "" {
+			return fmt.Errorf("field 'expression' requires an expression to evaluate")
+		}
+	default:
+		return fmt.Errorf("unrecognized field '%s': must be one of 'ip', 'client_ip', 'uri', 'header', 'cookie', or 'expression'", s.Field)
+	}
+	if s.LoadFactor == 0 {
+		s.LoadFactor = 1.25
+	}
+	if s.LoadFactor < 1 {
+		return fmt.Errorf("load_factor must be at least 1, got %f", s.LoadFactor)
+	}
+	if s.MaxProbes < 0 {
+		return fmt.Errorf("max_probes must be positive, got %d", s.MaxProbes)
+	}
+	if s.MaxProbes == 0 {
+		s.MaxProbes = maxLoadProbes
+	}
+	if err := validateMaskBits(s.IPv4MaskBits, s.IPv6MaskBits); err != nil {
+		return err
+	}
+	if s.MinConfirmations < 0 {
+		return fmt.Errorf("min_confirmations must be positive, got %d", s.MinConfirmations)
+	}
+	if s.MinConfirmations == 0 {
+		s.MinConfirmations = 1
+	}
+	s.debouncer = newHealthEventDebouncer(time.Duration(s.FlapWindow), s.MinConfirmations)
+	if s.TrackKeysLimit < 0 {
+		return fmt.Errorf("track_keys_limit must be positive, got %d", s.TrackKeysLimit)
+	}
+	if s.TrackKeys {
+		s.keySampler = newRecentKeySampler(s.TrackKeysLimit)
+	}
+	if s.ShareSampleSize < 0 {
+		return fmt.Errorf("share_sample_size must be positive, got %d", s.ShareSampleSize)
+	}
+	if err := validateHashInput(s.HashInput, s.HashSecret); err != nil {
+		return err
+	}
+
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "weighted_memento", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+
+	// Reduce the weights so large-but-proportional configurations
+	// don't allocate more virtual nodes than necessary, then make
+	// sure what remains fits under the cap
+	if s.MaxVirtualNodes < 0 {
+		return fmt.Errorf("max_virtual_nodes must be positive, got %d", s.MaxVirtualNodes)
+	}
+	if s.MaxVirtualNodes == 0 {
+		s.MaxVirtualNodes = defaultMaxVirtualNodes
+	}
+	if len(s.WeightPlaceholders) > 0 {
+		if len(s.Weights) > 0 {
+			return fmt.Errorf("weights and weight_placeholders are mutually exclusive")
+		}
+		// placeholder weights stay unreduced so later re-resolutions
+		// can be applied through the runtime weight-update path
+		// without re-normalizing the whole list
+		s.Weights = resolveWeightPlaceholders(caddy.NewReplacer(), s.WeightPlaceholders, nil, s.logger)
+	} else {
+		s.Weights = NormalizeWeights(s.Weights)
+	}
+	totalWeight := 0
+	for _, weight := range s.Weights {
+		if weight > 0 {
+			totalWeight += weight
+		}
+	}
+	if totalWeight > s.MaxVirtualNodes {
+		return fmt.Errorf("weights require %d virtual nodes after GCD reduction, exceeding max_virtual_nodes %d",
+			totalWeight, s.MaxVirtualNodes)
+	}
+	if s.DefaultWeightForNewHosts < 0 {
+		return fmt.Errorf("default_weight_for_new_hosts must be non-negative, got %d", s.DefaultWeightForNewHosts)
+	}
+
+	if err := s.provisionVerboseLogging(ctx, s); err != nil {
+		return err
+	}
+	if err := s.provisionSelectionTracing(); err != nil {
+		return err
+	}
+
+	if err := s.provisionHashFunction(); err != nil {
+		return err
+	}
+	if err := s.provisionAvailability(); err != nil {
+		return err
+	}
+	if err := s.provisionKeyComponents(); err != nil {
+		return err
+	}
+	if len(s.KeyComponents) > 0 && s.Field != "ip" {
+		return fmt.Errorf("key_components is only supported with the 'ip' field, not '%s'", s.Field)
+	}
+	if err := s.provisionOverrides(ctx); err != nil {
+		return err
+	}
+
+	// Initialize the weighted consistent hashing engine
+	s.consistentEngine = NewWeightedConsistentEngineWithCap(s.MaxVirtualNodes)
+	s.consistentEngine.SetKeyHasher(s.hashFn)
+	s.initialWeights = make(map[*Upstream]int)
+
+	switch s.InitialTopology {
+	case "":
+		s.InitialTopology = initialTopologyAll
+	case initialTopologyAll:
+	case initialTopologyHealthyOnly, initialTopologyLazy:
+		s.deferredInit = &deferredTopology{populate: s.populateFiltered}
+	default:
+		return fmt.Errorf("unrecognized initial_topology '%s': must be 'all', 'healthy_only', or 'lazy'", s.InitialTopology)
+	}
+
+	// Set up event system integration
+	s.ctx = ctx
+
+	if len(s.WeightPlaceholders) > 0 && s.ReresolveInterval > 0 {
+		go s.reresolveWeightsLoop(ctx)
+	}
+
+	return nil
+}
+
+// Validate makes sure the weights list can produce a working topology.
+// An all-zero list would leave the engine empty: PopulateInitialTopology
+// skips non-positive weights, so every request would silently take the
+// fallback path. Individual zero weights are allowed (they deliberately
+// exclude an upstream) but noted in the logs.
+func (s *WeightedMementoSelection) Validate() error {
+	if len(s.Weights) == 0 {
+		return nil
+	}
+	zeroes := 0
+	for _, weight := range s.Weights {
+		if weight <= 0 {
+			zeroes++
+		}
+	}
+	if zeroes == len(s.Weights) {
+		return fmt.Errorf("all %d weights are zero or negative; the topology would be empty and every request would take the fallback path", len(s.Weights))
+	}
+	if zeroes > 0 && s.logger != nil {
+		s.logger.Warn("some weights are zero or negative; the corresponding upstreams are excluded from the topology",
+			zap.Int("excluded", zeroes),
+			zap.Int("total", len(s.Weights)))
+	}
+	return nil
+}
+
+// validatePoolSize checks the weights list against the number of
+// configured upstreams, which only the handler knows. A list that is
+// neither empty (every upstream defaults to weight 1) nor exactly one
+// weight per upstream pairs weights with the wrong upstreams.
+func (s *WeightedMementoSelection) validatePoolSize(numUpstreams int) error {
+	if len(s.Weights) != 0 && len(s.Weights) != numUpstreams {
+		return fmt.Errorf("weighted_memento has %d weights for %d upstreams; provide one weight per upstream, or none",
+			len(s.Weights), numUpstreams)
+	}
+	return nil
+}
+
+// warnEmptyEngine logs, at most once a minute, that selection is
+// running against an empty topology and every request is taking the
+// fallback path, so the misconfiguration is observable instead of
+// hiding behind working-looking responses.
+func (s *WeightedMementoSelection) warnEmptyEngine() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.emptyEngineLastWarn)
+	if now-last < int64(time.Minute) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&s.emptyEngineLastWarn, last, now) {
+		return // another request just warned
+	}
+	s.logger.Warn("weighted_memento topology is empty; all requests are taking the fallback path",
+		zap.Int("configured_weights", len(s.Weights)))
+}
+
+// requestKey extracts the hash key for the request according to the
+// configured Field. The second return value is false when no key can
+// be derived (unknown field, or a missing header), in which case the
+// caller should defer to the fallback policy.
+func (s *WeightedMementoSelection) requestKey(req *http.Request) (string, bool) {
+	switch s.Field {
+	case "ip":
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		return s.composeKey(req, maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits)), true
+	case "client_ip":
+		address := clientIPVarOrRemoteAddr(req)
+		clientIP, _, err := net.SplitHostPort(address)
+		if err != nil {
+			clientIP = address
+		}
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "uri":
+		return req.RequestURI, true
+	case "header":
+		if s.HeaderField == "" {
+			return "", false
+		}
+		key, ok := headerHashValue(req, s.HeaderField, s.JoinValues, s.Canonicalize)
+		if !ok {
+			return "", false
+		}
+		return transformHashInput(key, s.HashInput, s.HashSecret), true
+	case "cookie":
+		if s.CookieName == "" {
+			return "", false
+		}
+		cookie, err := req.Cookie(s.CookieName)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return transformHashInput(cookie.Value, s.HashInput, s.HashSecret), true
+	case "expression":
+		repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if !ok {
+			return "", false
+		}
+		key := repl.ReplaceAll(s.Expression, "")
+		return key, key != ""
+	}
+	return "", false
+}
+
+// Select returns an available host, if any.
+func (s *WeightedMementoSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	if len(pool) == 0 {
+		return nil
+	}
+	s.ensureLazyTopology(pool)
+
+	// Get the key to hash based on the field type
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+	}
+	if s.keySampler != nil {
+		s.keySampler.record(key)
+	}
+	if upstream, ok := s.overrideFor(key, pool, s.Availability); ok {
+		return upstream
+	}
+
+	if upstream := s.SelectByKey(pool, key); upstream != nil {
+		return upstream
+	}
+
+	if s.BoundedLoad {
+		// every probe exceeded the bound; spread the load like least_conn
+		return LeastConnSelection{}.Select(pool, req, w)
+	}
+
+	// Fallback if the node is not found or engine is not ready
+	cause := selectionFallbackUnavailable
+	if s.consistentEngine == nil || s.consistentEngine.Size() == 0 {
+		cause = selectionFallbackEngineEmpty
+	}
+	if s.consistentEngine != nil && s.consistentEngine.Size() == 0 {
+		s.warnEmptyEngine()
+	}
+	upstream := selectViaFallback(s.fallback, pool, req, w, cause)
+	s.traceSelection("weighted_memento", key, upstream)
+	if s.verboseLogEnabled() {
+		s.logSelection("weighted_memento", key, upstream, true)
+	}
+	return upstream
+}
+
+// SelectByKey resolves an already-extracted key against the weighted
+// consistent topology, without touching a request. It returns nil when
+// the topology cannot map the key to a usable upstream; request-path
+// callers then defer to the fallback policy.
+func (s *WeightedMementoSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	if s.consistentEngine == nil {
+		return nil
+	}
+	s.ensureLazyTopology(pool)
+
+	if s.BoundedLoad {
+		return s.boundedLookup(pool, key)
+	}
+
+	// Use the weighted consistent engine to find the node
+	if upstream, ok := s.consistentEngine.Lookup(key); ok {
+		if availableFor(upstream, s.Availability) && !upstream.slowStartHoldback() {
+			s.traceSelection("weighted_memento", key, upstream)
+			if s.verboseLogEnabled() {
+				_, bucket, _ := s.consistentEngine.LookupBucket(key)
+				s.logSelection("weighted_memento", key, upstream, false, zap.Int("bucket", bucket))
+			}
+			return upstream
+		}
+
+		// The key's owner is warming up after a recovery or is known
+		// but can't take the request right now; optionally re-hash
+		// deterministically so the overflow target is stable for this key
+		if s.RehashUnavailable {
+			if secondary := s.rehashLookup(key); secondary != nil {
+				observeSelectionOverflow("weighted_memento", upstream)
+				return secondary
+			}
+		}
+
+		// Deterministic capacity overflow: look the same key up on a
+		// view of the topology without the capped owner, so each key
+		// has one stable secondary and the shed load follows the
+		// remaining nodes' weights instead of the random fallback
+		if secondary := s.overflowLookup(key, upstream); secondary != nil {
+			observeSelectionOverflow("weighted_memento", upstream)
+			s.traceSelection("weighted_memento", key, secondary)
+			if s.verboseLogEnabled() {
+				s.logSelection("weighted_memento", key, secondary, false,
+					zap.String("overflow_from", upstream.Dial))
+			}
+			return secondary
+		}
+	}
+
+	return nil
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request. The key's owner has been tried by definition,
+// so the engine is probed with deterministically derived keys (the same
+// scheme rehashLookup uses) until it yields an untried available host;
+// failing that, the fallback policy decides among the untried hosts.
+func (s *WeightedMementoSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	if len(pool) == 0 {
+		return nil
+	}
+	s.ensureLazyTopology(pool)
+	untried := make(UpstreamPool, 0, len(pool))
+	for _, upstream := range pool {
+		if _, ok := tried[upstream]; !ok {
+			untried = append(untried, upstream)
+		}
+	}
+	if len(untried) == 0 {
+		// every host has been tried; retrying a possibly-failing host
+		// beats returning no host at all
+		return s.Select(pool, req, w)
+	}
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectViaFallback(s.fallback, untried, req, w, selectionFallbackKeyMissing)
+	}
+	if s.consistentEngine == nil {
+		return selectViaFallback(s.fallback, untried, req, w, selectionFallbackEngineEmpty)
+	}
+	for probe := 0; probe <= s.MaxProbes; probe++ {
+		probeKey := key
+		if probe > 0 {
+			probeKey = key + "#" + strconv.Itoa(probe)
+		}
+		candidate, found := s.consistentEngine.Lookup(probeKey)
+		if !found {
+			// engine is empty; no derived key will fare any better
+			break
+		}
+		if _, already := tried[candidate]; already || !availableFor(candidate, s.Availability) {
+			continue
+		}
+		return candidate
+	}
+	return selectViaFallback(s.fallback, untried, req, w, selectionFallbackUnavailable)
+}
+
+// Preview explains which upstream the given key maps to, including the
+// memento bucket index. The pool argument is unused because the policy
+// tracks its own topology through health events.
+func (s *WeightedMementoSelection) Preview(_ UpstreamPool, key string) SelectionExplanation {
+	expl := SelectionExplanation{Policy: "weighted_memento", Key: key}
+	if s.consistentEngine == nil {
+		return expl
+	}
+	upstream, bucket, ok := s.consistentEngine.LookupBucket(key)
+	if !ok {
+		return expl
+	}
+	expl.Bucket = &bucket
+	if upstream != nil {
+		expl.Upstream = upstream.String()
+	}
+	return expl
+}
+
+// rehashLookup probes the engine with keys derived deterministically
+// from the original key until it finds an available upstream, trying at
+// most MaxProbes derived keys. Returns nil if every probe came up
+// empty or unavailable.
+func (s *WeightedMementoSelection) rehashLookup(key string) *Upstream {
+	for probe := 1; probe <= s.MaxProbes; probe++ {
+		if candidate, found := s.consistentEngine.Lookup(key + "#" + strconv.Itoa(probe)); found && availableFor(candidate, s.Availability) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// overflowLookup returns the stable secondary owner for a key whose
+// primary owner cannot take the request right now: the same key looked
+// up on a view of the topology with the primary removed, so the shed
+// load is distributed according to the remaining nodes' weights. Views
+// are cached per capped node and discarded on any topology change.
+func (s *WeightedMementoSelection) overflowLookup(key string, primary *Upstream) *Upstream {
+	var view *WeightedConsistentEngine
+	if cached, ok := s.overflowViews.Load(primary); ok {
+		view = cached.(*WeightedConsistentEngine)
+	} else {
+		view = s.consistentEngine.Clone()
+		view.RemoveNode(primary)
+		// a concurrent selection may have built the same view; keep
+		// whichever was stored first so all keys see one view
+		if stored, loaded := s.overflowViews.LoadOrStore(primary, view); loaded {
+			view = stored.(*WeightedConsistentEngine)
+		}
+	}
+	if secondary, ok := view.Lookup(key); ok && secondary != primary && availableFor(secondary, s.Availability) {
+		return secondary
+	}
+	return nil
+}
+
+// invalidateOverflowViews drops all cached overflow views. Callers must
+// do this whenever the live topology changes, so overflow decisions are
+// never made against a stale view.
+func (s *WeightedMementoSelection) invalidateOverflowViews() {
+	s.overflowViews.Range(func(key, _ any) bool {
+		s.overflowViews.Delete(key)
+		return true
+	})
+}
+
+// boundedLookup returns the upstream for key whose in-flight load is
+// within the configured bound, probing deterministically derived keys
+// like MementoSelection.boundedLookup does. Returns nil if every probe
+// exceeded the bound.
+func (s *WeightedMementoSelection) boundedLookup(pool UpstreamPool, key string) *Upstream {
+	bound, ok := loadBound(pool, s.LoadFactor)
+	if !ok {
+		return nil
+	}
+	probeKey := key
+	for probe := 0; probe <= maxLoadProbes; probe++ {
+		if probe > 0 {
+			probeKey = key + "#" + strconv.Itoa(probe)
+		}
+		upstream, found := s.consistentEngine.Lookup(probeKey)
+		if !found || !availableFor(upstream, s.Availability) {
+			continue
+		}
+		if float64(upstream.NumRequests()) <= bound {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// SetEventsApp sets the events app for this selection policy
+func (s *WeightedMementoSelection) SetEventsApp(events *caddyevents.App) {
+	if events != nil {
+		s.events = events
+		s.subscribeToHealthEvents()
+	}
+}
+
+// resolveDuplicateDials implements duplicateDialResolver; the handler
+// calls it before seeding the initial topology.
+func (s *WeightedMementoSelection) resolveDuplicateDials(upstreams []*Upstream) error {
+	return resolveDuplicateDialIdentities(upstreams, s.AllowDuplicateDials)
+}
+
+// PopulateInitialTopology populates the Memento topology with initial
+// upstreams. Under initial_topology healthy_only or lazy the upstream
+// set is only parked here; population happens on the mode's trigger.
+func (s *WeightedMementoSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	if s.deferredInit != nil {
+		s.deferredInit.hold(upstreams)
+		return
+	}
+	s.populateFiltered(upstreams, nil)
+}
+
+// populateFiltered is the real population path; a nil keep enters every
+// configured upstream. The weights stay positional over the full list,
+// and excluded upstreams keep their weight and identity index so a
+// later healthy event re-adds them with the configured weight.
+func (s *WeightedMementoSelection) populateFiltered(upstreams []*Upstream, keep func(*Upstream) bool) {
+	if s.consistentEngine == nil {
+		return
+	}
+	// publish the initial key shares once the topology is built, and
+	// warm the engine from the configured keys file
+	defer s.warmupEngine()
+	defer s.refreshKeyShareGauge()
+
+	// The events app may already be delivering health events; hold the
+	// update lock across the whole initialization so a racing handler
+	// can't add a node InitCluster is about to include
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+
+	s.initialUpstreams = append([]*Upstream(nil), upstreams...)
+	nodesWithWeights := make(map[*Upstream]int)
+	for i, upstream := range upstreams {
+		weight := 1 // Default weight
+		if i < len(s.Weights) {
+			weight = s.Weights[i]
+		}
+		if weight <= 0 {
+			continue
+		}
+		s.initialWeights[upstream] = weight // Store for later
+		indexUpstreamIDs(&s.nodesByID, upstream)
+		if keep != nil && !keep(upstream) {
+			// record the exclusion as an unhealthy state, so the host's
+			// first healthy event reads as a transition and re-adds it
+			if s.debouncer != nil {
+				s.debouncer.assume(upstream.String(), false)
+			}
+			continue
+		}
+		nodesWithWeights[upstream] = weight
+	}
+
+	s.consistentEngine.InitCluster(nodesWithWeights)
+
+	// Mark all nodes as present in the topology map
+	for upstream := range nodesWithWeights {
+		topologyActivate(&s.topology, upstream, "initial")
+	}
+
+	if s.verboseLogEnabled() {
+		stats := s.consistentEngine.GetMementoStats()
+		s.logger.Info("weighted memento topology initialized",
+			zap.Int("topology_size", s.consistentEngine.Size()),
+			zap.Int("total_weight", s.consistentEngine.TotalWeight()),
+			zap.Any("virtual_nodes", stats["virtual_nodes"]))
+	}
+}
+
+// warmupEngine runs the configured warm-up keys file through the
+// engine, if one is set. It is deferred before the topology update
+// lock in PopulateInitialTopology, so it runs after the lock is
+// released and warm-up lookups don't extend the critical section.
+func (s *WeightedMementoSelection) warmupEngine() {
+	if s.WarmupKeysFile == "" {
+		return
+	}
+	warmupFromKeysFile(s.WarmupKeysFile, s.consistentEngine, s.logger)
+}
+
+// ensureLazyTopology populates the topology from this selection's pool
+// when initial_topology is "lazy" and this is the first selection.
+func (s *WeightedMementoSelection) ensureLazyTopology(pool UpstreamPool) {
+	if s.deferredInit == nil || s.InitialTopology != initialTopologyLazy {
+		return
+	}
+	s.deferredInit.trigger(pool, func(upstream *Upstream) bool {
+		return availableFor(upstream, s.Availability)
+	})
+}
+
+// completeInitialHealthChecks populates a healthy_only-deferred
+// topology from the health state the first active round established.
+func (s *WeightedMementoSelection) completeInitialHealthChecks() {
+	if s.deferredInit == nil || s.InitialTopology != initialTopologyHealthyOnly {
+		return
+	}
+	s.deferredInit.trigger(nil, func(upstream *Upstream) bool {
+		return upstream.Healthy()
+	})
+}
+
+// reresolveWeights re-evaluates the weight placeholders and applies
+// any changes through the engine's runtime weight-update path, under
+// the same lock as the other topology mutations. A new list whose
+// total would exceed the virtual node cap is rejected wholesale,
+// keeping the previous weights.
+func (s *WeightedMementoSelection) reresolveWeights(repl *caddy.Replacer) {
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	resolved := resolveWeightPlaceholders(repl, s.WeightPlaceholders, s.Weights, s.logger)
+	totalWeight := 0
+	for _, weight := range resolved {
+		totalWeight += weight
+	}
+	if totalWeight > s.MaxVirtualNodes {
+		if s.logger != nil {
+			s.logger.Warn("re-resolved weights exceed max_virtual_nodes; keeping previous weights",
+				zap.Int("total_weight", totalWeight),
+				zap.Int("max_virtual_nodes", s.MaxVirtualNodes))
+		}
+		return
+	}
+	changed := false
+	for i, upstream := range s.initialUpstreams {
+		if i >= len(resolved) || i >= len(s.Weights) {
+			break
+		}
+		if resolved[i] == s.Weights[i] {
+			continue
+		}
+		s.Weights[i] = resolved[i]
+		s.initialWeights[upstream] = resolved[i]
+		if topologyActive(&s.topology, upstream) {
+			s.consistentEngine.UpdateWeight(upstream, resolved[i])
+		}
+		changed = true
+	}
+	if changed {
+		s.invalidateOverflowViews()
+		s.topologyChanged()
+	}
+}
+
+// reresolveWeightsLoop runs reresolveWeights on the configured
+// interval until the policy's context is cancelled (config unload).
+func (s *WeightedMementoSelection) reresolveWeightsLoop(ctx caddy.Context) {
+	ticker := time.NewTicker(time.Duration(s.ReresolveInterval))
+	defer ticker.Stop()
+	repl := caddy.NewReplacer()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reresolveWeights(repl)
+		}
+	}
+}
+
+// nodeByID returns the known upstream for the given node ID (dial string)
+// in O(1), or nil if the upstream was never part of the topology.
+func (s *WeightedMementoSelection) nodeByID(host string) *Upstream {
+	if val, ok := s.nodesByID.Load(host); ok {
+		return val.(*Upstream)
+	}
+	if val, ok := s.nodesByID.Load(canonicalDialKey(host)); ok {
+		return val.(*Upstream)
+	}
+	return nil
+}
+
+// AddUpstream implements TopologyAware. Upstreams discovered after
+// provisioning have no configured weight (weights are positional over
+// the static upstream list), so they join with the configured default
+// weight for new hosts, or 1 when none is set. The weight is recorded
+// so later health flaps re-add the host consistently.
+func (s *WeightedMementoSelection) AddUpstream(upstream *Upstream) {
+	if s.consistentEngine == nil {
+		return
+	}
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	if topologyActive(&s.topology, upstream) {
+		return
+	}
+	weight := 1
+	if s.DefaultWeightForNewHosts > 0 {
+		weight = s.DefaultWeightForNewHosts
+	}
+	if initial, ok := s.initialWeights[upstream]; ok {
+		weight = initial
+	} else {
+		s.initialWeights[upstream] = weight
+	}
+	s.consistentEngine.AddNode(upstream, weight)
+	topologyActivate(&s.topology, upstream, "add_upstream")
+	indexUpstreamIDs(&s.nodesByID, upstream)
+	s.invalidateOverflowViews()
+	s.topologyChanged()
+}
+
+// RemoveUpstream implements TopologyAware. Unlike an unhealthy event,
+// which keeps the node known so a later healthy event can restore it,
+// removal means the upstream no longer exists and is forgotten entirely.
+func (s *WeightedMementoSelection) RemoveUpstream(upstream *Upstream) {
+	if s.consistentEngine == nil {
+		return
+	}
+	s.topologyUpdateMu.Lock()
+	s.consistentEngine.RemoveNode(upstream)
+	s.topology.Delete(upstream)
+	s.topologyUpdateMu.Unlock()
+	unindexUpstreamIDs(&s.nodesByID, upstream)
+	s.invalidateOverflowViews()
+	s.topologyChanged()
+}
+
+// subscribeToHealthEvents subscribes to health check events for real-time topology updates
+func (s *WeightedMementoSelection) subscribeToHealthEvents() {
+	if s.events == nil {
+		return
+	}
+	s.events.On("healthy", s)
+	s.events.On("unhealthy", s)
+	s.events.On("topology_replace", s)
+	s.events.On(eventHealthCheckInitialComplete, s)
+}
+
+// unsubscribeFromHealthEvents removes this policy's event bindings so a
+// cleaned-up instance no longer receives health events
+func (s *WeightedMementoSelection) unsubscribeFromHealthEvents() {
+	if s.events == nil {
+		return
+	}
+	s.events.Off("healthy", s)
+	s.events.Off("unhealthy", s)
+	s.events.Off("topology_replace", s)
+	s.events.Off(eventHealthCheckInitialComplete, s)
+	s.events = nil
+}
+
+// Cleanup implements caddy.CleanerUpper. It deregisters this instance
+// from the events app and releases the engine, topology, and overflow
+// views, so a replaced config's policy stops reacting to health events
+// and doesn't pin the engine memory; the event handlers treat a nil
+// engine as a no-op, so a stray late event against the old instance
+// does nothing.
+func (s *WeightedMementoSelection) Cleanup() error {
+	// stop receiving health events before touching the engine
+	s.unsubscribeFromHealthEvents()
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	s.consistentEngine = nil
+	s.initialWeights = nil
+	s.initialUpstreams = nil
+	s.topology.Range(func(key, _ any) bool {
+		s.topology.Delete(key)
+		return true
+	})
+	s.nodesByID.Range(func(key, _ any) bool {
+		s.nodesByID.Delete(key)
+		return true
+	})
+	s.overflowViews.Range(func(key, _ any) bool {
+		s.overflowViews.Delete(key)
+		return true
+	})
+	return nil
+}
+
+// handleHealthyEvent handles when an upstream becomes healthy
+func (s *WeightedMementoSelection) handleHealthyEvent(ctx context.Context, event caddy.Event) error {
+	if s.consistentEngine == nil {
+		return nil
+	}
+	payload, ok := upstreamHealthEventFromEvent(event)
+	if !ok {
+		return nil
+	}
+
+	upstream := s.nodeByID(payload.Dial)
+	if upstream == nil {
+		if s.DefaultWeightForNewHosts <= 0 {
+			// usually means an emitter and this policy disagree on how
+			// the upstream address is spelled; warn, since the silent
+			// alternative is a host that can never enter the topology
+			if s.logger != nil {
+				s.logger.Warn("health event host does not match any known upstream",
+					zap.String("host", payload.Dial),
+					zap.String("event", event.Name()))
+			}
+			return nil
 		}
+		// a late joiner (e.g. scaled out after provisioning); admit it
+		// with the configured default weight
+		upstream = &Upstream{Dial: payload.Dial}
+		upstream.fillHost()
 	}
-	return nil
-}
 
-// SetEventsApp sets the events app for this selection policy
-// This should be called by the reverse proxy handler when it provisions the selection policy
-func (s *MementoSelection) SetEventsApp(events *caddyevents.App) {
-	if events != nil {
-		s.events = events
-		s.subscribeToHealthEvents()
+	// Only act once the debouncer confirms a real state change; a
+	// probing health checker re-emits "healthy" on every success
+	if s.debouncer != nil && !s.debouncer.confirm(payload.Dial, true, time.Now()) {
+		return nil
+	}
+
+	// Re-add the node only if it is not already in the topology; the
+	// check and the engine update happen under the update lock so they
+	// can't interleave with initial population
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	if !topologyActive(&s.topology, upstream) {
+		weight, hasInitialWeight := s.initialWeights[upstream]
+		if !hasInitialWeight {
+			if s.DefaultWeightForNewHosts <= 0 {
+				// the host was never assigned a weight and late joiners
+				// are not admitted; warn so the drop is visible
+				if s.logger != nil {
+					s.logger.Warn("healthy event for a host with no configured weight, not added; set default_weight_for_new_hosts to admit late joiners",
+						zap.String("host", payload.Dial))
+				}
+				return nil
+			}
+			weight = s.DefaultWeightForNewHosts
+			// remember the weight so subsequent flaps of this host
+			// re-add it consistently
+			s.initialWeights[upstream] = weight
+		}
+		s.consistentEngine.AddNode(upstream, weight)
+		topologyActivate(&s.topology, upstream, "healthy")
+		indexUpstreamIDs(&s.nodesByID, upstream)
+		s.invalidateOverflowViews()
+		s.topologyChanged()
 	}
+	return nil
 }
 
-// PopulateInitialTopology populates the Memento topology with initial upstreams
-// This should be called by the reverse proxy handler after SetEventsApp
-func (s *MementoSelection) PopulateInitialTopology(upstreams []*Upstream) {
+// handleUnhealthyEvent handles when an upstream becomes unhealthy
+func (s *WeightedMementoSelection) handleUnhealthyEvent(ctx context.Context, event caddy.Event) error {
 	if s.consistentEngine == nil {
-		return
+		return nil
+	}
+	payload, ok := upstreamHealthEventFromEvent(event)
+	if !ok {
+		return nil
 	}
 
-	// No lock needed: topology and engine are now thread-safe
-	// Add all configured upstreams as healthy
-	for _, upstream := range upstreams {
-		if _, exists := s.topology.Load(upstream); !exists {
-			if err := s.consistentEngine.AddNode(upstream); err != nil {
-				// Log error but continue - this shouldn't happen in normal operation
-				continue
-			}
-			s.topology.Store(upstream, true)
+	upstream := s.nodeByID(payload.Dial)
+	if upstream == nil {
+		// usually means an emitter and this policy disagree on how the
+		// upstream address is spelled; log it so the mismatch is visible
+		if s.logger != nil {
+			s.logger.Warn("health event host does not match any known upstream",
+				zap.String("host", payload.Dial),
+				zap.String("event", event.Name()))
 		}
+		return nil
 	}
-}
 
-// subscribeToHealthEvents subscribes to health check events for real-time topology updates
-func (s *MementoSelection) subscribeToHealthEvents() {
-	if s.events == nil {
-		return
+	// Only act once the debouncer confirms a real state change, so a
+	// brief flap doesn't churn the keys owned by this node
+	if s.debouncer != nil && !s.debouncer.confirm(payload.Dial, false, time.Now()) {
+		return nil
 	}
 
-	// Subscribe to "healthy" events
-	s.events.On("healthy", s)
-
-	// Subscribe to "unhealthy" events
-	s.events.On("unhealthy", s)
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	if topologyActive(&s.topology, upstream) {
+		s.consistentEngine.RemoveNode(upstream)
+		topologyDeactivate(&s.topology, upstream, "unhealthy")
+		s.invalidateOverflowViews()
+		s.topologyChanged()
+	}
+	return nil
 }
 
-// handleHealthyEvent handles when an upstream becomes healthy
-func (s *MementoSelection) handleHealthyEvent(ctx context.Context, event caddy.Event) error {
+// handleTopologyReplaceEvent is the weighted counterpart of the memento
+// policy's handler for "topology_replace": the diff between the event's
+// desired host list and the current topology is applied as one
+// uninterrupted update with a single version bump, instead of a series
+// of individual healthy/unhealthy events that would mix the old and new
+// sets. The weighted engine has no bulk API, so the diff is applied
+// node by node, in deterministic order. Re-added nodes get their
+// configured initial weight.
+func (s *WeightedMementoSelection) handleTopologyReplaceEvent(ctx context.Context, event caddy.Event) error {
 	if s.consistentEngine == nil {
 		return nil
 	}
-
-	host, ok := event.Data["host"].(string)
+	hosts, ok := topologyReplaceHosts(event)
 	if !ok {
 		return nil
 	}
 
-	var upstream *Upstream
-	s.topology.Range(func(key, value any) bool {
-		candidate, ok := key.(*Upstream)
-		if !ok {
-			return true
+	// Compute and apply the diff under the update lock so the snapshot
+	// of the current topology can't go stale mid-application
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+
+	desired := make(map[*Upstream]bool, len(hosts))
+	toAdd := make([]*Upstream, 0, len(hosts))
+	for _, host := range hosts {
+		upstream := s.nodeByID(host)
+		if upstream == nil {
+			if s.logger != nil {
+				s.logger.Debug("topology_replace host does not match any known upstream",
+					zap.String("host", host))
+			}
+			continue
+		}
+		if desired[upstream] {
+			continue
 		}
-		if candidate.String() == host {
-			upstream = candidate
-			return false
+		desired[upstream] = true
+		if !topologyActive(&s.topology, upstream) {
+			toAdd = append(toAdd, upstream)
+		}
+	}
+
+	var toRemove []*Upstream
+	s.topology.Range(func(key, val interface{}) bool {
+		upstream := key.(*Upstream)
+		if val.(*topologyNode).isActive() && !desired[upstream] {
+			toRemove = append(toRemove, upstream)
 		}
 		return true
 	})
-	if upstream == nil {
+	sort.Slice(toRemove, func(i, j int) bool {
+		return toRemove[i].hashKey() < toRemove[j].hashKey()
+	})
+
+	if len(toRemove) == 0 && len(toAdd) == 0 {
 		return nil
 	}
 
-	// No lock needed: topology and engine are now thread-safe
-	// Add node to consistent engine if not already present
-	if val, exists := s.topology.Load(upstream); !exists || val == false {
-		if err := s.consistentEngine.AddNode(upstream); err != nil {
-			// Log error but continue - this shouldn't happen in normal operation
-			return nil
+	for _, upstream := range toRemove {
+		s.consistentEngine.RemoveNode(upstream)
+		topologyDeactivate(&s.topology, upstream, "topology_replace")
+	}
+	for _, upstream := range toAdd {
+		weight, hasInitialWeight := s.initialWeights[upstream]
+		if !hasInitialWeight {
+			weight = 1
 		}
-		s.topology.Store(upstream, true)
+		s.consistentEngine.AddNode(upstream, weight)
+		topologyActivate(&s.topology, upstream, "topology_replace")
 	}
-
+	s.invalidateOverflowViews()
+	s.topologyChanged()
 	return nil
 }
 
-// handleUnhealthyEvent handles when an upstream becomes unhealthy
-func (s *MementoSelection) handleUnhealthyEvent(ctx context.Context, event caddy.Event) error {
+// topologyChanged records that an upstream joined or left the consistent
+// topology: it bumps the trace version stamp and re-publishes the key
+// share gauge, so the gauge reflects changes without being re-sampled
+// per request or per scrape.
+func (s *WeightedMementoSelection) topologyChanged() {
+	s.bumpTopologyVersion()
+	s.refreshKeyShareGauge()
+}
+
+// refreshKeyShareGauge re-estimates each node's share of the keyspace
+// and publishes it to the key share gauge.
+func (s *WeightedMementoSelection) refreshKeyShareGauge() {
 	if s.consistentEngine == nil {
-		return nil
+		return
+	}
+	observeKeyShares("weighted_memento", s.consistentEngine.KeyShareEstimate(s.ShareSampleSize))
+}
+
+// topologyStatus reports the tracked per-node membership metadata plus
+// an estimated key share per node, for the admin topology endpoint.
+func (s *WeightedMementoSelection) topologyStatus() []topologyNodeReport {
+	var engine topologyEngine
+	if s.consistentEngine != nil {
+		engine = s.consistentEngine
 	}
+	return topologyStatusReport(&s.topology, engine, s.ShareSampleSize)
+}
 
-	host, ok := event.Data["host"].(string)
-	if !ok {
+// healthDebounceCounters exposes the debouncer's per-node state for
+// the admin introspection endpoint.
+func (s *WeightedMementoSelection) healthDebounceCounters() []debounceCounters {
+	if s.debouncer == nil {
 		return nil
 	}
+	return s.debouncer.counters()
+}
 
-	var upstream *Upstream
-	s.topology.Range(func(key, value any) bool {
-		candidate, ok := key.(*Upstream)
-		if !ok {
-			return true
-		}
-		if candidate.String() == host {
-			upstream = candidate
-			return false
-		}
-		return true
-	})
+// simulateRemoval estimates the blast radius of taking the named
+// upstream down: it clones the weighted consistent engine, removes the
+// upstream on the clone, and replays the given keys (or the recent-key
+// sample when TrackKeys is enabled and no keys are supplied) against
+// both. The live engine is never modified.
+func (s *WeightedMementoSelection) simulateRemoval(host string, keys []string) (*removalSimulation, error) {
+	if s.consistentEngine == nil {
+		return nil, fmt.Errorf("consistent engine is not initialized")
+	}
+	upstream := s.nodeByID(host)
 	if upstream == nil {
-		return nil
+		return nil, fmt.Errorf("unknown upstream '%s'", host)
+	}
+	if !s.consistentEngine.indirection.HasNode(upstream) {
+		return nil, fmt.Errorf("upstream '%s' is not in the current topology", host)
+	}
+	if len(keys) == 0 && s.keySampler != nil {
+		keys = s.keySampler.snapshot()
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys to replay: supply keys in the request or enable track_keys on the policy")
 	}
 
-	// No lock needed: topology and engine are now thread-safe
-	// Remove node from consistent engine if present
-	if val, exists := s.topology.Load(upstream); exists && val == true {
-		if err := s.consistentEngine.RemoveNode(upstream); err != nil {
-			// Log error but continue - node might have been already removed
-			return nil
+	clone := s.consistentEngine.Clone()
+	clone.RemoveNode(upstream)
+
+	sim := &removalSimulation{
+		Upstream:   upstream.Dial,
+		TotalKeys:  len(keys),
+		MovedKeys:  []string{},
+		LoadDeltas: map[string]int{},
+	}
+	for _, key := range keys {
+		before, okBefore := s.consistentEngine.Lookup(key)
+		after, okAfter := clone.Lookup(key)
+		if !okBefore || !okAfter || before == after {
+			continue
 		}
-		s.topology.Store(upstream, false)
+		sim.MovedKeys = append(sim.MovedKeys, key)
+		sim.LoadDeltas[before.Dial]--
+		sim.LoadDeltas[after.Dial]++
 	}
-
-	return nil
+	return sim, nil
 }
 
 // Handle implements caddyevents.Handler interface
-func (s *MementoSelection) Handle(ctx context.Context, event caddy.Event) error {
+func (s *WeightedMementoSelection) Handle(ctx context.Context, event caddy.Event) error {
 	switch event.Name() {
 	case "healthy":
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
 		return s.handleHealthyEvent(ctx, event)
 	case "unhealthy":
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
 		return s.handleUnhealthyEvent(ctx, event)
+	case "topology_replace":
+		return s.handleTopologyReplaceEvent(ctx, event)
+	case eventHealthCheckInitialComplete:
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
+		s.completeInitialHealthChecks()
 	}
 	return nil
 }
 
-// WeightedMementoSelection is a policy that selects a host
-// using a weighted consistent hashing algorithm (based on Memento)
-// for optimal load distribution and minimal redistribution when the topology changes.
-type WeightedMementoSelection struct {
-	// The field to use for hashing. Can be "ip", "uri", "header", etc.
-	// Defaults to "ip" if not specified.
+// ConsistentLeastConnSelection is a policy that combines consistent
+// hashing with load awareness, sometimes called two-choice consistent
+// hashing or "ch_2". The request key's highest-scoring hosts by HRW
+// (rendezvous) hashing form a small, stable neighborhood — by default
+// the top two — and the neighborhood member with the fewest in-flight
+// requests wins. A key therefore only ever visits its neighborhood,
+// retaining most of the cache affinity of plain consistent hashing,
+// while a hot key's load is smoothed across the neighborhood instead
+// of concentrating on a single host.
+type ConsistentLeastConnSelection struct {
+	// The request field to derive the key from: "ip", "client_ip",
+	// "uri", "original_uri", "path_only", "path_and_query", "header",
+	// "cookie", or "expression" — the same fields the memento
+	// policies accept. The default is "ip".
 	Field string `json:"field,omitempty"`
 
-	// The header field name if Field is "header"
+	// The name of the header whose value is the key, when the field
+	// is "header".
 	HeaderField string `json:"header_field,omitempty"`
 
-	// The weight of each upstream in order,
-	// corresponding with the list of upstreams configured.
-	Weights []int `json:"weights,omitempty"`
-
-	// The fallback policy to use if the field is not present. Defaults to `random`.
+	// The name of the cookie whose value is the key, when the field
+	// is "cookie".
+	CookieName string `json:"cookie_name,omitempty"`
+
+	// A placeholder expression whose replaced value is the key, when
+	// the field is "expression".
+	Expression string `json:"expression,omitempty"`
+
+	// Prefix length in bits to group client IPv4 addresses by before
+	// hashing, when the field is "ip" or "client_ip". 0 means the
+	// full address.
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+
+	// Prefix length in bits to group client IPv6 addresses by before
+	// hashing, when the field is "ip" or "client_ip". 0 means the
+	// full address.
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	// How many of the key's highest-scoring hosts form its
+	// neighborhood. Larger neighborhoods smooth load better at the
+	// cost of affinity: each key's requests spread over more hosts.
+	// Default: 2.
+	Choices int `json:"choices,omitempty"`
+
+	// The selection policy to use when no key can be derived from
+	// the request or no neighborhood member is available. The
+	// default policy is random selection.
 	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
-	fallback    Selector
-
-	// Internal state for consistent hashing
-	consistentEngine *WeightedConsistentEngine
-	initialWeights   map[*Upstream]int // Persist initial weights for re-balancing
-	topology         sync.Map          // Track which nodes are currently available (map[*Upstream]bool, thread-safe)
 
-	// Event system integration
-	events *caddyevents.App
-	ctx    caddy.Context
-	logger *zap.Logger
+	fallback Selector
 }
 
 // CaddyModule returns the Caddy module information.
-func (WeightedMementoSelection) CaddyModule() caddy.ModuleInfo {
+func (ConsistentLeastConnSelection) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "http.reverse_proxy.selection_policies.weighted_memento",
-		New: func() caddy.Module { return new(WeightedMementoSelection) },
+		ID:  "http.reverse_proxy.selection_policies.consistent_least_conn",
+		New: func() caddy.Module { return new(ConsistentLeastConnSelection) },
 	}
 }
 
-// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
-func (s *WeightedMementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	d.Next() // consume policy name
+// Provision sets up the module.
+func (s *ConsistentLeastConnSelection) Provision(ctx caddy.Context) error {
+	if s.Field == "" {
+		s.Field = "ip"
+	}
+	if s.Field == "expression" && s.Expression == "" {
+		return fmt.Errorf("field 'expression' requires an expression to evaluate")
+	}
+	if s.Field == "cookie" && s.CookieName == "" {
+		return fmt.Errorf("field 'cookie' requires a cookie_name")
+	}
+	if s.Choices < 0 {
+		return fmt.Errorf("choices must be positive, got %d", s.Choices)
+	}
+	if s.Choices == 0 {
+		s.Choices = 2
+	}
+	if err := validateMaskBits(s.IPv4MaskBits, s.IPv6MaskBits); err != nil {
+		return err
+	}
 
-	// The first arguments are the weights
-	s.Weights = []int{}
-	for _, weight := range d.RemainingArgs() {
-		// if an arg is not a number, it's probably a block opener
-		if _, err := strconv.Atoi(weight); err != nil {
-			break
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	fallback, err := loadFallbackSelector(ctx, s, "consistent_least_conn", s.FallbackRaw)
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	s.fallback = markFallback(fallback)
+
+	return nil
+}
+
+// requestKey extracts the hash key for the request according to the
+// configured Field. The second return value is false when no key can
+// be derived (unknown field, or a missing header), in which case the
+// caller should defer to the fallback policy.
+func (s ConsistentLeastConnSelection) requestKey(req *http.Request) (string, bool) {
+	switch s.Field {
+	case "ip":
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
 		}
-		d.NextArg() // consume the weight arg
-		weightInt, err := strconv.Atoi(weight)
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "client_ip":
+		address := clientIPVarOrRemoteAddr(req)
+		clientIP, _, err := net.SplitHostPort(address)
 		if err != nil {
-			return d.Errf("invalid weight value '%s': %v", weight, err)
+			clientIP = address
 		}
-		if weightInt < 0 {
-			return d.Errf("invalid weight value '%s': weight should be non-negative", weight)
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "uri", "original_uri", "path_only", "path_and_query":
+		return uriHashKey(req, s.Field), true
+	case "header":
+		if s.HeaderField == "" {
+			return "", false
+		}
+		return headerHashValue(req, s.HeaderField, false, false)
+	case "cookie":
+		if s.CookieName == "" {
+			return "", false
+		}
+		cookie, err := req.Cookie(s.CookieName)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	case "expression":
+		repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if !ok {
+			return "", false
+		}
+		key := repl.ReplaceAll(s.Expression, "")
+		return key, key != ""
+	}
+	return "", false
+}
+
+// Select returns the least-loaded member of the key's neighborhood,
+// if any.
+func (s ConsistentLeastConnSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	if len(pool) == 0 {
+		return nil
+	}
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+	}
+	neighborhood := s.neighborhood(pool, key, nil)
+	if len(neighborhood) == 0 {
+		return selectViaFallback(s.fallback, pool, req, w, selectionFallbackUnavailable)
+	}
+	return leastRequests(neighborhood, false)
+}
+
+// SelectByKey resolves an already-extracted key against the pool
+// without an http.Request.
+func (s ConsistentLeastConnSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	return leastRequests(s.neighborhood(pool, key, nil), false)
+}
+
+// SelectExcluding is like Select but skips hosts the handler already
+// tried for this request: the neighborhood is re-ranked over the
+// untried hosts, so a retry stays as close to the key's owners as the
+// pool allows.
+func (s ConsistentLeastConnSelection) SelectExcluding(pool UpstreamPool, req *http.Request, w http.ResponseWriter, tried map[*Upstream]struct{}) *Upstream {
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+	}
+	if upstream := leastRequests(s.neighborhood(pool, key, tried), false); upstream != nil {
+		return upstream
+	}
+	return selectViaFallback(s.fallback, pool, req, w, selectionFallbackUnavailable)
+}
+
+// neighborhood returns the key's Choices highest-scoring available
+// hosts by HRW hashing, best first. Because each host's score depends
+// only on itself and the key, adding or removing an unrelated host
+// never changes the relative order of the survivors: a pool change
+// only ever promotes the next-highest scorer into the neighborhood.
+// Hosts in tried (may be nil) are skipped.
+func (s ConsistentLeastConnSelection) neighborhood(pool UpstreamPool, key string, tried map[*Upstream]struct{}) []*Upstream {
+	type scored struct {
+		upstream *Upstream
+		hash     uint64
+	}
+	top := make([]scored, 0, s.Choices)
+	for _, up := range pool {
+		if _, ok := tried[up]; ok {
+			continue
+		}
+		if up == nil || !up.Available() {
+			continue
+		}
+		h := hashTwo(up.hashKey(), key)
+		pos := len(top)
+		for pos > 0 && (top[pos-1].hash < h ||
+			(top[pos-1].hash == h && hrwTieBreak(top[pos-1].upstream, up))) {
+			pos--
 		}
-		s.Weights = append(s.Weights, weightInt)
+		if pos < s.Choices {
+			if len(top) < s.Choices {
+				top = append(top, scored{})
+			}
+			copy(top[pos+1:], top[pos:])
+			top[pos] = scored{upstream: up, hash: h}
+		}
+	}
+	neighborhood := make([]*Upstream, len(top))
+	for i, candidate := range top {
+		neighborhood[i] = candidate.upstream
+	}
+	return neighborhood
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	consistent_least_conn [<field>] {
+//	    field <field>
+//	    header_field <name>
+//	    cookie_name <name>
+//	    expression <expression>
+//	    choices <n>
+//	    ipv4_mask <bits>
+//	    ipv6_mask <bits>
+//	    fallback <policy>
+//	}
+func (s *ConsistentLeastConnSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if d.NextArg() {
+		s.Field = d.Val()
 	}
 
 	for d.NextBlock(0) {
@@ -1256,6 +8664,43 @@ func (s *WeightedMementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) er
 				return d.ArgErr()
 			}
 			s.HeaderField = d.Val()
+		case "cookie_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.CookieName = d.Val()
+		case "expression":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Expression = d.Val()
+		case "choices":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			choices, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid choices '%s': %v", d.Val(), err)
+			}
+			s.Choices = choices
+		case "ipv4_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv6MaskBits = bits
 		case "fallback":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -1272,126 +8717,361 @@ func (s *WeightedMementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) er
 			return d.Errf("unrecognized option '%s'", d.Val())
 		}
 	}
-	return nil
+	return nil
+}
+
+// TieredMementoSelection is a policy that partitions keys in two
+// levels: a key is first assigned to a named group of upstreams (a
+// datacenter, a rack, ...) by weighted consistent hashing, then to a
+// live member within that group by a per-group memento engine. Health
+// events only touch the member level, so a host going away moves only
+// that host's keys, and only to other members of the same group; an
+// entire group going dark removes the group from the first level,
+// spilling just that group's keys across the surviving groups
+// deterministically.
+type TieredMementoSelection struct {
+	// The groups partitioning the upstream pool. Every group needs a
+	// unique name and at least one member dial; an upstream may
+	// belong to at most one group.
+	Groups []TieredMementoGroup `json:"groups,omitempty"`
+
+	// The request field to derive the key from: "ip", "client_ip",
+	// "uri", "original_uri", "path_only", "path_and_query", "header",
+	// "cookie", or "expression" — the same fields the memento
+	// policies accept. The default is "ip".
+	Field string `json:"field,omitempty"`
+
+	// The name of the header whose value is the key, when the field
+	// is "header".
+	HeaderField string `json:"header_field,omitempty"`
+
+	// The name of the cookie whose value is the key, when the field
+	// is "cookie".
+	CookieName string `json:"cookie_name,omitempty"`
+
+	// A placeholder expression whose replaced value is the key, when
+	// the field is "expression".
+	Expression string `json:"expression,omitempty"`
+
+	// How many leading bits of an IPv4 client address count toward
+	// the key, when the field is "ip" or "client_ip". 0 means the
+	// whole address.
+	IPv4MaskBits int `json:"ipv4_mask_bits,omitempty"`
+
+	// How many leading bits of an IPv6 client address count toward
+	// the key. 0 means the whole address.
+	IPv6MaskBits int `json:"ipv6_mask_bits,omitempty"`
+
+	// The selection policy to use when no key can be derived from the
+	// request or the topology cannot map the key to a usable
+	// upstream. The default is random.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+	fallback    Selector
+
+	handlerScope
+
+	// Internal state for the two hashing levels
+	groupEngine     *WeightedConsistentEngine       // group sentinels, weighted by capacity
+	groupBySentinel map[*Upstream]*tieredGroupState // built once at topology init, read-only after
+	groupOf         sync.Map                        // *Upstream -> *tieredGroupState
+	nodesByID       sync.Map                        // Node ID (dial string) -> *Upstream, for O(1) event lookups
+
+	// Serializes topology initialization against the event handlers'
+	// check-and-modify sections
+	topologyUpdateMu sync.Mutex
+
+	events *caddyevents.App
+	logger *zap.Logger
+}
+
+// TieredMementoGroup configures one group of a tiered memento policy.
+type TieredMementoGroup struct {
+	// The group name. It doubles as the group-level hash identity, so
+	// renaming a group reshuffles the keys assigned to it.
+	Name string `json:"name"`
+
+	// The group's relative capacity weight at the first hashing
+	// level. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+
+	// The dial addresses (or explicit hash keys) of the group's
+	// member upstreams.
+	Dials []string `json:"dials,omitempty"`
+}
+
+// tieredGroupState is the runtime view of one configured group: its
+// member-level engine and the sentinel upstream representing it at the
+// group level.
+type tieredGroupState struct {
+	name     string
+	weight   int
+	sentinel *Upstream
+	engine   *ConsistentEngine
+}
+
+// CaddyModule returns the Caddy module information.
+func (TieredMementoSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.tiered_memento",
+		New: func() caddy.Module { return new(TieredMementoSelection) },
+	}
 }
 
 // Provision sets up the module.
-func (s *WeightedMementoSelection) Provision(ctx caddy.Context) error {
-	s.logger = ctx.Logger(s)
+func (s *TieredMementoSelection) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger()
 	if s.Field == "" {
-		s.Field = "ip" // Default to IP-based hashing
+		s.Field = "ip"
+	}
+	if s.Field == "expression" && s.Expression == "" {
+		return fmt.Errorf("field 'expression' requires an expression to evaluate")
+	}
+	if s.Field == "cookie" && s.CookieName == "" {
+		return fmt.Errorf("field 'cookie' requires a cookie_name")
+	}
+	if err := validateMaskBits(s.IPv4MaskBits, s.IPv6MaskBits); err != nil {
+		return err
+	}
+
+	if len(s.Groups) == 0 {
+		return fmt.Errorf("at least one group is required")
+	}
+	names := make(map[string]bool, len(s.Groups))
+	dials := make(map[string]string)
+	for i := range s.Groups {
+		group := &s.Groups[i]
+		if group.Name == "" {
+			return fmt.Errorf("group %d has no name", i)
+		}
+		if names[group.Name] {
+			return fmt.Errorf("group name '%s' is used more than once", group.Name)
+		}
+		names[group.Name] = true
+		if group.Weight < 0 {
+			return fmt.Errorf("group '%s' has negative weight %d", group.Name, group.Weight)
+		}
+		if group.Weight == 0 {
+			group.Weight = 1
+		}
+		if len(group.Dials) == 0 {
+			return fmt.Errorf("group '%s' has no member dials", group.Name)
+		}
+		for _, dial := range group.Dials {
+			if owner, taken := dials[dial]; taken && owner != group.Name {
+				return fmt.Errorf("upstream '%s' is listed in both group '%s' and group '%s'", dial, owner, group.Name)
+			}
+			dials[dial] = group.Name
+		}
 	}
 
 	if s.FallbackRaw == nil {
 		s.FallbackRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
 	}
-	mod, err := ctx.LoadModule(s, "FallbackRaw")
+	fallback, err := loadFallbackSelector(ctx, s, "tiered_memento", s.FallbackRaw)
 	if err != nil {
 		return fmt.Errorf("loading fallback selection policy: %s", err)
 	}
-	s.fallback = mod.(Selector)
-
-	// Initialize the weighted consistent hashing engine
-	s.consistentEngine = NewWeightedConsistentEngine()
-	s.initialWeights = make(map[*Upstream]int)
-
-	// Set up event system integration
-	s.ctx = ctx
+	s.fallback = markFallback(fallback)
 
 	return nil
 }
 
-// Select returns an available host, if any.
-func (s *WeightedMementoSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
-	if len(pool) == 0 {
-		return nil
-	}
-
-	// Get the key to hash based on the field type
-	var key string
+// requestKey extracts the hash key for the request according to the
+// configured Field. The second return value is false when no key can
+// be derived, in which case the caller should defer to the fallback
+// policy.
+func (s *TieredMementoSelection) requestKey(req *http.Request) (string, bool) {
 	switch s.Field {
 	case "ip":
 		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
 		if err != nil {
 			clientIP = req.RemoteAddr
 		}
-		key = clientIP
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
 	case "client_ip":
-		address := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string)
+		address := clientIPVarOrRemoteAddr(req)
 		clientIP, _, err := net.SplitHostPort(address)
 		if err != nil {
 			clientIP = address
 		}
-		key = clientIP
-	case "uri":
-		key = req.RequestURI
+		return maskedIPKey(clientIP, s.IPv4MaskBits, s.IPv6MaskBits), true
+	case "uri", "original_uri", "path_only", "path_and_query":
+		return uriHashKey(req, s.Field), true
 	case "header":
 		if s.HeaderField == "" {
-			return s.fallback.Select(pool, req, w)
+			return "", false
 		}
-		if s.HeaderField == "Host" && req.Host != "" {
-			key = req.Host
-		} else {
-			key = req.Header.Get(s.HeaderField)
+		return headerHashValue(req, s.HeaderField, false, false)
+	case "cookie":
+		if s.CookieName == "" {
+			return "", false
 		}
-		if key == "" {
-			return s.fallback.Select(pool, req, w)
+		cookie, err := req.Cookie(s.CookieName)
+		if err != nil || cookie.Value == "" {
+			return "", false
 		}
-	default:
-		return s.fallback.Select(pool, req, w)
-	}
-
-	// Use the weighted consistent engine to find the node
-	if upstream, ok := s.consistentEngine.Lookup(key); ok {
-		// s.logger.Debug("memento lookup", zap.String("key", key), zap.String("nodeID", upstream.String()))
-
-		if upstream.Available() {
-			return upstream
+		return cookie.Value, true
+	case "expression":
+		repl, ok := req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if !ok {
+			return "", false
 		}
+		key := repl.ReplaceAll(s.Expression, "")
+		return key, key != ""
+	}
+	return "", false
+}
 
+// Select returns an available host, if any.
+func (s *TieredMementoSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	if len(pool) == 0 {
+		return nil
+	}
+	key, ok := s.requestKey(req)
+	if !ok {
+		return selectViaFallback(s.fallback, pool, req, w, selectionFallbackKeyMissing)
+	}
+	if upstream := s.SelectByKey(pool, key); upstream != nil {
+		return upstream
+	}
+	cause := selectionFallbackUnavailable
+	if s.groupEngine == nil {
+		cause = selectionFallbackEngineEmpty
 	}
+	return selectViaFallback(s.fallback, pool, req, w, cause)
+}
 
-	// Fallback if the node is not found or engine is not ready
-	return s.fallback.Select(pool, req, w)
+// SelectByKey resolves an already-extracted key through both hashing
+// levels. It returns nil when the topology cannot map the key to a
+// usable upstream (engines not initialized, every group dark, or the
+// key's owner unavailable); request-path callers then defer to the
+// fallback policy.
+func (s *TieredMementoSelection) SelectByKey(pool UpstreamPool, key string) *Upstream {
+	upstream := s.lookup(key)
+	if upstream == nil || !upstream.Available() {
+		return nil
+	}
+	return upstream
 }
 
-// SetEventsApp sets the events app for this selection policy
-func (s *WeightedMementoSelection) SetEventsApp(events *caddyevents.App) {
-	if events != nil {
-		s.events = events
-		s.subscribeToHealthEvents()
+// lookup maps the key to its group by weighted consistent hashing,
+// then to a live member of that group by the group's memento engine.
+func (s *TieredMementoSelection) lookup(key string) *Upstream {
+	groupEngine := s.groupEngine
+	if groupEngine == nil {
+		return nil
+	}
+	sentinel, ok := groupEngine.Lookup(key)
+	if !ok {
+		return nil
+	}
+	state := s.groupBySentinel[sentinel]
+	if state == nil {
+		return nil
+	}
+	upstream, ok := state.engine.Lookup(key)
+	if !ok {
+		return nil
 	}
+	return upstream
 }
 
-// PopulateInitialTopology populates the Memento topology with initial upstreams
-func (s *WeightedMementoSelection) PopulateInitialTopology(upstreams []*Upstream) {
-	if s.consistentEngine == nil {
-		return
+// PopulateInitialTopology matches the configured upstreams against the
+// groups and seeds both hashing levels. Upstreams listed in no group
+// are warned about and never selected by this policy; groups whose
+// members are all absent start out dark.
+func (s *TieredMementoSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+
+	specs := make(map[string]*tieredGroupState)
+	states := make([]*tieredGroupState, 0, len(s.Groups))
+	for _, group := range s.Groups {
+		state := &tieredGroupState{
+			name:     group.Name,
+			weight:   group.Weight,
+			sentinel: &Upstream{Dial: group.Name, HashKey: group.Name},
+			engine:   NewConsistentEngine(),
+		}
+		states = append(states, state)
+		for _, dial := range group.Dials {
+			specs[dial] = state
+			if canonical := canonicalDialKey(dial); canonical != dial {
+				specs[canonical] = state
+			}
+		}
 	}
 
-	nodesWithWeights := make(map[*Upstream]int)
-	for i, upstream := range upstreams {
-		weight := 1 // Default weight
-		if i < len(s.Weights) {
-			weight = s.Weights[i]
+	for _, upstream := range upstreams {
+		state := specs[upstream.hashKey()]
+		if state == nil {
+			state = specs[upstream.Dial]
 		}
-		if weight <= 0 {
+		if state == nil {
+			state = specs[upstream.String()]
+		}
+		if state == nil {
+			if s.logger != nil {
+				s.logger.Warn("upstream is not listed in any tiered group and will never be selected",
+					zap.String("upstream", upstream.String()))
+			}
 			continue
 		}
-		nodesWithWeights[upstream] = weight
-		s.initialWeights[upstream] = weight // Store for later
+		if err := state.engine.AddNode(upstream); err != nil {
+			if s.logger != nil {
+				s.logger.Warn("cannot add upstream to its group engine",
+					zap.String("group", state.name),
+					zap.Error(err))
+			}
+			continue
+		}
+		s.groupOf.Store(upstream, state)
+		indexUpstreamIDs(&s.nodesByID, upstream)
 	}
 
-	s.consistentEngine.InitCluster(nodesWithWeights)
+	sentinelWeights := make(map[*Upstream]int, len(states))
+	bySentinel := make(map[*Upstream]*tieredGroupState, len(states))
+	for _, state := range states {
+		bySentinel[state.sentinel] = state
+		if state.engine.Size() == 0 {
+			if s.logger != nil {
+				s.logger.Warn("tiered group has no matching upstreams",
+					zap.String("group", state.name))
+			}
+			continue
+		}
+		sentinelWeights[state.sentinel] = state.weight
+	}
+	groupEngine := NewWeightedConsistentEngine()
+	groupEngine.InitCluster(sentinelWeights)
+	s.groupBySentinel = bySentinel
+	s.groupEngine = groupEngine
+}
 
-	// Mark all nodes as present in the topology map
-	for upstream := range nodesWithWeights {
-		s.topology.Store(upstream, true)
+// nodeByID returns the known upstream for the given node ID (dial
+// string) in O(1), or nil if the upstream belongs to no group. The ID
+// is also tried in its canonical spelling, so events from emitters
+// that don't normalize still match.
+func (s *TieredMementoSelection) nodeByID(host string) *Upstream {
+	if val, ok := s.nodesByID.Load(host); ok {
+		return val.(*Upstream)
+	}
+	if val, ok := s.nodesByID.Load(canonicalDialKey(host)); ok {
+		return val.(*Upstream)
+	}
+	return nil
+}
+
+// SetEventsApp sets the events app for this selection policy
+func (s *TieredMementoSelection) SetEventsApp(events *caddyevents.App) {
+	if events != nil {
+		s.events = events
+		s.subscribeToHealthEvents()
 	}
 }
 
 // subscribeToHealthEvents subscribes to health check events for real-time topology updates
-func (s *WeightedMementoSelection) subscribeToHealthEvents() {
+func (s *TieredMementoSelection) subscribeToHealthEvents() {
 	if s.events == nil {
 		return
 	}
@@ -1399,79 +9079,223 @@ func (s *WeightedMementoSelection) subscribeToHealthEvents() {
 	s.events.On("unhealthy", s)
 }
 
-// handleHealthyEvent handles when an upstream becomes healthy
-func (s *WeightedMementoSelection) handleHealthyEvent(ctx context.Context, event caddy.Event) error {
-	if s.consistentEngine == nil {
+// unsubscribeFromHealthEvents removes this policy's event bindings so a
+// cleaned-up instance no longer receives health events
+func (s *TieredMementoSelection) unsubscribeFromHealthEvents() {
+	if s.events == nil {
+		return
+	}
+	s.events.Off("healthy", s)
+	s.events.Off("unhealthy", s)
+	s.events = nil
+}
+
+// handleHealthyEvent restores a recovered member to its group's
+// engine; if the whole group had been dark, the group re-enters the
+// first hashing level, pulling its original keys back.
+func (s *TieredMementoSelection) handleHealthyEvent(_ context.Context, event caddy.Event) error {
+	if s.groupEngine == nil {
 		return nil
 	}
-	host, ok := event.Data["host"].(string)
+	payload, ok := upstreamHealthEventFromEvent(event)
 	if !ok {
 		return nil
 	}
-
-	var upstream *Upstream
-	for up := range s.initialWeights {
-		if up.String() == host {
-			upstream = up
-			break
-		}
-	}
+	upstream := s.nodeByID(payload.Dial)
 	if upstream == nil {
 		return nil
 	}
+	val, ok := s.groupOf.Load(upstream)
+	if !ok {
+		return nil
+	}
+	state := val.(*tieredGroupState)
 
-	// Re-add the node only if it was previously part of the topology
-	if _, exists := s.topology.Load(upstream); !exists {
-		weight, hasInitialWeight := s.initialWeights[upstream]
-		if !hasInitialWeight {
-			// This should not happen if the host was part of the initial config
-			weight = 1
-		}
-		s.consistentEngine.AddNode(upstream, weight)
-		s.topology.Store(upstream, true)
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	if state.engine.HasNode(upstream) {
+		return nil
+	}
+	wasDark := state.engine.Size() == 0
+	if err := state.engine.AddNode(upstream); err != nil {
+		return nil
+	}
+	if wasDark {
+		s.groupEngine.AddNode(state.sentinel, state.weight)
 	}
 	return nil
 }
 
-// handleUnhealthyEvent handles when an upstream becomes unhealthy
-func (s *WeightedMementoSelection) handleUnhealthyEvent(ctx context.Context, event caddy.Event) error {
-	if s.consistentEngine == nil {
+// handleUnhealthyEvent removes a failed member from its group's
+// engine, moving only that member's keys and only within the group.
+// When the group's last member goes, the group leaves the first
+// hashing level so just its keys spill to the surviving groups.
+func (s *TieredMementoSelection) handleUnhealthyEvent(_ context.Context, event caddy.Event) error {
+	if s.groupEngine == nil {
 		return nil
 	}
-	host, ok := event.Data["host"].(string)
+	payload, ok := upstreamHealthEventFromEvent(event)
 	if !ok {
 		return nil
 	}
-
-	var upstream *Upstream
-	for up := range s.initialWeights {
-		if up.String() == host {
-			upstream = up
-			break
-		}
-	}
+	upstream := s.nodeByID(payload.Dial)
 	if upstream == nil {
 		return nil
 	}
+	val, ok := s.groupOf.Load(upstream)
+	if !ok {
+		return nil
+	}
+	state := val.(*tieredGroupState)
 
-	if _, exists := s.topology.Load(upstream); exists {
-		s.consistentEngine.RemoveNode(upstream)
-		s.topology.Delete(upstream)
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	if !state.engine.HasNode(upstream) {
+		return nil
+	}
+	if err := state.engine.RemoveNode(upstream); err != nil {
+		return nil
+	}
+	if state.engine.Size() == 0 {
+		s.groupEngine.RemoveNode(state.sentinel)
 	}
 	return nil
 }
 
 // Handle implements caddyevents.Handler interface
-func (s *WeightedMementoSelection) Handle(ctx context.Context, event caddy.Event) error {
+func (s *TieredMementoSelection) Handle(ctx context.Context, event caddy.Event) error {
 	switch event.Name() {
 	case "healthy":
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
 		return s.handleHealthyEvent(ctx, event)
 	case "unhealthy":
+		if !s.acceptsHealthEventFrom(event) {
+			return nil
+		}
 		return s.handleUnhealthyEvent(ctx, event)
 	}
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper. It deregisters this instance
+// from the events app and releases both hashing levels.
+func (s *TieredMementoSelection) Cleanup() error {
+	s.unsubscribeFromHealthEvents()
+	s.topologyUpdateMu.Lock()
+	defer s.topologyUpdateMu.Unlock()
+	s.groupEngine = nil
+	s.groupBySentinel = nil
+	s.groupOf.Range(func(key, _ any) bool {
+		s.groupOf.Delete(key)
+		return true
+	})
+	s.nodesByID.Range(func(key, _ any) bool {
+		s.nodesByID.Delete(key)
+		return true
+	})
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	tiered_memento [<field>] {
+//	    field <field>
+//	    group <name> <weight> <dial...>
+//	    header_field <name>
+//	    cookie_name <name>
+//	    expression <expr>
+//	    ipv4_mask <bits>
+//	    ipv6_mask <bits>
+//	    fallback <policy...>
+//	}
+func (s *TieredMementoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if d.NextArg() {
+		s.Field = d.Val()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Field = d.Val()
+		case "group":
+			args := d.RemainingArgs()
+			if len(args) < 3 {
+				return d.Err("group requires a name, a weight, and at least one member dial")
+			}
+			weight, err := strconv.Atoi(args[1])
+			if err != nil {
+				return d.Errf("invalid group weight '%s': %v", args[1], err)
+			}
+			s.Groups = append(s.Groups, TieredMementoGroup{
+				Name:   args[0],
+				Weight: weight,
+				Dials:  args[2:],
+			})
+		case "header_field":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.HeaderField = d.Val()
+		case "cookie_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.CookieName = d.Val()
+		case "expression":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Expression = d.Val()
+		case "ipv4_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv4_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv4MaskBits = bits
+		case "ipv6_mask":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			bits, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ipv6_mask '%s': %v", d.Val(), err)
+			}
+			s.IPv6MaskBits = bits
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.FallbackRaw = mod
+		default:
+			handled, err := s.unmarshalHandlerScopeOption(d)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
 // Interface guards
 var (
 	_ Selector = (*RandomSelection)(nil)
@@ -1480,30 +9304,164 @@ var (
 	_ Selector = (*RoundRobinSelection)(nil)
 	_ Selector = (*WeightedRoundRobinSelection)(nil)
 	_ Selector = (*FirstSelection)(nil)
+	_ Selector = (*PrioritySelection)(nil)
 	_ Selector = (*IPHashSelection)(nil)
 	_ Selector = (*ClientIPHashSelection)(nil)
 	_ Selector = (*URIHashSelection)(nil)
+	_ Selector = (*RendezvousSelection)(nil)
 	_ Selector = (*QueryHashSelection)(nil)
+	_ Selector = (*JumpHashSelection)(nil)
 	_ Selector = (*HeaderHashSelection)(nil)
 	_ Selector = (*CookieHashSelection)(nil)
+	_ Selector = (*HeaderStickySelection)(nil)
+	_ Selector = (*StickyTableSelection)(nil)
+	_ Selector = (*ChainSelection)(nil)
+	_ Selector = (*MapSelection)(nil)
 	_ Selector = (*MementoSelection)(nil)
 	_ Selector = (*WeightedMementoSelection)(nil)
+	_ Selector = (*ConsistentLeastConnSelection)(nil)
+	_ Selector = (*TieredMementoSelection)(nil)
 
 	_ caddy.Validator = (*RandomChoiceSelection)(nil)
+	_ caddy.Validator = (*WeightedMementoSelection)(nil)
 
+	_ poolSizeValidator = (*WeightedMementoSelection)(nil)
+
+	_ caddy.Provisioner = (*RoundRobinSelection)(nil)
+	_ caddy.Provisioner = (*RandomSelection)(nil)
+	_ caddy.Provisioner = (*FirstSelection)(nil)
 	_ caddy.Provisioner = (*RandomChoiceSelection)(nil)
+	_ caddy.Provisioner = (*LeastConnSelection)(nil)
+	_ caddy.Provisioner = (*PrioritySelection)(nil)
+	_ caddy.Provisioner = (*IPHashSelection)(nil)
+	_ caddy.Provisioner = (*ClientIPHashSelection)(nil)
+	_ caddy.Provisioner = (*URIHashSelection)(nil)
+	_ caddy.Provisioner = (*RendezvousSelection)(nil)
 	_ caddy.Provisioner = (*WeightedRoundRobinSelection)(nil)
+	_ caddy.Provisioner = (*HeaderStickySelection)(nil)
+	_ caddy.Provisioner = (*StickyTableSelection)(nil)
+	_ caddy.Provisioner = (*ChainSelection)(nil)
+	_ caddy.Provisioner = (*MapSelection)(nil)
 	_ caddy.Provisioner = (*MementoSelection)(nil)
 	_ caddy.Provisioner = (*WeightedMementoSelection)(nil)
+	_ caddy.Provisioner = (*ConsistentLeastConnSelection)(nil)
+	_ caddy.Provisioner = (*TieredMementoSelection)(nil)
 
 	_ caddyfile.Unmarshaler = (*RandomChoiceSelection)(nil)
+	_ caddyfile.Unmarshaler = (*PrioritySelection)(nil)
 	_ caddyfile.Unmarshaler = (*WeightedRoundRobinSelection)(nil)
+	_ caddyfile.Unmarshaler = (*HeaderStickySelection)(nil)
+	_ caddyfile.Unmarshaler = (*StickyTableSelection)(nil)
+	_ caddyfile.Unmarshaler = (*ChainSelection)(nil)
+	_ caddyfile.Unmarshaler = (*MapSelection)(nil)
+	_ caddyfile.Unmarshaler = (*RendezvousSelection)(nil)
 	_ caddyfile.Unmarshaler = (*MementoSelection)(nil)
 	_ caddyfile.Unmarshaler = (*WeightedMementoSelection)(nil)
+	_ caddyfile.Unmarshaler = (*ConsistentLeastConnSelection)(nil)
+	_ caddyfile.Unmarshaler = (*TieredMementoSelection)(nil)
 
+	_ caddyevents.Handler = (*StickyTableSelection)(nil)
 	_ caddyevents.Handler = (*MementoSelection)(nil)
 	_ caddyevents.Handler = (*WeightedMementoSelection)(nil)
 
+	_ EventsAware = (*PrioritySelection)(nil)
+	_ EventsAware = (*StickyTableSelection)(nil)
+	_ EventsAware = (*ChainSelection)(nil)
+	_ EventsAware = (*MapSelection)(nil)
+	_ EventsAware = (*MementoSelection)(nil)
+	_ EventsAware = (*WeightedMementoSelection)(nil)
+	_ EventsAware = (*TieredMementoSelection)(nil)
+
+	_ TopologyInitializer = (*PrioritySelection)(nil)
+	_ TopologyInitializer = (*StickyTableSelection)(nil)
+	_ TopologyInitializer = (*ChainSelection)(nil)
+	_ TopologyInitializer = (*MapSelection)(nil)
+	_ TopologyInitializer = (*RandomChoiceSelection)(nil)
+	_ TopologyInitializer = (*LeastConnSelection)(nil)
+
+	_ TopologyAware = (*MementoSelection)(nil)
+	_ TopologyAware = (*WeightedMementoSelection)(nil)
+
+	_ handlerIdentityAware = (*MementoSelection)(nil)
+	_ handlerIdentityAware = (*WeightedMementoSelection)(nil)
+	_ handlerIdentityAware = (*TieredMementoSelection)(nil)
+	_ handlerIdentityAware = (*ChainSelection)(nil)
+	_ handlerIdentityAware = (*MapSelection)(nil)
+
+	_ retryAwareSelector = (*PrioritySelection)(nil)
+	_ retryAwareSelector = (*RoundRobinSelection)(nil)
+	_ retryAwareSelector = (*LeastConnSelection)(nil)
+	_ retryAwareSelector = (*IPHashSelection)(nil)
+	_ retryAwareSelector = (*ClientIPHashSelection)(nil)
+	_ retryAwareSelector = (*URIHashSelection)(nil)
+	_ retryAwareSelector = (*RendezvousSelection)(nil)
+	_ retryAwareSelector = (*QueryHashSelection)(nil)
+	_ retryAwareSelector = (*JumpHashSelection)(nil)
+	_ retryAwareSelector = (*HeaderHashSelection)(nil)
+	_ retryAwareSelector = (*CookieHashSelection)(nil)
+	_ retryAwareSelector = (*MementoSelection)(nil)
+	_ retryAwareSelector = (*WeightedMementoSelection)(nil)
+	_ retryAwareSelector = (*ConsistentLeastConnSelection)(nil)
+
+	_ Previewer = (*IPHashSelection)(nil)
+	_ Previewer = (*ClientIPHashSelection)(nil)
+	_ Previewer = (*URIHashSelection)(nil)
+	_ Previewer = (*RendezvousSelection)(nil)
+	_ Previewer = (*QueryHashSelection)(nil)
+	_ Previewer = (*JumpHashSelection)(nil)
+	_ Previewer = (*HeaderHashSelection)(nil)
+	_ Previewer = (*MementoSelection)(nil)
+	_ Previewer = (*WeightedMementoSelection)(nil)
+
+	_ removalSimulator = (*MementoSelection)(nil)
+	_ removalSimulator = (*WeightedMementoSelection)(nil)
+
+	_ topologyReporter = (*MementoSelection)(nil)
+	_ topologyReporter = (*WeightedMementoSelection)(nil)
+
+	_ KeySelector = (*IPHashSelection)(nil)
+	_ KeySelector = (*URIHashSelection)(nil)
+	_ KeySelector = (*QueryHashSelection)(nil)
+	_ KeySelector = (*JumpHashSelection)(nil)
+	_ KeySelector = (*HeaderHashSelection)(nil)
+	_ KeySelector = (*MementoSelection)(nil)
+	_ KeySelector = (*WeightedMementoSelection)(nil)
+	_ KeySelector = (*ConsistentLeastConnSelection)(nil)
+	_ KeySelector = (*TieredMementoSelection)(nil)
+
+	_ affinityKeyer = (*IPHashSelection)(nil)
+	_ affinityKeyer = (*ClientIPHashSelection)(nil)
+	_ affinityKeyer = (*URIHashSelection)(nil)
+	_ affinityKeyer = (*RendezvousSelection)(nil)
+	_ affinityKeyer = (*QueryHashSelection)(nil)
+	_ affinityKeyer = (*JumpHashSelection)(nil)
+	_ affinityKeyer = (*HeaderHashSelection)(nil)
+	_ affinityKeyer = (*MementoSelection)(nil)
+	_ affinityKeyer = (*WeightedMementoSelection)(nil)
+	_ affinityKeyer = (*ConsistentLeastConnSelection)(nil)
+
+	_ affinitySelector = (*IPHashSelection)(nil)
+	_ affinitySelector = (*ClientIPHashSelection)(nil)
+	_ affinitySelector = (*URIHashSelection)(nil)
+	_ affinitySelector = (*RendezvousSelection)(nil)
+	_ affinitySelector = (*QueryHashSelection)(nil)
+	_ affinitySelector = (*JumpHashSelection)(nil)
+	_ affinitySelector = (*HeaderHashSelection)(nil)
+	_ affinitySelector = (*CookieHashSelection)(nil)
+	_ affinitySelector = (*HeaderStickySelection)(nil)
+	_ affinitySelector = (*StickyTableSelection)(nil)
+	_ affinitySelector = (*MementoSelection)(nil)
+	_ affinitySelector = (*WeightedMementoSelection)(nil)
+	_ affinitySelector = (*ConsistentLeastConnSelection)(nil)
+	_ affinitySelector = (*TieredMementoSelection)(nil)
+
+	_ duplicateDialResolver = (*MementoSelection)(nil)
+	_ duplicateDialResolver = (*WeightedMementoSelection)(nil)
+
+	_ caddy.CleanerUpper = (*MementoSelection)(nil)
+	_ caddy.CleanerUpper = (*WeightedMementoSelection)(nil)
+	_ caddy.CleanerUpper = (*TieredMementoSelection)(nil)
+
 	// Back-compat alias
 )
 
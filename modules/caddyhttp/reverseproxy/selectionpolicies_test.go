@@ -16,15 +16,28 @@ package reverseproxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
 )
 
 func testPool() UpstreamPool {
@@ -124,13 +137,18 @@ func TestWeightedRoundRobinPolicy(t *testing.T) {
 	if h != pool[0] {
 		t.Error("Expected to select first host on availability.")
 	}
-	// mark host as full
+	// mark host as full; the weighted position is computed over the
+	// remaining hosts' weights {3, 1}, so the next turn is the first
+	// host's
 	pool[1].countRequest(1)
 	pool[1].MaxRequests = 1
 	h = wrrPolicy.Select(pool, req, nil)
-	if h != pool[2] {
+	if h == pool[1] {
 		t.Error("Expected to skip full host.")
 	}
+	if h != pool[0] {
+		t.Error("Expected the weighted position to fall on the first host.")
+	}
 }
 
 func TestWeightedRoundRobinPolicyWithZeroWeight(t *testing.T) {
@@ -185,6 +203,48 @@ func TestWeightedRoundRobinPolicyWithZeroWeight(t *testing.T) {
 	}
 }
 
+func TestWeightedRoundRobinPolicyMismatchedWeights(t *testing.T) {
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// fewer weights than upstreams: the missing weight defaults to 1,
+	// so [3 2] over three upstreams behaves like [3 2 1]
+	wrrPolicy := WeightedRoundRobinSelection{
+		Weights: []int{3, 2},
+	}
+	expected := []*Upstream{pool[0], pool[0], pool[1], pool[1], pool[2], pool[0]}
+	for i, want := range expected {
+		got := wrrPolicy.Select(pool, req, nil)
+		if want != got {
+			t.Errorf("Selection %d: got host[%s], want host[%s]", i+1, got, want)
+		}
+	}
+
+	// more weights than upstreams: the extra weights are ignored
+	wrrPolicy = WeightedRoundRobinSelection{
+		Weights: []int{3, 2, 1, 7, 9},
+	}
+	for i, want := range expected {
+		got := wrrPolicy.Select(pool, req, nil)
+		if want != got {
+			t.Errorf("Selection %d: got host[%s], want host[%s]", i+1, got, want)
+		}
+	}
+
+	// interior zero weight with fewer weights than upstreams: the
+	// zero-weight host is skipped and the last host defaults to 1
+	wrrPolicy = WeightedRoundRobinSelection{
+		Weights: []int{2, 0},
+	}
+	expected = []*Upstream{pool[0], pool[2], pool[0]}
+	for i, want := range expected {
+		got := wrrPolicy.Select(pool, req, nil)
+		if want != got {
+			t.Errorf("Selection %d: got host[%s], want host[%s]", i+1, got, want)
+		}
+	}
+}
+
 func TestLeastConnPolicy(t *testing.T) {
 	pool := testPool()
 	lcPolicy := LeastConnSelection{}
@@ -488,6 +548,95 @@ func TestClientIPHashPolicy(t *testing.T) {
 	}
 }
 
+func TestLeastConnPolicyWeighted(t *testing.T) {
+	pool := testPool()
+	leastConnPolicy := LeastConnSelection{Weights: []int{4, 16, 8}}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// with requests that never complete, least_conn keeps the weighted
+	// loads equal, so the share of assigned requests approximates the
+	// weights in steady state
+	const numRequests = 2800
+	counts := map[*Upstream]int{}
+	for i := 0; i < numRequests; i++ {
+		h := leastConnPolicy.Select(pool, req, nil)
+		if h == nil {
+			t.Fatal("Expected weighted least_conn to select a host.")
+		}
+		h.countRequest(1)
+		counts[h]++
+	}
+	totalWeight := 4 + 16 + 8
+	for i, weight := range []int{4, 16, 8} {
+		expected := float64(numRequests) * float64(weight) / float64(totalWeight)
+		if got := float64(counts[pool[i]]); math.Abs(got-expected) > expected*0.02 {
+			t.Errorf("Expected upstream %d to receive ~%.0f requests, got %.0f", i, expected, got)
+		}
+	}
+	for _, up := range pool {
+		up.countRequest(-counts[up])
+	}
+
+	// a zero weight excludes the upstream
+	zeroPolicy := LeastConnSelection{Weights: []int{0, 1, 1}}
+	for i := 0; i < 10; i++ {
+		if h := zeroPolicy.Select(pool, req, nil); h == pool[0] {
+			t.Error("Expected zero-weight upstream to never be selected.")
+			break
+		}
+	}
+
+	// negative weights are rejected at provision time
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	negative := LeastConnSelection{Weights: []int{1, -1}}
+	if err := negative.Provision(ctx); err == nil {
+		t.Error("Expected provisioning negative weights to fail.")
+	}
+}
+
+func TestRandomChoicePolicyWeighted(t *testing.T) {
+	pool := testPool()
+	randomChoicePolicy := RandomChoiceSelection{Choose: 2, Weights: []int{1, 1, 2}}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// with all hosts idle, the policy returns the strongest sampled
+	// candidate, so over many trials the share approximates the weights
+	const numTrials = 10000
+	counts := map[*Upstream]int{}
+	for i := 0; i < numTrials; i++ {
+		h := randomChoicePolicy.Select(pool, req, nil)
+		if h == nil {
+			t.Fatal("Expected weighted random_choose to select a host.")
+		}
+		counts[h]++
+	}
+	expectedShares := []float64{0.25, 0.25, 0.5}
+	for i, expected := range expectedShares {
+		share := float64(counts[pool[i]]) / numTrials
+		if math.Abs(share-expected) > 0.05 {
+			t.Errorf("Expected upstream %d share ~%.2f, got %.2f", i, expected, share)
+		}
+	}
+
+	// a zero weight excludes the upstream
+	zeroPolicy := RandomChoiceSelection{Choose: 2, Weights: []int{0, 1, 1}}
+	for i := 0; i < 100; i++ {
+		if h := zeroPolicy.Select(pool, req, nil); h == pool[0] {
+			t.Error("Expected zero-weight upstream to never be selected.")
+			break
+		}
+	}
+
+	// negative weights are rejected at provision time
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	negative := RandomChoiceSelection{Choose: 2, Weights: []int{-1}}
+	if err := negative.Provision(ctx); err == nil {
+		t.Error("Expected provisioning negative weights to fail.")
+	}
+}
+
 func TestFirstPolicy(t *testing.T) {
 	pool := testPool()
 	firstPolicy := FirstSelection{}
@@ -505,6 +654,53 @@ func TestFirstPolicy(t *testing.T) {
 	}
 }
 
+func TestPriorityPolicy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	// prefer the last host in config order, then the first; the second
+	// is unlisted and only serves when the listed ones cannot
+	priorityPolicy := PrioritySelection{Priorities: []string{"0.0.0.3", "0.0.0.1"}}
+	if err := priorityPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if h := priorityPolicy.Select(pool, req, nil); h != pool[2] {
+		t.Error("Expected the top priority host to be selected.")
+	}
+
+	// top priority down: the next listed host takes over
+	pool[2].setHealthy(false)
+	if h := priorityPolicy.Select(pool, req, nil); h != pool[0] {
+		t.Error("Expected the second priority host after the first went down.")
+	}
+
+	// every listed host down: the unlisted remainder serves in config order
+	pool[0].setHealthy(false)
+	if h := priorityPolicy.Select(pool, req, nil); h != pool[1] {
+		t.Error("Expected the unlisted host once all priorities were down.")
+	}
+
+	// recovery returns traffic to the top priority immediately
+	pool[2].setHealthy(true)
+	if h := priorityPolicy.Select(pool, req, nil); h != pool[2] {
+		t.Error("Expected traffic to return to the top priority host on recovery.")
+	}
+	pool[0].setHealthy(true)
+
+	// an entry matching no upstream is skipped, not fatal
+	unknownPolicy := PrioritySelection{Priorities: []string{"10.0.0.9:443", "0.0.0.2"}}
+	if err := unknownPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	unknownPolicy.PopulateInitialTopology(pool)
+	if h := unknownPolicy.Select(pool, req, nil); h != pool[1] {
+		t.Error("Expected the first known priority host to be selected.")
+	}
+}
+
 func TestQueryHashPolicy(t *testing.T) {
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
 	defer cancel()
@@ -581,6 +777,108 @@ func TestQueryHashPolicy(t *testing.T) {
 	}
 }
 
+func TestQueryHashPolicyWeighted(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	queryPolicy := QueryHashSelection{Key: "foo", Weights: []int{5, 3, 2}}
+	if err := queryPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	pool := testPool()
+
+	// Over many distinct keys, the share of keys each upstream owns
+	// should approximate the weight ratios.
+	const numKeys = 10000
+	counts := map[*Upstream]int{}
+	for i := 0; i < numKeys; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/?foo=key"+strconv.Itoa(i), nil)
+		h := queryPolicy.Select(pool, request, nil)
+		if h == nil {
+			t.Fatal("Expected weighted query policy to select a host.")
+		}
+		counts[h]++
+	}
+	expectedShares := []float64{0.5, 0.3, 0.2}
+	for i, up := range pool {
+		share := float64(counts[up]) / numKeys
+		if math.Abs(share-expectedShares[i]) > 0.03 {
+			t.Errorf("Expected upstream %d to own ~%.0f%% of keys, got %.1f%%",
+				i, expectedShares[i]*100, share*100)
+		}
+	}
+
+	// Marking one upstream unhealthy should not move keys owned by the others.
+	owners := map[int]*Upstream{}
+	for i := 0; i < 100; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/?foo=key"+strconv.Itoa(i), nil)
+		owners[i] = queryPolicy.Select(pool, request, nil)
+	}
+	pool[1].setHealthy(false)
+	for i := 0; i < 100; i++ {
+		if owners[i] == pool[1] {
+			continue
+		}
+		request := httptest.NewRequest(http.MethodGet, "/?foo=key"+strconv.Itoa(i), nil)
+		if h := queryPolicy.Select(pool, request, nil); h != owners[i] {
+			t.Errorf("Expected key %d to keep its owner after removing an unrelated upstream", i)
+		}
+	}
+
+	// A zero weight excludes the upstream entirely.
+	pool[1].setHealthy(true)
+	zeroPolicy := QueryHashSelection{Key: "foo", Weights: []int{0, 1, 1}}
+	if err := zeroPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/?foo=key"+strconv.Itoa(i), nil)
+		if h := zeroPolicy.Select(pool, request, nil); h == pool[0] {
+			t.Error("Expected zero-weight upstream to never be selected.")
+			break
+		}
+	}
+}
+
+func TestHeaderHashPolicyWeighted(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+	headerPolicy := HeaderHashSelection{Field: "X-Tenant", Weights: []int{5, 3, 2}}
+	if err := headerPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	const numKeys = 10000
+	counts := map[*Upstream]int{}
+	for i := 0; i < numKeys; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("X-Tenant", "tenant"+strconv.Itoa(i))
+		h := headerPolicy.Select(pool, request, nil)
+		if h == nil {
+			t.Fatal("Expected weighted header policy to select a host.")
+		}
+		counts[h]++
+	}
+	expectedShares := []float64{0.5, 0.3, 0.2}
+	for i, up := range pool {
+		share := float64(counts[up]) / numKeys
+		if math.Abs(share-expectedShares[i]) > 0.03 {
+			t.Errorf("Expected upstream %d to own ~%.0f%% of keys, got %.1f%%",
+				i, expectedShares[i]*100, share*100)
+		}
+	}
+
+	// Without the header, selection falls through to the fallback policy.
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if h := headerPolicy.Select(pool, request, nil); h == nil {
+		t.Error("Expected fallback policy to select a host if header is not present.")
+	}
+}
+
 func TestURIHashPolicy(t *testing.T) {
 	pool := testPool()
 	uriPolicy := URIHashSelection{}
@@ -636,6 +934,116 @@ func TestURIHashPolicy(t *testing.T) {
 	}
 }
 
+// rewrittenRequest simulates a request that arrived with origURI and was
+// rewritten (e.g. by handle_path stripping a prefix) to newURI before
+// reaching the proxy, recording the original request in the context the
+// way the server does.
+func rewrittenRequest(origURI, newURI string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, origURI, nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.OriginalRequestCtxKey, *req))
+	rewritten := httptest.NewRequest(http.MethodGet, newURI, nil)
+	req.URL = rewritten.URL
+	req.RequestURI = rewritten.RequestURI
+	return req
+}
+
+func TestURIHashPolicySources(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+
+	// original_uri: the same client URI rewritten differently by two
+	// mounts must still select the same host
+	origPolicy := URIHashSelection{Source: "original_uri"}
+	if err := origPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	mountA := rewrittenRequest("/shared/object", "/a/object")
+	mountB := rewrittenRequest("/shared/object", "/b/object")
+	hostA := origPolicy.Select(pool, mountA, nil)
+	hostB := origPolicy.Select(pool, mountB, nil)
+	if hostA == nil || hostA != hostB {
+		t.Errorf("Expected identical selection across mounts, got %v and %v", hostA, hostB)
+	}
+	// ...and match an unrewritten request for the same URI
+	plain := httptest.NewRequest(http.MethodGet, "/shared/object", nil)
+	if hostC := origPolicy.Select(pool, plain, nil); hostC != hostA {
+		t.Errorf("Expected rewritten and unrewritten requests to agree, got %v and %v", hostA, hostC)
+	}
+
+	// uri (the default): hashes the rewritten URI, so the two mounts
+	// above map to different keys but identical rewrites agree
+	uriPolicy := URIHashSelection{}
+	if err := uriPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	sameRewriteA := rewrittenRequest("/api/v1/object", "/object")
+	sameRewriteB := rewrittenRequest("/svc/object", "/object")
+	if h1, h2 := uriPolicy.Select(pool, sameRewriteA, nil), uriPolicy.Select(pool, sameRewriteB, nil); h1 != h2 {
+		t.Errorf("Expected identical selection for identical rewritten URIs, got %v and %v", h1, h2)
+	}
+
+	// path_only: the query string must not influence selection
+	pathPolicy := URIHashSelection{Source: "path_only"}
+	if err := pathPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	withQuery := httptest.NewRequest(http.MethodGet, "/object?page=1", nil)
+	otherQuery := httptest.NewRequest(http.MethodGet, "/object?page=2", nil)
+	if h1, h2 := pathPolicy.Select(pool, withQuery, nil), pathPolicy.Select(pool, otherQuery, nil); h1 == nil || h1 != h2 {
+		t.Errorf("Expected path_only to ignore the query string, got %v and %v", h1, h2)
+	}
+
+	// path_and_query: keeps the query but drops nothing else; requests
+	// differing only in query select independently of RequestURI quirks
+	pqPolicy := URIHashSelection{Source: "path_and_query"}
+	if err := pqPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if h := pqPolicy.Select(pool, withQuery, nil); h == nil {
+		t.Error("Expected path_and_query to select a host")
+	}
+
+	badPolicy := URIHashSelection{Source: "query_only"}
+	if err := badPolicy.Provision(ctx); err == nil {
+		t.Error("Expected Provision error for unrecognized source")
+	}
+}
+
+func TestMementoSelectionPolicyURISources(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "original_uri"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := testPool()
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	mountA := rewrittenRequest("/shared/object", "/a/object")
+	mountB := rewrittenRequest("/shared/object", "/b/object")
+	hostA := mementoPolicy.Select(pool, mountA, nil)
+	hostB := mementoPolicy.Select(pool, mountB, nil)
+	if hostA == nil || hostA != hostB {
+		t.Errorf("Expected identical memento selection across mounts, got %v and %v", hostA, hostB)
+	}
+
+	pathPolicy := MementoSelection{Field: "path_only"}
+	if err := pathPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pathPolicy.PopulateInitialTopology(pool)
+
+	withQuery := httptest.NewRequest(http.MethodGet, "/object?page=1", nil)
+	otherQuery := httptest.NewRequest(http.MethodGet, "/object?page=2", nil)
+	h1 := pathPolicy.Select(pool, withQuery, nil)
+	h2 := pathPolicy.Select(pool, otherQuery, nil)
+	if h1 == nil || h1 != h2 {
+		t.Errorf("Expected memento path_only to ignore the query string, got %v and %v", h1, h2)
+	}
+}
+
 func TestLeastRequests(t *testing.T) {
 	pool := testPool()
 	pool[0].Dial = "localhost:8080"
@@ -648,7 +1056,7 @@ func TestLeastRequests(t *testing.T) {
 	pool[1].countRequest(20)
 	pool[2].countRequest(30)
 
-	result := leastRequests(pool)
+	result := leastRequests(pool, false)
 
 	if result == nil {
 		t.Error("Least request should not return nil")
@@ -685,6 +1093,142 @@ func TestRandomChoicePolicy(t *testing.T) {
 	}
 }
 
+// recordingSelector is a test selector that records how many
+// times it was consulted and returns a fixed upstream.
+type recordingSelector struct {
+	calls    int
+	upstream *Upstream
+}
+
+func (r *recordingSelector) Select(_ UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
+	r.calls++
+	return r.upstream
+}
+
+func TestChainPolicyCascadeOrder(t *testing.T) {
+	pool := testPool()
+	first := &recordingSelector{upstream: nil}
+	second := &recordingSelector{upstream: pool[2]}
+	third := &recordingSelector{upstream: pool[0]}
+	chainPolicy := ChainSelection{policies: []Selector{first, second, third}}
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	h := chainPolicy.Select(pool, request, nil)
+	if h != pool[2] {
+		t.Error("Expected chain policy to return the first non-nil selection.")
+	}
+	if first.calls != 1 || second.calls != 1 {
+		t.Error("Expected chain policy to consult policies in order.")
+	}
+	if third.calls != 0 {
+		t.Error("Expected chain policy to stop at the first non-nil selection.")
+	}
+}
+
+func TestChainPolicyCookieChild(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	chainPolicy := ChainSelection{
+		PoliciesRaw: []json.RawMessage{
+			json.RawMessage(`{"policy":"cookie"}`),
+			json.RawMessage(`{"policy":"least_conn"}`),
+		},
+	}
+	if err := chainPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	pool := testPool()
+	pool[0].Dial = "localhost:8080"
+	pool[1].Dial = "localhost:8081"
+	pool[2].Dial = "localhost:8082"
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+
+	h := chainPolicy.Select(pool, request, w)
+	if h == nil {
+		t.Fatal("Expected chain policy to select a host.")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("Expected chained cookie policy to still set a cookie.")
+	}
+	if cookies[0].Name != "lb" {
+		t.Error("Expected chained cookie policy to set a cookie with name lb.")
+	}
+
+	// The cookie should stick the request to the selected host.
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(cookies[0])
+	if h2 := chainPolicy.Select(pool, request, httptest.NewRecorder()); h2 != h {
+		t.Error("Expected chain policy to stick to the host from the cookie.")
+	}
+
+	// An empty chain must not provision.
+	empty := ChainSelection{}
+	if err := empty.Provision(ctx); err == nil {
+		t.Error("Expected provisioning an empty chain to fail.")
+	}
+}
+
+func TestMapPolicy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	mapPolicy := MapSelection{
+		Source: "{http.request.header.X-Traffic-Class}",
+		PoliciesRaw: map[string]json.RawMessage{
+			"sticky":  json.RawMessage(`{"policy":"first"}`),
+			"webhook": json.RawMessage(`{"policy":"round_robin"}`),
+		},
+	}
+	if err := mapPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	pool := testPool()
+
+	newRequest := func(trafficClass string) *http.Request {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		repl := caddy.NewReplacer()
+		request = request.WithContext(context.WithValue(request.Context(), caddy.ReplacerCtxKey, repl))
+		request = caddyhttp.PrepareRequest(request, repl, nil, nil)
+		if trafficClass != "" {
+			request.Header.Set("X-Traffic-Class", trafficClass)
+		}
+		return request
+	}
+
+	// the matched branch dispatches to the mapped policy
+	pool[0].setHealthy(false)
+	if h := mapPolicy.Select(pool, newRequest("sticky"), nil); h != pool[1] {
+		t.Error("Expected map policy to dispatch to the first policy.")
+	}
+	pool[0].setHealthy(true)
+
+	// round_robin advances on each request for the webhook branch
+	h1 := mapPolicy.Select(pool, newRequest("webhook"), nil)
+	h2 := mapPolicy.Select(pool, newRequest("webhook"), nil)
+	if h1 == nil || h2 == nil || h1 == h2 {
+		t.Error("Expected map policy to dispatch webhook traffic to round robin.")
+	}
+
+	// an unmatched value uses the default policy
+	if h := mapPolicy.Select(pool, newRequest("unknown"), nil); h == nil {
+		t.Error("Expected map policy to fall back to the default policy.")
+	}
+	if h := mapPolicy.Select(pool, newRequest(""), nil); h == nil {
+		t.Error("Expected map policy to use the default policy when the source is empty.")
+	}
+
+	// a source placeholder is required
+	missingSource := MapSelection{}
+	if err := missingSource.Provision(ctx); err == nil {
+		t.Error("Expected provisioning a map policy without a source to fail.")
+	}
+}
+
 func TestCookieHashPolicy(t *testing.T) {
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
 	defer cancel()
@@ -851,41 +1395,178 @@ func TestCookieHashPolicyWithFirstFallback(t *testing.T) {
 	}
 }
 
-func TestMementoSelectionPolicy(t *testing.T) {
+func TestHeaderStickyPolicy(t *testing.T) {
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
 	defer cancel()
-
-	mementoPolicy := MementoSelection{Field: "ip"}
-	if err := mementoPolicy.Provision(ctx); err != nil {
+	stickyPolicy := HeaderStickySelection{
+		Secrets:     []string{"secret1"},
+		FallbackRaw: caddyconfig.JSONModuleObject(FirstSelection{}, "policy", "first", nil),
+	}
+	if err := stickyPolicy.Provision(ctx); err != nil {
 		t.Errorf("Provision error: %v", err)
 		t.FailNow()
 	}
 
 	pool := testPool()
-	mementoPolicy.PopulateInitialTopology(pool)
-	req, _ := http.NewRequest("GET", "/", nil)
+	pool[0].Dial = "localhost:8080"
+	pool[1].Dial = "localhost:8081"
+	pool[2].Dial = "localhost:8082"
 
-	// Test IP-based selection
-	req.RemoteAddr = "172.0.0.1:80"
-	h := mementoPolicy.Select(pool, req, nil)
-	if h == nil {
-		t.Error("Expected binomial policy to select a host")
+	// missing token: the fallback policy selects, and the token is
+	// written to the response header for the client to echo back
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	h := stickyPolicy.Select(pool, request, w)
+	if h != pool[0] {
+		t.Error("Expected sticky header policy to select the first host via fallback.")
 	}
-
-	// Test consistency - same IP should map to same host
-	h2 := mementoPolicy.Select(pool, req, nil)
-	if h != h2 {
-		t.Error("Expected consistent mapping for same IP")
+	token := w.Result().Header.Get("X-Session-Affinity")
+	if token == "" {
+		t.Fatal("Expected sticky header policy to write an affinity token.")
 	}
 
-	// Test different IPs
-	req.RemoteAddr = "172.0.0.2:80"
+	// echoed token: the request should stick to the same host
+	// and no new token should be written
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("X-Session-Affinity", token)
+	w = httptest.NewRecorder()
+	h = stickyPolicy.Select(pool, request, w)
+	if h != pool[0] {
+		t.Error("Expected sticky header policy to stick to the first host (matching token).")
+	}
+	if w.Result().Header.Get("X-Session-Affinity") != "" {
+		t.Error("Expected sticky header policy to not write a new token.")
+	}
+
+	// tampered token: must not match any host, so the fallback selects
+	// and a fresh token is written
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("X-Session-Affinity", token[:len(token)-1]+"0")
+	w = httptest.NewRecorder()
+	h = stickyPolicy.Select(pool, request, w)
+	if h != pool[0] {
+		t.Error("Expected sticky header policy to fall back on a tampered token.")
+	}
+	if w.Result().Header.Get("X-Session-Affinity") != token {
+		t.Error("Expected sticky header policy to write a fresh token after a tampered token.")
+	}
+
+	// pinned upstream unavailable: a new host is selected and a new token written
+	pool[0].setHealthy(false)
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("X-Session-Affinity", token)
+	w = httptest.NewRecorder()
+	h = stickyPolicy.Select(pool, request, w)
+	if h != pool[1] {
+		t.Error("Expected sticky header policy to select the next available host.")
+	}
+	newToken := w.Result().Header.Get("X-Session-Affinity")
+	if newToken == "" || newToken == token {
+		t.Error("Expected sticky header policy to write a token for the new host.")
+	}
+	pool[0].setHealthy(true)
+}
+
+func TestHeaderStickyPolicySecretRotation(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	oldPolicy := HeaderStickySelection{Secrets: []string{"old-secret"}}
+	if err := oldPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+	// the rotated policy signs with the new secret but still accepts
+	// tokens signed with the old one
+	newPolicy := HeaderStickySelection{Secrets: []string{"new-secret", "old-secret"}}
+	if err := newPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	pool := testPool()
+	pool[0].Dial = "localhost:8080"
+	pool[1].Dial = "localhost:8081"
+	pool[2].Dial = "localhost:8082"
+
+	oldToken, err := hashCookie("old-secret", pool[1].Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("X-Session-Affinity", oldToken)
+	w := httptest.NewRecorder()
+	h := newPolicy.Select(pool, request, w)
+	if h != pool[1] {
+		t.Error("Expected sticky header policy to accept a token signed with a rotated secret.")
+	}
+}
+
+func TestMementoSelectionPolicy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	pool := testPool()
+	mementoPolicy.PopulateInitialTopology(pool)
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// Test IP-based selection
+	req.RemoteAddr = "172.0.0.1:80"
+	h := mementoPolicy.Select(pool, req, nil)
+	if h == nil {
+		t.Error("Expected binomial policy to select a host")
+	}
+
+	// Test consistency - same IP should map to same host
+	h2 := mementoPolicy.Select(pool, req, nil)
+	if h != h2 {
+		t.Error("Expected consistent mapping for same IP")
+	}
+
+	// Test different IPs
+	req.RemoteAddr = "172.0.0.2:80"
 	h3 := mementoPolicy.Select(pool, req, nil)
 	if h == h3 {
 		t.Log("Different IPs mapped to same host - this can happen with hash collisions")
 	}
 }
 
+func TestMementoSelectionPolicyEngineOption(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, engine := range []string{"", "lockfree", "rwmutex"} {
+		mementoPolicy := MementoSelection{Field: "uri", Engine: engine}
+		if err := mementoPolicy.Provision(ctx); err != nil {
+			t.Errorf("Provision error for engine %q: %v", engine, err)
+			continue
+		}
+
+		pool := testPool()
+		mementoPolicy.PopulateInitialTopology(pool)
+		req, _ := http.NewRequest("GET", "/engine-test", nil)
+
+		h := mementoPolicy.Select(pool, req, nil)
+		if h == nil {
+			t.Errorf("Expected engine %q to select a host", engine)
+			continue
+		}
+		if h2 := mementoPolicy.Select(pool, req, nil); h != h2 {
+			t.Errorf("Expected consistent mapping with engine %q", engine)
+		}
+	}
+
+	badPolicy := MementoSelection{Field: "uri", Engine: "spinlock"}
+	if err := badPolicy.Provision(ctx); err == nil {
+		t.Error("Expected Provision error for unrecognized engine")
+	}
+}
+
 func TestMementoSelectionPolicyURI(t *testing.T) {
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
 	defer cancel()
@@ -1195,6 +1876,104 @@ func TestMementoSelectionPolicyChangeDetection(t *testing.T) {
 	}
 }
 
+func TestMementoSelectionSyncFromPool(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// no events app is wired up anywhere in this test: the topology can
+	// only follow the pool through sync_from_pool
+	mementoPolicy := MementoSelection{Field: "ip", SyncFromPool: true}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := testPool()
+	mementoPolicy.PopulateInitialTopology(pool)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	if h := mementoPolicy.Select(pool, req, nil); h == nil {
+		t.Fatal("Expected a host from the initial pool")
+	}
+
+	// a member flips unavailable: the next selection must notice and
+	// drop it from the topology
+	pool[1].setHealthy(false)
+	if h := mementoPolicy.Select(pool, req, nil); h == pool[1] {
+		t.Error("Selected a host that flipped unavailable")
+	}
+	if mementoPolicy.consistentEngine.HasNode(pool[1]) {
+		t.Error("Expected the unavailable host to leave the topology")
+	}
+
+	pool[1].setHealthy(true)
+	mementoPolicy.Select(pool, req, nil)
+	if !mementoPolicy.consistentEngine.HasNode(pool[1]) {
+		t.Error("Expected the recovered host to rejoin the topology")
+	}
+
+	// a reload grows the pool: the added member must join the topology
+	grown := append(pool, &Upstream{Host: new(Host), Dial: "0.0.0.4"})
+	mementoPolicy.Select(grown, req, nil)
+	if !mementoPolicy.consistentEngine.HasNode(grown[3]) {
+		t.Error("Expected the new pool member to join the topology")
+	}
+}
+
+func TestMementoSelectionSyncInterval(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	interval := 100 * time.Millisecond
+	mementoPolicy := MementoSelection{
+		Field:        "ip",
+		SyncFromPool: true,
+		SyncInterval: caddy.Duration(interval),
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := testPool()
+	mementoPolicy.PopulateInitialTopology(pool)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	// burn the first fingerprint check so the interval gate is armed
+	mementoPolicy.Select(pool, req, nil)
+
+	pool[1].setHealthy(false)
+	mementoPolicy.Select(pool, req, nil)
+	if !mementoPolicy.consistentEngine.HasNode(pool[1]) {
+		t.Error("Expected the topology to stay put before the sync interval elapses")
+	}
+
+	time.Sleep(interval + 50*time.Millisecond)
+	mementoPolicy.Select(pool, req, nil)
+	if mementoPolicy.consistentEngine.HasNode(pool[1]) {
+		t.Error("Expected the topology to follow the pool within one sync interval")
+	}
+	pool[1].setHealthy(true)
+}
+
+func TestMementoSelectionSyncFromPoolCaddyfile(t *testing.T) {
+	mementoPolicy := MementoSelection{}
+	if err := mementoPolicy.UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"memento ip {\n\tsync_from_pool\n\tsync_interval 5s\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if !mementoPolicy.SyncFromPool {
+		t.Error("Expected sync_from_pool to be enabled")
+	}
+	if time.Duration(mementoPolicy.SyncInterval) != 5*time.Second {
+		t.Errorf("Expected a 5s sync_interval, got %v", time.Duration(mementoPolicy.SyncInterval))
+	}
+	if err := mementoPolicy.UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"memento ip {\n\tsync_interval soon\n}")); err == nil {
+		t.Error("Expected an error for an invalid sync_interval")
+	}
+}
+
 func TestMementoSelectionPolicyMultipleTopologyChanges(t *testing.T) {
 	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
 	defer cancel()
@@ -1466,3 +2245,2888 @@ func BenchmarkMementoSelectionPolicyChangeDetectionWithTopologyChanges(b *testin
 		mementoPolicy.Select(pool, req, nil)
 	}
 }
+
+func provisionStickyTable(t *testing.T, ctx caddy.Context, policy *StickyTableSelection, inner Selector) {
+	t.Helper()
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if inner != nil {
+		policy.policy = inner
+	}
+}
+
+func stickyTableRequest(ip string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = ip + ":80"
+	return req
+}
+
+func TestStickyTablePolicy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	policy := StickyTableSelection{}
+	rec := &recordingSelector{upstream: pool[1]}
+	provisionStickyTable(t, ctx, &policy, rec)
+
+	// first request for a key consults the inner policy and records
+	// the result
+	if h := policy.Select(pool, stickyTableRequest("1.2.3.4"), nil); h != pool[1] {
+		t.Errorf("Expected first selection to come from the inner policy, got %v", h)
+	}
+	if rec.calls != 1 {
+		t.Errorf("Expected 1 inner selection, got %d", rec.calls)
+	}
+
+	// subsequent requests for the same key hit the table
+	rec.upstream = pool[2]
+	if h := policy.Select(pool, stickyTableRequest("1.2.3.4"), nil); h != pool[1] {
+		t.Errorf("Expected sticky selection, got %v", h)
+	}
+	if rec.calls != 1 {
+		t.Errorf("Expected table hit, inner policy was called %d times", rec.calls)
+	}
+
+	// a different key selects independently
+	if h := policy.Select(pool, stickyTableRequest("5.6.7.8"), nil); h != pool[2] {
+		t.Errorf("Expected new key to select via inner policy, got %v", h)
+	}
+	if rec.calls != 2 {
+		t.Errorf("Expected 2 inner selections, got %d", rec.calls)
+	}
+
+	// an unavailable recorded upstream forces re-selection
+	pool[1].setHealthy(false)
+	rec.upstream = pool[0]
+	if h := policy.Select(pool, stickyTableRequest("1.2.3.4"), nil); h != pool[0] {
+		t.Errorf("Expected re-selection after upstream became unavailable, got %v", h)
+	}
+	if rec.calls != 3 {
+		t.Errorf("Expected 3 inner selections, got %d", rec.calls)
+	}
+	pool[1].setHealthy(true)
+}
+
+func TestStickyTablePolicyTTLExpiry(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	policy := StickyTableSelection{TTL: caddy.Duration(20 * time.Millisecond)}
+	rec := &recordingSelector{upstream: pool[0]}
+	provisionStickyTable(t, ctx, &policy, rec)
+
+	if h := policy.Select(pool, stickyTableRequest("1.2.3.4"), nil); h != pool[0] {
+		t.Errorf("Expected initial selection, got %v", h)
+	}
+	if h := policy.Select(pool, stickyTableRequest("1.2.3.4"), nil); h != pool[0] || rec.calls != 1 {
+		t.Errorf("Expected table hit before TTL expiry, got %v after %d inner calls", h, rec.calls)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	rec.upstream = pool[2]
+	if h := policy.Select(pool, stickyTableRequest("1.2.3.4"), nil); h != pool[2] {
+		t.Errorf("Expected re-selection after TTL expiry, got %v", h)
+	}
+	if rec.calls != 2 {
+		t.Errorf("Expected 2 inner selections after expiry, got %d", rec.calls)
+	}
+}
+
+func TestStickyTablePolicyEviction(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	policy := StickyTableSelection{MaxEntries: 3}
+	rec := &recordingSelector{upstream: pool[0]}
+	provisionStickyTable(t, ctx, &policy, rec)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		policy.Select(pool, stickyTableRequest(ip), nil)
+	}
+	if len(policy.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(policy.entries))
+	}
+
+	// touch the first key so the second becomes the least recently used,
+	// then insert a fourth key to force an eviction
+	policy.Select(pool, stickyTableRequest("10.0.0.1"), nil)
+	policy.Select(pool, stickyTableRequest("10.0.0.4"), nil)
+
+	if len(policy.entries) != 3 {
+		t.Errorf("Expected table to stay at max_entries, got %d entries", len(policy.entries))
+	}
+	if _, ok := policy.entries["10.0.0.2"]; ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"} {
+		if _, ok := policy.entries[ip]; !ok {
+			t.Errorf("Expected entry for %s to survive eviction", ip)
+		}
+	}
+}
+
+func TestStickyTablePolicyUnhealthyInvalidation(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	pool[0].Dial = "localhost:8080"
+	pool[1].Dial = "localhost:8081"
+	policy := StickyTableSelection{}
+	rec := &recordingSelector{upstream: pool[0]}
+	provisionStickyTable(t, ctx, &policy, rec)
+
+	policy.Select(pool, stickyTableRequest("1.2.3.4"), nil)
+	rec.upstream = pool[1]
+	policy.Select(pool, stickyTableRequest("5.6.7.8"), nil)
+	if len(policy.entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(policy.entries))
+	}
+
+	event, err := caddy.NewEvent(ctx, "unhealthy", map[string]any{"host": pool[0].Dial})
+	if err != nil {
+		t.Fatalf("NewEvent error: %v", err)
+	}
+	if err := policy.Handle(context.Background(), event); err != nil {
+		t.Fatalf("Handle error: %v", err)
+	}
+
+	if _, ok := policy.entries["1.2.3.4"]; ok {
+		t.Error("Expected entries for the unhealthy upstream to be dropped")
+	}
+	if _, ok := policy.entries["5.6.7.8"]; !ok {
+		t.Error("Expected entries for other upstreams to survive")
+	}
+
+	// the dropped key re-selects on its next request
+	rec.upstream = pool[2]
+	if h := policy.Select(pool, stickyTableRequest("1.2.3.4"), nil); h != pool[2] {
+		t.Errorf("Expected dropped key to be re-selected, got %v", h)
+	}
+}
+
+func TestVerboseLoggingOutput(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+	pool := testPool()
+
+	ipPolicy := IPHashSelection{}
+	if err := ipPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	ipPolicy.VerboseLogging = true
+	ipPolicy.logger = logger
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+	h := ipPolicy.Select(pool, req, nil)
+	if h == nil {
+		t.Fatal("Expected ip_hash to select a host")
+	}
+
+	entries := logs.TakeAll()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if entries[0].Message != "selected upstream" {
+		t.Errorf("Unexpected log message %q", entries[0].Message)
+	}
+	if fields["policy"] != "ip_hash" {
+		t.Errorf("Expected policy field 'ip_hash', got %v", fields["policy"])
+	}
+	if fields["upstream"] != h.String() {
+		t.Errorf("Expected upstream field %q, got %v", h.String(), fields["upstream"])
+	}
+	if fields["fallback"] != false {
+		t.Errorf("Expected fallback field false, got %v", fields["fallback"])
+	}
+	// keys are hashed by default so PII doesn't reach the logs
+	if fields["key"] == "172.0.0.1" {
+		t.Error("Expected key to be hashed, got the raw client IP")
+	}
+
+	// plain mode logs the raw key
+	ipPolicy.LogKeyMode = "plain"
+	ipPolicy.Select(pool, req, nil)
+	entries = logs.TakeAll()
+	if len(entries) != 1 || entries[0].ContextMap()["key"] != "172.0.0.1" {
+		t.Errorf("Expected plain key in logs, got %v", entries)
+	}
+
+	// disabled by default: no entries, including when the flag is off
+	quietPolicy := IPHashSelection{}
+	if err := quietPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	quietPolicy.logger = logger
+	quietPolicy.Select(pool, req, nil)
+	if entries := logs.TakeAll(); len(entries) != 0 {
+		t.Errorf("Expected no log entries with verbose_logging off, got %d", len(entries))
+	}
+
+	// a fired fallback is flagged
+	queryPolicy := QueryHashSelection{Key: "token"}
+	if err := queryPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	queryPolicy.VerboseLogging = true
+	queryPolicy.logger = logger
+	queryPolicy.Select(pool, req, nil)
+	entries = logs.TakeAll()
+	if len(entries) != 1 || entries[0].ContextMap()["fallback"] != true {
+		t.Errorf("Expected fallback=true log entry, got %v", entries)
+	}
+
+	// memento includes the bucket index
+	mementoPolicy := MementoSelection{Field: "uri"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	mementoPolicy.VerboseLogging = true
+	mementoPolicy.logger = logger
+	mementoPolicy.PopulateInitialTopology(pool)
+	mementoPolicy.Select(pool, req, nil)
+	entries = logs.TakeAll()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 memento log entry, got %d", len(entries))
+	}
+	fields = entries[0].ContextMap()
+	if fields["policy"] != "memento" {
+		t.Errorf("Expected policy field 'memento', got %v", fields["policy"])
+	}
+	if _, ok := fields["bucket"]; !ok {
+		t.Error("Expected memento log entry to include the bucket index")
+	}
+
+	// invalid log_key_mode is rejected at provision time
+	badPolicy := IPHashSelection{}
+	badPolicy.LogKeyMode = "redacted"
+	if err := badPolicy.Provision(ctx); err == nil {
+		t.Error("Expected Provision error for unrecognized log_key_mode")
+	}
+}
+
+func TestIPHashPolicyMaskBits(t *testing.T) {
+	pool := testPool()
+	ipHash := IPHashSelection{IPv4MaskBits: 24}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// addresses inside the same /24 hash to the same prefix key,
+	// and therefore the same host
+	req.RemoteAddr = "10.1.2.3:80"
+	h := ipHash.Select(pool, req, nil)
+	if h != hostByHashing(pool, "10.1.2.0/24") {
+		t.Error("Expected masked ip hash to use the /24 prefix as key.")
+	}
+	req.RemoteAddr = "10.1.2.200:80"
+	if ipHash.Select(pool, req, nil) != h {
+		t.Error("Expected addresses in the same /24 to select the same host.")
+	}
+
+	// an address outside the prefix uses its own prefix key
+	req.RemoteAddr = "10.1.3.3:80"
+	if ipHash.Select(pool, req, nil) != hostByHashing(pool, "10.1.3.0/24") {
+		t.Error("Expected addresses outside the /24 to use their own prefix key.")
+	}
+
+	// IPv6 addresses are masked with the IPv6 bits
+	ipHash = IPHashSelection{IPv6MaskBits: 64}
+	req.RemoteAddr = "[2001:db8:1:1::1]:80"
+	h = ipHash.Select(pool, req, nil)
+	if h != hostByHashing(pool, "2001:db8:1:1::/64") {
+		t.Error("Expected masked ip hash to use the /64 prefix as key.")
+	}
+	req.RemoteAddr = "[2001:db8:1:1:ffff::2]:80"
+	if ipHash.Select(pool, req, nil) != h {
+		t.Error("Expected addresses in the same /64 to select the same host.")
+	}
+	req.RemoteAddr = "[2001:db8:1:2::1]:80"
+	if ipHash.Select(pool, req, nil) != hostByHashing(pool, "2001:db8:1:2::/64") {
+		t.Error("Expected addresses outside the /64 to use their own prefix key.")
+	}
+
+	// unparseable addresses fall back to the raw string
+	ipHash = IPHashSelection{IPv4MaskBits: 24, IPv6MaskBits: 64}
+	req.RemoteAddr = "not-an-ip"
+	if ipHash.Select(pool, req, nil) != hostByHashing(pool, "not-an-ip") {
+		t.Error("Expected malformed RemoteAddr to hash as the raw string.")
+	}
+
+	// out-of-range mask bits are rejected at provision time
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	bad := IPHashSelection{IPv4MaskBits: 40}
+	if err := bad.Provision(ctx); err == nil {
+		t.Error("Expected Provision error for ipv4_mask_bits out of range")
+	}
+	bad = IPHashSelection{IPv6MaskBits: 200}
+	if err := bad.Provision(ctx); err == nil {
+		t.Error("Expected Provision error for ipv6_mask_bits out of range")
+	}
+}
+
+func TestClientIPHashPolicyMaskBits(t *testing.T) {
+	pool := testPool()
+	ipHash := ClientIPHashSelection{IPv4MaskBits: 16}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]any)))
+
+	caddyhttp.SetVar(req.Context(), caddyhttp.ClientIPVarKey, "172.16.1.1:80")
+	h := ipHash.Select(pool, req, nil)
+	if h != hostByHashing(pool, "172.16.0.0/16") {
+		t.Error("Expected masked client ip hash to use the /16 prefix as key.")
+	}
+	caddyhttp.SetVar(req.Context(), caddyhttp.ClientIPVarKey, "172.16.200.9:80")
+	if ipHash.Select(pool, req, nil) != h {
+		t.Error("Expected client IPs in the same /16 to select the same host.")
+	}
+	caddyhttp.SetVar(req.Context(), caddyhttp.ClientIPVarKey, "172.17.1.1:80")
+	if ipHash.Select(pool, req, nil) != hostByHashing(pool, "172.17.0.0/16") {
+		t.Error("Expected client IPs outside the /16 to use their own prefix key.")
+	}
+}
+
+func TestMementoSelectionPolicyMaskBits(t *testing.T) {
+	pool := createMementoPool(3)
+
+	mementoPolicy := MementoSelection{Field: "ip", IPv4MaskBits: 24}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:80"
+	h := mementoPolicy.Select(pool, req, nil)
+	if h == nil {
+		t.Fatal("Expected memento policy to select a host")
+	}
+	req.RemoteAddr = "10.1.2.77:80"
+	if mementoPolicy.Select(pool, req, nil) != h {
+		t.Error("Expected memento to map addresses in the same /24 to the same host.")
+	}
+}
+
+func TestCookieHashPolicyStickyOnFailure(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	newPool := func() UpstreamPool {
+		pool := testPool()
+		pool[0].Dial = "localhost:8080"
+		pool[1].Dial = "localhost:8081"
+		pool[2].Dial = "localhost:8082"
+		for _, host := range pool {
+			host.setHealthy(true)
+		}
+		return pool
+	}
+
+	pinCookie := func(t *testing.T, policy CookieHashSelection, pool UpstreamPool) *http.Cookie {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, "/test", nil)
+		w := httptest.NewRecorder()
+		h := policy.Select(pool, request, w)
+		if h != pool[0] {
+			t.Fatalf("Expected initial selection to pin the first host, got %s", h)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) == 0 {
+			t.Fatal("Expected a cookie to be set on initial selection")
+		}
+		return cookies[0]
+	}
+
+	t.Run("temporary keeps the cookie during an outage", func(t *testing.T) {
+		policy := CookieHashSelection{
+			StickyOnFailure: "temporary",
+			FallbackRaw:     caddyconfig.JSONModuleObject(FirstSelection{}, "policy", "first", nil),
+		}
+		if err := policy.Provision(ctx); err != nil {
+			t.Errorf("Provision error: %v", err)
+			t.FailNow()
+		}
+		pool := newPool()
+		cookie := pinCookie(t, policy, pool)
+
+		// pinned host goes down: another host serves the request, but
+		// the cookie is left alone
+		pool[0].setHealthy(false)
+		request := httptest.NewRequest(http.MethodGet, "/test", nil)
+		request.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h := policy.Select(pool, request, w)
+		if h != pool[1] {
+			t.Errorf("Expected fallback host during outage, got %s", h)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("Expected temporary mode to not rewrite the cookie during the outage")
+		}
+
+		// pinned host recovers: the original cookie routes home again
+		pool[0].setHealthy(true)
+		request = httptest.NewRequest(http.MethodGet, "/test", nil)
+		request.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		if h := policy.Select(pool, request, w); h != pool[0] {
+			t.Errorf("Expected client to return to its home upstream after recovery, got %s", h)
+		}
+
+		// a cookie matching no upstream at all is still re-pinned
+		request = httptest.NewRequest(http.MethodGet, "/test", nil)
+		request.AddCookie(&http.Cookie{Name: "lb", Value: "bogus"})
+		w = httptest.NewRecorder()
+		if h := policy.Select(pool, request, w); h == nil {
+			t.Error("Expected a host for an unrecognized cookie")
+		}
+		if len(w.Result().Cookies()) == 0 {
+			t.Error("Expected an unrecognized cookie to be replaced")
+		}
+	})
+
+	t.Run("rehome rewrites the cookie during an outage", func(t *testing.T) {
+		policy := CookieHashSelection{
+			FallbackRaw: caddyconfig.JSONModuleObject(FirstSelection{}, "policy", "first", nil),
+		}
+		if err := policy.Provision(ctx); err != nil {
+			t.Errorf("Provision error: %v", err)
+			t.FailNow()
+		}
+		pool := newPool()
+		cookie := pinCookie(t, policy, pool)
+
+		pool[0].setHealthy(false)
+		request := httptest.NewRequest(http.MethodGet, "/test", nil)
+		request.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		h := policy.Select(pool, request, w)
+		if h != pool[1] {
+			t.Errorf("Expected fallback host during outage, got %s", h)
+		}
+		newCookies := w.Result().Cookies()
+		if len(newCookies) == 0 {
+			t.Fatal("Expected rehome mode to set a new cookie during the outage")
+		}
+
+		// after recovery the rewritten cookie keeps the client on the
+		// new host; the original pin is gone
+		pool[0].setHealthy(true)
+		request = httptest.NewRequest(http.MethodGet, "/test", nil)
+		request.AddCookie(newCookies[0])
+		w = httptest.NewRecorder()
+		if h := policy.Select(pool, request, w); h != pool[1] {
+			t.Errorf("Expected client to stay on the new host after recovery, got %s", h)
+		}
+	})
+
+	// invalid mode is rejected at provision time
+	bad := CookieHashSelection{StickyOnFailure: "retry"}
+	if err := bad.Provision(ctx); err == nil {
+		t.Error("Expected Provision error for unrecognized sticky_on_failure mode")
+	}
+}
+
+func TestUpstreamHashKeyStability(t *testing.T) {
+	newPool := func(ports []string) UpstreamPool {
+		pool := UpstreamPool{
+			{Host: new(Host), Dial: "10.0.1.1:" + ports[0], HashKey: "app-1"},
+			{Host: new(Host), Dial: "10.0.1.2:" + ports[1], HashKey: "app-2"},
+			{Host: new(Host), Dial: "10.0.1.3:" + ports[2], HashKey: "app-3"},
+		}
+		for _, host := range pool {
+			host.setHealthy(true)
+		}
+		return pool
+	}
+
+	indexOf := func(pool UpstreamPool, upstream *Upstream) int {
+		for i, host := range pool {
+			if host == upstream {
+				return i
+			}
+		}
+		return -1
+	}
+
+	pool := newPool([]string{"8080", "8080", "8080"})
+	before := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		before[key] = indexOf(pool, hostByHashing(pool, key))
+	}
+
+	// renumber every upstream: same hash keys, new ports, zero movement
+	renumbered := newPool([]string{"9090", "9091", "9092"})
+	for key, index := range before {
+		if indexOf(renumbered, hostByHashing(renumbered, key)) != index {
+			t.Fatalf("Expected key %s to stay on upstream %d after renumbering", key, index)
+		}
+	}
+
+	// without hash keys, renumbering is expected to move at least one key
+	for _, host := range renumbered {
+		host.HashKey = ""
+	}
+	moved := 0
+	for key, index := range before {
+		if indexOf(renumbered, hostByHashing(renumbered, key)) != index {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Error("Expected keys to move when hashing by dial address across a renumbering")
+	}
+}
+
+func TestCookieHashPolicyHashKeySurvivesRenumbering(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	cookieHashPolicy := CookieHashSelection{}
+	if err := cookieHashPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	pool := testPool()
+	pool[0].Dial = "localhost:8080"
+	pool[1].Dial = "localhost:8081"
+	pool[2].Dial = "localhost:8082"
+	for i, host := range pool {
+		host.HashKey = fmt.Sprintf("backend-%d", i)
+		host.setHealthy(true)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	h := cookieHashPolicy.Select(pool, request, w)
+	if h == nil {
+		t.Fatal("Expected a host to be selected")
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// renumber the pinned upstream's port; the cookie must still match
+	h.Dial = "localhost:9999"
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	if got := cookieHashPolicy.Select(pool, request, w); got != h {
+		t.Error("Expected the cookie to stick to the renumbered upstream.")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Expected no cookie rewrite after renumbering.")
+	}
+}
+
+func TestMementoSelectionPolicyHashKeyEventLookup(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	mementoPolicy := MementoSelection{Field: "uri"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+		t.FailNow()
+	}
+
+	pool := createMementoPool(3)
+	for i, host := range pool {
+		host.HashKey = fmt.Sprintf("node-%d", i)
+	}
+	mementoPolicy.PopulateInitialTopology(pool)
+	if mementoPolicy.consistentEngine.Size() != 3 {
+		t.Fatalf("Expected 3 nodes, got %d", mementoPolicy.consistentEngine.Size())
+	}
+
+	// health events still identify upstreams by dial address
+	event := caddy.Event{Data: map[string]any{"host": pool[1].Dial}}
+	if err := mementoPolicy.handleUnhealthyEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleUnhealthyEvent error: %v", err)
+	}
+	if mementoPolicy.consistentEngine.Size() != 2 {
+		t.Errorf("Expected dial-addressed event to remove the node, size is %d", mementoPolicy.consistentEngine.Size())
+	}
+}
+
+func TestUpstreamHashKeyUniqueness(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	handler := &Handler{
+		Upstreams: UpstreamPool{
+			{Dial: "localhost:8080", HashKey: "app-1"},
+			{Dial: "localhost:8081", HashKey: "app-1"},
+		},
+	}
+	err := handler.Provision(ctx)
+	if err == nil {
+		t.Fatal("Expected Provision error for duplicate hash_key")
+	}
+	if !strings.Contains(err.Error(), "hash_key") {
+		t.Errorf("Expected duplicate hash_key error, got: %v", err)
+	}
+}
+
+func TestRoundRobinPolicySelectExcluding(t *testing.T) {
+	pool := testPool()
+	rrPolicy := RoundRobinSelection{}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	tried := map[*Upstream]struct{}{pool[1]: {}}
+	for i := 0; i < 6; i++ {
+		h := rrPolicy.SelectExcluding(pool, req, nil, tried)
+		if h == nil {
+			t.Fatal("Expected round robin to select a host on retry")
+		}
+		if h == pool[1] {
+			t.Error("Expected round robin retry to skip the tried host")
+		}
+	}
+}
+
+func TestLeastConnPolicySelectExcluding(t *testing.T) {
+	pool := testPool()
+	lcPolicy := LeastConnSelection{}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// pool[0] has the fewest connections, but it already failed once
+	pool[1].countRequest(1)
+	pool[2].countRequest(2)
+	tried := map[*Upstream]struct{}{pool[0]: {}}
+	h := lcPolicy.SelectExcluding(pool, req, nil, tried)
+	if h != pool[1] {
+		t.Errorf("Expected retry to go to the least-loaded untried host, got %v", h)
+	}
+
+	// weights stay aligned with pool positions even when hosts are skipped
+	weighted := LeastConnSelection{Weights: []int{1, 0, 1}}
+	h = weighted.SelectExcluding(pool, req, nil, tried)
+	if h != pool[2] {
+		t.Errorf("Expected zero-weight host to stay excluded on retry, got %v", h)
+	}
+}
+
+func TestIPHashPolicySelectExcluding(t *testing.T) {
+	pool := testPool()
+	ipHash := IPHashSelection{}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	first := ipHash.Select(pool, req, nil)
+	if first == nil {
+		t.Fatal("Expected ip_hash to select a host")
+	}
+	tried := map[*Upstream]struct{}{first: {}}
+	second := ipHash.SelectExcluding(pool, req, nil, tried)
+	if second == nil {
+		t.Fatal("Expected ip_hash to select a different host on retry")
+	}
+	if second == first {
+		t.Error("Expected retry to go to a host other than the tried one")
+	}
+	if again := ipHash.SelectExcluding(pool, req, nil, tried); again != second {
+		t.Error("Expected the retry target to be deterministic for the same key")
+	}
+
+	// with two hosts tried, only one candidate remains
+	tried[second] = struct{}{}
+	third := ipHash.SelectExcluding(pool, req, nil, tried)
+	if third == nil || third == first || third == second {
+		t.Errorf("Expected the last untried host, got %v", third)
+	}
+
+	// once every host has been tried, any host beats none
+	tried[third] = struct{}{}
+	if last := ipHash.SelectExcluding(pool, req, nil, tried); last == nil {
+		t.Error("Expected a host even when all have been tried")
+	}
+}
+
+func TestMementoSelectionPolicySelectExcluding(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := testPool()
+	mementoPolicy.PopulateInitialTopology(pool)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	first := mementoPolicy.Select(pool, req, nil)
+	if first == nil {
+		t.Fatal("Expected memento to select a host")
+	}
+	tried := map[*Upstream]struct{}{first: {}}
+	second := mementoPolicy.SelectExcluding(pool, req, nil, tried)
+	if second == nil {
+		t.Fatal("Expected memento to select a different host on retry")
+	}
+	if second == first {
+		t.Error("Expected retry to go to a host other than the tried one")
+	}
+	if again := mementoPolicy.SelectExcluding(pool, req, nil, tried); again != second {
+		t.Error("Expected the retry target to be deterministic for the same key")
+	}
+
+	tried[second] = struct{}{}
+	third := mementoPolicy.SelectExcluding(pool, req, nil, tried)
+	if third == nil || third == first || third == second {
+		t.Errorf("Expected the last untried host, got %v", third)
+	}
+}
+
+func TestWeightedMementoSelectionUnmarshalCaddyfile(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		caddyfile   string
+		wantErr     bool
+		wantWeights []int
+		wantField   string
+	}{
+		{
+			name:        "weights only",
+			caddyfile:   "weighted_memento 10 2 8",
+			wantWeights: []int{10, 2, 8},
+		},
+		{
+			name:        "weights and block",
+			caddyfile:   "weighted_memento 10 2 8 {\n\tfield ip\n}",
+			wantWeights: []int{10, 2, 8},
+			wantField:   "ip",
+		},
+		{
+			name:        "block only",
+			caddyfile:   "weighted_memento {\n\tfield uri\n}",
+			wantWeights: []int{},
+			wantField:   "uri",
+		},
+		{
+			name:      "invalid weight in the middle",
+			caddyfile: "weighted_memento 10 x 8",
+			wantErr:   true,
+		},
+		{
+			name:      "zero weight",
+			caddyfile: "weighted_memento 10 0 8",
+			wantErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sel WeightedMementoSelection
+			err := sel.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tc.caddyfile))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalCaddyfile error: %v", err)
+			}
+			if len(sel.Weights) != len(tc.wantWeights) {
+				t.Fatalf("Expected weights %v, got %v", tc.wantWeights, sel.Weights)
+			}
+			for i, w := range tc.wantWeights {
+				if sel.Weights[i] != w {
+					t.Fatalf("Expected weights %v, got %v", tc.wantWeights, sel.Weights)
+				}
+			}
+			if sel.Field != tc.wantField {
+				t.Errorf("Expected field '%s', got '%s'", tc.wantField, sel.Field)
+			}
+		})
+	}
+}
+
+func TestRendezvousSelectionPolicy(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	rendezvous := RendezvousSelection{Field: "ip"}
+	if err := rendezvous.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	h := rendezvous.Select(pool, req, nil)
+	if h == nil {
+		t.Fatal("Expected rendezvous policy to select a host")
+	}
+	if h2 := rendezvous.Select(pool, req, nil); h2 != h {
+		t.Error("Expected consistent mapping for same IP")
+	}
+
+	// an unavailable winner must fall to the next-highest score
+	h.setHealthy(false)
+	h3 := rendezvous.Select(pool, req, nil)
+	if h3 == nil || h3 == h {
+		t.Error("Expected an available host when the winner is down")
+	}
+	h.setHealthy(true)
+
+	// a missing header defers to the fallback policy
+	headerPolicy := RendezvousSelection{Field: "header", HeaderField: "X-Affinity"}
+	if err := headerPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if headerPolicy.Select(pool, req, nil) == nil {
+		t.Error("Expected the fallback policy to select a host when the header is absent")
+	}
+}
+
+func TestRendezvousSelectionPolicyDistribution(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	numKeys := 3000
+
+	cv := func(replicas int) float64 {
+		rendezvous := RendezvousSelection{Field: "ip", Replicas: replicas}
+		if err := rendezvous.Provision(ctx); err != nil {
+			t.Fatalf("Provision error: %v", err)
+		}
+		counts := make(map[*Upstream]int)
+		for i := 0; i < numKeys; i++ {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:80", i%256, (i/256)%256, i%251)
+			h := rendezvous.Select(pool, req, nil)
+			if h == nil {
+				t.Fatal("Expected a host for every key")
+			}
+			counts[h]++
+		}
+		if len(counts) != len(pool) {
+			t.Fatalf("Expected all %d hosts to receive keys with %d replicas, got %d", len(pool), replicas, len(counts))
+		}
+		mean := float64(numKeys) / float64(len(pool))
+		var variance float64
+		for _, c := range counts {
+			diff := float64(c) - mean
+			variance += diff * diff
+		}
+		variance /= float64(len(pool))
+		return math.Sqrt(variance) / mean
+	}
+
+	cv1 := cv(1)
+	cv16 := cv(16)
+	t.Logf("coefficient of variation: replicas=1 %.4f, replicas=16 %.4f", cv1, cv16)
+
+	// replicas must not make the spread worse, and the replicated
+	// distribution must be well balanced in absolute terms
+	if cv16 > cv1*1.25+0.05 {
+		t.Errorf("Expected CV with 16 replicas (%.4f) to be no worse than with 1 (%.4f)", cv16, cv1)
+	}
+	if cv16 > 0.15 {
+		t.Errorf("Expected a balanced distribution with 16 replicas, CV is %.4f", cv16)
+	}
+}
+
+func TestRendezvousSelectionPolicyConsistency(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	rendezvous := RendezvousSelection{Field: "ip", Replicas: 8}
+	if err := rendezvous.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := testPool()
+	numKeys := 500
+	mapping := make(map[string]*Upstream)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("10.1.%d.%d:80", i/250, i%250)
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key
+		mapping[key] = rendezvous.Select(pool, req, nil)
+	}
+
+	// removing one node may only move the keys that node owned
+	removed := pool[1]
+	removed.setHealthy(false)
+	for key, before := range mapping {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key
+		after := rendezvous.Select(pool, req, nil)
+		if after == nil {
+			t.Fatalf("Key %s: expected a host after removal", key)
+		}
+		if before != removed && after != before {
+			t.Errorf("Key %s: moved from %s to %s although its host was not removed",
+				key, before.Dial, after.Dial)
+		}
+		if before == removed && after == removed {
+			t.Errorf("Key %s: still mapped to the removed host", key)
+		}
+	}
+
+	// restoring the node must bring every key home
+	removed.setHealthy(true)
+	for key, before := range mapping {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = key
+		if after := rendezvous.Select(pool, req, nil); after != before {
+			t.Errorf("Key %s: did not restore to its original host", key)
+		}
+	}
+}
+
+func TestHashInputModes(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+
+	provisionHeader := func(policy HeaderHashSelection) HeaderHashSelection {
+		if err := policy.Provision(ctx); err != nil {
+			t.Fatalf("Provision error: %v", err)
+		}
+		return policy
+	}
+	selectFor := func(policy HeaderHashSelection, val string) *Upstream {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("X-User", val)
+		return policy.Select(pool, request, nil)
+	}
+
+	// "raw" must stay byte-for-byte compatible with the default behavior
+	plain := provisionHeader(HeaderHashSelection{Field: "X-User"})
+	raw := provisionHeader(HeaderHashSelection{Field: "X-User", HashInput: "raw"})
+	for i := 0; i < 50; i++ {
+		val := fmt.Sprintf("user%d@example.com", i)
+		if selectFor(plain, val) != selectFor(raw, val) {
+			t.Errorf("Value %s: 'raw' diverged from the default mapping", val)
+		}
+	}
+
+	// digested inputs still give identical selection for identical input
+	hashed := provisionHeader(HeaderHashSelection{Field: "X-User", HashInput: "sha256"})
+	for i := 0; i < 50; i++ {
+		val := fmt.Sprintf("user%d@example.com", i)
+		if selectFor(hashed, val) != selectFor(hashed, val) {
+			t.Errorf("Value %s: sha256 hash input is not deterministic", val)
+		}
+	}
+
+	// the same hmac secret yields the same mapping across instances,
+	// while different secrets scramble it
+	macA := provisionHeader(HeaderHashSelection{Field: "X-User", HashInput: "hmac", HashSecret: "secret-a"})
+	macA2 := provisionHeader(HeaderHashSelection{Field: "X-User", HashInput: "hmac", HashSecret: "secret-a"})
+	macB := provisionHeader(HeaderHashSelection{Field: "X-User", HashInput: "hmac", HashSecret: "secret-b"})
+	differs := false
+	for i := 0; i < 100; i++ {
+		val := fmt.Sprintf("user%d@example.com", i)
+		if selectFor(macA, val) != selectFor(macA2, val) {
+			t.Errorf("Value %s: hmac mapping not stable for the same secret", val)
+		}
+		if selectFor(macA, val) != selectFor(macB, val) {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Error("Expected different hmac secrets to produce a different mapping")
+	}
+
+	// the query policy honors the same transform
+	queryPolicy := QueryHashSelection{Key: "u", HashInput: "sha256"}
+	if err := queryPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/?u=someone@example.com", nil)
+	first := queryPolicy.Select(pool, request, nil)
+	for i := 0; i < 10; i++ {
+		if got := queryPolicy.Select(pool, request, nil); got != first {
+			t.Error("Expected sha256 query hashing to be deterministic")
+		}
+	}
+
+	// hmac without a secret and unknown modes are rejected
+	missingSecret := HeaderHashSelection{Field: "X-User", HashInput: "hmac"}
+	if err := missingSecret.Provision(ctx); err == nil {
+		t.Error("Expected an error when hmac is chosen without a secret")
+	}
+	unknown := QueryHashSelection{Key: "u", HashInput: "md5"}
+	if err := unknown.Provision(ctx); err == nil {
+		t.Error("Expected an error for an unrecognized hash_input mode")
+	}
+}
+
+func TestCanonicalDialKey(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"10.0.0.1:80", "10.0.0.1:80"},
+		{"tcp/10.0.0.1:80", "10.0.0.1:80"},
+		{"localhost:8080", "localhost:8080"},
+		{"example.com", "example.com"},
+		{"example.com:80", "example.com:80"},
+		{"tcp/example.com:80", "example.com:80"},
+		{"unix//run/app.sock", "unix//run/app.sock"},
+		{"[fe80::1%eth0]:80", "[fe80::1%eth0]:80"},
+		// a dial address with placeholders cannot be parsed yet and
+		// must pass through unchanged
+		{"localhost:{http.vars.port}", "localhost:{http.vars.port}"},
+	} {
+		if got := canonicalDialKey(tc.in); got != tc.want {
+			t.Errorf("canonicalDialKey(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRoundRobinPolicyRandomStart(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// with enough independently seeded instances, they cannot all
+	// start at the same upstream
+	firstPicks := make(map[*Upstream]int)
+	for i := 0; i < 16; i++ {
+		rrPolicy := RoundRobinSelection{RandomStart: true}
+		if err := rrPolicy.Provision(ctx); err != nil {
+			t.Fatalf("Provision failed: %v", err)
+		}
+		firstPicks[rrPolicy.Select(pool, req, nil)]++
+	}
+	if len(firstPicks) < 2 {
+		t.Error("Expected randomly started instances to begin at different upstreams.")
+	}
+
+	// regardless of the starting offset, a full cycle still visits
+	// every upstream exactly once
+	rrPolicy := RoundRobinSelection{RandomStart: true}
+	if err := rrPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	counts := make(map[*Upstream]int)
+	for i := 0; i < len(pool); i++ {
+		counts[rrPolicy.Select(pool, req, nil)]++
+	}
+	for _, upstream := range pool {
+		if counts[upstream] != 1 {
+			t.Errorf("Expected each upstream to be selected once per cycle, got %v selections for %s.", counts[upstream], upstream.Dial)
+		}
+	}
+}
+
+func TestRoundRobinPolicyStep(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// a step coprime with the pool size covers every upstream once
+	// per cycle, just in a different order
+	rrPolicy := RoundRobinSelection{Step: 2}
+	if err := rrPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+	counts := make(map[*Upstream]int)
+	for i := 0; i < len(pool); i++ {
+		counts[rrPolicy.Select(pool, req, nil)]++
+	}
+	for _, upstream := range pool {
+		if counts[upstream] != 1 {
+			t.Errorf("Expected each upstream to be selected once per cycle, got %v selections for %s.", counts[upstream], upstream.Dial)
+		}
+	}
+
+	// an unavailable upstream on the stride is skipped in favor of an
+	// adjacent one
+	pool[0].setHealthy(false)
+	for i := 0; i < 2*len(pool); i++ {
+		if h := rrPolicy.Select(pool, req, nil); h == pool[0] {
+			t.Error("Expected down host to be skipped.")
+		}
+	}
+	pool[0].setHealthy(true)
+}
+
+func TestSelectionVarsReachUpstreamHeaders(t *testing.T) {
+	var gotPolicy, gotKey, gotUpstream string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPolicy = r.Header.Get("X-Selection-Policy")
+		gotKey = r.Header.Get("X-Selection-Key")
+		gotUpstream = r.Header.Get("X-Selection-Upstream")
+	}))
+	defer backend.Close()
+	dial := strings.TrimPrefix(backend.URL, "http://")
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{
+		Upstreams: UpstreamPool{{Dial: dial}},
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(HeaderHashSelection{Field: "X-Affinity"}, "policy", "header", nil),
+		},
+		Headers: &headers.Handler{
+			Request: &headers.HeaderOps{
+				Set: http.Header{
+					"X-Selection-Policy":   {"{http.vars.reverse_proxy.selection.policy}"},
+					"X-Selection-Key":      {"{http.vars.reverse_proxy.selection.key}"},
+					"X-Selection-Upstream": {"{http.vars.reverse_proxy.selection.upstream}"},
+				},
+			},
+		},
+	}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision handler: %v", err)
+	}
+	defer h.Cleanup()
+
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Affinity", "tenant-42")
+	req = caddyhttp.PrepareRequest(req, caddy.NewReplacer(), nil, nil)
+	rec := httptest.NewRecorder()
+	noopNext := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	if err := h.ServeHTTP(rec, req, noopNext); err != nil {
+		t.Fatalf("ServeHTTP failed: %v", err)
+	}
+
+	if gotPolicy != "header" {
+		t.Errorf("Expected selection.policy placeholder to resolve to 'header', got '%s'.", gotPolicy)
+	}
+	if gotKey != "tenant-42" {
+		t.Errorf("Expected selection.key placeholder to resolve to 'tenant-42', got '%s'.", gotKey)
+	}
+	if gotUpstream != dial {
+		t.Errorf("Expected selection.upstream placeholder to resolve to '%s', got '%s'.", dial, gotUpstream)
+	}
+}
+
+func TestSlowStartShare(t *testing.T) {
+	pool := testPool()
+
+	// with slow start disabled, a recovery does not reduce the share
+	pool[0].Host.markHealthySince(time.Now())
+	if share := pool[0].slowStartShare(); share != 1 {
+		t.Errorf("Expected full share with slow start disabled, got %f", share)
+	}
+
+	for _, upstream := range pool {
+		upstream.slowStartWindow = time.Hour
+	}
+
+	// a host that was never unhealthy keeps its full share
+	if share := pool[1].slowStartShare(); share != 1 {
+		t.Errorf("Expected full share for never-unhealthy host, got %f", share)
+	}
+
+	// halfway through the window the share is about half
+	pool[0].Host.markHealthySince(time.Now().Add(-30 * time.Minute))
+	if share := pool[0].slowStartShare(); share < 0.45 || share > 0.55 {
+		t.Errorf("Expected roughly half share midway through the window, got %f", share)
+	}
+
+	// once the window has elapsed the ramp is over
+	pool[0].Host.markHealthySince(time.Now().Add(-2 * time.Hour))
+	if share := pool[0].slowStartShare(); share != 1 {
+		t.Errorf("Expected full share after the window elapsed, got %f", share)
+	}
+}
+
+func TestRoundRobinSlowStartRamp(t *testing.T) {
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, upstream := range pool {
+		upstream.slowStartWindow = time.Hour
+	}
+	warming := pool[0]
+
+	// the warming host's share of its fair third ramps roughly
+	// linearly with its progress through the window
+	for _, point := range []float64{0.25, 0.5, 0.75} {
+		elapsed := time.Duration(point * float64(time.Hour))
+		warming.Host.markHealthySince(time.Now().Add(-elapsed))
+		rrPolicy := RoundRobinSelection{}
+		counts := make(map[*Upstream]int)
+		const rounds = 2000
+		for i := 0; i < 3*rounds; i++ {
+			counts[rrPolicy.Select(pool, req, nil)]++
+		}
+		got := float64(counts[warming]) / float64(rounds)
+		if got < point-0.12 || got > point+0.12 {
+			t.Errorf("At %.0f%% of the window, expected the warming host to get ~%.2f of its fair share, got %.2f",
+				point*100, point, got)
+		}
+	}
+
+	// after the window, rotation is exact again
+	warming.Host.markHealthySince(time.Now().Add(-2 * time.Hour))
+	rrPolicy := RoundRobinSelection{}
+	counts := make(map[*Upstream]int)
+	for i := 0; i < 3; i++ {
+		counts[rrPolicy.Select(pool, req, nil)]++
+	}
+	if counts[warming] != 1 {
+		t.Errorf("Expected exact rotation after the window, warming host got %d of 3", counts[warming])
+	}
+}
+
+func TestLeastConnSlowStart(t *testing.T) {
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, upstream := range pool {
+		upstream.slowStartWindow = time.Hour
+	}
+	lcPolicy := LeastConnSelection{}
+
+	// early in its ramp an idle warming host looks busier than idle
+	// peers and must not win
+	pool[1].Host.markHealthySince(time.Now().Add(-time.Minute))
+	for i := 0; i < 50; i++ {
+		if h := lcPolicy.Select(pool, req, nil); h == pool[1] {
+			t.Fatal("Expected the warming host to lose to idle peers early in the ramp.")
+		}
+	}
+
+	// deep into the ramp, an idle warming host beats much busier peers
+	pool[1].Host.markHealthySince(time.Now().Add(-59 * time.Minute))
+	if err := pool[0].countRequest(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool[2].countRequest(10); err != nil {
+		t.Fatal(err)
+	}
+	if h := lcPolicy.Select(pool, req, nil); h != pool[1] {
+		t.Error("Expected the nearly warmed-up idle host to beat busy peers.")
+	}
+}
+
+func TestCookieHashPolicySalt(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+	siteA := CookieHashSelection{Salt: "site-a.example"}
+	if err := siteA.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	siteB := CookieHashSelection{Salt: "site-b.example"}
+	if err := siteB.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	// issue a cookie from site A
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	h := siteA.Select(pool, request, w)
+	if h == nil {
+		t.Fatal("Expected site A to select a host.")
+	}
+	cookieA := w.Result().Cookies()[0]
+
+	// the same upstream produces a different cookie value on site B
+	shaB, err := saltedCookieHash("", "site-b.example", h.hashKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shaB == cookieA.Value {
+		t.Error("Expected differently salted policies to produce different cookie values.")
+	}
+
+	// site A's cookie is not a valid token on site B: the client is
+	// re-pinned and the cookie overwritten
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(cookieA)
+	w = httptest.NewRecorder()
+	siteB.Select(pool, request, w)
+	rePinned := w.Result().Cookies()
+	if len(rePinned) != 1 {
+		t.Fatal("Expected site B to re-pin a client presenting site A's cookie.")
+	}
+	if rePinned[0].Value == cookieA.Value {
+		t.Error("Expected site B to overwrite the foreign cookie with its own value.")
+	}
+
+	// on site A the cookie still validates and sticks without a rewrite
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(cookieA)
+	w = httptest.NewRecorder()
+	if got := siteA.Select(pool, request, w); got != h {
+		t.Error("Expected site A to keep honoring its own cookie.")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Expected no cookie rewrite for a valid sticky cookie.")
+	}
+}
+
+func TestCookieHashPolicyDefaultSaltIsHost(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+	cookieHashPolicy := CookieHashSelection{}
+	if err := cookieHashPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	// issue a cookie on one host
+	request := httptest.NewRequest(http.MethodGet, "http://site-a.example/test", nil)
+	w := httptest.NewRecorder()
+	h := cookieHashPolicy.Select(pool, request, w)
+	if h == nil {
+		t.Fatal("Expected a host to be selected.")
+	}
+	cookie := w.Result().Cookies()[0]
+
+	// the same cookie presented under another host is re-pinned
+	request = httptest.NewRequest(http.MethodGet, "http://site-b.example/test", nil)
+	request.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	cookieHashPolicy.Select(pool, request, w)
+	if len(w.Result().Cookies()) != 1 {
+		t.Error("Expected a cookie issued under one host to be re-pinned under another.")
+	}
+}
+
+func TestCookieHashPolicyCompatMode(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+	compat := CookieHashSelection{Secret: "secret", CompatMode: true}
+	if err := compat.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	h := compat.Select(pool, request, w)
+	if h == nil {
+		t.Fatal("Expected a host to be selected.")
+	}
+	unsalted, err := hashCookie("secret", h.hashKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Result().Cookies()[0].Value != unsalted {
+		t.Error("Expected compat_mode to reproduce the historical unsalted cookie value.")
+	}
+}
+
+func TestHostByHashingStreamingEquivalence(t *testing.T) {
+	// the streamed digest must reproduce the concatenated hash exactly,
+	// or every existing key-to-upstream mapping would shift
+	for i := 0; i < 1000; i++ {
+		a := fmt.Sprintf("upstream-%d.internal:%d", i%37, 8000+i%100)
+		b := fmt.Sprintf("client-key-%d", i)
+		if hashTwo(a, b) != hash(a+b) {
+			t.Fatalf("hashTwo(%q, %q) diverged from hash of the concatenation", a, b)
+		}
+	}
+
+	pool := testPool()
+	weights := []int{3, 1, 2}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("client-%d.example.com", i)
+		if got, want := hostByHashing(pool, key), hostByHashingConcat(pool, key); got != want {
+			t.Fatalf("Streaming selection for %q picked %s, concatenating picked %s", key, got.Dial, want.Dial)
+		}
+		// the weighted loop streams three parts; pin it against the
+		// concatenated form too
+		streamed, _ := hostByHashingWeightedExplained(pool, key, weights, nil)
+		var want *Upstream
+		var highest uint64
+		for i, up := range pool {
+			for replica := 0; replica < weights[i]; replica++ {
+				if h := hash(up.hashKey() + "#" + strconv.Itoa(replica) + key); h > highest {
+					highest = h
+					want = up
+				}
+			}
+		}
+		if streamed != want {
+			t.Fatalf("Weighted streaming selection for %q picked %s, concatenating picked %s", key, streamed.Dial, want.Dial)
+		}
+	}
+}
+
+func TestQueryHashFallbackCookieSetsCookie(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// Provision `lb_policy query foo { fallback cookie }` the way the
+	// Caddyfile adapter would.
+	var sel QueryHashSelection
+	if err := sel.UnmarshalCaddyfile(caddyfile.NewTestDispenser("query foo {\n\tfallback cookie\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if err := sel.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	// No ?foo= in the request, so selection goes to the cookie
+	// fallback, which must receive the ResponseWriter to set its
+	// sticky cookie.
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	host := sel.Select(pool, req, w)
+	if host == nil {
+		t.Fatal("Expected the cookie fallback to select a host")
+	}
+	var found bool
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "lb" && cookie.Value != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected the cookie fallback to set its 'lb' cookie")
+	}
+}
+
+func TestSelectionTraceSampling(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+
+	// Rate 1 records every selection, bounded by the ring size.
+	always := IPHashSelection{selectionTracing: selectionTracing{TraceSampleRate: 1, TraceBufferSize: 8}}
+	if err := always.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("172.0.1.%d:80", i)
+		always.Select(pool, req, nil)
+	}
+	trace, enabled := always.selectionTraceSnapshot()
+	if !enabled {
+		t.Fatal("Expected tracing to be enabled at rate 1")
+	}
+	if len(trace) != 8 {
+		t.Errorf("Expected the ring to cap the trace at 8 records, got %d", len(trace))
+	}
+	for _, entry := range trace {
+		if entry.Policy != "ip_hash" || entry.KeyHash == "" || entry.Upstream == "none" {
+			t.Errorf("Unexpected trace entry: %+v", entry)
+		}
+	}
+
+	// Rate 0 keeps tracing off entirely.
+	off := IPHashSelection{}
+	if err := off.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if _, enabled := off.selectionTraceSnapshot(); enabled {
+		t.Error("Expected tracing to be disabled at rate 0")
+	}
+
+	// A fractional rate samples roughly that share of selections.
+	half := IPHashSelection{selectionTracing: selectionTracing{TraceSampleRate: 0.5, TraceBufferSize: 4096}}
+	if err := half.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	const selections = 2000
+	for i := 0; i < selections; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("172.0.%d.%d:80", i/256, i%256)
+		half.Select(pool, req, nil)
+	}
+	trace, _ = half.selectionTraceSnapshot()
+	if len(trace) < 800 || len(trace) > 1200 {
+		t.Errorf("Expected roughly half of %d selections sampled, got %d", selections, len(trace))
+	}
+}
+
+func TestSelectionTraceTopologyVersion(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{
+		Field:            "ip",
+		selectionTracing: selectionTracing{TraceSampleRate: 1, TraceBufferSize: 64},
+	}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := testPool()
+	mementoPolicy.PopulateInitialTopology(pool)
+
+	traceFor := func(addr string) selectionTraceEntry {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		if host := mementoPolicy.Select(pool, req, nil); host == nil {
+			t.Fatalf("Expected host selection for %s", addr)
+		}
+		trace, _ := mementoPolicy.selectionTraceSnapshot()
+		if len(trace) == 0 {
+			t.Fatal("Expected the selection to be traced")
+		}
+		return trace[len(trace)-1]
+	}
+
+	if v := traceFor("172.0.0.1:80").TopologyVersion; v != 0 {
+		t.Errorf("Expected topology version 0 before any events, got %d", v)
+	}
+
+	// An unhealthy event removes a node and must bump the version.
+	mementoPolicy.handleUnhealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"host": pool[1].String()},
+	})
+	if v := traceFor("172.0.0.2:80").TopologyVersion; v != 1 {
+		t.Errorf("Expected topology version 1 after a removal, got %d", v)
+	}
+
+	// The matching healthy event re-adds it and bumps again.
+	mementoPolicy.handleHealthyEvent(context.Background(), caddy.Event{
+		Data: map[string]any{"host": pool[1].String()},
+	})
+	if v := traceFor("172.0.0.3:80").TopologyVersion; v != 2 {
+		t.Errorf("Expected topology version 2 after the re-add, got %d", v)
+	}
+}
+
+func TestSelectionTraceEndpoint(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	tracedPolicy := &IPHashSelection{selectionTracing: selectionTracing{TraceSampleRate: 1}}
+	if err := tracedPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := testPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+	tracedPolicy.Select(pool, req, nil)
+
+	registerSelectionPreview("ip_hash", tracedPolicy, pool)
+	defer unregisterSelectionPreview("ip_hash", tracedPolicy)
+
+	traceReq := httptest.NewRequest("GET", "/reverse_proxy/selection/trace?policy=ip_hash", nil)
+	w := httptest.NewRecorder()
+	if err := (adminUpstreams{}).handleSelectionTrace(w, traceReq); err != nil {
+		t.Fatalf("Trace request failed: %v", err)
+	}
+	var trace []selectionTraceEntry
+	if err := json.NewDecoder(w.Body).Decode(&trace); err != nil {
+		t.Fatalf("Decoding trace response: %v", err)
+	}
+	if len(trace) != 1 || trace[0].Policy != "ip_hash" {
+		t.Errorf("Unexpected trace response: %+v", trace)
+	}
+
+	// A policy without trace sampling configured cannot be dumped.
+	untracedPolicy := &IPHashSelection{}
+	registerSelectionPreview("untraced", untracedPolicy, pool)
+	defer unregisterSelectionPreview("untraced", untracedPolicy)
+	traceReq = httptest.NewRequest("GET", "/reverse_proxy/selection/trace?policy=untraced", nil)
+	if err := (adminUpstreams{}).handleSelectionTrace(httptest.NewRecorder(), traceReq); err == nil {
+		t.Error("Expected dumping an untraced policy to fail")
+	} else if apiErr, ok := err.(caddy.APIError); !ok || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Errorf("Expected a 400 APIError, got %v", err)
+	}
+}
+
+func TestWeightedRoundRobinPolicyRatioWithHostDown(t *testing.T) {
+	pool := testPool()
+	wrrPolicy := WeightedRoundRobinSelection{
+		Weights: []int{3, 2, 1},
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	countOver := func(n int) map[*Upstream]int {
+		counts := make(map[*Upstream]int)
+		for i := 0; i < n; i++ {
+			host := wrrPolicy.Select(pool, req, nil)
+			if host == nil {
+				t.Fatal("Expected a host selection")
+			}
+			counts[host]++
+		}
+		return counts
+	}
+
+	// With the first host down, the remaining weights {2, 1} must
+	// still be honored exactly: 2:1 between the second and third host.
+	pool[0].setHealthy(false)
+	counts := countOver(600)
+	if counts[pool[0]] != 0 {
+		t.Errorf("Expected no selections of the down host, got %d", counts[pool[0]])
+	}
+	if counts[pool[1]] != 400 || counts[pool[2]] != 200 {
+		t.Errorf("Expected a 400:200 split between remaining hosts, got %d:%d",
+			counts[pool[1]], counts[pool[2]])
+	}
+
+	// Once it returns, the full 3:2:1 ratio resumes.
+	pool[0].setHealthy(true)
+	counts = countOver(600)
+	if counts[pool[0]] != 300 || counts[pool[1]] != 200 || counts[pool[2]] != 100 {
+		t.Errorf("Expected a 300:200:100 split, got %d:%d:%d",
+			counts[pool[0]], counts[pool[1]], counts[pool[2]])
+	}
+}
+
+// fakeConsistentSelection is a minimal third-party-style selection
+// policy implementing EventsAware and TopologyInitializer, used to
+// verify the handler wires unknown policies generically instead of
+// special-casing the built-in memento types.
+type fakeConsistentSelection struct {
+	eventsSet         bool
+	eventsSetFirst    bool
+	topologyUpstreams []*Upstream
+}
+
+func init() {
+	caddy.RegisterModule(fakeConsistentSelection{})
+}
+
+// CaddyModule returns the Caddy module information.
+func (fakeConsistentSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.fake_consistent",
+		New: func() caddy.Module { return new(fakeConsistentSelection) },
+	}
+}
+
+// Select returns the first host, if any.
+func (s *fakeConsistentSelection) Select(pool UpstreamPool, _ *http.Request, _ http.ResponseWriter) *Upstream {
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[0]
+}
+
+// SetEventsApp implements EventsAware.
+func (s *fakeConsistentSelection) SetEventsApp(events *caddyevents.App) {
+	s.eventsSet = true
+}
+
+// PopulateInitialTopology implements TopologyInitializer.
+func (s *fakeConsistentSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	s.eventsSetFirst = s.eventsSet
+	s.topologyUpstreams = upstreams
+}
+
+func TestHandlerWiresConsistentSelectorInterfaces(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{
+		Upstreams: UpstreamPool{
+			{Dial: "0.0.0.1"},
+			{Dial: "0.0.0.2"},
+		},
+		LoadBalancing: &LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(
+				fakeConsistentSelection{}, "policy", "fake_consistent", nil),
+		},
+	}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	defer h.Cleanup()
+
+	sel, ok := h.LoadBalancing.SelectionPolicy.(*fakeConsistentSelection)
+	if !ok {
+		t.Fatalf("Expected the fake policy to be loaded, got %T", h.LoadBalancing.SelectionPolicy)
+	}
+	if !sel.eventsSet {
+		t.Error("Expected the handler to call SetEventsApp on an EventsAware policy")
+	}
+	if len(sel.topologyUpstreams) != len(h.Upstreams) {
+		t.Errorf("Expected PopulateInitialTopology to receive %d upstreams, got %d",
+			len(h.Upstreams), len(sel.topologyUpstreams))
+	}
+	if !sel.eventsSetFirst {
+		t.Error("Expected SetEventsApp to be called before PopulateInitialTopology")
+	}
+}
+
+func TestCookieHashPolicyStickyIDCutover(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// Blue and green share a sticky identity during the cutover window.
+	cookieHashPolicy := CookieHashSelection{
+		Secret: "secret",
+		StickyIDs: map[string]string{
+			"localhost:8080": "app",
+			"localhost:9090": "app",
+		},
+	}
+	if err := cookieHashPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	blue := &Upstream{Host: new(Host), Dial: "localhost:8080"}
+	other := &Upstream{Host: new(Host), Dial: "localhost:8081"}
+
+	// Issue a cookie against the blue deployment.
+	pool := UpstreamPool{blue, other}
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	w := httptest.NewRecorder()
+	for cookieHashPolicy.Select(pool, request, w) != blue {
+		w = httptest.NewRecorder()
+	}
+	issued := w.Result().Cookies()[0]
+
+	// Replace blue with green: the cookie issued against blue must
+	// match green with no Set-Cookie churn.
+	green := &Upstream{Host: new(Host), Dial: "localhost:9090"}
+	pool = UpstreamPool{other, green}
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(issued)
+	w = httptest.NewRecorder()
+	if h := cookieHashPolicy.Select(pool, request, w); h != green {
+		t.Errorf("Expected the cookie issued against blue to match green, got %v", h)
+	}
+	if rewrites := w.Result().Cookies(); len(rewrites) != 0 {
+		t.Errorf("Expected no cookie rewrite during the cutover, got %v", rewrites)
+	}
+
+	// With both deployments up, the later one in pool order (green)
+	// wins by default...
+	pool = UpstreamPool{blue, other, green}
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(issued)
+	if h := cookieHashPolicy.Select(pool, request, httptest.NewRecorder()); h != green {
+		t.Errorf("Expected the newer deployment to be preferred, got %v", h)
+	}
+
+	// ...unless the policy prefers the first match.
+	cookieHashPolicy.Prefer = "first"
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(issued)
+	if h := cookieHashPolicy.Select(pool, request, httptest.NewRecorder()); h != blue {
+		t.Errorf("Expected prefer first to pick the older deployment, got %v", h)
+	}
+
+	// And if the preferred deployment is down, the other match serves.
+	cookieHashPolicy.Prefer = "last"
+	green.setHealthy(false)
+	request = httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.AddCookie(issued)
+	if h := cookieHashPolicy.Select(pool, request, httptest.NewRecorder()); h != blue {
+		t.Errorf("Expected the remaining shared-identity host to serve, got %v", h)
+	}
+}
+
+func TestJumpHashPolicyTailRemoval(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	jumpPolicy := JumpHashSelection{Field: "ip"}
+	if err := jumpPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+	}
+	pool := createMementoPool(10)
+
+	const numKeys = 2000
+	selectFor := func(i int) *Upstream {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.30.%d.%d:80", i/256, i%256)
+		return jumpPolicy.Select(pool, req, nil)
+	}
+	before := make([]*Upstream, numKeys)
+	ownedByTail := 0
+	for i := 0; i < numKeys; i++ {
+		before[i] = selectFor(i)
+		if before[i] == nil {
+			t.Fatalf("Expected host selection for key %d", i)
+		}
+		if before[i] == pool[9] {
+			ownedByTail++
+		}
+	}
+	// roughly a tenth of the keys should sit on the tail host
+	if ownedByTail < numKeys/20 || ownedByTail > numKeys/5 {
+		t.Errorf("Expected the tail host to own about %d keys, got %d", numKeys/10, ownedByTail)
+	}
+
+	// removing the tail host must only move the keys it owned
+	pool[9].setHealthy(false)
+	for i := 0; i < numKeys; i++ {
+		after := selectFor(i)
+		if after == pool[9] {
+			t.Fatalf("Key %d still maps to the removed tail host", i)
+		}
+		if before[i] != pool[9] && after != before[i] {
+			t.Errorf("Key %d moved from %s to %s although the tail host did not own it",
+				i, before[i].Dial, after.Dial)
+		}
+	}
+
+	// restoring the tail host restores the original mapping exactly
+	pool[9].setHealthy(true)
+	for i := 0; i < numKeys; i++ {
+		if got := selectFor(i); got != before[i] {
+			t.Errorf("Key %d: expected mapping restored to %s, got %s", i, before[i].Dial, got.Dial)
+		}
+	}
+}
+
+func TestJumpHashPolicyValidation(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	headerPolicy := JumpHashSelection{Field: "header"}
+	if err := headerPolicy.Provision(ctx); err == nil {
+		t.Error("Expected error provisioning field 'header' without a header_field")
+	}
+	queryPolicy := JumpHashSelection{Field: "query"}
+	if err := queryPolicy.Provision(ctx); err == nil {
+		t.Error("Expected error provisioning field 'query' without a query_key")
+	}
+	typoPolicy := JumpHashSelection{Field: "cookei"}
+	if err := typoPolicy.Provision(ctx); err == nil {
+		t.Error("Expected error provisioning an unrecognized field")
+	}
+}
+
+func TestJumpHashPolicyCaddyfileAndFallback(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	jumpPolicy := JumpHashSelection{}
+	if err := jumpPolicy.UnmarshalCaddyfile(caddyfile.NewTestDispenser("jump_hash query {\n\tquery_key tenant\n}")); err != nil {
+		t.Errorf("UnmarshalCaddyfile error: %v", err)
+	}
+	if jumpPolicy.Field != "query" || jumpPolicy.QueryKey != "tenant" {
+		t.Errorf("Expected field 'query' with query_key 'tenant', got '%s'/'%s'",
+			jumpPolicy.Field, jumpPolicy.QueryKey)
+	}
+	if err := jumpPolicy.Provision(ctx); err != nil {
+		t.Errorf("Provision error: %v", err)
+	}
+	pool := testPool()
+
+	// the same query value maps to one stable host
+	req, _ := http.NewRequest("GET", "/?tenant=acme", nil)
+	first := jumpPolicy.Select(pool, req, nil)
+	if first == nil {
+		t.Fatal("Expected host selection for the query key")
+	}
+	for i := 0; i < 10; i++ {
+		if got := jumpPolicy.Select(pool, req, nil); got != first {
+			t.Errorf("Expected stable selection %s, got %s", first.Dial, got.Dial)
+		}
+	}
+
+	// a request without the query key defers to the fallback policy
+	bare, _ := http.NewRequest("GET", "/", nil)
+	if jumpPolicy.Select(pool, bare, nil) == nil {
+		t.Error("Expected the fallback policy to select a host")
+	}
+}
+
+func TestFallbackChainTwoLevels(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	queryPolicy := QueryHashSelection{
+		Key: "tenant",
+		FallbackRaw: caddyconfig.JSONModuleObject(HeaderHashSelection{
+			Field:       "X-Tenant",
+			FallbackRaw: caddyconfig.JSONModuleObject(FirstSelection{}, "policy", "first", nil),
+		}, "policy", "header", nil),
+	}
+	if err := queryPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Expected a two-level fallback chain to provision, got: %v", err)
+	}
+	if queryPolicy.fallback == nil {
+		t.Fatal("Expected the fallback policy to be loaded")
+	}
+}
+
+func TestFallbackChainTooDeep(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	raw := caddyconfig.JSONModuleObject(FirstSelection{}, "policy", "first", nil)
+	for i := 0; i < maxFallbackDepth+1; i++ {
+		raw = caddyconfig.JSONModuleObject(QueryHashSelection{
+			Key:         fmt.Sprintf("level%d", i),
+			FallbackRaw: raw,
+		}, "policy", "query", nil)
+	}
+	queryPolicy := QueryHashSelection{Key: "root", FallbackRaw: raw}
+
+	err := queryPolicy.Provision(ctx)
+	if err == nil {
+		t.Fatalf("Expected a %d-level fallback chain to be rejected", maxFallbackDepth+1)
+	}
+	if !strings.Contains(err.Error(), "levels deep") {
+		t.Errorf("Expected a nesting depth error, got: %v", err)
+	}
+}
+
+func TestFallbackSelfReference(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	queryPolicy := QueryHashSelection{
+		Key:         "tenant",
+		FallbackRaw: caddyconfig.JSONModuleObject(QueryHashSelection{Key: "tenant"}, "policy", "query", nil),
+	}
+	err := queryPolicy.Provision(ctx)
+	if err == nil {
+		t.Fatal("Expected a self-referencing fallback to be rejected")
+	}
+	if !strings.Contains(err.Error(), "cannot be its own fallback") {
+		t.Errorf("Expected a self-reference error, got: %v", err)
+	}
+
+	// the same policy type with a different config is a legitimate fallback
+	differentKey := QueryHashSelection{
+		Key:         "tenant",
+		FallbackRaw: caddyconfig.JSONModuleObject(QueryHashSelection{Key: "session"}, "policy", "query", nil),
+	}
+	if err := differentKey.Provision(ctx); err != nil {
+		t.Fatalf("Expected a same-type fallback with a different key to provision, got: %v", err)
+	}
+}
+
+func TestClientIPHashBareRequest(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	clientIPHash := ClientIPHashSelection{}
+	if err := clientIPHash.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := testPool()
+	for _, upstream := range pool {
+		upstream.setHealthy(true)
+	}
+
+	// a request built outside the middleware chain has no vars map at
+	// all; selection must fall back to RemoteAddr instead of panicking
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	host := clientIPHash.Select(pool, req, nil)
+	if host == nil {
+		t.Fatal("Expected a host to be selected from RemoteAddr")
+	}
+	if again := clientIPHash.Select(pool, req, nil); again != host {
+		t.Errorf("Expected the RemoteAddr fallback to be deterministic, got %s then %s", host, again)
+	}
+
+	// when the var is set, it wins over RemoteAddr
+	varReq := req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{
+		caddyhttp.ClientIPVarKey: "10.0.0.7",
+	}))
+	if varHost := clientIPHash.Select(pool, varReq, nil); varHost == nil {
+		t.Error("Expected a host to be selected from the client IP var")
+	}
+}
+
+func TestURIHashQueryParamCanonicalization(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// deny-list with glob patterns drops cache-busting params
+	ignorePolicy := URIHashSelection{IgnoreQueryParams: []string{"utm_*", "_"}}
+	if err := ignorePolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/app?a=1&utm_source=x&_=123456", nil)
+	key, _ := ignorePolicy.requestKey(req)
+	if key != "/app?a=1" {
+		t.Errorf("Expected ignored params to be stripped, got key %q", key)
+	}
+
+	// surviving params are re-encoded sorted by name, so reordered
+	// query strings produce the same key
+	first := httptest.NewRequest(http.MethodGet, "/app?a=1&b=2&utm_medium=mail", nil)
+	second := httptest.NewRequest(http.MethodGet, "/app?b=2&utm_campaign=x&a=1", nil)
+	firstKey, _ := ignorePolicy.requestKey(first)
+	secondKey, _ := ignorePolicy.requestKey(second)
+	if firstKey != secondKey {
+		t.Errorf("Expected reordered queries to canonicalize identically, got %q and %q", firstKey, secondKey)
+	}
+
+	// the allow-list takes precedence over the deny-list
+	includePolicy := URIHashSelection{
+		IncludeQueryParams: []string{"tenant"},
+		IgnoreQueryParams:  []string{"tenant"},
+	}
+	if err := includePolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/app?tenant=5&session=9", nil)
+	key, _ = includePolicy.requestKey(req)
+	if key != "/app?tenant=5" {
+		t.Errorf("Expected only allow-listed params to survive, got key %q", key)
+	}
+
+	// a key whose params are all filtered out reduces to the path
+	req = httptest.NewRequest(http.MethodGet, "/app?session=9", nil)
+	key, _ = includePolicy.requestKey(req)
+	if key != "/app" {
+		t.Errorf("Expected a fully filtered query to reduce to the path, got key %q", key)
+	}
+
+	// an invalid glob is rejected at provision time
+	badPolicy := URIHashSelection{IgnoreQueryParams: []string{"[utm"}}
+	if err := badPolicy.Provision(ctx); err == nil {
+		t.Error("Expected an invalid glob pattern to be rejected")
+	}
+}
+
+func TestWeightedRoundRobinPlaceholderWeights(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	t.Setenv("WRR_WEIGHT_A", "3")
+	t.Setenv("WRR_WEIGHT_B", "1")
+
+	wrrPolicy := WeightedRoundRobinSelection{
+		WeightPlaceholders: []string{"{env.WRR_WEIGHT_A}", "{env.WRR_WEIGHT_B}"},
+		ReresolveInterval:  caddy.Duration(10 * time.Millisecond),
+	}
+	if err := wrrPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := testPool()[:2]
+	for _, upstream := range pool {
+		upstream.setHealthy(true)
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	countSelections := func(n int) map[*Upstream]int {
+		counts := make(map[*Upstream]int)
+		for i := 0; i < n; i++ {
+			counts[wrrPolicy.Select(pool, req, nil)]++
+		}
+		return counts
+	}
+
+	// weights 3:1 over a full number of cycles give an exact split
+	counts := countSelections(400)
+	if counts[pool[0]] != 300 || counts[pool[1]] != 100 {
+		t.Errorf("Expected a 300/100 split for weights 3:1, got %d/%d", counts[pool[0]], counts[pool[1]])
+	}
+
+	// a mid-run weight change is picked up after the interval
+	t.Setenv("WRR_WEIGHT_A", "1")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if weights := wrrPolicy.currentWeights(); len(weights) == 2 && weights[0] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Weight change was not re-resolved within the deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	counts = countSelections(400)
+	if counts[pool[0]] != 200 || counts[pool[1]] != 200 {
+		t.Errorf("Expected a 200/200 split after the weight change, got %d/%d", counts[pool[0]], counts[pool[1]])
+	}
+
+	// an invalid value keeps the previous weight instead of dropping it
+	t.Setenv("WRR_WEIGHT_B", "bogus")
+	time.Sleep(50 * time.Millisecond)
+	if weights := wrrPolicy.currentWeights(); len(weights) != 2 || weights[1] != 1 {
+		t.Errorf("Expected the invalid weight to keep its previous value 1, got %v", weights)
+	}
+}
+
+func TestHeaderHashPolicyValueOptions(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	newRequest := func(values ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, val := range values {
+			req.Header.Add("X-Tenant", val)
+		}
+		return req
+	}
+
+	// default behavior is unchanged: only the first value counts,
+	// exactly as sent
+	defaultPolicy := HeaderHashSelection{Field: "X-Tenant"}
+	if err := defaultPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	key, ok := defaultPolicy.requestKey(newRequest(" Acme ", "second"))
+	if !ok || key != " Acme " {
+		t.Errorf("Expected the raw first value ' Acme ', got %q (ok=%v)", key, ok)
+	}
+
+	// canonicalize trims and lowercases, so spelling variations of one
+	// tenant produce the same key
+	canonicalPolicy := HeaderHashSelection{Field: "X-Tenant", Canonicalize: true}
+	if err := canonicalPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	first, _ := canonicalPolicy.requestKey(newRequest(" Acme "))
+	second, _ := canonicalPolicy.requestKey(newRequest("acme"))
+	if first != "acme" || first != second {
+		t.Errorf("Expected canonicalized keys to agree on 'acme', got %q and %q", first, second)
+	}
+
+	// join_values hashes every value, joined with ","
+	joinPolicy := HeaderHashSelection{Field: "X-Tenant", JoinValues: true}
+	if err := joinPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	key, _ = joinPolicy.requestKey(newRequest("a", "b"))
+	if key != "a,b" {
+		t.Errorf("Expected joined key 'a,b', got %q", key)
+	}
+
+	// both options combine
+	bothPolicy := HeaderHashSelection{Field: "X-Tenant", JoinValues: true, Canonicalize: true}
+	if err := bothPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	key, _ = bothPolicy.requestKey(newRequest(" A ", "B"))
+	if key != "a,b" {
+		t.Errorf("Expected joined canonical key 'a,b', got %q", key)
+	}
+
+	// a present-but-empty header counts as absent, so the fallback runs
+	fallbackPolicy := HeaderHashSelection{
+		Field:       "X-Tenant",
+		FallbackRaw: caddyconfig.JSONModuleObject(FirstSelection{}, "policy", "first", nil),
+	}
+	if err := fallbackPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := testPool()
+	for _, upstream := range pool {
+		upstream.setHealthy(true)
+	}
+	if host := fallbackPolicy.Select(pool, newRequest(""), nil); host != pool[0] {
+		t.Errorf("Expected the first-selection fallback for an empty header, got %v", host)
+	}
+}
+
+func TestValidateRetryAffinity(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	logger := zap.New(core)
+
+	// unrecognized values are rejected
+	lb := &LoadBalancing{SelectionPolicy: ClientIPHashSelection{}, RetryAffinity: "bogus"}
+	if err := lb.validateRetryAffinity("client_ip_hash", logger); err == nil {
+		t.Error("Expected an error for an unrecognized retry_affinity value")
+	}
+
+	// an affinity policy with retries in the default (rehash) mode warns
+	lb = &LoadBalancing{SelectionPolicy: ClientIPHashSelection{}, Retries: 2}
+	if err := lb.validateRetryAffinity("client_ip_hash", logger); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if logs.Len() != 1 {
+		t.Errorf("Expected one warning for affinity policy with retries, got %d", logs.Len())
+	}
+
+	// strict mode is the user opting in, so no warning
+	lb = &LoadBalancing{SelectionPolicy: ClientIPHashSelection{}, Retries: 2, RetryAffinity: "strict"}
+	if err := lb.validateRetryAffinity("client_ip_hash", logger); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// non-affinity policies never warn
+	lb = &LoadBalancing{SelectionPolicy: RandomSelection{}, Retries: 2}
+	if err := lb.validateRetryAffinity("random", logger); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if logs.Len() != 1 {
+		t.Errorf("Expected no further warnings, got %d total", logs.Len())
+	}
+}
+
+func TestRetryAffinityModes(t *testing.T) {
+	var backendHits int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHits++
+	}))
+	defer backend.Close()
+	liveDial := strings.TrimPrefix(backend.URL, "http://")
+
+	// a listener that is immediately closed gives us an address that
+	// reliably refuses connections
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to open listener: %v", err)
+	}
+	deadDial := deadListener.Addr().String()
+	deadListener.Close()
+
+	newHandler := func(retryAffinity string) *Handler {
+		return &Handler{
+			Upstreams: UpstreamPool{{Dial: deadDial}, {Dial: liveDial}},
+			LoadBalancing: &LoadBalancing{
+				SelectionPolicyRaw: caddyconfig.JSONModuleObject(HeaderHashSelection{Field: "X-Affinity"}, "policy", "header", nil),
+				Retries:            2,
+				RetryAffinity:      retryAffinity,
+			},
+		}
+	}
+	newRequest := func(key string) *http.Request {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("X-Affinity", key)
+		return caddyhttp.PrepareRequest(req, caddy.NewReplacer(), nil, nil)
+	}
+	noopNext := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// rehash (the default): the retry may select the other upstream,
+	// so the request succeeds on the live backend
+	rehash := newHandler("")
+	if err := rehash.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision handler: %v", err)
+	}
+	defer rehash.Cleanup()
+
+	// find a key the policy hashes to the dead upstream
+	affinityKey := ""
+	for i := 0; i < 100; i++ {
+		candidate := fmt.Sprintf("key-%d", i)
+		if rehash.LoadBalancing.SelectionPolicy.Select(rehash.Upstreams, newRequest(candidate), nil) == rehash.Upstreams[0] {
+			affinityKey = candidate
+			break
+		}
+	}
+	if affinityKey == "" {
+		t.Fatal("Could not find a key mapping to the dead upstream")
+	}
+
+	if err := rehash.ServeHTTP(httptest.NewRecorder(), newRequest(affinityKey), noopNext); err != nil {
+		t.Errorf("Expected rehash mode to retry onto the live upstream, got error: %v", err)
+	}
+	if backendHits != 1 {
+		t.Errorf("Expected one backend hit in rehash mode, got %d", backendHits)
+	}
+
+	// strict: the failed attempt must not move to a different
+	// upstream, so the request fails and the live backend is not hit
+	strict := newHandler("strict")
+	if err := strict.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision handler: %v", err)
+	}
+	defer strict.Cleanup()
+
+	backendHits = 0
+	if err := strict.ServeHTTP(httptest.NewRecorder(), newRequest(affinityKey), noopNext); err == nil {
+		t.Error("Expected strict mode to surface the dial error instead of retrying")
+	}
+	if backendHits != 0 {
+		t.Errorf("Expected no backend hits in strict mode, got %d", backendHits)
+	}
+}
+
+func TestConsistentLeastConnNeighborhoodStability(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	chPolicy := ConsistentLeastConnSelection{Field: "ip"}
+	if err := chPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(10)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i, i)
+		before := chPolicy.neighborhood(pool, key, nil)
+		if len(before) != 2 {
+			t.Fatalf("Expected a neighborhood of 2, got %d", len(before))
+		}
+		inNeighborhood := map[*Upstream]bool{before[0]: true, before[1]: true}
+
+		// removing an unrelated host leaves the neighborhood untouched
+		shrunk := make(UpstreamPool, 0, len(pool)-1)
+		removedUnrelated := false
+		for _, upstream := range pool {
+			if !removedUnrelated && !inNeighborhood[upstream] {
+				removedUnrelated = true
+				continue
+			}
+			shrunk = append(shrunk, upstream)
+		}
+		after := chPolicy.neighborhood(shrunk, key, nil)
+		if len(after) != 2 || after[0] != before[0] || after[1] != before[1] {
+			t.Errorf("Key %s: neighborhood changed after removing an unrelated host", key)
+		}
+
+		// removing a member keeps the survivor and promotes exactly
+		// one next-highest scorer
+		withoutPrimary := make(UpstreamPool, 0, len(pool)-1)
+		for _, upstream := range pool {
+			if upstream != before[0] {
+				withoutPrimary = append(withoutPrimary, upstream)
+			}
+		}
+		promoted := chPolicy.neighborhood(withoutPrimary, key, nil)
+		if len(promoted) != 2 {
+			t.Fatalf("Expected a neighborhood of 2 after removal, got %d", len(promoted))
+		}
+		if promoted[0] != before[1] && promoted[1] != before[1] {
+			t.Errorf("Key %s: survivor %s left the neighborhood after removing the other member",
+				key, before[1].Dial)
+		}
+	}
+}
+
+func TestConsistentLeastConnPicksLeastLoadedNeighbor(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	chPolicy := ConsistentLeastConnSelection{Field: "ip"}
+	if err := chPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(5)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:80"
+
+	neighborhood := chPolicy.neighborhood(pool, "10.1.2.3", nil)
+	if err := neighborhood[0].Host.countRequest(5); err != nil {
+		t.Fatalf("countRequest error: %v", err)
+	}
+	if host := chPolicy.Select(pool, req, nil); host != neighborhood[1] {
+		t.Errorf("Expected the less-loaded neighbor %s, got %v", neighborhood[1].Dial, host)
+	}
+
+	// a request with no derivable key goes through the fallback
+	chPolicy.Field = "header"
+	chPolicy.HeaderField = "X-Missing"
+	chPolicy.fallback = FirstSelection{}
+	if host := chPolicy.Select(pool, req, nil); host != pool[0] {
+		t.Errorf("Expected the fallback to select the first host, got %v", host)
+	}
+}
+
+func TestConsistentLeastConnLoadSmoothing(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	mementoPool := createMementoPool(5)
+	mementoPolicy.PopulateInitialTopology(mementoPool)
+
+	chPolicy := ConsistentLeastConnSelection{Field: "ip"}
+	if err := chPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	chPool := createMementoPool(5)
+
+	// long-lived requests under a Zipf key distribution: the hottest
+	// keys dominate, so a pure consistent hash concentrates them on
+	// single hosts while ch_2 spreads each across its neighborhood
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.3, 1, 99)
+	hostsPerKey := make(map[string]map[*Upstream]bool)
+	const draws = 5000
+	for i := 0; i < draws; i++ {
+		key := fmt.Sprintf("key-%d", zipf.Uint64())
+
+		if host := mementoPolicy.SelectByKey(mementoPool, key); host != nil {
+			_ = host.Host.countRequest(1)
+		}
+
+		host := chPolicy.SelectByKey(chPool, key)
+		if host == nil {
+			t.Fatalf("Expected a host for key %s", key)
+		}
+		_ = host.Host.countRequest(1)
+		if hostsPerKey[key] == nil {
+			hostsPerKey[key] = make(map[*Upstream]bool)
+		}
+		hostsPerKey[key][host] = true
+	}
+
+	// affinity: each key only ever visits its 2-host neighborhood
+	for key, hosts := range hostsPerKey {
+		if len(hosts) > 2 {
+			t.Errorf("Key %s visited %d hosts; expected at most its neighborhood of 2", key, len(hosts))
+		}
+	}
+
+	maxLoad := func(pool UpstreamPool) int {
+		maximum := 0
+		for _, upstream := range pool {
+			if load := upstream.Host.NumRequests(); load > maximum {
+				maximum = load
+			}
+		}
+		return maximum
+	}
+	if chMax, mementoMax := maxLoad(chPool), maxLoad(mementoPool); chMax >= mementoMax {
+		t.Errorf("Expected ch_2 to smooth the hottest host below pure memento, got %d >= %d", chMax, mementoMax)
+	}
+}
+
+func TestRandomSelectionAntiAffinity(t *testing.T) {
+	policy := RandomSelection{AntiAffinity: &AntiAffinity{}}
+	if err := policy.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(2)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	// with two hosts, consecutive selections for the same client
+	// must alternate
+	prev := policy.Select(pool, req, nil)
+	if prev == nil {
+		t.Fatal("Expected a host to be selected")
+	}
+	for i := 0; i < 20; i++ {
+		next := policy.Select(pool, req, nil)
+		if next == nil {
+			t.Fatal("Expected a host to be selected")
+		}
+		if next == prev {
+			t.Fatal("Expected consecutive selections for the same client to alternate")
+		}
+		prev = next
+	}
+
+	// a different client is not constrained by this client's history
+	other, _ := http.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "172.0.0.2:80"
+	if upstream := policy.Select(pool, other, nil); upstream == nil {
+		t.Fatal("Expected a host to be selected for the other client")
+	}
+
+	// with a single host, the exclusion is skipped and selection
+	// still succeeds
+	solo := createMementoPool(1)
+	for i := 0; i < 3; i++ {
+		if upstream := policy.Select(solo, req, nil); upstream != solo[0] {
+			t.Fatalf("Expected the lone host to keep serving, got %v", upstream)
+		}
+	}
+}
+
+func TestRandomChoiceSelectionAntiAffinity(t *testing.T) {
+	policy := RandomChoiceSelection{
+		Choose:       2,
+		AntiAffinity: &AntiAffinity{Key: "header", HeaderField: "X-Client"},
+	}
+	if err := policy.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := createMementoPool(2)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Client", "client-a")
+
+	prev := policy.Select(pool, req, nil)
+	if prev == nil {
+		t.Fatal("Expected a host to be selected")
+	}
+	for i := 0; i < 20; i++ {
+		next := policy.Select(pool, req, nil)
+		if next == nil {
+			t.Fatal("Expected a host to be selected")
+		}
+		if next == prev {
+			t.Fatal("Expected consecutive selections for the same client to alternate")
+		}
+		prev = next
+	}
+
+	// a request without the identifying header is selected normally
+	anonymous, _ := http.NewRequest("GET", "/", nil)
+	if upstream := policy.Select(pool, anonymous, nil); upstream == nil {
+		t.Fatal("Expected a host to be selected without a client key")
+	}
+}
+
+func TestAntiAffinityTrackerBounded(t *testing.T) {
+	tracker := newAntiAffinityTracker(time.Minute, 4)
+	pool := createMementoPool(2)
+	for i := 0; i < 16; i++ {
+		tracker.record(fmt.Sprintf("client-%d", i), pool[i%2])
+	}
+	if len(tracker.entries) != 4 {
+		t.Errorf("Expected the store to hold at most 4 entries, got %d", len(tracker.entries))
+	}
+	// the most recent keys survive, the oldest were evicted
+	if tracker.last("client-15") == nil {
+		t.Error("Expected the most recent key to be retained")
+	}
+	if tracker.last("client-0") != nil {
+		t.Error("Expected the oldest key to be evicted")
+	}
+}
+
+// TestFallbackPolicyWithNestedBlock verifies that a nested fallback
+// policy can take both inline arguments and its own sub-block, and that
+// options following the block still parse.
+func TestFallbackPolicyWithNestedBlock(t *testing.T) {
+	var memento MementoSelection
+	input := "memento ip {\n\tfallback cookie lb mysecret {\n\t\tmax_age 1h\n\t}\n\tpreserve_state\n}"
+	if err := memento.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if !memento.PreserveState {
+		t.Error("Expected the option after the nested fallback block to be parsed")
+	}
+	var cookieConfig map[string]any
+	if err := json.Unmarshal(memento.FallbackRaw, &cookieConfig); err != nil {
+		t.Fatalf("Unmarshaling FallbackRaw: %v", err)
+	}
+	if cookieConfig["policy"] != "cookie" || cookieConfig["name"] != "lb" || cookieConfig["secret"] != "mysecret" {
+		t.Errorf("Unexpected fallback config: %v", cookieConfig)
+	}
+	if maxAge, _ := cookieConfig["max_age"].(float64); time.Duration(maxAge) != time.Hour {
+		t.Errorf("Expected max_age of 1h in the fallback config, got %v", cookieConfig["max_age"])
+	}
+}
+
+// TestFallbackPolicyInlineNestedBlock is the single-line form of the
+// same config: the nested block's closing brace shares a line with the
+// enclosing policy's, which the line-oriented segment splitting used to
+// misread as one block.
+func TestFallbackPolicyInlineNestedBlock(t *testing.T) {
+	var memento MementoSelection
+	input := "memento ip { fallback cookie lb mysecret { max_age 1h } }"
+	if err := memento.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	var cookieConfig map[string]any
+	if err := json.Unmarshal(memento.FallbackRaw, &cookieConfig); err != nil {
+		t.Fatalf("Unmarshaling FallbackRaw: %v", err)
+	}
+	if cookieConfig["policy"] != "cookie" || cookieConfig["secret"] != "mysecret" {
+		t.Errorf("Unexpected fallback config: %v", cookieConfig)
+	}
+	if maxAge, _ := cookieConfig["max_age"].(float64); time.Duration(maxAge) != time.Hour {
+		t.Errorf("Expected max_age of 1h in the fallback config, got %v", cookieConfig["max_age"])
+	}
+}
+
+// TestFallbackMementoUnderHeader covers a consistent policy as the
+// fallback of a simple one, with the nested policy using its own block.
+func TestFallbackMementoUnderHeader(t *testing.T) {
+	var header HeaderHashSelection
+	input := "header X-Tenant {\n\tfallback memento ip {\n\t\tpreserve_state\n\t}\n}"
+	if err := header.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	var mementoConfig map[string]any
+	if err := json.Unmarshal(header.FallbackRaw, &mementoConfig); err != nil {
+		t.Fatalf("Unmarshaling FallbackRaw: %v", err)
+	}
+	if mementoConfig["policy"] != "memento" || mementoConfig["field"] != "ip" {
+		t.Errorf("Unexpected fallback config: %v", mementoConfig)
+	}
+	if preserve, _ := mementoConfig["preserve_state"].(bool); !preserve {
+		t.Errorf("Expected preserve_state in the fallback config, got %v", mementoConfig)
+	}
+}
+
+func TestSelectionPoliciesTolerateDegeneratePools(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// a few policies refuse to provision without minimal config;
+	// seed just enough for Provision to succeed
+	seed := map[string]func(caddy.Module){
+		"http.reverse_proxy.selection_policies.query": func(m caddy.Module) {
+			m.(*QueryHashSelection).Key = "q"
+		},
+		"http.reverse_proxy.selection_policies.header": func(m caddy.Module) {
+			m.(*HeaderHashSelection).Field = "X-Test"
+		},
+		"http.reverse_proxy.selection_policies.map": func(m caddy.Module) {
+			m.(*MapSelection).Source = "{http.request.uri}"
+		},
+		"http.reverse_proxy.selection_policies.chain": func(m caddy.Module) {
+			m.(*ChainSelection).PoliciesRaw = []json.RawMessage{
+				caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil),
+			}
+		},
+		"http.reverse_proxy.selection_policies.tiered_memento": func(m caddy.Module) {
+			m.(*TieredMementoSelection).Groups = []TieredMementoGroup{
+				{Name: "g1", Dials: []string{"localhost:8080"}},
+			}
+		},
+		"http.reverse_proxy.selection_policies.zone_aware": func(m caddy.Module) {
+			m.(*ZoneAwareSelection).LocalZone = "z1"
+		},
+		"http.reverse_proxy.selection_policies.groups": func(m caddy.Module) {
+			m.(*GroupSelection).Groups = []SelectionGroup{
+				{Name: "g1", Dials: []string{"localhost:8080"}},
+			}
+		},
+	}
+
+	pools := map[string]UpstreamPool{
+		"empty":              {},
+		"single nil element": {nil},
+		"all nil elements":   {nil, nil, nil},
+	}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.RemoteAddr = "172.0.0.1:80"
+
+	policies := caddy.GetModules("http.reverse_proxy.selection_policies")
+	if len(policies) == 0 {
+		t.Fatal("Expected registered selection policies")
+	}
+	for _, modInfo := range policies {
+		name := string(modInfo.ID)
+		instance := modInfo.New()
+		if configure := seed[name]; configure != nil {
+			configure(instance)
+		}
+		if prov, ok := instance.(caddy.Provisioner); ok {
+			if err := prov.Provision(ctx); err != nil {
+				t.Errorf("Provisioning %s: %v", name, err)
+				continue
+			}
+		}
+		sel, ok := instance.(Selector)
+		if !ok {
+			t.Errorf("Policy %s does not implement Selector", name)
+			continue
+		}
+		for poolName, pool := range pools {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("Policy %s panicked on %s pool: %v", name, poolName, r)
+					}
+				}()
+				if upstream := sel.Select(pool, req, nil); upstream != nil {
+					t.Errorf("Policy %s selected %v from %s pool; want nil", name, poolName, upstream)
+				}
+			}()
+		}
+	}
+}
+
+func TestHostByHashingDeterministicTieBreak(t *testing.T) {
+	// a constant hash function forces every upstream into an HRW tie
+	constant := func(identity, key string) uint64 { return 42 }
+	a := &Upstream{Host: new(Host), Dial: "0.0.0.1"}
+	b := &Upstream{Host: new(Host), Dial: "0.0.0.2"}
+	c := &Upstream{Host: new(Host), Dial: "0.0.0.3"}
+	orderings := []UpstreamPool{{a, b, c}, {c, b, a}, {b, c, a}}
+
+	for i, pool := range orderings {
+		if winner, _ := hostByHashingWith(pool, "key", constant, availabilityFull, nil); winner != a {
+			t.Errorf("Ordering %d: expected the smallest canonical key to win the tie, got %v", i, winner)
+		}
+	}
+	for i, pool := range orderings {
+		winner, _ := hostByHashingWeightedWith(pool, "key", constant, availabilityFull, []int{2, 2, 2}, nil)
+		if winner != a {
+			t.Errorf("Weighted ordering %d: expected the smallest canonical key to win the tie, got %v", i, winner)
+		}
+	}
+
+	// an explicit hash_key is the canonical key, not the dial address
+	d := &Upstream{Host: new(Host), Dial: "0.0.0.4", HashKey: "0.0.0.0"}
+	if winner, _ := hostByHashingWith(UpstreamPool{a, b, d}, "key", constant, availabilityFull, nil); winner != d {
+		t.Errorf("Expected the hash_key to decide the tie, got %v", winner)
+	}
+}
+
+func TestIPHashSelectionTieBreakAcrossPoolOrder(t *testing.T) {
+	forward := testPool()
+	reverse := UpstreamPool{forward[2], forward[1], forward[0]}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	ipHash := IPHashSelection{}
+	ipHash.hashFn = func(identity, key string) uint64 { return 7 }
+	first := ipHash.Select(forward, req, nil)
+	second := ipHash.Select(reverse, req, nil)
+	if first == nil || first != second {
+		t.Errorf("Expected the same winner regardless of pool order, got %v and %v", first, second)
+	}
+}
+
+func TestSelectionFallbackCauseVar(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := testPool()
+	// mirror the handler: a vars table on the request with the cause
+	// reset, so the policy's report is observable
+	newVarsReq := func() *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "172.0.0.1:80"
+		req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+		caddyhttp.SetVar(req.Context(), selectionCauseVarKey, selectionFallbackNone)
+		return req
+	}
+	causeVar := func(req *http.Request) string {
+		cause, _ := caddyhttp.GetVar(req.Context(), selectionCauseVarKey).(string)
+		return cause
+	}
+
+	headerPolicy := HeaderHashSelection{Field: "X-Affinity"}
+	if err := headerPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	// normal scenario: the header is present and the primary path serves
+	req := newVarsReq()
+	req.Header.Set("X-Affinity", "abc")
+	if upstream := headerPolicy.Select(pool, req, nil); upstream == nil {
+		t.Fatal("Expected a selection with the header present")
+	}
+	if cause := causeVar(req); cause != selectionFallbackNone {
+		t.Errorf("Expected cause 'none' for a primary selection, got '%s'", cause)
+	}
+
+	// fallback scenario: the header is missing
+	req = newVarsReq()
+	if upstream := headerPolicy.Select(pool, req, nil); upstream == nil {
+		t.Fatal("Expected a fallback selection without the header")
+	}
+	if cause := causeVar(req); cause != selectionFallbackKeyMissing {
+		t.Errorf("Expected cause 'key_missing' without the header, got '%s'", cause)
+	}
+
+	// a memento policy with an empty topology reports engine_empty
+	mementoPolicy := &MementoSelection{Field: "ip"}
+	if err := mementoPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	req = newVarsReq()
+	if upstream := mementoPolicy.Select(pool, req, nil); upstream == nil {
+		t.Fatal("Expected a fallback selection with an empty topology")
+	}
+	if cause := causeVar(req); cause != selectionFallbackEngineEmpty {
+		t.Errorf("Expected cause 'engine_empty' with an empty topology, got '%s'", cause)
+	}
+
+	// when a fallback policy itself falls back, the outermost cause wins
+	req = newVarsReq()
+	recordFallbackCause(req, selectionFallbackKeyMissing)
+	recordFallbackCause(req, selectionFallbackUnavailable)
+	if cause := causeVar(req); cause != selectionFallbackKeyMissing {
+		t.Errorf("Expected the first cause to win, got '%s'", cause)
+	}
+}
+
+// TestLeastConnAgeDiscounted simulates one long-stuck request and
+// verifies that under count_weighting age_discounted its host still
+// receives new work once the stuck request's contribution has decayed,
+// instead of being starved for as long as the request hangs.
+func TestLeastConnAgeDiscounted(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	pool := testPool()
+	for i := range pool {
+		pool[i].setHealthy(true)
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	lcPolicy := LeastConnSelection{
+		countWeightingChooser: countWeightingChooser{
+			CountWeighting: "age_discounted",
+			DecayHalfLife:  caddy.Duration(5 * time.Millisecond),
+		},
+	}
+	if err := lcPolicy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	lcPolicy.PopulateInitialTopology(pool)
+
+	// hang one request on pool[0] and let it age several half-lives
+	pool[0].countRequest(1)
+	defer pool[0].countRequest(-1)
+	time.Sleep(50 * time.Millisecond)
+
+	// fresh work lands on the other two hosts: the raw counts now tie
+	// at one each, but the stuck request counts for almost nothing
+	pool[1].countRequest(1)
+	defer pool[1].countRequest(-1)
+	pool[2].countRequest(1)
+	defer pool[2].countRequest(-1)
+
+	for i := 0; i < 20; i++ {
+		if h := lcPolicy.Select(pool, req, nil); h != pool[0] {
+			t.Fatalf("Expected the host behind the stuck request to win, got %v", h)
+		}
+	}
+
+	// the raw count is untouched by the discounting
+	if n := pool[0].NumRequests(); n != 1 {
+		t.Errorf("Expected raw count 1 on pool[0], got %d", n)
+	}
+
+	// RandomChoice reaches the same comparison through leastRequests
+	if up := leastRequests([]*Upstream{pool[1], pool[0]}, true); up != pool[0] {
+		t.Errorf("Expected leastRequests to discount the stuck request, got %v", up)
+	}
+}
+
+// TestCountWeightingConfig exercises the count_weighting options on
+// the policies that share the chooser.
+func TestCountWeightingConfig(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	badPolicy := LeastConnSelection{
+		countWeightingChooser: countWeightingChooser{CountWeighting: "decayed"},
+	}
+	if err := badPolicy.Provision(ctx); err == nil {
+		t.Error("Expected provision error for unrecognized count_weighting")
+	}
+
+	defaulted := LeastConnSelection{
+		countWeightingChooser: countWeightingChooser{CountWeighting: "age_discounted"},
+	}
+	if err := defaulted.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if time.Duration(defaulted.DecayHalfLife) != time.Minute {
+		t.Errorf("Expected default half-life of 1m, got %v", time.Duration(defaulted.DecayHalfLife))
+	}
+
+	var lcPolicy LeastConnSelection
+	err := lcPolicy.UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"least_conn {\n\tcount_weighting age_discounted\n\tdecay_half_life 30s\n}"))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if lcPolicy.CountWeighting != "age_discounted" || time.Duration(lcPolicy.DecayHalfLife) != 30*time.Second {
+		t.Errorf("Unexpected parsed config: %q %v", lcPolicy.CountWeighting, time.Duration(lcPolicy.DecayHalfLife))
+	}
+
+	var rcPolicy RandomChoiceSelection
+	err = rcPolicy.UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"random_choose 2 {\n\tcount_weighting age_discounted\n}"))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if rcPolicy.CountWeighting != "age_discounted" {
+		t.Errorf("Expected random_choose to parse count_weighting, got %q", rcPolicy.CountWeighting)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selectiontest provides a reusable statistical test harness for
+// reverse proxy selection policies. The built-in hashing policies are
+// tested against three guarantees: keys spread evenly across the pool,
+// the same key always lands on the same upstream, and removing one
+// upstream only moves the keys that were mapped to it. Plugin authors
+// writing their own Selector modules can assert the same guarantees
+// without reimplementing the bookkeeping:
+//
+//	pool := selectiontest.Pool(10)
+//	keys := selectiontest.Keys("user", 5000)
+//	selectiontest.CheckDistribution(t, sel, pool, selectiontest.URIRequest, keys, 0.15)
+//	selectiontest.CheckConsistency(t, sel, pool, selectiontest.URIRequest, keys)
+//	selectiontest.CheckMinimalDisruptionOnRemoval(t, sel, pool, selectiontest.URIRequest, keys, 3)
+//
+// Requests are built by a RequestMaker so the same checks work for
+// policies that hash the client IP, the URI, a header, or anything else
+// derivable from a key.
+package selectiontest
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// RequestMaker builds a request that carries the given key in
+// whatever part of the request the policy under test hashes.
+type RequestMaker func(key string) *http.Request
+
+// IPRequest carries the key as the request's remote address. The key
+// must be a valid host or host:port (e.g. "10.0.3.7:80") for policies
+// that split off the port.
+func IPRequest(key string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = key
+	return req
+}
+
+// URIRequest carries the key as the request URI.
+func URIRequest(key string) *http.Request {
+	req, _ := http.NewRequest("GET", "/"+key, nil)
+	return req
+}
+
+// HeaderRequest returns a RequestMaker that carries the key in the
+// given header field.
+func HeaderRequest(field string) RequestMaker {
+	return func(key string) *http.Request {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(field, key)
+		return req
+	}
+}
+
+// Pool returns n healthy upstreams with distinct dial addresses of the
+// form "10.0.0.i:8080".
+func Pool(n int) reverseproxy.UpstreamPool {
+	pool := make(reverseproxy.UpstreamPool, n)
+	for i := range pool {
+		pool[i] = &reverseproxy.Upstream{
+			Host: new(reverseproxy.Host),
+			Dial: fmt.Sprintf("10.0.0.%d:8080", i+1),
+		}
+	}
+	return pool
+}
+
+// Keys returns n distinct deterministic keys with the given prefix.
+func Keys(prefix string, n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s-%d", prefix, i)
+	}
+	return keys
+}
+
+// mapKeys selects every key once and returns the resulting
+// key-to-upstream mapping, failing the test if the policy returns no
+// upstream for any key.
+func mapKeys(t testing.TB, sel reverseproxy.Selector, pool reverseproxy.UpstreamPool, mk RequestMaker, keys []string) map[string]*reverseproxy.Upstream {
+	t.Helper()
+	mapping := make(map[string]*reverseproxy.Upstream, len(keys))
+	for _, key := range keys {
+		upstream := sel.Select(pool, mk(key), nil)
+		if upstream == nil {
+			t.Fatalf("policy returned no upstream for key %q", key)
+		}
+		mapping[key] = upstream
+	}
+	return mapping
+}
+
+// CheckDistribution selects every key once and fails the test if the
+// per-upstream load is uneven: the coefficient of variation (standard
+// deviation over mean) of the selection counts must not exceed maxCV.
+// Upstreams that received no keys count as zero, so a policy that
+// ignores part of the pool fails too. A maxCV around 0.10-0.25 is
+// typical for consistent-hashing policies with a few thousand keys.
+func CheckDistribution(t testing.TB, sel reverseproxy.Selector, pool reverseproxy.UpstreamPool, mk RequestMaker, keys []string, maxCV float64) {
+	t.Helper()
+	counts := make(map[*reverseproxy.Upstream]int, len(pool))
+	for _, upstream := range mapKeys(t, sel, pool, mk, keys) {
+		counts[upstream]++
+	}
+	mean := float64(len(keys)) / float64(len(pool))
+	var sumSquares float64
+	for _, upstream := range pool {
+		diff := float64(counts[upstream]) - mean
+		sumSquares += diff * diff
+	}
+	cv := math.Sqrt(sumSquares/float64(len(pool))) / mean
+	if cv > maxCV {
+		t.Errorf("uneven distribution: coefficient of variation %.4f exceeds %.4f (mean %.1f keys per upstream)", cv, maxCV, mean)
+	}
+}
+
+// CheckConsistency selects every key twice and fails the test if any
+// key maps to a different upstream on the second pass.
+func CheckConsistency(t testing.TB, sel reverseproxy.Selector, pool reverseproxy.UpstreamPool, mk RequestMaker, keys []string) {
+	t.Helper()
+	first := mapKeys(t, sel, pool, mk, keys)
+	second := mapKeys(t, sel, pool, mk, keys)
+	for _, key := range keys {
+		if first[key] != second[key] {
+			t.Errorf("key %q is not stable: first pass chose %s, second pass chose %s", key, first[key], second[key])
+		}
+	}
+}
+
+// CheckMinimalDisruptionOnRemoval records the key-to-upstream mapping,
+// marks pool[removeIdx] unhealthy, and fails the test if any key that
+// was NOT mapped to the removed upstream moves, or if any key that was
+// remains on it. The removed upstream is restored to health before
+// returning.
+func CheckMinimalDisruptionOnRemoval(t testing.TB, sel reverseproxy.Selector, pool reverseproxy.UpstreamPool, mk RequestMaker, keys []string, removeIdx int) {
+	t.Helper()
+	before := mapKeys(t, sel, pool, mk, keys)
+	removed := pool[removeIdx]
+	removed.SetHealthyForTesting(false)
+	defer removed.SetHealthyForTesting(true)
+	after := mapKeys(t, sel, pool, mk, keys)
+	for _, key := range keys {
+		if before[key] == removed {
+			if after[key] == removed {
+				t.Errorf("key %q still maps to removed upstream %s", key, removed)
+			}
+			continue
+		}
+		if after[key] != before[key] {
+			t.Errorf("key %q moved from %s to %s even though its upstream was not removed", key, before[key], after[key])
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// These tests exercise the built-in hashing policies through the
+// selectiontest harness, both to keep the distribution/consistency/
+// disruption guarantees pinned and to prove the harness works as a
+// public API for third-party Selector modules. They live in an
+// external test package because selectiontest imports reverseproxy.
+
+package reverseproxy_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy/selectiontest"
+)
+
+// ipKeys returns n distinct host:port keys for policies that hash the
+// client IP.
+func ipKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.%d.%d.%d:80", i/65536%256, i/256%256, i%256)
+	}
+	return keys
+}
+
+func TestHarnessIPHash(t *testing.T) {
+	sel := reverseproxy.IPHashSelection{}
+	pool := selectiontest.Pool(10)
+	keys := ipKeys(5000)
+
+	selectiontest.CheckDistribution(t, sel, pool, selectiontest.IPRequest, keys, 0.15)
+	selectiontest.CheckConsistency(t, sel, pool, selectiontest.IPRequest, keys)
+	selectiontest.CheckMinimalDisruptionOnRemoval(t, sel, pool, selectiontest.IPRequest, keys, 3)
+}
+
+func TestHarnessURIHash(t *testing.T) {
+	sel := reverseproxy.URIHashSelection{Source: "path_only"}
+	pool := selectiontest.Pool(10)
+	keys := selectiontest.Keys("article", 5000)
+
+	selectiontest.CheckDistribution(t, sel, pool, selectiontest.URIRequest, keys, 0.15)
+	selectiontest.CheckConsistency(t, sel, pool, selectiontest.URIRequest, keys)
+	selectiontest.CheckMinimalDisruptionOnRemoval(t, sel, pool, selectiontest.URIRequest, keys, 0)
+}
+
+func TestHarnessHeaderHash(t *testing.T) {
+	sel := reverseproxy.HeaderHashSelection{Field: "X-Tenant"}
+	pool := selectiontest.Pool(10)
+	keys := selectiontest.Keys("tenant", 5000)
+	mk := selectiontest.HeaderRequest("X-Tenant")
+
+	selectiontest.CheckDistribution(t, sel, pool, mk, keys, 0.15)
+	selectiontest.CheckConsistency(t, sel, pool, mk, keys)
+	selectiontest.CheckMinimalDisruptionOnRemoval(t, sel, pool, mk, keys, 9)
+}
+
+func TestHarnessMemento(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	sel := &reverseproxy.MementoSelection{Field: "ip"}
+	if err := sel.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := selectiontest.Pool(10)
+	sel.PopulateInitialTopology(pool)
+
+	keys := ipKeys(5000)
+	selectiontest.CheckDistribution(t, sel, pool, selectiontest.IPRequest, keys, 0.15)
+	selectiontest.CheckConsistency(t, sel, pool, selectiontest.IPRequest, keys)
+	selectiontest.CheckMinimalDisruptionOnRemoval(t, sel, pool, selectiontest.IPRequest, keys, 5)
+}
+
+func TestHarnessWeightedMemento(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// equal weights so the distribution check's even-spread expectation
+	// applies
+	sel := &reverseproxy.WeightedMementoSelection{
+		Field:   "ip",
+		Weights: []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+	}
+	if err := sel.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := selectiontest.Pool(10)
+	sel.PopulateInitialTopology(pool)
+
+	keys := ipKeys(5000)
+	selectiontest.CheckDistribution(t, sel, pool, selectiontest.IPRequest, keys, 0.15)
+	selectiontest.CheckConsistency(t, sel, pool, selectiontest.IPRequest, keys)
+	selectiontest.CheckMinimalDisruptionOnRemoval(t, sel, pool, selectiontest.IPRequest, keys, 7)
+}
+
+func TestHarnessJumpHash(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	sel := &reverseproxy.JumpHashSelection{Field: "ip"}
+	if err := sel.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := selectiontest.Pool(10)
+	keys := ipKeys(5000)
+
+	selectiontest.CheckDistribution(t, sel, pool, selectiontest.IPRequest, keys, 0.15)
+	selectiontest.CheckConsistency(t, sel, pool, selectiontest.IPRequest, keys)
+	// jump hash only guarantees minimal movement for changes at the
+	// tail of the pool, so the disruption check removes the last
+	// upstream; a mid-pool removal would reshuffle far more
+	selectiontest.CheckMinimalDisruptionOnRemoval(t, sel, pool, selectiontest.IPRequest, keys, 9)
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultShareSampleSize is how many synthetic keys the status endpoint
+// samples through the engine to estimate each node's key share when no
+// explicit sample size is configured.
+const defaultShareSampleSize = 10000
+
+// topologyNode tracks one upstream's membership in a memento policy's
+// topology along with the metadata the status endpoint reports: when
+// the node first joined, how many times it flapped out of the topology,
+// and the last event applied to it. Entries are only forgotten when the
+// upstream itself is removed (TopologyAware.RemoveUpstream), so the
+// metadata survives unhealthy/healthy cycles.
+type topologyNode struct {
+	mu          sync.Mutex
+	active      bool
+	addedAt     time.Time
+	flapCount   int
+	lastEvent   string
+	lastEventAt time.Time
+}
+
+// isActive reports whether the node is currently in the topology.
+func (n *topologyNode) isActive() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.active
+}
+
+// topologyActivate marks the upstream active in the topology map,
+// creating its entry on first sight. The event names what put the node
+// in (e.g. "initial", "healthy", "topology_replace").
+func topologyActivate(topology *sync.Map, upstream *Upstream, event string) {
+	val, _ := topology.LoadOrStore(upstream, &topologyNode{})
+	node := val.(*topologyNode)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	now := time.Now()
+	if node.addedAt.IsZero() {
+		node.addedAt = now
+	}
+	node.active = true
+	node.lastEvent = event
+	node.lastEventAt = now
+}
+
+// topologyDeactivate marks the upstream inactive, keeping its entry so
+// the metadata survives and a later event can restore it. Each
+// transition out of the topology counts as one flap.
+func topologyDeactivate(topology *sync.Map, upstream *Upstream, event string) {
+	val, ok := topology.Load(upstream)
+	if !ok {
+		return
+	}
+	node := val.(*topologyNode)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.active {
+		node.flapCount++
+	}
+	node.active = false
+	node.lastEvent = event
+	node.lastEventAt = time.Now()
+}
+
+// topologyActive reports whether the upstream is currently in the
+// topology; never-seen upstreams are not.
+func topologyActive(topology *sync.Map, upstream *Upstream) bool {
+	val, ok := topology.Load(upstream)
+	if !ok {
+		return false
+	}
+	return val.(*topologyNode).isActive()
+}
+
+// topologyNodeReport is the JSON view of one tracked upstream for the
+// status endpoint.
+type topologyNodeReport struct {
+	// The dial address of the upstream.
+	Upstream string `json:"upstream"`
+
+	// Whether the node is currently in the topology.
+	Active bool `json:"active"`
+
+	// When the node first joined the topology.
+	AddedAt time.Time `json:"added_at"`
+
+	// How many times the node has left the topology since it first
+	// joined; each unhealthy-and-back cycle counts once.
+	FlapCount int `json:"flap_count"`
+
+	// The last event applied to the node ("initial", "healthy",
+	// "unhealthy", "topology_replace", ...), and when.
+	LastEvent   string    `json:"last_event"`
+	LastEventAt time.Time `json:"last_event_at"`
+
+	// The estimated fraction of the keyspace the node currently owns,
+	// computed by sampling synthetic keys through the engine. Zero for
+	// inactive nodes.
+	KeyShare float64 `json:"key_share"`
+}
+
+// topologyReporter is implemented by selection policies that track
+// their own upstream topology and can report per-node membership
+// metadata; the admin topology endpoint reads it.
+type topologyReporter interface {
+	topologyStatus() []topologyNodeReport
+}
+
+// topologyEngine is the slice of the consistent engines the status
+// report needs: enough to sample synthetic keys through the live
+// mapping. Both the unweighted and the weighted engine satisfy it.
+type topologyEngine interface {
+	Lookup(key string) (*Upstream, bool)
+	Size() int
+}
+
+// estimateKeyShares samples the given number of synthetic keys through
+// the engine and returns the fraction each upstream received. The
+// sample is deterministic, so repeated calls on an unchanged topology
+// report the same shares.
+func estimateKeyShares(engine topologyEngine, samples int) map[*Upstream]float64 {
+	if engine == nil || engine.Size() == 0 {
+		return nil
+	}
+	if samples <= 0 {
+		samples = defaultShareSampleSize
+	}
+	counts := make(map[*Upstream]int)
+	for i := 0; i < samples; i++ {
+		if upstream, ok := engine.Lookup(fmt.Sprintf("share-sample-%d", i)); ok {
+			counts[upstream]++
+		}
+	}
+	shares := make(map[*Upstream]float64, len(counts))
+	for upstream, count := range counts {
+		shares[upstream] = float64(count) / float64(samples)
+	}
+	return shares
+}
+
+// topologyStatusReport builds the per-node reports for a policy's
+// topology map, sorted by upstream address for stable output.
+func topologyStatusReport(topology *sync.Map, engine topologyEngine, sampleSize int) []topologyNodeReport {
+	shares := estimateKeyShares(engine, sampleSize)
+	reports := []topologyNodeReport{}
+	topology.Range(func(key, val interface{}) bool {
+		upstream := key.(*Upstream)
+		node := val.(*topologyNode)
+		node.mu.Lock()
+		report := topologyNodeReport{
+			Upstream:    upstream.Dial,
+			Active:      node.active,
+			AddedAt:     node.addedAt,
+			FlapCount:   node.flapCount,
+			LastEvent:   node.lastEvent,
+			LastEventAt: node.lastEventAt,
+		}
+		node.mu.Unlock()
+		report.KeyShare = shares[upstream]
+		reports = append(reports, report)
+		return true
+	})
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Upstream < reports[j].Upstream
+	})
+	return reports
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"bufio"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxWarmupKeys caps how many keys a warm-up file may contribute, so a
+// pathological file (or one that isn't a key list at all) cannot stall
+// startup indefinitely.
+const maxWarmupKeys = 1_000_000
+
+// warmupFromKeysFile reads newline-delimited keys from path and runs
+// each through the engine once, warming its internal structures so the
+// first real lookups after a (re)load don't pay for cold caches and
+// first-touch allocations. Empty lines are skipped and at most
+// maxWarmupKeys keys are processed. A file that cannot be read is a
+// warning, not an error: warm-up is an optimization and must never keep
+// a config from loading. Returns how many keys were processed.
+func warmupFromKeysFile(path string, engine topologyEngine, logger *zap.Logger) int {
+	file, err := os.Open(path)
+	if err != nil {
+		if logger != nil {
+			logger.Warn("cannot read warm-up keys file, skipping warm-up",
+				zap.String("warmup_keys_file", path),
+				zap.Error(err))
+		}
+		return 0
+	}
+	defer file.Close()
+
+	start := time.Now()
+	processed := 0
+	truncated := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key := scanner.Text()
+		if key == "" {
+			continue
+		}
+		if processed >= maxWarmupKeys {
+			truncated = true
+			break
+		}
+		engine.Lookup(key)
+		processed++
+	}
+	if err := scanner.Err(); err != nil && logger != nil {
+		logger.Warn("error while reading warm-up keys file",
+			zap.String("warmup_keys_file", path),
+			zap.Int("keys_processed", processed),
+			zap.Error(err))
+	}
+	if truncated && logger != nil {
+		logger.Warn("warm-up keys file exceeds the key cap, remainder skipped",
+			zap.String("warmup_keys_file", path),
+			zap.Int("key_cap", maxWarmupKeys))
+	}
+	if logger != nil {
+		logger.Info("warmed up selection engine from keys file",
+			zap.String("warmup_keys_file", path),
+			zap.Int("keys_processed", processed),
+			zap.Duration("duration", time.Since(start)))
+	}
+	return processed
+}
@@ -2,11 +2,18 @@ package reverseproxy
 
 import (
 	"sort"
+	"strconv"
 	"sync"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy/memento"
 )
 
+// defaultMaxVirtualNodes is the default cap on the total number of
+// virtual nodes (buckets) the engine may hold. Each unit of weight
+// becomes one bucket, so pathological weights like {10000, 1} would
+// otherwise explode memory and make AddNode quadratic.
+const defaultMaxVirtualNodes = 1024
+
 // WeightedConsistentEngine manages the weighted assignment of buckets to nodes
 // using an underlying Memento engine. It coordinates between the hashing logic
 // of MementoEngine and the mapping logic of WeightedIndirection.
@@ -14,18 +21,117 @@ type WeightedConsistentEngine struct {
 	memento     *memento.MementoEngine // The underlying consistent hashing engine
 	indirection *WeightedIndirection   // Manages the mapping of buckets to nodes
 
+	// The cap on the total number of virtual nodes. Weights are
+	// reduced by their GCD before bucket assignment; callers should
+	// validate the reduced total against this cap before
+	// provisioning (see MaxVirtualNodes).
+	maxVirtualNodes int
+
+	// Optional key pre-mixer configured through the policy's
+	// hash_function option. The memento engine hashes keys with its own
+	// internal FNV-1a; when set, keys are run through this function
+	// first, so the configured function (e.g. keyed siphash) decides
+	// the distribution. Nil leaves keys untouched.
+	keyHasher hashFunction
+
 	// Mutex to protect concurrent access
 	mu sync.RWMutex
 }
 
 // NewWeightedConsistentEngine creates a new weighted consistent hashing engine.
 func NewWeightedConsistentEngine() *WeightedConsistentEngine {
+	return NewWeightedConsistentEngineWithCap(defaultMaxVirtualNodes)
+}
+
+// NewWeightedConsistentEngineWithCap creates a new weighted consistent
+// hashing engine with the given cap on total virtual nodes.
+func NewWeightedConsistentEngineWithCap(maxVirtualNodes int) *WeightedConsistentEngine {
+	if maxVirtualNodes <= 0 {
+		maxVirtualNodes = defaultMaxVirtualNodes
+	}
 	return &WeightedConsistentEngine{
-		memento:     memento.NewMementoEngineWithType(0, true),
-		indirection: NewWeightedIndirection(),
+		memento:         memento.NewMementoEngineWithType(0, true),
+		indirection:     NewWeightedIndirection(),
+		maxVirtualNodes: maxVirtualNodes,
 	}
 }
 
+// MaxVirtualNodes returns the cap on the total number of virtual nodes.
+func (w *WeightedConsistentEngine) MaxVirtualNodes() int {
+	return w.maxVirtualNodes
+}
+
+// SetKeyHasher installs (or, with nil, removes) a key pre-mixer: every
+// lookup key is hashed through fn and the engine's internal hashing
+// runs on the mixed form instead. Changing the hasher on a live engine
+// remaps keys, so it is meant to be called right after construction.
+func (w *WeightedConsistentEngine) SetKeyHasher(fn hashFunction) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.keyHasher = fn
+}
+
+// mixKey applies the configured key pre-mixer, if any. The caller must
+// hold at least a read lock.
+func (w *WeightedConsistentEngine) mixKey(key string) string {
+	if w.keyHasher == nil {
+		return key
+	}
+	return strconv.FormatUint(w.keyHasher(key, ""), 16)
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// NormalizeWeights reduces the given weights by their greatest common
+// divisor, so e.g. {50, 30, 20} collapses to {5, 3, 2} and produces a
+// tenth of the virtual nodes with an identical distribution. Zero
+// weights are preserved as zero and do not affect the reduction. The
+// input slice is not modified.
+func NormalizeWeights(weights []int) []int {
+	divisor := 0
+	for _, weight := range weights {
+		if weight > 0 {
+			divisor = gcd(divisor, weight)
+		}
+	}
+	normalized := make([]int, len(weights))
+	copy(normalized, weights)
+	if divisor <= 1 {
+		return normalized
+	}
+	for i, weight := range normalized {
+		if weight > 0 {
+			normalized[i] = weight / divisor
+		}
+	}
+	return normalized
+}
+
+// normalizeWeightMap is NormalizeWeights for a node-to-weight map,
+// returning a new map with the reduced weights.
+func normalizeWeightMap(nodesWithWeights map[*Upstream]int) map[*Upstream]int {
+	divisor := 0
+	for _, weight := range nodesWithWeights {
+		if weight > 0 {
+			divisor = gcd(divisor, weight)
+		}
+	}
+	normalized := make(map[*Upstream]int, len(nodesWithWeights))
+	for upstream, weight := range nodesWithWeights {
+		if divisor > 1 && weight > 0 {
+			weight /= divisor
+		}
+		normalized[upstream] = weight
+	}
+	return normalized
+}
+
 // --- Utility Implementations ---
 
 // No longer needed here, moved to WeightedIndirection
@@ -33,10 +139,14 @@ func NewWeightedConsistentEngine() *WeightedConsistentEngine {
 // --- Main Operation Implementations ---
 
 // InitCluster initializes the cluster with a set of upstreams and their weights.
+// Weights are reduced by their GCD first, so configurations like {50, 30, 20}
+// allocate buckets as {5, 3, 2} with an identical distribution.
 func (w *WeightedConsistentEngine) InitCluster(nodesWithWeights map[*Upstream]int) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	nodesWithWeights = normalizeWeightMap(nodesWithWeights)
+
 	totalBuckets := 0
 	upstreams := make([]*Upstream, 0, len(nodesWithWeights))
 
@@ -48,9 +158,10 @@ func (w *WeightedConsistentEngine) InitCluster(nodesWithWeights map[*Upstream]in
 	// Re-initialize the engine with the correct total size
 	w.memento = memento.NewMementoEngine(totalBuckets)
 
-	// Sort upstreams for deterministic bucket assignment
+	// Sort upstreams by their stable identity for deterministic bucket
+	// assignment that survives dial address renumbering
 	sort.Slice(upstreams, func(i, j int) bool {
-		return upstreams[i].String() < upstreams[j].String()
+		return upstreams[i].hashKey() < upstreams[j].hashKey()
 	})
 
 	// Initialize data structures for each node in the indirection layer
@@ -77,6 +188,22 @@ func (w *WeightedConsistentEngine) InitCluster(nodesWithWeights map[*Upstream]in
 	}
 }
 
+// Clone returns a deep copy of the engine: the memento state (including
+// its replacement history, so the clone maps every key exactly like the
+// original) and the weighted bucket indirection. Mutating the clone —
+// e.g. removing a node to estimate the blast radius of taking it down —
+// leaves the live engine untouched.
+func (w *WeightedConsistentEngine) Clone() *WeightedConsistentEngine {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return &WeightedConsistentEngine{
+		memento:         w.memento.Clone(),
+		indirection:     w.indirection.Clone(),
+		maxVirtualNodes: w.maxVirtualNodes,
+		keyHasher:       w.keyHasher,
+	}
+}
+
 // Lookup finds the node that owns a key.
 func (w *WeightedConsistentEngine) Lookup(key string) (*Upstream, bool) {
 	w.mu.RLock()
@@ -86,11 +213,48 @@ func (w *WeightedConsistentEngine) Lookup(key string) (*Upstream, bool) {
 		return nil, false
 	}
 
-	bucketID := w.memento.GetBucket(key)
+	bucketID := w.memento.GetBucket(w.mixKey(key))
+	upstream, ok := w.indirection.GetNodeID(bucketID)
+	return upstream, ok
+}
+
+// LookupBytes is Lookup for callers that already hold the key as a byte
+// slice; the key is hashed in place, without a string conversion.
+func (w *WeightedConsistentEngine) LookupBytes(key []byte) (*Upstream, bool) {
+	if w.keyHasher != nil {
+		// mixing rebuilds the key anyway, so the byte fast path has
+		// nothing left to save; take the string path
+		return w.Lookup(string(key))
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.memento.Size() == 0 {
+		return nil, false
+	}
+
+	bucketID := w.memento.GetBucketBytes(key)
 	upstream, ok := w.indirection.GetNodeID(bucketID)
 	return upstream, ok
 }
 
+// LookupBucket finds the node that owns a key and also reports the
+// bucket index the key maps to. This is primarily useful for debugging
+// and preview endpoints; normal selection should use Lookup.
+func (w *WeightedConsistentEngine) LookupBucket(key string) (*Upstream, int, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.memento.Size() == 0 {
+		return nil, -1, false
+	}
+
+	bucketID := w.memento.GetBucket(w.mixKey(key))
+	upstream, ok := w.indirection.GetNodeID(bucketID)
+	return upstream, bucketID, ok
+}
+
 // AddNode adds a new node with a given weight.
 func (w *WeightedConsistentEngine) AddNode(upstream *Upstream, weight int) {
 	w.mu.Lock()
@@ -129,6 +293,66 @@ func (w *WeightedConsistentEngine) RemoveNode(upstream *Upstream) {
 	w.indirection.RemoveNode(upstream)
 }
 
+// Size returns the number of live upstreams in the cluster.
+func (w *WeightedConsistentEngine) Size() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.indirection.Size()
+}
+
+// TotalWeight returns the sum of the effective (GCD-reduced) weights of
+// all live upstreams, which equals the number of virtual nodes in use.
+func (w *WeightedConsistentEngine) TotalWeight() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	total := 0
+	for _, weight := range w.indirection.GetWeights() {
+		total += weight
+	}
+	return total
+}
+
+// GetTopology returns the live upstreams with their effective
+// (GCD-reduced) weights.
+func (w *WeightedConsistentEngine) GetTopology() map[*Upstream]int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.indirection.GetWeights()
+}
+
+// GetMementoStats returns statistics about the engine's internal
+// structure, mirroring ConsistentEngine.GetMementoStats for the
+// weighted case: the virtual node (bucket) count, the size of the
+// removal history, and the topology size with its total weight.
+func (w *WeightedConsistentEngine) GetMementoStats() map[string]interface{} {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	totalWeight := 0
+	for _, weight := range w.indirection.GetWeights() {
+		totalWeight += weight
+	}
+	return map[string]interface{}{
+		"virtual_nodes":     w.memento.Size(),
+		"binomial_size":     w.memento.BinomialArraySize(),
+		"memento_size":      w.memento.MementoSize(),
+		"memento_empty":     w.memento.MementoEmpty(),
+		"last_removed":      w.memento.LastRemoved(),
+		"topology_size":     w.indirection.Size(),
+		"total_weight":      totalWeight,
+		"max_virtual_nodes": w.maxVirtualNodes,
+	}
+}
+
+// KeyShareEstimate samples sampleSize synthetic keys through Lookup and
+// returns the fraction of the keyspace each node currently owns, which
+// for a healthy cluster converges on each node's share of the total
+// weight. The sample keys are deterministic, so repeated calls on an
+// unchanged topology return identical shares. A non-positive sampleSize
+// uses the default sample size.
+func (w *WeightedConsistentEngine) KeyShareEstimate(sampleSize int) map[*Upstream]float64 {
+	return estimateKeyShares(w, sampleSize)
+}
+
 // UpdateWeight updates the weight of an existing node.
 func (w *WeightedConsistentEngine) UpdateWeight(upstream *Upstream, newWeight int) {
 	w.mu.Lock()
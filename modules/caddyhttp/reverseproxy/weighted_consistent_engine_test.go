@@ -328,3 +328,280 @@ func TestWCE_LoadBalancing(t *testing.T) {
 		t.Logf("Maximum load deviation (%.2f%%) is within the %.2f%% tolerance.", maxDeviation, tolerance)
 	}
 }
+
+// TestNormalizeWeights verifies GCD-based weight reduction.
+func TestNormalizeWeights(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []int
+		want []int
+	}{
+		{"reducible", []int{50, 30, 20}, []int{5, 3, 2}},
+		{"coprime", []int{7, 3}, []int{7, 3}},
+		{"zeros preserved", []int{40, 0, 20}, []int{2, 0, 1}},
+		{"single", []int{100}, []int{1}},
+		{"empty", []int{}, []int{}},
+	}
+	for _, tc := range cases {
+		got := NormalizeWeights(tc.in)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+// TestWCE_NormalizedInitCluster verifies that reducible weights allocate
+// proportionally fewer buckets while keeping the same distribution shape.
+func TestWCE_NormalizedInitCluster(t *testing.T) {
+	engine := NewWeightedConsistentEngine()
+	up1 := &Upstream{Dial: "node1"}
+	up2 := &Upstream{Dial: "node2"}
+	up3 := &Upstream{Dial: "node3"}
+	engine.InitCluster(map[*Upstream]int{up1: 50, up2: 30, up3: 20})
+
+	// 50+30+20 reduces to 5+3+2 = 10 buckets
+	if size := engine.memento.Size(); size != 10 {
+		t.Errorf("Expected 10 buckets after GCD reduction, got %d", size)
+	}
+
+	const numTestKeys = 10000
+	distribution := make(map[*Upstream]int)
+	for i := 0; i < numTestKeys; i++ {
+		key := fmt.Sprintf("192.168.1.%d:%d", i%256, i)
+		upstream, ok := engine.Lookup(key)
+		if !ok {
+			t.Fatalf("Lookup failed for key %s", key)
+		}
+		distribution[upstream]++
+	}
+	expectedShares := map[*Upstream]float64{up1: 0.5, up2: 0.3, up3: 0.2}
+	for upstream, expected := range expectedShares {
+		share := float64(distribution[upstream]) / numTestKeys
+		deviation := (share - expected) / expected * 100
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		if deviation > 15.0 {
+			t.Errorf("Node %s: share %.3f deviates %.2f%% from expected %.3f",
+				upstream.String(), share, deviation, expected)
+		}
+	}
+}
+
+// BenchmarkWCE_PathologicalWeights compares provisioning cost for large
+// proportional weights with and without GCD reduction. The "raw" case
+// adds buckets one weight unit at a time as AddNode does; the
+// "normalized" case goes through InitCluster, which reduces the weights
+// first.
+func BenchmarkWCE_PathologicalWeights(b *testing.B) {
+	weights := []int{50000, 30000, 20000}
+
+	b.Run("raw_add_node", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			engine := NewWeightedConsistentEngine()
+			for j, weight := range weights {
+				engine.AddNode(&Upstream{Dial: fmt.Sprintf("node%d", j)}, weight)
+			}
+		}
+	})
+
+	b.Run("normalized_init_cluster", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			engine := NewWeightedConsistentEngine()
+			nodesWithWeights := make(map[*Upstream]int, len(weights))
+			for j, weight := range weights {
+				nodesWithWeights[&Upstream{Dial: fmt.Sprintf("node%d", j)}] = weight
+			}
+			engine.InitCluster(nodesWithWeights)
+		}
+	})
+}
+
+// TestWCE_ZeroWeightInitCluster verifies that zero-weight entries own no
+// buckets and never win a lookup, while still counting as cluster members.
+func TestWCE_ZeroWeightInitCluster(t *testing.T) {
+	engine := NewWeightedConsistentEngine()
+	up1 := &Upstream{Dial: "node1"}
+	up2 := &Upstream{Dial: "node2"}
+	up3 := &Upstream{Dial: "node3"}
+	engine.InitCluster(map[*Upstream]int{
+		up1: 2,
+		up2: 0,
+		up3: 1,
+	})
+
+	if size := engine.Size(); size != 3 {
+		t.Errorf("Expected size 3, got %d", size)
+	}
+	if total := engine.TotalWeight(); total != 3 {
+		t.Errorf("Expected total weight 3, got %d", total)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if upstream, ok := engine.Lookup(key); !ok {
+			t.Fatalf("Lookup failed for key %s", key)
+		} else if upstream == up2 {
+			t.Fatalf("Key %s mapped to zero-weight upstream", key)
+		}
+	}
+}
+
+// TestWCE_DuplicateAddNode verifies that adding an already-known node is
+// a no-op and does not inflate the bucket count.
+func TestWCE_DuplicateAddNode(t *testing.T) {
+	engine := NewWeightedConsistentEngine()
+	up1 := &Upstream{Dial: "node1"}
+	up2 := &Upstream{Dial: "node2"}
+	engine.InitCluster(map[*Upstream]int{
+		up1: 2,
+		up2: 1,
+	})
+
+	before := engine.GetMementoStats()
+	engine.AddNode(up1, 5)
+	after := engine.GetMementoStats()
+
+	if engine.Size() != 2 {
+		t.Errorf("Expected size to stay 2, got %d", engine.Size())
+	}
+	if before["virtual_nodes"] != after["virtual_nodes"] {
+		t.Errorf("Expected virtual node count to stay %v, got %v",
+			before["virtual_nodes"], after["virtual_nodes"])
+	}
+	if weight := engine.GetTopology()[up1]; weight != 2 {
+		t.Errorf("Expected duplicate AddNode to keep weight 2, got %d", weight)
+	}
+}
+
+// TestWCE_RemoveUnknownNode verifies that removing an upstream that was
+// never added leaves the cluster untouched.
+func TestWCE_RemoveUnknownNode(t *testing.T) {
+	engine := NewWeightedConsistentEngine()
+	up1 := &Upstream{Dial: "node1"}
+	up2 := &Upstream{Dial: "node2"}
+	engine.InitCluster(map[*Upstream]int{
+		up1: 2,
+		up2: 1,
+	})
+
+	engine.RemoveNode(&Upstream{Dial: "stranger"})
+
+	if engine.Size() != 2 {
+		t.Errorf("Expected size to stay 2, got %d", engine.Size())
+	}
+	if engine.TotalWeight() != 3 {
+		t.Errorf("Expected total weight to stay 3, got %d", engine.TotalWeight())
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := engine.Lookup(fmt.Sprintf("key-%d", i)); !ok {
+			t.Fatal("Expected lookups to keep working after removing unknown node")
+		}
+	}
+}
+
+// TestWCE_StatsAndTopology verifies the introspection API against a
+// cluster that has seen a removal.
+func TestWCE_StatsAndTopology(t *testing.T) {
+	engine := NewWeightedConsistentEngine()
+	up1 := &Upstream{Dial: "node1"}
+	up2 := &Upstream{Dial: "node2"}
+	up3 := &Upstream{Dial: "node3"}
+	engine.InitCluster(map[*Upstream]int{
+		up1: 3,
+		up2: 2,
+		up3: 1,
+	})
+
+	topology := engine.GetTopology()
+	if len(topology) != 3 || topology[up1] != 3 || topology[up2] != 2 || topology[up3] != 1 {
+		t.Errorf("Unexpected topology: %v", topology)
+	}
+
+	stats := engine.GetMementoStats()
+	if stats["virtual_nodes"] != 6 {
+		t.Errorf("Expected 6 virtual nodes, got %v", stats["virtual_nodes"])
+	}
+	if stats["memento_empty"] != true {
+		t.Errorf("Expected empty removal history, got %v", stats["memento_empty"])
+	}
+
+	engine.RemoveNode(up2)
+
+	if engine.Size() != 2 {
+		t.Errorf("Expected size 2 after removal, got %d", engine.Size())
+	}
+	if engine.TotalWeight() != 4 {
+		t.Errorf("Expected total weight 4 after removal, got %d", engine.TotalWeight())
+	}
+	stats = engine.GetMementoStats()
+	if stats["virtual_nodes"] != 4 {
+		t.Errorf("Expected 4 virtual nodes after removal, got %v", stats["virtual_nodes"])
+	}
+	if stats["memento_size"] != 2 {
+		t.Errorf("Expected 2 tombstones after removal, got %v", stats["memento_size"])
+	}
+}
+
+// TestWCE_LookupBytesParity verifies the byte-slice lookup maps every
+// key exactly like the string lookup.
+func TestWCE_LookupBytesParity(t *testing.T) {
+	engine := NewWeightedConsistentEngine()
+	up1 := &Upstream{Dial: "node1"}
+	up2 := &Upstream{Dial: "node2"}
+	up3 := &Upstream{Dial: "node3"}
+	engine.InitCluster(map[*Upstream]int{up1: 3, up2: 1, up3: 2})
+
+	// a removal leaves memento history behind, so byte lookups also
+	// follow replacement chains
+	engine.RemoveNode(up2)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("parity-key-%d", i)
+		fromString, okString := engine.Lookup(key)
+		fromBytes, okBytes := engine.LookupBytes([]byte(key))
+		if okString != okBytes || fromString != fromBytes {
+			t.Fatalf("LookupBytes(%q) = (%v, %v), Lookup = (%v, %v)",
+				key, fromBytes, okBytes, fromString, okString)
+		}
+	}
+}
+
+// TestWCE_KeyShareEstimate verifies that the estimated key shares track
+// the configured weights and that the deterministic sample makes
+// consecutive estimates identical.
+func TestWCE_KeyShareEstimate(t *testing.T) {
+	engine := NewWeightedConsistentEngine()
+	up1 := &Upstream{Dial: "node1"}
+	up2 := &Upstream{Dial: "node2"}
+	up3 := &Upstream{Dial: "node3"}
+	engine.InitCluster(map[*Upstream]int{up1: 5, up2: 3, up3: 2})
+
+	shares := engine.KeyShareEstimate(10000)
+	expected := map[*Upstream]float64{up1: 0.5, up2: 0.3, up3: 0.2}
+	tolerance := 0.05
+	for upstream, want := range expected {
+		got := shares[upstream]
+		if got < want-tolerance || got > want+tolerance {
+			t.Errorf("Node %s: expected share around %.2f, got %.3f", upstream.String(), want, got)
+		}
+	}
+
+	// the sample is deterministic, so a second estimate on the same
+	// topology must match exactly
+	again := engine.KeyShareEstimate(10000)
+	for upstream, share := range shares {
+		if again[upstream] != share {
+			t.Errorf("Node %s: estimate jittered between calls: %.4f then %.4f",
+				upstream.String(), share, again[upstream])
+		}
+	}
+}
@@ -91,6 +91,20 @@ func (w *WeightedIndirection) GetWeight(upstream *Upstream) (int, bool) {
 	return weight, ok
 }
 
+// GetWeights returns a copy of the upstream-to-weight mapping.
+func (w *WeightedIndirection) GetWeights() map[*Upstream]int {
+	weights := make(map[*Upstream]int, len(w.weight))
+	for upstream, weight := range w.weight {
+		weights[upstream] = weight
+	}
+	return weights
+}
+
+// Size returns the number of upstreams in the indirection layer.
+func (w *WeightedIndirection) Size() int {
+	return len(w.weight)
+}
+
 // HasNode checks if an upstream exists in the indirection layer.
 func (w *WeightedIndirection) HasNode(upstream *Upstream) bool {
 	_, exists := w.weight[upstream]
@@ -120,3 +134,23 @@ func (w *WeightedIndirection) RemoveNode(upstream *Upstream) {
 func (w *WeightedIndirection) UpdateWeight(upstream *Upstream, newWeight int) {
 	w.weight[upstream] = newWeight
 }
+
+// Clone returns a copy of the indirection with the same mappings. The
+// upstream pointers are shared (they identify live hosts), but the
+// mapping state itself is independent of the original.
+func (w *WeightedIndirection) Clone() *WeightedIndirection {
+	clone := NewWeightedIndirection()
+	for bucketID, upstream := range w.bucketOwner {
+		clone.bucketOwner[bucketID] = upstream
+	}
+	for upstream, buckets := range w.nodeBuckets {
+		clone.nodeBuckets[upstream] = append([]int{}, buckets...)
+	}
+	for bucketID, pos := range w.nodeBucketPos {
+		clone.nodeBucketPos[bucketID] = pos
+	}
+	for upstream, weight := range w.weight {
+		clone.weight[upstream] = weight
+	}
+	return clone
+}
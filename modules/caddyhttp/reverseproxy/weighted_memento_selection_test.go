@@ -5,7 +5,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/caddyserver/caddy/v2"
 )
@@ -410,3 +416,363 @@ func (fs *failSelector) Select(pool UpstreamPool, r *http.Request, w http.Respon
 	fs.t.Fatal("Fallback selector was called unexpectedly. This indicates the primary lookup failed.")
 	return nil
 }
+
+// TestWeightedMementoSelectionMaxVirtualNodes verifies that provisioning
+// rejects weights that still exceed the virtual node cap after GCD
+// reduction, and that reducible weights provision fine.
+func TestWeightedMementoSelectionMaxVirtualNodes(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// {10000, 1} is coprime, so reduction can't help; with the default
+	// cap of 1024 virtual nodes this must fail
+	policy := &WeightedMementoSelection{Field: "ip", Weights: []int{10000, 1}}
+	if err := policy.Provision(ctx); err == nil {
+		t.Error("Expected provisioning coprime pathological weights to fail")
+	}
+
+	// {50000, 30000, 20000} reduces to {5, 3, 2} and provisions fine
+	policy = &WeightedMementoSelection{Field: "ip", Weights: []int{50000, 30000, 20000}}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if got := policy.Weights; got[0] != 5 || got[1] != 3 || got[2] != 2 {
+		t.Errorf("Expected weights reduced to {5 3 2}, got %v", got)
+	}
+
+	// an explicit cap can allow larger totals
+	policy = &WeightedMementoSelection{Field: "ip", Weights: []int{10000, 1}, MaxVirtualNodes: 20000}
+	if err := policy.Provision(ctx); err != nil {
+		t.Errorf("Expected a raised cap to allow the weights, got: %v", err)
+	}
+}
+
+// TestWeightedMementoSelectionTopologyReplace verifies that a
+// "topology_replace" event swaps the live set in one update: departed
+// nodes leave, joining nodes enter with their configured weights, and
+// keys owned by surviving nodes stay put.
+func TestWeightedMementoSelectionTopologyReplace(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	weights := []int{2, 2, 2, 2, 2, 3, 3}
+	pool := createWeightedPool(len(weights), weights)
+	policy := &WeightedMementoSelection{Field: "ip", Weights: weights}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.PopulateInitialTopology(pool)
+
+	// narrow the live set to the first five nodes
+	hosts := make([]string, 5)
+	for i := 0; i < 5; i++ {
+		hosts[i] = pool[i].Dial
+	}
+	event := caddy.Event{Data: map[string]any{"hosts": hosts}}
+	if err := policy.handleTopologyReplaceEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleTopologyReplaceEvent error: %v", err)
+	}
+	if got := policy.consistentEngine.Size(); got != 5 {
+		t.Fatalf("Expected 5 live nodes after the replace, got %d", got)
+	}
+
+	const numKeys = 200
+	before := make([]*Upstream, numKeys)
+	selectFor := func(i int) *Upstream {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.60.%d.%d:80", i/256, i%256)
+		host := policy.Select(pool, req, nil)
+		if host == nil {
+			t.Fatalf("Expected host selection for key %d", i)
+		}
+		return host
+	}
+	for i := 0; i < numKeys; i++ {
+		before[i] = selectFor(i)
+	}
+
+	// swap node 4 out and nodes 5-6 in as one event
+	newHosts := append(hosts[:4:4], pool[5].Dial, pool[6].Dial)
+	event = caddy.Event{Data: map[string]any{"hosts": newHosts}}
+	if err := policy.handleTopologyReplaceEvent(context.Background(), event); err != nil {
+		t.Fatalf("handleTopologyReplaceEvent error: %v", err)
+	}
+	if got := policy.consistentEngine.Size(); got != 6 {
+		t.Fatalf("Expected 6 live nodes after the swap, got %d", got)
+	}
+
+	// keys on the surviving nodes must not have moved to other
+	// survivors; keys from the departed node land on any live node
+	for i := 0; i < numKeys; i++ {
+		after := selectFor(i)
+		if after == pool[4] {
+			t.Fatalf("Key %d still maps to the departed node", i)
+		}
+		if before[i] != pool[4] && after != before[i] && after != pool[5] && after != pool[6] {
+			t.Errorf("Key %d moved between surviving nodes: %s to %s",
+				i, before[i].Dial, after.Dial)
+		}
+	}
+}
+
+// TestWeightedMementoSelectionValidateWeights covers the static weight
+// validation: an all-zero list is rejected, a partially-zero list is
+// allowed with a warning, and the weights list must line up with the
+// upstream count when one is configured.
+func TestWeightedMementoSelectionValidateWeights(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// all-zero weights would leave the engine empty
+	policy := &WeightedMementoSelection{Field: "ip", Weights: []int{0, 0, 0}}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if err := policy.Validate(); err == nil {
+		t.Error("Expected Validate to reject all-zero weights")
+	}
+
+	// no weights at all is fine: every upstream defaults to weight 1
+	policy = &WeightedMementoSelection{Field: "ip"}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if err := policy.Validate(); err != nil {
+		t.Errorf("Expected Validate to accept empty weights, got %v", err)
+	}
+
+	// a partially-zero list is a deliberate exclusion: accepted, but warned about
+	core, logs := observer.New(zapcore.WarnLevel)
+	policy = &WeightedMementoSelection{Field: "ip", Weights: []int{2, 0, 1}}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.logger = zap.New(core)
+	if err := policy.Validate(); err != nil {
+		t.Errorf("Expected Validate to accept partially-zero weights, got %v", err)
+	}
+	if logs.Len() != 1 {
+		t.Errorf("Expected 1 warning about zero weights, got %d", logs.Len())
+	}
+
+	// the weights list must match the upstream count exactly, or be absent
+	if err := policy.validatePoolSize(2); err == nil {
+		t.Error("Expected validatePoolSize to reject 3 weights for 2 upstreams")
+	}
+	if err := policy.validatePoolSize(3); err != nil {
+		t.Errorf("Expected validatePoolSize to accept 3 weights for 3 upstreams, got %v", err)
+	}
+	noWeights := &WeightedMementoSelection{Field: "ip"}
+	if err := noWeights.validatePoolSize(7); err != nil {
+		t.Errorf("Expected validatePoolSize to accept an empty weights list, got %v", err)
+	}
+}
+
+// TestWeightedMementoSelectionEmptyEngineWarning verifies that serving
+// with an empty topology logs a rate-limited warning, so an engine that
+// silently pushes everything down the fallback path is observable.
+func TestWeightedMementoSelectionEmptyEngineWarning(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	pool := createWeightedPool(3, nil)
+	policy := &WeightedMementoSelection{Field: "ip", Weights: []int{0, 0, 0}}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	core, logs := observer.New(zapcore.WarnLevel)
+	policy.logger = zap.New(core)
+	// zero weights add nothing, so the engine stays empty
+	policy.PopulateInitialTopology(pool)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.70.0.1:80"
+	if host := policy.Select(pool, req, nil); host == nil {
+		t.Fatal("Expected the fallback to select a host")
+	}
+	if logs.Len() != 1 {
+		t.Fatalf("Expected 1 empty-topology warning, got %d", logs.Len())
+	}
+
+	// immediately selecting again must not warn again (rate-limited)
+	if host := policy.Select(pool, req, nil); host == nil {
+		t.Fatal("Expected the fallback to select a host")
+	}
+	if logs.Len() != 1 {
+		t.Errorf("Expected the warning to be rate-limited, got %d entries", logs.Len())
+	}
+}
+
+// TestWeightedMementoSelectionKeyShares verifies that the sampled
+// key-share estimates in the topology report sum to ~1.0 and roughly
+// follow the configured weights.
+func TestWeightedMementoSelectionKeyShares(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	weights := []int{3, 1}
+	pool := createWeightedPool(len(weights), weights)
+	policy := &WeightedMementoSelection{Field: "ip", Weights: weights}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.PopulateInitialTopology(pool)
+
+	reports := policy.topologyStatus()
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 topology reports, got %d", len(reports))
+	}
+	totalShare := 0.0
+	shares := make(map[string]float64, len(reports))
+	for _, report := range reports {
+		totalShare += report.KeyShare
+		shares[report.Upstream] = report.KeyShare
+	}
+	if totalShare < 0.999 || totalShare > 1.001 {
+		t.Errorf("Expected key shares to sum to ~1.0, got %f", totalShare)
+	}
+	// weight 3 vs 1 should give roughly a 75/25 split
+	if share := shares[pool[0].Dial]; share < 0.65 || share > 0.85 {
+		t.Errorf("Expected ~0.75 share for the weight-3 node, got %f", share)
+	}
+	if share := shares[pool[1].Dial]; share < 0.15 || share > 0.35 {
+		t.Errorf("Expected ~0.25 share for the weight-1 node, got %f", share)
+	}
+}
+
+func TestWeightedMementoSelectionClientIPBareRequest(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	weights := []int{2, 1, 1}
+	pool := createWeightedPool(len(weights), weights)
+	policy := &WeightedMementoSelection{Field: "client_ip", Weights: weights}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	policy.PopulateInitialTopology(pool)
+
+	// a request with no vars map must fall back to RemoteAddr
+	// instead of panicking on the missing client IP var
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	host := policy.Select(pool, req, nil)
+	if host == nil {
+		t.Fatal("Expected a host to be selected from RemoteAddr")
+	}
+	if again := policy.Select(pool, req, nil); again != host {
+		t.Errorf("Expected the RemoteAddr fallback to be deterministic, got %s then %s", host, again)
+	}
+}
+
+// TestWeightedMementoSelectionConcurrentInitAndEvents hammers initial
+// population with concurrent health events, which used to double-add
+// virtual nodes when a healthy event slipped between InitCluster and
+// the topology map updates. Run with -race.
+func TestWeightedMementoSelectionConcurrentInitAndEvents(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	weights := []int{2, 1, 3, 1, 2}
+	pool := createWeightedPool(len(weights), weights)
+	policy := &WeightedMementoSelection{Field: "ip", Weights: weights}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		policy.PopulateInitialTopology(pool)
+	}()
+	for _, upstream := range pool {
+		wg.Add(1)
+		go func(dial string) {
+			defer wg.Done()
+			event := caddy.Event{Data: map[string]any{"host": dial}}
+			for i := 0; i < 50; i++ {
+				_ = policy.handleHealthyEvent(context.Background(), event)
+				_ = policy.handleUnhealthyEvent(context.Background(), event)
+				_ = policy.handleHealthyEvent(context.Background(), event)
+			}
+		}(upstream.Dial)
+	}
+	wg.Wait()
+
+	// every per-host goroutine ended on a healthy event, so the engine
+	// must hold each upstream exactly once at its configured weight
+	if size := policy.consistentEngine.Size(); size != len(pool) {
+		t.Errorf("Expected %d nodes in the engine, got %d", len(pool), size)
+	}
+	totalWeight := 0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+	if got := policy.consistentEngine.TotalWeight(); got != totalWeight {
+		t.Errorf("Expected total weight %d (no duplicate virtual nodes), got %d", totalWeight, got)
+	}
+	topology := policy.consistentEngine.GetTopology()
+	for i, upstream := range pool {
+		if got := topology[upstream]; got != weights[i] {
+			t.Errorf("Expected weight %d for %s, got %d", weights[i], upstream.Dial, got)
+		}
+	}
+}
+
+// TestWeightedMementoSelectionPlaceholderWeights verifies that weights
+// can come from placeholders and that a mid-run change is applied
+// through the engine's runtime weight-update path.
+func TestWeightedMementoSelectionPlaceholderWeights(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	t.Setenv("WM_WEIGHT_A", "3")
+	t.Setenv("WM_WEIGHT_B", "1")
+
+	policy := &WeightedMementoSelection{
+		Field:              "ip",
+		WeightPlaceholders: []string{"{env.WM_WEIGHT_A}", "{env.WM_WEIGHT_B}"},
+		ReresolveInterval:  caddy.Duration(10 * time.Millisecond),
+	}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	pool := createWeightedPool(2, []int{3, 1})
+	policy.PopulateInitialTopology(pool)
+
+	if got := policy.consistentEngine.TotalWeight(); got != 4 {
+		t.Errorf("Expected total weight 4 from resolved placeholders, got %d", got)
+	}
+	if got := policy.consistentEngine.GetTopology()[pool[0]]; got != 3 {
+		t.Errorf("Expected weight 3 for the first upstream, got %d", got)
+	}
+
+	// a mid-run change takes effect after the interval
+	t.Setenv("WM_WEIGHT_A", "2")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if policy.consistentEngine.GetTopology()[pool[0]] == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Weight change was not applied within the deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := policy.consistentEngine.TotalWeight(); got != 3 {
+		t.Errorf("Expected total weight 3 after the change, got %d", got)
+	}
+
+	// an invalid value keeps the previous weight instead of dropping
+	// the node
+	t.Setenv("WM_WEIGHT_B", "bogus")
+	time.Sleep(50 * time.Millisecond)
+	if got := policy.consistentEngine.GetTopology()[pool[1]]; got != 1 {
+		t.Errorf("Expected the invalid weight to keep its previous value 1, got %d", got)
+	}
+	if size := policy.consistentEngine.Size(); size != 2 {
+		t.Errorf("Expected both nodes to remain in the engine, got %d", size)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// ZoneAwareSelection is a composite policy that keeps traffic inside
+// the proxy's own zone when it can: the inner policy first runs over
+// the upstreams whose Zone matches local_zone, and only when that
+// subset has fewer than min_zone_hosts available members does it run
+// over the full pool. Deployments that pay for cross-zone traffic get
+// zone locality without giving up the inner policy's semantics.
+//
+// When the inner policy keeps a consistent topology (the memento
+// policies), the local zone gets its own instance seeded with only the
+// zone's members, so a topology change inside the zone still moves the
+// minimal number of keys; the full-pool instance serves the spill
+// path, so spilled keys also land consistently.
+type ZoneAwareSelection struct {
+	// The zone this Caddy instance runs in, matched against each
+	// upstream's `zone`. Placeholders are supported, so the zone can
+	// come from the environment, e.g. "{env.AVAILABILITY_ZONE}".
+	LocalZone string `json:"local_zone,omitempty"`
+
+	// The minimum number of available local-zone upstreams required
+	// to keep a selection local; below it the inner policy runs over
+	// the full pool. Default is 1.
+	MinZoneHosts int `json:"min_zone_hosts,omitempty"`
+
+	// The selection policy to run over the chosen subset.
+	// Defaults to `random`.
+	PolicyRaw json.RawMessage `json:"policy,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+
+	policy     Selector        // runs over the full pool on the spill path
+	zonePolicy Selector        // per-zone instance for topology-keeping inner policies
+	rawPolicy  json.RawMessage // kept so the local-zone instance can be loaded at topology init
+	localZone  string          // LocalZone with placeholders resolved
+
+	ctx       caddy.Context
+	events    *caddyevents.App
+	logger    *zap.Logger
+	handlerID string // owning handler's identity, forwarded to both inner instances
+}
+
+// CaddyModule returns the Caddy module information.
+func (ZoneAwareSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.zone_aware",
+		New: func() caddy.Module { return new(ZoneAwareSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *ZoneAwareSelection) Provision(ctx caddy.Context) error {
+	s.ctx = ctx
+	s.logger = ctx.Logger()
+	s.localZone = caddy.NewReplacer().ReplaceAll(s.LocalZone, "")
+	if s.localZone == "" {
+		return fmt.Errorf("local_zone is required (a zone name or a placeholder such as {env.AVAILABILITY_ZONE})")
+	}
+	if s.MinZoneHosts < 0 {
+		return fmt.Errorf("min_zone_hosts must be positive, got %d", s.MinZoneHosts)
+	}
+	if s.MinZoneHosts == 0 {
+		s.MinZoneHosts = 1
+	}
+	if s.PolicyRaw == nil {
+		s.PolicyRaw = caddyconfig.JSONModuleObject(RandomSelection{}, "policy", "random", nil)
+	}
+	// LoadModule nils out the raw config; keep a copy so the
+	// local-zone instance can be loaded once the topology is known
+	s.rawPolicy = append(json.RawMessage(nil), s.PolicyRaw...)
+	mod, err := ctx.LoadModule(s, "PolicyRaw")
+	if err != nil {
+		return fmt.Errorf("loading inner selection policy: %v", err)
+	}
+	s.policy = mod.(Selector)
+	return nil
+}
+
+// Select returns an available host, if any: one from the local zone
+// while it has at least min_zone_hosts available members, otherwise
+// whatever the inner policy picks from the full pool.
+func (s *ZoneAwareSelection) Select(pool UpstreamPool, req *http.Request, w http.ResponseWriter) *Upstream {
+	local := make(UpstreamPool, 0, len(pool))
+	available := 0
+	for _, upstream := range pool {
+		if upstream == nil || upstream.Zone != s.localZone {
+			continue
+		}
+		local = append(local, upstream)
+		if upstream.Available() {
+			available++
+		}
+	}
+	if available >= s.MinZoneHosts {
+		policy := s.zonePolicy
+		if policy == nil {
+			policy = s.policy
+		}
+		if upstream := policy.Select(local, req, w); upstream != nil {
+			return upstream
+		}
+	}
+	return s.policy.Select(pool, req, w)
+}
+
+// SetEventsApp propagates the events app to the inner policy; the
+// local-zone instance, created later at topology init, gets it then.
+func (s *ZoneAwareSelection) SetEventsApp(events *caddyevents.App) {
+	s.events = events
+	if aware, ok := s.policy.(EventsAware); ok {
+		aware.SetEventsApp(events)
+	}
+}
+
+// setHandlerIdentity propagates the owning handler's identity to the
+// inner policy, and remembers it for the local-zone instance created
+// later at topology init.
+func (s *ZoneAwareSelection) setHandlerIdentity(id string) {
+	s.handlerID = id
+	if aware, ok := s.policy.(handlerIdentityAware); ok {
+		aware.setHandlerIdentity(id)
+	}
+}
+
+// PopulateInitialTopology seeds the inner policy with the full pool
+// and, when the inner policy keeps a topology, builds the local zone's
+// own instance seeded with only the zone's members.
+func (s *ZoneAwareSelection) PopulateInitialTopology(upstreams []*Upstream) {
+	initializer, keepsTopology := s.policy.(TopologyInitializer)
+	if keepsTopology {
+		initializer.PopulateInitialTopology(upstreams)
+	}
+	if !keepsTopology {
+		// a stateless inner policy selects over whatever subset it
+		// is handed, so one shared instance serves both paths
+		return
+	}
+
+	local := make([]*Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream != nil && upstream.Zone == s.localZone {
+			local = append(local, upstream)
+		}
+	}
+	if len(local) == 0 {
+		if s.logger != nil {
+			s.logger.Warn("no configured upstream is in the local zone; every selection will use the full pool",
+				zap.String("local_zone", s.localZone))
+		}
+		return
+	}
+
+	zonePolicy, err := loadInlineSelector(s.ctx, s.rawPolicy)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Error("loading local-zone instance of the inner policy; falling back to the shared instance",
+				zap.String("local_zone", s.localZone),
+				zap.Error(err))
+		}
+		return
+	}
+	if aware, ok := zonePolicy.(handlerIdentityAware); ok {
+		aware.setHandlerIdentity(s.handlerID)
+	}
+	if aware, ok := zonePolicy.(EventsAware); ok {
+		aware.SetEventsApp(s.events)
+	}
+	if initializer, ok := zonePolicy.(TopologyInitializer); ok {
+		initializer.PopulateInitialTopology(local)
+	}
+	s.zonePolicy = zonePolicy
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy zone_aware [<local_zone>] {
+//		local_zone <zone>
+//		min_zone_hosts <n>
+//		policy <policy>
+//	}
+func (s *ZoneAwareSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+
+	if d.NextArg() {
+		s.LocalZone = d.Val()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "local_zone":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.LocalZone = d.Val()
+		case "min_zone_hosts":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid min_zone_hosts '%s': %v", d.Val(), err)
+			}
+			s.MinZoneHosts = n
+		case "policy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.PolicyRaw != nil {
+				return d.Err("inner policy already specified")
+			}
+			mod, err := loadFallbackPolicy(d)
+			if err != nil {
+				return err
+			}
+			s.PolicyRaw = mod
+		default:
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*ZoneAwareSelection)(nil)
+	_ Selector              = (*ZoneAwareSelection)(nil)
+	_ caddyfile.Unmarshaler = (*ZoneAwareSelection)(nil)
+	_ EventsAware           = (*ZoneAwareSelection)(nil)
+	_ TopologyInitializer   = (*ZoneAwareSelection)(nil)
+	_ handlerIdentityAware  = (*ZoneAwareSelection)(nil)
+)
@@ -0,0 +1,225 @@
+// Copyright 2024 Massimo Saia and The Caddy Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// zonedPool returns two healthy upstreams in zone "a" followed by two
+// in zone "b".
+func zonedPool() UpstreamPool {
+	pool := make(UpstreamPool, 0, 4)
+	for i, zone := range []string{"a", "a", "b", "b"} {
+		pool = append(pool, &Upstream{
+			Host: new(Host),
+			Dial: fmt.Sprintf("localhost:%d", 8080+i),
+			Zone: zone,
+		})
+	}
+	return pool
+}
+
+func TestZoneAwareKeepsTrafficLocal(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := ZoneAwareSelection{LocalZone: "a"}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := zonedPool()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	for i := 0; i < 50; i++ {
+		upstream := policy.Select(pool, req, nil)
+		if upstream == nil {
+			t.Fatal("Expected a selection with the local zone healthy")
+		}
+		if upstream.Zone != "a" {
+			t.Fatalf("Expected all traffic in zone a, got %s (%s)", upstream.Zone, upstream.Dial)
+		}
+	}
+}
+
+func TestZoneAwareSpillsWhenZoneEmpty(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := ZoneAwareSelection{LocalZone: "a"}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := zonedPool()
+	pool[0].setHealthy(false)
+	pool[1].setHealthy(false)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	for i := 0; i < 50; i++ {
+		upstream := policy.Select(pool, req, nil)
+		if upstream == nil {
+			t.Fatal("Expected a selection from the remote zone")
+		}
+		if upstream.Zone != "b" {
+			t.Fatalf("Expected spill to zone b with zone a down, got %s (%s)", upstream.Zone, upstream.Dial)
+		}
+	}
+
+	// the local zone recovering pulls traffic back
+	pool[0].setHealthy(true)
+	pool[1].setHealthy(true)
+	if upstream := policy.Select(pool, req, nil); upstream == nil || upstream.Zone != "a" {
+		t.Errorf("Expected traffic back in zone a after recovery, got %v", upstream)
+	}
+}
+
+func TestZoneAwareMinZoneHosts(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := ZoneAwareSelection{
+		LocalZone:    "a",
+		MinZoneHosts: 2,
+		PolicyRaw:    caddyconfig.JSONModuleObject(FirstSelection{}, "policy", "first", nil),
+	}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	// remote host first in pool order, so the spill path is visible
+	pool := UpstreamPool{
+		{Host: new(Host), Dial: "localhost:8082", Zone: "b"},
+		{Host: new(Host), Dial: "localhost:8080", Zone: "a"},
+		{Host: new(Host), Dial: "localhost:8081", Zone: "a"},
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	if upstream := policy.Select(pool, req, nil); upstream == nil || upstream.Dial != "localhost:8080" {
+		t.Errorf("Expected the first local host with the zone at strength, got %v", upstream)
+	}
+
+	// one local host down leaves the zone below min_zone_hosts
+	pool[2].setHealthy(false)
+	if upstream := policy.Select(pool, req, nil); upstream == nil || upstream.Dial != "localhost:8082" {
+		t.Errorf("Expected the full-pool selection below min_zone_hosts, got %v", upstream)
+	}
+}
+
+func TestZoneAwareMementoPerZoneTopology(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	policy := ZoneAwareSelection{
+		LocalZone: "a",
+		PolicyRaw: caddyconfig.JSONModuleObject(MementoSelection{Field: "ip"}, "policy", "memento", nil),
+	}
+	if err := policy.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+
+	pool := zonedPool()
+	policy.PopulateInitialTopology(pool)
+	if policy.zonePolicy == nil {
+		t.Fatal("Expected a local-zone instance for a topology-keeping inner policy")
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "172.0.0.1:80"
+
+	// a key maps to a local member, stably
+	first := policy.Select(pool, req, nil)
+	if first == nil || first.Zone != "a" {
+		t.Fatalf("Expected the key's owner in zone a, got %v", first)
+	}
+	for i := 0; i < 20; i++ {
+		if upstream := policy.Select(pool, req, nil); upstream != first {
+			t.Fatalf("Expected a stable owner for the key, got %s then %v", first.Dial, upstream)
+		}
+	}
+
+	// with the local zone dark, the same key spills to a remote member
+	pool[0].setHealthy(false)
+	pool[1].setHealthy(false)
+	spilled := policy.Select(pool, req, nil)
+	if spilled == nil || spilled.Zone != "b" {
+		t.Fatalf("Expected spill to zone b with zone a down, got %v", spilled)
+	}
+
+	// recovery restores the original owner: the zone engine's
+	// topology never changed, so no keys moved inside the zone
+	pool[0].setHealthy(true)
+	pool[1].setHealthy(true)
+	if upstream := policy.Select(pool, req, nil); upstream != first {
+		t.Errorf("Expected the original owner after recovery, got %v", upstream)
+	}
+}
+
+func TestZoneAwareProvision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	missing := ZoneAwareSelection{}
+	if err := missing.Provision(ctx); err == nil {
+		t.Error("Expected an error without a local_zone")
+	}
+	negative := ZoneAwareSelection{LocalZone: "a", MinZoneHosts: -1}
+	if err := negative.Provision(ctx); err == nil {
+		t.Error("Expected an error for a negative min_zone_hosts")
+	}
+
+	t.Setenv("TEST_ZONE_AWARE_ZONE", "us-east-1a")
+	fromEnv := ZoneAwareSelection{LocalZone: "{env.TEST_ZONE_AWARE_ZONE}"}
+	if err := fromEnv.Provision(ctx); err != nil {
+		t.Fatalf("Provision error: %v", err)
+	}
+	if fromEnv.localZone != "us-east-1a" {
+		t.Errorf("Expected the zone from the environment, got '%s'", fromEnv.localZone)
+	}
+}
+
+func TestZoneAwareCaddyfile(t *testing.T) {
+	policy := ZoneAwareSelection{}
+	if err := policy.UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"zone_aware us-east-1a {\n\tmin_zone_hosts 2\n\tpolicy least_conn\n}")); err != nil {
+		t.Fatalf("UnmarshalCaddyfile error: %v", err)
+	}
+	if policy.LocalZone != "us-east-1a" {
+		t.Errorf("Expected local_zone us-east-1a, got '%s'", policy.LocalZone)
+	}
+	if policy.MinZoneHosts != 2 {
+		t.Errorf("Expected min_zone_hosts 2, got %d", policy.MinZoneHosts)
+	}
+	if policy.PolicyRaw == nil {
+		t.Error("Expected an inner policy config")
+	}
+
+	if err := (&ZoneAwareSelection{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(
+		"zone_aware {\n\tmax_zone_hosts 2\n}")); err == nil {
+		t.Error("Expected an error for an unrecognized option")
+	}
+}